@@ -0,0 +1,66 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strings"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+// queuePackage is used to filter goroutines created by the queue.
+const queuePackage = "github.com/gyuho/dplearn/pkg/etcd-queue."
+
+// NewDiagHandler returns the diagnostics handler, serving pprof, expvar,
+// goroutine dump of queue internals, active queue watchers, and item
+// search (e.g. "/debug/queue/search?q=status=failed AND created>-24h"),
+// with liveness and readiness checks ("/healthz" and "/readyz").
+// It is opt-in, and must not be exposed publicly.
+func NewDiagHandler(qu queue.Queue) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.Handle("/readyz", readyzHandler(qu))
+
+	mux.HandleFunc("/debug/queue/goroutines", func(w http.ResponseWriter, req *http.Request) {
+		buf := new(bytes.Buffer)
+		if err := runtimepprof.Lookup("goroutine").WriteTo(buf, 2); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var stacks []string
+		for _, st := range strings.Split(buf.String(), "\n\n") {
+			if strings.Contains(st, queuePackage) {
+				stacks = append(stacks, st)
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "queue goroutines: %d (total %d)\n\n", len(stacks), runtime.NumGoroutine())
+		fmt.Fprint(w, strings.Join(stacks, "\n\n"))
+	})
+	mux.HandleFunc("/debug/queue/watchers", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(qu.Watchers())
+	})
+	mux.HandleFunc("/debug/queue/search", func(w http.ResponseWriter, req *http.Request) {
+		entries, err := qu.Search(req.Context(), req.URL.Query().Get("q"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+	return mux
+}
@@ -0,0 +1,109 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func TestDiagHandler(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := queue.NewEmbeddedQueue(context.Background(), 24379, 24380, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	qu.Watch(queue.WithConsumer(ctx, "test"), "/cats-request")
+
+	srv := httptest.NewServer(NewDiagHandler(qu))
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/debug/queue/watchers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st queue.WatcherStats
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Watchers) != 1 || st.Watchers[0].Key != queue.PendingPrefix("cats-request") || st.Watchers[0].Consumer != "test" {
+		t.Fatalf("unexpected watchers %+v", st)
+	}
+
+	resp, err = srv.Client().Get(srv.URL + "/debug/queue/goroutines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "queue goroutines: ") || !strings.Contains(string(b), queuePackage) {
+		t.Fatalf("unexpected goroutine dump %q", b)
+	}
+
+	item := queue.CreateItem("/cats-request", 100, "data")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = srv.Client().Get(srv.URL + "/debug/queue/search?q=" + url.QueryEscape("bucket=cats* AND status=pending"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []*queue.IndexEntry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Item.Key != item.Key {
+		t.Fatalf("unexpected search results %+v", entries)
+	}
+
+	resp, err = srv.Client().Get(srv.URL + "/debug/queue/search?q=" + url.QueryEscape("created>=yesterday"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	for path, expected := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusOK} {
+		resp, err = srv.Client().Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rd queue.Readiness
+		err = json.NewDecoder(resp.Body).Decode(&rd)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != expected {
+			t.Fatalf("%q: expected %d, got %d", path, expected, resp.StatusCode)
+		}
+		if path == "/readyz" && (!rd.Ready || len(rd.Checks) == 0) {
+			t.Fatalf("unexpected readiness %+v", rd)
+		}
+	}
+}
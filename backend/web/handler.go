@@ -2,6 +2,7 @@ package web
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,6 +25,7 @@ import (
 
 	humanize "github.com/dustin/go-humanize"
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Server warps http.Server.
@@ -54,6 +57,12 @@ func with(h ContextHandler, srv *Server, qu queue.Queue, cache lru.Cache) Contex
 		ctx = context.WithValue(ctx, queueKey, qu)
 		ctx = context.WithValue(ctx, cacheKey, cache)
 		ctx = context.WithValue(ctx, userKey, generateUserID(req))
+		if token := bearerToken(req); token != "" {
+			ctx = queue.WithIdentity(ctx, queue.TokenIdentity(token))
+		}
+		if id := req.Header.Get(WorkerIDHeader); id != "" {
+			ctx = queue.WithWorker(ctx, id)
+		}
 		return h.ServeHTTPContext(ctx, w, req)
 	})
 }
@@ -63,10 +72,28 @@ const (
 
 	// RequestIDHeader is the field name for request ID header.
 	RequestIDHeader = "Request-Id"
+
+	// WorkerIDHeader is the field name for the ID of the worker popping
+	// items, to route items with affinity to the worker.
+	WorkerIDHeader = "Worker-Id"
 )
 
 // StartServer starts a backend webserver with stoppable listener.
 func StartServer(scheme, hostPort string, qu queue.Queue) (*Server, error) {
+	return startServer(scheme, hostPort, qu, nil)
+}
+
+// StartTLSServer starts a backend webserver over TLS. Clients must
+// present certificates, if required by the configuration (see
+// 'tlsutil.Reloader.ServerConfig').
+func StartTLSServer(hostPort string, qu queue.Queue, tlsCfg *tls.Config) (*Server, error) {
+	if tlsCfg == nil {
+		return nil, fmt.Errorf("no TLS configuration")
+	}
+	return startServer("https", hostPort, qu, tlsCfg)
+}
+
+func startServer(scheme, hostPort string, qu queue.Queue, tlsCfg *tls.Config) (*Server, error) {
 	rootCtx, rootCancel := context.WithCancel(context.Background())
 	mux := http.NewServeMux()
 	webURL := url.URL{Scheme: scheme, Host: hostPort}
@@ -74,7 +101,7 @@ func StartServer(scheme, hostPort string, qu queue.Queue) (*Server, error) {
 		rootCtx:    rootCtx,
 		rootCancel: rootCancel,
 		webURL:     webURL,
-		httpServer: &http.Server{Addr: webURL.Host, Handler: mux},
+		httpServer: &http.Server{Addr: webURL.Host, Handler: mux, TLSConfig: tlsCfg},
 		qu:         qu,
 		donec:      make(chan struct{}),
 	}
@@ -82,18 +109,29 @@ func StartServer(scheme, hostPort string, qu queue.Queue) (*Server, error) {
 	cache := lru.NewInMemory(imageCacheSize)
 	cache.CreateNamespace(imageCacheBucket)
 
-	mux.Handle("/healthz", &ContextAdapter{
-		ctx: rootCtx,
-		handler: ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
-			w.WriteHeader(200)
-			w.Write([]byte("OK"))
-			return nil
-		}),
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.Handle("/readyz", readyzHandler(qu))
+	mux.Handle("/openapi.json", &ContextAdapter{
+		ctx:     rootCtx,
+		handler: ContextHandlerFunc(openAPIHandler),
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/alert-rules", &ContextAdapter{
+		ctx:     rootCtx,
+		handler: ContextHandlerFunc(alertRulesHandler),
 	})
 	mux.Handle("/cats-request", &ContextAdapter{
 		ctx:     rootCtx,
 		handler: with(ContextHandlerFunc(clientRequestHandler), srv, qu, cache),
 	})
+	mux.Handle("/cats-request/watch", &ContextAdapter{
+		ctx:     rootCtx,
+		handler: with(ContextHandlerFunc(watchHandler), srv, qu, cache),
+	})
+	mux.Handle("/cats-request/value", &ContextAdapter{
+		ctx:     rootCtx,
+		handler: with(ContextHandlerFunc(valueHandler), srv, qu, cache),
+	})
 	mux.Handle("/cats-request/queue", &ContextAdapter{
 		ctx:     rootCtx,
 		handler: with(ContextHandlerFunc(queueHandler), srv, qu, cache),
@@ -112,7 +150,12 @@ func StartServer(scheme, hostPort string, qu queue.Queue) (*Server, error) {
 		}()
 
 		glog.Infof("starting server %q", srv.webURL.String())
-		if err := srv.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		serve := srv.httpServer.ListenAndServe
+		if tlsCfg != nil {
+			// certificates are provided by the configuration
+			serve = func() error { return srv.httpServer.ListenAndServeTLS("", "") }
+		}
+		if err := serve(); err != nil && err != http.ErrServerClosed {
 			glog.Fatal(err)
 		}
 
@@ -192,6 +235,16 @@ func (srv *Server) StopNotify() <-chan struct{} {
 	return srv.donec
 }
 
+// bearerToken returns the API token of 'Authorization: Bearer <token>',
+// whose hash is the identity for queue ACLs (see 'queue.TokenIdentity').
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
+
 func queueHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
 	reqPath := req.URL.Path
 	bucket := path.Dir(reqPath)
@@ -224,8 +277,28 @@ func queueHandler(ctx context.Context, w http.ResponseWriter, req *http.Request)
 		if !ok {
 			return json.NewEncoder(w).Encode(&queue.Item{Bucket: bucket, Progress: 0, Error: fmt.Sprintf("unknown request ID %q", item.RequestID)})
 		}
+		if item.Progress > 0 && item.Progress < queue.MaxProgress {
+			// progress of child items is aggregated into their parents
+			if err = qu.UpdateProgress(ctx, &item); err != nil {
+				if queue.IsInvalidTransition(err) {
+					return json.NewEncoder(w).Encode(&queue.Item{Bucket: bucket, Progress: 0, Error: err.Error()})
+				}
+				glog.Warningf("failed to update progress of %q (%v)", item.Key, err)
+			}
+		}
 		srv.requestCache.Store(item.RequestID, item)
 
+		if item.Progress == queue.MaxProgress || item.Canceled || item.Error != "" {
+			// workers may post the finished item more than once
+			if err = qu.Complete(ctx, &item); err != nil && err != queue.ErrAlreadyCompleted {
+				glog.Warningf("failed to complete %q (%v)", item.Key, err)
+				if queue.IsAccessDenied(err) {
+					w.WriteHeader(http.StatusForbidden)
+					return json.NewEncoder(w).Encode(&queue.Item{Bucket: bucket, Progress: 0, Error: err.Error()})
+				}
+			}
+		}
+
 		glog.Infof("queue received POST on %q", item.RequestID)
 		return json.NewEncoder(w).Encode(&item)
 
@@ -235,6 +308,36 @@ func queueHandler(ctx context.Context, w http.ResponseWriter, req *http.Request)
 	return nil
 }
 
+// itemStatus is the item with its estimated time to complete,
+// so that frontend can show the remaining time.
+type itemStatus struct {
+	*queue.Item
+	ETA *queue.Estimate `json:"eta,omitempty"`
+}
+
+func itemStatusOf(ctx context.Context, qu queue.Queue, item *queue.Item) itemStatus {
+	st := itemStatus{Item: item}
+	if item == nil || item.Key == "" || item.Error != "" || item.Canceled || item.Progress >= queue.MaxProgress {
+		return st
+	}
+	// sharded jobs have the aggregated progress of their child items
+	if ent, err := qu.Get(ctx, item.Key); err == nil && ent.Item.Progress > item.Progress && ent.Item.Progress < queue.MaxProgress {
+		copied := *item
+		copied.Progress = ent.Item.Progress
+		st.Item = &copied
+	}
+	est, err := qu.ETA(ctx, item)
+	if err != nil {
+		// the item may be purged, before the cache is updated
+		glog.V(2).Infof("failed to estimate %q (%v)", item.Key, err)
+		return st
+	}
+	if est.Samples > 0 {
+		st.ETA = &est
+	}
+	return st
+}
+
 // Request defines requests from frontend.
 type Request struct {
 	DataFromFrontend string `json:"data_from_frontend"`
@@ -262,7 +365,14 @@ func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.
 			glog.Warning(err)
 			return json.NewEncoder(w).Encode(&queue.Item{Bucket: reqPath, Progress: 0, Error: err.Error()})
 		}
-		return json.NewEncoder(w).Encode(vi)
+		var item *queue.Item
+		switch v := vi.(type) {
+		case *queue.Item:
+			item = v
+		case queue.Item:
+			item = &v
+		}
+		return json.NewEncoder(w).Encode(itemStatusOf(ctx, qu, item))
 
 	case http.MethodPost: // item creation/cancel
 		rb, err := ioutil.ReadAll(req.Body)
@@ -312,11 +422,25 @@ func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.
 				return json.NewEncoder(w).Encode(v)
 			}
 
-			item := queue.CreateItem(reqPath, 100, creq.DataFromFrontend)
+			// interactive user requests preempt low-priority background jobs
+			var item *queue.Item
+			item, err = queue.CreateItemWithPriority(reqPath, queue.PriorityUrgent, creq.DataFromFrontend)
+			if err != nil {
+				glog.Warning(err)
+				return json.NewEncoder(w).Encode(&queue.Item{Bucket: reqPath, Progress: 0, Error: err.Error()})
+			}
 			item.RequestID = requestID
+			item.Owner = userID
+			// frontend data is plain text (image URL, question or sentence)
+			item.ContentType = queue.ContentTypeText
+			// concurrent requests of the same job share one item
+			item.IdempotencyKey = requestID
 
 			if err = qu.Add(ctx, item, queue.WithTTL(enqueueTTL)); err != nil {
 				glog.Warning(err)
+				if queue.IsAccessDenied(err) {
+					w.WriteHeader(http.StatusForbidden)
+				}
 				return json.NewEncoder(w).Encode(&queue.Item{Bucket: reqPath, Progress: 0, Error: err.Error()})
 			}
 			srv.requestCache.Store(requestID, item)
@@ -178,3 +178,23 @@ func TestServer(t *testing.T) {
 		t.Fatal("took too long to shut down")
 	}
 }
+
+func TestWithTokenIdentity(t *testing.T) {
+	var identity string
+	h := with(ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+		identity = queue.IdentityFrom(ctx)
+		return nil
+	}), nil, nil, nil)
+
+	req, err := http.NewRequest(http.MethodPost, "/cats-request/queue", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer s3cr3t-t0ken")
+	if err = h.ServeHTTPContext(context.Background(), nil, req); err != nil {
+		t.Fatal(err)
+	}
+	if identity != queue.TokenIdentity("s3cr3t-t0ken") || strings.Contains(identity, "s3cr3t") {
+		t.Fatalf("expected hashed token identity, got %q", identity)
+	}
+}
@@ -0,0 +1,28 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+// healthzHandler reports the liveness of the process, independent
+// of its dependencies.
+func healthzHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+// readyzHandler reports the readiness of the queue with the result
+// of each check, and 503 if any check fails (see 'queue.CheckReady').
+func readyzHandler(qu queue.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rd := queue.CheckReady(req.Context(), qu)
+		w.Header().Set("Content-Type", "application/json")
+		if !rd.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(rd)
+	}
+}
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+// alertRulesHandler serves suggested Prometheus alerting rules.
+// Thresholds can be overridden with 'max-pending', 'max-oldest-age',
+// 'max-claim-latency' and 'for' query parameters.
+func alertRulesHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	switch req.Method {
+	case http.MethodGet:
+		var cfg queue.AlertRulesConfig
+		q := req.URL.Query()
+		if v := q.Get("max-pending"); v != "" {
+			var n int64
+			if _, err := fmt.Sscanf(v, "%d", &n); err != nil {
+				http.Error(w, fmt.Sprintf("invalid max-pending %q", v), http.StatusBadRequest)
+				return nil
+			}
+			cfg.MaxPending = n
+		}
+		for _, p := range []struct {
+			name string
+			d    *time.Duration
+		}{
+			{"max-oldest-age", &cfg.MaxOldestAge},
+			{"max-claim-latency", &cfg.MaxClaimLatency},
+			{"for", &cfg.For},
+		} {
+			v := q.Get(p.name)
+			if v == "" {
+				continue
+			}
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s %q (%v)", p.name, v, err), http.StatusBadRequest)
+				return nil
+			}
+			*p.d = d
+		}
+
+		rules, err := queue.AlertRules(cfg)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/x-yaml")
+		w.Write(rules)
+	default:
+		http.Error(w, "Method Not Allowed", 405)
+	}
+	return nil
+}
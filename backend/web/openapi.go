@@ -0,0 +1,199 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+// apiOperation describes an HTTP handler operation for OpenAPI document.
+type apiOperation struct {
+	path        string
+	method      string
+	operationID string
+	summary     string
+	headers     []string
+	request     interface{}
+	response    interface{}
+}
+
+// apiOperations lists queue-facing handlers served by StartServer.
+var apiOperations = []apiOperation{
+	{
+		path:        "/cats-request",
+		method:      http.MethodPost,
+		operationID: "enqueue",
+		summary:     "Creates an item with 'create_request' true, or cancels the request with 'create_request' false.",
+		request:     Request{},
+		response:    queue.Item{},
+	},
+	{
+		path:        "/cats-request",
+		method:      http.MethodGet,
+		operationID: "status",
+		summary:     "Returns the latest status of the request.",
+		headers:     []string{RequestIDHeader},
+		response:    queue.Item{},
+	},
+	{
+		path:        "/cats-request/watch",
+		method:      http.MethodGet,
+		operationID: "watch",
+		summary:     "Streams status updates of the request as server-sent events (text/event-stream), until it finishes.",
+		headers:     []string{RequestIDHeader},
+		response:    queue.Item{},
+	},
+	{
+		path:        "/cats-request/value",
+		method:      http.MethodGet,
+		operationID: "value",
+		summary:     "Returns the value of the request, decoded by its 'content_type' and served with it (406 if not accepted).",
+		headers:     []string{RequestIDHeader},
+		response:    "",
+	},
+	{
+		path:        "/cats-request/queue",
+		method:      http.MethodGet,
+		operationID: "pop",
+		summary:     "Returns the first item in the queue, blocking until there is one (used by workers).",
+		response:    queue.Item{},
+	},
+	{
+		path:        "/cats-request/queue",
+		method:      http.MethodPost,
+		operationID: "update",
+		summary:     "Updates the status of the request (used by workers).",
+		request:     queue.Item{},
+		response:    queue.Item{},
+	},
+}
+
+// openAPISpec generates OpenAPI v3 document from 'apiOperations'.
+func openAPISpec() map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]map[string]interface{})
+	for _, op := range apiOperations {
+		o := map[string]interface{}{
+			"operationId": op.operationID,
+			"summary":     op.summary,
+		}
+		var params []interface{}
+		for _, h := range op.headers {
+			params = append(params, map[string]interface{}{
+				"name":     h,
+				"in":       "header",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+		if op.request != nil {
+			o["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemaRef(schemas, reflect.TypeOf(op.request))},
+				},
+			}
+		}
+		o["responses"] = map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "OK (errors are reported in 'error' field)",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemaRef(schemas, reflect.TypeOf(op.response))},
+				},
+			},
+			"405": map[string]interface{}{"description": "Method Not Allowed"},
+		}
+		if paths[op.path] == nil {
+			paths[op.path] = make(map[string]interface{})
+		}
+		paths[op.path][strings.ToLower(op.method)] = o
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "dplearn backend",
+			"version": "v1",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaRef registers the struct schema in components, and returns its reference.
+func schemaRef(schemas map[string]interface{}, tp reflect.Type) map[string]interface{} {
+	if tp.Kind() == reflect.Ptr {
+		tp = tp.Elem()
+	}
+	if tp.Kind() != reflect.Struct || tp == timeType {
+		return schemaOf(schemas, tp)
+	}
+	if _, ok := schemas[tp.Name()]; !ok {
+		schemas[tp.Name()] = nil // avoid infinite recursion
+		schemas[tp.Name()] = schemaOf(schemas, tp)
+	}
+	return map[string]interface{}{"$ref": "#/components/schemas/" + tp.Name()}
+}
+
+// schemaOf returns JSON schema of the type, following 'encoding/json' field tags.
+func schemaOf(schemas map[string]interface{}, tp reflect.Type) map[string]interface{} {
+	if tp == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch tp.Kind() {
+	case reflect.Ptr:
+		return schemaOf(schemas, tp.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaRef(schemas, tp.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaRef(schemas, tp.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for i := 0; i < tp.NumField(); i++ {
+			f := tp.Field(i)
+			if f.PkgPath != "" { // unexported
+				continue
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = schemaRef(schemas, f.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	}
+	return map[string]interface{}{}
+}
+
+func openAPIHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(openAPISpec())
+	default:
+		http.Error(w, "Method Not Allowed", 405)
+	}
+	return nil
+}
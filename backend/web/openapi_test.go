@@ -0,0 +1,48 @@
+package web
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPISpec(t *testing.T) {
+	data, err := json.Marshal(openAPISpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err = json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Fatalf("unexpected version %q", spec.OpenAPI)
+	}
+	for _, op := range apiOperations {
+		o, ok := spec.Paths[op.path][strings.ToLower(op.method)]
+		if !ok {
+			t.Fatalf("missing %s %s", op.method, op.path)
+		}
+		if o["operationId"] != op.operationID {
+			t.Fatalf("unexpected operation %+v", o)
+		}
+	}
+	item, ok := spec.Components.Schemas["Item"]
+	if !ok {
+		t.Fatalf("missing Item schema %+v", spec.Components.Schemas)
+	}
+	if item.Properties["created_at"]["format"] != "date-time" || item.Properties["progress"]["type"] != "integer" {
+		t.Fatalf("unexpected Item schema %+v", item)
+	}
+	if _, ok = spec.Components.Schemas["Request"].Properties["create_request"]; !ok {
+		t.Fatalf("unexpected Request schema %+v", spec.Components.Schemas["Request"])
+	}
+}
@@ -0,0 +1,55 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+// valueHandler serves the value of the request item, decoded by its
+// content type (see 'queue.Item.Bytes'), with the content type in the
+// response headers. It returns 406 if the request does not accept the
+// content type. Request ID is read from header, or 'request_id' query.
+func valueHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	srv := ctx.Value(serverKey).(*Server)
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", 405)
+		return nil
+	}
+	requestID := req.Header.Get(RequestIDHeader)
+	if requestID == "" {
+		requestID = req.URL.Query().Get("request_id")
+	}
+	vi, ok := srv.requestCache.Load(requestID)
+	if requestID == "" || !ok {
+		http.Error(w, fmt.Sprintf("cannot find request ID %q", requestID), http.StatusNotFound)
+		return nil
+	}
+	var item queue.Item
+	switch v := vi.(type) {
+	case *queue.Item:
+		item = *v
+	case queue.Item:
+		item = v
+	}
+
+	contentType := item.ContentType
+	if contentType == "" {
+		contentType = queue.ContentTypeText
+	}
+	if !queue.AcceptsContentType(req.Header.Get("Accept"), contentType) {
+		http.Error(w, fmt.Sprintf("value of %q is %q", requestID, contentType), http.StatusNotAcceptable)
+		return nil
+	}
+	data, err := item.Bytes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,67 @@
+package web
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func TestValueHandler(t *testing.T) {
+	srv := &Server{}
+	image := queue.CreateItem("/cats-request", 100, "")
+	if err := image.SetBytes(queue.ContentTypeJPEG, []byte{0xff, 0xd8}); err != nil {
+		t.Fatal(err)
+	}
+	srv.requestCache.Store("image", image)
+	srv.requestCache.Store("text", queue.Item{Bucket: "/cats-request", Value: "it's a cat"})
+
+	ts := httptest.NewServer(&ContextAdapter{
+		ctx:     context.Background(),
+		handler: with(ContextHandlerFunc(valueHandler), srv, nil, nil),
+	})
+	defer ts.Close()
+
+	for i, tt := range []struct {
+		requestID   string
+		accept      string
+		code        int
+		contentType string
+		body        string
+	}{
+		{"image", "", http.StatusOK, queue.ContentTypeJPEG, "\xff\xd8"},
+		{"image", "image/*", http.StatusOK, queue.ContentTypeJPEG, "\xff\xd8"},
+		{"image", "application/json", http.StatusNotAcceptable, "", ""},
+		{"text", "", http.StatusOK, queue.ContentTypeText, "it's a cat"},
+		{"unknown", "", http.StatusNotFound, "", ""},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/cats-request/value?request_id="+tt.requestID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.code {
+			t.Fatalf("#%d: expected %d, got %d (%s)", i, tt.code, resp.StatusCode, body)
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != tt.contentType || string(body) != tt.body {
+			t.Fatalf("#%d: expected %q %q, got %q %q", i, tt.contentType, tt.body, ct, body)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	queue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+const watchInterval = 500 * time.Millisecond
+
+// watchHandler streams status updates of the request as server-sent events,
+// until the request is done, canceled, or failed. Request ID is read from
+// header, or 'request_id' query parameter for browser EventSource.
+func watchHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	srv := ctx.Value(serverKey).(*Server)
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", 405)
+		return nil
+	}
+	requestID := req.Header.Get(RequestIDHeader)
+	if requestID == "" {
+		requestID = req.URL.Query().Get("request_id")
+	}
+	if requestID == "" {
+		http.Error(w, fmt.Sprintf("expected %q from header or 'request_id' query", RequestIDHeader), http.StatusBadRequest)
+		return nil
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	var last []byte
+	for {
+		var item queue.Item
+		vi, ok := srv.requestCache.Load(requestID)
+		if !ok {
+			item = queue.Item{Bucket: req.URL.Path, Error: fmt.Sprintf("cannot find request ID %q", requestID)}
+		} else {
+			switch v := vi.(type) {
+			case *queue.Item:
+				item = *v
+			case queue.Item:
+				item = v
+			}
+		}
+
+		data, err := json.Marshal(&item)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(last, data) {
+			if _, err = fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return err
+			}
+			flusher.Flush()
+			last = data
+		}
+		if item.Progress == queue.MaxProgress || item.Canceled || item.Error != "" {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-req.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -21,6 +21,21 @@ ITEM_KEYS = ['bucket', 'key', 'value', 'progress', 'canceled', 'error',
              'request_id']
 
 
+def tls_options():
+    """tls_options returns the requests options for HTTPS endpoints,
+    from WORKER_TLS_CERT, WORKER_TLS_KEY, and WORKER_TLS_CA. Certificate
+    files are read on every new connection, so rotated files are used.
+    """
+    opts = {}
+    cert = os.environ.get('WORKER_TLS_CERT', '')
+    if cert != '':
+        opts['cert'] = (cert, os.environ.get('WORKER_TLS_KEY', cert))
+    ca_file = os.environ.get('WORKER_TLS_CA', '')
+    if ca_file != '':
+        opts['verify'] = ca_file
+    return opts
+
+
 def fetch_item(endpoint, timeout=None):
     """fetch_item fetches a scheduled job from queue service.
     """
@@ -28,7 +43,7 @@ def fetch_item(endpoint, timeout=None):
         try:
             # blocks until first item is available
             log.info('fetching item from {0}'.format(endpoint))
-            rresp = requests.get(endpoint, timeout=timeout)
+            rresp = requests.get(endpoint, timeout=timeout, **tls_options())
             log.info('fetched item from {0}'.format(endpoint))
 
             # even empty, Go backend should encode every field
@@ -58,7 +73,7 @@ def post_item(endpoint, item):
             req_id = item['request_id']
             log.info('posting item to {0} with request ID {1}'.format(endpoint, req_id))
             rresp = requests.post(endpoint, data=json.dumps(item),
-                                  headers=headers)
+                                  headers=headers, **tls_options())
             log.info('posted item to {0} with request ID {1}'.format(endpoint, req_id))
 
             item = json.loads(rresp.text)
@@ -3,13 +3,22 @@ package main
 import (
 	"context"
 	"flag"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/gyuho/dplearn/backend/web"
+	"github.com/gyuho/dplearn/pkg/archive"
+	"github.com/gyuho/dplearn/pkg/audit"
 	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/operator"
+	"github.com/gyuho/dplearn/pkg/tlsutil"
+	"github.com/gyuho/dplearn/pkg/workflow"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
@@ -18,8 +27,42 @@ func main() {
 	queuePortClient := flag.Int("queue-port-client", 22000, "Specify the client port for queue service.")
 	queuePortPeer := flag.Int("queue-port-peer", 22001, "Specify the peer port for queue service.")
 	dataDir := flag.String("data-dir", filepath.Join(os.TempDir(), "etcd-data"), "Specify the etcd data directory.")
+	rejectUnknownBuckets := flag.Bool("reject-unknown-buckets", false, "'true' to reject enqueue to buckets not matching -allowed-buckets or configured.")
+	allowedBuckets := flag.String("allowed-buckets", "", "Comma-separated bucket name patterns (e.g. '/cats-request,/*-request').")
+	coalesceWindow := flag.Duration("queue-coalesce-window", etcdqueue.AddCoalesceWindow, "Latency budget to coalesce concurrent enqueues into one transaction (0 to disable).")
+	slowConsumerThreshold := flag.Duration("slow-consumer-threshold", etcdqueue.SlowConsumerThreshold, "Duration a queue watcher can be blocked, before its consumer is reported as slow.")
+	evictSlowConsumers := flag.Bool("evict-slow-consumers", false, "'true' to close queue watchers of slow consumers (e.g. idle dashboard tabs).")
+	breakerThreshold := flag.Int("queue-breaker-threshold", etcdqueue.BreakerThreshold, "Consecutive etcd failures to fail queue requests fast (0 to disable).")
+	breakerCooldown := flag.Duration("queue-breaker-cooldown", etcdqueue.BreakerCooldown, "Duration to fail queue requests fast, before probing etcd again.")
+	requestTimeout := flag.Duration("queue-request-timeout", etcdqueue.DefaultRequestTimeout, "Timeout of queue operations without deadline, including their etcd retries (0 to disable).")
+	notifyWorkers := flag.Int("queue-notify-workers", etcdqueue.NotifyWorkers, "Goroutines per bucket to deliver item states to watchers.")
+	maxValueBytes := flag.Int("queue-max-value-bytes", etcdqueue.DefaultMaxValueBytes, "Maximum size of item values (0 to disable), below etcd's request limit.")
+	recoverOrphans := flag.String("recover-orphans", "", "Policy of in-progress items of workers gone at startup ('requeue' or 'fail'). Disabled if empty.")
+	archiveDir := flag.String("archive-dir", "", "Directory to archive old completed items into, out of etcd. Disabled if empty.")
+	archiveAfter := flag.Duration("archive-after", 7*24*time.Hour, "Age of completed items to archive, since completion.")
+	archiveInterval := flag.Duration("archive-interval", time.Hour, "Interval to archive completed items.")
+	queueACL := flag.Bool("queue-acl", false, "'true' to enforce bucket ACLs on the bearer tokens of requests, by their hashes (see 'dplearn-queue acl -token').")
+	auditFile := flag.String("audit-file", "", "File to append queue audit records to. Disabled if empty.")
+	auditURL := flag.String("audit-url", "", "HTTP endpoint to post queue audit records to (bearer token from $AUDIT_TOKEN). Disabled if empty.")
+	auditFormat := flag.String("audit-format", "json", "Format of audit records ('json' or 'cef').")
+	workflowInterval := flag.Duration("workflow-interval", 0, "Interval to enqueue steps of running workflows as their dependencies complete (0 to disable).")
+	diagHost := flag.String("diag-host", "", "Specify host and port for diagnostics (pprof, expvar, queue watchers). Disabled if empty.")
+	externalMetricsHost := flag.String("external-metrics-host", "", "Specify host and port for Kubernetes external metrics of -external-metrics-buckets (HTTPS with -tls-cert-file). Disabled if empty.")
+	externalMetricsBuckets := flag.String("external-metrics-buckets", "/cats-request", "Comma-separated buckets to expose as external metrics for autoscaling.")
+	tlsCertFile := flag.String("tls-cert-file", "", "Certificate file to serve HTTPS (overrides -web-scheme).")
+	tlsKeyFile := flag.String("tls-key-file", "", "Key file of -tls-cert-file.")
+	tlsCAFile := flag.String("tls-ca-file", "", "CA file to require and verify client certificates (mutual TLS).")
+	tlsReloadInterval := flag.Duration("tls-reload-interval", time.Minute, "Interval to reload rotated certificate files.")
 	flag.Parse()
 
+	etcdqueue.AddCoalesceWindow = *coalesceWindow
+	etcdqueue.SlowConsumerThreshold = *slowConsumerThreshold
+	etcdqueue.EvictSlowConsumers = *evictSlowConsumers
+	etcdqueue.BreakerThreshold = *breakerThreshold
+	etcdqueue.BreakerCooldown = *breakerCooldown
+	etcdqueue.NotifyWorkers = *notifyWorkers
+	etcdqueue.OrphanRecovery = etcdqueue.OrphanPolicy(*recoverOrphans)
+
 	rootCtx, rootCancel := context.WithCancel(context.Background())
 	defer rootCancel()
 
@@ -29,8 +72,87 @@ func main() {
 	}
 	defer qu.Stop()
 
+	policy := etcdqueue.BucketPolicy{RejectUnknown: *rejectUnknownBuckets}
+	for _, pattern := range strings.Split(*allowedBuckets, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			policy.Patterns = append(policy.Patterns, pattern)
+		}
+	}
+	if err = qu.SetBucketPolicy(policy); err != nil {
+		glog.Fatal(err)
+	}
+	if err = qu.SetLimits(etcdqueue.Limits{MaxValueBytes: *maxValueBytes, RequestTimeout: *requestTimeout}); err != nil {
+		glog.Fatal(err)
+	}
+	prometheus.MustRegister(etcdqueue.NewStatsCollector(qu, "/cats-request"))
+
+	if *archiveDir != "" {
+		st, err := archive.NewDirStorage(*archiveDir)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("archiving completed items older than %v to %q", *archiveAfter, *archiveDir)
+		go archive.New(qu, st, *archiveAfter).Run(rootCtx, *archiveInterval)
+	}
+
+	if *auditFile != "" {
+		sink, err := audit.NewFileSink(*auditFile)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer sink.Close()
+		startAudit(rootCtx, "file", audit.Format(*auditFormat), qu, sink)
+	}
+	if *auditURL != "" {
+		startAudit(rootCtx, "http", audit.Format(*auditFormat), qu, audit.NewHTTPSink(*auditURL, os.Getenv("AUDIT_TOKEN")))
+	}
+
+	if *workflowInterval > 0 {
+		glog.Infof("running workflow engine every %v", *workflowInterval)
+		go workflow.New(qu).Run(rootCtx, *workflowInterval)
+	}
+
+	if *diagHost != "" {
+		glog.Infof("starting diagnostics server with %q", *diagHost)
+		go func() {
+			if err := http.ListenAndServe(*diagHost, web.NewDiagHandler(qu)); err != nil {
+				glog.Warningf("diagnostics server stopped (%v)", err)
+			}
+		}()
+	}
+
+	if *externalMetricsHost != "" {
+		var buckets []string
+		for _, bucket := range strings.Split(*externalMetricsBuckets, ",") {
+			if bucket = strings.TrimSpace(bucket); bucket != "" {
+				buckets = append(buckets, bucket)
+			}
+		}
+		glog.Infof("starting external metrics server with %q (buckets %q)", *externalMetricsHost, buckets)
+		srv := &http.Server{Addr: *externalMetricsHost, Handler: operator.NewExternalMetricsHandler(qu, buckets...)}
+		go func() {
+			var err error
+			if *tlsCertFile != "" {
+				// the aggregation layer authenticates with its own client certificates
+				err = serveTLS(rootCtx, srv, tlsutil.Config{CertFile: *tlsCertFile, KeyFile: *tlsKeyFile}, *tlsReloadInterval)
+			} else {
+				err = srv.ListenAndServe()
+			}
+			glog.Warningf("external metrics server stopped (%v)", err)
+		}()
+	}
+
 	glog.Infof("starting web server with %q (queue :%d/:%d, data-dir %q)", *hostPort, *queuePortClient, *queuePortPeer, *dataDir)
-	srv, err := web.StartServer(*webScheme, *hostPort, qu)
+	var webQu etcdqueue.Queue = qu
+	if *queueACL {
+		webQu = etcdqueue.NewACLQueue(qu)
+	}
+	var srv *web.Server
+	if *tlsCertFile != "" {
+		srv, err = startTLSServer(rootCtx, *hostPort, webQu, tlsutil.Config{CertFile: *tlsCertFile, KeyFile: *tlsKeyFile, CAFile: *tlsCAFile}, *tlsReloadInterval)
+	} else {
+		srv, err = web.StartServer(*webScheme, *hostPort, webQu)
+	}
 	if err != nil {
 		glog.Fatal(err)
 	}
@@ -40,3 +162,42 @@ func main() {
 		glog.Warning("stopped web server")
 	}
 }
+
+// startTLSServer starts the web server over TLS, reloading rotated
+// certificate files every interval until the context is done.
+func startTLSServer(ctx context.Context, hostPort string, qu etcdqueue.Queue, cfg tlsutil.Config, interval time.Duration) (*web.Server, error) {
+	r, err := tlsutil.NewReloader(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg, err := r.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	go r.Run(ctx, interval)
+	glog.Infof("serving HTTPS (client certificates required: %v)", cfg.CAFile != "")
+	return web.StartTLSServer(hostPort, qu, tlsCfg)
+}
+
+// serveTLS serves the server over TLS, reloading rotated certificate
+// files every interval until the context is done.
+func serveTLS(ctx context.Context, srv *http.Server, cfg tlsutil.Config, interval time.Duration) error {
+	r, err := tlsutil.NewReloader(cfg)
+	if err != nil {
+		return err
+	}
+	if srv.TLSConfig, err = r.ServerConfig(); err != nil {
+		return err
+	}
+	go r.Run(ctx, interval)
+	return srv.ListenAndServeTLS("", "")
+}
+
+func startAudit(ctx context.Context, name string, format audit.Format, qu etcdqueue.Queue, sink audit.Sink) {
+	e, err := audit.New(audit.Config{Name: name, Format: format}, qu, sink)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("exporting %s audit records to %s sink", format, name)
+	go e.Run(ctx)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func aclCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("acl", flag.ExitOnError)
+	clear := fs.Bool("clear", false, "'true' to delete the ACL, allowing all operations in the bucket.")
+	token := fs.Bool("token", false, "'true' if identities are API tokens, to grant their hashes instead of storing the tokens.")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		return fmt.Errorf("expected bucket argument (usage: %s)", commands["acl"].usage)
+	}
+	bucket := fs.Arg(0)
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	if fs.NArg() == 1 && !*clear {
+		acl, err := qu.ACL(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		return printJSON(acl)
+	}
+	acl := etcdqueue.ACL{Grants: make(map[string]etcdqueue.Role)}
+	for _, grant := range fs.Args()[1:] {
+		ss := strings.SplitN(grant, "=", 2)
+		if len(ss) != 2 || ss[0] == "" {
+			return fmt.Errorf("expected identity=role, got %q", grant)
+		}
+		id := ss[0]
+		if *token && id != etcdqueue.AnyIdentity {
+			id = etcdqueue.TokenIdentity(id)
+		}
+		acl.Grants[id] = etcdqueue.Role(ss[1])
+	}
+	if *clear && len(acl.Grants) > 0 {
+		return fmt.Errorf("-clear with grants %q", fs.Args()[1:])
+	}
+	if err := qu.SetACL(ctx, bucket, acl); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "updated ACL of %q with %d grants\n", bucket, len(acl.Grants))
+	return nil
+}
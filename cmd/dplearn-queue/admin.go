@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gyuho/dplearn/pkg/archive"
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+const adminUsage = `admin <subcommand> [args]
+
+Subcommands:
+  compact                 compact etcd history up to the current revision
+  defrag                  defragment the storage of each endpoint
+  snapshot <file>         save etcd binary snapshot (restore with 'etcdctl snapshot restore')
+  backup <file>           save all keys as JSON lines, for online restore
+  restore <file>          write keys from 'backup' file back to etcd
+  alarms                  list active alarms (e.g. NOSPACE)
+  gc [-older-than 24h] [-events-older-than 0]
+                          delete completed items, and journaled events
+  archive -dir <dir> [-older-than 168h]
+                          move completed items into archive files
+  archived -dir <dir> [-since 24h] [-key k] <bucket>
+                          query archived items`
+
+func adminCommand(qu etcdqueue.Queue, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("expected subcommand (usage: %s)", adminUsage)
+	}
+	cli := qu.Client()
+	sub, args := args[0], args[1:]
+
+	switch sub {
+	case "compact":
+		ctx, cancel := requestContext()
+		defer cancel()
+		resp, err := cli.Get(ctx, "foo")
+		if err != nil {
+			return err
+		}
+		rev := resp.Header.Revision
+		if _, err = cli.Compact(ctx, rev, clientv3.WithCompactPhysical()); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "compacted revision %d\n", rev)
+
+	case "defrag":
+		for _, ep := range cli.Endpoints() {
+			ctx, cancel := requestContext()
+			_, err := cli.Defragment(ctx, ep)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("failed to defragment %q (%v)", ep, err)
+			}
+			fmt.Fprintf(os.Stderr, "defragmented %q\n", ep)
+		}
+
+	case "snapshot":
+		if err := expectArgs(args, 1, adminUsage); err != nil {
+			return err
+		}
+		ctx, cancel := signalContext()
+		defer cancel()
+		rd, err := cli.Snapshot(ctx)
+		if err != nil {
+			return err
+		}
+		defer rd.Close()
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(f, rd)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if err = f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "saved snapshot %q (%d bytes)\n", args[0], n)
+		return f.Close()
+
+	case "backup":
+		if err := expectArgs(args, 1, adminUsage); err != nil {
+			return err
+		}
+		return backup(cli, args[0])
+
+	case "restore":
+		if err := expectArgs(args, 1, adminUsage); err != nil {
+			return err
+		}
+		return restore(cli, args[0])
+
+	case "alarms":
+		ctx, cancel := requestContext()
+		defer cancel()
+		resp, err := cli.AlarmList(ctx)
+		if err != nil {
+			return err
+		}
+		if len(resp.Alarms) == 0 {
+			fmt.Fprintln(os.Stderr, "no alarms")
+		}
+		for _, a := range resp.Alarms {
+			fmt.Printf("member %x: %s\n", a.MemberID, a.Alarm)
+		}
+
+	case "gc":
+		fs := flag.NewFlagSet("gc", flag.ExitOnError)
+		olderThan := fs.Duration("older-than", 24*time.Hour, "Delete completed items created before this duration.")
+		eventsOlderThan := fs.Duration("events-older-than", 0, "Delete journaled events created before this duration (0 to keep all).")
+		fs.Parse(args)
+		ctx, cancel := requestContext()
+		defer cancel()
+		n, err := qu.GCCompleted(ctx, *olderThan)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "deleted %d completed item(s)\n", n)
+		if *eventsOlderThan > 0 {
+			if n, err = qu.GCEvents(ctx, *eventsOlderThan); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "deleted %d event(s)\n", n)
+		}
+
+	case "archive":
+		fs := flag.NewFlagSet("archive", flag.ExitOnError)
+		dir := fs.String("dir", "", "Archive directory.")
+		olderThan := fs.Duration("older-than", 7*24*time.Hour, "Archive items completed before this duration.")
+		fs.Parse(args)
+		st, err := archive.NewDirStorage(*dir)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := requestContext()
+		defer cancel()
+		n, err := archive.New(qu, st, *olderThan).Archive(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "archived %d completed item(s)\n", n)
+
+	case "archived":
+		fs := flag.NewFlagSet("archived", flag.ExitOnError)
+		dir := fs.String("dir", "", "Archive directory.")
+		since := fs.Duration("since", 0, "Select items completed within the duration (0 for all).")
+		key := fs.String("key", "", "Select the item of the key.")
+		fs.Parse(args)
+		if err := expectArgs(fs.Args(), 1, adminUsage); err != nil {
+			return err
+		}
+		q := archive.Query{Bucket: fs.Arg(0), Key: *key}
+		if *since > 0 {
+			q.Since = time.Now().Add(-*since)
+		}
+		st, err := archive.NewDirStorage(*dir)
+		if err != nil {
+			return err
+		}
+		items, err := archive.Find(st, q)
+		if err != nil {
+			return err
+		}
+		return printJSON(items)
+
+	default:
+		return fmt.Errorf("unknown subcommand %q (usage: %s)", sub, adminUsage)
+	}
+	return nil
+}
+
+// backupKV is a key-value pair in backup file.
+type backupKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func backup(cli *clientv3.Client, fpath string) error {
+	ctx, cancel := requestContext()
+	defer cancel()
+	resp, err := cli.Get(ctx, "\x00", clientv3.WithFromKey())
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, kv := range resp.Kvs {
+		if err = enc.Encode(backupKV{Key: string(kv.Key), Value: string(kv.Value)}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "saved %d key(s) at revision %d to %q\n", len(resp.Kvs), resp.Header.Revision, fpath)
+	return f.Close()
+}
+
+func restore(cli *clientv3.Client, fpath string) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n := 0
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var kv backupKV
+		if err = dec.Decode(&kv); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to parse %q (%v)", fpath, err)
+		}
+		ctx, cancel := requestContext()
+		_, err = cli.Put(ctx, kv.Key, kv.Value)
+		cancel()
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	fmt.Fprintf(os.Stderr, "restored %d key(s) from %q\n", n, fpath)
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func configCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	retention := fs.Duration("retention", 0, "Retention of completed items (e.g. '72h'), overriding GC duration.")
+	rateLimit := fs.Float64("rate-limit", 0, "Maximum number of items added per second.")
+	rateBurst := fs.Int("rate-burst", 0, "Maximum number of items added at once.")
+	maxPending := fs.Int("max-pending", 0, "Maximum number of pending items.")
+	maxBytes := fs.Int64("max-bytes", 0, "Maximum total size of pending and completed items.")
+	maxInFlight := fs.Int("max-in-flight", 0, "Maximum number of in-progress items.")
+	maxAttempts := fs.Int("max-attempts", 0, "Maximum number of attempts of failed items.")
+	concurrencyKey := fs.String("concurrency-key", "", "Item label (e.g. 'user_id') whose items are in progress one at a time per value.")
+	shadowBucket := fs.String("shadow-bucket", "", "Shadow bucket mirroring added items, for experimental workers.")
+	shadowPercent := fs.Int("shadow-percent", 0, "Percentage of added items mirrored into the shadow bucket (0 to 100).")
+	paused := fs.Bool("paused", false, "'true' to reject Add and Pop of the bucket (e.g. during a transfer).")
+	show := fs.Bool("show", false, "'true' to print the current config, instead of updating it.")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 1, commands["config"].usage); err != nil {
+		return err
+	}
+	bucket := fs.Arg(0)
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	if *show {
+		cfg, err := qu.BucketConfig(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		return printJSON(cfg)
+	}
+	cfg := etcdqueue.BucketConfig{
+		Retention:      *retention,
+		RateLimit:      *rateLimit,
+		RateBurst:      *rateBurst,
+		MaxPending:     *maxPending,
+		MaxBytes:       *maxBytes,
+		MaxInFlight:    *maxInFlight,
+		ConcurrencyKey: *concurrencyKey,
+		Retry:          etcdqueue.RetryPolicy{MaxAttempts: *maxAttempts},
+		Shadow:         etcdqueue.ShadowConfig{Bucket: *shadowBucket, Percent: *shadowPercent},
+		Paused:         *paused,
+	}
+	if err := qu.SetBucketConfig(ctx, bucket, cfg); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "updated config of %q\n", bucket)
+	return nil
+}
+
+func createBucketCommand(qu etcdqueue.Queue, args []string) error {
+	if err := expectArgs(args, 2, commands["create-bucket"].usage); err != nil {
+		return err
+	}
+	bucket := args[0]
+	data, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	var tmpl etcdqueue.BucketTemplate
+	if err = json.Unmarshal(data, &tmpl); err != nil {
+		return fmt.Errorf("%q has invalid template (%v)", args[1], err)
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	if err = qu.CreateBucketFromTemplate(ctx, bucket, tmpl); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "created %q from %q\n", bucket, args[1])
+	return nil
+}
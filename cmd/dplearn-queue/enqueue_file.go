@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+// job defines a single item to enqueue, read from JSON or CSV file.
+// CSV files must have a header with "bucket", "value", and optional
+// "weight" and "request_id" columns.
+type job struct {
+	Bucket    string `json:"bucket"`
+	Weight    uint64 `json:"weight"`
+	Value     string `json:"value"`
+	RequestID string `json:"request_id"`
+}
+
+// reject is a job that failed validation.
+type reject struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// enqueueReport is printed after bulk enqueue.
+type enqueueReport struct {
+	Created  []string `json:"created"`
+	Rejected []reject `json:"rejected"`
+}
+
+func enqueueFile(qu etcdqueue.Queue, fpath string, ttl time.Duration) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var jobs []job
+	switch strings.ToLower(filepath.Ext(fpath)) {
+	case ".csv":
+		jobs, err = readJobsCSV(f)
+	default:
+		err = json.NewDecoder(f).Decode(&jobs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %q (%v)", fpath, err)
+	}
+
+	rp := enqueueReport{Created: []string{}, Rejected: []reject{}}
+	items := make([]*etcdqueue.Item, 0, len(jobs))
+	for i, j := range jobs {
+		switch {
+		case j.Bucket == "":
+			rp.Rejected = append(rp.Rejected, reject{Index: i, Error: "empty bucket"})
+			continue
+		case j.Value == "":
+			rp.Rejected = append(rp.Rejected, reject{Index: i, Error: "empty value"})
+			continue
+		case j.Weight > etcdqueue.MaxWeight:
+			rp.Rejected = append(rp.Rejected, reject{Index: i, Error: fmt.Sprintf("weight %d exceeds %d", j.Weight, etcdqueue.MaxWeight)})
+			continue
+		}
+		item := etcdqueue.CreateItem(j.Bucket, j.Weight, j.Value)
+		item.RequestID = j.RequestID
+		items = append(items, item)
+	}
+
+	var opts []etcdqueue.OpOption
+	if ttl > 0 {
+		opts = append(opts, etcdqueue.WithTTL(ttl))
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	if err = qu.AddBatch(ctx, items, opts...); err != nil {
+		return err
+	}
+	for _, item := range items {
+		rp.Created = append(rp.Created, item.Key)
+	}
+	return printJSON(rp)
+}
+
+func readJobsCSV(r io.Reader) ([]job, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	cols := make(map[string]int)
+	for i, name := range rows[0] {
+		cols[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range []string{"bucket", "value"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("missing %q column in header %q", name, rows[0])
+		}
+	}
+	field := func(row []string, name string) string {
+		if i, ok := cols[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	jobs := make([]job, 0, len(rows)-1)
+	for i, row := range rows[1:] {
+		j := job{Bucket: field(row, "bucket"), Value: field(row, "value"), RequestID: field(row, "request_id")}
+		if w := field(row, "weight"); w != "" {
+			j.Weight, err = strconv.ParseUint(w, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("row %d has invalid weight %q (%v)", i+1, w, err)
+			}
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,182 @@
+// dplearn-queue is a command line tool to operate the queue service.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/tlsutil"
+)
+
+type command struct {
+	usage string
+	run   func(qu etcdqueue.Queue, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	// initialized in init, since commands refer back to their usage
+	commands = map[string]command{
+		"enqueue":       {usage: "enqueue [flags] <bucket> <value> | enqueue -file <jobs.json|jobs.csv>", run: enqueueCommand},
+		"front":         {usage: "front [flags] <bucket>", run: frontCommand},
+		"list":          {usage: "list [flags] <bucket> | list -query <query> [bucket]", run: listCommand},
+		"get":           {usage: "get <key>", run: getCommand},
+		"cancel":        {usage: "cancel [flags] <key>", run: cancelCommand},
+		"undelete":      {usage: "undelete <key>", run: undeleteCommand},
+		"annotate":      {usage: "annotate [flags] <key> [text]", run: annotateCommand},
+		"lineage":       {usage: "lineage <key>", run: lineageCommand},
+		"workers":       {usage: "workers", run: workersCommand},
+		"replay":        {usage: "replay [flags] <export.ndjson[.gz]>", run: replayCommand},
+		"completed":     {usage: "completed [flags]", run: completedCommand},
+		"stats":         {usage: "stats [flags] <bucket>", run: statsCommand},
+		"purge":         {usage: "purge [flags] <bucket>", run: purgeCommand},
+		"watch":         {usage: "watch [flags] <bucket>", run: watchCommand},
+		"tail":          {usage: "tail [flags] <bucket>", run: tailCommand},
+		"mirror":        {usage: "mirror [flags]", run: mirrorCommand},
+		"transfer":      {usage: "transfer -dst-endpoints <endpoints> <bucket>", run: transferCommand},
+		"redact":        {usage: "redact [flags] <bucket>", run: redactCommand},
+		"config":        {usage: "config [flags] <bucket>", run: configCommand},
+		"create-bucket": {usage: "create-bucket <bucket> <template.json>", run: createBucketCommand},
+		"acl":           {usage: "acl [flags] <bucket> [identity=role ...]", run: aclCommand},
+		"quota":         {usage: "quota [flags] [owner]", run: quotaCommand},
+		"usage":         {usage: "usage <-owner owner | -bucket bucket>", run: usageCommand},
+		"schema":        {usage: "schema <set|get|delete> <bucket> [schema.json]", run: schemaCommand},
+		"member":        {usage: "member <list|add name peer-url|remove hex-id|health>", run: memberCommand},
+		"workflow":      {usage: "workflow <submit spec.json [key=value ...]|get id|list|delete id>", run: workflowCommand},
+		"operator":      {usage: "operator [flags]", run: operatorCommand},
+		"admin":         {usage: "admin <compact|defrag|snapshot|backup|restore|alarms|gc> [args]", run: adminCommand},
+	}
+}
+
+var (
+	endpoints        = flag.String("endpoints", "localhost:22000", "Comma-separated etcd client endpoints (e.g. the embedded queue of backend-web-server).")
+	dialTimeout      = flag.Duration("dial-timeout", 5*time.Second, "Dial timeout for etcd client.")
+	keepAliveTime    = flag.Duration("keepalive-time", 0, "Interval to ping etcd to check if the connection is alive (0 to disable).")
+	keepAliveTimeout = flag.Duration("keepalive-timeout", 0, "Timeout of keepalive pings before closing the connection.")
+	maxSendBytes     = flag.Int("max-send-bytes", 0, "Maximum size of requests to etcd (0 for the client default).")
+	maxRecvBytes     = flag.Int("max-recv-bytes", 0, "Maximum size of responses from etcd (0 for the client default).")
+	cmdTimeout       = flag.Duration("command-timeout", 10*time.Second, "Timeout for each queue request.")
+	readOnly         = flag.Bool("read-only", false, "'true' to reject mutations (e.g. when connected to a replica cluster).")
+	certFile         = flag.String("cert", "", "Client certificate file for etcd endpoints with mutual TLS.")
+	keyFile          = flag.String("key", "", "Key file of -cert.")
+	caFile           = flag.String("cacert", "", "CA file to verify HTTPS etcd endpoints.")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: dplearn-queue [flags] <command> [args]\n\nCommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	cli, err := etcdqueue.NewClient(clientConfig(*endpoints))
+	if err != nil {
+		fatalf("failed to connect to %q (%v)", *endpoints, err)
+	}
+	newQueue := etcdqueue.NewQueue
+	if *readOnly {
+		newQueue = etcdqueue.NewReadOnlyQueue
+	}
+	qu, err := newQueue(cli)
+	if err != nil {
+		fatalf("failed to create queue on %q (%v)", *endpoints, err)
+	}
+	defer qu.Stop()
+
+	if err = cmd.run(qu, flag.Args()[1:]); err != nil {
+		qu.Stop()
+		fatalf("%s: %v", flag.Arg(0), err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// clientConfig returns the etcd client configuration of the flags.
+func clientConfig(eps string) etcdqueue.ClientConfig {
+	cfg := etcdqueue.ClientConfig{
+		Endpoints:        strings.Split(eps, ","),
+		DialTimeout:      *dialTimeout,
+		KeepAliveTime:    *keepAliveTime,
+		KeepAliveTimeout: *keepAliveTimeout,
+		MaxSendMsgSize:   *maxSendBytes,
+		MaxRecvMsgSize:   *maxRecvBytes,
+	}
+	tcfg := tlsutil.Config{CertFile: *certFile, KeyFile: *keyFile, CAFile: *caFile}
+	if !tcfg.Empty() {
+		r, err := tlsutil.NewReloader(tcfg)
+		if err != nil {
+			fatalf("failed to load certificates (%v)", err)
+		}
+		cfg.TLS = r.ClientConfig()
+	}
+	return cfg
+}
+
+// requestContext returns a context with the command timeout.
+func requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), *cmdTimeout)
+}
+
+// signalContext returns a context canceled on SIGINT or SIGTERM,
+// for long-running commands.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigc:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigc)
+	}()
+	return ctx, cancel
+}
+
+// expectArgs returns an error if the number of arguments does not match.
+func expectArgs(args []string, n int, usage string) error {
+	if len(args) != n {
+		return fmt.Errorf("expected %d argument(s), got %q (usage: %s)", n, args, usage)
+	}
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func memberCommand(qu etcdqueue.Queue, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("expected subcommand (usage: %s)", commands["member"].usage)
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	switch args[0] {
+	case "list":
+		ms, err := etcdqueue.Members(ctx, qu)
+		if err != nil {
+			return err
+		}
+		return printJSON(ms)
+
+	case "add":
+		if err := expectArgs(args, 3, commands["member"].usage); err != nil {
+			return err
+		}
+		initial, err := etcdqueue.AddMember(ctx, qu, args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "added %q; start it now with initial cluster:\n", args[1])
+		fmt.Println(initial)
+
+	case "remove":
+		if err := expectArgs(args, 2, commands["member"].usage); err != nil {
+			return err
+		}
+		id, err := strconv.ParseUint(args[1], 16, 64)
+		if err != nil {
+			return fmt.Errorf("invalid member ID %q (%v)", args[1], err)
+		}
+		if err = etcdqueue.RemoveMember(ctx, qu, id); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "removed member %x\n", id)
+
+	case "health":
+		if err := etcdqueue.CheckHealth(ctx, qu); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "cluster is healthy\n")
+
+	default:
+		return fmt.Errorf("unknown subcommand %q (usage: %s)", args[0], commands["member"].usage)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/mirror"
+)
+
+func mirrorCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("mirror", flag.ExitOnError)
+	name := fs.String("name", "default", "Mirror name, to persist its cursor in the destination.")
+	dstEndpoints := fs.String("dst-endpoints", "", "Comma-separated etcd client endpoints of the destination cluster.")
+	prefixes := fs.String("prefixes", etcdqueue.PendingPrefix("")+","+etcdqueue.CompletedPrefix(""), "Comma-separated key prefixes to mirror.")
+	policy := fs.String("policy", string(mirror.SourceWins), "Conflict policy ('source-wins' or 'destination-wins').")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 0, commands["mirror"].usage); err != nil {
+		return err
+	}
+	if *dstEndpoints == "" {
+		return fmt.Errorf("'-dst-endpoints' is required")
+	}
+
+	dst, err := etcdqueue.NewClient(clientConfig(*dstEndpoints))
+	if err != nil {
+		return fmt.Errorf("failed to connect to %q (%v)", *dstEndpoints, err)
+	}
+	defer dst.Close()
+
+	m, err := mirror.New(mirror.Config{
+		Name:     *name,
+		Prefixes: splitList(*prefixes),
+		Policy:   mirror.ConflictPolicy(*policy),
+	}, qu.Client(), dst)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	if err = m.Run(ctx); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/operator"
+)
+
+func operatorCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("operator", flag.ExitOnError)
+	host := fs.String("kube-host", "", "Kubernetes API server URL (e.g. 'http://localhost:8001' of 'kubectl proxy'). Defaults to the in-cluster service account.")
+	namespace := fs.String("namespace", "", "Namespace of the resources to reconcile. Empty for all namespaces.")
+	resync := fs.Duration("resync", 5*time.Minute, "Interval to reconcile all resources again.")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 0, commands["operator"].usage); err != nil {
+		return err
+	}
+
+	cfg := operator.Config{Host: *host, Token: os.Getenv("KUBE_TOKEN")}
+	if *host == "" {
+		var err error
+		if cfg, err = operator.InClusterConfig(); err != nil {
+			return err
+		}
+	}
+	cfg.Namespace = *namespace
+	c, err := operator.NewController(cfg, qu)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	if err = c.Run(ctx, *resync); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
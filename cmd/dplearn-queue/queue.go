@@ -0,0 +1,326 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func enqueueCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("enqueue", flag.ExitOnError)
+	weight := fs.Uint64("weight", 100, "Item weight (higher is popped first, maximum 99999).")
+	ttl := fs.Duration("ttl", 0, "Item TTL (0 to never expire).")
+	requestID := fs.String("request-id", "", "Request ID of the item.")
+	parent := fs.String("parent", "", "Key of the item that spawned this item (see 'lineage').")
+	affinity := fs.String("affinity-key", "", "Key of a related item, to route this item to the worker that popped it (see 'workers').")
+	schemaVersion := fs.Int("schema-version", 0, "Payload schema version, only popped by workers supporting it (0 for any worker).")
+	modelType := fs.String("model-type", "", "Model type, only popped by workers supporting it (e.g. 'cnn').")
+	contentType := fs.String("content-type", "", "Content type of the value (e.g. 'application/json'), only popped by workers supporting it. Binary values are stored in base64.")
+	wait := fs.Bool("wait", false, "'true' to wait for the bucket capacity, instead of failing when full.")
+	file := fs.String("file", "", "JSON or CSV file of job definitions to enqueue in batch.")
+	fs.Parse(args)
+	if *file != "" {
+		if err := expectArgs(fs.Args(), 0, commands["enqueue"].usage); err != nil {
+			return err
+		}
+		return enqueueFile(qu, *file, *ttl)
+	}
+	if err := expectArgs(fs.Args(), 2, commands["enqueue"].usage); err != nil {
+		return err
+	}
+
+	item := etcdqueue.CreateItem(fs.Arg(0), *weight, fs.Arg(1))
+	item.RequestID = *requestID
+	item.ParentKey = *parent
+	item.AffinityKey = *affinity
+	item.SchemaVersion = *schemaVersion
+	item.ModelType = *modelType
+	if *contentType != "" {
+		if err := item.SetBytes(*contentType, []byte(fs.Arg(1))); err != nil {
+			return err
+		}
+	}
+
+	var opts []etcdqueue.OpOption
+	if *ttl > 0 {
+		opts = append(opts, etcdqueue.WithTTL(*ttl))
+	}
+	if *wait {
+		opts = append(opts, etcdqueue.WithWaitCapacity())
+	}
+
+	ctx, cancel := requestContext()
+	defer cancel()
+	if err := qu.Add(ctx, item, opts...); err != nil {
+		return err
+	}
+	return printJSON(item)
+}
+
+func frontCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("front", flag.ExitOnError)
+	serializable := fs.Bool("serializable", false, "'true' to read from the local member, which may be stale.")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 1, commands["front"].usage); err != nil {
+		return err
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	item, err := qu.Front(ctx, fs.Arg(0), readOpts(*serializable)...)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		fmt.Fprintf(os.Stderr, "%q is empty\n", fs.Arg(0))
+		return nil
+	}
+	return newItemPrinter(qu).print(ctx, item)
+}
+
+func listCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	selector := fs.String("l", "", "Label selector to filter items (e.g. 'model=resnet,env=prod').")
+	query := fs.String("query", "", "Search items of all statuses (e.g. 'bucket=cats* AND status=failed AND created>-24h'), with the optional bucket.")
+	serializable := fs.Bool("serializable", false, "'true' to read from the local member, which may be stale.")
+	fs.Parse(args)
+	if *query != "" {
+		return searchItems(qu, *query, *selector, fs.Args())
+	}
+	if err := expectArgs(fs.Args(), 1, commands["list"].usage); err != nil {
+		return err
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	items, err := qu.ListSelector(ctx, fs.Arg(0), *selector, readOpts(*serializable)...)
+	if err != nil {
+		return err
+	}
+	p := newItemPrinter(qu)
+	for _, item := range items {
+		if err = p.print(ctx, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func searchItems(qu etcdqueue.Queue, query, selector string, args []string) error {
+	if selector != "" {
+		return fmt.Errorf("-l and -query cannot be combined (use 'label.<name>=<value>' terms)")
+	}
+	switch len(args) {
+	case 0:
+	case 1:
+		query = fmt.Sprintf("bucket=%s AND %s", args[0], query)
+	default:
+		return fmt.Errorf("expected at most 1 argument, got %q (usage: %s)", args, commands["list"].usage)
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	entries, err := qu.Search(ctx, query)
+	if err != nil {
+		return err
+	}
+	p := newItemPrinter(qu)
+	for _, ent := range entries {
+		if err = p.print(ctx, ent.Item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func completedCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("completed", flag.ExitOnError)
+	since := fs.Duration("since", 24*time.Hour, "List items completed within the duration.")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 0, commands["completed"].usage); err != nil {
+		return err
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	items, err := qu.ListCompletedSince(ctx, time.Now().Add(-*since))
+	if err != nil {
+		return err
+	}
+	p := newItemPrinter(qu)
+	for _, item := range items {
+		if err = p.print(ctx, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getCommand(qu etcdqueue.Queue, args []string) error {
+	if err := expectArgs(args, 1, commands["get"].usage); err != nil {
+		return err
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	ent, err := qu.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(ent)
+}
+
+func cancelCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("cancel", flag.ExitOnError)
+	by := fs.String("by", os.Getenv("USER"), "Initiator of the cancellation.")
+	reason := fs.String("reason", "", "Reason of the cancellation (e.g. 'worker maintenance').")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 1, commands["cancel"].usage); err != nil {
+		return err
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	item, err := qu.Cancel(ctx, fs.Arg(0), etcdqueue.WithCancelReason(*by, *reason))
+	if err != nil {
+		return err
+	}
+	return printJSON(item)
+}
+
+func undeleteCommand(qu etcdqueue.Queue, args []string) error {
+	if err := expectArgs(args, 1, commands["undelete"].usage); err != nil {
+		return err
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	item, err := qu.Undelete(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(item)
+}
+
+func annotateCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("annotate", flag.ExitOnError)
+	author := fs.String("author", os.Getenv("USER"), "Author of the annotation.")
+	fs.Parse(args)
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	// without text, print the annotations of the item
+	if fs.NArg() == 1 {
+		as, err := qu.Annotations(ctx, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		return printJSON(as)
+	}
+	if err := expectArgs(fs.Args(), 2, commands["annotate"].usage); err != nil {
+		return err
+	}
+	a := &etcdqueue.Annotation{Author: *author, Text: fs.Arg(1)}
+	if err := qu.Annotate(ctx, fs.Arg(0), a); err != nil {
+		return err
+	}
+	return printJSON(a)
+}
+
+func lineageCommand(qu etcdqueue.Queue, args []string) error {
+	if err := expectArgs(args, 1, commands["lineage"].usage); err != nil {
+		return err
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	node, err := qu.Lineage(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(node)
+}
+
+func workersCommand(qu etcdqueue.Queue, args []string) error {
+	if err := expectArgs(args, 0, commands["workers"].usage); err != nil {
+		return err
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	ws, err := qu.Workers(ctx)
+	if err != nil {
+		return err
+	}
+	return printJSON(ws)
+}
+
+func replayCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "Speed factor of the original inter-arrival times (e.g. '2' to replay twice as fast).")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 1, commands["replay"].usage); err != nil {
+		return err
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	n, err := etcdqueue.Replay(ctx, qu, fs.Arg(0), *speed)
+	fmt.Fprintf(os.Stderr, "replayed %d items\n", n)
+	return err
+}
+
+func statsCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	serializable := fs.Bool("serializable", false, "'true' to read from the local member, which may be stale.")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 1, commands["stats"].usage); err != nil {
+		return err
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	st, err := qu.Stats(ctx, fs.Arg(0), readOpts(*serializable)...)
+	if err != nil {
+		return err
+	}
+	return printJSON(st)
+}
+
+// readOpts returns the read options for the '-serializable' flag.
+func readOpts(serializable bool) []etcdqueue.OpOption {
+	if serializable {
+		return []etcdqueue.OpOption{etcdqueue.WithSerializable()}
+	}
+	return nil
+}
+
+func purgeCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "'true' to confirm deleting all items in the bucket.")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 1, commands["purge"].usage); err != nil {
+		return err
+	}
+	if !*yes {
+		return fmt.Errorf("refusing to purge %q without '-yes'", fs.Arg(0))
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	n, err := qu.Purge(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "purged %d item(s) in %q\n", n, fs.Arg(0))
+	return nil
+}
+
+func watchCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	window := fs.Duration("window", 0, "Window to coalesce updates of the same item into the latest one (e.g. '500ms').")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 1, commands["watch"].usage); err != nil {
+		return err
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	p := newItemPrinter(qu)
+	for ev := range qu.Watch(ctx, fs.Arg(0), etcdqueue.WithNotifyWindow(*window)) {
+		if err := p.printEvent(ctx, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func quotaCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("quota", flag.ExitOnError)
+	maxBytes := fs.Int64("max-bytes", 0, "Maximum total size of items of the owner (0 to remove the quota).")
+	show := fs.Bool("show", false, "'true' to print the current quota, instead of updating it.")
+	fs.Parse(args)
+	if len(fs.Args()) > 1 {
+		return fmt.Errorf("expected at most 1 argument (usage: %s)", commands["quota"].usage)
+	}
+	// empty owner is the default quota
+	owner := fs.Arg(0)
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	if *show {
+		q, err := qu.OwnerQuota(ctx, owner)
+		if err != nil {
+			return err
+		}
+		return printJSON(q)
+	}
+	if err := qu.SetOwnerQuota(ctx, owner, etcdqueue.Quota{MaxBytes: *maxBytes}); err != nil {
+		return err
+	}
+	if owner == "" {
+		fmt.Fprintf(os.Stderr, "updated default quota\n")
+	} else {
+		fmt.Fprintf(os.Stderr, "updated quota of %q\n", owner)
+	}
+	return nil
+}
+
+func usageCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	owner := fs.String("owner", "", "Owner to report usage of.")
+	bucket := fs.String("bucket", "", "Bucket to report usage of.")
+	fs.Parse(args)
+	if (*owner == "") == (*bucket == "") {
+		return fmt.Errorf("expected one of -owner or -bucket (usage: %s)", commands["usage"].usage)
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	var u etcdqueue.Usage
+	var err error
+	if *owner != "" {
+		u, err = qu.OwnerUsage(ctx, *owner)
+	} else {
+		u, err = qu.BucketUsage(ctx, *bucket)
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(u)
+}
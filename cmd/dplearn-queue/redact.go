@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func redactCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("redact", flag.ExitOnError)
+	fields := fs.String("fields", "", "Comma-separated item fields to redact (e.g. 'value,request_id').")
+	labels := fs.String("labels", "", "Comma-separated label keys to redact.")
+	show := fs.Bool("show", false, "'true' to print the current redaction, instead of updating it.")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 1, commands["redact"].usage); err != nil {
+		return err
+	}
+	bucket := fs.Arg(0)
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	if *show {
+		r, err := qu.Redaction(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		return printJSON(r)
+	}
+	r := etcdqueue.Redaction{Fields: splitList(*fields), Labels: splitList(*labels)}
+	if err := qu.SetRedaction(ctx, bucket, r); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "updated redaction of %q\n", bucket)
+	return nil
+}
+
+func splitList(s string) []string {
+	var ss []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ss = append(ss, v)
+		}
+	}
+	return ss
+}
+
+// itemPrinter prints items with sensitive fields redacted, per bucket.
+type itemPrinter struct {
+	qu         etcdqueue.Queue
+	redactions map[string]etcdqueue.Redaction
+}
+
+func newItemPrinter(qu etcdqueue.Queue) *itemPrinter {
+	return &itemPrinter{qu: qu, redactions: make(map[string]etcdqueue.Redaction)}
+}
+
+func (p *itemPrinter) print(ctx context.Context, item *etcdqueue.Item) error {
+	r, ok := p.redactions[item.Bucket]
+	if !ok && item.Bucket != "" {
+		var err error
+		if r, err = p.qu.Redaction(ctx, item.Bucket); err != nil {
+			return err
+		}
+		p.redactions[item.Bucket] = r
+	}
+	return printJSON(r.Redact(item))
+}
+
+// printEvent prints the event with its item redacted.
+func (p *itemPrinter) printEvent(ctx context.Context, ev *etcdqueue.Event) error {
+	if ev.Item == nil {
+		return printJSON(ev)
+	}
+	r, ok := p.redactions[ev.Bucket]
+	if !ok {
+		var err error
+		if r, err = p.qu.Redaction(ctx, ev.Bucket); err != nil {
+			return err
+		}
+		p.redactions[ev.Bucket] = r
+	}
+	cp := *ev
+	cp.Item = r.Redact(ev.Item)
+	return printJSON(&cp)
+}
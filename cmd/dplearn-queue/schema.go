@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func schemaCommand(qu etcdqueue.Queue, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("expected subcommand and bucket (usage: %s)", commands["schema"].usage)
+	}
+	sub, bucket := args[0], args[1]
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	switch sub {
+	case "set":
+		if err := expectArgs(args, 3, commands["schema"].usage); err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(args[2])
+		if err != nil {
+			return err
+		}
+		if err = qu.RegisterSchema(ctx, bucket, data); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "registered schema for %q\n", bucket)
+
+	case "get":
+		data, err := qu.Schema(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			return fmt.Errorf("no schema registered for %q", bucket)
+		}
+		fmt.Println(string(data))
+
+	case "delete":
+		if err := qu.DeleteSchema(ctx, bucket); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "deleted schema of %q\n", bucket)
+
+	default:
+		return fmt.Errorf("unknown subcommand %q (usage: %s)", sub, commands["schema"].usage)
+	}
+	return nil
+}
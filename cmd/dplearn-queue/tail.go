@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorBlue   = "\x1b[34m"
+)
+
+func tailCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	noColor := fs.Bool("no-color", false, "'true' to disable colorized output.")
+	width := fs.Int("width", 30, "Width of progress bars.")
+	delta := fs.Bool("delta", false, "'true' to receive only changed fields of items, for buckets with large values.")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 1, commands["tail"].usage); err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	return tailBucket(ctx, os.Stdout, qu, fs.Arg(0), *width, !*noColor, *delta)
+}
+
+// tailBucket writes the events of the bucket, with progress bars of
+// their items, until the context is canceled.
+func tailBucket(ctx context.Context, w io.Writer, qu etcdqueue.Queue, bucket string, width int, color, delta bool) error {
+	var opts []etcdqueue.OpOption
+	if delta {
+		opts = append(opts, etcdqueue.WithDelta())
+	}
+	// last states of items, to apply patches until their terminal events
+	items := make(map[string]*etcdqueue.Item)
+	for ev := range qu.WatchBucket(ctx, bucket, opts...) {
+		if ev.Patch != nil {
+			base, ok := items[ev.Key]
+			if !ok {
+				// items patched before the tail started are read
+				ent, err := qu.Get(ctx, ev.Key)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "skipping %s event of %q (%v)\n", ev.Type, ev.Key, err)
+					continue
+				}
+				base = ent.Item
+			}
+			item, err := etcdqueue.ApplyPatch(base, ev.Patch)
+			if err != nil {
+				return err
+			}
+			ev.Item = item
+		}
+		switch ev.Type {
+		case etcdqueue.EventComplete, etcdqueue.EventCancel, etcdqueue.EventTransfer:
+			delete(items, ev.Key)
+		default:
+			if delta && ev.Item != nil {
+				items[ev.Key] = ev.Item
+			}
+		}
+		switch {
+		case ev.Error != "":
+			return fmt.Errorf("%s", ev.Error)
+		case ev.Item == nil:
+			fmt.Fprintf(w, "%s %s %s\n", time.Now().Format("15:04:05"), strings.ToUpper(string(ev.Type)), ev.Bucket)
+		default:
+			renderItem(w, ev.Item, width, color)
+		}
+	}
+	return nil
+}
+
+// renderItem writes a single line of item transition with a progress bar.
+func renderItem(w io.Writer, item *etcdqueue.Item, width int, color bool) {
+	status, c := "PENDING", colorBlue
+	switch {
+	case item.Error != "":
+		status, c = "ERROR", colorRed
+	case item.Canceled:
+		status, c = "CANCELED", colorRed
+	case item.Progress >= etcdqueue.MaxProgress:
+		status, c = "DONE", colorGreen
+	case item.Progress > 0:
+		status, c = "RUNNING", colorYellow
+	case item.Status == etcdqueue.StatusClaimed:
+		status, c = "CLAIMED", colorYellow
+	}
+	if !color {
+		c = ""
+	}
+	reset := colorReset
+	if c == "" {
+		reset = ""
+	}
+
+	line := fmt.Sprintf("%s %s%-8s%s %s %3d%% %s",
+		time.Now().Format("15:04:05"),
+		c, status, reset,
+		progressBar(item.Progress, width),
+		item.Progress,
+		item.Key,
+	)
+	if item.Error != "" {
+		line += fmt.Sprintf(" (%s%s%s)", c, item.Error, reset)
+	} else if item.Canceled {
+		line += fmt.Sprintf(" (%s%s%s)", c, item.CancelMessage(), reset)
+	}
+	fmt.Fprintln(w, line)
+}
+
+// progressBar returns a progress bar of the given width (e.g. "[=====     ]").
+func progressBar(progress, width int) string {
+	if progress < 0 {
+		progress = 0
+	}
+	if progress > etcdqueue.MaxProgress {
+		progress = etcdqueue.MaxProgress
+	}
+	done := progress * width / etcdqueue.MaxProgress
+	return "[" + strings.Repeat("=", done) + strings.Repeat(" ", width-done) + "]"
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+// syncBuffer is bytes.Buffer safe for concurrent writes and reads.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTailBucketProgress(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := etcdqueue.NewEmbeddedQueue(context.Background(), 45379, 45380, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	for _, delta := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		out := &syncBuffer{}
+		errc := make(chan error, 1)
+		go func() { errc <- tailBucket(ctx, out, qu, "my-job", 10, false, delta) }()
+		time.Sleep(100 * time.Millisecond)
+
+		if err = qu.Add(ctx, etcdqueue.CreateItem("my-job", 100, "data")); err != nil {
+			t.Fatal(err)
+		}
+		item := <-qu.Pop(ctx, "my-job")
+		if item.Error != "" {
+			t.Fatal(item.Error)
+		}
+		for _, progress := range []int{30, 60} {
+			item.Progress = progress
+			if err = qu.UpdateProgress(ctx, item); err != nil {
+				t.Fatal(err)
+			}
+		}
+		item.Progress = etcdqueue.MaxProgress
+		if err = qu.Complete(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+
+		// the bar advances with each progress update
+		bars := []string{"[          ]   0%", "[===       ]  30%", "[======    ]  60%", "[==========] 100%"}
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(out.String(), bars[len(bars)-1]) && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		cancel()
+		if err = <-errc; err != nil {
+			t.Fatal(err)
+		}
+		lines := out.String()
+		last := -1
+		for _, bar := range bars {
+			i := strings.Index(lines, bar)
+			if i <= last {
+				t.Fatalf("delta %v: expected %q after previous bars, got\n%s", delta, bar, lines)
+			}
+			last = i
+		}
+	}
+}
+
+func TestTailBucketMidStream(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := etcdqueue.NewEmbeddedQueue(context.Background(), 45381, 45382, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err = qu.Add(ctx, etcdqueue.CreateItem("my-job", 100, "data")); err != nil {
+		t.Fatal(err)
+	}
+	item := <-qu.Pop(ctx, "my-job")
+	if item.Error != "" {
+		t.Fatal(item.Error)
+	}
+
+	// patches of items added before the tail apply to their current states
+	out := &syncBuffer{}
+	errc := make(chan error, 1)
+	go func() { errc <- tailBucket(ctx, out, qu, "my-job", 10, false, true) }()
+	time.Sleep(100 * time.Millisecond)
+	item.Progress = 40
+	if err = qu.UpdateProgress(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	item.Progress = etcdqueue.MaxProgress
+	if err = qu.Complete(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), "[==========] 100%") && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if lines := out.String(); !strings.Contains(lines, "[====      ]  40%") || !strings.Contains(lines, "[==========] 100%") {
+		t.Fatalf("expected progress bars, got\n%s", lines)
+	}
+}
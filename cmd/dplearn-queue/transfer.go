@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func transferCommand(qu etcdqueue.Queue, args []string) error {
+	fs := flag.NewFlagSet("transfer", flag.ExitOnError)
+	dstEndpoints := fs.String("dst-endpoints", "", "Comma-separated etcd client endpoints of the destination cluster.")
+	fs.Parse(args)
+	if err := expectArgs(fs.Args(), 1, commands["transfer"].usage); err != nil {
+		return err
+	}
+	if *dstEndpoints == "" {
+		return fmt.Errorf("'-dst-endpoints' is required")
+	}
+
+	cli, err := etcdqueue.NewClient(clientConfig(*dstEndpoints))
+	if err != nil {
+		return fmt.Errorf("failed to connect to %q (%v)", *dstEndpoints, err)
+	}
+	dst, err := etcdqueue.NewQueue(cli)
+	if err != nil {
+		return fmt.Errorf("failed to create queue on %q (%v)", *dstEndpoints, err)
+	}
+	defer dst.Stop()
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	n, err := qu.Transfer(ctx, dst, fs.Arg(0))
+	fmt.Fprintf(os.Stderr, "transferred %d items of %q\n", n, fs.Arg(0))
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/workflow"
+)
+
+func workflowCommand(qu etcdqueue.Queue, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("expected subcommand (usage: %s)", commands["workflow"].usage)
+	}
+	e := workflow.New(qu)
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	switch args[0] {
+	case "submit":
+		if len(args) < 2 {
+			return fmt.Errorf("expected spec file (usage: %s)", commands["workflow"].usage)
+		}
+		data, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		var spec workflow.Spec
+		if err = json.Unmarshal(data, &spec); err != nil {
+			return fmt.Errorf("%q has invalid spec (%v)", args[1], err)
+		}
+		params := make(map[string]string)
+		for _, kv := range args[2:] {
+			ss := strings.SplitN(kv, "=", 2)
+			if len(ss) != 2 {
+				return fmt.Errorf("expected key=value, got %q", kv)
+			}
+			params[ss[0]] = ss[1]
+		}
+		wf, err := e.Submit(ctx, spec, params)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "submitted %q\n", wf.ID)
+		return printJSON(wf)
+
+	case "get":
+		if err := expectArgs(args, 2, commands["workflow"].usage); err != nil {
+			return err
+		}
+		wf, err := e.Get(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		return printJSON(wf)
+
+	case "list":
+		wfs, err := e.List(ctx)
+		if err != nil {
+			return err
+		}
+		for _, wf := range wfs {
+			fmt.Printf("%s\t%s\t%s\n", wf.ID, wf.Status, wf.UpdatedAt.Format(time.RFC3339))
+		}
+
+	case "delete":
+		if err := expectArgs(args, 2, commands["workflow"].usage); err != nil {
+			return err
+		}
+		if err := e.Delete(ctx, args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "deleted %q\n", args[1])
+
+	default:
+		return fmt.Errorf("unknown subcommand %q (usage: %s)", args[0], commands["workflow"].usage)
+	}
+	return nil
+}
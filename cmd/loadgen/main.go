@@ -0,0 +1,118 @@
+// loadgen generates synthetic queue load, and reports end-to-end latency
+// percentiles for pre-release performance sign-off.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/loadgen"
+)
+
+func main() {
+	endpoints := flag.String("endpoints", "", "Comma-separated etcd client endpoints (empty to run an embedded queue).")
+	embeddedPort := flag.Int("embedded-port", 42379, "Client port of the embedded queue (peer port is the next port).")
+	bucket := flag.String("bucket", "loadgen", "Bucket of generated items.")
+	pattern := flag.String("pattern", "steady", "Enqueue pattern ('steady', 'burst', or 'diurnal').")
+	rate := flag.Float64("rate", 10, "Items per second (minimum rate of 'diurnal').")
+	peak := flag.Float64("peak", 100, "Items per second of bursts, or maximum rate of 'diurnal'.")
+	period := flag.Duration("period", time.Minute, "Interval of bursts, or period of 'diurnal'.")
+	burstFor := flag.Duration("burst-for", 5*time.Second, "Duration of each burst.")
+	sizeDist := flag.String("size-dist", "fixed", "Payload size distribution ('fixed', 'uniform', or 'lognormal').")
+	size := flag.Int("size", 1024, "Payload size in bytes (minimum of 'uniform', median of 'lognormal').")
+	sizeMax := flag.Int("size-max", 64*1024, "Maximum payload size in bytes of 'uniform' and 'lognormal'.")
+	sigma := flag.Float64("size-sigma", 1, "Sigma of 'lognormal' payload sizes.")
+	duration := flag.Duration("duration", time.Minute, "How long items are enqueued.")
+	workers := flag.Int("workers", 4, "Number of workers popping and completing items.")
+	processTime := flag.Duration("process-time", 0, "How long workers process each item.")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "How long to wait for workers to complete enqueued items.")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "Seed of payload sizes.")
+	asJSON := flag.Bool("json", false, "'true' to print the report in JSON.")
+	flag.Parse()
+
+	cfg := loadgen.Config{
+		Bucket:       *bucket,
+		Duration:     *duration,
+		Workers:      *workers,
+		ProcessTime:  *processTime,
+		DrainTimeout: *drainTimeout,
+		Seed:         *seed,
+	}
+	switch *pattern {
+	case "steady":
+		cfg.Pattern = loadgen.Steady{PerSecond: *rate}
+	case "burst":
+		cfg.Pattern = loadgen.Burst{PerSecond: *rate, Peak: *peak, Every: *period, For: *burstFor}
+	case "diurnal":
+		cfg.Pattern = loadgen.Diurnal{Min: *rate, Max: *peak, Period: *period}
+	default:
+		fatalf("unknown pattern %q", *pattern)
+	}
+	switch *sizeDist {
+	case "fixed":
+		cfg.Sizes = loadgen.Fixed(*size)
+	case "uniform":
+		cfg.Sizes = loadgen.Uniform{Min: *size, Max: *sizeMax}
+	case "lognormal":
+		cfg.Sizes = loadgen.LogNormal{Median: *size, Sigma: *sigma, Max: *sizeMax}
+	default:
+		fatalf("unknown size distribution %q", *sizeDist)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	var qu etcdqueue.Queue
+	if *endpoints != "" {
+		cli, err := etcdqueue.NewClient(etcdqueue.ClientConfig{Endpoints: strings.Split(*endpoints, ","), DialTimeout: 5 * time.Second})
+		if err != nil {
+			fatalf("failed to connect to %q (%v)", *endpoints, err)
+		}
+		if qu, err = etcdqueue.NewQueue(cli); err != nil {
+			fatalf("failed to create queue on %q (%v)", *endpoints, err)
+		}
+	} else {
+		dataDir, err := ioutil.TempDir(os.TempDir(), "loadgen")
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer os.RemoveAll(dataDir)
+		if qu, err = etcdqueue.NewEmbeddedQueue(ctx, *embeddedPort, *embeddedPort+1, dataDir); err != nil {
+			fatalf("failed to start embedded queue (%v)", err)
+		}
+	}
+	defer qu.Stop()
+
+	rp, err := loadgen.Run(ctx, qu, cfg)
+	if err != nil && rp == nil {
+		qu.Stop()
+		fatalf("%v", err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(rp)
+	} else {
+		fmt.Print(rp)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -34,6 +34,15 @@ export class Request {
   }
 }
 
+// Estimate represents TypeScript version of Estimate in https://github.com/gyuho/dplearn/blob/master/pkg/etcd-queue/eta.go.
+// Durations are in nanoseconds.
+export class Estimate {
+  public position: number;
+  public start_in: number;
+  public complete_in: number;
+  public samples: number;
+}
+
 // Item represents TypeScript version of Item in https://github.com/gyuho/dplearn/blob/master/pkg/etcd-queue/queue.go.
 export class Item {
   public bucket: string;
@@ -42,8 +51,11 @@ export class Item {
   public value: string;
   public progress: number;
   public canceled: boolean;
+  public canceled_by: string;
+  public cancel_reason: string;
   public error: string;
   public request_id: string;
+  public eta: Estimate;
   constructor(
     bucket: string,
     key: string,
@@ -58,9 +70,22 @@ export class Item {
     this.value = value;
     this.progress = progress;
     this.canceled = false;
+    this.canceled_by = "";
+    this.cancel_reason = "";
     this.error = error;
     this.request_id = reqID;
+    this.eta = null;
+  }
+}
+
+// remainingMessage returns the estimated remaining time (e.g. "~4 minutes remaining").
+export function remainingMessage(eta: Estimate): string {
+  const secs = Math.ceil(eta.complete_in / 1e9);
+  if (secs < 60) {
+    return `~${secs} second${secs === 1 ? "" : "s"} remaining`;
   }
+  const mins = Math.round(secs / 60);
+  return `~${mins} minute${mins === 1 ? "" : "s"} remaining`;
 }
 
 @Injectable()
@@ -140,12 +165,21 @@ export class BackendService implements OnDestroy {
 
     if (resp.canceled === true) {
       clearInterval(this.pollingHandler);
-      this.result += " - canceled!";
+      let msg = "canceled";
+      if (resp.canceled_by) {
+        msg += ` by ${resp.canceled_by}`;
+      }
+      if (resp.cancel_reason) {
+        msg += `: ${resp.cancel_reason}`;
+      }
+      this.result += ` - ${msg}!`;
     }
 
     this.progress = resp.progress;
     if (this.progress === 100) {
       clearInterval(this.pollingHandler);
+    } else if (resp.eta && resp.eta.samples > 0) {
+      this.result += ` (${remainingMessage(resp.eta)})`;
     }
   }
 
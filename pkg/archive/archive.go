@@ -0,0 +1,254 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/golang/glog"
+)
+
+// Archiver moves completed items older than the given age from the
+// queue into archive files, one per bucket and completion date (UTC):
+//
+//	<bucket>/<YYYY-MM-DD>/<archived-at-nanoseconds>.ndjson.gz
+//
+// Each line is a Record of an item, with its annotations and metrics,
+// which are deleted from the queue with the item.
+//
+// Items are deleted from the queue only after their file is written.
+// If the deletion fails, the items are archived again on the next run,
+// and Query returns only their last copies.
+type Archiver struct {
+	qu        etcdqueue.Queue
+	st        Storage
+	olderThan time.Duration
+	now       func() time.Time
+}
+
+// New returns a new Archiver of items completed more than 'olderThan' ago.
+func New(qu etcdqueue.Queue, st Storage, olderThan time.Duration) *Archiver {
+	return &Archiver{qu: qu, st: st, olderThan: olderThan, now: time.Now}
+}
+
+// Run archives items every interval, until the context is done.
+func (a *Archiver) Run(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+		if n, err := a.Archive(ctx); err != nil {
+			glog.Warningf("archive: failed after archiving %d items (%v)", n, err)
+		}
+	}
+}
+
+// Archive archives items completed more than 'olderThan' ago,
+// and returns the number of archived items.
+func (a *Archiver) Archive(ctx context.Context) (int64, error) {
+	now := a.now()
+	items, err := a.qu.ListCompletedBefore(ctx, now.Add(-a.olderThan))
+	if err != nil {
+		return 0, err
+	}
+
+	groups := make(map[string][]*Record)
+	for _, item := range items {
+		rec, err := a.record(ctx, item)
+		if err != nil {
+			return 0, err
+		}
+		dir := dirKey(item.Bucket, item.CompletedAt)
+		groups[dir] = append(groups[dir], rec)
+	}
+	dirs := make([]string, 0, len(groups))
+	for dir := range groups {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var archived int64
+	for _, dir := range dirs {
+		data, err := encode(groups[dir])
+		if err != nil {
+			return archived, err
+		}
+		key := path.Join(dir, fmt.Sprintf("%035X.ndjson.gz", now.UnixNano()))
+		if err = a.st.Put(key, data); err != nil {
+			return archived, fmt.Errorf("failed to write %q (%v)", key, err)
+		}
+		recItems := make([]*etcdqueue.Item, len(groups[dir]))
+		for i, rec := range groups[dir] {
+			recItems[i] = rec.Item
+		}
+		n, err := a.qu.DeleteCompleted(ctx, recItems...)
+		archived += n
+		if err != nil {
+			return archived, err
+		}
+		glog.Infof("archive: archived %d items to %q", n, key)
+	}
+	return archived, nil
+}
+
+// Record is an archived item.
+type Record struct {
+	Item        *etcdqueue.Item         `json:"item"`
+	Annotations []*etcdqueue.Annotation `json:"annotations,omitempty"`
+	Metrics     []*etcdqueue.Metric     `json:"metrics,omitempty"`
+}
+
+// record returns the record of the item, with its annotations and metrics.
+func (a *Archiver) record(ctx context.Context, item *etcdqueue.Item) (*Record, error) {
+	as, err := a.qu.Annotations(ctx, item.Key)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := a.qu.Metrics(ctx, item.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &Record{Item: item, Annotations: as, Metrics: ms}, nil
+}
+
+// dirKey returns the directory key of the bucket and completion date.
+func dirKey(bucket string, completedAt time.Time) string {
+	return path.Join(bucketKey(bucket), completedAt.UTC().Format("2006-01-02"))
+}
+
+func bucketKey(bucket string) string {
+	return strings.TrimPrefix(bucket, "/")
+}
+
+// encode returns the gzip-compressed NDJSON of the records.
+func encode(recs []*Record) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Query selects archived items.
+type Query struct {
+	// Bucket is the bucket of items (required).
+	Bucket string
+
+	// Since and Until select items completed in [Since, Until).
+	// Zero values are unbounded.
+	Since time.Time
+	Until time.Time
+
+	// Key selects the item of the key, if not empty.
+	Key string
+}
+
+// Find returns archived items matching the query, in the order of completion.
+func Find(st Storage, q Query) ([]*Record, error) {
+	if q.Bucket == "" {
+		return nil, fmt.Errorf("empty bucket")
+	}
+	keys, err := st.List(bucketKey(q.Bucket) + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	// an item archived more than once has multiple copies, keep the last
+	var recs []*Record
+	idx := make(map[string]int)
+	for _, key := range keys {
+		if !q.matchDate(path.Base(path.Dir(key))) {
+			continue
+		}
+		err = decode(st, key, func(rec *Record) {
+			if !q.match(rec.Item) {
+				return
+			}
+			if i, ok := idx[rec.Item.Key]; ok {
+				recs[i] = rec
+				return
+			}
+			idx[rec.Item.Key] = len(recs)
+			recs = append(recs, rec)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].Item.CompletedAt.Before(recs[j].Item.CompletedAt) })
+	return recs, nil
+}
+
+// matchDate returns false if no item completed on the date (of
+// "YYYY-MM-DD" directory) can match the query.
+func (q Query) matchDate(date string) bool {
+	day, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return false
+	}
+	if !q.Since.IsZero() && !day.Add(24*time.Hour).After(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !day.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+func (q Query) match(item *etcdqueue.Item) bool {
+	if item.Bucket != q.Bucket || (q.Key != "" && item.Key != q.Key) {
+		return false
+	}
+	if !q.Since.IsZero() && item.CompletedAt.Before(q.Since) {
+		return false
+	}
+	return q.Until.IsZero() || item.CompletedAt.Before(q.Until)
+}
+
+// decode calls the function on each record in the archive file. Files
+// archived before records are lines of items.
+func decode(st Storage, key string, f func(*Record)) error {
+	rc, err := st.Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return fmt.Errorf("%q is not gzip file (%v)", key, err)
+	}
+	defer zr.Close()
+
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		var rec Record
+		if err = json.Unmarshal(sc.Bytes(), &rec); err == nil && rec.Item == nil {
+			rec.Item = new(etcdqueue.Item)
+			err = json.Unmarshal(sc.Bytes(), rec.Item)
+		}
+		if err != nil {
+			return fmt.Errorf("%q has wrong JSON %q (%v)", key, sc.Text(), err)
+		}
+		f(&rec)
+	}
+	return sc.Err()
+}
@@ -0,0 +1,170 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func TestArchiver(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	qu, err := etcdqueue.NewEmbeddedQueue(context.Background(), 35379, 35380, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	archiveDir, err := ioutil.TempDir(os.TempDir(), "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archiveDir)
+	st, err := NewDirStorage(archiveDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var items []*etcdqueue.Item
+	for i := 0; i < 3; i++ {
+		item := etcdqueue.CreateItem("/cats-request", 100, "data")
+		if err = qu.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+		popped := <-qu.Pop(ctx, "/cats-request")
+		if err = qu.Annotate(ctx, popped.Key, &etcdqueue.Annotation{Text: "note"}); err != nil {
+			t.Fatal(err)
+		}
+		if err = qu.AppendMetrics(ctx, popped.Key, &etcdqueue.Metric{Name: "loss", Epoch: i, Value: 0.5}); err != nil {
+			t.Fatal(err)
+		}
+		popped.Progress = etcdqueue.MaxProgress
+		if err = qu.Complete(ctx, popped); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, popped)
+	}
+
+	// nothing is old enough
+	a := New(qu, st, time.Hour)
+	n, err := a.Archive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected no archived item, got %d", n)
+	}
+
+	a.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if n, err = a.Archive(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 archived items, got %d", n)
+	}
+	completed, err := qu.ListCompleted(ctx, "/cats-request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 0 {
+		t.Fatalf("expected no completed item in queue, got %d", len(completed))
+	}
+
+	found, err := Find(st, Query{Bucket: "/cats-request"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 {
+		t.Fatalf("expected 3 items, got %d", len(found))
+	}
+	for i := range items {
+		if err = items[i].Equal(found[i].Item); err != nil {
+			t.Fatal(err)
+		}
+		if len(found[i].Annotations) != 1 || found[i].Annotations[0].Text != "note" {
+			t.Fatalf("expected the annotation, got %+v", found[i].Annotations)
+		}
+		if len(found[i].Metrics) != 1 || found[i].Metrics[0].Epoch != i {
+			t.Fatalf("expected the metric of epoch %d, got %+v", i, found[i].Metrics)
+		}
+	}
+
+	// annotations and metrics are deleted with their items
+	as, err := qu.Annotations(ctx, items[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := qu.Metrics(ctx, items[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 0 || len(ms) != 0 {
+		t.Fatalf("expected no annotations and metrics, got %+v and %+v", as, ms)
+	}
+
+	if found, err = Find(st, Query{Bucket: "/cats-request", Key: items[1].Key}); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Item.Key != items[1].Key {
+		t.Fatalf("expected %q, got %+v", items[1].Key, found)
+	}
+	if found, err = Find(st, Query{Bucket: "/cats-request", Until: items[0].CompletedAt}); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Fatalf("expected no item, got %d", len(found))
+	}
+	if _, err = Find(st, Query{}); err == nil {
+		t.Fatal("expected error on empty bucket")
+	}
+}
+
+func TestDecodeItems(t *testing.T) {
+	archiveDir, err := ioutil.TempDir(os.TempDir(), "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archiveDir)
+	st, err := NewDirStorage(archiveDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// files archived before records are lines of items
+	item := etcdqueue.CreateItem("/cats-request", 100, "data")
+	item.CompletedAt = time.Now()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err = json.NewEncoder(zw).Encode(item); err != nil {
+		t.Fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = st.Put(path.Join(dirKey(item.Bucket, item.CompletedAt), "old.ndjson.gz"), buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := Find(st, Query{Bucket: "/cats-request"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 {
+		t.Fatalf("expected 1 item, got %d", len(found))
+	}
+	if err = item.Equal(found[0].Item); err != nil {
+		t.Fatal(err)
+	}
+}
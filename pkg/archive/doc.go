@@ -0,0 +1,4 @@
+// Package archive moves old completed queue items out of etcd into
+// compressed NDJSON files (local directory or object storage), and
+// queries the archived items.
+package archive
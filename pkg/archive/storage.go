@@ -0,0 +1,101 @@
+package archive
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gyuho/dplearn/pkg/fileutil"
+	"github.com/gyuho/dplearn/pkg/gcp"
+)
+
+// Storage stores archive files by key.
+type Storage interface {
+	// Put writes the data to the key.
+	Put(key string, data []byte) error
+
+	// Get returns the reader of the data of the key.
+	Get(key string) (io.ReadCloser, error)
+
+	// List returns all keys with the prefix, in sorted order.
+	List(prefix string) ([]string, error)
+}
+
+type dirStorage struct {
+	dir string
+}
+
+// NewDirStorage returns a Storage of files in the local directory.
+func NewDirStorage(dir string) (Storage, error) {
+	if err := fileutil.TouchDirAll(dir); err != nil {
+		return nil, err
+	}
+	return &dirStorage{dir: dir}, nil
+}
+
+func (s *dirStorage) Put(key string, data []byte) error {
+	fpath := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := fileutil.TouchDirAll(filepath.Dir(fpath)); err != nil {
+		return err
+	}
+	// rename so that readers never see partial files
+	tmp := fpath + ".tmp"
+	if err := fileutil.WriteToFile(tmp, data); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fpath)
+}
+
+func (s *dirStorage) Get(key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, filepath.FromSlash(key)))
+}
+
+func (s *dirStorage) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(s.dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(fpath, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, fpath)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+type gcsStorage struct {
+	s *gcp.Storage
+}
+
+// NewGCS returns a Storage backed by Google Cloud Storage.
+func NewGCS(s *gcp.Storage) Storage {
+	return &gcsStorage{s: s}
+}
+
+func (s *gcsStorage) Put(key string, data []byte) error {
+	return s.s.Put(key, data)
+}
+
+func (s *gcsStorage) Get(key string) (io.ReadCloser, error) {
+	return s.s.Get(key)
+}
+
+func (s *gcsStorage) List(prefix string) ([]string, error) {
+	keys, err := s.s.ListPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,239 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// OutcomeSuccess is the outcome of committed queue mutations.
+	OutcomeSuccess = "success"
+	// OutcomeDenied is the outcome of operations denied by bucket ACLs.
+	OutcomeDenied = "denied"
+)
+
+// Record is an audit record of a queue event. Item data is not exported.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Action  string    `json:"action"`
+	Bucket  string    `json:"bucket"`
+	Key     string    `json:"key,omitempty"`
+	Outcome string    `json:"outcome"`
+
+	// Rev is the etcd revision of the event, to deduplicate records
+	// exported more than once.
+	Rev int64 `json:"rev"`
+}
+
+// NewRecord returns the audit record of the journaled event.
+func NewRecord(ev *etcdqueue.Event) *Record {
+	r := &Record{
+		Time:    ev.CreatedAt,
+		Actor:   ev.Actor,
+		Action:  string(ev.Type),
+		Bucket:  ev.Bucket,
+		Key:     ev.Key,
+		Outcome: OutcomeSuccess,
+		Rev:     ev.Rev,
+	}
+	if ev.Type == etcdqueue.EventDenied {
+		r.Action = strings.ToLower(ev.Op)
+		r.Outcome = OutcomeDenied
+	}
+	return r
+}
+
+// Format is the encoding of audit records.
+type Format string
+
+const (
+	// FormatJSON encodes records in JSON, one per line.
+	FormatJSON Format = "json"
+	// FormatCEF encodes records in ArcSight Common Event Format.
+	FormatCEF Format = "cef"
+)
+
+// Encode encodes the record in the format, without trailing newline.
+func (f Format) Encode(r *Record) ([]byte, error) {
+	switch f {
+	case FormatJSON:
+		return json.Marshal(r)
+	case FormatCEF:
+		return encodeCEF(r), nil
+	default:
+		return nil, fmt.Errorf("unknown audit format %q", f)
+	}
+}
+
+// severity returns the CEF severity of the record (0-10).
+func severity(r *Record) int {
+	switch {
+	case r.Outcome == OutcomeDenied:
+		return 7
+	case r.Action == string(etcdqueue.EventCancel), r.Action == string(etcdqueue.EventPurge):
+		return 5
+	default:
+		return 3
+	}
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// encodeCEF encodes the record as:
+//
+//	CEF:0|dplearn|etcd-queue|1.0|<action>|<action>|<severity>|rt=... suser=... act=... cs1Label=bucket cs1=... fname=... outcome=... cn1Label=rev cn1=...
+func encodeCEF(r *Record) []byte {
+	var buf bytes.Buffer
+	action := cefHeaderEscaper.Replace(r.Action)
+	fmt.Fprintf(&buf, "CEF:0|dplearn|etcd-queue|1.0|%s|%s|%d|", action, action, severity(r))
+
+	ext := [][2]string{
+		{"rt", strconv.FormatInt(r.Time.UnixNano()/int64(time.Millisecond), 10)},
+		{"suser", r.Actor},
+		{"act", r.Action},
+		{"cs1Label", "bucket"},
+		{"cs1", r.Bucket},
+		{"fname", r.Key},
+		{"outcome", r.Outcome},
+		{"cn1Label", "rev"},
+		{"cn1", strconv.FormatInt(r.Rev, 10)},
+	}
+	first := true
+	for _, kv := range ext {
+		if kv[1] == "" {
+			continue
+		}
+		if !first {
+			buf.WriteByte(' ')
+		}
+		first = false
+		buf.WriteString(kv[0])
+		buf.WriteByte('=')
+		buf.WriteString(cefExtensionEscaper.Replace(kv[1]))
+	}
+	return buf.Bytes()
+}
+
+// Config defines exporter configuration.
+type Config struct {
+	// Name identifies the exporter, to persist its cursor.
+	Name string
+
+	// Format is the encoding of records. Defaults to FormatJSON.
+	Format Format
+
+	// PollInterval is the interval to read new events. Defaults to 1 second.
+	PollInterval time.Duration
+}
+
+// Exporter streams queue events from the journal to the sink as audit
+// records. Its cursor is persisted in etcd after each write, so that it
+// resumes after restart (at-least-once delivery, deduplicated by 'Rev').
+type Exporter struct {
+	cfg  Config
+	qu   etcdqueue.Queue
+	sink Sink
+}
+
+// New creates a new exporter.
+func New(cfg Config, qu etcdqueue.Queue, sink Sink) (*Exporter, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("invalid audit config %+v", cfg)
+	}
+	if cfg.Format == "" {
+		cfg.Format = FormatJSON
+	}
+	if _, err := cfg.Format.Encode(&Record{}); err != nil {
+		return nil, err
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = time.Second
+	}
+	return &Exporter{cfg: cfg, qu: qu, sink: sink}, nil
+}
+
+const pfxAudit = "_audit"
+
+func (e *Exporter) cursorKey() string {
+	return path.Join(pfxAudit, e.cfg.Name, "cursor")
+}
+
+// Cursor returns the next revision to export.
+func (e *Exporter) Cursor(ctx context.Context) (int64, error) {
+	resp, err := e.qu.Client().Get(ctx, e.cursorKey())
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
+}
+
+// Run exports events until the context is canceled.
+func (e *Exporter) Run(ctx context.Context) error {
+	cursor, err := e.Cursor(ctx)
+	if err != nil {
+		return err
+	}
+	glog.Infof("audit %q starting from revision %d", e.cfg.Name, cursor)
+
+	for {
+		cursor, err = e.export(ctx, cursor)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			glog.Warningf("audit %q failed at revision %d (%v)", e.cfg.Name, cursor, err)
+		}
+
+		select {
+		case <-time.After(e.cfg.PollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// readLimit is the number of events read at a time from the journal.
+const readLimit = 1000
+
+// export writes all events from the cursor, in pages of 'readLimit'
+// events, and returns the next cursor.
+func (e *Exporter) export(ctx context.Context, cursor int64) (int64, error) {
+	for {
+		evs, err := e.qu.ReadEvents(ctx, cursor, etcdqueue.WithLimit(readLimit))
+		if err != nil || len(evs) == 0 {
+			return cursor, err
+		}
+		lines := make([][]byte, 0, len(evs))
+		for _, ev := range evs {
+			line, err := e.cfg.Format.Encode(NewRecord(ev))
+			if err != nil {
+				return cursor, err
+			}
+			lines = append(lines, line)
+		}
+		if err = e.sink.Write(ctx, lines); err != nil {
+			return cursor, err
+		}
+		cursor = evs[len(evs)-1].Rev + 1
+		if _, err = e.qu.Client().Put(ctx, e.cursorKey(), strconv.FormatInt(cursor, 10)); err != nil || len(evs) < readLimit {
+			return cursor, err
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func TestEncodeCEF(t *testing.T) {
+	r := &Record{
+		Time:    time.Unix(1, 0),
+		Actor:   "web=1",
+		Action:  "add",
+		Bucket:  "/cats|request",
+		Key:     "/cats|request/00001",
+		Outcome: OutcomeDenied,
+		Rev:     5,
+	}
+	data, err := FormatCEF.Encode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `CEF:0|dplearn|etcd-queue|1.0|add|add|7|rt=1000 suser=web\=1 act=add cs1Label=bucket cs1=/cats|request fname=/cats|request/00001 outcome=denied cn1Label=rev cn1=5`
+	if string(data) != expected {
+		t.Fatalf("expected %s, got %s", expected, data)
+	}
+	if _, err = Format("xml").Encode(r); err == nil {
+		t.Fatal("expected unknown format error")
+	}
+}
+
+func TestExporter(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := etcdqueue.NewEmbeddedQueue(context.Background(), 36379, 36380, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	acl := etcdqueue.ACL{Grants: map[string]etcdqueue.Role{"web": etcdqueue.RoleEnqueue}}
+	if err = qu.SetACL(ctx, "test-bucket", acl); err != nil {
+		t.Fatal(err)
+	}
+	aq := etcdqueue.NewACLQueue(qu)
+	item := etcdqueue.CreateItem("test-bucket", 100, "test-data")
+	if err = aq.Add(etcdqueue.WithIdentity(ctx, "web"), item); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = aq.Purge(etcdqueue.WithIdentity(ctx, "web"), "test-bucket"); !etcdqueue.IsAccessDenied(err) {
+		t.Fatalf("expected AccessDeniedError, got %v", err)
+	}
+
+	fpath := filepath.Join(dataDir, "audit.log")
+	sink, err := NewFileSink(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	e, err := New(Config{Name: "test"}, qu, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := e.export(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = e.export(ctx, cursor); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records without duplicates, got %q", lines)
+	}
+	var added, denied Record
+	if err = json.Unmarshal([]byte(lines[0]), &added); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal([]byte(lines[1]), &denied); err != nil {
+		t.Fatal(err)
+	}
+	if added.Actor != "web" || added.Action != "add" || added.Key != item.Key || added.Outcome != OutcomeSuccess {
+		t.Fatalf("unexpected record %+v", added)
+	}
+	if denied.Actor != "web" || denied.Action != "purge" || denied.Bucket != "test-bucket" || denied.Outcome != OutcomeDenied {
+		t.Fatalf("unexpected record %+v", denied)
+	}
+
+	// HTTP sinks post batches of records
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer ts.Close()
+	e, err = New(Config{Name: "siem", Format: FormatCEF}, qu, NewHTTPSink(ts.URL, "wrong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = e.export(ctx, 0); err == nil {
+		t.Fatal("expected unauthorized error")
+	}
+	e.sink = NewHTTPSink(ts.URL, "token")
+	if _, err = e.export(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(body, []byte("CEF:0|")) != 2 {
+		t.Fatalf("expected 2 CEF records, got %q", body)
+	}
+}
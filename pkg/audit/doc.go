@@ -0,0 +1,4 @@
+// Package audit exports queue audit events (actor, action, bucket, key,
+// and outcome) in JSON or CEF to files or HTTP collectors, for security
+// information and event management (SIEM) systems.
+package audit
@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Sink writes encoded audit records.
+type Sink interface {
+	// Write writes the records, one per line.
+	Write(ctx context.Context, lines [][]byte) error
+
+	// Close closes the sink.
+	Close() error
+}
+
+type fileSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFileSink returns a Sink appending records to the file
+// (e.g. tailed by log shippers).
+func NewFileSink(fpath string) (Sink, error) {
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{f: f}, nil
+}
+
+func (s *fileSink) Write(ctx context.Context, lines [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(joinLines(lines)); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *fileSink) Close() error {
+	return s.f.Close()
+}
+
+type httpSink struct {
+	endpoint string
+	token    string
+	cli      *http.Client
+}
+
+// NewHTTPSink returns a Sink posting records to the HTTP endpoint
+// (e.g. a SIEM collector), one request per batch with a record per line.
+// The token is sent as 'Authorization: Bearer <token>', if not empty.
+func NewHTTPSink(endpoint, token string) Sink {
+	return &httpSink{endpoint: endpoint, token: token, cli: http.DefaultClient}
+}
+
+func (s *httpSink) Write(ctx context.Context, lines [][]byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(joinLines(lines)))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%q returned %s", s.endpoint, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
+
+func joinLines(lines [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,142 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/golang/glog"
+)
+
+// Publisher publishes messages to a topic.
+type Publisher interface {
+	// Publish publishes data to the topic, keyed by the item key.
+	Publish(ctx context.Context, topic, key string, data []byte) error
+
+	// Close closes the publisher.
+	Close() error
+}
+
+// Config defines bridge configuration.
+type Config struct {
+	// Name identifies the bridge, to persist its cursor.
+	Name string
+
+	// TopicPrefix is prepended to event types to build topic names
+	// (e.g. "dplearn.queue" publishes to "dplearn.queue.add").
+	TopicPrefix string
+
+	// PollInterval is the interval to read new events. Defaults to 1 second.
+	PollInterval time.Duration
+}
+
+// Bridge republishes queue events from the journal.
+// Its cursor is persisted in etcd after each publish,
+// so that it resumes after restart (at-least-once delivery).
+type Bridge struct {
+	cfg Config
+	qu  etcdqueue.Queue
+	pub Publisher
+}
+
+// New creates a new bridge.
+func New(cfg Config, qu etcdqueue.Queue, pub Publisher) (*Bridge, error) {
+	if cfg.Name == "" || cfg.TopicPrefix == "" {
+		return nil, fmt.Errorf("invalid bridge config %+v", cfg)
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = time.Second
+	}
+	return &Bridge{cfg: cfg, qu: qu, pub: pub}, nil
+}
+
+const pfxBridge = "_bridge"
+
+func (b *Bridge) cursorKey() string {
+	return path.Join(pfxBridge, b.cfg.Name, "cursor")
+}
+
+// Cursor returns the next revision to publish.
+func (b *Bridge) Cursor(ctx context.Context) (int64, error) {
+	resp, err := b.qu.Client().Get(ctx, b.cursorKey())
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
+}
+
+// Topic returns the topic name of the event type.
+func (b *Bridge) Topic(tp etcdqueue.EventType) string {
+	return b.cfg.TopicPrefix + "." + string(tp)
+}
+
+// Run publishes events until the context is canceled.
+func (b *Bridge) Run(ctx context.Context) error {
+	cursor, err := b.Cursor(ctx)
+	if err != nil {
+		return err
+	}
+	glog.Infof("bridge %q starting from revision %d", b.cfg.Name, cursor)
+
+	for {
+		cursor, err = b.publish(ctx, cursor)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			glog.Warningf("bridge %q failed at revision %d (%v)", b.cfg.Name, cursor, err)
+		}
+
+		select {
+		case <-time.After(b.cfg.PollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// readLimit is the number of events read at a time from the journal.
+const readLimit = 1000
+
+// publish publishes all events from the cursor, in pages of 'readLimit'
+// events, and returns the next cursor.
+func (b *Bridge) publish(ctx context.Context, cursor int64) (int64, error) {
+	for {
+		evs, err := b.qu.ReadEvents(ctx, cursor, etcdqueue.WithLimit(readLimit))
+		if err != nil {
+			return cursor, err
+		}
+		for i, ev := range evs {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return cursor, err
+			}
+			key := ev.Key
+			if key == "" {
+				key = ev.Bucket
+			}
+			if err = b.pub.Publish(ctx, b.Topic(ev.Type), key, data); err != nil {
+				return cursor, err
+			}
+
+			// events in the same revision must all be published before moving the cursor
+			if i == len(evs)-1 || evs[i+1].Rev != ev.Rev {
+				cursor = ev.Rev + 1
+				if _, err = b.qu.Client().Put(ctx, b.cursorKey(), strconv.FormatInt(cursor, 10)); err != nil {
+					return cursor, err
+				}
+			}
+		}
+		if len(evs) < readLimit {
+			return cursor, nil
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package bridge
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+type message struct {
+	topic, key string
+}
+
+type fakePublisher struct {
+	mu   sync.Mutex
+	msgs []message
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, topic, key string, data []byte) error {
+	p.mu.Lock()
+	p.msgs = append(p.msgs, message{topic: topic, key: key})
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *fakePublisher) Close() error { return nil }
+
+func TestBridge(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := etcdqueue.NewEmbeddedQueue(context.Background(), 32379, 32380, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	item := etcdqueue.CreateItem("test-bucket", 100, "test-data")
+	if err = qu.Add(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	<-qu.Pop(context.Background(), "test-bucket")
+
+	pub := &fakePublisher{}
+	b, err := New(Config{Name: "test", TopicPrefix: "dplearn.queue"}, qu, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := b.publish(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pub.msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %+v", pub.msgs)
+	}
+	if pub.msgs[0] != (message{topic: "dplearn.queue.add", key: item.Key}) || pub.msgs[1].topic != "dplearn.queue.pop" {
+		t.Fatalf("unexpected messages %+v", pub.msgs)
+	}
+
+	saved, err := b.Cursor(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != cursor {
+		t.Fatalf("expected cursor %d, got %d", cursor, saved)
+	}
+	if _, err = b.publish(context.Background(), saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(pub.msgs) != 2 {
+		t.Fatalf("expected no duplicate messages, got %+v", pub.msgs)
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	linec := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {}\r\n"))
+		rd := bufio.NewReader(conn)
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			linec <- strings.TrimSpace(line)
+		}
+	}()
+
+	pub, err := NewNATSPublisher(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Publish(context.Background(), "dplearn.queue.add", "key", []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for len(lines) < 3 {
+		select {
+		case line := <-linec:
+			lines = append(lines, line)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected NATS protocol lines, got %q", lines)
+		}
+	}
+	if !strings.HasPrefix(lines[0], "CONNECT ") || lines[1] != "PUB dplearn.queue.add 7" || lines[2] != `{"a":1}` {
+		t.Fatalf("unexpected NATS protocol lines %q", lines)
+	}
+	pub.Close()
+}
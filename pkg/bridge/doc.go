@@ -0,0 +1,2 @@
+// Package bridge republishes queue events to external streaming systems.
+package bridge
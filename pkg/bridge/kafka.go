@@ -0,0 +1,69 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// kafkaRESTPublisher publishes messages via Kafka REST Proxy v2.
+// See https://docs.confluent.io/current/kafka-rest/docs/api.html.
+type kafkaRESTPublisher struct {
+	endpoint string
+	cli      *http.Client
+}
+
+// NewKafkaRESTPublisher creates a publisher to the Kafka REST Proxy
+// (e.g. "http://localhost:8082"). Topic names must not contain '/'.
+func NewKafkaRESTPublisher(endpoint string, cli *http.Client) Publisher {
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	return &kafkaRESTPublisher{endpoint: strings.TrimSuffix(endpoint, "/"), cli: cli}
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+func (p *kafkaRESTPublisher) Publish(ctx context.Context, topic, key string, data []byte) error {
+	body, err := json.Marshal(kafkaRecords{Records: []kafkaRecord{{Key: key, Value: data}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.endpoint+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := p.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kafka %q returned %d (%s)", topic, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+func (p *kafkaRESTPublisher) Close() error {
+	return nil
+}
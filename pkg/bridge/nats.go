@@ -0,0 +1,97 @@
+package bridge
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// natsPublisher publishes messages using NATS text protocol.
+// See https://nats.io/documentation/internals/nats-protocol/.
+type natsPublisher struct {
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+
+	donec chan struct{}
+}
+
+// NewNATSPublisher connects to the NATS server (e.g. "localhost:4222").
+// NATS subjects are the topic names.
+func NewNATSPublisher(addr string) (Publisher, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(conn)
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected NATS greeting %q", line)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	p := &natsPublisher{conn: conn, w: bufio.NewWriter(conn), donec: make(chan struct{})}
+	if err = p.write("CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"dplearn-bridge\"}\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go p.readLoop(rd)
+	return p, nil
+}
+
+// readLoop answers server PINGs, and logs server errors.
+func (p *natsPublisher) readLoop(rd *bufio.Reader) {
+	defer close(p.donec)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			if err = p.write("PONG\r\n"); err != nil {
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			glog.Warningf("NATS error %q", strings.TrimSpace(line))
+		}
+	}
+}
+
+func (p *natsPublisher) write(s string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.WriteString(s); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, topic, key string, data []byte) error {
+	if strings.ContainsAny(topic, " \t\r\n") {
+		return fmt.Errorf("invalid NATS subject %q", topic)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		p.conn.SetWriteDeadline(dl)
+		defer p.conn.SetWriteDeadline(time.Time{})
+	}
+	return p.write(fmt.Sprintf("PUB %s %d\r\n%s\r\n", topic, len(data), data))
+}
+
+func (p *natsPublisher) Close() error {
+	err := p.conn.Close()
+	<-p.donec
+	return err
+}
@@ -0,0 +1,252 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/golang/glog"
+)
+
+// RequestIDHeader is the field name for request ID header.
+// Must be in sync with 'backend/web.RequestIDHeader'.
+const RequestIDHeader = "Request-Id"
+
+// userAgent identifies the client. Backend derives user IDs
+// from user agent, so it must be the same across requests.
+const userAgent = "dplearn-client"
+
+// Config defines client configuration.
+type Config struct {
+	// Endpoint is the backend URL (e.g. "http://localhost:2200").
+	Endpoint string
+
+	// Token is sent as bearer token in 'Authorization' header, if not empty.
+	Token string
+
+	// Retries is the number of retries on network errors or 5xx responses.
+	Retries int
+
+	// RetryInterval is the wait time before the first retry,
+	// doubled on every retry.
+	RetryInterval time.Duration
+
+	// TLS configures the transport for HTTPS endpoints (e.g. client
+	// certificates of 'tlsutil.Reloader.ClientConfig' for mutual TLS).
+	// Ignored if HTTPClient is set.
+	TLS *tls.Config
+
+	// HTTPClient is used to send requests. Defaults to 'http.DefaultClient'.
+	HTTPClient *http.Client
+}
+
+// Client is the client for backend HTTP API.
+type Client struct {
+	cfg Config
+}
+
+// New creates a new client.
+func New(cfg Config) (*Client, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("empty endpoint")
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	if cfg.RetryInterval == 0 {
+		cfg.RetryInterval = 100 * time.Millisecond
+	}
+	if cfg.HTTPClient == nil && cfg.TLS != nil {
+		cfg.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: cfg.TLS,
+		}}
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	return &Client{cfg: cfg}, nil
+}
+
+// request defines requests to backend.
+// Must be in sync with 'backend/web.Request'.
+type request struct {
+	DataFromFrontend string `json:"data_from_frontend"`
+	CreateRequest    bool   `json:"create_request"`
+}
+
+// SubmitCatsVsDogs requests classification of the image URL,
+// and returns the created item with request ID.
+func (c *Client) SubmitCatsVsDogs(ctx context.Context, imageURL string) (*etcdqueue.Item, error) {
+	body, err := json.Marshal(request{DataFromFrontend: imageURL, CreateRequest: true})
+	if err != nil {
+		return nil, err
+	}
+	var item etcdqueue.Item
+	if err = c.do(ctx, http.MethodPost, "/cats-request", nil, body, &item); err != nil {
+		return nil, err
+	}
+	if item.Error != "" {
+		return &item, fmt.Errorf("failed to submit %q (%s)", imageURL, item.Error)
+	}
+	return &item, nil
+}
+
+// Status returns the latest status of the request.
+func (c *Client) Status(ctx context.Context, requestID string) (*etcdqueue.Item, error) {
+	var item etcdqueue.Item
+	if err := c.do(ctx, http.MethodGet, "/cats-request", map[string]string{RequestIDHeader: requestID}, nil, &item); err != nil {
+		return nil, err
+	}
+	if item.Error != "" {
+		return &item, fmt.Errorf("failed to get status of %q (%s)", requestID, item.Error)
+	}
+	return &item, nil
+}
+
+// Cancel cancels the request of the image URL.
+func (c *Client) Cancel(ctx context.Context, imageURL string) error {
+	body, err := json.Marshal(request{DataFromFrontend: imageURL, CreateRequest: false})
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, "/cats-request", nil, body, nil)
+}
+
+// WatchSSE streams status updates of the request from server-sent events.
+// The channel is closed when the request finishes, or the context is canceled.
+func (c *Client) WatchSSE(ctx context.Context, requestID string) (<-chan *etcdqueue.Item, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/cats-request/watch", map[string]string{RequestIDHeader: requestID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("watch %q returned %d (%s)", requestID, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	ch := make(chan *etcdqueue.Item)
+	go func() {
+		defer close(ch)
+		defer resp.Body.Close()
+
+		var data bytes.Buffer
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "data:"):
+				data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+				continue
+			case line != "":
+				continue // ignore other fields (e.g. 'event', 'id')
+			}
+			if data.Len() == 0 {
+				continue
+			}
+			var item etcdqueue.Item
+			if err := json.Unmarshal(data.Bytes(), &item); err != nil {
+				item = etcdqueue.Item{Error: fmt.Sprintf("wrong JSON %q (%v)", data.String(), err)}
+			}
+			data.Reset()
+			select {
+			case ch <- &item:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			glog.Warningf("watch %q stopped (%v)", requestID, err)
+		}
+	}()
+	return ch, nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, headers map[string]string, body []byte) (*http.Request, error) {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.cfg.Endpoint+path, rd)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", userAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// do sends the request with retries, and decodes JSON response into 'out'.
+// Empty response body is allowed.
+func (c *Client) do(ctx context.Context, method, path string, headers map[string]string, body []byte, out interface{}) error {
+	interval := c.cfg.RetryInterval
+	var err error
+	for i := 0; i <= c.cfg.Retries; i++ {
+		if i > 0 {
+			glog.Warningf("retrying %s %q (%v)", method, path, err)
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			interval *= 2
+		}
+
+		var req *http.Request
+		req, err = c.newRequest(ctx, method, path, headers, body)
+		if err != nil {
+			return err
+		}
+		var resp *http.Response
+		resp, err = c.cfg.HTTPClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		var b []byte
+		b, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case resp.StatusCode >= 500:
+			err = fmt.Errorf("%s %q returned %d (%s)", method, path, resp.StatusCode, strings.TrimSpace(string(b)))
+			continue
+		case resp.StatusCode != http.StatusOK:
+			return fmt.Errorf("%s %q returned %d (%s)", method, path, resp.StatusCode, strings.TrimSpace(string(b)))
+		}
+		if out == nil || len(bytes.TrimSpace(b)) == 0 {
+			return nil
+		}
+		return json.Unmarshal(b, out)
+	}
+	return err
+}
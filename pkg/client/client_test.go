@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func TestClient(t *testing.T) {
+	var failures int32 = 2
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cats-request", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(&etcdqueue.Item{RequestID: req.Header.Get(RequestIDHeader), Progress: 50})
+		case http.MethodPost:
+			var r request
+			b, _ := ioutil.ReadAll(req.Body)
+			json.Unmarshal(b, &r)
+			if r.CreateRequest {
+				json.NewEncoder(w).Encode(&etcdqueue.Item{Bucket: "/cats-request", Value: r.DataFromFrontend, RequestID: "test-id"})
+			}
+		}
+	})
+	mux.HandleFunc("/cats-request/watch", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, p := range []int{0, 50, 100} {
+			fmt.Fprintf(w, "data: {\"request_id\":%q,\"progress\":%d}\n\n", req.Header.Get(RequestIDHeader), p)
+			w.(http.Flusher).Flush()
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cli, err := New(Config{Endpoint: ts.URL, Token: "test-token", Retries: 3, RetryInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := cli.SubmitCatsVsDogs(context.Background(), "https://test.com/cat.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.RequestID != "test-id" || item.Value != "https://test.com/cat.jpg" {
+		t.Fatalf("unexpected item %+v", item)
+	}
+
+	item, err = cli.Status(context.Background(), "test-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.RequestID != "test-id" || item.Progress != 50 {
+		t.Fatalf("unexpected item %+v", item)
+	}
+
+	if err = cli.Cancel(context.Background(), "https://test.com/cat.jpg"); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := cli.WatchSSE(context.Background(), "test-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var progress []int
+	for item := range ch {
+		if item.Error != "" || item.RequestID != "test-id" {
+			t.Fatalf("unexpected item %+v", item)
+		}
+		progress = append(progress, item.Progress)
+	}
+	if fmt.Sprint(progress) != "[0 50 100]" {
+		t.Fatalf("unexpected progress %v", progress)
+	}
+
+	unauthorized, err := New(Config{Endpoint: ts.URL, Retries: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = unauthorized.Status(context.Background(), "test-id"); err == nil {
+		t.Fatal("expected error on unauthorized request")
+	}
+}
@@ -0,0 +1,2 @@
+// Package client implements Go client for backend HTTP API.
+package client
@@ -0,0 +1,269 @@
+package dataset
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/fileutil"
+	"github.com/gyuho/dplearn/pkg/urlutil"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+	"github.com/gyuho/archiver"
+)
+
+// BucketPrefix is the bucket prefix for all dataset shards.
+// Shards of each dataset are scheduled in "/datasets/[DATASET NAME]".
+const BucketPrefix = "/datasets"
+
+// Bucket returns the bucket name for shards of the dataset.
+func Bucket(name string) string {
+	return path.Join(BucketPrefix, name)
+}
+
+// Config defines dataset ingestion configuration.
+type Config struct {
+	// Name is the dataset name (e.g. "cats-vs-dogs").
+	Name string
+
+	// SourceURL is the URL to download the dataset from.
+	SourceURL string
+
+	// Checksum is the expected SHA-256 hex digest of downloaded file.
+	// Leave empty to skip verification.
+	Checksum string
+
+	// DownloadPath is the file path to store the downloaded file.
+	DownloadPath string
+
+	// OutputDir is the directory to unarchive the downloaded file.
+	// If the file is not an archive, the downloaded file is sharded as is.
+	OutputDir string
+
+	// ShardSize is the number of files per shard.
+	ShardSize int
+
+	// Weight is the weight of shard items.
+	Weight uint64
+}
+
+// Dataset is the registered dataset, stored in etcd.
+type Dataset struct {
+	Name      string    `json:"name"`
+	SourceURL string    `json:"source_url"`
+	Checksum  string    `json:"checksum"`
+	Files     int       `json:"files"`
+	Shards    int       `json:"shards"`
+	Bucket    string    `json:"bucket"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Shard is a chunk of dataset files, encoded as Item Value.
+type Shard struct {
+	Dataset string   `json:"dataset"`
+	Index   int      `json:"index"`
+	Total   int      `json:"total"`
+	Files   []string `json:"files"`
+}
+
+const pfxDatasets = "_datasets"
+
+// ShardItem returns the item of the shard, scheduled in the dataset
+// bucket. The idempotency key is the dataset name, checksum, and shard
+// index, so that re-running Ingest of the same data attaches to the
+// shards already scheduled, instead of scheduling them again.
+func ShardItem(s Shard, checksum string, weight uint64) (*etcdqueue.Item, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	item := etcdqueue.CreateItem(Bucket(s.Dataset), weight, string(data))
+	item.IdempotencyKey = path.Join(s.Dataset, checksum, strconv.Itoa(s.Index))
+	return item, nil
+}
+
+// Ingest downloads, checksums, shards, and registers the dataset,
+// and schedules each shard in the dataset bucket. Ingest is idempotent:
+// re-runs (e.g. after a partial failure) do not schedule shards twice
+// (see 'ShardItem').
+func Ingest(ctx context.Context, qu etcdqueue.Queue, cfg Config) (*Dataset, error) {
+	if cfg.Name == "" || cfg.SourceURL == "" || cfg.DownloadPath == "" {
+		return nil, fmt.Errorf("invalid dataset config: %+v", cfg)
+	}
+	if cfg.ShardSize <= 0 {
+		return nil, fmt.Errorf("invalid shard size %d", cfg.ShardSize)
+	}
+
+	if err := Download(cfg.SourceURL, cfg.DownloadPath); err != nil {
+		return nil, err
+	}
+	sum, err := Checksum(cfg.DownloadPath)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Checksum != "" && cfg.Checksum != sum {
+		return nil, fmt.Errorf("%q checksum mismatch (expected %s, got %s)", cfg.DownloadPath, cfg.Checksum, sum)
+	}
+	glog.Infof("%q checksum %s", cfg.DownloadPath, sum)
+
+	files := []string{cfg.DownloadPath}
+	if ff := archiver.MatchingFormat(cfg.DownloadPath); ff != nil && cfg.OutputDir != "" {
+		if !fileutil.Exist(cfg.OutputDir) {
+			glog.Infof("unarchiving %q to %q", cfg.DownloadPath, cfg.OutputDir)
+			if err = ff.Open(cfg.DownloadPath, cfg.OutputDir); err != nil {
+				return nil, err
+			}
+			glog.Infof("unarchived %q to %q", cfg.DownloadPath, cfg.OutputDir)
+		}
+		var fis []fileutil.FileInfo
+		fis, err = fileutil.WalkFiles(cfg.OutputDir)
+		if err != nil {
+			return nil, err
+		}
+		files = make([]string, 0, len(fis))
+		for _, fi := range fis {
+			files = append(files, fi.Path)
+		}
+	}
+
+	shards := Split(cfg.Name, files, cfg.ShardSize)
+	ds := &Dataset{
+		Name:      cfg.Name,
+		SourceURL: cfg.SourceURL,
+		Checksum:  sum,
+		Files:     len(files),
+		Shards:    len(shards),
+		Bucket:    Bucket(cfg.Name),
+		CreatedAt: time.Now(),
+	}
+	if err = Register(ctx, qu.Client(), ds); err != nil {
+		return nil, err
+	}
+
+	for _, s := range shards {
+		item, err := ShardItem(s, sum, cfg.Weight)
+		if err != nil {
+			return nil, err
+		}
+		if err = qu.Add(ctx, item); err != nil {
+			return nil, err
+		}
+	}
+	glog.Infof("ingested %q (%d files, %d shards)", ds.Name, ds.Files, ds.Shards)
+	return ds, nil
+}
+
+// Download downloads the URL contents to the target path,
+// if the target file does not exist or its size is different.
+// The contents are streamed to a temporary file, renamed to the target
+// path on success, so that partial downloads never replace the target.
+func Download(sourceURL, targetPath string) error {
+	size, sizet, err := urlutil.GetContentLength(sourceURL)
+	if err != nil {
+		return err
+	}
+	if fileutil.Exist(targetPath) {
+		fi, err := fileutil.GetFileInfo(targetPath)
+		if err != nil {
+			return err
+		}
+		if fi.Size == size {
+			glog.Infof("%q(%s) == %q(%s) (no need to download)", sourceURL, sizet, targetPath, fi.SizeTxt)
+			return nil
+		}
+	}
+
+	glog.Infof("downloading %q to %q", sourceURL, targetPath)
+	if !fileutil.Exist(filepath.Dir(targetPath)) {
+		if err = fileutil.TouchDirAll(filepath.Dir(targetPath)); err != nil {
+			return err
+		}
+	}
+	tmpPath := targetPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_TRUNC|os.O_CREATE, fileutil.PrivateFileMode)
+	if err != nil {
+		return err
+	}
+	n, err := urlutil.Copy(f, urlutil.TrimQuery(sourceURL))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, targetPath); err != nil {
+		return err
+	}
+	glog.Infof("downloaded %q to %q (%d bytes)", sourceURL, targetPath, n)
+	return nil
+}
+
+// Checksum returns the SHA-256 hex digest of the file.
+func Checksum(fpath string) (string, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Split splits files into shards of the given size.
+func Split(name string, files []string, size int) []Shard {
+	total := (len(files) + size - 1) / size
+	shards := make([]Shard, 0, total)
+	for i := 0; i < len(files); i += size {
+		end := i + size
+		if end > len(files) {
+			end = len(files)
+		}
+		shards = append(shards, Shard{Dataset: name, Index: len(shards), Total: total, Files: files[i:end]})
+	}
+	return shards
+}
+
+// Register writes the dataset record to etcd.
+func Register(ctx context.Context, cli *clientv3.Client, ds *Dataset) error {
+	data, err := json.Marshal(ds)
+	if err != nil {
+		return err
+	}
+	_, err = cli.Put(ctx, path.Join(pfxDatasets, ds.Name), string(data))
+	return err
+}
+
+// Get returns the registered dataset.
+func Get(ctx context.Context, cli *clientv3.Client, name string) (*Dataset, error) {
+	key := path.Join(pfxDatasets, name)
+	resp, err := cli.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) != 1 {
+		return nil, fmt.Errorf("dataset %q not found", name)
+	}
+	var ds Dataset
+	if err = json.Unmarshal(resp.Kvs[0].Value, &ds); err != nil {
+		return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", key, string(resp.Kvs[0].Value), err)
+	}
+	return &ds, nil
+}
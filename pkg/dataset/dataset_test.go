@@ -0,0 +1,123 @@
+package dataset
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	var files []string
+	for i := 0; i < 7; i++ {
+		files = append(files, fmt.Sprintf("cat.%d.jpg", i))
+	}
+	shards := Split("cats", files, 3)
+	if len(shards) != 3 {
+		t.Fatalf("expected 3 shards, got %+v", shards)
+	}
+	if len(shards[2].Files) != 1 || shards[2].Files[0] != "cat.6.jpg" {
+		t.Fatalf("unexpected last shard %+v", shards[2])
+	}
+	for i, s := range shards {
+		if s.Index != i || s.Total != 3 || s.Dataset != "cats" {
+			t.Fatalf("unexpected shard %+v", s)
+		}
+	}
+	if len(Split("cats", nil, 3)) != 0 {
+		t.Fatal("expected no shards")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "dataset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "test")
+	if err = ioutil.WriteFile(fpath, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := Checksum(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected checksum %q", sum)
+	}
+}
+
+func TestShardItem(t *testing.T) {
+	s := Shard{Dataset: "cats", Index: 2, Total: 3, Files: []string{"cat.6.jpg"}}
+	item1, err := ShardItem(s, "abc", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item2, err := ShardItem(s, "abc", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item1.Bucket != Bucket("cats") {
+		t.Fatalf("expected bucket %q, got %q", Bucket("cats"), item1.Bucket)
+	}
+	if item1.IdempotencyKey == "" || item1.IdempotencyKey != item2.IdempotencyKey {
+		t.Fatalf("expected the same idempotency key, got %q and %q", item1.IdempotencyKey, item2.IdempotencyKey)
+	}
+	s.Index = 1
+	item3, err := ShardItem(s, "abc", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item4, err := ShardItem(s, "def", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item3.IdempotencyKey == item1.IdempotencyKey || item4.IdempotencyKey == item3.IdempotencyKey {
+		t.Fatalf("expected different idempotency keys, got %q, %q, %q", item1.IdempotencyKey, item3.IdempotencyKey, item4.IdempotencyKey)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "dataset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/data" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	fpath := filepath.Join(dir, "sub", "data")
+	if err = Download(ts.URL+"/data?x=1", fpath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", string(data))
+	}
+
+	// failed download keeps the existing file
+	if err = Download(ts.URL+"/missing", fpath); err == nil {
+		t.Fatal("expected error on missing URL")
+	}
+	if data, err = ioutil.ReadFile(fpath); err != nil || string(data) != "hello" {
+		t.Fatalf("expected %q kept, got %q (%v)", "hello", string(data), err)
+	}
+	if _, err = os.Stat(fpath + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected temporary file removed, got %v", err)
+	}
+}
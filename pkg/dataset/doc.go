@@ -0,0 +1,2 @@
+// Package dataset implements dataset ingestion pipeline.
+package dataset
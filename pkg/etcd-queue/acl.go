@@ -0,0 +1,461 @@
+package etcdqueue
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// Role is the set of operations allowed to an identity in a bucket.
+type Role string
+
+const (
+	// RoleEnqueue allows Add, AddBatch, Enqueue, and FanOut.
+	RoleEnqueue Role = "enqueue"
+	// RoleConsume allows Pop, PopBackfill, UpdateProgress, Complete, and
+	// AppendMetrics.
+	RoleConsume Role = "consume"
+	// RoleAdmin allows all operations, including bucket configuration,
+	// Cancel, Purge, Transfer, and SetACL.
+	RoleAdmin Role = "admin"
+)
+
+// AnyIdentity grants the role to all identities, including requests
+// without identity (e.g. public enqueue).
+const AnyIdentity = "*"
+
+// GlobalACL is the bucket of the ACL granting operations across buckets
+// (e.g. Migrate), which are denied without its grants.
+const GlobalACL = ""
+
+// ACL is the access-control list of a bucket, independent of etcd RBAC.
+// It is enforced by queues of NewACLQueue. Buckets without ACL allow
+// all operations, except the global bucket (see 'GlobalACL').
+type ACL struct {
+	// Grants maps identities (e.g. principal names, or TokenIdentity of
+	// API tokens) to their roles. Raw tokens should never be granted,
+	// since ACLs are stored in etcd as is.
+	Grants map[string]Role `json:"grants"`
+}
+
+// Validate returns an error if any role is unknown.
+func (acl ACL) Validate() error {
+	for id, r := range acl.Grants {
+		switch r {
+		case RoleEnqueue, RoleConsume, RoleAdmin:
+		default:
+			return fmt.Errorf("unknown role %q of %q", r, id)
+		}
+	}
+	return nil
+}
+
+// allows returns true if the identity has the role, or is admin.
+func (acl ACL) allows(identity string, role Role) bool {
+	for _, id := range []string{identity, AnyIdentity} {
+		if r, ok := acl.Grants[id]; ok && (r == role || r == RoleAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrAccessDenied is matched by AccessDeniedError.
+var ErrAccessDenied = errors.New("queue: access denied")
+
+// AccessDeniedError is returned when the identity of the request is not
+// allowed the operation by the bucket ACL.
+type AccessDeniedError struct {
+	Identity string
+	Bucket   string
+	// Op is the denied operation (e.g. "Add").
+	Op string
+}
+
+func (e *AccessDeniedError) Error() string {
+	if e.Bucket == GlobalACL {
+		return fmt.Sprintf("%v: %q is not allowed to %s across buckets", ErrAccessDenied, e.Identity, e.Op)
+	}
+	return fmt.Sprintf("%v: %q is not allowed to %s in %q", ErrAccessDenied, e.Identity, e.Op, e.Bucket)
+}
+
+// Is makes the error match ErrAccessDenied with errors.Is.
+func (e *AccessDeniedError) Is(target error) bool {
+	return target == ErrAccessDenied
+}
+
+// IsAccessDenied returns true if the error is AccessDeniedError.
+func IsAccessDenied(err error) bool {
+	_, ok := err.(*AccessDeniedError)
+	return ok
+}
+
+type identityKey struct{}
+
+// WithIdentity sets the identity of requests with the context, checked
+// against bucket ACLs. The identity is journaled as 'Event.Actor', and
+// logged on denials, so it must not be a secret: API tokens should be
+// resolved to their principals, or to TokenIdentity.
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// TokenIdentity returns the identity of the API token: its SHA-256
+// hash prefixed with "token:", so that tokens are not stored in ACLs,
+// journaled, or logged.
+func TokenIdentity(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:])
+}
+
+// IdentityFrom returns the identity of the context, or empty if none.
+func IdentityFrom(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
+
+const pfxACL = "_acl"
+
+func aclKey(bucket string) string {
+	return path.Join(pfxACL, bucket)
+}
+
+func (qu *queue) SetACL(ctx context.Context, bucket string, acl ACL) error {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if err := acl.Validate(); err != nil {
+		return err
+	}
+	if len(acl.Grants) == 0 {
+		_, err := qu.kv.Delete(ctx, aclKey(bucket))
+		return err
+	}
+	data, err := json.Marshal(acl)
+	if err != nil {
+		return err
+	}
+	if _, err = qu.kv.Put(ctx, aclKey(bucket), string(data)); err != nil {
+		return err
+	}
+	glog.Infof("queue: updated ACL of %q with %d grants", bucket, len(acl.Grants))
+	return nil
+}
+
+func (qu *queue) ACL(ctx context.Context, bucket string) (ACL, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	var acl ACL
+	resp, err := qu.kv.Get(ctx, aclKey(bucket))
+	if err != nil {
+		return acl, err
+	}
+	if len(resp.Kvs) == 0 {
+		return acl, nil
+	}
+	if err = json.Unmarshal(resp.Kvs[0].Value, &acl); err != nil {
+		return acl, fmt.Errorf("%q returned wrong JSON %q (%v)", aclKey(bucket), string(resp.Kvs[0].Value), err)
+	}
+	return acl, nil
+}
+
+// aclQueue enforces bucket ACLs on the identities of request contexts.
+type aclQueue struct {
+	Queue
+}
+
+// NewACLQueue returns a Queue that checks the identity of each mutation
+// (see 'WithIdentity') against the ACL of its bucket, returning
+// AccessDeniedError if not allowed (e.g. for HTTP servers serving
+// untrusted clients). Watchers return the error in 'Item.Error'.
+// Operations across buckets (SetOwnerQuota, Migrate, GCCompleted,
+// GCEvents, RegisterWorker, and Lock) are checked against the global ACL (see
+// 'GlobalACL'). SetBucketPolicy and SetLimits are always denied, and
+// Client returns <nil>, since they bypass ACLs. Reads are not checked.
+func NewACLQueue(qu Queue) Queue {
+	return &aclQueue{Queue: qu}
+}
+
+// clientOf returns the etcd client of the queue, including the queue
+// of NewACLQueue, for the functions of this package over queues.
+func clientOf(qu Queue) *clientv3.Client {
+	if aq, ok := qu.(*aclQueue); ok {
+		return clientOf(aq.Queue)
+	}
+	return qu.Client()
+}
+
+// authorize returns AccessDeniedError if the identity of the context is
+// not allowed the role in any of the buckets. Denials are journaled as
+// EventDenied of the item key, if any.
+func (qu *aclQueue) authorize(ctx context.Context, op string, role Role, key string, buckets ...string) error {
+	identity := IdentityFrom(ctx)
+	seen := make(map[string]bool, len(buckets))
+	for _, bucket := range buckets {
+		if seen[bucket] {
+			continue
+		}
+		seen[bucket] = true
+		acl, err := qu.Queue.ACL(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if (len(acl.Grants) > 0 || bucket == GlobalACL) && !acl.allows(identity, role) {
+			glog.Warningf("queue: denied %s of %q in %q", op, identity, bucket)
+			ev := rawEvent{Type: EventDenied, Bucket: bucket, Key: key, Actor: identity, Op: op}
+			if _, err = clientOf(qu.Queue).Do(ctx, journalOp(ev, clockOf(qu.Queue).Now())); err != nil {
+				glog.Warningf("queue: failed to journal denied %s in %q (%v)", op, bucket, err)
+			}
+			return &AccessDeniedError{Identity: identity, Bucket: bucket, Op: op}
+		}
+	}
+	return nil
+}
+
+func deniedWatcher(bucket string, err error) ItemWatcher {
+	ch := make(chan *Item, 1)
+	ch <- &Item{Bucket: bucket, Error: err.Error()}
+	close(ch)
+	return ch
+}
+
+// itemBuckets returns the buckets of the item keys, where the items are
+// written regardless of their 'Bucket' fields.
+func itemBuckets(items []*Item) []string {
+	buckets := make([]string, 0, len(items))
+	for _, item := range items {
+		if item != nil {
+			buckets = append(buckets, path.Dir(item.Key))
+		}
+	}
+	return buckets
+}
+
+func (qu *aclQueue) Add(ctx context.Context, item *Item, opts ...OpOption) error {
+	if item == nil {
+		return fmt.Errorf("received <nil> Item")
+	}
+	if err := qu.authorize(ctx, "Add", RoleEnqueue, item.Key, path.Dir(item.Key)); err != nil {
+		return err
+	}
+	return qu.Queue.Add(ctx, item, opts...)
+}
+
+func (qu *aclQueue) AddBatch(ctx context.Context, items []*Item, opts ...OpOption) error {
+	if err := qu.authorize(ctx, "AddBatch", RoleEnqueue, "", itemBuckets(items)...); err != nil {
+		return err
+	}
+	return qu.Queue.AddBatch(ctx, items, opts...)
+}
+
+func (qu *aclQueue) FanOut(ctx context.Context, bucket string, items []*Item, opts ...OpOption) (*JoinHandle, error) {
+	if err := qu.authorize(ctx, "FanOut", RoleEnqueue, "", bucket); err != nil {
+		return nil, err
+	}
+	return qu.Queue.FanOut(ctx, bucket, items, opts...)
+}
+
+func (qu *aclQueue) Enqueue(ctx context.Context, item *Item, opts ...OpOption) ItemWatcher {
+	if item == nil {
+		return deniedWatcher("", fmt.Errorf("received <nil> Item"))
+	}
+	if err := qu.authorize(ctx, "Enqueue", RoleEnqueue, item.Key, path.Dir(item.Key)); err != nil {
+		return deniedWatcher(item.Bucket, err)
+	}
+	return qu.Queue.Enqueue(ctx, item, opts...)
+}
+
+func (qu *aclQueue) Pop(ctx context.Context, bucket string) ItemWatcher {
+	if err := qu.authorize(ctx, "Pop", RoleConsume, "", bucket); err != nil {
+		return deniedWatcher(bucket, err)
+	}
+	return qu.Queue.Pop(ctx, bucket)
+}
+
+func (qu *aclQueue) PopBackfill(ctx context.Context, cfg BackfillConfig) ItemWatcher {
+	if err := qu.authorize(ctx, "PopBackfill", RoleConsume, "", cfg.Bucket); err != nil {
+		return deniedWatcher(cfg.Bucket, err)
+	}
+	return qu.Queue.PopBackfill(ctx, cfg)
+}
+
+func (qu *aclQueue) Complete(ctx context.Context, item *Item) error {
+	if item == nil {
+		return fmt.Errorf("received <nil> Item")
+	}
+	if err := qu.authorize(ctx, "Complete", RoleConsume, item.Key, path.Dir(item.Key)); err != nil {
+		return err
+	}
+	return qu.Queue.Complete(ctx, item)
+}
+
+func (qu *aclQueue) UpdateProgress(ctx context.Context, item *Item) error {
+	if item == nil {
+		return fmt.Errorf("received <nil> Item")
+	}
+	if err := qu.authorize(ctx, "UpdateProgress", RoleConsume, item.Key, path.Dir(item.Key)); err != nil {
+		return err
+	}
+	return qu.Queue.UpdateProgress(ctx, item)
+}
+
+func (qu *aclQueue) AppendMetrics(ctx context.Context, itemKey string, ms ...*Metric) error {
+	if err := qu.authorize(ctx, "AppendMetrics", RoleConsume, itemKey, path.Dir(itemKey)); err != nil {
+		return err
+	}
+	return qu.Queue.AppendMetrics(ctx, itemKey, ms...)
+}
+
+func (qu *aclQueue) Cancel(ctx context.Context, itemKey string, opts ...OpOption) (*Item, error) {
+	if err := qu.authorize(ctx, "Cancel", RoleAdmin, itemKey, path.Dir(itemKey)); err != nil {
+		return nil, err
+	}
+	return qu.Queue.Cancel(ctx, itemKey, opts...)
+}
+
+func (qu *aclQueue) Undelete(ctx context.Context, itemKey string) (*Item, error) {
+	if err := qu.authorize(ctx, "Undelete", RoleAdmin, itemKey, path.Dir(itemKey)); err != nil {
+		return nil, err
+	}
+	return qu.Queue.Undelete(ctx, itemKey)
+}
+
+func (qu *aclQueue) Annotate(ctx context.Context, itemKey string, a *Annotation) error {
+	if err := qu.authorize(ctx, "Annotate", RoleAdmin, itemKey, path.Dir(itemKey)); err != nil {
+		return err
+	}
+	return qu.Queue.Annotate(ctx, itemKey, a)
+}
+
+func (qu *aclQueue) Purge(ctx context.Context, bucket string) (int64, error) {
+	if err := qu.authorize(ctx, "Purge", RoleAdmin, "", bucket); err != nil {
+		return 0, err
+	}
+	return qu.Queue.Purge(ctx, bucket)
+}
+
+func (qu *aclQueue) Transfer(ctx context.Context, dst Queue, bucket string) (int, error) {
+	if err := qu.authorize(ctx, "Transfer", RoleAdmin, "", bucket); err != nil {
+		return 0, err
+	}
+	return qu.Queue.Transfer(ctx, dst, bucket)
+}
+
+func (qu *aclQueue) DeleteCompleted(ctx context.Context, items ...*Item) (int64, error) {
+	if err := qu.authorize(ctx, "DeleteCompleted", RoleAdmin, "", itemBuckets(items)...); err != nil {
+		return 0, err
+	}
+	return qu.Queue.DeleteCompleted(ctx, items...)
+}
+
+func (qu *aclQueue) SetBucketConfig(ctx context.Context, bucket string, cfg BucketConfig) error {
+	if err := qu.authorize(ctx, "SetBucketConfig", RoleAdmin, "", bucket); err != nil {
+		return err
+	}
+	return qu.Queue.SetBucketConfig(ctx, bucket, cfg)
+}
+
+func (qu *aclQueue) CreateBucketFromTemplate(ctx context.Context, bucket string, tmpl BucketTemplate) error {
+	if err := qu.authorize(ctx, "CreateBucketFromTemplate", RoleAdmin, "", bucket); err != nil {
+		return err
+	}
+	return qu.Queue.CreateBucketFromTemplate(ctx, bucket, tmpl)
+}
+
+func (qu *aclQueue) CreateSessionBucket(ctx context.Context, bucket string) (*SessionBucket, error) {
+	if err := qu.authorize(ctx, "CreateSessionBucket", RoleAdmin, "", bucket); err != nil {
+		return nil, err
+	}
+	return qu.Queue.CreateSessionBucket(ctx, bucket)
+}
+
+func (qu *aclQueue) RegisterSchema(ctx context.Context, bucket string, schema []byte) error {
+	if err := qu.authorize(ctx, "RegisterSchema", RoleAdmin, "", bucket); err != nil {
+		return err
+	}
+	return qu.Queue.RegisterSchema(ctx, bucket, schema)
+}
+
+func (qu *aclQueue) DeleteSchema(ctx context.Context, bucket string) error {
+	if err := qu.authorize(ctx, "DeleteSchema", RoleAdmin, "", bucket); err != nil {
+		return err
+	}
+	return qu.Queue.DeleteSchema(ctx, bucket)
+}
+
+func (qu *aclQueue) SetRedaction(ctx context.Context, bucket string, r Redaction) error {
+	if err := qu.authorize(ctx, "SetRedaction", RoleAdmin, "", bucket); err != nil {
+		return err
+	}
+	return qu.Queue.SetRedaction(ctx, bucket, r)
+}
+
+func (qu *aclQueue) SetACL(ctx context.Context, bucket string, acl ACL) error {
+	if err := qu.authorize(ctx, "SetACL", RoleAdmin, "", bucket); err != nil {
+		return err
+	}
+	return qu.Queue.SetACL(ctx, bucket, acl)
+}
+
+func (qu *aclQueue) SetBucketPolicy(p BucketPolicy) error {
+	glog.Warningf("queue: denied SetBucketPolicy")
+	return &AccessDeniedError{Bucket: GlobalACL, Op: "SetBucketPolicy"}
+}
+
+func (qu *aclQueue) SetLimits(l Limits) error {
+	glog.Warningf("queue: denied SetLimits")
+	return &AccessDeniedError{Bucket: GlobalACL, Op: "SetLimits"}
+}
+
+func (qu *aclQueue) SetOwnerQuota(ctx context.Context, owner string, q Quota) error {
+	if err := qu.authorize(ctx, "SetOwnerQuota", RoleAdmin, "", GlobalACL); err != nil {
+		return err
+	}
+	return qu.Queue.SetOwnerQuota(ctx, owner, q)
+}
+
+func (qu *aclQueue) Migrate(ctx context.Context, from, to Layout) (int, error) {
+	if err := qu.authorize(ctx, "Migrate", RoleAdmin, "", GlobalACL); err != nil {
+		return 0, err
+	}
+	return qu.Queue.Migrate(ctx, from, to)
+}
+
+func (qu *aclQueue) GCCompleted(ctx context.Context, olderThan time.Duration) (int64, error) {
+	if err := qu.authorize(ctx, "GCCompleted", RoleAdmin, "", GlobalACL); err != nil {
+		return 0, err
+	}
+	return qu.Queue.GCCompleted(ctx, olderThan)
+}
+
+func (qu *aclQueue) GCEvents(ctx context.Context, olderThan time.Duration) (int64, error) {
+	if err := qu.authorize(ctx, "GCEvents", RoleAdmin, "", GlobalACL); err != nil {
+		return 0, err
+	}
+	return qu.Queue.GCEvents(ctx, olderThan)
+}
+
+func (qu *aclQueue) RegisterWorker(ctx context.Context, id string, caps Capabilities) (*Worker, error) {
+	if err := qu.authorize(ctx, "RegisterWorker", RoleConsume, "", GlobalACL); err != nil {
+		return nil, err
+	}
+	return qu.Queue.RegisterWorker(ctx, id, caps)
+}
+
+func (qu *aclQueue) Lock(ctx context.Context, name string) (*Mutex, error) {
+	if err := qu.authorize(ctx, "Lock", RoleConsume, "", GlobalACL); err != nil {
+		return nil, err
+	}
+	return qu.Queue.Lock(ctx, name)
+}
+
+func (qu *aclQueue) Client() *clientv3.Client {
+	return nil
+}
@@ -0,0 +1,232 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestACLQueue(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	eq, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eq.Stop()
+	qu := NewACLQueue(eq)
+
+	// buckets without ACL allow all operations
+	ctx := context.Background()
+	if err = qu.Add(ctx, CreateItem("my-job", 100, "data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = qu.SetACL(ctx, "my-job", ACL{Grants: map[string]Role{"web": "read"}}); err == nil {
+		t.Fatal("expected unknown role error")
+	}
+	acl := ACL{Grants: map[string]Role{"web": RoleEnqueue, "worker": RoleConsume, "oncall": RoleAdmin}}
+	if err = qu.SetACL(ctx, "my-job", acl); err != nil {
+		t.Fatal(err)
+	}
+
+	web, worker, oncall := WithIdentity(ctx, "web"), WithIdentity(ctx, "worker"), WithIdentity(ctx, "oncall")
+	item := CreateItem("my-job", 100, "data")
+
+	// items are authorized on the bucket of their keys, not their 'Bucket' fields
+	mismatched := CreateItem("other-job", 100, "data")
+	mismatched.Key = path.Join("my-job", path.Base(mismatched.Key))
+	for i, err := range []error{
+		qu.Add(worker, mismatched),
+		qu.AddBatch(worker, []*Item{mismatched}),
+		qu.Complete(web, mismatched),
+		qu.UpdateProgress(web, mismatched),
+	} {
+		if !IsAccessDenied(err) {
+			t.Fatalf("#%d: expected AccessDeniedError, got %v", i, err)
+		}
+	}
+	if err = qu.Add(oncall, mismatched); err == nil || IsAccessDenied(err) {
+		t.Fatalf("expected bucket mismatch error, got %v", err)
+	}
+	if err = qu.UpdateProgress(oncall, mismatched); err == nil || IsAccessDenied(err) {
+		t.Fatalf("expected bucket mismatch error, got %v", err)
+	}
+
+	for i, err := range []error{
+		qu.Add(ctx, CreateItem("my-job", 100, "data")),
+		qu.Add(worker, CreateItem("my-job", 100, "data")),
+		qu.AddBatch(worker, []*Item{CreateItem("other-job", 100, "data"), CreateItem("my-job", 100, "data")}),
+		qu.SetACL(web, "my-job", ACL{}),
+	} {
+		if !IsAccessDenied(err) {
+			t.Fatalf("#%d: expected AccessDeniedError, got %v", i, err)
+		}
+	}
+	if err = (<-qu.Pop(web, "my-job")).Err(); err == nil {
+		t.Fatal("expected Pop to be denied")
+	}
+	if err = qu.Add(web, item); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.Cancel(worker, item.Key); !IsAccessDenied(err) {
+		t.Fatalf("expected AccessDeniedError, got %v", err)
+	}
+	popped := <-qu.Pop(worker, "my-job")
+	if popped.Err() != nil {
+		t.Fatal(popped.Err())
+	}
+	popped.Progress = MaxProgress
+	if err = qu.Complete(worker, popped); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.Purge(oncall, "my-job"); err != nil {
+		t.Fatal(err)
+	}
+
+	// any identity may be granted
+	acl.Grants[AnyIdentity] = RoleEnqueue
+	if err = qu.SetACL(oncall, "my-job", acl); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, CreateItem("my-job", 100, "data")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := qu.ACL(ctx, "my-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Grants) != 4 || got.Grants["oncall"] != RoleAdmin {
+		t.Fatalf("unexpected ACL %+v", got)
+	}
+}
+
+func TestACLQueueGlobal(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	eq, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eq.Stop()
+	qu := NewACLQueue(eq)
+
+	ctx := context.Background()
+	oncall, worker := WithIdentity(ctx, "oncall"), WithIdentity(ctx, "worker")
+	check := func(ctx context.Context) []error {
+		_, err1 := qu.Migrate(ctx, DefaultLayout, DefaultLayout)
+		_, err2 := qu.GCCompleted(ctx, time.Hour)
+		err3 := qu.SetOwnerQuota(ctx, "alice", Quota{MaxBytes: 100})
+		return []error{err1, err2, err3}
+	}
+
+	// operations across buckets are denied without global ACL
+	for i, err := range append(check(oncall),
+		qu.SetACL(oncall, GlobalACL, ACL{Grants: map[string]Role{"oncall": RoleAdmin}}),
+		qu.SetBucketPolicy(BucketPolicy{}),
+		qu.SetLimits(Limits{}),
+	) {
+		if !IsAccessDenied(err) {
+			t.Fatalf("#%d: expected AccessDeniedError, got %v", i, err)
+		}
+	}
+	if _, err = qu.RegisterWorker(worker, "worker-1", Capabilities{}); !IsAccessDenied(err) {
+		t.Fatalf("expected AccessDeniedError, got %v", err)
+	}
+	if _, err = qu.Lock(worker, "my-lock"); !IsAccessDenied(err) {
+		t.Fatalf("expected AccessDeniedError, got %v", err)
+	}
+
+	acl := ACL{Grants: map[string]Role{"oncall": RoleAdmin, "worker": RoleConsume}}
+	if err = eq.SetACL(ctx, GlobalACL, acl); err != nil {
+		t.Fatal(err)
+	}
+	for i, err := range check(worker) {
+		if !IsAccessDenied(err) {
+			t.Fatalf("#%d: expected AccessDeniedError, got %v", i, err)
+		}
+	}
+	for i, err := range check(oncall) {
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	w, err := qu.RegisterWorker(worker, "worker-1", Capabilities{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the etcd client bypasses ACLs, but the queue is still checked
+	if qu.Client() != nil {
+		t.Fatal("expected no etcd client")
+	}
+	if rd := CheckReady(ctx, qu); !rd.Ready {
+		t.Fatalf("expected ready, got %+v", rd)
+	}
+}
+
+func TestACLQueueTokenIdentity(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	eq, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eq.Stop()
+	qu := NewACLQueue(eq)
+
+	const token, other = "s3cr3t-t0ken", "0ther-t0ken"
+	id := TokenIdentity(token)
+	if id != TokenIdentity(token) || id == TokenIdentity(other) || strings.Contains(id, token) {
+		t.Fatalf("unexpected token identity %q", id)
+	}
+
+	ctx := context.Background()
+	if err = eq.SetACL(ctx, "my-job", ACL{Grants: map[string]Role{id: RoleEnqueue}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(WithIdentity(ctx, id), CreateItem("my-job", 100, "data")); err != nil {
+		t.Fatal(err)
+	}
+	err = qu.Add(WithIdentity(ctx, TokenIdentity(other)), CreateItem("my-job", 100, "data"))
+	if !IsAccessDenied(err) || strings.Contains(err.Error(), other) {
+		t.Fatalf("expected AccessDeniedError without token, got %v", err)
+	}
+
+	evs, err := eq.ReadEvents(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range evs {
+		if strings.Contains(ev.Actor, token) || strings.Contains(ev.Actor, other) {
+			t.Fatalf("token journaled in %+v", ev)
+		}
+	}
+}
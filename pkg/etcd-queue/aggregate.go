@@ -0,0 +1,116 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// AggregateWindows is the number of time windows returned by Aggregate,
+// ending with the current window.
+var AggregateWindows = 24
+
+// WindowStats represents the throughput of a bucket in a time window.
+type WindowStats struct {
+	Bucket string    `json:"bucket"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+
+	// Enqueued is the number of items added, including retries.
+	Enqueued int64 `json:"enqueued"`
+	// Completed is the number of items completed successfully.
+	Completed int64 `json:"completed"`
+	// Errors is the number of failed items.
+	Errors int64 `json:"errors"`
+
+	// MeanLatency is the mean time from creation to completion
+	// of the successful items.
+	MeanLatency time.Duration `json:"mean_latency"`
+}
+
+// windowIndex returns the index of the window containing the time,
+// or -1 if the time is out of the windows.
+func windowIndex(start time.Time, window time.Duration, n int, t time.Time) int {
+	if t.Before(start) {
+		return -1
+	}
+	i := int(t.Sub(start) / window)
+	if i >= n {
+		return -1
+	}
+	return i
+}
+
+func (qu *queue) Aggregate(ctx context.Context, bucket string, window time.Duration) ([]WindowStats, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid window %v", window)
+	}
+	n := AggregateWindows
+	if n < 1 {
+		n = 1
+	}
+	start := qu.clock.Now().Truncate(window).Add(-time.Duration(n-1) * window)
+
+	stats := make([]WindowStats, n)
+	for i := range stats {
+		stats[i] = WindowStats{
+			Bucket: bucket,
+			Start:  start.Add(time.Duration(i) * window),
+			End:    start.Add(time.Duration(i+1) * window),
+		}
+	}
+
+	// enqueues are read from the event journal of the bucket, keyed by
+	// event time
+	resp, err := qu.kv.Get(ctx, eventTimeKey(bucket, start),
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(bucketEventsPrefix(bucket))))
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		var ev rawEvent
+		if err = json.Unmarshal(kv.Value, &ev); err != nil {
+			return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", string(kv.Key), string(kv.Value), err)
+		}
+		if ev.Type != EventAdd || ev.Bucket != bucket {
+			continue
+		}
+		if i := windowIndex(start, window, n, ev.CreatedAt); i >= 0 {
+			stats[i].Enqueued++
+		}
+	}
+
+	// completions are read from the completed index, keyed by completion time
+	items, err := qu.ListCompletedSince(ctx, start)
+	if err != nil {
+		return nil, err
+	}
+	latencies := make([]time.Duration, n)
+	for _, item := range items {
+		if item.Bucket != bucket {
+			continue
+		}
+		i := windowIndex(start, window, n, item.CompletedAt)
+		if i < 0 {
+			continue
+		}
+		switch terminalStatus(item) {
+		case StatusCompleted:
+			stats[i].Completed++
+			latencies[i] += item.CompletedAt.Sub(item.CreatedAt)
+		case StatusFailed:
+			stats[i].Errors++
+		}
+	}
+	for i := range stats {
+		if stats[i].Completed > 0 {
+			stats[i].MeanLatency = latencies[i] / time.Duration(stats[i].Completed)
+		}
+	}
+	return stats, nil
+}
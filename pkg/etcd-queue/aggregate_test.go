@@ -0,0 +1,134 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAggregate(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err = qu.Add(ctx, CreateItem("my-job", 100, "data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = qu.Add(ctx, CreateItem("other-job", 100, "data")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := <-qu.Pop(ctx, "my-job")
+	done.Progress = MaxProgress
+	if err = qu.Complete(ctx, done); err != nil {
+		t.Fatal(err)
+	}
+	failed := <-qu.Pop(ctx, "my-job")
+	failed.Error = "failed"
+	if err = qu.Complete(ctx, failed); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := qu.Aggregate(ctx, "my-job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != AggregateWindows {
+		t.Fatalf("expected %d windows, got %d", AggregateWindows, len(stats))
+	}
+	now := time.Now()
+	if last := stats[len(stats)-1]; last.Start.After(now) || !last.End.After(now) {
+		t.Fatalf("expected the last window to contain %v, got %+v", now, last)
+	}
+
+	// items may span windows, so counts are summed
+	var sum WindowStats
+	for i, st := range stats {
+		if i > 0 && !st.Start.Equal(stats[i-1].End) {
+			t.Fatalf("expected window #%d to start at %v, got %v", i, stats[i-1].End, st.Start)
+		}
+		sum.Enqueued += st.Enqueued
+		sum.Completed += st.Completed
+		sum.Errors += st.Errors
+		if st.Completed > 0 {
+			sum.MeanLatency = st.MeanLatency
+		}
+	}
+	if sum.Enqueued != 3 || sum.Completed != 1 || sum.Errors != 1 {
+		t.Fatalf("unexpected counts %+v", sum)
+	}
+	if sum.MeanLatency <= 0 {
+		t.Fatalf("expected positive latency, got %v", sum.MeanLatency)
+	}
+
+	if _, err = qu.Aggregate(ctx, "my-job", 0); err == nil {
+		t.Fatal("expected error on zero window")
+	}
+}
+
+func TestAggregateClock(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	// coalesced Add calls wait for the window of the clock
+	defer func(window time.Duration) { AddCoalesceWindow = window }(AddCoalesceWindow)
+	AddCoalesceWindow = 0
+
+	// windows and journal keys are both of the clock of the queue,
+	// far from the system time
+	start := time.Date(2018, 1, 2, 0, 0, 30, 0, time.UTC)
+	clk := NewFakeClock(start)
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir, WithClock(clk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if err = qu.Add(ctx, CreateItem("my-job", 100, "data")); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(2 * time.Minute)
+	for i := 0; i < 2; i++ {
+		if err = qu.Add(ctx, CreateItem("my-job", 100, "data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := qu.Aggregate(ctx, "my-job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(stats)
+	if last := stats[n-1]; !last.Start.Equal(start.Add(2 * time.Minute).Truncate(time.Minute)) {
+		t.Fatalf("expected the last window to start at %v, got %v", start.Add(2*time.Minute).Truncate(time.Minute), last.Start)
+	}
+	for i, expected := range map[int]int64{n - 3: 1, n - 2: 0, n - 1: 2} {
+		if stats[i].Enqueued != expected {
+			t.Fatalf("window #%d: expected %d enqueued, got %d", i, expected, stats[i].Enqueued)
+		}
+	}
+}
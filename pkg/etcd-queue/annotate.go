@@ -0,0 +1,89 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// Annotation is a timestamped note on an item, attached by operators
+// (e.g. "retried manually after GPU OOM").
+type Annotation struct {
+	// Author is the operator who wrote the note.
+	Author string `json:"author,omitempty"`
+
+	// Text is the note.
+	Text string `json:"text"`
+
+	// CreatedAt is timestamp of annotation creation.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const pfxAnnotations = "_annotations"
+
+// annotationsPrefix returns the prefix of all annotations of the item key.
+func annotationsPrefix(itemKey string) string {
+	return path.Join(pfxAnnotations, itemKey) + "/"
+}
+
+func (qu *queue) Annotate(ctx context.Context, itemKey string, a *Annotation) error {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if a == nil {
+		return fmt.Errorf("received <nil> Annotation")
+	}
+	if a.Text == "" {
+		return fmt.Errorf("empty annotation text")
+	}
+	ent, err := qu.Get(ctx, itemKey)
+	if err != nil {
+		return err
+	}
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = qu.clock.Now()
+	}
+
+	// lexicographically sorted by creation time, and annotations of the
+	// same time are moved by a nanosecond, not to overwrite each other
+	for {
+		data, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		key := annotationsPrefix(ent.Item.Key) + fmt.Sprintf("%035X", a.CreatedAt.UnixNano())
+		resp, err := qu.kv.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, string(data))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		a.CreatedAt = a.CreatedAt.Add(time.Nanosecond)
+	}
+}
+
+func (qu *queue) Annotations(ctx context.Context, itemKey string) ([]*Annotation, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	pfx := annotationsPrefix(itemKey)
+	resp, err := qu.kv.Get(ctx, pfx, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	as := make([]*Annotation, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var a Annotation
+		if err = json.Unmarshal(kv.Value, &a); err != nil {
+			return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", string(kv.Key), string(kv.Value), err)
+		}
+		as = append(as, &a)
+	}
+	return as, nil
+}
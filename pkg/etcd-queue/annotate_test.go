@@ -0,0 +1,73 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAnnotate(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	item := CreateItem("my-job", 100, "data")
+	if err = qu.Annotate(ctx, item.Key, &Annotation{Text: "note"}); err != ErrItemNotFound {
+		t.Fatalf("expected %v, got %v", ErrItemNotFound, err)
+	}
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Annotate(ctx, item.Key, &Annotation{}); err == nil {
+		t.Fatal("expected empty text error")
+	}
+
+	now := time.Now()
+	for _, a := range []*Annotation{
+		{Author: "alice", Text: "retried manually after GPU OOM", CreatedAt: now},
+		{Author: "bob", Text: "same time", CreatedAt: now},
+		{Author: "carol", Text: "earlier", CreatedAt: now.Add(-time.Minute)},
+	} {
+		if err = qu.Annotate(ctx, item.Key, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	as, err := qu.Annotations(ctx, item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 3 || as[0].Author != "carol" || as[1].Author != "alice" || as[2].Author != "bob" {
+		t.Fatalf("unexpected annotations %+v", as)
+	}
+
+	// annotations are deleted with the completed item
+	popped := <-qu.Pop(ctx, "my-job")
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Annotate(ctx, item.Key, &Annotation{Text: "done"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.DeleteCompleted(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	if as, err = qu.Annotations(ctx, item.Key); err != nil || len(as) != 0 {
+		t.Fatalf("expected no annotation, got %+v (%v)", as, err)
+	}
+}
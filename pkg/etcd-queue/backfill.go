@@ -0,0 +1,123 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// BackfillConfig configures backfill scheduling, where items in the
+// backfill bucket are only dispatched when the cluster is idle.
+type BackfillConfig struct {
+	// Bucket is the low-priority background bucket.
+	Bucket string
+
+	// InteractiveBuckets must have no pending item, to dispatch backfill items.
+	InteractiveBuckets []string
+
+	// MaxLatency is the threshold of linearizable read latency, to measure
+	// etcd load. Zero means no threshold.
+	MaxLatency time.Duration
+
+	// PollInterval is the interval to re-check conditions. Defaults to 1 second.
+	PollInterval time.Duration
+}
+
+func (qu *queue) PopBackfill(ctx context.Context, cfg BackfillConfig) ItemWatcher {
+	ch := make(chan *Item, 1)
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = time.Second
+	}
+
+	ctx, done := qu.trackWatch(ctx, "pop-backfill", bucketPrefix(cfg.Bucket))
+	qu.subscribe(ctx, cfg.Bucket)
+	if !qu.goBackground("pop-backfill", cfg.Bucket, func() {
+		defer close(ch)
+		defer done()
+		defer qu.recoverPanic("pop-backfill", cfg.Bucket, func(err error) {
+			notifyItem(ch, &Item{Bucket: cfg.Bucket, Error: err.Error()})
+		})
+
+		for {
+			item, err := qu.tryBackfill(ctx, cfg)
+			if err != nil {
+				ch <- &Item{Bucket: cfg.Bucket, Error: err.Error()}
+				return
+			}
+			if item != nil {
+				ch <- item
+				return
+			}
+
+			select {
+			case <-qu.clock.After(cfg.PollInterval):
+			case <-ctx.Done():
+				ch <- &Item{Bucket: cfg.Bucket, Error: ctx.Err().Error()}
+				return
+			}
+		}
+	}) {
+		done()
+		return closedWatcher(cfg.Bucket)
+	}
+	return ch
+}
+
+// tryBackfill pops the first backfill item if the cluster is idle.
+// It returns <nil> if there is no item to dispatch.
+func (qu *queue) tryBackfill(ctx context.Context, cfg BackfillConfig) (*Item, error) {
+	for _, bucket := range cfg.InteractiveBuckets {
+		resp, err := qu.kv.Get(ctx, bucketPrefix(bucket), clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			return nil, err
+		}
+		if resp.Count > 0 {
+			glog.V(2).Infof("backfill: %q has %d pending items", bucket, resp.Count)
+			return nil, nil
+		}
+	}
+
+	now := qu.clock.Now()
+	resp, err := qu.kv.Get(ctx, bucketPrefix(cfg.Bucket), clientv3.WithFirstKey()...)
+	if err != nil {
+		return nil, err
+	}
+	if took := qu.clock.Since(now); cfg.MaxLatency > 0 && took > cfg.MaxLatency {
+		glog.V(2).Infof("backfill: read latency %v exceeds %v", took, cfg.MaxLatency)
+		return nil, nil
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	item, err := decodeItem(resp.Kvs[0])
+	if err != nil {
+		return nil, err
+	}
+	item.Status = StatusClaimed
+	item.ClaimedAt = qu.clock.Now()
+	data, err := marshalItem(item)
+	if err != nil {
+		return nil, err
+	}
+
+	// claim the item, in case other workers pop it concurrently
+	queueKey := path.Join(pfxQueue, item.Key)
+	tresp, err := qu.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(queueKey), "=", resp.Kvs[0].ModRevision)).
+		Then(append([]clientv3.Op{clientv3.OpDelete(queueKey), qu.eventOp(ctx, EventPop, item.Bucket, item.Key, data)}, indexOps(item, data, StatusInProgress, StatusPending)...)...).
+		Commit()
+	qu.invalidateFront(item.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete %q (%v)", queueKey, err)
+	}
+	if !tresp.Succeeded {
+		return nil, nil
+	}
+	observeClaim(item)
+	return item, nil
+}
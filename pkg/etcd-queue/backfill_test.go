@@ -0,0 +1,70 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueuePopBackfill(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	cfg := BackfillConfig{
+		Bucket:             "backfill-bucket",
+		InteractiveBuckets: []string{"interactive-bucket"},
+		MaxLatency:         time.Second,
+		PollInterval:       100 * time.Millisecond,
+	}
+
+	interactive := CreateItem("interactive-bucket", 100, "user-request")
+	backfill := CreateItem("backfill-bucket", 100, "reindex")
+	for _, it := range []*Item{interactive, backfill} {
+		if err = qu.Add(context.Background(), it); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bch := qu.PopBackfill(context.Background(), cfg)
+	select {
+	case it := <-bch:
+		t.Fatalf("unexpected backfill item %+v", it)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	item := <-qu.Pop(context.Background(), "interactive-bucket")
+	if err = interactive.Equal(item); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case it := <-bch:
+		if err = backfill.Equal(it); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected backfill item, but got none")
+	}
+
+	items, err := qu.List(context.Background(), "backfill-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Fatalf("expected backfill item popped, got %+v", items)
+	}
+}
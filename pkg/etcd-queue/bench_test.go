@@ -0,0 +1,88 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newBenchQueue starts an embedded queue for benchmarks.
+func newBenchQueue(b *testing.B) (Queue, func()) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		b.Fatal(err)
+	}
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		os.RemoveAll(dataDir)
+		b.Fatal(err)
+	}
+	return qu, func() {
+		qu.Stop()
+		os.RemoveAll(dataDir)
+	}
+}
+
+func BenchmarkEnqueue(b *testing.B) {
+	qu, stop := newBenchQueue(b)
+	defer stop()
+
+	value := strings.Repeat("x", 256)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := qu.Add(context.Background(), CreateItem("bench-bucket", 100, value)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEnqueueParallelCoalesced(b *testing.B) {
+	defer func(window time.Duration) { AddCoalesceWindow = window }(AddCoalesceWindow)
+	AddCoalesceWindow = 5 * time.Millisecond
+
+	qu, stop := newBenchQueue(b)
+	defer stop()
+
+	value := strings.Repeat("x", 256)
+	b.SetParallelism(32)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := qu.Add(context.Background(), CreateItem("bench-bucket", 100, value)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFrontDeepBucket(b *testing.B) {
+	qu, stop := newBenchQueue(b)
+	defer stop()
+
+	value := strings.Repeat("x", 256)
+	items := make([]*Item, 0, 10000)
+	for i := 0; i < cap(items); i++ {
+		items = append(items, CreateItem("bench-bucket", uint64(i)%MaxWeight, value))
+	}
+	if err := qu.AddBatch(context.Background(), items); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		item, err := qu.Front(context.Background(), "bench-bucket")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if item == nil {
+			b.Fatal("expected front item")
+		}
+	}
+}
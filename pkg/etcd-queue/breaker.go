@@ -0,0 +1,126 @@
+package etcdqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrQueueUnavailable is returned without sending requests to etcd,
+// while the circuit breaker is open after consecutive etcd failures.
+var ErrQueueUnavailable = errors.New("queue: etcd is unavailable")
+
+var (
+	// BreakerThreshold is the number of consecutive etcd failures, after
+	// retries, to open the circuit breaker. Zero disables the breaker.
+	BreakerThreshold = 5
+
+	// BreakerCooldown is how long the open breaker fails requests fast,
+	// before letting requests through to probe etcd again.
+	BreakerCooldown = 10 * time.Second
+)
+
+var breakerTrips = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "etcdqueue",
+	Name:      "breaker_trips_total",
+	Help:      "Number of times the circuit breaker opened on etcd failures.",
+})
+
+func init() {
+	prometheus.MustRegister(breakerTrips)
+}
+
+// breaker is a circuit breaker of etcd requests. It opens after
+// 'BreakerThreshold' consecutive failures, and is half-open after
+// 'BreakerCooldown': the next failure opens it again, and the next
+// success closes it.
+type breaker struct {
+	clock    Clock
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+}
+
+// clk returns the clock of the breaker, or DefaultClock if not set.
+func (b *breaker) clk() Clock {
+	if b == nil || b.clock == nil {
+		return DefaultClock
+	}
+	return b.clock
+}
+
+// allow returns false if the breaker is open.
+func (b *breaker) allow() bool {
+	if b == nil || BreakerThreshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures < BreakerThreshold || b.clk().Since(b.openedAt) >= BreakerCooldown
+}
+
+// do fails fast with ErrQueueUnavailable if the breaker is open, or
+// calls f with retries on transient errors, and records the result.
+func (b *breaker) do(ctx context.Context, f func() error) error {
+	if !b.allow() {
+		return ErrQueueUnavailable
+	}
+	err := retryTransient(ctx, b.clk(), f)
+	b.record(err)
+	return err
+}
+
+// once is do without retries.
+func (b *breaker) once(ctx context.Context, f func() error) error {
+	if !b.allow() {
+		return ErrQueueUnavailable
+	}
+	err := f()
+	b.record(err)
+	return err
+}
+
+// record records the result of an etcd request.
+func (b *breaker) record(err error) {
+	if b == nil || BreakerThreshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isUnavailable(err) {
+		if b.failures >= BreakerThreshold {
+			glog.Infof("queue: closed circuit breaker, etcd is available")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= BreakerThreshold {
+		if b.failures == BreakerThreshold {
+			glog.Warningf("queue: opened circuit breaker after %d consecutive etcd failures (%v)", b.failures, err)
+			breakerTrips.Inc()
+		}
+		b.openedAt = b.clk().Now()
+	}
+}
+
+// isUnavailable returns true if the error means etcd could not serve
+// the request, as opposed to rejecting it (e.g. compacted revision).
+func isUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if isTransient(err) || err == context.DeadlineExceeded {
+		return true
+	}
+	if st, ok := status.FromError(err); ok {
+		return st.Code() == codes.DeadlineExceeded
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package etcdqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+func TestBreaker(t *testing.T) {
+	oldRetries, oldThreshold, oldCooldown := TransientRetries, BreakerThreshold, BreakerCooldown
+	TransientRetries, BreakerThreshold, BreakerCooldown = 0, 2, 200*time.Millisecond
+	defer func() { TransientRetries, BreakerThreshold, BreakerCooldown = oldRetries, oldThreshold, oldCooldown }()
+	clk := NewFakeClock(time.Now())
+
+	f := &flakyKV{err: rpctypes.ErrNoLeader, failures: 3}
+	br := &breaker{clock: clk}
+	kv := retryKV{kv: f, br: br}
+
+	// consecutive failures open the breaker
+	for i := 0; i < 2; i++ {
+		if _, err := kv.Put(context.Background(), "foo", "bar"); err != rpctypes.ErrNoLeader {
+			t.Fatalf("#%d: expected %v, got %v", i, rpctypes.ErrNoLeader, err)
+		}
+	}
+	if _, err := kv.Put(context.Background(), "foo", "bar"); err != ErrQueueUnavailable {
+		t.Fatalf("expected %v, got %v", ErrQueueUnavailable, err)
+	}
+	if _, err := kv.Txn(context.Background()).Commit(); err != ErrQueueUnavailable {
+		t.Fatalf("expected %v, got %v", ErrQueueUnavailable, err)
+	}
+	if f.calls != 2 {
+		t.Fatalf("expected 2 calls to etcd, got %d", f.calls)
+	}
+
+	// failed probe opens the breaker again
+	clk.Advance(BreakerCooldown)
+	if _, err := kv.Put(context.Background(), "foo", "bar"); err != rpctypes.ErrNoLeader {
+		t.Fatalf("expected %v, got %v", rpctypes.ErrNoLeader, err)
+	}
+	if _, err := kv.Put(context.Background(), "foo", "bar"); err != ErrQueueUnavailable {
+		t.Fatalf("expected %v, got %v", ErrQueueUnavailable, err)
+	}
+
+	// Add, AddBatch, and Front fail fast
+	qu := &queue{breaker: br}
+	if err := qu.Add(context.Background(), CreateItem("my-job", 100, "")); err != ErrQueueUnavailable {
+		t.Fatalf("expected %v, got %v", ErrQueueUnavailable, err)
+	}
+	if err := qu.AddBatch(context.Background(), []*Item{CreateItem("my-job", 100, "")}); err != ErrQueueUnavailable {
+		t.Fatalf("expected %v, got %v", ErrQueueUnavailable, err)
+	}
+	if _, err := qu.Front(context.Background(), "my-job"); err != ErrQueueUnavailable {
+		t.Fatalf("expected %v, got %v", ErrQueueUnavailable, err)
+	}
+
+	// successful probe closes the breaker
+	clk.Advance(BreakerCooldown)
+	for i := 0; i < 3; i++ {
+		if _, err := kv.Put(context.Background(), "foo", "bar"); err != nil {
+			t.Fatalf("#%d: unexpected error %v", i, err)
+		}
+	}
+	if f.calls != 6 {
+		t.Fatalf("expected 6 calls to etcd, got %d", f.calls)
+	}
+}
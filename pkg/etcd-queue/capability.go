@@ -0,0 +1,46 @@
+package etcdqueue
+
+// Capabilities are the payloads a worker can process, advertised on
+// RegisterWorker. Pop with the worker context (see 'Worker.Context') only
+// offers items the worker accepts, so that a worker of schema version 1
+// does not pull version 2 items it would fail immediately. Empty fields
+// accept all items.
+type Capabilities struct {
+	// SchemaVersions are the supported 'Item.SchemaVersion'.
+	SchemaVersions []int `json:"schema_versions,omitempty"`
+
+	// ModelTypes are the supported 'Item.ModelType' (e.g. "cnn", "rnn").
+	ModelTypes []string `json:"model_types,omitempty"`
+
+	// ContentTypes are the supported 'Item.ContentType', as media ranges
+	// (e.g. "image/*", "application/json").
+	ContentTypes []string `json:"content_types,omitempty"`
+}
+
+// Accepts returns true if the worker of the capabilities can process the
+// item. Items without schema version, model type or content type are
+// accepted by all.
+func (c Capabilities) Accepts(item *Item) bool {
+	if item.SchemaVersion != 0 && len(c.SchemaVersions) > 0 {
+		ok := false
+		for _, v := range c.SchemaVersions {
+			ok = ok || v == item.SchemaVersion
+		}
+		if !ok {
+			return false
+		}
+	}
+	if item.ModelType != "" && len(c.ModelTypes) > 0 {
+		ok := false
+		for _, tp := range c.ModelTypes {
+			ok = ok || tp == item.ModelType
+		}
+		if !ok {
+			return false
+		}
+	}
+	if item.ContentType != "" && !matchContentType(item.ContentType, c.ContentTypes) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCapabilitiesAccepts(t *testing.T) {
+	caps := Capabilities{SchemaVersions: []int{1, 2}, ModelTypes: []string{"cnn"}, ContentTypes: []string{"image/*", ContentTypeJSON}}
+	for i, tt := range []struct {
+		item   *Item
+		accept bool
+	}{
+		{&Item{}, true},
+		{&Item{SchemaVersion: 2}, true},
+		{&Item{SchemaVersion: 3}, false},
+		{&Item{ModelType: "cnn"}, true},
+		{&Item{SchemaVersion: 1, ModelType: "rnn"}, false},
+		{&Item{ContentType: ContentTypeJPEG}, true},
+		{&Item{ContentType: "application/json; charset=utf-8"}, true},
+		{&Item{ContentType: ContentTypeOctetStream}, false},
+	} {
+		if ok := caps.Accepts(tt.item); ok != tt.accept {
+			t.Fatalf("#%d: expected %v, got %v", i, tt.accept, ok)
+		}
+	}
+	if !(Capabilities{}).Accepts(&Item{SchemaVersion: 3, ModelType: "rnn", ContentType: ContentTypeOctetStream}) {
+		t.Fatal("expected empty capabilities to accept all items")
+	}
+}
+
+func TestWorkerCapabilities(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	v1, err := qu.RegisterWorker(ctx, "v1", Capabilities{SchemaVersions: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v1.Close()
+	v2, err := qu.RegisterWorker(ctx, "v2", Capabilities{SchemaVersions: []int{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v2.Close()
+	ws, err := qu.Workers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ws) != 2 || len(ws[1].Capabilities.SchemaVersions) != 2 {
+		t.Fatalf("unexpected workers %+v", ws)
+	}
+
+	newItem := CreateItem("my-job", 100, "v2 job")
+	newItem.SchemaVersion = 2
+	oldItem := CreateItem("my-job", 100, "v1 job")
+	oldItem.SchemaVersion = 1
+	if err = qu.AddBatch(ctx, []*Item{newItem, oldItem}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the v1 worker is not offered the v2 item
+	popped := <-qu.Pop(v1.Context(ctx), "my-job")
+	if popped.Err() != nil || popped.Key != oldItem.Key {
+		t.Fatalf("expected %q, got %+v", oldItem.Key, popped)
+	}
+	cctx, cancel := context.WithTimeout(v1.Context(ctx), 300*time.Millisecond)
+	blocked := <-qu.Pop(cctx, "my-job")
+	cancel()
+	if blocked.Err() == nil {
+		t.Fatalf("expected Pop to skip %q, got %+v", newItem.Key, blocked)
+	}
+	popped = <-qu.Pop(v2.Context(ctx), "my-job")
+	if popped.Err() != nil || popped.Key != newItem.Key {
+		t.Fatalf("expected %q, got %+v", newItem.Key, popped)
+	}
+}
@@ -0,0 +1,67 @@
+package etcdqueue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// ErrBucketFull is returned when adding items would exceed
+// the bucket 'MaxPending', to give back-pressure to producers.
+var ErrBucketFull = errors.New("queue: bucket is full")
+
+// WithWaitCapacity configures Add and AddBatch to block until the bucket
+// has capacity for the items, or the context is done, instead of
+// returning ErrBucketFull.
+func WithWaitCapacity() OpOption {
+	return func(op *Op) { op.waitCapacity = true }
+}
+
+// CapacityPollInterval is the interval to re-check pending items,
+// when Add waits for the bucket capacity.
+var CapacityPollInterval = time.Second
+
+// checkCapacity returns ErrBucketFull if any bucket does not have
+// capacity for the items. The limit is best-effort, since concurrent
+// writers may add items at the same time.
+func (qu *queue) checkCapacity(ctx context.Context, wait bool, items ...*Item) error {
+	counts := make(map[string]int64)
+	for _, item := range items {
+		counts[item.Bucket]++
+	}
+	for bucket, n := range counts {
+		for {
+			cfg, err := qu.bucketConfig(ctx, bucket)
+			if err != nil {
+				return err
+			}
+			if cfg.MaxPending == 0 {
+				break
+			}
+			if n > int64(cfg.MaxPending) {
+				return ErrBucketFull
+			}
+			resp, err := qu.kv.Get(ctx, bucketPrefix(bucket), clientv3.WithPrefix(), clientv3.WithCountOnly())
+			if err != nil {
+				return err
+			}
+			if resp.Count+n <= int64(cfg.MaxPending) {
+				break
+			}
+			if !wait {
+				return ErrBucketFull
+			}
+			glog.V(2).Infof("queue: %q has %d pending items (max %d)", bucket, resp.Count, cfg.MaxPending)
+
+			select {
+			case <-qu.clock.After(CapacityPollInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
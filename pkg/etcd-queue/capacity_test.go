@@ -0,0 +1,73 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCapacity(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	prev := CapacityPollInterval
+	CapacityPollInterval = 50 * time.Millisecond
+	defer func() { CapacityPollInterval = prev }()
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if err = qu.SetBucketConfig(ctx, "test-bucket", BucketConfig{MaxPending: 2}); err != nil {
+		t.Fatal(err)
+	}
+	waitConfig(t, qu, "test-bucket", BucketConfig{MaxPending: 2})
+
+	if err = qu.AddBatch(ctx, []*Item{CreateItem("test-bucket", 100, "a"), CreateItem("test-bucket", 100, "b"), CreateItem("test-bucket", 100, "c")}); err != ErrBucketFull {
+		t.Fatalf("expected %v, got %v", ErrBucketFull, err)
+	}
+	if err = qu.AddBatch(ctx, []*Item{CreateItem("test-bucket", 100, "a"), CreateItem("test-bucket", 100, "b")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, CreateItem("test-bucket", 100, "c")); err != ErrBucketFull {
+		t.Fatalf("expected %v, got %v", ErrBucketFull, err)
+	}
+
+	// other buckets are not limited
+	if err = qu.Add(ctx, CreateItem("other-bucket", 100, "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	err = qu.Add(wctx, CreateItem("test-bucket", 100, "c"), WithWaitCapacity())
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- qu.Add(ctx, CreateItem("test-bucket", 100, "c"), WithWaitCapacity()) }()
+	if item := <-qu.Pop(ctx, "test-bucket"); item.Error != "" {
+		t.Fatal(item.Error)
+	}
+	select {
+	case err = <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Add after Pop")
+	}
+}
@@ -0,0 +1,74 @@
+package etcdqueue
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// ClientConfig configures the etcd client of the queue, to tune large
+// items and flaky networks. Zero values use etcd client defaults.
+type ClientConfig struct {
+	// Endpoints are the etcd client endpoints.
+	Endpoints []string
+
+	// DialTimeout is the timeout for failing to establish a connection.
+	DialTimeout time.Duration
+
+	// KeepAliveTime is the time after which the client pings the server
+	// to see if the transport is alive.
+	KeepAliveTime time.Duration
+
+	// KeepAliveTimeout is the time that the client waits for a response
+	// to the keepalive ping, before closing the connection.
+	KeepAliveTimeout time.Duration
+
+	// MaxSendMsgSize is the client-side request size limit in bytes.
+	// Items larger than etcd server '--max-request-bytes' are rejected
+	// by the server regardless.
+	MaxSendMsgSize int
+
+	// MaxRecvMsgSize is the client-side response size limit in bytes
+	// (e.g. List of large buckets). Defaults to math.MaxInt32.
+	MaxRecvMsgSize int
+
+	// TLS is the client TLS configuration for HTTPS endpoints (e.g.
+	// client certificates for mutual TLS). <nil> for plaintext.
+	TLS *tls.Config
+}
+
+// NewClient creates an etcd client from the configuration.
+func NewClient(cfg ClientConfig) (*clientv3.Client, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, fmt.Errorf("no etcd endpoint")
+	}
+	if cfg.DialTimeout < 0 || cfg.KeepAliveTime < 0 || cfg.KeepAliveTimeout < 0 || cfg.MaxSendMsgSize < 0 || cfg.MaxRecvMsgSize < 0 {
+		return nil, fmt.Errorf("invalid negative value in client config %+v", cfg)
+	}
+	return clientv3.New(clientv3.Config{
+		Endpoints:            cfg.Endpoints,
+		DialTimeout:          cfg.DialTimeout,
+		DialKeepAliveTime:    cfg.KeepAliveTime,
+		DialKeepAliveTimeout: cfg.KeepAliveTimeout,
+		MaxCallSendMsgSize:   cfg.MaxSendMsgSize,
+		MaxCallRecvMsgSize:   cfg.MaxRecvMsgSize,
+		TLS:                  cfg.TLS,
+	})
+}
+
+// NewClientQueue creates a new queue with an etcd client of the
+// configuration. The client is closed on Stop.
+func NewClientQueue(cfg ClientConfig) (Queue, error) {
+	cli, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	qu, err := NewQueue(cli)
+	if err != nil {
+		cli.Close()
+		return nil, err
+	}
+	return qu, nil
+}
@@ -0,0 +1,55 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientQueue(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	srv, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	if _, err = NewClientQueue(ClientConfig{}); err == nil {
+		t.Fatal("expected error without endpoint")
+	}
+	if _, err = NewClientQueue(ClientConfig{Endpoints: []string{"localhost:1"}, MaxSendMsgSize: -1}); err == nil {
+		t.Fatal("expected error with negative message size")
+	}
+
+	qu, err := NewClientQueue(ClientConfig{
+		Endpoints:        []string{fmt.Sprintf("localhost:%d", cport)},
+		DialTimeout:      5 * time.Second,
+		KeepAliveTime:    time.Second,
+		KeepAliveTimeout: time.Second,
+		MaxSendMsgSize:   4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	if err = qu.Add(context.Background(), CreateItem("my-job", 100, "small")); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(context.Background(), CreateItem("my-job", 100, strings.Repeat("x", 8192))); err == nil {
+		t.Fatal("expected error with item larger than 'MaxSendMsgSize'")
+	}
+}
@@ -0,0 +1,162 @@
+package etcdqueue
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for retention, delays, backoffs,
+// and timestamps of items (e.g. 'Item.CompletedAt').
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is the timer of Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the timer from firing, and returns false
+	// if the timer has already fired or been stopped.
+	Stop() bool
+}
+
+// DefaultClock is the clock of queues created without 'WithClock',
+// and of items created by 'CreateItem'. Lease TTLs are expired by etcd,
+// with its own clock.
+var DefaultClock Clock = systemClock{}
+
+// QueueOption configures the queue on creation.
+type QueueOption func(*queue)
+
+// WithClock sets the clock of the queue, so that all timestamps,
+// delays, and event journal keys of the queue follow the clock
+// (e.g. FakeClock in tests to move time without sleeps).
+// Event journal keys are ordered by the clock, so the clock must
+// move between events of the same item, and Add calls coalesced by
+// 'AddCoalesceWindow' wait for the clock to pass the window.
+func WithClock(clk Clock) QueueOption {
+	return func(qu *queue) { qu.clock = clk }
+}
+
+// clockOf returns the clock of the queue, unwrapping ACL and embedded
+// queues, or DefaultClock if not known.
+func clockOf(qu Queue) Clock {
+	switch q := qu.(type) {
+	case *aclQueue:
+		return clockOf(q.Queue)
+	case *embeddedQueue:
+		return clockOf(q.Queue)
+	case *readOnlyQueue:
+		return q.clock
+	case *queue:
+		return q.clock
+	}
+	return DefaultClock
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// FakeClock is Clock that only moves on Advance.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c    *FakeClock
+	at   time.Time
+	fire func(now time.Time)
+}
+
+// NewFakeClock returns FakeClock at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.schedule(d, func(now time.Time) { ch <- now })
+	return ch
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.schedule(d, func(time.Time) { go f() })
+}
+
+// Waiters returns the number of timers not fired yet, so that tests
+// can advance the clock after goroutines start waiting.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Advance moves the clock forward, and fires timers that are due,
+// in the order of their deadlines.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due, pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.at.After(now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, t := range due {
+		t.fire(now)
+	}
+}
+
+func (c *FakeClock) schedule(d time.Duration, fire func(now time.Time)) *fakeTimer {
+	c.mu.Lock()
+	t := &fakeTimer{c: c, at: c.now.Add(d), fire: fire}
+	if d <= 0 {
+		now := c.now
+		c.mu.Unlock()
+		fire(now)
+		return t
+	}
+	c.timers = append(c.timers, t)
+	c.mu.Unlock()
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	c := t.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, ot := range c.timers {
+		if ot == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
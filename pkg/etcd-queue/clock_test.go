@@ -0,0 +1,123 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+	clk := NewFakeClock(start)
+
+	after := clk.After(time.Minute)
+	fired := make(chan struct{})
+	clk.AfterFunc(2*time.Minute, func() { close(fired) })
+	stopped := clk.AfterFunc(time.Minute, func() { t.Fatal("stopped timer fired") })
+	if !stopped.Stop() {
+		t.Fatal("expected the timer stopped")
+	}
+	if stopped.Stop() {
+		t.Fatal("expected the timer already stopped")
+	}
+	if n := clk.Waiters(); n != 2 {
+		t.Fatalf("expected 2 waiters, got %d", n)
+	}
+
+	clk.Advance(30 * time.Second)
+	select {
+	case <-after:
+		t.Fatal("fired before the deadline")
+	default:
+	}
+	if d := clk.Since(start); d != 30*time.Second {
+		t.Fatalf("expected 30s, got %v", d)
+	}
+
+	clk.Advance(30 * time.Second)
+	select {
+	case now := <-after:
+		if !now.Equal(start.Add(time.Minute)) {
+			t.Fatalf("expected %v, got %v", start.Add(time.Minute), now)
+		}
+	default:
+		t.Fatal("expected fired at the deadline")
+	}
+
+	clk.Advance(time.Hour)
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to run the function")
+	}
+	if n := clk.Waiters(); n != 0 {
+		t.Fatalf("expected no waiter, got %d", n)
+	}
+
+	select {
+	case <-clk.After(0):
+	default:
+		t.Fatal("expected fired without delay")
+	}
+}
+
+func TestQueueWithClock(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	// coalesced Add calls wait for the window of the clock
+	defer func(window time.Duration) { AddCoalesceWindow = window }(AddCoalesceWindow)
+	AddCoalesceWindow = 0
+
+	start := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+	clk := NewFakeClock(start)
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir, WithClock(clk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	item := CreateItem("my-job", 100, "foo")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Minute)
+	canceled, err := qu.Cancel(ctx, item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !canceled.CanceledAt.Equal(start.Add(time.Minute)) {
+		t.Fatalf("expected canceled at %v, got %v", start.Add(time.Minute), canceled.CanceledAt)
+	}
+
+	// journal keys and timestamps follow the clock of the queue
+	evs, err := qu.ReadEvents(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []time.Time
+	for _, ev := range evs {
+		if ev.Bucket == "my-job" {
+			got = append(got, ev.CreatedAt.UTC())
+		}
+	}
+	expected := []time.Time{start, start.Add(time.Minute)}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(got))
+	}
+	for i := range expected {
+		if !got[i].Equal(expected[i]) {
+			t.Fatalf("#%d: expected event at %v, got %v", i, expected[i], got[i])
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package etcdqueue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// AddCoalesceWindow is the latency budget to coalesce concurrent Add
+// calls into one transaction, reducing round trips when ingesting bursts
+// of items. Zero disables coalescing, so that each Add is written in its
+// own transaction. The window follows the clock of the queue (see
+// 'WithClock').
+var AddCoalesceWindow = 5 * time.Millisecond
+
+// maxTxnOps is etcd's default '--max-txn-ops' limit.
+const maxTxnOps = 128
+
+// addRequest is an Add call waiting to be coalesced.
+type addRequest struct {
+	ctx  context.Context
+	item *Item
+	ttl  int64
+	// lease is the lease of the session bucket, if any.
+	lease clientv3.LeaseID
+	errc  chan error
+}
+
+// coalescer batches Add requests, until the window expires or the
+// batch reaches the transaction limit.
+type coalescer struct {
+	mu      sync.Mutex
+	pending []*addRequest
+	nops    int
+	nbytes  int
+	keys    map[string]struct{}
+	timer   Timer
+}
+
+// coalesceAdd queues the item to be written with other Add calls,
+// and waits for the batch to be committed.
+func (qu *queue) coalesceAdd(ctx context.Context, item *Item, data []byte, ttl int64, window time.Duration) error {
+	lease, err := qu.sessionLease(ctx, item.Bucket)
+	if err != nil {
+		return err
+	}
+	req := &addRequest{ctx: ctx, item: item, ttl: ttl, lease: lease, errc: make(chan error, 1)}
+	// the item, its operations, its sequence counter, and the usage
+	// counters of its owner and bucket
+	nops := len(qu.addOps(ctx, item, data)) + 4
+	nbytes := nops * len(data)
+
+	c := &qu.coalescer
+	c.mu.Lock()
+	_, dup := c.keys[item.Key]
+	if dup || c.nops+nops > maxTxnOps || c.nbytes+nbytes > maxTxnBytes {
+		// same keys cannot be written twice in one transaction, and
+		// transactions are limited in operations and bytes
+		qu.flushLocked()
+	}
+	if c.keys == nil {
+		c.keys = make(map[string]struct{})
+	}
+	c.pending = append(c.pending, req)
+	c.nops += nops
+	c.nbytes += nbytes
+	c.keys[item.Key] = struct{}{}
+	if len(c.pending) == 1 {
+		c.timer = qu.clock.AfterFunc(window, func() {
+			c.mu.Lock()
+			qu.flushLocked()
+			c.mu.Unlock()
+		})
+	}
+	c.mu.Unlock()
+
+	select {
+	case err := <-req.errc:
+		return err
+	case <-ctx.Done():
+		// the item may still be written, if the batch is being committed
+		return ctx.Err()
+	}
+}
+
+// flushLocked commits the pending batch in the background.
+// It must be called with the coalescer lock held.
+func (qu *queue) flushLocked() {
+	c := &qu.coalescer
+	if len(c.pending) == 0 {
+		return
+	}
+	c.timer.Stop()
+	reqs := c.pending
+	c.pending, c.nops, c.nbytes, c.keys = nil, 0, 0, nil
+	if !qu.goBackground("coalesce", "", func() { qu.commitAdds(reqs) }) {
+		for _, req := range reqs {
+			req.errc <- ErrQueueClosed
+		}
+	}
+}
+
+// failCoalesced fails the pending batch with the error, without
+// committing it (e.g. on Stop).
+func (qu *queue) failCoalesced(err error) {
+	c := &qu.coalescer
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		return
+	}
+	c.timer.Stop()
+	for _, req := range c.pending {
+		req.errc <- err
+	}
+	c.pending, c.nops, c.nbytes, c.keys = nil, 0, 0, nil
+}
+
+func (qu *queue) commitAdds(reqs []*addRequest) {
+	qu.writemu.Lock()
+	defer qu.writemu.Unlock()
+	defer qu.recoverPanic("coalesce", "", func(err error) {
+		for _, req := range reqs {
+			select {
+			case req.errc <- err:
+			default:
+			}
+		}
+	})
+
+	// the batch outlives the callers, so it has its own timeout;
+	// skip canceled requests, and share one lease per TTL
+	ctx, cancel := qu.withTimeout(qu.rootCtx)
+	defer cancel()
+	leases := make(map[int64]clientv3.LeaseID)
+	var putOpts [][]clientv3.OpOption
+	var written []*addRequest
+	for _, req := range reqs {
+		if err := req.ctx.Err(); err != nil {
+			req.errc <- err
+			continue
+		}
+		var opts []clientv3.OpOption
+		if req.lease != 0 {
+			opts = append(opts, clientv3.WithLease(req.lease))
+		} else if req.ttl > 5 {
+			id, ok := leases[req.ttl]
+			if !ok {
+				resp, err := qu.grant(ctx, req.ttl)
+				if err != nil {
+					req.errc <- err
+					continue
+				}
+				id = resp.ID
+				leases[req.ttl] = id
+			}
+			opts = append(opts, clientv3.WithLease(id))
+		}
+		putOpts = append(putOpts, opts)
+		written = append(written, req)
+	}
+	if len(written) == 0 {
+		return
+	}
+
+	errs := make([]error, len(written))
+	err := qu.writeCoalesced(ctx, written, putOpts)
+	if err != nil && len(written) > 1 && IsQuotaExceeded(err) {
+		// coalesced Add calls are independent, so that only the items
+		// over quota are rejected, as if written one by one
+		for i := range written {
+			errs[i] = qu.writeCoalesced(ctx, written[i:i+1], putOpts[i:i+1])
+		}
+	} else {
+		for i := range written {
+			errs[i] = err
+		}
+	}
+	for i, req := range written {
+		qu.invalidateFront(req.item.Bucket)
+		req.errc <- errs[i]
+	}
+	if err == nil {
+		glog.Infof("queue: wrote %d coalesced items", len(written))
+	}
+}
+
+// writeCoalesced writes the items of the requests in one transaction.
+func (qu *queue) writeCoalesced(ctx context.Context, reqs []*addRequest, putOpts [][]clientv3.OpOption) error {
+	items := make([]*Item, len(reqs))
+	for i, req := range reqs {
+		items[i] = req.item
+	}
+	_, err := qu.sequenceTxn(ctx, items, nil, func(vals [][]byte) []clientv3.Op {
+		var ops []clientv3.Op
+		for i, req := range reqs {
+			ops = append(ops, clientv3.OpPut(PendingKey(req.item.Key), string(vals[i]), putOpts[i]...))
+			ops = append(ops, qu.addOps(req.ctx, req.item, vals[i])...)
+		}
+		return ops
+	})
+	return err
+}
@@ -0,0 +1,150 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAddCoalesce(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	defer func(window time.Duration) { AddCoalesceWindow = window }(AddCoalesceWindow)
+	AddCoalesceWindow = 5 * time.Millisecond
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	resp, err := qu.Client().Get(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := resp.Header.Revision
+
+	// more items than one transaction can hold
+	n := 100
+	var wg sync.WaitGroup
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			item := CreateItem("test-bucket", 100, fmt.Sprintf("%d", i))
+			item.Owner = "test-owner"
+			errc <- qu.Add(context.Background(), item, WithTTL(time.Minute))
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := qu.List(context.Background(), "test-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Fatalf("expected %d items, got %d", n, len(items))
+	}
+	evs, err := qu.ReadEvents(context.Background(), rev+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != n {
+		t.Fatalf("expected %d events, got %d", n, len(evs))
+	}
+	revs := make(map[int64]struct{})
+	for _, ev := range evs {
+		revs[ev.Rev] = struct{}{}
+	}
+	if len(revs) >= n/2 {
+		t.Fatalf("expected coalesced transactions, got %d revisions for %d items", len(revs), n)
+	}
+
+	// canceled Add is not written
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = qu.Add(ctx, CreateItem("test-bucket", 100, "canceled")); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if items, err = qu.List(context.Background(), "test-bucket"); err != nil || len(items) != n {
+		t.Fatalf("expected %d items, got %d (%v)", n, len(items), err)
+	}
+}
+
+func TestAddCoalesceQuota(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	defer func(window time.Duration) { AddCoalesceWindow = window }(AddCoalesceWindow)
+	AddCoalesceWindow = 100 * time.Millisecond
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	item := CreateItem("test-bucket", 100, "data")
+	item.Owner = "bob"
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	u, err := qu.OwnerUsage(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.SetOwnerQuota(ctx, "alice", Quota{MaxBytes: 2*u.Bytes + u.Bytes/2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a coalesced batch over quota rejects only the items over quota
+	var wg sync.WaitGroup
+	var added, exceeded int64
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item := CreateItem("test-bucket", 100, "data")
+			item.Owner = "alice"
+			switch err := qu.Add(ctx, item); {
+			case err == nil:
+				atomic.AddInt64(&added, 1)
+			case IsQuotaExceeded(err):
+				atomic.AddInt64(&exceeded, 1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 2 || exceeded != 2 {
+		t.Fatalf("expected 2 added and 2 rejected, got %d and %d", added, exceeded)
+	}
+}
@@ -0,0 +1,70 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/go-semver/semver"
+	"github.com/golang/glog"
+)
+
+// MinEtcdVersion is the minimum server version of external etcd
+// clusters, checked by NewQueue. Older clusters lack server features
+// the queue depends on, and fail in unexpected ways at runtime.
+var MinEtcdVersion = semver.Version{Major: 3, Minor: 2}
+
+// IncompatibleClusterError is returned by NewQueue when the etcd
+// cluster does not meet the requirements of the queue.
+type IncompatibleClusterError struct {
+	// Endpoint is the endpoint of the incompatible member, if any.
+	Endpoint string
+	Reason   string
+}
+
+func (e *IncompatibleClusterError) Error() string {
+	if e.Endpoint == "" {
+		return fmt.Sprintf("queue: incompatible etcd cluster (%s)", e.Reason)
+	}
+	return fmt.Sprintf("queue: incompatible etcd cluster at %q (%s)", e.Endpoint, e.Reason)
+}
+
+// checkCluster fails fast if any endpoint is older than 'MinEtcdVersion',
+// or if the cluster rejects transactions of 'maxTxnOps' operations or
+// lease grants. Read-only queues do not grant leases.
+func checkCluster(ctx context.Context, cli *clientv3.Client, readOnly bool) error {
+	for _, ep := range cli.Endpoints() {
+		resp, err := cli.Status(ctx, ep)
+		if err != nil {
+			return fmt.Errorf("failed to get status of %q (%v)", ep, err)
+		}
+		v, err := semver.NewVersion(resp.Version)
+		if err != nil {
+			return &IncompatibleClusterError{Endpoint: ep, Reason: fmt.Sprintf("unknown version %q", resp.Version)}
+		}
+		if v.LessThan(MinEtcdVersion) {
+			return &IncompatibleClusterError{Endpoint: ep, Reason: fmt.Sprintf("version %s is older than %s", v, MinEtcdVersion)}
+		}
+		glog.Infof("etcd endpoint %q has version %s", ep, v)
+	}
+
+	ops := make([]clientv3.Op, maxTxnOps)
+	for i := range ops {
+		ops[i] = clientv3.OpGet(pfxFeatures, clientv3.WithCountOnly())
+	}
+	if _, err := cli.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return &IncompatibleClusterError{Reason: fmt.Sprintf("transaction of %d operations failed (%v); '--max-txn-ops' must be at least %d", maxTxnOps, err, maxTxnOps)}
+	}
+
+	if readOnly {
+		return nil
+	}
+	lresp, err := cli.Grant(ctx, 5)
+	if err != nil {
+		return &IncompatibleClusterError{Reason: fmt.Sprintf("lease grant failed (%v)", err)}
+	}
+	if _, err = cli.Revoke(ctx, lresp.ID); err != nil {
+		glog.Warningf("failed to revoke lease %x (%v)", lresp.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/go-semver/semver"
+)
+
+func TestCheckCluster(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	cli, err := clientv3.New(clientv3.Config{Endpoints: qu.ClientEndpoints()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	ctx := context.Background()
+	if err = checkCluster(ctx, cli, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewQueue(cli); err != nil {
+		t.Fatal(err)
+	}
+
+	old := MinEtcdVersion
+	defer func() { MinEtcdVersion = old }()
+	MinEtcdVersion = semver.Version{Major: 99}
+	_, err = NewQueue(cli)
+	cerr, ok := err.(*IncompatibleClusterError)
+	if !ok || cerr.Endpoint != qu.ClientEndpoints()[0] || !strings.Contains(cerr.Reason, "older than 99.0.0") {
+		t.Fatalf("expected IncompatibleClusterError, got %v", err)
+	}
+}
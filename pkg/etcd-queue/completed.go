@@ -0,0 +1,307 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+const pfxCompleted = "_completed"
+
+// CompleteHook is called on Complete, and may update the item
+// (e.g. set ResultURL). Errors are logged, and do not fail completion.
+type CompleteHook func(ctx context.Context, item *Item) error
+
+func (qu *queue) AddCompleteHook(h CompleteHook) {
+	qu.hooksmu.Lock()
+	qu.completeHooks = append(qu.completeHooks, h)
+	qu.hooksmu.Unlock()
+}
+
+// completedPrefix returns the key prefix of all completed items in the bucket.
+func completedPrefix(bucket string) string {
+	return path.Join(pfxCompleted, bucket) + "/"
+}
+
+func (qu *queue) Complete(ctx context.Context, item *Item) error {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if item == nil {
+		return fmt.Errorf("received <nil> Item")
+	}
+	if item.Key == "" {
+		return fmt.Errorf("received empty item key %+v", item)
+	}
+	if err := checkItemKey(item); err != nil {
+		return err
+	}
+
+	if err := item.Transition(terminalStatus(item)); err != nil {
+		return err
+	}
+
+	retried, err := qu.retry(ctx, item)
+	if err != nil {
+		return err
+	}
+	if retried {
+		return nil
+	}
+
+	qu.hooksmu.RLock()
+	hooks := qu.completeHooks
+	qu.hooksmu.RUnlock()
+	for _, h := range hooks {
+		if err := h(ctx, item); err != nil {
+			glog.Warningf("queue: complete hook failed on %q (%v)", item.Key, err)
+		}
+	}
+
+	item.CompletedAt = qu.clock.Now()
+	data, err := marshalItem(item)
+	if err != nil {
+		return err
+	}
+
+	// completed items of session buckets vanish with the session
+	opts, err := qu.leaseOpts(ctx, item.Bucket, 0)
+	if err != nil {
+		return err
+	}
+
+	// joins and parent progress are updated after 'writemu' is released
+	completed := false
+	defer func() {
+		if completed {
+			qu.fireJoin(ctx, item)
+			qu.aggregateProgress(ctx, item.ParentKey)
+		}
+	}()
+
+	qu.writemu.Lock()
+	defer qu.writemu.Unlock()
+
+	// remove from the queue, in case the item was not popped (e.g. canceled)
+	ops := []clientv3.Op{
+		clientv3.OpDelete(path.Join(pfxQueue, item.Key)),
+		clientv3.OpPut(path.Join(pfxCompleted, item.Key), string(data), opts...),
+		qu.eventOp(ctx, EventComplete, item.Bucket, item.Key, data),
+		clientv3.OpPut(completedIndexKey(item), string(data), opts...),
+	}
+	st := terminalStatus(item)
+	if st != StatusCompleted {
+		// unsuccessful jobs may be requested again
+		ops = append(ops, idempotencyOps(item)...)
+	}
+	ops = append(ops, fanOutOps(item)...)
+	ops = append(ops, childProgressOps(item)...)
+	var prev []Status
+	for _, p := range []Status{StatusPending, StatusInProgress, StatusCompleted, StatusFailed, StatusCanceled, StatusExpired} {
+		if p != st {
+			prev = append(prev, p)
+		}
+	}
+	resp, err := qu.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(path.Join(pfxCompleted, item.Key)), "=", 0)).
+		Then(append(ops, indexOps(item, data, st, prev...)...)...).
+		Commit()
+	qu.invalidateFront(item.Bucket)
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrAlreadyCompleted
+	}
+	observeCompletion(item)
+	glog.Infof("queue: completed %q", item.Key)
+	completed = true
+	return nil
+}
+
+func (qu *queue) ListCompleted(ctx context.Context, bucket string) ([]*Item, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	resp, err := qu.kv.Get(ctx, completedPrefix(bucket), clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Item, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		item, err := decodeItem(kv)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (qu *queue) GCCompleted(ctx context.Context, olderThan time.Duration) (int64, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	resp, err := qu.kv.Get(ctx, pfxCompleted+"/", clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	// operations to delete each item, with its index entries
+	var dels []itemDelete
+	for _, kv := range resp.Kvs {
+		item, err := decodeItem(kv)
+		if err != nil {
+			glog.Warningf("queue: deleting malformed completed item (%v)", err)
+			dels = append(dels, itemDelete{key: string(kv.Key), ops: []clientv3.Op{clientv3.OpDelete(string(kv.Key))}})
+			continue
+		}
+		if qu.clock.Since(item.CreatedAt) < qu.retention(ctx, item.Bucket, olderThan) {
+			continue
+		}
+		dels = append(dels, completedDelete(item))
+	}
+
+	qu.writemu.Lock()
+	defer qu.writemu.Unlock()
+
+	deleted, err := qu.commitItemOps(ctx, dels)
+	if err != nil {
+		return deleted, err
+	}
+	glog.Infof("queue: garbage-collected %d completed items older than %v", deleted, olderThan)
+	return deleted, nil
+}
+
+func (qu *queue) DeleteCompleted(ctx context.Context, items ...*Item) (int64, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	dels := make([]itemDelete, 0, len(items))
+	for _, item := range items {
+		if item == nil || item.Key == "" {
+			return 0, fmt.Errorf("received invalid item %+v", item)
+		}
+		dels = append(dels, completedDelete(item))
+	}
+
+	qu.writemu.Lock()
+	defer qu.writemu.Unlock()
+
+	deleted, err := qu.commitItemOps(ctx, dels)
+	if err != nil {
+		return deleted, err
+	}
+	glog.Infof("queue: deleted %d completed items", deleted)
+	return deleted, nil
+}
+
+// completedDelete returns the deletion of the completed item, with its
+// index entries.
+func completedDelete(item *Item) itemDelete {
+	return itemDelete{item: item, key: path.Join(pfxCompleted, item.Key), ops: completedDeleteOps(item)}
+}
+
+// completedDeleteOps returns the operations to delete the completed
+// item, with its index entries.
+func completedDeleteOps(item *Item) []clientv3.Op {
+	ops := []clientv3.Op{
+		clientv3.OpDelete(path.Join(pfxCompleted, item.Key)),
+		clientv3.OpDelete(annotationsPrefix(item.Key), clientv3.WithPrefix()),
+		clientv3.OpDelete(metricsPrefix(item.Key), clientv3.WithPrefix()),
+	}
+	ops = append(ops, unlinkOps(item)...)
+	st := terminalStatus(item)
+	ops = append(ops, unindexOps(item, st)...)
+	if st == StatusCompleted {
+		// keys of other statuses were released on Complete
+		ops = append(ops, idempotencyOps(item)...)
+	}
+	if !item.CompletedAt.IsZero() {
+		ops = append(ops, clientv3.OpDelete(completedIndexKey(item)))
+	}
+	return ops
+}
+
+// itemDelete is the operations deleting an item, whose charge (see
+// 'Item.Charged') is released if its key still exists. Item is <nil>
+// for keys without charges (e.g. malformed items).
+type itemDelete struct {
+	item *Item
+	key  string
+	ops  []clientv3.Op
+}
+
+// commitItemOps commits the operations of each item, in transactions
+// within etcd's default '--max-txn-ops' limit, and returns the number
+// of committed items. It must be called with 'writemu' held.
+func (qu *queue) commitItemOps(ctx context.Context, dels []itemDelete) (int64, error) {
+	var n int64
+	for len(dels) > 0 {
+		// each item may update the usage counters of its owner and bucket
+		var ops []clientv3.Op
+		i := 0
+		for i < len(dels) && len(ops)+len(dels[i].ops)+2*(i+1) <= 4*MaxBatchSize {
+			ops = append(ops, dels[i].ops...)
+			i++
+		}
+		if err := qu.commitDeletes(ctx, dels[:i], ops); err != nil {
+			return n, err
+		}
+		n += int64(i)
+		dels = dels[i:]
+	}
+	return n, nil
+}
+
+// commitDeletes commits the operations of the deletions, releasing the
+// charges of the items whose keys have not been deleted concurrently.
+func (qu *queue) commitDeletes(ctx context.Context, dels []itemDelete, ops []clientv3.Op) error {
+	var guarded []itemDelete
+	var gets []clientv3.Op
+	for _, d := range dels {
+		if d.item != nil && d.item.Charged > 0 {
+			guarded = append(guarded, d)
+			gets = append(gets, clientv3.OpGet(d.key, clientv3.WithKeysOnly()))
+		}
+	}
+	for retry := 0; ; retry++ {
+		var items []*Item
+		var cmps []clientv3.Cmp
+		if len(gets) > 0 {
+			resp, err := qu.kv.Txn(ctx).Then(gets...).Commit()
+			if err != nil {
+				return err
+			}
+			for i, d := range guarded {
+				rev := int64(0)
+				if kvs := resp.Responses[i].GetResponseRange().Kvs; len(kvs) > 0 {
+					rev = kvs[0].ModRevision
+					items = append(items, d.item)
+				}
+				cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(d.key), "=", rev))
+			}
+		}
+		ok, err := qu.releaseTxn(ctx, items, cmps, ops)
+		if err != nil || ok {
+			return err
+		}
+		if err = waitConflict(ctx, retry); err != nil {
+			return err
+		}
+	}
+}
+
+// retention returns the retention of completed items in the bucket,
+// or the default if not configured.
+func (qu *queue) retention(ctx context.Context, bucket string, def time.Duration) time.Duration {
+	cfg, err := qu.bucketConfig(ctx, bucket)
+	if err != nil {
+		glog.Warningf("queue: failed to read config of %q (%v)", bucket, err)
+		return def
+	}
+	if cfg.Retention > 0 {
+		return cfg.Retention
+	}
+	return def
+}
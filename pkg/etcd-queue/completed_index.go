@@ -0,0 +1,73 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// pfxCompletedIndex is the prefix of completed items, partitioned by
+// completion date (UTC), so that recent completions are read with a
+// small range:
+//
+//	_idx/completed-at/<YYYY-MM-DD>/<completed-at-nanoseconds>/<item-key>
+var pfxCompletedIndex = path.Join(pfxIndex, "completed-at")
+
+// completedIndexKey returns the index key of the completed item.
+func completedIndexKey(item *Item) string {
+	t := item.CompletedAt.UTC()
+	return path.Join(pfxCompletedIndex, t.Format("2006-01-02"), fmt.Sprintf("%035X", t.UnixNano()), item.Key)
+}
+
+// completedIndexBound returns the index key that sorts before all
+// items completed at or after the given time.
+func completedIndexBound(t time.Time) string {
+	t = t.UTC()
+	return path.Join(pfxCompletedIndex, t.Format("2006-01-02"), fmt.Sprintf("%035X", t.UnixNano()))
+}
+
+func (qu *queue) ListCompletedSince(ctx context.Context, since time.Time) ([]*Item, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	end := clientv3.GetPrefixRangeEnd(pfxCompletedIndex + "/")
+	resp, err := qu.kv.Get(ctx, completedIndexBound(since), clientv3.WithRange(end))
+	if err != nil {
+		return nil, err
+	}
+	return decodeCompletedIndex(resp.Kvs)
+}
+
+// decodeCompletedIndex returns the items of completed index entries.
+func decodeCompletedIndex(kvs []*mvccpb.KeyValue) ([]*Item, error) {
+	// an item completed more than once has multiple entries, keep the last
+	items := make([]*Item, 0, len(kvs))
+	idx := make(map[string]int, len(kvs))
+	for _, kv := range kvs {
+		var item Item
+		if err := json.Unmarshal(kv.Value, &item); err != nil {
+			return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", string(kv.Key), string(kv.Value), err)
+		}
+		if i, ok := idx[item.Key]; ok {
+			items[i] = &item
+			continue
+		}
+		idx[item.Key] = len(items)
+		items = append(items, &item)
+	}
+	return items, nil
+}
+
+func (qu *queue) ListCompletedBefore(ctx context.Context, before time.Time) ([]*Item, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	resp, err := qu.kv.Get(ctx, pfxCompletedIndex+"/", clientv3.WithRange(completedIndexBound(before)))
+	if err != nil {
+		return nil, err
+	}
+	return decodeCompletedIndex(resp.Kvs)
+}
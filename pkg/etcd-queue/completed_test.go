@@ -0,0 +1,107 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueComplete(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	testBucket := "test-bucket"
+
+	item1 := CreateItem(testBucket, 100, "test-data-1")
+	item2 := CreateItem(testBucket, 100, "test-data-2")
+	item2.CreatedAt = item2.CreatedAt.Add(-time.Hour)
+	for _, it := range []*Item{item1, item2} {
+		if err = qu.Add(context.Background(), it); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// pending items are claimed before completion
+	if popped := <-qu.Pop(context.Background(), testBucket); popped.Key != item1.Key {
+		t.Fatalf("expected %q, got %+v", item1.Key, popped)
+	}
+	item1.Status = StatusClaimed
+	item1.Progress = MaxProgress
+	if err = qu.Complete(context.Background(), item1); err != nil {
+		t.Fatal(err)
+	}
+	item2.Canceled = true
+	if err = qu.Complete(context.Background(), item2); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := qu.List(context.Background(), testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Fatalf("expected no pending items, got %+v", items)
+	}
+	items, err = qu.ListCompleted(context.Background(), testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Progress != MaxProgress || !items[1].Canceled {
+		t.Fatalf("unexpected completed items %+v", items)
+	}
+
+	items, err = qu.ListCompletedSince(context.Background(), time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Key != item1.Key || items[1].Key != item2.Key {
+		t.Fatalf("unexpected completed items %+v", items)
+	}
+	if err = item1.Equal(items[0]); err != nil {
+		t.Fatal(err)
+	}
+	items, err = qu.ListCompletedSince(context.Background(), item2.CompletedAt.Add(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Fatalf("expected no completed items, got %+v", items)
+	}
+
+	n, err := qu.GCCompleted(context.Background(), 30*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 deleted item, got %d", n)
+	}
+	items, err = qu.ListCompleted(context.Background(), testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Key != item1.Key {
+		t.Fatalf("unexpected completed items %+v", items)
+	}
+	items, err = qu.ListCompletedSince(context.Background(), time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Key != item1.Key {
+		t.Fatalf("unexpected completed items %+v", items)
+	}
+}
@@ -0,0 +1,154 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// ConcurrencyScanLimit is the maximum number of pending items scanned
+// by Pop for an item whose concurrency key is not in progress.
+var ConcurrencyScanLimit int64 = 256
+
+const pfxConcurrency = "_concurrency"
+
+// concurrencyKey returns the key revised on every Pop of the label
+// value, so that concurrent Pops of the same value fail all but one.
+func concurrencyKey(bucket, value string) string {
+	return path.Join(pfxConcurrency, bucket, value)
+}
+
+// popEligibleWatcher is popEligible, notified via ItemWatcher.
+func (qu *queue) popEligibleWatcher(ctx context.Context, bucket, label string) ItemWatcher {
+	ch := make(chan *Item, 1)
+	ctx, done := qu.trackWatch(ctx, "pop-eligible", bucketPrefix(bucket))
+	qu.subscribe(ctx, bucket)
+	if !qu.goBackground("pop-eligible", bucket, func() {
+		defer close(ch)
+		defer done()
+		defer qu.recoverPanic("pop-eligible", bucket, func(err error) {
+			notifyItem(ch, &Item{Bucket: bucket, Error: err.Error()})
+		})
+
+		item, err := qu.popEligible(ctx, bucket, label)
+		if err != nil {
+			item = &Item{Bucket: bucket, Error: err.Error()}
+		}
+		ch <- item
+	}) {
+		done()
+		return closedWatcher(bucket)
+	}
+	return ch
+}
+
+// popEligible claims the first pending item whose value of the label
+// (if any) is not in progress, that is not routed to another live
+// worker, and that the worker of the context accepts, waiting until
+// there is one. Items routed to the worker are claimed first.
+func (qu *queue) popEligible(ctx context.Context, bucket, label string) (*Item, error) {
+	pfxQueueBucket := path.Join(pfxQueue, bucket) + "/"
+	pfxInProgress := statusIndexPrefix(StatusInProgress) + bucket + "/"
+	worker := WorkerFrom(ctx)
+	for {
+		ops := []clientv3.Op{
+			clientv3.OpGet(pfxQueueBucket, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend), clientv3.WithLimit(ConcurrencyScanLimit)),
+			clientv3.OpGet(pfxWorkers+"/", clientv3.WithPrefix()),
+		}
+		if label != "" {
+			ops = append(ops, clientv3.OpGet(pfxInProgress, clientv3.WithPrefix()))
+		}
+		resp, err := qu.kv.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return nil, err
+		}
+		alive := make(map[string]*WorkerInfo)
+		for _, kv := range resp.Responses[1].GetResponseRange().Kvs {
+			w, err := decodeWorker(kv.Key, kv.Value)
+			if err != nil {
+				return nil, err
+			}
+			alive[w.ID] = w
+		}
+		caps := Capabilities{}
+		if w := alive[worker]; w != nil {
+			caps = w.Capabilities
+		}
+		busy := make(map[string]bool)
+		if label != "" {
+			for _, kv := range resp.Responses[2].GetResponseRange().Kvs {
+				var ent IndexEntry
+				if err = json.Unmarshal(kv.Value, &ent); err != nil {
+					return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", string(kv.Key), string(kv.Value), err)
+				}
+				if ent.Item != nil && ent.Item.Labels[label] != "" {
+					busy[ent.Item.Labels[label]] = true
+				}
+			}
+		}
+
+		var (
+			item *Item
+			rev  int64
+		)
+		for _, kv := range resp.Responses[0].GetResponseRange().Kvs {
+			it, err := decodeItem(kv)
+			if err != nil {
+				return nil, err
+			}
+			if (label != "" && busy[it.Labels[label]]) || reservedFor(it, worker, alive) || !caps.Accepts(it) {
+				continue
+			}
+			if item == nil || (worker != "" && it.Affinity == worker && item.Affinity != worker) {
+				item, rev = it, kv.ModRevision
+			}
+			if worker == "" || it.Affinity == worker {
+				break
+			}
+		}
+		if item != nil {
+			// the item must still be pending, and no other Pop of the
+			// value may have claimed since the read
+			cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(path.Join(pfxQueue, item.Key)), "=", rev)}
+			var extra []clientv3.Op
+			if value := item.Labels[label]; label != "" && value != "" {
+				ck := concurrencyKey(bucket, value)
+				cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(ck), "<", resp.Header.Revision+1))
+				extra = append(extra, clientv3.OpPut(ck, item.Key))
+			}
+			claimed, err := qu.claimIf(ctx, item, cmps, extra...)
+			if err != nil {
+				return nil, err
+			}
+			if claimed {
+				return item, nil
+			}
+			continue
+		}
+
+		// wait for new items, in-progress items to finish, or workers
+		// to go away
+		glog.V(2).Infof("queue: %q has no eligible pending item (label %q, worker %q)", bucket, label, worker)
+		wctx, cancel := context.WithCancel(ctx)
+		qch := qu.cli.Watch(wctx, pfxQueueBucket, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+		var ich clientv3.WatchChan
+		if label != "" {
+			ich = qu.cli.Watch(wctx, pfxInProgress, clientv3.WithPrefix(), clientv3.WithFilterPut(), clientv3.WithRev(resp.Header.Revision+1))
+		}
+		wch := qu.cli.Watch(wctx, pfxWorkers+"/", clientv3.WithPrefix(), clientv3.WithFilterPut(), clientv3.WithRev(resp.Header.Revision+1))
+		select {
+		case <-qch:
+		case <-ich:
+		case <-wch:
+		case <-ctx.Done():
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
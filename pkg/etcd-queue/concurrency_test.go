@@ -0,0 +1,83 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyKey(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if err = qu.SetBucketConfig(ctx, "fine-tune", BucketConfig{ConcurrencyKey: "user_id"}); err != nil {
+		t.Fatal(err)
+	}
+	var items []*Item
+	for _, user := range []string{"alice", "alice", "bob", ""} {
+		item := CreateItem("fine-tune", 100, "job of "+user)
+		if user != "" {
+			item.Labels = map[string]string{"user_id": user}
+		}
+		if err = qu.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+
+	// the second item of alice is skipped while the first is in progress
+	for _, expected := range []*Item{items[0], items[2], items[3]} {
+		popped := <-qu.Pop(ctx, "fine-tune")
+		if popped.Err() != nil {
+			t.Fatal(popped.Err())
+		}
+		if popped.Key != expected.Key {
+			t.Fatalf("expected %q, got %q", expected.Value, popped.Value)
+		}
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	blocked := <-qu.Pop(cctx, "fine-tune")
+	cancel()
+	if blocked.Err() == nil {
+		t.Fatalf("expected Pop to wait for alice, got %q", blocked.Value)
+	}
+
+	donec := make(chan *Item, 1)
+	go func() {
+		donec <- <-qu.Pop(ctx, "fine-tune")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	first, err := qu.Get(ctx, items[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Item.Progress = MaxProgress
+	if err = qu.Complete(ctx, first.Item); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case popped := <-donec:
+		if popped.Err() != nil || popped.Key != items[1].Key {
+			t.Fatalf("expected %q, got %+v", items[1].Key, popped)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to pop the next item of alice")
+	}
+}
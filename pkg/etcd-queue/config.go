@@ -0,0 +1,364 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/golang/glog"
+)
+
+// BucketConfig configures a bucket. It is stored in etcd, and watched
+// by queues, so that changes take effect without restarting processes.
+// Zero values mean no limit.
+type BucketConfig struct {
+	// Retention is how long completed items are kept. It overrides
+	// the duration given to GCCompleted.
+	Retention time.Duration `json:"retention,omitempty"`
+
+	// RateLimit is the maximum number of items added per second.
+	// Add and AddBatch return RateLimitError when exceeded.
+	RateLimit float64 `json:"rate_limit,omitempty"`
+
+	// RateBurst is the maximum number of items added at once.
+	// Defaults to RateLimit, rounded up.
+	RateBurst int `json:"rate_burst,omitempty"`
+
+	// MaxPending is the maximum number of pending items. Add and AddBatch
+	// return ErrBucketFull when exceeded (see 'WithWaitCapacity').
+	MaxPending int `json:"max_pending,omitempty"`
+
+	// MaxBytes is the maximum total size of pending and completed items,
+	// in JSON. Add and AddBatch return QuotaExceededError when exceeded.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// MaxInFlight is the maximum number of in-progress items.
+	// Pop waits until in-progress items are completed.
+	// The limit is best-effort, since concurrent Pops may claim
+	// items at the same time.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+
+	// ConcurrencyKey is the item label (e.g. "user_id") whose items are
+	// in progress one at a time per label value, while items of other
+	// values proceed in parallel. Pop skips items whose value is in
+	// progress. Items without the label are not limited.
+	ConcurrencyKey string `json:"concurrency_key,omitempty"`
+
+	// Retry is the retry policy of failed items.
+	Retry RetryPolicy `json:"retry,omitempty"`
+
+	// Shadow mirrors a percentage of added items into a shadow bucket.
+	Shadow ShadowConfig `json:"shadow,omitempty"`
+
+	// Paused rejects Add and AddBatch, and Pop, with ErrBucketPaused
+	// (e.g. while the bucket is transferred to another cluster).
+	Paused bool `json:"paused,omitempty"`
+}
+
+// RetryPolicy defines how failed items are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of an item. Complete
+	// requeues failed items until they are attempted MaxAttempts times.
+	// Zero or one means no retry.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+}
+
+// Validate returns an error if the configuration is invalid.
+func (cfg BucketConfig) Validate() error {
+	if cfg.Retention < 0 || cfg.RateLimit < 0 || cfg.RateBurst < 0 || cfg.MaxPending < 0 || cfg.MaxBytes < 0 || cfg.MaxInFlight < 0 || cfg.Retry.MaxAttempts < 0 {
+		return fmt.Errorf("invalid negative value in bucket config %+v", cfg)
+	}
+	return cfg.Shadow.Validate()
+}
+
+// RateLimitError is returned when items are added faster than
+// the rate limit of the bucket.
+type RateLimitError struct {
+	Bucket string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("queue: %q exceeded its rate limit", e.Bucket)
+}
+
+// IsRateLimited returns true if the error is RateLimitError.
+func IsRateLimited(err error) bool {
+	_, ok := err.(*RateLimitError)
+	return ok
+}
+
+const pfxConfig = "_config"
+
+func configKey(bucket string) string {
+	return path.Join(pfxConfig, bucket)
+}
+
+func (qu *queue) SetBucketConfig(ctx context.Context, bucket string, cfg BucketConfig) error {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.Shadow.Bucket == bucket {
+		return fmt.Errorf("%q cannot be its own shadow bucket", bucket)
+	}
+	if cfg == (BucketConfig{}) {
+		_, err := qu.kv.Delete(ctx, configKey(bucket))
+		return err
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = qu.kv.Put(ctx, configKey(bucket), string(data))
+	return err
+}
+
+func (qu *queue) BucketConfig(ctx context.Context, bucket string) (BucketConfig, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	var cfg BucketConfig
+	resp, err := qu.kv.Get(ctx, configKey(bucket))
+	if err != nil {
+		return cfg, err
+	}
+	if len(resp.Kvs) == 0 {
+		return cfg, nil
+	}
+	if err = json.Unmarshal(resp.Kvs[0].Value, &cfg); err != nil {
+		return cfg, fmt.Errorf("%q returned wrong JSON %q (%v)", configKey(bucket), string(resp.Kvs[0].Value), err)
+	}
+	return cfg, nil
+}
+
+// bucketConfig returns the cached configuration of the bucket.
+// The cache is loaded on first use, and kept up-to-date by watch.
+func (qu *queue) bucketConfig(ctx context.Context, bucket string) (BucketConfig, error) {
+	cfg, _, err := qu.lookupConfig(ctx, bucket)
+	return cfg, err
+}
+
+// lookupConfig returns the cached configuration of the bucket,
+// and false if the bucket has no configuration.
+func (qu *queue) lookupConfig(ctx context.Context, bucket string) (BucketConfig, bool, error) {
+	qu.configmu.RLock()
+	configs := qu.configs
+	qu.configmu.RUnlock()
+	if configs == nil {
+		var err error
+		if configs, err = qu.loadConfigs(ctx); err != nil {
+			return BucketConfig{}, false, err
+		}
+	}
+	cfg, ok := configs[bucket]
+	return cfg, ok, nil
+}
+
+func (qu *queue) loadConfigs(ctx context.Context) (map[string]BucketConfig, error) {
+	qu.configmu.Lock()
+	defer qu.configmu.Unlock()
+	if qu.configs != nil {
+		return qu.configs, nil
+	}
+
+	resp, err := qu.kv.Get(ctx, pfxConfig+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	configs := make(map[string]BucketConfig, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var cfg BucketConfig
+		if err = json.Unmarshal(kv.Value, &cfg); err != nil {
+			glog.Warningf("queue: ignoring malformed config %q (%v)", string(kv.Key), err)
+			continue
+		}
+		configs[strings.TrimPrefix(string(kv.Key), pfxConfig+"/")] = cfg
+	}
+	qu.configs = configs
+	rev := resp.Header.Revision + 1
+	qu.goBackground("watch-config", pfxConfig, func() { qu.watchConfigs(rev) })
+	return configs, nil
+}
+
+// watchConfigs applies configuration changes from the revision. If the
+// watch fails (e.g. compacted), the cache is dropped to be reloaded.
+func (qu *queue) watchConfigs(rev int64) {
+	wch := qu.cli.Watch(qu.rootCtx, pfxConfig+"/", clientv3.WithPrefix(), clientv3.WithRev(rev))
+	for wresp := range wch {
+		if err := wresp.Err(); err != nil {
+			glog.Warningf("queue: config watch failed (%v), reloading", err)
+			break
+		}
+		qu.configmu.Lock()
+		configs := make(map[string]BucketConfig, len(qu.configs))
+		for k, v := range qu.configs {
+			configs[k] = v
+		}
+		for _, ev := range wresp.Events {
+			bucket := strings.TrimPrefix(string(ev.Kv.Key), pfxConfig+"/")
+			if ev.Type == mvccpb.DELETE {
+				delete(configs, bucket)
+				continue
+			}
+			var cfg BucketConfig
+			if err := json.Unmarshal(ev.Kv.Value, &cfg); err != nil {
+				glog.Warningf("queue: ignoring malformed config %q (%v)", string(ev.Kv.Key), err)
+				continue
+			}
+			configs[bucket] = cfg
+			glog.Infof("queue: reloaded config of %q %+v", bucket, cfg)
+		}
+		qu.configs = configs
+		qu.configmu.Unlock()
+	}
+
+	qu.configmu.Lock()
+	qu.configs = nil
+	qu.configmu.Unlock()
+}
+
+// rateLimiter is a token bucket of the bucket rate limit.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(cfg BucketConfig, now time.Time) *rateLimiter {
+	burst := float64(cfg.RateBurst)
+	if burst == 0 {
+		burst = float64(int(cfg.RateLimit + 0.999999))
+	}
+	return &rateLimiter{rate: cfg.RateLimit, burst: burst, tokens: burst, last: now}
+}
+
+func (l *rateLimiter) allow(n int, now time.Time) bool {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// checkRateLimit takes tokens for the items from their bucket rate
+// limiters. It takes no token if any bucket exceeds its limit.
+func (qu *queue) checkRateLimit(ctx context.Context, items ...*Item) error {
+	counts := make(map[string]int)
+	for _, item := range items {
+		counts[item.Bucket]++
+	}
+	cfgs := make(map[string]BucketConfig, len(counts))
+	for bucket := range counts {
+		cfg, err := qu.bucketConfig(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if cfg.RateLimit > 0 {
+			cfgs[bucket] = cfg
+		}
+	}
+	if len(cfgs) == 0 {
+		return nil
+	}
+
+	qu.limitmu.Lock()
+	defer qu.limitmu.Unlock()
+	if qu.limiters == nil {
+		qu.limiters = make(map[string]*rateLimiter)
+	}
+	now := qu.clock.Now()
+	taken := make(map[string]*rateLimiter)
+	for bucket, cfg := range cfgs {
+		l, ok := qu.limiters[bucket]
+		if !ok || l.rate != cfg.RateLimit || (cfg.RateBurst > 0 && l.burst != float64(cfg.RateBurst)) {
+			l = newRateLimiter(cfg, now)
+			qu.limiters[bucket] = l
+		}
+		if !l.allow(counts[bucket], now) {
+			for b, tl := range taken {
+				tl.tokens += float64(counts[b])
+			}
+			return &RateLimitError{Bucket: bucket}
+		}
+		taken[bucket] = l
+	}
+	return nil
+}
+
+// InFlightPollInterval is the interval to re-check in-progress items,
+// when Pop waits for the bucket 'MaxInFlight'.
+var InFlightPollInterval = time.Second
+
+// waitInFlight blocks until the bucket has less in-progress items
+// than its 'MaxInFlight'.
+func (qu *queue) waitInFlight(ctx context.Context, bucket string) error {
+	for {
+		cfg, err := qu.bucketConfig(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if cfg.MaxInFlight == 0 {
+			return nil
+		}
+		resp, err := qu.kv.Get(ctx, statusIndexPrefix(StatusInProgress)+bucket+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			return err
+		}
+		if resp.Count < int64(cfg.MaxInFlight) {
+			return nil
+		}
+		glog.V(2).Infof("queue: %q has %d in-progress items (max %d)", bucket, resp.Count, cfg.MaxInFlight)
+
+		select {
+		case <-qu.clock.After(InFlightPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// retry requeues the failed item, if its bucket retry policy allows.
+// It returns false if the item should be completed.
+func (qu *queue) retry(ctx context.Context, item *Item) (bool, error) {
+	if terminalStatus(item) != StatusFailed {
+		return false, nil
+	}
+	cfg, err := qu.bucketConfig(ctx, item.Bucket)
+	if err != nil {
+		return false, err
+	}
+	if item.Attempts+1 >= cfg.Retry.MaxAttempts {
+		return false, nil
+	}
+
+	glog.Warningf("queue: retrying %q after attempt %d of %d (%s)", item.Key, item.Attempts+1, cfg.Retry.MaxAttempts, item.Error)
+	retried := *item
+	retried.Attempts++
+	retried.Error = ""
+	retried.Progress = 0
+	retried.Status = StatusPending
+
+	qu.writemu.Lock()
+	defer qu.writemu.Unlock()
+
+	err = qu.putItem(ctx, &retried, 0, func(data []byte) []clientv3.Op {
+		return append([]clientv3.Op{qu.eventOp(ctx, EventAdd, retried.Bucket, retried.Key, data)}, indexOps(&retried, data, StatusPending, StatusInProgress)...)
+	})
+	qu.invalidateFront(retried.Bucket)
+	if err != nil {
+		return false, err
+	}
+	*item = retried
+	return true, nil
+}
@@ -0,0 +1,139 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBucketConfig(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	prev := InFlightPollInterval
+	InFlightPollInterval = 50 * time.Millisecond
+	defer func() { InFlightPollInterval = prev }()
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if err = qu.SetBucketConfig(ctx, "test-bucket", BucketConfig{MaxInFlight: -1}); err == nil {
+		t.Fatal("expected error on negative MaxInFlight")
+	}
+
+	// load the config cache before update, to test reload by watch
+	if err = qu.Add(ctx, CreateItem("test-bucket", 100, "a")); err != nil {
+		t.Fatal(err)
+	}
+	cfg := BucketConfig{RateLimit: 0.001, RateBurst: 2, MaxInFlight: 1, Retry: RetryPolicy{MaxAttempts: 2}}
+	if err = qu.SetBucketConfig(ctx, "test-bucket", cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := qu.BucketConfig(ctx, "test-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != cfg {
+		t.Fatalf("expected %+v, got %+v", cfg, got)
+	}
+	waitConfig(t, qu, "test-bucket", cfg)
+
+	// rate limit of burst 2, on top of the first item
+	if err = qu.AddBatch(ctx, []*Item{CreateItem("test-bucket", 100, "b"), CreateItem("test-bucket", 100, "c")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, CreateItem("test-bucket", 100, "d")); !IsRateLimited(err) {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+
+	// max in-flight 1
+	item := <-qu.Pop(ctx, "test-bucket")
+	if item.Error != "" {
+		t.Fatal(item.Error)
+	}
+	pctx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	if blocked := <-qu.Pop(pctx, "test-bucket"); blocked.Error != context.DeadlineExceeded.Error() {
+		t.Fatalf("expected Pop blocked by max in-flight, got %+v", blocked)
+	}
+	cancel()
+
+	// first failure is retried
+	item.Error = "out of memory"
+	if err = qu.Complete(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	if item.Attempts != 1 || item.Error != "" {
+		t.Fatalf("expected retried item, got %+v", item)
+	}
+	items, err := qu.List(ctx, "test-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 || items[0].Key != item.Key || items[0].Attempts != 1 {
+		t.Fatalf("expected requeued item first, got %+v", items)
+	}
+
+	// second failure is completed
+	item = <-qu.Pop(ctx, "test-bucket")
+	item.Error = "out of memory"
+	if err = qu.Complete(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	completed, err := qu.ListCompleted(ctx, "test-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 1 || completed[0].Attempts != 1 || completed[0].Error != "out of memory" {
+		t.Fatalf("expected failed item completed, got %+v", completed)
+	}
+
+	// retention overrides GC duration
+	if n, err := qu.GCCompleted(ctx, 0); err != nil || n != 1 {
+		t.Fatalf("expected 1 deleted, got %d (%v)", n, err)
+	}
+	if err = qu.SetBucketConfig(ctx, "test-bucket", BucketConfig{Retention: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	waitConfig(t, qu, "test-bucket", BucketConfig{Retention: time.Hour})
+	item = <-qu.Pop(ctx, "test-bucket")
+	if err = qu.Complete(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := qu.GCCompleted(ctx, 0); err != nil || n != 0 {
+		t.Fatalf("expected 0 deleted within retention, got %d (%v)", n, err)
+	}
+
+	// empty config removes it
+	if err = qu.SetBucketConfig(ctx, "test-bucket", BucketConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	waitConfig(t, qu, "test-bucket", BucketConfig{})
+}
+
+// waitConfig waits until the queue reloads the bucket config.
+func waitConfig(t *testing.T, qu Queue, bucket string, cfg BucketConfig) {
+	for i := 0; i < 50; i++ {
+		got, err := qu.(*embeddedQueue).Queue.(*queue).bucketConfig(context.Background(), bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == cfg {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expected config %+v reloaded", cfg)
+}
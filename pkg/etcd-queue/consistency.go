@@ -0,0 +1,19 @@
+package etcdqueue
+
+import "github.com/coreos/etcd/clientv3"
+
+// WithSerializable configures List, ListSelector, Front and Stats to read
+// from the local etcd member without a quorum round-trip. Serializable
+// reads are cheaper but may return stale items, so they suit dashboards
+// and monitoring, not dispatch decisions. Reads are linearizable by default.
+func WithSerializable() OpOption {
+	return func(op *Op) { op.serializable = true }
+}
+
+// readOpts appends the consistency options of the operation to 'opts'.
+func (op *Op) readOpts(opts ...clientv3.OpOption) []clientv3.OpOption {
+	if op.serializable {
+		opts = append(opts, clientv3.WithSerializable())
+	}
+	return opts
+}
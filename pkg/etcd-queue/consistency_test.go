@@ -0,0 +1,74 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSerializableReads(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	item1 := CreateItem("dashboard", 100, "a")
+	item2 := CreateItem("dashboard", 200, "b")
+	if err = qu.Add(ctx, item1); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, item2); err != nil {
+		t.Fatal(err)
+	}
+
+	// single member serves serializable reads at the latest revision
+	items, err := qu.List(ctx, "dashboard", WithSerializable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items, got %d", len(items))
+	}
+	if err = item2.Equal(items[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = item1.Equal(items[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	front, err := qu.Front(ctx, "dashboard", WithSerializable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if front == nil {
+		t.Fatal("expected front item, got <nil>")
+	}
+	if err = item2.Equal(front); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := qu.Stats(ctx, "dashboard", WithSerializable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lst, err := qu.Stats(ctx, "dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st != lst {
+		t.Fatalf("expected stats %+v, got %+v", lst, st)
+	}
+}
@@ -0,0 +1,131 @@
+package etcdqueue
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// Content types of item values (see 'Item.ContentType').
+const (
+	ContentTypeJSON        = "application/json"
+	ContentTypeText        = "text/plain; charset=utf-8"
+	ContentTypeOctetStream = "application/octet-stream"
+	ContentTypeJPEG        = "image/jpeg"
+)
+
+// textual returns true if values of the media type are stored as is
+// (e.g. "application/json", "text/plain"). Other values are binary,
+// and stored in base64, since item values are JSON strings.
+func textual(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == ContentTypeJSON ||
+		strings.HasSuffix(mediaType, "+json")
+}
+
+// mediaType returns the media type of the content type without
+// parameters (e.g. "text/plain" of "text/plain; charset=utf-8").
+func mediaType(contentType string) (string, error) {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err == nil && !strings.Contains(mt, "/") {
+		err = fmt.Errorf("expected type/subtype")
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid content type %q (%v)", contentType, err)
+	}
+	return mt, nil
+}
+
+// SetBytes sets the value to the data of the content type, encoded in
+// base64 unless the content type is textual (e.g. JSON, text/*).
+func (item *Item) SetBytes(contentType string, data []byte) error {
+	mt, err := mediaType(contentType)
+	if err != nil {
+		return err
+	}
+	item.ContentType = contentType
+	if textual(mt) {
+		item.Value = string(data)
+	} else {
+		item.Value = base64.StdEncoding.EncodeToString(data)
+	}
+	return nil
+}
+
+// Bytes returns the data of the value, decoded by its content type.
+// Values without content type are returned as is.
+func (item *Item) Bytes() ([]byte, error) {
+	if item.ContentType == "" {
+		return []byte(item.Value), nil
+	}
+	mt, err := mediaType(item.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	if textual(mt) {
+		return []byte(item.Value), nil
+	}
+	data, err := base64.StdEncoding.DecodeString(item.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%q has %q value not in base64 (%v)", item.Key, item.ContentType, err)
+	}
+	return data, nil
+}
+
+// validateContent returns an error if any item value does not match its
+// content type (e.g. invalid JSON, or binary value not in base64).
+func validateContent(items ...*Item) error {
+	for _, item := range items {
+		if item.ContentType == "" {
+			continue
+		}
+		mt, err := mediaType(item.ContentType)
+		if err != nil {
+			return fmt.Errorf("%q has %v", item.Key, err)
+		}
+		if mt == ContentTypeJSON || strings.HasSuffix(mt, "+json") {
+			if !json.Valid([]byte(item.Value)) {
+				return fmt.Errorf("%q has %q value not in JSON", item.Key, item.ContentType)
+			}
+			continue
+		}
+		if _, err = item.Bytes(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchContentType returns true if the content type matches any of the
+// media ranges (e.g. "image/*", "*/*"). Empty ranges match all.
+func matchContentType(contentType string, ranges []string) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	mt, err := mediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, r := range ranges {
+		rt, err := mediaType(r)
+		if err != nil {
+			continue
+		}
+		if rt == "*/*" || rt == mt || (strings.HasSuffix(rt, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(rt, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptsContentType returns true if the Accept header value (e.g.
+// "image/*, application/json;q=0.9") accepts the content type. Empty
+// headers accept all.
+func AcceptsContentType(accept, contentType string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	return matchContentType(contentType, strings.Split(accept, ","))
+}
@@ -0,0 +1,119 @@
+package etcdqueue
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestItemBytes(t *testing.T) {
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00}
+	for i, tt := range []struct {
+		contentType string
+		data        []byte
+		value       string
+	}{
+		{ContentTypeJSON, []byte(`{"a":1}`), `{"a":1}`},
+		{ContentTypeText, []byte("a.jpg"), "a.jpg"},
+		{ContentTypeJPEG, jpeg, "/9j/4AA="},
+		{ContentTypeOctetStream, []byte{}, ""},
+	} {
+		item := CreateItem("my-job", 100, "")
+		if err := item.SetBytes(tt.contentType, tt.data); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if item.ContentType != tt.contentType || item.Value != tt.value {
+			t.Fatalf("#%d: unexpected item %q %q", i, item.ContentType, item.Value)
+		}
+		data, err := item.Bytes()
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !bytes.Equal(data, tt.data) {
+			t.Fatalf("#%d: expected %q, got %q", i, tt.data, data)
+		}
+	}
+	if err := CreateItem("my-job", 100, "").SetBytes("image", jpeg); err == nil {
+		t.Fatal("expected invalid content type error")
+	}
+	if data, err := CreateItem("my-job", 100, "\xff").Bytes(); err != nil || string(data) != "\xff" {
+		t.Fatalf("expected value without content type as is, got %q (%v)", data, err)
+	}
+
+	for i, tt := range []struct {
+		accept string
+		ok     bool
+	}{
+		{"", true},
+		{"*/*", true},
+		{"text/html, image/*;q=0.8", true},
+		{"image/jpeg", true},
+		{"image/png, application/json", false},
+	} {
+		if ok := AcceptsContentType(tt.accept, ContentTypeJPEG); ok != tt.ok {
+			t.Fatalf("#%d: expected %v, got %v", i, tt.ok, ok)
+		}
+	}
+}
+
+func TestAddContentType(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	for i, item := range []*Item{
+		{Bucket: "my-job", Key: "my-job/1", Value: "{", ContentType: ContentTypeJSON},
+		{Bucket: "my-job", Key: "my-job/2", Value: "not base64!", ContentType: ContentTypeJPEG},
+		{Bucket: "my-job", Key: "my-job/3", Value: "data", ContentType: "image"},
+	} {
+		if err = qu.Add(ctx, item); err == nil || !strings.Contains(err.Error(), item.Key) {
+			t.Fatalf("#%d: expected invalid value error, got %v", i, err)
+		}
+		if err = qu.AddBatch(ctx, []*Item{item}); err == nil {
+			t.Fatalf("#%d: expected invalid value error", i)
+		}
+	}
+
+	// workers only pop items of their content types
+	jsonWorker, err := qu.RegisterWorker(ctx, "json", Capabilities{ContentTypes: []string{ContentTypeJSON}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jsonWorker.Close()
+	image := CreateItem("my-job", 100, "")
+	if err = image.SetBytes(ContentTypeJPEG, []byte{0xff, 0xd8}); err != nil {
+		t.Fatal(err)
+	}
+	doc := CreateItem("my-job", 100, `{"a":1}`)
+	doc.ContentType = ContentTypeJSON
+	if err = qu.AddBatch(ctx, []*Item{image, doc}); err != nil {
+		t.Fatal(err)
+	}
+	popped := <-qu.Pop(jsonWorker.Context(ctx), "my-job")
+	if popped.Err() != nil || popped.Key != doc.Key || popped.ContentType != ContentTypeJSON {
+		t.Fatalf("expected %q, got %+v", doc.Key, popped)
+	}
+	popped = <-qu.Pop(ctx, "my-job")
+	if popped.Err() != nil || popped.Key != image.Key {
+		t.Fatalf("expected %q, got %+v", image.Key, popped)
+	}
+	if data, err := popped.Bytes(); err != nil || !bytes.Equal(data, []byte{0xff, 0xd8}) {
+		t.Fatalf("unexpected value %q (%v)", data, err)
+	}
+}
@@ -0,0 +1,95 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// pfxDedup is the prefix of delivery records of dedup windows, attached
+// to leases expiring after the window:
+//
+//	_dedup/<name>/<item key>/<sequence>-<attempts> = ""
+const pfxDedup = "_dedup"
+
+// Dedup tracks the items handled by a group of workers within a window,
+// so that handlers skip items delivered more than once (e.g. popped again
+// after a reconnect), instead of repeating their side effects. Records
+// expire with their leases after the window, so that the prefix stays
+// small without explicit deletes.
+type Dedup struct {
+	cli    *clientv3.Client
+	name   string
+	window time.Duration
+
+	mu      sync.Mutex
+	lease   clientv3.LeaseID
+	renewAt time.Time
+}
+
+// NewDedup returns the dedup window of the name, shared by workers of
+// the same name. Records are kept at least for the window, and at most
+// for twice the window.
+func NewDedup(qu Queue, name string, window time.Duration) (*Dedup, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid dedup name %q", name)
+	}
+	if window < time.Second {
+		return nil, fmt.Errorf("dedup window %v is shorter than a second", window)
+	}
+	return &Dedup{cli: clientOf(qu), name: name, window: window}, nil
+}
+
+// dedupKey identifies the delivery of the item. Retried items are new
+// deliveries, with more attempts.
+func (d *Dedup) dedupKey(item *Item) string {
+	return path.Join(pfxDedup, d.name, item.Key, fmt.Sprintf("%d-%d", item.Sequence, item.Attempts))
+}
+
+// Seen records the delivery of the item, and returns true if it has
+// already been recorded within the window.
+func (d *Dedup) Seen(ctx context.Context, item *Item) (bool, error) {
+	lease, err := d.leaseID(ctx)
+	if err != nil {
+		return false, err
+	}
+	key := d.dedupKey(item)
+	resp, err := d.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, "", clientv3.WithLease(lease))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return !resp.Succeeded, nil
+}
+
+// Forget removes the delivery record of the item, so that it is handled
+// again when delivered again (e.g. after its handler failed).
+func (d *Dedup) Forget(ctx context.Context, item *Item) error {
+	_, err := d.cli.Delete(ctx, d.dedupKey(item))
+	return err
+}
+
+// leaseID returns the lease of new records, granted for twice the window
+// and replaced after the window, so that each record outlives the window.
+func (d *Dedup) leaseID(ctx context.Context) (clientv3.LeaseID, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := DefaultClock.Now()
+	if d.lease != 0 && now.Before(d.renewAt) {
+		return d.lease, nil
+	}
+	resp, err := d.cli.Grant(ctx, int64(math.Ceil((2 * d.window).Seconds())))
+	if err != nil {
+		return 0, err
+	}
+	d.lease, d.renewAt = resp.ID, now.Add(d.window)
+	return d.lease, nil
+}
@@ -0,0 +1,81 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err = NewDedup(qu, "a/b", time.Minute); err == nil {
+		t.Fatal("expected error from invalid name")
+	}
+	d1, err := NewDedup(qu, "resnet", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := NewDedup(qu, "resnet", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewDedup(qu, "inception", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := CreateItem("dedup", 100, "value")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	popped := <-qu.Pop(ctx, "dedup")
+	if popped == nil || popped.Err() != nil {
+		t.Fatalf("unexpected pop %+v", popped)
+	}
+
+	// workers of the same name share the window
+	for i, tc := range []struct {
+		d    *Dedup
+		seen bool
+	}{{d1, false}, {d1, true}, {d2, true}, {other, false}} {
+		seen, err := tc.d.Seen(ctx, popped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen != tc.seen {
+			t.Fatalf("#%d: expected seen %v, got %v", i, tc.seen, seen)
+		}
+	}
+
+	// retries are new deliveries
+	popped.Attempts++
+	if seen, err := d1.Seen(ctx, popped); err != nil || seen {
+		t.Fatalf("expected retry not seen, got %v (%v)", seen, err)
+	}
+	if err = d1.Forget(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	if seen, err := d2.Seen(ctx, popped); err != nil || seen {
+		t.Fatalf("expected forgotten item not seen, got %v (%v)", seen, err)
+	}
+}
@@ -0,0 +1,102 @@
+package etcdqueue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// WithDelta configures WatchBucket to send only the changed fields of
+// items in 'Event.Patch', after the first event of each item with the
+// full 'Event.Item'. Values that do not change after Add (e.g. large
+// inputs) are not sent again. Consumers rebuild items with ApplyPatch.
+func WithDelta() OpOption {
+	return func(op *Op) { op.delta = true }
+}
+
+// deltaEncoder tracks the last sent fields of items, per item key,
+// until their terminal events.
+type deltaEncoder struct {
+	last map[string]map[string]json.RawMessage
+}
+
+// encode replaces the item of the event with the patch from the last
+// sent state of the item, if any.
+func (d *deltaEncoder) encode(ev *Event) error {
+	if ev.Key == "" {
+		// purge ends all items of the bucket
+		d.last = nil
+		return nil
+	}
+	if ev.Item == nil {
+		return nil
+	}
+	data, err := json.Marshal(ev.Item)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	prev, ok := d.last[ev.Key]
+	switch ev.Type {
+	case EventComplete, EventCancel, EventTransfer:
+		delete(d.last, ev.Key)
+	default:
+		if d.last == nil {
+			d.last = make(map[string]map[string]json.RawMessage)
+		}
+		d.last[ev.Key] = fields
+	}
+	if !ok {
+		return nil
+	}
+
+	patch := make(map[string]json.RawMessage)
+	for k, v := range fields {
+		if pv, ok := prev[k]; !ok || !bytes.Equal(pv, v) {
+			patch[k] = v
+		}
+	}
+	for k := range prev {
+		if _, ok := fields[k]; !ok {
+			patch[k] = json.RawMessage("null")
+		}
+	}
+	ev.Item, ev.Patch = nil, patch
+	return nil
+}
+
+// ApplyPatch returns the item with the changed fields of the event
+// patch (see 'WithDelta'). Fields set to null are removed.
+// The given item is not modified.
+func ApplyPatch(item *Item, patch map[string]json.RawMessage) (*Item, error) {
+	if item == nil {
+		return nil, fmt.Errorf("received <nil> Item")
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range patch {
+		if string(v) == "null" {
+			delete(fields, k)
+			continue
+		}
+		fields[k] = v
+	}
+	if data, err = json.Marshal(fields); err != nil {
+		return nil, err
+	}
+	var patched Item
+	if err = json.Unmarshal(data, &patched); err != nil {
+		return nil, err
+	}
+	return &patched, nil
+}
@@ -0,0 +1,87 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchBucketDelta(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wch := qu.WatchBucket(ctx, "my-job", WithDelta())
+
+	item := CreateItem("my-job", 100, strings.Repeat("x", 4096))
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	popped := <-qu.Pop(ctx, "my-job")
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+
+	var last *Item
+	for i, exp := range []struct {
+		tp EventType
+		st Status
+	}{
+		{EventAdd, StatusPending},
+		{EventPop, StatusClaimed},
+		{EventComplete, StatusCompleted},
+	} {
+		select {
+		case ev := <-wch:
+			if ev.Error != "" {
+				t.Fatalf("#%d: unexpected error %q", i, ev.Error)
+			}
+			if ev.Type != exp.tp || ev.Key != item.Key {
+				t.Fatalf("#%d: expected %q event of %q, got %+v", i, exp.tp, item.Key, ev)
+			}
+			if i == 0 {
+				if ev.Item == nil || ev.Patch != nil {
+					t.Fatalf("#%d: expected full item, got %+v", i, ev)
+				}
+				last = ev.Item
+				break
+			}
+			if ev.Item != nil {
+				t.Fatalf("#%d: expected patch, got item %+v", i, ev.Item)
+			}
+			if _, ok := ev.Patch["value"]; ok {
+				t.Fatalf("#%d: unexpected unchanged value in patch %v", i, ev.Patch)
+			}
+			if last, err = ApplyPatch(last, ev.Patch); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("#%d: timed out waiting for %q event", i, exp.tp)
+		}
+		if last.Status != exp.st {
+			t.Fatalf("#%d: expected status %q, got %q", i, exp.st, last.Status)
+		}
+	}
+	if last.Value != item.Value || last.Progress != MaxProgress {
+		t.Fatalf("unexpected patched item %+v", last)
+	}
+}
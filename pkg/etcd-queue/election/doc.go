@@ -0,0 +1,4 @@
+// Package election implements leader election over the queue's etcd client,
+// so that backend replicas and schedulers elect leaders without depending
+// directly on etcd concurrency packages.
+package election
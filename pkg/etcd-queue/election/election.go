@@ -0,0 +1,101 @@
+package election
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/coreos/etcd/clientv3/concurrency"
+)
+
+// ErrNoLeader is returned when there is no elected leader.
+var ErrNoLeader = errors.New("election: no leader")
+
+const pfxElection = "_election"
+
+// Election is a leader election of the name. Each candidate creates its
+// own Election, backed by a session lease. When the candidate stops
+// keeping the lease alive (e.g. crash), its leadership expires after TTL.
+type Election struct {
+	name string
+	sess *concurrency.Session
+	e    *concurrency.Election
+}
+
+// New creates an election of the name, with the session TTL in seconds.
+// Zero TTL uses etcd default of 60 seconds.
+func New(qu etcdqueue.Queue, name string, ttl int) (*Election, error) {
+	if name == "" {
+		return nil, fmt.Errorf("empty election name")
+	}
+	var opts []concurrency.SessionOption
+	if ttl > 0 {
+		opts = append(opts, concurrency.WithTTL(ttl))
+	}
+	sess, err := concurrency.NewSession(qu.Client(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Election{
+		name: name,
+		sess: sess,
+		e:    concurrency.NewElection(sess, path.Join(pfxElection, name)),
+	}, nil
+}
+
+// Campaign blocks until this candidate is elected with the value
+// (e.g. its host name), or the context is canceled.
+func (e *Election) Campaign(ctx context.Context, value string) error {
+	return e.e.Campaign(ctx, value)
+}
+
+// Resign gives up leadership, so that other candidates can be elected.
+func (e *Election) Resign(ctx context.Context) error {
+	return e.e.Resign(ctx)
+}
+
+// Leader returns the value of the current leader.
+func (e *Election) Leader(ctx context.Context) (string, error) {
+	resp, err := e.e.Leader(ctx)
+	if err == concurrency.ErrElectionNoLeader {
+		return "", ErrNoLeader
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// Observe streams the values of elected leaders, until the context is canceled.
+func (e *Election) Observe(ctx context.Context) <-chan string {
+	ch := make(chan string)
+	och := e.e.Observe(ctx)
+	go func() {
+		defer close(ch)
+		for resp := range och {
+			if len(resp.Kvs) == 0 {
+				continue
+			}
+			select {
+			case ch <- string(resp.Kvs[0].Value):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// Done returns the channel closed when the session expires, after which
+// the leadership is lost and the election must be recreated.
+func (e *Election) Done() <-chan struct{} {
+	return e.sess.Done()
+}
+
+// Close resigns, and revokes the session lease.
+func (e *Election) Close() error {
+	return e.sess.Close()
+}
@@ -0,0 +1,86 @@
+package election
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func TestElection(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := etcdqueue.NewEmbeddedQueue(context.Background(), 34379, 34380, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	e1, err := New(qu, "scheduler", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e1.Close()
+	e2, err := New(qu, "scheduler", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e2.Close()
+
+	if _, err = e1.Leader(ctx); err != ErrNoLeader {
+		t.Fatalf("expected %v, got %v", ErrNoLeader, err)
+	}
+	if err = e1.Campaign(ctx, "host-1"); err != nil {
+		t.Fatal(err)
+	}
+	leader, err := e2.Leader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leader != "host-1" {
+		t.Fatalf("expected leader 'host-1', got %q", leader)
+	}
+
+	obs := e2.Observe(ctx)
+	if v := <-obs; v != "host-1" {
+		t.Fatalf("expected observed 'host-1', got %q", v)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- e2.Campaign(ctx, "host-2") }()
+	select {
+	case err = <-errc:
+		t.Fatalf("unexpected election of host-2 (%v)", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if err = e1.Resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected host-2 elected after resign")
+	}
+	select {
+	case v := <-obs:
+		if v != "host-2" {
+			t.Fatalf("expected observed 'host-2', got %q", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected observed 'host-2'")
+	}
+}
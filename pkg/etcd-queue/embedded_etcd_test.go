@@ -41,8 +41,9 @@ func TestEtcd(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(resp.Kvs) != 0 {
-		t.Fatalf("len(resp.Kvs) expected 0, got %+v", resp.Kvs)
+	// only enabled features are written on start
+	if len(resp.Kvs) != len(supportedFeatures) {
+		t.Fatalf("len(resp.Kvs) expected %d, got %+v", len(supportedFeatures), resp.Kvs)
 	}
 
 	lresp, lerr := cli.Grant(context.Background(), 2)
@@ -120,7 +121,7 @@ func TestEtcd(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(resp.Kvs) != 2 {
-		t.Fatalf("len(resp.Kvs) expected 2, got %+v", resp.Kvs)
+	if len(resp.Kvs) != len(supportedFeatures)+2 {
+		t.Fatalf("len(resp.Kvs) expected %d, got %+v", len(supportedFeatures)+2, resp.Kvs)
 	}
 }
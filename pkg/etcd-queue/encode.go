@@ -0,0 +1,116 @@
+package etcdqueue
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// bufPool pools encoding buffers, to reduce allocations at high
+// enqueue rates.
+var bufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// encodeJSON encodes the value with a pooled buffer. The returned
+// string does not share memory with the buffer.
+func encodeJSON(v interface{}) (string, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return "", err
+	}
+	// trim the newline from Encode
+	return string(buf.Bytes()[:buf.Len()-1]), nil
+}
+
+// marshalItem encodes the item once, to be shared by the queue value,
+// its event and indexes in the same transaction.
+func marshalItem(item *Item) ([]byte, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+
+	if err := json.NewEncoder(buf).Encode(item); err != nil {
+		return nil, err
+	}
+	data := make([]byte, buf.Len()-1)
+	copy(data, buf.Bytes())
+	return data, nil
+}
+
+// TimeFormat is the JSON format of item timestamps, written in UTC so
+// that serialized items do not depend on the zone of their writers.
+// Timestamps are read in TimeFormat or RFC3339, so that items written
+// before a format change are still decoded.
+var TimeFormat = time.RFC3339Nano
+
+// formatTime returns the timestamp in TimeFormat, or empty if zero.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(TimeFormat)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(TimeFormat, s)
+	if err != nil {
+		var rerr error
+		if t, rerr = time.Parse(time.RFC3339Nano, s); rerr != nil {
+			return time.Time{}, err
+		}
+	}
+	return t.UTC(), nil
+}
+
+// itemFields is Item without its JSON methods.
+type itemFields Item
+
+// itemJSON is the JSON of Item, with the timestamps in TimeFormat.
+type itemJSON struct {
+	*itemFields
+	CreatedAt   string `json:"created_at"`
+	CanceledAt  string `json:"canceled_at,omitempty"`
+	ClaimedAt   string `json:"claimed_at,omitempty"`
+	CompletedAt string `json:"completed_at,omitempty"`
+}
+
+// MarshalJSON encodes the item, with its timestamps in UTC TimeFormat.
+func (item Item) MarshalJSON() ([]byte, error) {
+	return json.Marshal(itemJSON{
+		itemFields:  (*itemFields)(&item),
+		CreatedAt:   formatTime(item.CreatedAt),
+		CanceledAt:  formatTime(item.CanceledAt),
+		ClaimedAt:   formatTime(item.ClaimedAt),
+		CompletedAt: formatTime(item.CompletedAt),
+	})
+}
+
+// UnmarshalJSON decodes the item, with its timestamps in UTC.
+func (item *Item) UnmarshalJSON(data []byte) error {
+	v := itemJSON{itemFields: (*itemFields)(item)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		s string
+		t *time.Time
+	}{
+		{v.CreatedAt, &item.CreatedAt},
+		{v.CanceledAt, &item.CanceledAt},
+		{v.ClaimedAt, &item.ClaimedAt},
+		{v.CompletedAt, &item.CompletedAt},
+	} {
+		t, err := parseTime(f.s)
+		if err != nil {
+			return err
+		}
+		*f.t = t
+	}
+	return nil
+}
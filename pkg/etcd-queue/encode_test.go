@@ -0,0 +1,121 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeItem(t *testing.T) {
+	item := CreateItem("test-bucket", 100, "<value>")
+	item.Owner = "test-owner"
+	item.Labels = map[string]string{"model": "resnet"}
+
+	data, err := marshalItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := json.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(expected) {
+		t.Fatalf("expected %s, got %s", expected, data)
+	}
+
+	// events and index entries embed the encoded item
+	var ev Event
+	if err = json.Unmarshal((&queue{clock: DefaultClock}).eventOp(context.Background(), EventAdd, item.Bucket, item.Key, data).ValueBytes(), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != EventAdd || ev.Key != item.Key || ev.Item == nil {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	if err = item.Equal(ev.Item); err != nil {
+		t.Fatal(err)
+	}
+	ops := indexOps(item, data, StatusPending)
+	if len(ops) != 2 {
+		t.Fatalf("expected status and owner index, got %d ops", len(ops))
+	}
+	var ent IndexEntry
+	if err = json.Unmarshal(ops[0].ValueBytes(), &ent); err != nil {
+		t.Fatal(err)
+	}
+	if ent.Status != StatusPending || ent.Item == nil {
+		t.Fatalf("unexpected index entry %+v", ent)
+	}
+	if err = item.Equal(ent.Item); err != nil {
+		t.Fatal(err)
+	}
+
+	// events without item omit it
+	if err = json.Unmarshal((&queue{clock: DefaultClock}).eventOp(context.Background(), EventPurge, item.Bucket, "", nil).ValueBytes(), &ev); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestItemTimeFormat(t *testing.T) {
+	item := CreateItem("test-bucket", 100, "<value>")
+	item.CreatedAt = time.Date(2017, 10, 1, 9, 30, 0, 123456789, time.FixedZone("PDT", -7*3600))
+	item.CompletedAt = item.CreatedAt.Add(time.Second)
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"created_at":"2017-10-01T16:30:00.123456789Z"`) ||
+		!strings.Contains(string(data), `"completed_at":"2017-10-01T16:30:01.123456789Z"`) {
+		t.Fatalf("expected UTC RFC3339Nano timestamps, got %s", data)
+	}
+	// zero timestamps are omitted
+	if strings.Contains(string(data), "claimed_at") || strings.Contains(string(data), "canceled_at") {
+		t.Fatalf("expected no zero timestamps, got %s", data)
+	}
+
+	var decoded Item
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.CreatedAt != item.CreatedAt.UTC() || decoded.CompletedAt != item.CompletedAt.UTC() || !decoded.ClaimedAt.IsZero() {
+		t.Fatalf("unexpected timestamps %+v", decoded)
+	}
+	if decoded.Key != item.Key || decoded.Value != item.Value || decoded.Status != item.Status {
+		t.Fatalf("expected %+v, got %+v", item, decoded)
+	}
+	if err = item.Equal(&decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	// items written before a format change are still decoded
+	old := TimeFormat
+	defer func() { TimeFormat = old }()
+	TimeFormat = time.RFC3339
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.CreatedAt != item.CreatedAt.UTC() {
+		t.Fatalf("expected %v, got %v", item.CreatedAt.UTC(), decoded.CreatedAt)
+	}
+	if data, err = json.Marshal(decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"created_at":"2017-10-01T16:30:00Z"`) {
+		t.Fatalf("expected RFC3339 timestamp, got %s", data)
+	}
+}
+
+func BenchmarkMarshalItem(b *testing.B) {
+	item := CreateItem("bench-bucket", 100, "value")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := marshalItem(item)
+		if err != nil {
+			b.Fatal(err)
+		}
+		(&queue{clock: DefaultClock}).eventOp(context.Background(), EventAdd, item.Bucket, item.Key, data)
+		indexOps(item, data, StatusPending, StatusInProgress)
+	}
+}
@@ -0,0 +1,62 @@
+package etcdqueue
+
+import "context"
+
+func (qu *queue) Enqueue(ctx context.Context, item *Item, opts ...OpOption) ItemWatcher {
+	ch := make(chan *Item, 1)
+	if item == nil {
+		ch <- &Item{Error: "received <nil> Item"}
+		close(ch)
+		return ch
+	}
+
+	accepted := *item
+	accepted.Status = StatusAccepted
+	ch <- &accepted
+
+	// Add writes the item, so the caller's item is not shared
+	added := *item
+	started := qu.goBackground("enqueue", item.Key, func() {
+		defer close(ch)
+		defer qu.recoverPanic("enqueue", item.Key, func(err error) {
+			rolled := accepted
+			rolled.Error = err.Error()
+			notifyItem(ch, &rolled)
+		})
+
+		if err := qu.Add(ctx, &added, opts...); err != nil {
+			rolled := accepted
+			rolled.Error = err.Error()
+			select {
+			case ch <- &rolled:
+			case <-ctx.Done():
+			case <-qu.rootCtx.Done():
+			}
+			return
+		}
+
+		// Add returns after the commit, so the item is durable
+		acked := added
+		acked.Status = StatusAcked
+		select {
+		case ch <- &acked:
+		case <-ctx.Done():
+			return
+		case <-qu.rootCtx.Done():
+			return
+		}
+		for st := range qu.WatchItem(ctx, added.Key, opts...) {
+			select {
+			case ch <- st:
+			case <-ctx.Done():
+				return
+			case <-qu.rootCtx.Done():
+				return
+			}
+		}
+	})
+	if !started {
+		return closedWatcher(item.Bucket)
+	}
+	return ch
+}
@@ -0,0 +1,167 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEnqueue(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// accepted before the write is committed
+	item := CreateItem("my-job", 100, "data")
+	w := qu.Enqueue(ctx, item)
+	select {
+	case st := <-w:
+		if st.Status != StatusAccepted || st.Key != item.Key || st.Error != "" {
+			t.Fatalf("unexpected accepted item %+v", st)
+		}
+	default:
+		t.Fatal("expected the accepted item without waiting")
+	}
+	expectStatus(t, w, StatusAcked)
+	expectStatus(t, w, StatusPending)
+	if _, err = qu.Cancel(ctx, item.Key); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, w, StatusCanceled)
+	select {
+	case st, ok := <-w:
+		if ok {
+			t.Fatalf("unexpected state %+v", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to close the watcher")
+	}
+
+	// rolled back on failed writes
+	done := CreateItem("my-job", 100, "data")
+	done.Status = StatusCompleted
+	w = qu.Enqueue(ctx, done)
+	expectStatus(t, w, StatusAccepted)
+	select {
+	case st := <-w:
+		if st.Status != StatusAccepted || !strings.Contains(st.Error, "cannot transition") {
+			t.Fatalf("expected rollback, got %+v", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to receive rollback")
+	}
+	if st, ok := <-w; ok {
+		t.Fatalf("expected the watcher closed after rollback, got %+v", st)
+	}
+	if done.Status != StatusCompleted || done.Error != "" {
+		t.Fatalf("expected the given item unmodified, got %+v", done)
+	}
+}
+
+// TestEnqueueServerCrash closes the embedded etcd server while items are
+// being enqueued, and expects every acknowledged item after restart.
+func TestEnqueueServerCrash(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq := qu.(*embeddedQueue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// producers enqueue until the crash fails their enqueues
+	const producers, crashAfter = 20, 100
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		crash  sync.Once
+		acked  []*Item
+		failed int
+	)
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				for st := range qu.Enqueue(ctx, CreateItem("my-job", 100, fmt.Sprintf("%d-%d", i, j))) {
+					if st.Error != "" {
+						mu.Lock()
+						failed++
+						mu.Unlock()
+						return
+					}
+					if st.Status == StatusAcked {
+						mu.Lock()
+						acked = append(acked, st)
+						if len(acked) == crashAfter {
+							go crash.Do(eq.srv.Close)
+						}
+						mu.Unlock()
+						break
+					}
+				}
+			}
+		}(i)
+	}
+	donec := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(donec)
+	}()
+	select {
+	case <-donec:
+	case <-time.After(30 * time.Second):
+		t.Fatal("took too long to acknowledge or fail enqueues")
+	}
+	cancel()
+	eq.Queue.Stop()
+
+	if len(acked) < crashAfter || failed != producers {
+		t.Fatalf("expected acknowledged and failed enqueues, got %d and %d", len(acked), failed)
+	}
+
+	qu, err = NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+	for _, item := range acked {
+		ent, err := qu.Get(context.Background(), item.Key)
+		if err != nil {
+			t.Fatalf("acknowledged %q lost (%v)", item.Key, err)
+		}
+		if ent.Item.Value != item.Value {
+			t.Fatalf("expected %q, got %q", item.Value, ent.Item.Value)
+		}
+	}
+}
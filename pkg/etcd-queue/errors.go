@@ -0,0 +1,64 @@
+package etcdqueue
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrItemNotFound is returned when the item of the key is not in the queue.
+	ErrItemNotFound = errors.New("queue: item not found")
+
+	// ErrBucketNotFound is matched by UnknownBucketError, returned for
+	// unknown buckets with 'BucketPolicy.RejectUnknown'.
+	ErrBucketNotFound = errors.New("queue: bucket not found")
+
+	// ErrAlreadyCompleted is returned when the item has already been
+	// completed (e.g. Cancel of a completed item, or Complete twice).
+	ErrAlreadyCompleted = errors.New("queue: item already completed")
+
+	// ErrCanceled is returned when the item has already been canceled.
+	ErrCanceled = errors.New("queue: item canceled")
+
+	// ErrUndeleteExpired is returned by Undelete when the item has been
+	// canceled longer than 'UndeleteWindow'.
+	ErrUndeleteExpired = errors.New("queue: undelete window expired")
+)
+
+// sentinels are errors sent as 'Item.Error' strings (e.g. by Pop and
+// Watch), to be converted back by Err. Typed errors matching them (e.g.
+// AccessDeniedError) are prefixed with their messages.
+var sentinels = []error{
+	ErrItemNotFound,
+	ErrBucketNotFound,
+	ErrAlreadyCompleted,
+	ErrCanceled,
+	ErrUndeleteExpired,
+	ErrBucketFull,
+	ErrBucketPaused,
+	ErrQueueUnavailable,
+	ErrQueueClosed,
+	ErrWatcherEvicted,
+	ErrValueTooLarge,
+	ErrAccessDenied,
+	ErrTooManyConflicts,
+	context.Canceled,
+	context.DeadlineExceeded,
+}
+
+// Err returns the error of 'Item.Error', or <nil> if empty. Known errors,
+// and typed errors matching them, are returned as their sentinel values,
+// so that callers can compare them (e.g. 'item.Err() == ErrWatcherEvicted')
+// instead of matching strings.
+func (item *Item) Err() error {
+	if item.Error == "" {
+		return nil
+	}
+	for _, err := range sentinels {
+		if item.Error == err.Error() || strings.HasPrefix(item.Error, err.Error()+": ") {
+			return err
+		}
+	}
+	return errors.New(item.Error)
+}
@@ -0,0 +1,85 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if _, err = qu.Cancel(ctx, "my-job/unknown"); err != ErrItemNotFound {
+		t.Fatalf("expected %v, got %v", ErrItemNotFound, err)
+	}
+
+	item1 := CreateItem("my-job", 100, "canceled")
+	if err = qu.Add(ctx, item1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.Cancel(ctx, item1.Key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.Cancel(ctx, item1.Key); err != ErrCanceled {
+		t.Fatalf("expected %v, got %v", ErrCanceled, err)
+	}
+
+	item2 := CreateItem("my-job", 100, "completed")
+	if err = qu.Add(ctx, item2); err != nil {
+		t.Fatal(err)
+	}
+	item2 = <-qu.Pop(ctx, "my-job")
+	item2.Progress = MaxProgress
+	if err = qu.Complete(ctx, item2); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Complete(ctx, item2); err != ErrAlreadyCompleted {
+		t.Fatalf("expected %v, got %v", ErrAlreadyCompleted, err)
+	}
+	if _, err = qu.Cancel(ctx, item2.Key); err != ErrAlreadyCompleted {
+		t.Fatalf("expected %v, got %v", ErrAlreadyCompleted, err)
+	}
+
+	if !(&UnknownBucketError{Bucket: "my-job"}).Is(ErrBucketNotFound) {
+		t.Fatalf("expected UnknownBucketError to match %v", ErrBucketNotFound)
+	}
+}
+
+func TestItemErr(t *testing.T) {
+	tests := []struct {
+		item *Item
+		err  error
+	}{
+		{item: &Item{}, err: nil},
+		{item: &Item{Error: ErrWatcherEvicted.Error()}, err: ErrWatcherEvicted},
+		{item: &Item{Error: ErrQueueUnavailable.Error()}, err: ErrQueueUnavailable},
+		{item: &Item{Error: context.Canceled.Error()}, err: context.Canceled},
+		{item: &Item{Error: (&ValueTooLargeError{Key: "my-job/1", Size: 2, Limit: 1}).Error()}, err: ErrValueTooLarge},
+		{item: &Item{Error: (&AccessDeniedError{Identity: "alice", Bucket: "my-job", Op: "Pop"}).Error()}, err: ErrAccessDenied},
+		{item: &Item{Error: (&UnknownBucketError{Bucket: "my-job"}).Error()}, err: ErrBucketNotFound},
+	}
+	for i, tt := range tests {
+		if err := tt.item.Err(); err != tt.err {
+			t.Fatalf("#%d: expected %v, got %v", i, tt.err, err)
+		}
+	}
+	if err := (&Item{Error: "unknown"}).Err(); err == nil || err.Error() != "unknown" {
+		t.Fatalf("expected 'unknown' error, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package etcdqueue
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+var (
+	// ETAHistory is the duration of recent completions to estimate
+	// processing durations and throughput of buckets.
+	ETAHistory = time.Hour
+
+	// etaCacheTTL is the duration to reuse the bucket history, since
+	// clients poll estimates frequently (e.g. every 500ms).
+	etaCacheTTL = 5 * time.Second
+)
+
+// Estimate is the estimated time for an item to start and complete.
+type Estimate struct {
+	// Position is the number of pending items ahead of the item.
+	Position int64 `json:"position"`
+
+	// StartIn is the estimated duration until the item is claimed,
+	// or zero if already claimed.
+	StartIn time.Duration `json:"start_in"`
+
+	// CompleteIn is the estimated duration until the item is completed.
+	CompleteIn time.Duration `json:"complete_in"`
+
+	// Samples is the number of recent completions the estimate is based on.
+	// Durations are unknown if zero.
+	Samples int `json:"samples"`
+}
+
+// etaHistory is the processing history of a bucket.
+type etaHistory struct {
+	samples int
+	// mean is the mean duration from claim to completion.
+	mean time.Duration
+	// rate is the number of completions per second.
+	rate float64
+	at   time.Time
+}
+
+type etaCache struct {
+	mu      sync.Mutex
+	entries map[string]*etaHistory
+}
+
+func (qu *queue) ETA(ctx context.Context, item *Item) (Estimate, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	var est Estimate
+	ent, err := qu.Get(ctx, item.Key)
+	if err != nil {
+		return est, err
+	}
+	if ent.Status.Terminal() {
+		return est, nil
+	}
+	h, err := qu.history(ctx, ent.Item.Bucket)
+	if err != nil {
+		return est, err
+	}
+
+	if ent.Status == StatusPending {
+		resp, err := qu.kv.Get(ctx, bucketPrefix(ent.Item.Bucket),
+			clientv3.WithRange(path.Join(pfxQueue, ent.Item.Key)),
+			clientv3.WithCountOnly(),
+		)
+		if err != nil {
+			return est, err
+		}
+		est.Position = resp.Count
+	}
+	est.Samples = h.samples
+	if h.samples == 0 {
+		return est, nil
+	}
+
+	if ent.Status == StatusPending {
+		est.StartIn = time.Duration(float64(est.Position) / h.rate * float64(time.Second))
+		est.CompleteIn = est.StartIn + h.mean
+		return est, nil
+	}
+
+	// progress is reported by workers, and may be newer than the index
+	progress := ent.Item.Progress
+	if item.Progress > progress {
+		progress = item.Progress
+	}
+	remaining := h.mean
+	if claimed := ent.Item.ClaimedAt; !claimed.IsZero() {
+		elapsed := qu.clock.Since(claimed)
+		remaining = h.mean - elapsed
+		if progress > 0 && progress < MaxProgress {
+			remaining = elapsed * time.Duration(MaxProgress-progress) / time.Duration(progress)
+		}
+	}
+	if remaining > 0 {
+		est.CompleteIn = remaining
+	}
+	return est, nil
+}
+
+// history returns the processing history of the bucket, from items
+// completed within 'ETAHistory'.
+func (qu *queue) history(ctx context.Context, bucket string) (*etaHistory, error) {
+	c := &qu.eta
+	c.mu.Lock()
+	h, ok := c.entries[bucket]
+	c.mu.Unlock()
+	if ok && qu.clock.Since(h.at) < etaCacheTTL {
+		return h, nil
+	}
+
+	now := qu.clock.Now()
+	items, err := qu.ListCompletedSince(ctx, now.Add(-ETAHistory))
+	if err != nil {
+		return nil, err
+	}
+	h = &etaHistory{at: now}
+	var (
+		total       time.Duration
+		first, last time.Time
+		completions int
+	)
+	for _, item := range items {
+		if item.Bucket != bucket || terminalStatus(item) != StatusCompleted {
+			continue
+		}
+		completions++
+		if first.IsZero() {
+			first = item.CompletedAt
+		}
+		last = item.CompletedAt
+
+		// items claimed by older versions have no claim time
+		if !item.ClaimedAt.IsZero() {
+			h.samples++
+			total += item.CompletedAt.Sub(item.ClaimedAt)
+		}
+	}
+	if h.samples > 0 {
+		h.mean = total / time.Duration(h.samples)
+		if h.mean < time.Millisecond {
+			h.mean = time.Millisecond
+		}
+
+		// completions are at least as fast as one worker, since the
+		// bucket may have been idle between completions
+		h.rate = 1 / h.mean.Seconds()
+		if span := last.Sub(first); completions > 1 && span > 0 {
+			if r := float64(completions-1) / span.Seconds(); r > h.rate {
+				h.rate = r
+			}
+		}
+	}
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*etaHistory)
+	}
+	c.entries[bucket] = h
+	c.mu.Unlock()
+	return h, nil
+}
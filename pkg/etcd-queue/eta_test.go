@@ -0,0 +1,96 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestETA(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	// histories are read on every estimate
+	defer func(ttl time.Duration) { etaCacheTTL = ttl }(etaCacheTTL)
+	etaCacheTTL = 0
+
+	ctx := context.Background()
+	var items []*Item
+	for i := 0; i < 4; i++ {
+		item := CreateItem("my-job", 100, "data")
+		if err = qu.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+
+	// no history yet
+	est, err := qu.ETA(ctx, items[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Position != 2 || est.Samples != 0 || est.StartIn != 0 || est.CompleteIn != 0 {
+		t.Fatalf("unexpected estimate %+v", est)
+	}
+
+	popped := <-qu.Pop(ctx, "my-job")
+	if popped.ClaimedAt.IsZero() {
+		t.Fatalf("expected claim time, got %+v", popped)
+	}
+	time.Sleep(200 * time.Millisecond)
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1 item ahead, processed by at least one worker
+	est, err = qu.ETA(ctx, items[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Position != 1 || est.Samples != 1 {
+		t.Fatalf("unexpected estimate %+v", est)
+	}
+	if est.StartIn < 200*time.Millisecond || est.StartIn > time.Second {
+		t.Fatalf("unexpected start %v", est.StartIn)
+	}
+	if est.CompleteIn < est.StartIn+200*time.Millisecond {
+		t.Fatalf("unexpected completion %v (start %v)", est.CompleteIn, est.StartIn)
+	}
+
+	// claimed items are estimated by progress
+	claimed := <-qu.Pop(ctx, "my-job")
+	time.Sleep(100 * time.Millisecond)
+	claimed.Progress = 50
+	est, err = qu.ETA(ctx, claimed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Position != 0 || est.StartIn != 0 || est.CompleteIn < 100*time.Millisecond || est.CompleteIn > time.Second {
+		t.Fatalf("unexpected estimate %+v", est)
+	}
+
+	// completed items are done
+	est, err = qu.ETA(ctx, popped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est != (Estimate{}) {
+		t.Fatalf("unexpected estimate %+v", est)
+	}
+}
@@ -0,0 +1,252 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// EventType is the type of queue event.
+type EventType string
+
+const (
+	// EventAdd is recorded when an item is added to the queue.
+	EventAdd EventType = "add"
+	// EventPop is recorded when an item is popped from the queue.
+	EventPop EventType = "pop"
+	// EventCancel is recorded when a pending item is canceled.
+	EventCancel EventType = "cancel"
+	// EventUndelete is recorded when a canceled item is restored.
+	EventUndelete EventType = "undelete"
+	// EventProgress is recorded when the progress of an item in progress
+	// is updated.
+	EventProgress EventType = "progress"
+	// EventComplete is recorded when an item is completed.
+	EventComplete EventType = "complete"
+	// EventPurge is recorded when all items in a bucket are purged.
+	EventPurge EventType = "purge"
+	// EventTransfer is recorded when a pending item is transferred to
+	// another queue, and without key when the bucket transfer is done
+	// (see 'Transfer').
+	EventTransfer EventType = "transfer"
+	// EventDenied is recorded when an operation is denied by the bucket
+	// ACL (see 'NewACLQueue').
+	EventDenied EventType = "denied"
+)
+
+// Event types streamed by Watch and WatchFront, derived from the changes
+// of the items rather than read from the journal.
+const (
+	// EventCreated is streamed when an item is added to the bucket, or
+	// becomes the front item (see 'WatchFront').
+	EventCreated EventType = "created"
+	// EventUpdated is streamed when a pending item is rewritten
+	// (e.g. requeued with Add).
+	EventUpdated EventType = "updated"
+	// EventCompleted is streamed when an item of the bucket is completed.
+	EventCompleted EventType = "completed"
+	// EventCanceled is streamed when an item of the bucket is canceled.
+	EventCanceled EventType = "canceled"
+	// EventDeleted is streamed when a pending item is otherwise removed
+	// from the bucket (e.g. popped, purged, or transferred).
+	EventDeleted EventType = "deleted"
+)
+
+// Event is a queue event in the journal, written in the same
+// transaction as the queue mutation.
+type Event struct {
+	Type   EventType `json:"type"`
+	Bucket string    `json:"bucket"`
+	Key    string    `json:"key"`
+
+	// Item is the item at the time of event, if available.
+	Item *Item `json:"item,omitempty"`
+	// Patch is the changed fields of the item JSON since its last event,
+	// set instead of Item by WatchBucket with WithDelta (see 'ApplyPatch').
+	Patch map[string]json.RawMessage `json:"patch,omitempty"`
+
+	// Actor is the identity of the request (see 'WithIdentity'),
+	// empty if unknown.
+	Actor string `json:"actor,omitempty"`
+	// Op is the denied operation of EventDenied (e.g. "Add").
+	Op string `json:"op,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+
+	// Rev is the etcd revision of the event, used as a cursor.
+	// Events in the same transaction share the same revision.
+	Rev int64 `json:"rev"`
+
+	// Error is set on watch errors (see 'WatchBucket').
+	Error string `json:"error,omitempty"`
+}
+
+const pfxEvents = "_events"
+
+// rawEvent is Event with the encoded item, so that items are not
+// encoded again for their events.
+type rawEvent struct {
+	Type      EventType       `json:"type"`
+	Bucket    string          `json:"bucket"`
+	Key       string          `json:"key"`
+	Item      json.RawMessage `json:"item,omitempty"`
+	Actor     string          `json:"actor,omitempty"`
+	Op        string          `json:"op,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	Rev       int64           `json:"rev"`
+}
+
+// eventOp returns the operation to append the event to the journal,
+// with the encoded item (see 'marshalItem'), or <nil> if not available.
+// The actor is the identity of the context.
+func (qu *queue) eventOp(ctx context.Context, tp EventType, bucket, key string, item []byte) clientv3.Op {
+	return journalOp(rawEvent{Type: tp, Bucket: bucket, Key: key, Item: item, Actor: IdentityFrom(ctx)}, qu.clock.Now())
+}
+
+// journalOp returns the operation to append the event created at now
+// to the journal.
+// Events are keyed by bucket and creation time:
+//
+//	_events/<bucket>/<time>/<id>
+//
+// where the ID is the item ID, or the event type of bucket events
+// (e.g. purge), so that bucket watches and time ranges read only the
+// events of their buckets.
+func journalOp(ev rawEvent, now time.Time) clientv3.Op {
+	ev.CreatedAt = now
+	data, _ := encodeJSON(ev)
+
+	id := path.Base(ev.Key)
+	if ev.Key == "" {
+		id = string(ev.Type)
+	}
+	return clientv3.OpPut(path.Join(eventTimeKey(ev.Bucket, now), id), data)
+}
+
+// bucketEventsPrefix returns the key prefix of journal events of the
+// bucket. Trailing slash is needed, so that "a" does not match "ab".
+func bucketEventsPrefix(bucket string) string {
+	return path.Join(pfxEvents, bucket) + "/"
+}
+
+// eventTimeKey returns the key of journal events of the bucket created
+// at the time, so that events of the bucket sort by creation time.
+func eventTimeKey(bucket string, t time.Time) string {
+	return path.Join(pfxEvents, bucket, fmt.Sprintf("%035X", t.UnixNano()))
+}
+
+// eventKeyTime returns the creation time in the journal key.
+func eventKeyTime(key string) (time.Time, bool) {
+	ts := path.Base(path.Dir(key))
+	if len(ts) != 35 {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(ts, 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// WithLimit configures ReadEvents to return about n events: all events
+// of the last revision read are returned, so that consumers resume from
+// its revision plus one. Zero means no limit.
+func WithLimit(n int64) OpOption {
+	return func(op *Op) { op.limit = n }
+}
+
+func (qu *queue) ReadEvents(ctx context.Context, fromRev int64, opts ...OpOption) ([]*Event, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	ret := Op{}
+	ret.applyOpts(opts)
+
+	resp, err := qu.kv.Get(ctx, pfxEvents+"/",
+		clientv3.WithPrefix(),
+		clientv3.WithMinModRev(fromRev),
+		clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortAscend),
+		clientv3.WithLimit(ret.limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	kvs := resp.Kvs
+	if resp.More && len(kvs) > 0 {
+		// events of the same revision are not split across reads
+		last := kvs[len(kvs)-1].ModRevision
+		for len(kvs) > 0 && kvs[len(kvs)-1].ModRevision == last {
+			kvs = kvs[:len(kvs)-1]
+		}
+		lresp, err := qu.kv.Get(ctx, pfxEvents+"/",
+			clientv3.WithPrefix(),
+			clientv3.WithMinModRev(last),
+			clientv3.WithMaxModRev(last),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+			clientv3.WithRev(resp.Header.Revision),
+		)
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, lresp.Kvs...)
+	}
+	evs := make([]*Event, 0, len(kvs))
+	redactions := make(map[string]Redaction)
+	for _, kv := range kvs {
+		var ev Event
+		if err = json.Unmarshal(kv.Value, &ev); err != nil {
+			return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", string(kv.Key), string(kv.Value), err)
+		}
+		ev.Rev = kv.ModRevision
+		if ev.Item != nil {
+			r, ok := redactions[ev.Bucket]
+			if !ok {
+				if r, err = qu.Redaction(ctx, ev.Bucket); err != nil {
+					return nil, err
+				}
+				redactions[ev.Bucket] = r
+			}
+			ev.Item = r.Redact(ev.Item)
+		}
+		evs = append(evs, &ev)
+	}
+	return evs, nil
+}
+
+func (qu *queue) GCEvents(ctx context.Context, olderThan time.Duration) (int64, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if olderThan <= 0 {
+		return 0, fmt.Errorf("invalid event retention %v", olderThan)
+	}
+	before := qu.clock.Now().Add(-olderThan)
+	resp, err := qu.kv.Get(ctx, pfxEvents+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return 0, err
+	}
+	var ops []clientv3.Op
+	for _, kv := range resp.Kvs {
+		if t, ok := eventKeyTime(string(kv.Key)); ok && t.Before(before) {
+			ops = append(ops, clientv3.OpDelete(string(kv.Key)))
+		}
+	}
+	var deleted int64
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		if _, err = qu.kv.Txn(ctx).Then(ops[:n]...).Commit(); err != nil {
+			return deleted, err
+		}
+		deleted += int64(n)
+		ops = ops[n:]
+	}
+	glog.Infof("queue: garbage-collected %d events older than %v", deleted, olderThan)
+	return deleted, nil
+}
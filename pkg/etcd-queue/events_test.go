@@ -0,0 +1,143 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueReadEvents(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	testBucket := "test-bucket"
+
+	item1 := CreateItem(testBucket, 9000, "test-data-1")
+	item2 := CreateItem(testBucket, 100, "test-data-2")
+	item3 := CreateItem(testBucket, 100, "test-data-3")
+	if err = qu.Add(context.Background(), item1); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.AddBatch(context.Background(), []*Item{item2, item3}); err != nil {
+		t.Fatal(err)
+	}
+	popped := <-qu.Pop(context.Background(), testBucket)
+	if err = item1.Equal(popped); err != nil {
+		t.Fatal(err)
+	}
+
+	evs, err := qu.ReadEvents(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 4 {
+		t.Fatalf("expected 4 events, got %+v", evs)
+	}
+	if evs[0].Type != EventAdd || evs[0].Key != item1.Key || evs[3].Type != EventPop || evs[3].Key != item1.Key {
+		t.Fatalf("unexpected events %+v %+v", evs[0], evs[3])
+	}
+	if evs[1].Rev != evs[2].Rev {
+		t.Fatalf("expected batch events in the same revision, got %d and %d", evs[1].Rev, evs[2].Rev)
+	}
+	cursor := evs[3].Rev + 1
+
+	if _, err = qu.Cancel(context.Background(), item2.Key); err != nil {
+		t.Fatal(err)
+	}
+	popped.Progress = MaxProgress
+	if err = qu.Complete(context.Background(), popped); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.Purge(context.Background(), testBucket); err != nil {
+		t.Fatal(err)
+	}
+
+	evs, err = qu.ReadEvents(context.Background(), cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 3 {
+		t.Fatalf("expected 3 events, got %+v", evs)
+	}
+	for i, tp := range []EventType{EventCancel, EventComplete, EventPurge} {
+		if evs[i].Type != tp || evs[i].Bucket != testBucket {
+			t.Fatalf("expected %q event, got %+v", tp, evs[i])
+		}
+	}
+	if evs[1].Item == nil || evs[1].Item.Progress != MaxProgress {
+		t.Fatalf("unexpected complete event %+v", evs[1])
+	}
+}
+
+func TestQueueReadEventsLimit(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if err = qu.Add(ctx, CreateItem("test-bucket", 100, "data")); err != nil {
+		t.Fatal(err)
+	}
+	batch := []*Item{CreateItem("test-bucket", 100, "data"), CreateItem("test-bucket", 100, "data"), CreateItem("test-bucket", 100, "data")}
+	if err = qu.AddBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, CreateItem("test-bucket", 100, "data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// pages end at revision boundaries
+	var sizes []int
+	for cursor := int64(0); ; {
+		evs, err := qu.ReadEvents(ctx, cursor, WithLimit(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(evs) == 0 {
+			break
+		}
+		sizes = append(sizes, len(evs))
+		cursor = evs[len(evs)-1].Rev + 1
+	}
+	if len(sizes) != 2 || sizes[0] != 4 || sizes[1] != 1 {
+		t.Fatalf("expected pages of 4 and 1 events, got %v", sizes)
+	}
+
+	// events are kept within the retention
+	if n, err := qu.GCEvents(ctx, time.Hour); err != nil || n != 0 {
+		t.Fatalf("expected no events deleted, got %d (%v)", n, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n, err := qu.GCEvents(ctx, time.Millisecond); err != nil || n != 5 {
+		t.Fatalf("expected 5 events deleted, got %d (%v)", n, err)
+	}
+	if evs, err := qu.ReadEvents(ctx, 0); err != nil || len(evs) != 0 {
+		t.Fatalf("expected no events, got %d (%v)", len(evs), err)
+	}
+}
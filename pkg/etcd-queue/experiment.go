@@ -0,0 +1,83 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// Metric is a time-series data point of an item (e.g. loss per epoch),
+// appended by workers while processing the item.
+type Metric struct {
+	// Name is the metric name (e.g. "loss", "accuracy").
+	Name string `json:"name"`
+
+	// Epoch is the training iteration that the metric was measured at.
+	Epoch int `json:"epoch"`
+
+	// Value is the measured value.
+	Value float64 `json:"value"`
+
+	// CreatedAt is timestamp of metric creation.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const pfxMetrics = "_metrics"
+
+// metricsPrefix returns the prefix of all metrics of the item key.
+func metricsPrefix(itemKey string) string {
+	return path.Join(pfxMetrics, itemKey) + "/"
+}
+
+func (qu *queue) AppendMetrics(ctx context.Context, itemKey string, ms ...*Metric) error {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if itemKey == "" {
+		return fmt.Errorf("received empty item key")
+	}
+	if len(ms) == 0 {
+		return nil
+	}
+
+	ops := make([]clientv3.Op, 0, len(ms))
+	for _, m := range ms {
+		if m == nil {
+			return fmt.Errorf("received <nil> Metric")
+		}
+		if m.CreatedAt.IsZero() {
+			m.CreatedAt = qu.clock.Now()
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		// lexicographically sorted by epoch, and then by name
+		key := metricsPrefix(itemKey) + fmt.Sprintf("%010d/%s", m.Epoch, m.Name)
+		ops = append(ops, clientv3.OpPut(key, string(data)))
+	}
+	_, err := qu.kv.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+func (qu *queue) Metrics(ctx context.Context, itemKey string) ([]*Metric, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	pfx := metricsPrefix(itemKey)
+	resp, err := qu.kv.Get(ctx, pfx, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]*Metric, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var m Metric
+		if err = json.Unmarshal(kv.Value, &m); err != nil {
+			return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", string(kv.Key), string(kv.Value), err)
+		}
+		ms = append(ms, &m)
+	}
+	return ms, nil
+}
@@ -0,0 +1,56 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	item := CreateItem("test-bucket", 100, "test-data")
+	if err = qu.AppendMetrics(context.Background(), item.Key,
+		&Metric{Name: "loss", Epoch: 10, Value: 0.5},
+		&Metric{Name: "accuracy", Epoch: 10, Value: 0.6},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.AppendMetrics(context.Background(), item.Key, &Metric{Name: "loss", Epoch: 2, Value: 0.9}); err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err := qu.Metrics(context.Background(), item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 3 {
+		t.Fatalf("expected 3 metrics, got %+v", ms)
+	}
+	if ms[0].Epoch != 2 || ms[1].Name != "accuracy" || ms[2].Value != 0.5 {
+		t.Fatalf("unexpected metrics order %+v %+v %+v", ms[0], ms[1], ms[2])
+	}
+
+	ms, err = qu.Metrics(context.Background(), CreateItem("test-bucket", 100, "test-data").Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 0 {
+		t.Fatalf("expected no metrics, got %+v", ms)
+	}
+}
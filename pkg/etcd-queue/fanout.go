@@ -0,0 +1,288 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+const (
+	// FanOutLabel is the item label of the fan-out ID of shard items.
+	FanOutLabel = "fanout"
+	// FanOutJoinLabel is the item label of the fan-out ID of join items.
+	FanOutJoinLabel = "fanout-join"
+)
+
+const pfxFanOut = "_fanout"
+
+func fanOutMetaKey(id string) string {
+	return path.Join(pfxFanOut, id, "meta")
+}
+
+// fanOutDonePrefix returns the prefix of the markers of finished shards,
+// written in the same transaction as their Complete or Cancel.
+func fanOutDonePrefix(id string) string {
+	return path.Join(pfxFanOut, id, "done") + "/"
+}
+
+// fanOutMeta is the persisted state of a fan-out.
+type fanOutMeta struct {
+	Keys []string `json:"keys"`
+
+	// Join is enqueued once all shards finish, if not <nil>.
+	Join *Item `json:"join,omitempty"`
+
+	// Fired is true once the join item is enqueued.
+	Fired bool `json:"fired,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WithJoinItem configures FanOut to enqueue the item once all shards
+// finish (e.g. a reduce job), labeled with the fan-out ID.
+func WithJoinItem(item *Item) OpOption {
+	return func(op *Op) { op.join = item }
+}
+
+// fanOutOps returns the operation to mark the shard finished, if the
+// item is a shard.
+func fanOutOps(item *Item) []clientv3.Op {
+	id, ok := item.Labels[FanOutLabel]
+	if !ok || item.Key == "" {
+		return nil
+	}
+	return []clientv3.Op{clientv3.OpPut(fanOutDonePrefix(id)+item.Key, string(terminalStatus(item)))}
+}
+
+// unfanOutOps returns the operation to unmark the restored shard
+// (see 'Undelete').
+func unfanOutOps(item *Item) []clientv3.Op {
+	id, ok := item.Labels[FanOutLabel]
+	if !ok {
+		return nil
+	}
+	return []clientv3.Op{clientv3.OpDelete(fanOutDonePrefix(id) + item.Key)}
+}
+
+func (qu *queue) FanOut(ctx context.Context, bucket string, items []*Item, opts ...OpOption) (*JoinHandle, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no item to fan out to %q", bucket)
+	}
+	ret := Op{}
+	ret.applyOpts(opts)
+
+	id := path.Join(bucket, fmt.Sprintf("%035X", qu.clock.Now().UnixNano()))
+	meta := fanOutMeta{Keys: make([]string, 0, len(items)), Join: ret.join, CreatedAt: qu.clock.Now()}
+	for _, item := range items {
+		if item == nil {
+			return nil, fmt.Errorf("received <nil> Item")
+		}
+		if item.Bucket != bucket {
+			return nil, fmt.Errorf("%q is not in bucket %q", item.Key, bucket)
+		}
+		if item.Labels == nil {
+			item.Labels = make(map[string]string)
+		}
+		item.Labels[FanOutLabel] = id
+		meta.Keys = append(meta.Keys, item.Key)
+	}
+	if meta.Join != nil {
+		if meta.Join.Labels == nil {
+			meta.Join.Labels = make(map[string]string)
+		}
+		meta.Join.Labels[FanOutJoinLabel] = id
+		meta.Join.IdempotencyKey = path.Join(pfxFanOut, id)
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := qu.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(fanOutMetaKey(id)), "=", 0)).
+		Then(clientv3.OpPut(fanOutMetaKey(id), string(data))).
+		Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, fmt.Errorf("fan-out %q already exists", id)
+	}
+
+	// shards beyond 'MaxBatchSize' are written in more than one transaction
+	if err = qu.AddBatch(ctx, items, opts...); err != nil {
+		return nil, err
+	}
+	glog.Infof("queue: fanned out %d items to %q (%s)", len(items), bucket, id)
+	return &JoinHandle{ID: id, Keys: meta.Keys, qu: qu}, nil
+}
+
+func (qu *queue) Join(ctx context.Context, id string) (*JoinHandle, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	meta, _, err := qu.fanOutMeta(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &JoinHandle{ID: id, Keys: meta.Keys, qu: qu}, nil
+}
+
+func (qu *queue) fanOutMeta(ctx context.Context, id string) (*fanOutMeta, int64, error) {
+	resp, err := qu.kv.Get(ctx, fanOutMetaKey(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, fmt.Errorf("fan-out %q not found", id)
+	}
+	var meta fanOutMeta
+	if err = json.Unmarshal(resp.Kvs[0].Value, &meta); err != nil {
+		return nil, 0, fmt.Errorf("%q returned wrong JSON %q (%v)", string(resp.Kvs[0].Key), string(resp.Kvs[0].Value), err)
+	}
+	return &meta, resp.Kvs[0].ModRevision, nil
+}
+
+// fireJoin enqueues the join item of the fan-out of the finished shard,
+// if all shards have finished. It must be called without 'writemu' held.
+func (qu *queue) fireJoin(ctx context.Context, shard *Item) {
+	id, ok := shard.Labels[FanOutLabel]
+	if !ok {
+		return
+	}
+	if err := qu.tryFireJoin(ctx, id); err != nil {
+		glog.Warningf("queue: failed to join fan-out %q on %q (%v)", id, shard.Key, err)
+	}
+}
+
+func (qu *queue) tryFireJoin(ctx context.Context, id string) error {
+	meta, rev, err := qu.fanOutMeta(ctx, id)
+	if err != nil || meta.Fired || meta.Join == nil {
+		return err
+	}
+	resp, err := qu.kv.Get(ctx, fanOutDonePrefix(id), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return err
+	}
+	if resp.Count < int64(len(meta.Keys)) {
+		return nil
+	}
+
+	// concurrent last shards attach to the same item by its idempotency key
+	join := *meta.Join
+	if err = qu.Add(ctx, &join); err != nil {
+		return err
+	}
+	meta.Fired = true
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = qu.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(fanOutMetaKey(id)), "=", rev)).
+		Then(clientv3.OpPut(fanOutMetaKey(id), string(data))).
+		Commit()
+	if err == nil {
+		glog.Infof("queue: joined fan-out %q with %q", id, join.Key)
+	}
+	return err
+}
+
+// JoinHandle tracks the shards of a fan-out (see 'Queue.FanOut').
+type JoinHandle struct {
+	// ID is the fan-out ID, set in 'FanOutLabel' of its shards.
+	ID string
+
+	// Keys are the keys of the shards.
+	Keys []string
+
+	qu *queue
+}
+
+// Done returns the number of finished (completed, failed, or canceled)
+// shards.
+func (h *JoinHandle) Done(ctx context.Context) (int, error) {
+	resp, err := h.qu.kv.Get(ctx, fanOutDonePrefix(h.ID), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return int(resp.Count), nil
+}
+
+// Wait blocks until all shards finish, and returns the finished shards
+// in the order of 'Keys'. Expired shards never finish.
+func (h *JoinHandle) Wait(ctx context.Context) ([]*Item, error) {
+	pfx := fanOutDonePrefix(h.ID)
+	for {
+		resp, err := h.qu.kv.Get(ctx, pfx, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			return nil, err
+		}
+		if resp.Count >= int64(len(h.Keys)) {
+			return h.Results(ctx)
+		}
+
+		// wait for the next marker after the count
+		wctx, cancel := context.WithCancel(ctx)
+		wch := h.qu.cli.Watch(wctx, pfx, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+		select {
+		case <-wch:
+		case <-ctx.Done():
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// OnComplete calls the function in a new goroutine, once all shards
+// finish (see 'Wait'), or with the error of the context. Stop waits for
+// the function to return. After Stop, it is called with ErrQueueClosed
+// before OnComplete returns. A panic while waiting is passed to the
+// function as PanicError, and panics of the function are reported to
+// error hooks (see 'AddErrorHook').
+func (h *JoinHandle) OnComplete(ctx context.Context, fn func([]*Item, error)) {
+	if !h.qu.goBackground("join", h.ID, func() {
+		var (
+			items []*Item
+			err   error
+		)
+		func() {
+			defer h.qu.recoverPanic("join", h.ID, func(perr error) { err = perr })
+			items, err = h.Wait(ctx)
+		}()
+		fn(items, err)
+	}) {
+		fn(nil, ErrQueueClosed)
+	}
+}
+
+// Results returns the shards in the order of 'Keys'. Removed shards
+// (e.g. garbage collected) are skipped.
+func (h *JoinHandle) Results(ctx context.Context) ([]*Item, error) {
+	items := make([]*Item, 0, len(h.Keys))
+	for _, key := range h.Keys {
+		ent, err := h.qu.Get(ctx, key)
+		if err == ErrItemNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, ent.Item)
+	}
+	return items, nil
+}
+
+// Close deletes the fan-out state. Shards and the join item are not
+// deleted.
+func (h *JoinHandle) Close(ctx context.Context) error {
+	_, err := h.qu.kv.Delete(ctx, path.Join(pfxFanOut, h.ID)+"/", clientv3.WithPrefix())
+	return err
+}
@@ -0,0 +1,126 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFanOut(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if _, err = qu.FanOut(ctx, "infer", []*Item{CreateItem("other", 100, "shard")}); err == nil {
+		t.Fatal("expected bucket mismatch error")
+	}
+
+	shards := make([]*Item, 40)
+	for i := range shards {
+		shards[i] = CreateItem("infer", 100, fmt.Sprintf("shard-%d", i))
+	}
+	h, err := qu.FanOut(ctx, "infer", shards, WithJoinItem(CreateItem("reduce", 100, "merge")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Keys) != len(shards) || shards[0].Labels[FanOutLabel] != h.ID {
+		t.Fatalf("unexpected handle %+v", h)
+	}
+	donec := make(chan []*Item, 1)
+	h.OnComplete(ctx, func(items []*Item, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		donec <- items
+	})
+
+	// canceled shards finish the fan-out, and undelete restores them
+	if _, err = qu.Cancel(ctx, shards[0].Key); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := h.Done(ctx); err != nil || n != 1 {
+		t.Fatalf("expected 1 done, got %d (%v)", n, err)
+	}
+	if _, err = qu.Undelete(ctx, shards[0].Key); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := h.Done(ctx); err != nil || n != 0 {
+		t.Fatalf("expected 0 done, got %d (%v)", n, err)
+	}
+
+	for i := range shards {
+		item := <-qu.Pop(ctx, "infer")
+		if item.Err() != nil {
+			t.Fatal(item.Err())
+		}
+		item.Progress = MaxProgress
+		if i == 0 {
+			item.Error = "bad shard"
+		}
+		if err = qu.Complete(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+		if i < len(shards)-1 {
+			if items, err := qu.List(ctx, "reduce"); err != nil || len(items) != 0 {
+				t.Fatalf("expected no join item before all shards, got %+v (%v)", items, err)
+			}
+		}
+	}
+
+	select {
+	case items := <-donec:
+		if len(items) != len(shards) || items[0].Key != shards[0].Key {
+			t.Fatalf("unexpected results %d", len(items))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to join")
+	}
+	items, err := qu.List(ctx, "reduce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Labels[FanOutJoinLabel] != h.ID {
+		t.Fatalf("expected 1 join item, got %+v", items)
+	}
+
+	// the join item can reattach to the fan-out
+	joined, err := qu.Join(ctx, items[0].Labels[FanOutJoinLabel])
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := joined.Results(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := 0
+	for _, item := range results {
+		if item.Error != "" {
+			failed++
+		}
+	}
+	if len(results) != len(shards) || failed != 1 {
+		t.Fatalf("expected %d results with 1 failure, got %d (%d failed)", len(shards), len(results), failed)
+	}
+	if err = joined.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.Join(ctx, h.ID); err == nil {
+		t.Fatal("expected not found error")
+	}
+}
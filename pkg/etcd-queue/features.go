@@ -0,0 +1,111 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// Feature is a data format written by the queue, that older versions of
+// the queue cannot read (e.g. new indexes). Features are persisted when
+// enabled, so that queues refuse to start against data they would
+// silently corrupt (e.g. on rollback, or mixed-version deployments).
+type Feature string
+
+const (
+	// FeatureStatusIndex indexes items by status and owner (see 'IndexEntry').
+	FeatureStatusIndex Feature = "status-index"
+	// FeatureCompletedIndex indexes completed items by completion time.
+	FeatureCompletedIndex Feature = "completed-index"
+	// FeatureItemStatus stores 'Item.Status' in items.
+	FeatureItemStatus Feature = "item-status"
+	// FeatureMigratedKeys forwards old keys of migrated items (see 'Migrate').
+	FeatureMigratedKeys Feature = "migrated-keys"
+)
+
+// supportedFeatures are the features this version reads and writes.
+var supportedFeatures = []Feature{
+	FeatureStatusIndex,
+	FeatureCompletedIndex,
+	FeatureItemStatus,
+	FeatureMigratedKeys,
+}
+
+// pfxFeatures is the prefix of enabled features:
+//
+//	_meta/features/<feature> = <enabled-at>
+var pfxFeatures = path.Join("_meta", "features") + "/"
+
+// UnsupportedFeatureError is returned by NewQueue when the data has been
+// written with features unknown to this version of the queue.
+type UnsupportedFeatureError struct {
+	Features []Feature
+}
+
+func (e *UnsupportedFeatureError) Error() string {
+	fs := make([]string, len(e.Features))
+	for i, f := range e.Features {
+		fs[i] = string(f)
+	}
+	return fmt.Sprintf("queue: data written with unsupported features [%s]; upgrade the queue", strings.Join(fs, ", "))
+}
+
+// initFeatures fails if the data has been written with unsupported
+// features, and enables supported features not yet persisted, so that
+// older versions refuse to start. Read-only queues only check features.
+func (qu *queue) initFeatures(ctx context.Context) error {
+	enabled, err := qu.Features(ctx)
+	if err != nil {
+		return err
+	}
+	known := make(map[Feature]bool, len(supportedFeatures))
+	for _, f := range supportedFeatures {
+		known[f] = true
+	}
+	var unknown []Feature
+	for _, f := range enabled {
+		if !known[f] {
+			unknown = append(unknown, f)
+		}
+		delete(known, f)
+	}
+	if len(unknown) > 0 {
+		return &UnsupportedFeatureError{Features: unknown}
+	}
+	if qu.readOnly || len(known) == 0 {
+		return nil
+	}
+
+	// concurrent queues of the same version enable the same features
+	enabledAt := qu.clock.Now().UTC().Format(time.RFC3339)
+	ops := make([]clientv3.Op, 0, len(known))
+	for _, f := range supportedFeatures {
+		if known[f] {
+			ops = append(ops, clientv3.OpPut(pfxFeatures+string(f), enabledAt))
+		}
+	}
+	if _, err = qu.kv.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return err
+	}
+	glog.Infof("queue: enabled %d features", len(ops))
+	return nil
+}
+
+func (qu *queue) Features(ctx context.Context) ([]Feature, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	resp, err := qu.kv.Get(ctx, pfxFeatures, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	fs := make([]Feature, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		fs = append(fs, Feature(strings.TrimPrefix(string(kv.Key), pfxFeatures)))
+	}
+	return fs, nil
+}
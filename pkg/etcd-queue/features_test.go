@@ -0,0 +1,91 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	fs, err := qu.Features(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []Feature{FeatureCompletedIndex, FeatureItemStatus, FeatureMigratedKeys, FeatureStatusIndex}
+	if !reflect.DeepEqual(fs, exp) {
+		t.Fatalf("expected %v, got %v", exp, fs)
+	}
+
+	// queues of the same version start against the data
+	if _, err = NewQueue(qu.Client()); err != nil {
+		t.Fatal(err)
+	}
+
+	// data written by a newer version
+	if _, err = qu.Client().Put(ctx, pfxFeatures+"new-index", "enabled"); err != nil {
+		t.Fatal(err)
+	}
+	for _, newQueue := range []func() (Queue, error){
+		func() (Queue, error) { return NewQueue(qu.Client()) },
+		func() (Queue, error) { return NewReadOnlyQueue(qu.Client()) },
+	} {
+		_, err = newQueue()
+		ferr, ok := err.(*UnsupportedFeatureError)
+		if !ok || !reflect.DeepEqual(ferr.Features, []Feature{"new-index"}) {
+			t.Fatalf("expected UnsupportedFeatureError, got %v", err)
+		}
+	}
+}
+
+func TestFeaturesReadOnly(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	// read-only queues do not enable features
+	ctx := context.Background()
+	if _, err = qu.Client().Delete(ctx, pfxFeatures+string(FeatureMigratedKeys)); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := NewReadOnlyQueue(qu.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := ro.Features(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != len(supportedFeatures)-1 {
+		t.Fatalf("expected %d features, got %v", len(supportedFeatures)-1, fs)
+	}
+}
@@ -0,0 +1,232 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/golang/glog"
+)
+
+// frontCache caches the front item per bucket, invalidated by a prefix
+// watch on the bucket, so that Front on hot buckets is served from memory.
+// Writes from this queue also invalidate the cache, so that Front reads
+// its own writes without waiting for the watch.
+type frontCache struct {
+	mu      sync.Mutex
+	entries map[string]*frontEntry
+}
+
+type frontEntry struct {
+	// kv is the cached front item, or <nil> if the bucket is empty.
+	kv     *mvccpb.KeyValue
+	cached bool
+
+	// gen is incremented on every invalidation, so that reads issued
+	// before an invalidation are not cached.
+	gen int64
+}
+
+func (qu *queue) Front(ctx context.Context, bucket string, opts ...OpOption) (*Item, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	ret := Op{}
+	ret.applyOpts(opts)
+
+	// cached items may be stale, while etcd is unavailable
+	if !qu.breaker.allow() {
+		return nil, ErrQueueUnavailable
+	}
+
+	c := &qu.front
+	c.mu.Lock()
+	ent, ok := c.entries[bucket]
+	if ok && ent.cached {
+		kv := ent.kv
+		c.mu.Unlock()
+		if kv == nil {
+			return nil, nil
+		}
+		return decodeItem(kv)
+	}
+	var gen int64
+	if ok {
+		gen = ent.gen
+	}
+	c.mu.Unlock()
+
+	resp, err := qu.kv.Get(ctx, bucketPrefix(bucket), ret.readOpts(clientv3.WithFirstKey()...)...)
+	if err != nil {
+		return nil, err
+	}
+	var kv *mvccpb.KeyValue
+	if len(resp.Kvs) > 0 {
+		kv = resp.Kvs[0]
+	}
+
+	c.mu.Lock()
+	cur, exists := c.entries[bucket]
+	switch {
+	case !exists:
+		// watch from the read revision, not to miss any write after it
+		if c.entries == nil {
+			c.entries = make(map[string]*frontEntry)
+		}
+		ent = &frontEntry{kv: kv, cached: true}
+		c.entries[bucket] = ent
+		e, rev := ent, resp.Header.Revision+1
+		qu.goBackground("watch-front", bucket, func() { qu.watchFront(bucket, e, rev) })
+	case ok && cur == ent && cur.gen == gen:
+		cur.kv, cur.cached = kv, true
+	}
+	c.mu.Unlock()
+
+	if kv == nil {
+		return nil, nil
+	}
+	return decodeItem(kv)
+}
+
+// invalidateFront drops the cached front items of the buckets.
+func (qu *queue) invalidateFront(buckets ...string) {
+	qu.front.mu.Lock()
+	for _, bucket := range buckets {
+		if ent, ok := qu.front.entries[bucket]; ok {
+			ent.kv, ent.cached = nil, false
+			ent.gen++
+		}
+	}
+	qu.front.mu.Unlock()
+}
+
+// watchFront invalidates the cached front item on any write to the
+// bucket. If the watch fails (e.g. compacted), the entry is removed
+// to be re-created on next Front.
+func (qu *queue) watchFront(bucket string, ent *frontEntry, rev int64) {
+	wch := qu.cli.Watch(qu.rootCtx, bucketPrefix(bucket), clientv3.WithPrefix(), clientv3.WithRev(rev))
+	for wresp := range wch {
+		if err := wresp.Err(); err != nil {
+			glog.Warningf("queue: front cache watch on %q failed (%v)", bucket, err)
+			break
+		}
+		if len(wresp.Events) > 0 {
+			qu.invalidateFront(bucket)
+		}
+	}
+
+	qu.front.mu.Lock()
+	if qu.front.entries[bucket] == ent {
+		delete(qu.front.entries, bucket)
+	}
+	qu.front.mu.Unlock()
+}
+
+func (qu *queue) WatchFront(ctx context.Context, bucket string) EventWatcher {
+	if err := qu.lc.err(); err != nil {
+		return closedEventWatcher(bucket, err)
+	}
+	ch := make(chan *Event, 100)
+
+	pfx := bucketPrefix(bucket)
+	ctx, done := qu.trackWatch(ctx, "watch-front", pfx)
+	qu.subscribe(ctx, bucket)
+	if !qu.goBackground("watch-front", bucket, func() {
+		defer close(ch)
+		defer done()
+		defer notifyEvictedEvent(ctx, ch, bucket)
+		defer qu.recoverPanic("watch-front", bucket, func(err error) {
+			notifyEvent(ch, &Event{Bucket: bucket, Error: err.Error()})
+		})
+
+		resp, err := qu.kv.Get(ctx, pfx, clientv3.WithFirstKey()...)
+		if err != nil {
+			sendEvent(ctx, ch, &Event{Bucket: bucket, Error: err.Error()})
+			return
+		}
+		var cur *mvccpb.KeyValue
+		if len(resp.Kvs) > 0 {
+			cur = resp.Kvs[0]
+		}
+		if !sendFrontEvents(ctx, ch, bucket, nil, cur, nil) {
+			return
+		}
+
+		// the front is read again at the revision of each response,
+		// since items behind the front are not tracked
+		wch := qu.cli.Watch(ctx, pfx, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+		for wresp := range wch {
+			if wresp.Err() != nil {
+				sendEvent(ctx, ch, &Event{Bucket: bucket, Error: fmt.Sprintf("%q returned error %v", pfx, wresp.Err())})
+				return
+			}
+			if len(wresp.Events) == 0 {
+				continue
+			}
+			deleted := make(map[string]int64)
+			for _, ev := range wresp.Events {
+				if ev.Type == mvccpb.DELETE {
+					deleted[string(ev.Kv.Key)] = ev.Kv.ModRevision
+				}
+			}
+			rev := wresp.Events[len(wresp.Events)-1].Kv.ModRevision
+			resp, err = qu.kv.Get(ctx, pfx, append(clientv3.WithFirstKey(), clientv3.WithRev(rev))...)
+			if err != nil {
+				sendEvent(ctx, ch, &Event{Bucket: bucket, Rev: rev, Error: err.Error()})
+				return
+			}
+			var next *mvccpb.KeyValue
+			if len(resp.Kvs) > 0 {
+				next = resp.Kvs[0]
+			}
+			if !sendFrontEvents(ctx, ch, bucket, cur, next, deleted) {
+				return
+			}
+			cur = next
+		}
+	}) {
+		done()
+		return closedEventWatcher(bucket, ErrQueueClosed)
+	}
+	return ch
+}
+
+// sendFrontEvents sends the events of the front item changed from prev
+// to next, given the revisions of the keys deleted since prev was read.
+// It returns false if the context is canceled.
+func sendFrontEvents(ctx context.Context, ch chan<- *Event, bucket string, prev, next *mvccpb.KeyValue, deleted map[string]int64) bool {
+	var evs []*Event
+	same := prev != nil && next != nil && string(prev.Key) == string(next.Key) && prev.CreateRevision == next.CreateRevision
+	if prev != nil && !same {
+		if rev, ok := deleted[string(prev.Key)]; ok {
+			evs = append(evs, frontEvent(EventDeleted, bucket, prev, rev))
+		}
+	}
+	switch {
+	case next == nil:
+	case !same:
+		evs = append(evs, frontEvent(EventCreated, bucket, next, next.ModRevision))
+	case next.ModRevision != prev.ModRevision:
+		evs = append(evs, frontEvent(EventUpdated, bucket, next, next.ModRevision))
+	}
+	for _, ev := range evs {
+		if !sendEvent(ctx, ch, ev) {
+			return false
+		}
+	}
+	return true
+}
+
+// frontEvent returns the event of the front item.
+func frontEvent(tp EventType, bucket string, kv *mvccpb.KeyValue, rev int64) *Event {
+	ev := &Event{Type: tp, Bucket: bucket, Key: strings.TrimPrefix(string(kv.Key), pfxQueue+"/"), Rev: rev}
+	item, err := decodeItem(kv)
+	if err != nil {
+		ev.Error = err.Error()
+		return ev
+	}
+	ev.Item = item
+	return ev
+}
@@ -0,0 +1,150 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFrontCache(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	item, err := qu.Front(ctx, "test-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != nil {
+		t.Fatalf("expected empty bucket, got %+v", item)
+	}
+
+	item1 := CreateItem("test-bucket", 100, "a")
+	if err = qu.Add(ctx, item1); err != nil {
+		t.Fatal(err)
+	}
+	waitFront(t, qu, "test-bucket", item1)
+
+	// cached item is a copy
+	item, err = qu.Front(ctx, "test-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Value = "modified"
+	waitFront(t, qu, "test-bucket", item1)
+
+	// higher weight becomes the front
+	item2 := CreateItem("test-bucket", 200, "b")
+	if err = qu.Add(ctx, item2); err != nil {
+		t.Fatal(err)
+	}
+	waitFront(t, qu, "test-bucket", item2)
+
+	<-qu.Pop(ctx, "test-bucket")
+	waitFront(t, qu, "test-bucket", item1)
+	<-qu.Pop(ctx, "test-bucket")
+	waitFront(t, qu, "test-bucket", nil)
+
+	// writes from other clients are invalidated by watch
+	item3 := CreateItem("test-bucket", 100, "c")
+	data, err := json.Marshal(item3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.Client().Put(ctx, PendingKey(item3.Key), string(data)); err != nil {
+		t.Fatal(err)
+	}
+	waitFront(t, qu, "test-bucket", item3, 50)
+}
+
+// waitFront waits until Front returns the expected item, retrying for
+// writes from other clients, until the cache is invalidated by watch.
+// Without retries, Front must read its own writes.
+func waitFront(t *testing.T, qu Queue, bucket string, expected *Item, retries ...int) {
+	n := 1
+	if len(retries) > 0 {
+		n = retries[0]
+	}
+	var item *Item
+	var err error
+	for i := 0; i < n; i++ {
+		if item, err = qu.Front(context.Background(), bucket); err != nil {
+			t.Fatal(err)
+		}
+		if expected == nil && item == nil {
+			return
+		}
+		if expected != nil && item != nil && expected.Equal(item) == nil {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expected front %+v, got %+v", expected, item)
+}
+
+func TestWatchFront(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	item1 := CreateItem("test-bucket", 100, "a")
+	if err = qu.Add(ctx, item1); err != nil {
+		t.Fatal(err)
+	}
+	wch := qu.WatchFront(ctx, "test-bucket")
+	expectEvent(t, wch, EventCreated, item1.Key)
+
+	// items behind the front are not streamed
+	if err = qu.Add(ctx, CreateItem("test-bucket", 10, "b")); err != nil {
+		t.Fatal(err)
+	}
+	item2 := CreateItem("test-bucket", 9000, "c")
+	if err = qu.Add(ctx, item2); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, wch, EventCreated, item2.Key)
+
+	item2.Value = "c2"
+	if err = qu.Add(ctx, item2); err != nil {
+		t.Fatal(err)
+	}
+	if ev := expectEvent(t, wch, EventUpdated, item2.Key); ev.Item.Value != "c2" {
+		t.Fatalf("expected updated value, got %+v", ev.Item)
+	}
+
+	if it := <-qu.Pop(ctx, "test-bucket"); it.Key != item2.Key {
+		t.Fatalf("expected %q popped, got %+v", item2.Key, it)
+	}
+	expectEvent(t, wch, EventDeleted, item2.Key)
+	expectEvent(t, wch, EventCreated, item1.Key)
+}
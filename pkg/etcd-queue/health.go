@@ -0,0 +1,126 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+)
+
+var (
+	// BackendQuotaBytes is the backend quota of etcd ('--quota-backend-bytes',
+	// defaults to 2 GiB), to check the database size against.
+	BackendQuotaBytes int64 = 2 * 1024 * 1024 * 1024
+
+	// ReadyQuotaRatio is the ratio of 'BackendQuotaBytes' the database
+	// can use, before the queue is reported as not ready.
+	ReadyQuotaRatio = 0.9
+)
+
+// keyHealthWatch is the key watched by readiness checks.
+const keyHealthWatch = "_health/watch"
+
+// HealthCheck is the result of a readiness check.
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Readiness is the result of readiness checks of the queue.
+type Readiness struct {
+	Ready  bool          `json:"ready"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// CheckReady checks that every etcd endpoint is reachable, the cluster
+// has a leader, watches can be established, and the database is below
+// the ratio of its quota without space alarms. Each check times out
+// after 'MemberHealthTimeout'.
+func CheckReady(ctx context.Context, qu Queue) Readiness {
+	ctx, cancel := context.WithTimeout(ctx, MemberHealthTimeout)
+	defer cancel()
+	cli := clientOf(qu)
+
+	var (
+		rd       = Readiness{Ready: true}
+		leader   uint64
+		dbSize   int64
+		reachErr error
+	)
+	check := func(name, detail string, err error) {
+		c := HealthCheck{Name: name, OK: err == nil, Detail: detail}
+		if err != nil {
+			c.Error = err.Error()
+			rd.Ready = false
+		}
+		rd.Checks = append(rd.Checks, c)
+	}
+
+	eps := cli.Endpoints()
+	if len(eps) == 0 {
+		// embedded clients have no endpoints, and serve the status
+		// of the embedded member
+		eps = []string{""}
+	}
+	for _, ep := range eps {
+		resp, err := cli.Status(ctx, ep)
+		if err != nil {
+			reachErr = fmt.Errorf("failed to get status of %q (%v)", ep, err)
+			break
+		}
+		if resp.Leader != 0 {
+			leader = resp.Leader
+		}
+		if resp.DbSize > dbSize {
+			dbSize = resp.DbSize
+		}
+	}
+	check("etcd", fmt.Sprintf("endpoints %q", cli.Endpoints()), reachErr)
+
+	var err error
+	if leader == 0 {
+		err = fmt.Errorf("no leader")
+	}
+	check("leader", fmt.Sprintf("leader %x", leader), err)
+
+	check("watch", "", checkWatch(ctx, cli))
+
+	limit := int64(float64(BackendQuotaBytes) * ReadyQuotaRatio)
+	err = nil
+	if dbSize > limit {
+		err = fmt.Errorf("database size %d exceeds %d (%.0f%% of quota)", dbSize, limit, ReadyQuotaRatio*100)
+	} else if aresp, aerr := cli.AlarmList(ctx); aerr != nil {
+		err = fmt.Errorf("failed to list alarms (%v)", aerr)
+	} else {
+		for _, a := range aresp.Alarms {
+			if a.Alarm == pb.AlarmType_NOSPACE {
+				err = fmt.Errorf("member %x raised space alarm", a.MemberID)
+				break
+			}
+		}
+	}
+	check("disk", fmt.Sprintf("database size %d of quota %d", dbSize, BackendQuotaBytes), err)
+	return rd
+}
+
+// checkWatch returns an error if a watch is not created before the
+// context is done.
+func checkWatch(ctx context.Context, cli *clientv3.Client) error {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+	for resp := range cli.Watch(ctx, keyHealthWatch, clientv3.WithCreatedNotify()) {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		if resp.Created {
+			return nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("watch not created (%v)", err)
+	}
+	return fmt.Errorf("watch closed")
+}
@@ -0,0 +1,60 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckReady(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	rd := CheckReady(ctx, qu)
+	if !rd.Ready {
+		t.Fatalf("expected ready, got %+v", rd)
+	}
+	var names []string
+	for _, c := range rd.Checks {
+		names = append(names, c.Name)
+	}
+	if len(names) != 4 || names[0] != "etcd" || names[1] != "leader" || names[2] != "watch" || names[3] != "disk" {
+		t.Fatalf("unexpected checks %v", names)
+	}
+
+	// database above the ratio of quota
+	old := BackendQuotaBytes
+	BackendQuotaBytes = 1
+	defer func() { BackendQuotaBytes = old }()
+	rd = CheckReady(ctx, qu)
+	if rd.Ready {
+		t.Fatalf("expected not ready, got %+v", rd)
+	}
+	for _, c := range rd.Checks {
+		if c.OK != (c.Name != "disk") {
+			t.Fatalf("unexpected check %+v", c)
+		}
+	}
+	BackendQuotaBytes = old
+
+	// stopped queue
+	qu.Stop()
+	if rd = CheckReady(ctx, qu); rd.Ready {
+		t.Fatalf("expected not ready, got %+v", rd)
+	}
+}
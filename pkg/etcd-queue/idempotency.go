@@ -0,0 +1,105 @@
+package etcdqueue
+
+import (
+	"context"
+	"path"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// pfxIdempotency is the prefix of idempotency keys, mapping to the item
+// keys of their logical jobs:
+//
+//	_idem/<bucket>/<idempotency-key> = <item-key>
+const pfxIdempotency = "_idem"
+
+func idempotencyKey(item *Item) string {
+	return path.Join(pfxIdempotency, item.Bucket, item.IdempotencyKey)
+}
+
+// idempotencyOps returns the operation to release the idempotency key of
+// the item, so that later requests of the same key create a new item.
+func idempotencyOps(item *Item) []clientv3.Op {
+	if item.IdempotencyKey == "" {
+		return nil
+	}
+	return []clientv3.Op{clientv3.OpDelete(idempotencyKey(item))}
+}
+
+// attachDuplicate replaces the item with the existing item of the same
+// idempotency key, and returns true. It returns false if there is no
+// other item of the key, releasing the key if its item has been removed
+// (e.g. purged, or garbage collected).
+func (qu *queue) attachDuplicate(ctx context.Context, item *Item) (bool, error) {
+	ik := idempotencyKey(item)
+	resp, err := qu.kv.Get(ctx, ik)
+	if err != nil {
+		return false, err
+	}
+	if len(resp.Kvs) == 0 || string(resp.Kvs[0].Value) == item.Key {
+		return false, nil
+	}
+	ent, err := qu.Get(ctx, string(resp.Kvs[0].Value))
+	if err == ErrItemNotFound {
+		_, err = qu.kv.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(ik), "=", resp.Kvs[0].ModRevision)).
+			Then(clientv3.OpDelete(ik)).
+			Commit()
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+	glog.Infof("queue: attached %q to %q of idempotency key %q", item.Key, ent.Item.Key, item.IdempotencyKey)
+	*item = *ent.Item
+	item.Status = ent.Status
+	return true, nil
+}
+
+// addIdempotent writes the item with its idempotency key, or attaches
+// the item to the existing item if another request wrote the key first.
+// It must be called with 'writemu' held.
+func (qu *queue) addIdempotent(ctx context.Context, item *Item, ttl int64) error {
+	opts, err := qu.leaseOpts(ctx, item.Bucket, ttl)
+	if err != nil {
+		return err
+	}
+
+	ik := idempotencyKey(item)
+	ops := func(vals [][]byte) []clientv3.Op {
+		return append([]clientv3.Op{
+			clientv3.OpPut(PendingKey(item.Key), string(vals[0]), opts...),
+			clientv3.OpPut(ik, item.Key, opts...),
+		}, qu.addOps(ctx, item, vals[0])...)
+	}
+	for {
+		gresp, err := qu.kv.Get(ctx, ik)
+		if err != nil {
+			return err
+		}
+		cmp := clientv3.Compare(clientv3.CreateRevision(ik), "=", 0)
+		if len(gresp.Kvs) > 0 {
+			if string(gresp.Kvs[0].Value) != item.Key {
+				attached, err := qu.attachDuplicate(ctx, item)
+				if err != nil || attached {
+					return err
+				}
+				// stale key has been released
+				continue
+			}
+			// requeued item of the key (e.g. preempted)
+			cmp = clientv3.Compare(clientv3.ModRevision(ik), "=", gresp.Kvs[0].ModRevision)
+		}
+
+		written, err := qu.sequenceTxn(ctx, []*Item{item}, []clientv3.Cmp{cmp}, ops)
+		qu.invalidateFront(item.Bucket)
+		if err != nil {
+			return err
+		}
+		if written {
+			glog.Infof("queue: wrote %q with idempotency key %q and TTL %d", item.Key, item.IdempotencyKey, ttl)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotency(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	item1 := CreateItem("my-job", 100, "data")
+	item1.IdempotencyKey = "req-1"
+	if err = qu.Add(ctx, item1); err != nil {
+		t.Fatal(err)
+	}
+
+	// duplicate request attaches to the first item
+	item2 := CreateItem("my-job", 100, "data")
+	item2.IdempotencyKey = "req-1"
+	if err = qu.Add(ctx, item2); err != nil {
+		t.Fatal(err)
+	}
+	if item2.Key != item1.Key || item2.Status != StatusPending {
+		t.Fatalf("expected attached %q in %q, got %q in %q", item1.Key, StatusPending, item2.Key, item2.Status)
+	}
+	items, err := qu.List(ctx, "my-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected 1 item, got %d", len(items))
+	}
+
+	// items with idempotency keys are only added one by one
+	item3 := CreateItem("my-job", 100, "data")
+	item3.IdempotencyKey = "req-3"
+	if err = qu.AddBatch(ctx, []*Item{item3}); err == nil {
+		t.Fatal("expected error on AddBatch")
+	}
+
+	// both requests share one watch
+	w1, w2 := qu.WatchItem(ctx, item1.Key), qu.WatchItem(ctx, item2.Key)
+	n := 0
+	for _, w := range qu.Watchers().Watchers {
+		if w.Kind == "watch-item-mux" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 item watch, got %d", n)
+	}
+	expectStatus(t, w1, StatusPending)
+	expectStatus(t, w2, StatusPending)
+
+	popped := <-qu.Pop(ctx, "my-job")
+	expectStatus(t, w1, StatusClaimed)
+	expectStatus(t, w2, StatusClaimed)
+
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, w1, StatusCompleted)
+	expectStatus(t, w2, StatusCompleted)
+	for _, w := range []ItemWatcher{w1, w2} {
+		select {
+		case item, ok := <-w:
+			if ok {
+				t.Fatalf("expected closed watcher, got %+v", item)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("took too long to close watcher")
+		}
+	}
+
+	// completed jobs are not run again
+	item4 := CreateItem("my-job", 100, "data")
+	item4.IdempotencyKey = "req-1"
+	if err = qu.Add(ctx, item4); err != nil {
+		t.Fatal(err)
+	}
+	if item4.Key != item1.Key || item4.Status != StatusCompleted {
+		t.Fatalf("expected attached %q in %q, got %q in %q", item1.Key, StatusCompleted, item4.Key, item4.Status)
+	}
+
+	// canceled jobs release their keys
+	item5 := CreateItem("my-job", 100, "data")
+	item5.IdempotencyKey = "req-5"
+	if err = qu.Add(ctx, item5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.Cancel(ctx, item5.Key); err != nil {
+		t.Fatal(err)
+	}
+	item6 := CreateItem("my-job", 100, "data")
+	item6.IdempotencyKey = "req-5"
+	key6 := item6.Key
+	if err = qu.Add(ctx, item6); err != nil {
+		t.Fatal(err)
+	}
+	if item6.Key != key6 {
+		t.Fatalf("expected new item %q, got %q", key6, item6.Key)
+	}
+}
+
+func expectStatus(t *testing.T, w ItemWatcher, st Status) {
+	select {
+	case item := <-w:
+		if item.Error != "" {
+			t.Fatal(item.Error)
+		}
+		if item.Status != st {
+			t.Fatalf("expected %q, got %q", st, item.Status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("took too long to receive %q", st)
+	}
+}
@@ -0,0 +1,210 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// Status is the lifecycle status of an item.
+type Status string
+
+const (
+	// StatusPending is for items in the queue.
+	StatusPending Status = "pending"
+	// StatusClaimed is for popped items, not yet started by workers.
+	// Claimed items are indexed as StatusInProgress.
+	StatusClaimed Status = "claimed"
+	// StatusInProgress is for popped items, not yet completed.
+	StatusInProgress Status = "in-progress"
+	// StatusCompleted is for items completed without error.
+	StatusCompleted Status = "completed"
+	// StatusFailed is for items completed with error.
+	StatusFailed Status = "failed"
+	// StatusCanceled is for canceled items.
+	StatusCanceled Status = "canceled"
+	// StatusExpired is for items completed after their deadline
+	// (e.g. results no longer needed by requesters).
+	StatusExpired Status = "expired"
+	// StatusTransferred is for pending items moved to another queue
+	// (see 'Transfer').
+	StatusTransferred Status = "transferred"
+	// StatusAccepted is for items delivered by Enqueue before their
+	// writes are committed. It is never written to etcd, and is not an
+	// acknowledgment: the write may still fail, or be lost with the server.
+	StatusAccepted Status = "accepted"
+	// StatusAcked is for items delivered by Enqueue after their writes
+	// are committed, which etcd acknowledges once they are persisted on
+	// a quorum of members. It is never written to etcd.
+	StatusAcked Status = "acked"
+)
+
+// terminalStatus returns the status of the completed item. Items without
+// terminal status derive it from 'Canceled' and 'Error' fields.
+func terminalStatus(item *Item) Status {
+	switch {
+	case item.Status.Terminal():
+		return item.Status
+	case item.Canceled:
+		return StatusCanceled
+	case item.Error != "":
+		return StatusFailed
+	default:
+		return StatusCompleted
+	}
+}
+
+// pfxIndex is the prefix of secondary indexes, maintained in the same
+// transaction as item writes:
+//
+//	_idx/status/<status>/<item-key>
+//	_idx/owner/<owner>/<item-key>
+//
+// Index values are IndexEntry snapshots, so that queries read only the
+// index range.
+const pfxIndex = "_idx"
+
+// IndexEntry is the snapshot of an item in the index.
+type IndexEntry struct {
+	Status Status `json:"status"`
+	Item   *Item  `json:"item"`
+}
+
+func statusIndexPrefix(st Status) string {
+	return path.Join(pfxIndex, "status", string(st)) + "/"
+}
+
+func ownerIndexPrefix(owner string) string {
+	return path.Join(pfxIndex, "owner", owner) + "/"
+}
+
+// rawIndexEntry is IndexEntry with the encoded item.
+type rawIndexEntry struct {
+	Status Status          `json:"status"`
+	Item   json.RawMessage `json:"item"`
+}
+
+// indexOps returns the operations to index the item with the status,
+// removing it from the previous statuses. The data is the encoded item
+// (see 'marshalItem').
+func indexOps(item *Item, data []byte, st Status, prev ...Status) []clientv3.Op {
+	entry, _ := encodeJSON(rawIndexEntry{Status: st, Item: data})
+	ops := make([]clientv3.Op, 0, len(prev)+2)
+	for _, p := range prev {
+		ops = append(ops, clientv3.OpDelete(statusIndexPrefix(p)+item.Key))
+	}
+	ops = append(ops, clientv3.OpPut(statusIndexPrefix(st)+item.Key, entry))
+	if item.Owner != "" {
+		ops = append(ops, clientv3.OpPut(ownerIndexPrefix(item.Owner)+item.Key, entry))
+	}
+	return ops
+}
+
+// unindexOps returns the operations to remove the item from indexes.
+func unindexOps(item *Item, st Status) []clientv3.Op {
+	ops := []clientv3.Op{clientv3.OpDelete(statusIndexPrefix(st) + item.Key)}
+	if item.Owner != "" {
+		ops = append(ops, clientv3.OpDelete(ownerIndexPrefix(item.Owner)+item.Key))
+	}
+	return ops
+}
+
+func (qu *queue) ListByOwner(ctx context.Context, owner string) ([]*IndexEntry, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if owner == "" {
+		return nil, fmt.Errorf("empty owner")
+	}
+	return qu.readIndex(ctx, ownerIndexPrefix(owner))
+}
+
+func (qu *queue) ListByStatus(ctx context.Context, st Status) ([]*Item, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	entries, err := qu.readIndex(ctx, statusIndexPrefix(st))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Item, 0, len(entries))
+	for _, ent := range entries {
+		items = append(items, ent.Item)
+	}
+	return items, nil
+}
+
+// readIndex returns index entries under the prefix. Pending items may
+// be removed without updating indexes (e.g. TTL expiry, Purge), so
+// pending entries are checked against the queue, and stale entries
+// are skipped and deleted.
+func (qu *queue) readIndex(ctx context.Context, pfx string) ([]*IndexEntry, error) {
+	resp, err := qu.kv.Get(ctx, pfx, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*IndexEntry, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var ent IndexEntry
+		if err = json.Unmarshal(kv.Value, &ent); err != nil {
+			return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", string(kv.Key), string(kv.Value), err)
+		}
+		if ent.Item == nil {
+			return nil, fmt.Errorf("%q has no item", string(kv.Key))
+		}
+		if ent.Status == StatusPending {
+			stale, err := qu.deleteStaleIndex(ctx, string(kv.Key), kv.ModRevision, &ent)
+			if err != nil {
+				return nil, err
+			}
+			if stale {
+				continue
+			}
+		}
+		entries = append(entries, &ent)
+	}
+	return entries, nil
+}
+
+// deleteStaleIndex deletes the pending index entry if its item is no
+// longer in the queue, and the entry has not been updated since read.
+// It returns true if the entry is stale. Read-only queues only skip
+// stale entries.
+func (qu *queue) deleteStaleIndex(ctx context.Context, idxKey string, rev int64, ent *IndexEntry) (bool, error) {
+	queueKey := path.Join(pfxQueue, ent.Item.Key)
+	if qu.readOnly {
+		gresp, err := qu.kv.Get(ctx, queueKey, clientv3.WithCountOnly())
+		if err != nil {
+			return false, err
+		}
+		return gresp.Count == 0, nil
+	}
+	// expired items are released with their status entries, which
+	// Purge deletes with the charges released
+	items := []*Item{ent.Item}
+	cmps := []clientv3.Cmp{
+		clientv3.Compare(clientv3.CreateRevision(queueKey), "=", 0),
+		clientv3.Compare(clientv3.ModRevision(idxKey), "=", rev),
+	}
+	if statusKey := statusIndexPrefix(StatusPending) + ent.Item.Key; idxKey != statusKey {
+		gresp, err := qu.kv.Get(ctx, statusKey, clientv3.WithKeysOnly())
+		if err != nil {
+			return false, err
+		}
+		if len(gresp.Kvs) == 0 {
+			items = nil
+		} else {
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(statusKey), "=", gresp.Kvs[0].ModRevision))
+		}
+	}
+	deleted, err := qu.releaseTxn(ctx, items, cmps, unindexOps(ent.Item, StatusPending))
+	if err != nil {
+		return false, err
+	}
+	if deleted {
+		glog.Infof("queue: deleted stale index entries of %q", ent.Item.Key)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,114 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+func TestQueueIndex(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	bucket := "index-bucket"
+	expectStatus := func(owner string, sts ...Status) {
+		t.Helper()
+		entries, err := qu.ListByOwner(ctx, owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(sts) {
+			t.Fatalf("expected %d entries, got %+v", len(sts), entries)
+		}
+		for i := range entries {
+			if entries[i].Status != sts[i] || entries[i].Item.Owner != owner {
+				t.Fatalf("#%d: expected status %q, got %+v", i, sts[i], entries[i])
+			}
+		}
+	}
+
+	item1 := CreateItem(bucket, 100, "a")
+	item1.Owner = "alice"
+	item2 := CreateItem(bucket, 100, "b")
+	item2.Owner = "alice"
+	if err = qu.AddBatch(ctx, []*Item{item1, item2}); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus("alice", StatusPending, StatusPending)
+
+	popped := <-qu.Pop(ctx, bucket)
+	if popped.Key != item1.Key {
+		t.Fatalf("expected %q, got %+v", item1.Key, popped)
+	}
+	expectStatus("alice", StatusInProgress, StatusPending)
+
+	canceled, err := qu.Cancel(ctx, item2.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus("alice", StatusInProgress, StatusCanceled)
+
+	popped.Error = "failed"
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Complete(ctx, canceled); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus("alice", StatusFailed, StatusCanceled)
+
+	items, err := qu.ListByStatus(ctx, StatusFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Key != item1.Key {
+		t.Fatalf("expected %q, got %+v", item1.Key, items)
+	}
+	if items, err = qu.ListByStatus(ctx, StatusInProgress); err != nil || len(items) != 0 {
+		t.Fatalf("expected no in-progress item, got %+v (%v)", items, err)
+	}
+
+	// purged items are removed from indexes on read
+	item3 := CreateItem(bucket, 100, "c")
+	item3.Owner = "bob"
+	if err = qu.Add(ctx, item3); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus("bob", StatusPending)
+	if _, err = qu.Purge(ctx, bucket); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus("bob")
+	if items, err = qu.ListByStatus(ctx, StatusPending); err != nil || len(items) != 0 {
+		t.Fatalf("expected no pending item, got %+v (%v)", items, err)
+	}
+
+	if _, err = qu.GCCompleted(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus("alice")
+	resp, err := qu.Client().Get(ctx, pfxIndex, clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Count != 0 {
+		t.Fatalf("expected no index entries, got %d", resp.Count)
+	}
+}
@@ -0,0 +1,144 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// Key layout accessors, for consumers of etcd keys (e.g. 'pkg/mirror',
+// or Client().Watch) not to hardcode internal prefixes. An empty bucket
+// returns the prefix of all buckets.
+
+// checkItemKey returns an error if the item key is not in its bucket,
+// since items are stored and authorized by their keys.
+func checkItemKey(item *Item) error {
+	if path.Dir(item.Key) != path.Clean(item.Bucket) {
+		return fmt.Errorf("item key %q is not in bucket %q", item.Key, item.Bucket)
+	}
+	return nil
+}
+
+// PendingKey returns the etcd key of the pending item.
+func PendingKey(itemKey string) string {
+	return path.Join(pfxQueue, itemKey)
+}
+
+// PendingPrefix returns the etcd key prefix of pending items in the bucket.
+func PendingPrefix(bucket string) string {
+	return bucketPrefix(bucket)
+}
+
+// CompletedKey returns the etcd key of the completed item.
+func CompletedKey(itemKey string) string {
+	return path.Join(pfxCompleted, itemKey)
+}
+
+// CompletedPrefix returns the etcd key prefix of completed items in the bucket.
+func CompletedPrefix(bucket string) string {
+	return completedPrefix(bucket)
+}
+
+// EventsPrefix returns the etcd key prefix of the event journal, with
+// the events of all buckets.
+func EventsPrefix() string {
+	return pfxEvents + "/"
+}
+
+func (qu *queue) Get(ctx context.Context, itemKey string) (*IndexEntry, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	ent, _, err := qu.get(ctx, itemKey)
+	return ent, err
+}
+
+// get is Get, also returning the revision of the read. Old keys of
+// migrated items are forwarded to their new keys (see 'Migrate').
+func (qu *queue) get(ctx context.Context, itemKey string) (*IndexEntry, int64, error) {
+	seen := make(map[string]bool)
+	for {
+		ent, rev, fwd, err := qu.getKey(ctx, itemKey)
+		if err != ErrItemNotFound || fwd == "" || seen[fwd] {
+			return ent, rev, err
+		}
+		seen[itemKey] = true
+		itemKey = fwd
+	}
+}
+
+// getKey returns the item of the key, or the forwarding key of the
+// migrated item with ErrItemNotFound.
+func (qu *queue) getKey(ctx context.Context, itemKey string) (*IndexEntry, int64, string, error) {
+	// popped and canceled items are only in the status index, and
+	// transferred items in their records
+	resp, err := qu.kv.Txn(ctx).Then(
+		clientv3.OpGet(PendingKey(itemKey)),
+		clientv3.OpGet(CompletedKey(itemKey)),
+		clientv3.OpGet(statusIndexPrefix(StatusInProgress)+itemKey),
+		clientv3.OpGet(statusIndexPrefix(StatusCanceled)+itemKey),
+		clientv3.OpGet(migratedKey(itemKey)),
+		clientv3.OpGet(transferredKey(itemKey)),
+	).Commit()
+	if err != nil {
+		return nil, 0, "", err
+	}
+	fwd := ""
+	for i, r := range resp.Responses {
+		kvs := r.GetResponseRange().Kvs
+		if len(kvs) == 0 {
+			continue
+		}
+		switch i {
+		case 0:
+			item, err := decodeItem(kvs[0])
+			if err != nil {
+				return nil, 0, "", err
+			}
+			return &IndexEntry{Status: StatusPending, Item: item}, resp.Header.Revision, "", nil
+		case 1:
+			item, err := decodeItem(kvs[0])
+			if err != nil {
+				return nil, 0, "", err
+			}
+			return &IndexEntry{Status: terminalStatus(item), Item: item}, resp.Header.Revision, "", nil
+		case 4:
+			fwd = string(kvs[0].Value)
+		case 5:
+			item, err := decodeItem(kvs[0])
+			if err != nil {
+				return nil, 0, "", err
+			}
+			return &IndexEntry{Status: StatusTransferred, Item: item}, resp.Header.Revision, "", nil
+		default:
+			var ent IndexEntry
+			if err = json.Unmarshal(kvs[0].Value, &ent); err != nil {
+				return nil, 0, "", fmt.Errorf("%q returned wrong JSON %q (%v)", string(kvs[0].Key), string(kvs[0].Value), err)
+			}
+			if ent.Item == nil {
+				return nil, 0, "", fmt.Errorf("%q has no item", string(kvs[0].Key))
+			}
+			// claimed items are indexed as in-progress
+			if ent.Item.Status == StatusClaimed {
+				ent.Status = StatusClaimed
+			}
+			return &ent, resp.Header.Revision, "", nil
+		}
+	}
+	return nil, resp.Header.Revision, fwd, ErrItemNotFound
+}
+
+func (qu *queue) GetCompleted(ctx context.Context, itemKey string) (*Item, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	resp, err := qu.kv.Get(ctx, CompletedKey(itemKey))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrItemNotFound
+	}
+	return decodeItem(resp.Kvs[0])
+}
@@ -0,0 +1,134 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+func TestKeys(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	item := CreateItem("my-job", 100, "data")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	// accessors return keys of stored items
+	resp, err := qu.Client().Get(ctx, PendingKey(item.Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 {
+		t.Fatalf("expected 1 key at %q, got %d", PendingKey(item.Key), len(resp.Kvs))
+	}
+	for _, pfx := range []string{PendingPrefix("my-job"), PendingPrefix("")} {
+		if !strings.HasPrefix(PendingKey(item.Key), pfx) {
+			t.Fatalf("expected %q to have prefix %q", PendingKey(item.Key), pfx)
+		}
+	}
+
+	popped := <-qu.Pop(ctx, "my-job")
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	got, err := qu.GetCompleted(ctx, item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusCompleted {
+		t.Fatalf("expected %q, got %q", StatusCompleted, got.Status)
+	}
+	if resp, err = qu.Client().Get(ctx, CompletedPrefix(""), clientv3.WithPrefix()); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Key) != CompletedKey(item.Key) {
+		t.Fatalf("expected completed key %q, got %+v", CompletedKey(item.Key), resp.Kvs)
+	}
+}
+
+func TestGet(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	expectStatus := func(item *Item, st Status) {
+		ent, err := qu.Get(ctx, item.Key)
+		if err != nil {
+			t.Fatalf("%q: %v", item.Key, err)
+		}
+		if ent.Status != st {
+			t.Fatalf("%q: expected %q, got %q", item.Key, st, ent.Status)
+		}
+		if err = item.Equal(ent.Item); err != nil {
+			t.Fatalf("%q: %v", item.Key, err)
+		}
+	}
+
+	if _, err = qu.Get(ctx, "my-job/unknown"); err != ErrItemNotFound {
+		t.Fatalf("expected %v, got %v", ErrItemNotFound, err)
+	}
+
+	item1 := CreateItem("my-job", 100, "completed")
+	item2 := CreateItem("my-job", 100, "failed")
+	item3 := CreateItem("my-job", 100, "canceled")
+	for _, item := range []*Item{item1, item2, item3} {
+		if err = qu.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+		expectStatus(item, StatusPending)
+	}
+
+	popped := <-qu.Pop(ctx, "my-job")
+	expectStatus(popped, StatusClaimed)
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(popped, StatusCompleted)
+
+	popped = <-qu.Pop(ctx, "my-job")
+	popped.Error = "out of memory"
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(popped, StatusFailed)
+
+	canceled, err := qu.Cancel(ctx, item3.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(canceled, StatusCanceled)
+}
@@ -0,0 +1,107 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// labelOp is the operator of a label requirement.
+type labelOp int
+
+const (
+	labelEquals labelOp = iota
+	labelNotEquals
+	labelExists
+	labelNotExists
+)
+
+type labelRequirement struct {
+	key   string
+	op    labelOp
+	value string
+}
+
+// Selector selects items by labels, as in Kubernetes equality-based
+// label selectors (e.g. "model=resnet,env!=dev,gpu,!canary").
+// Empty selector matches all items.
+type Selector []labelRequirement
+
+// ParseSelector parses the comma-separated label selector.
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var req labelRequirement
+		switch {
+		case strings.Contains(term, "!="):
+			kv := strings.SplitN(term, "!=", 2)
+			req = labelRequirement{key: kv[0], op: labelNotEquals, value: kv[1]}
+		case strings.Contains(term, "=="):
+			kv := strings.SplitN(term, "==", 2)
+			req = labelRequirement{key: kv[0], op: labelEquals, value: kv[1]}
+		case strings.Contains(term, "="):
+			kv := strings.SplitN(term, "=", 2)
+			req = labelRequirement{key: kv[0], op: labelEquals, value: kv[1]}
+		case strings.HasPrefix(term, "!"):
+			req = labelRequirement{key: term[1:], op: labelNotExists}
+		default:
+			req = labelRequirement{key: term, op: labelExists}
+		}
+		req.key, req.value = strings.TrimSpace(req.key), strings.TrimSpace(req.value)
+		if req.key == "" || strings.ContainsAny(req.key, "=! ") || strings.ContainsAny(req.value, "=! ") {
+			return nil, fmt.Errorf("invalid label selector term %q", term)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// Matches returns true if the labels satisfy all requirements.
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, req := range sel {
+		v, ok := labels[req.key]
+		switch req.op {
+		case labelEquals:
+			if !ok || v != req.value {
+				return false
+			}
+		case labelNotEquals:
+			if ok && v == req.value {
+				return false
+			}
+		case labelExists:
+			if !ok {
+				return false
+			}
+		case labelNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (qu *queue) ListSelector(ctx context.Context, bucket, selector string, opts ...OpOption) ([]*Item, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	items, err := qu.List(ctx, bucket, opts...)
+	if err != nil {
+		return nil, err
+	}
+	matched := items[:0]
+	for _, item := range items {
+		if sel.Matches(item.Labels) {
+			matched = append(matched, item)
+		}
+	}
+	return matched, nil
+}
@@ -0,0 +1,91 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSelector(t *testing.T) {
+	labels := map[string]string{"model": "resnet", "env": "prod"}
+	tests := []struct {
+		selector string
+		matches  bool
+	}{
+		{"", true},
+		{"model=resnet", true},
+		{"model==resnet,env=prod", true},
+		{"model=resnet,env=dev", false},
+		{"env!=dev", true},
+		{"env!=prod", false},
+		{"model", true},
+		{"gpu", false},
+		{"!gpu", true},
+		{"!model", false},
+	}
+	for i, tt := range tests {
+		sel, err := ParseSelector(tt.selector)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if m := sel.Matches(labels); m != tt.matches {
+			t.Fatalf("#%d: %q expected %v, got %v", i, tt.selector, tt.matches, m)
+		}
+	}
+
+	for _, s := range []string{"=prod", "a=b=c", "a b"} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Fatalf("expected error on %q", s)
+		}
+	}
+}
+
+func TestQueueListSelector(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	bucket := "label-bucket"
+	item1 := CreateItem(bucket, 100, "a")
+	item1.Labels = map[string]string{"model": "resnet", "env": "prod"}
+	item2 := CreateItem(bucket, 100, "b")
+	item2.Labels = map[string]string{"model": "resnet", "env": "dev"}
+	item3 := CreateItem(bucket, 100, "c")
+	for _, item := range []*Item{item1, item2, item3} {
+		if err = qu.Add(context.Background(), item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := qu.ListSelector(context.Background(), bucket, "model=resnet,env=prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected 1 item, got %+v", items)
+	}
+	if err = item1.Equal(items[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err = qu.ListSelector(context.Background(), bucket, "!model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Key != item3.Key {
+		t.Fatalf("expected %q, got %+v", item3.Key, items)
+	}
+}
@@ -0,0 +1,140 @@
+package etcdqueue
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrQueueClosed is returned by operations after Stop, without
+// sending requests to etcd.
+var ErrQueueClosed = errors.New("queue: queue closed")
+
+// lifecycle is the running state of the queue. Stop rejects new
+// operations with ErrQueueClosed, and waits for background goroutines
+// to exit. Methods are no-ops on <nil> (e.g. queues built in tests).
+type lifecycle struct {
+	mu      sync.RWMutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// err returns ErrQueueClosed if the queue has been stopped.
+func (l *lifecycle) err() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.stopped {
+		return ErrQueueClosed
+	}
+	return nil
+}
+
+// add registers a background goroutine to be waited by Stop.
+// It returns false if the queue has been stopped.
+func (l *lifecycle) add() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.stopped {
+		return false
+	}
+	l.wg.Add(1)
+	return true
+}
+
+// done unregisters the goroutine registered by add.
+func (l *lifecycle) done() {
+	if l != nil {
+		l.wg.Done()
+	}
+}
+
+// stop rejects new operations and goroutines. It returns false if
+// the queue has already been stopped.
+func (l *lifecycle) stop() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return false
+	}
+	l.stopped = true
+	return true
+}
+
+// wait waits for registered goroutines to exit, after stop.
+func (l *lifecycle) wait() {
+	if l != nil {
+		l.wg.Wait()
+	}
+}
+
+// goBackground runs f on a goroutine waited by Stop, recovering from
+// its panic (see 'recoverPanic'). It returns false, without running f,
+// if the queue has been stopped.
+func (qu *queue) goBackground(goroutine, key string, f func()) bool {
+	if !qu.lc.add() {
+		return false
+	}
+	go func() {
+		defer qu.lc.done()
+		defer qu.recoverPanic(goroutine, key, nil)
+		f()
+	}()
+	return true
+}
+
+// stopped returns the channel closed on Stop, so that background
+// goroutines blocked on consumers exit before Stop returns. It is <nil>
+// for queues built in tests.
+func (qu *queue) stopped() <-chan struct{} {
+	if qu.rootCtx == nil {
+		return nil
+	}
+	return qu.rootCtx.Done()
+}
+
+// goBackgroundOf is goBackground of the queue, including the queues of
+// NewACLQueue and NewEmbeddedQueue, for goroutines over Queue interfaces
+// (e.g. TypedQueue), with the channel closed on Stop. Goroutines of
+// other Queue implementations, or after Stop, are not waited.
+func goBackgroundOf(qu Queue, goroutine, key string, f func(stopc <-chan struct{})) {
+	switch q := qu.(type) {
+	case *queue:
+		if q.goBackground(goroutine, key, func() { f(q.stopped()) }) {
+			return
+		}
+	case *readOnlyQueue:
+		goBackgroundOf(q.queue, goroutine, key, f)
+		return
+	case *aclQueue:
+		goBackgroundOf(q.Queue, goroutine, key, f)
+		return
+	case *embeddedQueue:
+		goBackgroundOf(q.Queue, goroutine, key, f)
+		return
+	}
+	go f(nil)
+}
+
+// closedWatcher returns the closed watcher with ErrQueueClosed.
+func closedWatcher(bucket string) ItemWatcher {
+	ch := make(chan *Item, 1)
+	ch <- &Item{Bucket: bucket, Error: ErrQueueClosed.Error()}
+	close(ch)
+	return ch
+}
+
+// closedEventWatcher returns the closed event watcher with the error.
+func closedEventWatcher(bucket string, err error) EventWatcher {
+	ch := make(chan *Event, 1)
+	ch <- &Event{Bucket: bucket, Error: err.Error()}
+	close(ch)
+	return ch
+}
@@ -0,0 +1,173 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStop(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// watchers are not drained by their consumers
+	ctx := context.Background()
+	item := CreateItem("my-job", 100, "data")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	qu.Watch(ctx, "my-job")
+	qu.WatchFront(ctx, "my-job")
+	qu.WatchBucket(ctx, "my-job")
+	qu.WatchItem(ctx, item.Key)
+	qu.Enqueue(ctx, CreateItem("my-job", 100, "data"))
+	for i := 0; i < 200; i++ {
+		if err = qu.Add(ctx, CreateItem("my-job", 100, "data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = qu.Front(ctx, "my-job"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.BucketConfig(ctx, "my-job"); err != nil {
+		t.Fatal(err)
+	}
+
+	donec := make(chan struct{})
+	go func() {
+		qu.Stop()
+		close(donec)
+	}()
+	select {
+	case <-donec:
+	case <-time.After(10 * time.Second):
+		t.Fatal("took too long to stop")
+	}
+	if n := qu.Watchers().Goroutines; n != 0 {
+		t.Fatalf("expected no watch goroutine after Stop, got %d", n)
+	}
+
+	// operations after Stop fail fast
+	if err = qu.Add(ctx, CreateItem("my-job", 100, "data")); err != ErrQueueClosed {
+		t.Fatalf("expected %v, got %v", ErrQueueClosed, err)
+	}
+	if _, err = qu.Get(ctx, item.Key); err != ErrQueueClosed {
+		t.Fatalf("expected %v, got %v", ErrQueueClosed, err)
+	}
+	for i, w := range []ItemWatcher{
+		qu.Enqueue(ctx, CreateItem("my-job", 100, "data")),
+		qu.Pop(ctx, "my-job"),
+		qu.WatchItem(ctx, item.Key),
+	} {
+		select {
+		case it := <-w:
+			if it.Err() != ErrQueueClosed {
+				t.Fatalf("#%d: expected %v, got %+v", i, ErrQueueClosed, it)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("#%d: took too long to fail", i)
+		}
+	}
+	for i, w := range []EventWatcher{
+		qu.Watch(ctx, "my-job"),
+		qu.WatchFront(ctx, "my-job"),
+		qu.WatchBucket(ctx, "my-job"),
+	} {
+		if ev := <-w; ev.Error != ErrQueueClosed.Error() {
+			t.Fatalf("#%d: expected %v, got %+v", i, ErrQueueClosed, ev)
+		}
+	}
+
+	// Stop is idempotent
+	qu.Stop()
+}
+
+func TestStopWaitsGoroutines(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	item := CreateItem("my-job", 100, "data")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	h, err := qu.FanOut(ctx, "shards", []*Item{CreateItem("shards", 100, "data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var called int32
+	h.OnComplete(ctx, func(items []*Item, err error) {
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&called, 1)
+	})
+
+	// watchers are not drained by their consumers, and their contexts
+	// are never done
+	window := WithNotifyWindow(time.Hour)
+	iws := []ItemWatcher{
+		qu.Pop(ctx, "empty"),
+		qu.PopBackfill(ctx, BackfillConfig{Bucket: "empty", PollInterval: time.Hour}),
+		qu.WatchPreempt(ctx, item),
+		qu.WatchItem(ctx, item.Key, window),
+	}
+	ews := []EventWatcher{
+		qu.Watch(ctx, "my-job", window),
+		qu.WatchFront(ctx, "my-job"),
+		qu.WatchBucket(ctx, "my-job"),
+	}
+	for i := 0; i < 10; i++ {
+		if err = qu.Add(ctx, CreateItem("my-job", 100, "data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	qu.Stop()
+
+	// all goroutines have exited, closing their channels
+	if atomic.LoadInt32(&called) != 1 {
+		t.Fatal("expected OnComplete to return before Stop")
+	}
+	for i, w := range iws {
+		for open := true; open; {
+			select {
+			case _, open = <-w:
+			default:
+				t.Fatalf("#%d: item watcher still open after Stop", i)
+			}
+		}
+	}
+	for i, w := range ews {
+		for open := true; open; {
+			select {
+			case _, open = <-w:
+			default:
+				t.Fatalf("#%d: event watcher still open after Stop", i)
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultMaxValueBytes is the default 'Limits.MaxValueBytes'. Items are
+// written with their events and index entries in one transaction, so it
+// leaves room below etcd's default '--max-request-bytes' of 1.5 MiB.
+const DefaultMaxValueBytes = 256 * 1024
+
+// DefaultRequestTimeout is the default 'Limits.RequestTimeout'.
+const DefaultRequestTimeout = 30 * time.Second
+
+// Limits are the request limits of a queue instance.
+type Limits struct {
+	// MaxValueBytes is the maximum size of item values, checked by Add,
+	// AddBatch and Enqueue. Zero disables the check.
+	MaxValueBytes int
+
+	// RequestTimeout is the timeout of each operation (e.g. Add), with
+	// all its etcd requests and their retries, when the context has no
+	// deadline (e.g. context.Background), so that operations do not hang
+	// forever when etcd is unreachable. Watches, Lock, Migrate and
+	// Transfer are not affected. Zero disables the timeout.
+	RequestTimeout time.Duration
+}
+
+// DefaultLimits returns the limits of new queues.
+func DefaultLimits() Limits {
+	return Limits{MaxValueBytes: DefaultMaxValueBytes, RequestTimeout: DefaultRequestTimeout}
+}
+
+// Validate returns an error if any limit is negative.
+func (l Limits) Validate() error {
+	if l.MaxValueBytes < 0 || l.RequestTimeout < 0 {
+		return fmt.Errorf("invalid negative value in limits %+v", l)
+	}
+	return nil
+}
+
+func (qu *queue) SetLimits(l Limits) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	qu.limitsmu.Lock()
+	qu.limits = l
+	qu.limitsmu.Unlock()
+	return nil
+}
+
+func (qu *queue) getLimits() Limits {
+	qu.limitsmu.RLock()
+	l := qu.limits
+	qu.limitsmu.RUnlock()
+	return l
+}
+
+// withTimeout returns the context with 'Limits.RequestTimeout', if it
+// has no deadline. Operations call it once on entry, so that nested
+// operations and retries share the timeout.
+func (qu *queue) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := qu.getLimits().RequestTimeout
+	if _, ok := ctx.Deadline(); ok || timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,136 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// MaxLineageDepth is the maximum number of ancestors walked by Lineage,
+// to bound reads of long (or corrupted) chains.
+var MaxLineageDepth = 64
+
+const pfxLineage = "_lineage"
+
+// childrenPrefix returns the prefix of the child links of the item key.
+func childrenPrefix(itemKey string) string {
+	return path.Join(pfxLineage, itemKey) + "/"
+}
+
+// lineageOps returns the operations to link the item to its parent,
+// written in the same transaction as the item.
+func lineageOps(item *Item) []clientv3.Op {
+	if item.ParentKey == "" {
+		return nil
+	}
+	return []clientv3.Op{clientv3.OpPut(childrenPrefix(item.ParentKey)+item.Key, item.Key)}
+}
+
+// unlinkOps returns the operations to remove the links (and progress, see
+// 'UpdateProgress') of the deleted item. Its children keep 'ParentKey',
+// and Lineage stops at the missing parent.
+func unlinkOps(item *Item) []clientv3.Op {
+	ops := []clientv3.Op{
+		clientv3.OpDelete(childrenPrefix(item.Key), clientv3.WithPrefix()),
+		clientv3.OpDelete(childProgressPrefix(item.Key), clientv3.WithPrefix()),
+	}
+	if item.ParentKey != "" {
+		ops = append(ops,
+			clientv3.OpDelete(childrenPrefix(item.ParentKey)+item.Key),
+			clientv3.OpDelete(childProgressPrefix(item.ParentKey)+item.Key),
+		)
+	}
+	return ops
+}
+
+// checkParents returns ErrItemNotFound if the parent of any item does
+// not exist, unless the parent is in the same batch.
+func (qu *queue) checkParents(ctx context.Context, items ...*Item) error {
+	keys := make(map[string]bool, len(items))
+	for _, item := range items {
+		keys[item.Key] = true
+	}
+	for _, item := range items {
+		if item.ParentKey == "" || keys[item.ParentKey] {
+			continue
+		}
+		if item.ParentKey == item.Key {
+			return fmt.Errorf("%q cannot be its own parent", item.Key)
+		}
+		if _, err := qu.Get(ctx, item.ParentKey); err != nil {
+			if err == ErrItemNotFound {
+				return fmt.Errorf("parent %q of %q not found", item.ParentKey, item.Key)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// LineageNode is an item in the lineage graph, with its child items.
+type LineageNode struct {
+	Status   Status         `json:"status"`
+	Item     *Item          `json:"item"`
+	Children []*LineageNode `json:"children,omitempty"`
+}
+
+func (qu *queue) Lineage(ctx context.Context, itemKey string) (*LineageNode, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	ent, err := qu.Get(ctx, itemKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// walk up to the oldest existing ancestor
+	seen := map[string]bool{ent.Item.Key: true}
+	for depth := 0; ent.Item.ParentKey != "" && depth < MaxLineageDepth; depth++ {
+		if seen[ent.Item.ParentKey] {
+			return nil, fmt.Errorf("lineage of %q has a cycle at %q", itemKey, ent.Item.ParentKey)
+		}
+		parent, err := qu.Get(ctx, ent.Item.ParentKey)
+		if err == ErrItemNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		seen[parent.Item.Key] = true
+		ent = parent
+	}
+
+	root := &LineageNode{Status: ent.Status, Item: ent.Item}
+	visited := map[string]bool{ent.Item.Key: true}
+	nodes := []*LineageNode{root}
+	for len(nodes) > 0 {
+		node := nodes[0]
+		nodes = nodes[1:]
+		resp, err := qu.kv.Get(ctx, childrenPrefix(node.Item.Key), clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+		if err != nil {
+			return nil, err
+		}
+		node.Item.ChildKeys = make([]string, 0, len(resp.Kvs))
+		for _, kv := range resp.Kvs {
+			childKey := string(kv.Value)
+			node.Item.ChildKeys = append(node.Item.ChildKeys, childKey)
+			if visited[childKey] {
+				continue
+			}
+			visited[childKey] = true
+			child, err := qu.Get(ctx, childKey)
+			if err == ErrItemNotFound {
+				// deleted by TTL, without unlinking
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			cn := &LineageNode{Status: child.Status, Item: child.Item}
+			node.Children = append(node.Children, cn)
+			nodes = append(nodes, cn)
+		}
+	}
+	return root, nil
+}
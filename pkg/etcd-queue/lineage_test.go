@@ -0,0 +1,85 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLineage(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	train := CreateItem("train", 100, "resnet")
+	if err = qu.Add(ctx, train); err != nil {
+		t.Fatal(err)
+	}
+	orphan := CreateItem("eval", 100, "orphan")
+	orphan.ParentKey = "train/missing"
+	if err = qu.Add(ctx, orphan); err == nil {
+		t.Fatal("expected missing parent error")
+	}
+
+	eval1, eval2 := CreateItem("eval", 100, "top-1"), CreateItem("eval", 100, "top-5")
+	eval1.ParentKey, eval2.ParentKey = train.Key, train.Key
+	report := CreateItem("report", 100, "summary")
+	report.ParentKey = eval1.Key
+	if err = qu.AddBatch(ctx, []*Item{eval1, eval2, report}); err != nil {
+		t.Fatal(err)
+	}
+
+	// lineage of any item returns the whole graph from the root
+	root, err := qu.Lineage(ctx, report.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Item.Key != train.Key || len(root.Item.ChildKeys) != 2 || len(root.Children) != 2 {
+		t.Fatalf("unexpected root %+v", root)
+	}
+	var evalNode *LineageNode
+	for _, c := range root.Children {
+		if c.Item.Key == eval1.Key {
+			evalNode = c
+		}
+	}
+	if evalNode == nil || len(evalNode.Children) != 1 || evalNode.Children[0].Item.Key != report.Key {
+		t.Fatalf("unexpected children %+v", root.Children)
+	}
+
+	// deleted parents are unlinked, and lineage starts at the child
+	popped := <-qu.Pop(ctx, "train")
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	if root, err = qu.Lineage(ctx, eval2.Key); err != nil {
+		t.Fatal(err)
+	}
+	if root.Status != StatusCompleted || len(root.Children) != 2 {
+		t.Fatalf("unexpected root %+v", root)
+	}
+	if _, err = qu.DeleteCompleted(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	if root, err = qu.Lineage(ctx, report.Key); err != nil {
+		t.Fatal(err)
+	}
+	if root.Item.Key != eval1.Key || len(root.Children) != 1 {
+		t.Fatalf("unexpected root %+v", root)
+	}
+}
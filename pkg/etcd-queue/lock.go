@@ -0,0 +1,57 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/coreos/etcd/clientv3/concurrency"
+)
+
+const pfxLock = "_lock"
+
+// LockTTL is the lease TTL of locks in seconds. If the lock holder
+// crashes, the lock is released after the TTL.
+var LockTTL = 30
+
+// Mutex is a distributed lock acquired by Lock.
+type Mutex struct {
+	name string
+	sess *concurrency.Session
+	mu   *concurrency.Mutex
+}
+
+func (qu *queue) Lock(ctx context.Context, name string) (*Mutex, error) {
+	if name == "" {
+		return nil, fmt.Errorf("empty lock name")
+	}
+	sess, err := concurrency.NewSession(qu.cli, concurrency.WithTTL(LockTTL), concurrency.WithContext(qu.rootCtx))
+	if err != nil {
+		return nil, err
+	}
+	mu := concurrency.NewMutex(sess, path.Join(pfxLock, name))
+	if err = mu.Lock(ctx); err != nil {
+		sess.Close()
+		return nil, fmt.Errorf("failed to lock %q (%v)", name, err)
+	}
+	return &Mutex{name: name, sess: sess, mu: mu}, nil
+}
+
+// Name returns the lock name.
+func (m *Mutex) Name() string { return m.name }
+
+// Done returns the channel closed when the lock lease expires
+// (e.g. network partition), after which the lock is no longer held.
+func (m *Mutex) Done() <-chan struct{} { return m.sess.Done() }
+
+// Unlock releases the lock, and revokes its lease.
+func (m *Mutex) Unlock(ctx context.Context) error {
+	err := m.mu.Unlock(ctx)
+	if cerr := m.sess.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to unlock %q (%v)", m.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	m1, err := qu.Lock(context.Background(), "gpu-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lock of other name is not blocked
+	m2, err := qu.Lock(context.Background(), "gpu-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m2.Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	_, err = qu.Lock(ctx, "gpu-0")
+	cancel()
+	if err == nil {
+		t.Fatal("expected error while 'gpu-0' is locked")
+	}
+
+	lockc := make(chan *Mutex, 1)
+	go func() {
+		m, err := qu.Lock(context.Background(), "gpu-0")
+		if err != nil {
+			t.Error(err)
+		}
+		lockc <- m
+	}()
+	select {
+	case <-lockc:
+		t.Fatal("unexpected lock of 'gpu-0'")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	if err = m1.Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-lockc:
+		if m == nil {
+			t.Fatal("expected lock of 'gpu-0'")
+		}
+		if err = m.Unlock(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected lock of 'gpu-0' after unlock")
+	}
+}
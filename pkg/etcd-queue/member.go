@@ -0,0 +1,176 @@
+package etcdqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/golang/glog"
+)
+
+var (
+	// ErrClusterUnhealthy is returned by AddMember and RemoveMember when
+	// the membership change could lose the quorum (e.g. an added member
+	// has not started yet, or the cluster does not serve quorum reads).
+	ErrClusterUnhealthy = errors.New("queue: cluster is unhealthy")
+
+	// ErrLearnerUnsupported is returned by PromoteLearner, since etcd
+	// before v3.4 has no learner members. Members are added as voting
+	// members, and should be started right after AddMember.
+	ErrLearnerUnsupported = errors.New("queue: learner members require etcd v3.4")
+)
+
+// MemberHealthTimeout is the timeout of quorum reads by health checks.
+var MemberHealthTimeout = 5 * time.Second
+
+// Member is an etcd cluster member. Added members have no name until
+// they start.
+type Member struct {
+	ID         uint64   `json:"id"`
+	Name       string   `json:"name"`
+	PeerURLs   []string `json:"peer_urls"`
+	ClientURLs []string `json:"client_urls"`
+}
+
+// Started returns true if the member has joined the cluster.
+func (m *Member) Started() bool { return m.Name != "" }
+
+// Members returns the members of the etcd cluster of the queue.
+func Members(ctx context.Context, qu Queue) ([]*Member, error) {
+	resp, err := clientOf(qu).MemberList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]*Member, 0, len(resp.Members))
+	for _, m := range resp.Members {
+		ms = append(ms, &Member{ID: m.ID, Name: m.Name, PeerURLs: m.PeerURLs, ClientURLs: m.ClientURLs})
+	}
+	return ms, nil
+}
+
+// CheckHealth returns ErrClusterUnhealthy if any member has not started,
+// or the cluster does not serve quorum reads.
+func CheckHealth(ctx context.Context, qu Queue) error {
+	ms, err := Members(ctx, qu)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		if !m.Started() {
+			return fmt.Errorf("%v (member %x at %v has not started)", ErrClusterUnhealthy, m.ID, m.PeerURLs)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, MemberHealthTimeout)
+	defer cancel()
+	if _, err = clientOf(qu).Get(ctx, "health"); err != nil {
+		return fmt.Errorf("%v (quorum read failed: %v)", ErrClusterUnhealthy, err)
+	}
+	return nil
+}
+
+// WaitHealthy waits until CheckHealth succeeds (e.g. after the member
+// added by AddMember has started), or the context is done.
+func WaitHealthy(ctx context.Context, qu Queue) error {
+	for {
+		err := CheckHealth(ctx, qu)
+		if err == nil {
+			return nil
+		}
+		glog.V(2).Infof("queue: waiting for healthy cluster (%v)", err)
+		select {
+		case <-DefaultClock.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			return fmt.Errorf("%v (%v)", err, ctx.Err())
+		}
+	}
+}
+
+// AddMember adds the member of the name and peer URL to the healthy
+// cluster of the queue, and returns the initial cluster to start it with
+// (see 'JoinEmbeddedQueue'). Members are added one at a time: the quorum
+// includes the new member until it starts, so another member cannot be
+// added before (see 'WaitHealthy').
+func AddMember(ctx context.Context, qu Queue, name, peerURL string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "=,") {
+		return "", fmt.Errorf("invalid member name %q", name)
+	}
+	if err := CheckHealth(ctx, qu); err != nil {
+		return "", err
+	}
+	resp, err := clientOf(qu).MemberAdd(ctx, []string{peerURL})
+	if err != nil {
+		return "", err
+	}
+	glog.Infof("queue: added member %x %q at %q", resp.Member.ID, name, peerURL)
+
+	// the added member has no name until it starts
+	var urls []string
+	for _, m := range resp.Members {
+		n := m.Name
+		if m.ID == resp.Member.ID {
+			n = name
+		}
+		for _, u := range m.PeerURLs {
+			urls = append(urls, n+"="+u)
+		}
+	}
+	sort.Strings(urls)
+	return strings.Join(urls, ","), nil
+}
+
+// RemoveMember removes the member from the cluster of the queue. Members
+// that have not started are always removed (e.g. to undo AddMember).
+// Started members are only removed from healthy clusters of more than
+// one member, so that the remaining members keep the quorum.
+func RemoveMember(ctx context.Context, qu Queue, id uint64) error {
+	ms, err := Members(ctx, qu)
+	if err != nil {
+		return err
+	}
+	var target *Member
+	for _, m := range ms {
+		if m.ID == id {
+			target = m
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("member %x not found", id)
+	}
+	if target.Started() {
+		if len(ms) == 1 {
+			return fmt.Errorf("cannot remove the last member %x", id)
+		}
+		if err = CheckHealth(ctx, qu); err != nil {
+			return err
+		}
+	}
+	for {
+		_, err = clientOf(qu).MemberRemove(ctx, id)
+		if rpctypes.Error(err) != rpctypes.ErrUnhealthy {
+			break
+		}
+		// etcd rejects removals until the remaining members have been
+		// connected for its health interval (e.g. just after AddMember)
+		glog.V(2).Infof("queue: waiting to remove member %x (%v)", id, err)
+		select {
+		case <-DefaultClock.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			return fmt.Errorf("%v (%v)", err, ctx.Err())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	glog.Infof("queue: removed member %x %q", id, target.Name)
+	return nil
+}
+
+// PromoteLearner promotes the learner member to a voting member. It
+// returns ErrLearnerUnsupported, until etcd is upgraded to v3.4.
+func PromoteLearner(ctx context.Context, qu Queue, id uint64) error {
+	return ErrLearnerUnsupported
+}
@@ -0,0 +1,104 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMembers(t *testing.T) {
+	var ports []int
+	for i := 0; i < 2; i++ {
+		cport := int(atomic.LoadInt32(&basePort))
+		atomic.StoreInt32(&basePort, int32(cport)+2)
+		ports = append(ports, cport)
+	}
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), ports[0], ports[0]+1, dataDir+"/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	ms, err := Members(ctx, qu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 1 || !ms[0].Started() {
+		t.Fatalf("expected one started member, got %+v", ms)
+	}
+	if err = RemoveMember(ctx, qu, ms[0].ID); err == nil {
+		t.Fatal("expected error on removing the last member")
+	}
+	if err = PromoteLearner(ctx, qu, ms[0].ID); err != ErrLearnerUnsupported {
+		t.Fatalf("expected %v, got %v", ErrLearnerUnsupported, err)
+	}
+
+	peerURL := fmt.Sprintf("http://localhost:%d", ports[1]+1)
+	initial, err := AddMember(ctx, qu, "etcd-queue-2", peerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(initial, "etcd-queue-2="+peerURL) || !strings.Contains(initial, "etcd-queue=") {
+		t.Fatalf("unexpected initial cluster %q", initial)
+	}
+	// the added member is in the quorum until it starts
+	if _, err = AddMember(ctx, qu, "etcd-queue-3", "http://localhost:1"); err == nil || !strings.Contains(err.Error(), ErrClusterUnhealthy.Error()) {
+		t.Fatalf("expected %v, got %v", ErrClusterUnhealthy, err)
+	}
+
+	qu2, err := JoinEmbeddedQueue(ctx, "etcd-queue-2", ports[1], ports[1]+1, dataDir+"/2", initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu2.Stop()
+	if err = WaitHealthy(ctx, qu); err != nil {
+		t.Fatal(err)
+	}
+
+	// data is replicated to the new member
+	item := CreateItem("members", 100, "value")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	ent, err := qu2.Get(ctx, item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = item.Equal(ent.Item); err != nil {
+		t.Fatal(err)
+	}
+
+	if ms, err = Members(ctx, qu); err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 {
+		t.Fatalf("expected two members, got %+v", ms)
+	}
+	for _, m := range ms {
+		if m.Name == "etcd-queue-2" {
+			if err = RemoveMember(ctx, qu, m.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if ms, err = Members(ctx, qu); err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 1 || ms[0].Name != "etcd-queue" {
+		t.Fatalf("expected the first member, got %+v", ms)
+	}
+}
@@ -0,0 +1,167 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// Layout encodes the keys of items in their buckets, from the weights
+// and creation times of items. Keys sort in the order of Pop.
+type Layout interface {
+	// Encode returns the item key.
+	Encode(bucket string, weight uint64, createdAt time.Time) string
+
+	// Decode returns the weight of the item key, or false if the key
+	// is not encoded in the layout.
+	Decode(itemKey string) (uint64, bool)
+}
+
+// DefaultLayout is the layout of keys created by 'CreateItem'. It is
+// replaced before migrating existing keys to a new layout (see
+// 'Migrate'), so that new items are created in the new layout.
+var DefaultLayout Layout = weightLayout{}
+
+// weightLayout encodes 5-digit inverted weights, followed by
+// hex-encoded creation times in unix nano seconds.
+type weightLayout struct{}
+
+func (weightLayout) Encode(bucket string, weight uint64, createdAt time.Time) string {
+	if weight > MaxWeight {
+		weight = MaxWeight
+	}
+	// maximum weight comes first, lexicographically
+	priority := 99999 - weight
+	return path.Join(bucket, fmt.Sprintf("%05d%035X", priority, createdAt.UnixNano()))
+}
+
+func (weightLayout) Decode(itemKey string) (uint64, bool) {
+	id := path.Base(itemKey)
+	if len(id) != 40 {
+		return 0, false
+	}
+	if _, err := strconv.ParseUint(id[5:], 16, 64); err != nil {
+		return 0, false
+	}
+	priority, err := strconv.ParseUint(id[:5], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return 99999 - priority, true
+}
+
+// MigrateBatch is the number of items rewritten by each transaction of
+// Migrate, under the limit of operations per etcd transaction.
+var MigrateBatch = 10
+
+// pfxMigrated is the prefix of forwarding keys, mapping the old keys
+// of migrated items to their new keys:
+//
+//	_migrated/<old-item-key> = <new-item-key>
+const pfxMigrated = "_migrated"
+
+func migratedKey(itemKey string) string {
+	return path.Join(pfxMigrated, itemKey)
+}
+
+func (qu *queue) Migrate(ctx context.Context, from, to Layout) (int, error) {
+	cursor := pfxQueue + "/"
+	end := clientv3.GetPrefixRangeEnd(cursor)
+	migrated := 0
+	for {
+		resp, err := qu.kv.Get(ctx, cursor,
+			clientv3.WithRange(end),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+			clientv3.WithLimit(int64(MigrateBatch)),
+		)
+		if err != nil {
+			return migrated, err
+		}
+		if len(resp.Kvs) == 0 {
+			glog.Infof("queue: migrated %d items", migrated)
+			return migrated, nil
+		}
+
+		var cmps []clientv3.Cmp
+		var ops []clientv3.Op
+		n := 0
+		for _, kv := range resp.Kvs {
+			item, err := decodeItem(kv)
+			if err != nil {
+				return migrated, err
+			}
+			weight, ok := from.Decode(item.Key)
+			if !ok {
+				continue
+			}
+			newKey := to.Encode(item.Bucket, weight, item.CreatedAt)
+			if newKey == item.Key {
+				continue
+			}
+			cmp, iops, err := migrateOps(kv.ModRevision, kv.Lease, item, newKey)
+			if err != nil {
+				return migrated, err
+			}
+			cmps = append(cmps, cmp...)
+			ops = append(ops, iops...)
+			n++
+		}
+
+		if n > 0 {
+			// rewritten items move under the writes of other clients,
+			// that are retried by reading the batch again
+			qu.writemu.Lock()
+			tresp, err := qu.kv.Txn(ctx).If(cmps...).Then(ops...).Commit()
+			qu.writemu.Unlock()
+			if err != nil {
+				return migrated, err
+			}
+			if !tresp.Succeeded {
+				glog.V(2).Infof("queue: retrying migration of %d items from %q", n, cursor)
+				continue
+			}
+			migrated += n
+			glog.V(2).Infof("queue: migrated %d items from %q", n, cursor)
+		}
+		// new keys may sort after the cursor, and are skipped when read
+		cursor = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// migrateOps returns the conditions and operations to move the pending
+// item to the new key, with its lease, indexes, idempotency key, and the
+// forwarding key from the old key. The item is updated with the new key.
+func migrateOps(rev, lease int64, item *Item, newKey string) ([]clientv3.Cmp, []clientv3.Op, error) {
+	oldKey := item.Key
+	unindex := unindexOps(item, StatusPending)
+
+	item.Key = newKey
+	data, err := marshalItem(item)
+	if err != nil {
+		return nil, nil, err
+	}
+	var opts []clientv3.OpOption
+	if lease != 0 {
+		opts = append(opts, clientv3.WithLease(clientv3.LeaseID(lease)))
+	}
+
+	cmps := []clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(PendingKey(oldKey)), "=", rev),
+		clientv3.Compare(clientv3.CreateRevision(PendingKey(newKey)), "=", 0),
+	}
+	ops := append(unindex,
+		clientv3.OpDelete(PendingKey(oldKey)),
+		clientv3.OpPut(PendingKey(newKey), string(data), opts...),
+		clientv3.OpPut(migratedKey(oldKey), newKey, opts...),
+	)
+	ops = append(ops, indexOps(item, data, StatusPending)...)
+	if item.IdempotencyKey != "" {
+		ops = append(ops, clientv3.OpPut(idempotencyKey(item), newKey, opts...))
+	}
+	return cmps, ops, nil
+}
@@ -0,0 +1,143 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dashLayout separates inverted weights and creation times with a dash.
+type dashLayout struct{}
+
+func (dashLayout) Encode(bucket string, weight uint64, createdAt time.Time) string {
+	return path.Join(bucket, fmt.Sprintf("%05d-%020d", 99999-weight, createdAt.UnixNano()))
+}
+
+func (dashLayout) Decode(itemKey string) (uint64, bool) {
+	id := path.Base(itemKey)
+	if len(id) != 26 || id[5] != '-' {
+		return 0, false
+	}
+	priority, err := strconv.ParseUint(id[:5], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return 99999 - priority, true
+}
+
+func TestWeightLayout(t *testing.T) {
+	item := CreateItem("my-job", 300, "data")
+	weight, ok := DefaultLayout.Decode(item.Key)
+	if !ok || weight != 300 {
+		t.Fatalf("expected weight 300, got %d (%v)", weight, ok)
+	}
+	if key := DefaultLayout.Encode(item.Bucket, weight, item.CreatedAt); key != item.Key {
+		t.Fatalf("expected %q, got %q", item.Key, key)
+	}
+	if _, ok = DefaultLayout.Decode(dashLayout{}.Encode("my-job", 300, item.CreatedAt)); ok {
+		t.Fatal("expected the dash layout not decoded")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	var items []*Item
+	for i := 0; i < 25; i++ {
+		bucket := "my-job"
+		if i%2 == 1 {
+			bucket = "other-job"
+		}
+		item := CreateItem(bucket, uint64(100+i%3), fmt.Sprintf("%d", i))
+		if i == 0 {
+			item.Owner = "alice"
+			item.IdempotencyKey = "req-1"
+		}
+		if err = qu.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	before, err := qu.List(ctx, "my-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := qu.Migrate(ctx, DefaultLayout, dashLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(items) {
+		t.Fatalf("expected %d migrated items, got %d", len(items), n)
+	}
+
+	// rewritten keys keep the order of items
+	after, err := qu.List(ctx, "my-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("expected %d items, got %d", len(before), len(after))
+	}
+	for i := range after {
+		if after[i].Value != before[i].Value {
+			t.Fatalf("#%d: expected %q, got %q", i, before[i].Value, after[i].Value)
+		}
+		if _, ok := (dashLayout{}).Decode(after[i].Key); !ok {
+			t.Fatalf("#%d: expected key in the new layout, got %q", i, after[i].Key)
+		}
+	}
+
+	// old keys are forwarded to new keys
+	ent, err := qu.Get(ctx, items[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.Status != StatusPending || ent.Item.Value != "0" || !strings.HasPrefix(path.Base(ent.Item.Key), "99899-") {
+		t.Fatalf("unexpected entry %+v", ent.Item)
+	}
+	if _, err = qu.Get(ctx, ent.Item.Key); err != nil {
+		t.Fatal(err)
+	}
+	owned, err := qu.ListByOwner(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owned) != 1 || owned[0].Item.Key != ent.Item.Key {
+		t.Fatalf("expected owner index of %q, got %+v", ent.Item.Key, owned)
+	}
+	dup := CreateItem("my-job", 100, "0")
+	dup.IdempotencyKey = "req-1"
+	if err = qu.Add(ctx, dup); err != nil {
+		t.Fatal(err)
+	}
+	if dup.Key != ent.Item.Key {
+		t.Fatalf("expected attached to %q, got %q", ent.Item.Key, dup.Key)
+	}
+
+	// migrated keys are skipped
+	if n, err = qu.Migrate(ctx, DefaultLayout, dashLayout{}); err != nil || n != 0 {
+		t.Fatalf("expected no migrated items, got %d (%v)", n, err)
+	}
+}
@@ -0,0 +1,213 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// Model represents a trained model version, so that workers can discover
+// which parameters to load.
+type Model struct {
+	// Name is the model name (e.g. "cats").
+	Name string `json:"name"`
+
+	// Version is the model version, unique within the name.
+	Version string `json:"version"`
+
+	// Checksum is the checksum of model parameter file.
+	Checksum string `json:"checksum"`
+
+	// StorageURI is the location of model parameters
+	// (e.g. "gs://dplearn/parameters-cats.npy").
+	StorageURI string `json:"storage_uri"`
+
+	// Metrics contains evaluation results (e.g. "accuracy": 0.8).
+	Metrics map[string]float64 `json:"metrics"`
+
+	// CreatedAt is timestamp of model registration.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ModelRegistry registers model versions in etcd.
+type ModelRegistry interface {
+	// Register registers a new model version.
+	// It returns an error if the version already exists.
+	Register(ctx context.Context, m *Model) error
+
+	// Get returns the model of the given name and version.
+	Get(ctx context.Context, name, version string) (*Model, error)
+
+	// List returns all versions of the model, sorted by version, with
+	// numbers in versions compared by value (e.g. "v2" before "v10").
+	List(ctx context.Context, name string) ([]*Model, error)
+
+	// SetCurrent points the current model to the given version.
+	SetCurrent(ctx context.Context, name, version string) error
+
+	// Current returns the current model of the given name.
+	Current(ctx context.Context, name string) (*Model, error)
+}
+
+type modelRegistry struct {
+	cli *clientv3.Client
+}
+
+// NewModelRegistry creates a new model registry from given etcd client.
+func NewModelRegistry(cli *clientv3.Client) ModelRegistry {
+	return &modelRegistry{cli: cli}
+}
+
+const (
+	pfxModels       = "models"
+	pfxModelVersion = "versions"
+	modelCurrentKey = "current"
+)
+
+func modelVersionKey(name, version string) string {
+	return path.Join(pfxModels, name, pfxModelVersion, version)
+}
+
+func modelCurrentPointerKey(name string) string {
+	return path.Join(pfxModels, name, modelCurrentKey)
+}
+
+// lessVersion compares the versions by runs of digits and non-digits,
+// with digit runs compared by value, so that "v2" sorts before "v10".
+func lessVersion(a, b string) bool {
+	for a != "" && b != "" {
+		ra, rb := versionRun(a), versionRun(b)
+		if isDigit(ra[0]) && isDigit(rb[0]) {
+			na, nb := trimZeros(ra), trimZeros(rb)
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+		} else if ra != rb {
+			return ra < rb
+		}
+		a, b = a[len(ra):], b[len(rb):]
+	}
+	return len(a) < len(b)
+}
+
+// versionRun returns the leading run of digits or non-digits.
+func versionRun(s string) string {
+	i := 1
+	for i < len(s) && isDigit(s[i]) == isDigit(s[0]) {
+		i++
+	}
+	return s[:i]
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func trimZeros(s string) string {
+	for len(s) > 1 && s[0] == '0' {
+		s = s[1:]
+	}
+	return s
+}
+
+func (mr *modelRegistry) Register(ctx context.Context, m *Model) error {
+	if m == nil {
+		return fmt.Errorf("received <nil> Model")
+	}
+	if m.Name == "" || m.Version == "" {
+		return fmt.Errorf("invalid model: %+v", m)
+	}
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = DefaultClock.Now()
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	key := modelVersionKey(m.Name, m.Version)
+	resp, err := mr.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(data))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("model %q version %q already exists", m.Name, m.Version)
+	}
+	glog.Infof("registered model %q version %q (%s)", m.Name, m.Version, m.StorageURI)
+	return nil
+}
+
+func (mr *modelRegistry) Get(ctx context.Context, name, version string) (*Model, error) {
+	key := modelVersionKey(name, version)
+	resp, err := mr.cli.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) != 1 {
+		return nil, fmt.Errorf("model %q version %q not found", name, version)
+	}
+	var m Model
+	if err = json.Unmarshal(resp.Kvs[0].Value, &m); err != nil {
+		return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", key, string(resp.Kvs[0].Value), err)
+	}
+	return &m, nil
+}
+
+func (mr *modelRegistry) List(ctx context.Context, name string) ([]*Model, error) {
+	pfx := path.Join(pfxModels, name, pfxModelVersion) + "/"
+	resp, err := mr.cli.Get(ctx, pfx, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]*Model, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var m Model
+		if err = json.Unmarshal(kv.Value, &m); err != nil {
+			return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", string(kv.Key), string(kv.Value), err)
+		}
+		ms = append(ms, &m)
+	}
+	sort.SliceStable(ms, func(i, j int) bool { return lessVersion(ms[i].Version, ms[j].Version) })
+	return ms, nil
+}
+
+func (mr *modelRegistry) SetCurrent(ctx context.Context, name, version string) error {
+	key := modelVersionKey(name, version)
+	ptr := modelCurrentPointerKey(name)
+
+	// only point to the registered version
+	resp, err := mr.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), ">", 0)).
+		Then(clientv3.OpPut(ptr, version)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("model %q version %q not found", name, version)
+	}
+	glog.Infof("set current model %q to version %q", name, version)
+	return nil
+}
+
+func (mr *modelRegistry) Current(ctx context.Context, name string) (*Model, error) {
+	ptr := modelCurrentPointerKey(name)
+	resp, err := mr.cli.Get(ctx, ptr)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) != 1 {
+		return nil, fmt.Errorf("model %q has no current version", name)
+	}
+	return mr.Get(ctx, name, string(resp.Kvs[0].Value))
+}
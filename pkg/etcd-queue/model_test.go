@@ -0,0 +1,96 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestModelRegistry(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	mr := NewModelRegistry(qu.Client())
+
+	if _, err = mr.Current(context.Background(), "cats"); err == nil {
+		t.Fatal("expected error on missing current model")
+	}
+
+	m1 := &Model{Name: "cats", Version: "v1", Checksum: "aaa", StorageURI: "gs://test/v1.npy", Metrics: map[string]float64{"accuracy": 0.7}}
+	m2 := &Model{Name: "cats", Version: "v2", Checksum: "bbb", StorageURI: "gs://test/v2.npy", Metrics: map[string]float64{"accuracy": 0.8}}
+	m10 := &Model{Name: "cats", Version: "v10", Checksum: "ccc", StorageURI: "gs://test/v10.npy"}
+	for _, m := range []*Model{m1, m10, m2} {
+		if err = mr.Register(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = mr.Register(context.Background(), m1); err == nil {
+		t.Fatal("expected error on duplicate version")
+	}
+
+	ms, err := mr.List(context.Background(), "cats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 3 || ms[0].Version != "v1" || ms[1].Version != "v2" || ms[2].Version != "v10" {
+		t.Fatalf("unexpected models %+v", ms)
+	}
+	resp, err := qu.Client().Get(context.Background(), "models/cats/versions/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Count != 1 {
+		t.Fatalf("expected model registered under %q, got %d keys", "models/", resp.Count)
+	}
+
+	if err = mr.SetCurrent(context.Background(), "cats", "v3"); err == nil {
+		t.Fatal("expected error on unknown version")
+	}
+	if err = mr.SetCurrent(context.Background(), "cats", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	cur, err := mr.Current(context.Background(), "cats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.Version != "v2" || cur.StorageURI != m2.StorageURI || cur.Metrics["accuracy"] != 0.8 {
+		t.Fatalf("unexpected current model %+v", cur)
+	}
+}
+
+func TestLessVersion(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"v1", "v2", true},
+		{"v2", "v10", true},
+		{"v10", "v2", false},
+		{"v1.2", "v1.10", true},
+		{"v1.10", "v1.2", false},
+		{"v1", "v1", false},
+		{"v01", "v1", false},
+		{"v1", "v1.1", true},
+		{"a", "b", true},
+		{"2018-01-02", "2018-01-10", true},
+	}
+	for i, tt := range tests {
+		if less := lessVersion(tt.a, tt.b); less != tt.less {
+			t.Fatalf("#%d: expected lessVersion(%q, %q) %v, got %v", i, tt.a, tt.b, tt.less, less)
+		}
+	}
+}
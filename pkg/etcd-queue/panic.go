@@ -0,0 +1,69 @@
+package etcdqueue
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PanicError is the panic recovered in a queue goroutine (e.g. on
+// a malformed item), reported to error hooks (see 'AddErrorHook').
+type PanicError struct {
+	// Goroutine is the kind of the goroutine (e.g. "watch").
+	Goroutine string
+	// Key is the key watched or resolved by the goroutine, if any.
+	Key string
+
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("queue: recovered panic in %s goroutine of %q (%v)", e.Goroutine, e.Key, e.Value)
+}
+
+// ErrorHook is called with errors of queue goroutines, which have
+// no caller to return them to (e.g. PanicError).
+type ErrorHook func(err error)
+
+var recoveredPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "etcdqueue",
+	Name:      "recovered_panics_total",
+	Help:      "Number of panics recovered in queue goroutines.",
+}, []string{"goroutine"})
+
+func init() {
+	prometheus.MustRegister(recoveredPanics)
+}
+
+func (qu *queue) AddErrorHook(h ErrorHook) {
+	qu.hooksmu.Lock()
+	qu.errorHooks = append(qu.errorHooks, h)
+	qu.hooksmu.Unlock()
+}
+
+// recoverPanic recovers the panic of the goroutine, and reports it to
+// error hooks, and to notify (if not <nil>) before the goroutine exits
+// (e.g. to send the error to its watcher). It must be deferred by the
+// goroutine, after other deferred calls that close its channels.
+func (qu *queue) recoverPanic(goroutine, key string, notify func(err error)) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	err := &PanicError{Goroutine: goroutine, Key: key, Value: v, Stack: debug.Stack()}
+	glog.Errorf("%v\n%s", err, err.Stack)
+	recoveredPanics.WithLabelValues(goroutine).Inc()
+
+	if notify != nil {
+		notify(err)
+	}
+	qu.hooksmu.RLock()
+	hooks := qu.errorHooks
+	qu.hooksmu.RUnlock()
+	for _, h := range hooks {
+		h(err)
+	}
+}
@@ -0,0 +1,134 @@
+package etcdqueue
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	errc := make(chan error, 10)
+	qu := &queue{}
+	qu.AddErrorHook(func(err error) { errc <- err })
+
+	// background goroutines report panics to hooks
+	qu.goBackground("test", "foo", func() { panic("boom") })
+	select {
+	case err := <-errc:
+		perr, ok := err.(*PanicError)
+		if !ok || perr.Goroutine != "test" || perr.Key != "foo" || perr.Value != "boom" || len(perr.Stack) == 0 {
+			t.Fatalf("unexpected error %#v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to report panic")
+	}
+
+	// items failing to resolve (etcd client is <nil>) fail their own
+	// watchers, and workers keep serving others
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := &itemMux{
+		pool:   qu.newWorkerPool(ctx, "watch-item", "my-job", 1),
+		items:  make(map[string]*itemWatchGroup),
+		notify: make(chan struct{}, 1),
+	}
+	sub := &itemSub{ctx: ctx, ch: make(chan *Item, itemWatchBuffer)}
+	g := &itemWatchGroup{key: "my-job/malformed", subs: []*itemSub{sub}}
+	m.items[g.key] = g
+	qu.scheduleResolve(ctx, m, g)
+
+	select {
+	case item := <-sub.ch:
+		if !strings.Contains(item.Error, "recovered panic in watch-item goroutine") {
+			t.Fatalf("unexpected item %+v", item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to receive panic")
+	}
+	if err := <-errc; err == nil {
+		t.Fatal("expected the panic reported")
+	}
+	if _, ok := <-sub.ch; ok {
+		t.Fatal("expected the watcher closed")
+	}
+	if len(m.items) != 0 {
+		t.Fatalf("expected the group removed, got %+v", m.items)
+	}
+
+	donec := make(chan struct{})
+	if !m.pool.submit(ctx, func() { close(donec) }) {
+		t.Fatal("expected the job submitted")
+	}
+	select {
+	case <-donec:
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to run the job after panic")
+	}
+}
+
+func TestRecoverPanicCoalesce(t *testing.T) {
+	errc := make(chan error, 10)
+	qu := &queue{}
+	qu.AddErrorHook(func(err error) { errc <- err })
+
+	// <nil> states panic in the coalescing goroutines, which fail
+	// their own watchers
+	items := make(chan *Item, 1)
+	items <- nil
+	select {
+	case item := <-qu.coalesceItems(context.Background(), items, time.Hour):
+		if !strings.Contains(item.Error, "recovered panic in coalesce-items goroutine") {
+			t.Fatalf("unexpected item %+v", item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to receive panic")
+	}
+	events := make(chan *Event, 1)
+	events <- nil
+	select {
+	case ev := <-qu.coalesceEvents(context.Background(), events, time.Hour):
+		if !strings.Contains(ev.Error, "recovered panic in coalesce-events goroutine") {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to receive panic")
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := (<-errc).(*PanicError); !ok {
+			t.Fatal("expected the panic reported")
+		}
+	}
+}
+
+func TestRecoverPanicOnComplete(t *testing.T) {
+	errc := make(chan error, 10)
+	qu := &queue{}
+	qu.AddErrorHook(func(err error) { errc <- err })
+
+	// waiting panics (etcd client is <nil>), and so does the function
+	h := &JoinHandle{ID: "my-job/join", Keys: []string{"my-job/1"}, qu: qu}
+	donec := make(chan error, 1)
+	h.OnComplete(context.Background(), func(items []*Item, err error) {
+		donec <- err
+		panic("boom")
+	})
+	select {
+	case err := <-donec:
+		if perr, ok := err.(*PanicError); !ok || perr.Goroutine != "join" || perr.Key != h.ID {
+			t.Fatalf("unexpected error %#v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to complete")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errc:
+			if _, ok := err.(*PanicError); !ok {
+				t.Fatalf("unexpected error %#v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("took too long to report panic")
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"path"
+)
+
+// BucketPolicy controls which buckets Add and AddBatch accept. By
+// default, adding to an unknown bucket implicitly creates it.
+type BucketPolicy struct {
+	// RejectUnknown is true to reject items of unknown buckets, so that
+	// typos do not silently create orphan buckets. Known buckets are the
+	// ones matching Patterns, or with a configuration (see 'SetBucketConfig').
+	RejectUnknown bool
+
+	// Patterns are the allowed bucket name patterns, in the syntax of
+	// 'path.Match' (e.g. "/cats-request", "train-*").
+	Patterns []string
+}
+
+// Validate returns an error if any pattern is malformed.
+func (p BucketPolicy) Validate() error {
+	for _, pattern := range p.Patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid bucket pattern %q (%v)", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matches returns true if the bucket matches any pattern.
+func (p BucketPolicy) matches(bucket string) bool {
+	for _, pattern := range p.Patterns {
+		if ok, _ := path.Match(pattern, bucket); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// UnknownBucketError is returned when items are added to an unknown
+// bucket, with 'BucketPolicy.RejectUnknown'.
+type UnknownBucketError struct {
+	Bucket string
+}
+
+func (e *UnknownBucketError) Error() string {
+	return fmt.Sprintf("%v: %q", ErrBucketNotFound, e.Bucket)
+}
+
+// Is makes the error match ErrBucketNotFound with errors.Is.
+func (e *UnknownBucketError) Is(target error) bool {
+	return target == ErrBucketNotFound
+}
+
+// IsUnknownBucket returns true if the error is UnknownBucketError.
+func IsUnknownBucket(err error) bool {
+	_, ok := err.(*UnknownBucketError)
+	return ok
+}
+
+func (qu *queue) SetBucketPolicy(p BucketPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	qu.policymu.Lock()
+	qu.policy = p
+	qu.policymu.Unlock()
+	return nil
+}
+
+// checkBuckets returns UnknownBucketError if any item is in an unknown
+// bucket, and the policy rejects unknown buckets.
+func (qu *queue) checkBuckets(ctx context.Context, items ...*Item) error {
+	qu.policymu.RLock()
+	p := qu.policy
+	qu.policymu.RUnlock()
+	if !p.RejectUnknown {
+		return nil
+	}
+
+	for _, item := range items {
+		if p.matches(item.Bucket) {
+			continue
+		}
+		_, ok, err := qu.lookupConfig(ctx, item.Bucket)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &UnknownBucketError{Bucket: item.Bucket}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBucketPolicy(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if err = qu.SetBucketPolicy(BucketPolicy{RejectUnknown: true, Patterns: []string{"["}}); err == nil {
+		t.Fatal("expected error on malformed pattern")
+	}
+
+	// unknown buckets are created by default
+	if err = qu.Add(ctx, CreateItem("tpyo-bucket", 100, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = qu.SetBucketPolicy(BucketPolicy{RejectUnknown: true, Patterns: []string{"train-*"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, CreateItem("tpyo-bucket", 100, "a")); !IsUnknownBucket(err) {
+		t.Fatalf("expected unknown bucket error, got %v", err)
+	}
+	if err = qu.AddBatch(ctx, []*Item{CreateItem("train-a", 100, "a"), CreateItem("tpyo-bucket", 100, "b")}); !IsUnknownBucket(err) {
+		t.Fatalf("expected unknown bucket error, got %v", err)
+	}
+	if err = qu.AddBatch(ctx, []*Item{CreateItem("train-a", 100, "a"), CreateItem("train-b", 100, "b")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// configured buckets are known
+	if err = qu.SetBucketConfig(ctx, "test-bucket", BucketConfig{MaxInFlight: 1}); err != nil {
+		t.Fatal(err)
+	}
+	waitConfig(t, qu, "test-bucket", BucketConfig{MaxInFlight: 1})
+	if err = qu.Add(ctx, CreateItem("test-bucket", 100, "a")); err != nil {
+		t.Fatal(err)
+	}
+}
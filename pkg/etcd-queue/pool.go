@@ -0,0 +1,59 @@
+package etcdqueue
+
+import (
+	"context"
+	"sync"
+)
+
+// NotifyWorkers is the number of goroutines per bucket to fan out item
+// states to WatchItem subscribers. Notifications beyond the pool wait
+// for idle workers, so that goroutine counts stay bounded on load spikes.
+var NotifyWorkers = 8
+
+// workerPool runs functions on a fixed number of goroutines,
+// until its context is done. Workers are waited by Stop.
+type workerPool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+}
+
+func (qu *queue) newWorkerPool(ctx context.Context, goroutine, key string, size int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &workerPool{jobs: make(chan func(), size)}
+	p.wg.Add(size)
+	for i := 0; i < size; i++ {
+		worker := func() {
+			defer p.wg.Done()
+			for {
+				select {
+				case f := <-p.jobs:
+					f()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		if !qu.goBackground(goroutine, key, worker) {
+			p.wg.Done()
+		}
+	}
+	return p
+}
+
+// submit queues the function, blocking while all workers are busy and
+// the queue is full. It returns false if the context is done.
+func (p *workerPool) submit(ctx context.Context, f func()) bool {
+	select {
+	case p.jobs <- f:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// wait waits for all workers to exit, after the pool context is done.
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
@@ -0,0 +1,44 @@
+package etcdqueue
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := (&queue{}).newWorkerPool(ctx, "test", "", 2)
+
+	var (
+		running, max int32
+		wg           sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		if !p.submit(ctx, func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}) {
+			t.Fatal("expected submit")
+		}
+	}
+	wg.Wait()
+	if max > 2 {
+		t.Fatalf("expected at most 2 concurrent jobs, got %d", max)
+	}
+
+	// workers exit when the context is done
+	cancel()
+	p.wait()
+}
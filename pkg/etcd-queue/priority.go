@@ -0,0 +1,97 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+)
+
+// PriorityClass is the class of item priority, mapped to weights.
+// Items without class are considered 'PriorityNormal'.
+type PriorityClass string
+
+const (
+	// PriorityLow is for background jobs (e.g. batch re-indexing),
+	// which can be preempted by 'PriorityUrgent' items.
+	PriorityLow PriorityClass = "low"
+	// PriorityNormal is the default priority class.
+	PriorityNormal PriorityClass = "normal"
+	// PriorityHigh is for jobs that should be processed before normal ones.
+	PriorityHigh PriorityClass = "high"
+	// PriorityUrgent is for interactive user requests,
+	// which preempt 'PriorityLow' items in progress.
+	PriorityUrgent PriorityClass = "urgent"
+)
+
+var priorityWeights = map[PriorityClass]uint64{
+	PriorityLow:    100,
+	PriorityNormal: 1000,
+	PriorityHigh:   10000,
+	PriorityUrgent: MaxWeight,
+}
+
+// Weight returns the item weight of the priority class.
+func (p PriorityClass) Weight() uint64 {
+	if w, ok := priorityWeights[p]; ok {
+		return w
+	}
+	return priorityWeights[PriorityNormal]
+}
+
+// Preempts returns true if items of the class should preempt
+// in-progress items of the other class.
+func (p PriorityClass) Preempts(other PriorityClass) bool {
+	return p == PriorityUrgent && other == PriorityLow
+}
+
+// CreateItemWithPriority creates an item with the weight of the priority class.
+func CreateItemWithPriority(bucket string, class PriorityClass, value string) (*Item, error) {
+	if _, ok := priorityWeights[class]; !ok {
+		return nil, fmt.Errorf("unknown priority class %q", class)
+	}
+	item := CreateItem(bucket, class.Weight(), value)
+	item.Priority = class
+	return item, nil
+}
+
+// priorityOf returns the priority class of the item.
+func priorityOf(item *Item) PriorityClass {
+	if item.Priority == "" {
+		return PriorityNormal
+	}
+	return item.Priority
+}
+
+func (qu *queue) WatchPreempt(ctx context.Context, item *Item) ItemWatcher {
+	ch := make(chan *Item, 1)
+
+	ctx, done := qu.trackWatch(ctx, "watch-preempt", item.Key)
+	cctx, cancel := context.WithCancel(ctx)
+	wch := qu.Watch(cctx, item.Bucket)
+	if !qu.goBackground("watch-preempt", item.Key, func() {
+		defer close(ch)
+		defer cancel()
+		defer done()
+		defer qu.recoverPanic("watch-preempt", item.Key, func(err error) {
+			notifyItem(ch, &Item{Bucket: item.Bucket, Key: item.Key, Error: err.Error()})
+		})
+
+		for ev := range wch {
+			if ev.Error != "" {
+				ch <- &Item{Bucket: item.Bucket, Key: item.Key, Error: ev.Error}
+				return
+			}
+			if ev.Type != EventCreated && ev.Type != EventUpdated {
+				continue
+			}
+			if priorityOf(ev.Item).Preempts(priorityOf(item)) {
+				ch <- ev.Item
+				return
+			}
+		}
+	}) {
+		cancel()
+		done()
+		return closedWatcher(item.Bucket)
+	}
+	return ch
+}
@@ -0,0 +1,90 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueuePreempt(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	testBucket := "test-bucket"
+
+	low, err := CreateItemWithPriority(testBucket, PriorityLow, "reindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(context.Background(), low); err != nil {
+		t.Fatal(err)
+	}
+	item := <-qu.Pop(context.Background(), testBucket)
+	if err = low.Equal(item); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pch := qu.WatchPreempt(ctx, item)
+
+	high, err := CreateItemWithPriority(testBucket, PriorityHigh, "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(context.Background(), high); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case it := <-pch:
+		t.Fatalf("unexpected preemption by %+v", it)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	urgent, err := CreateItemWithPriority(testBucket, PriorityUrgent, "user-request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(context.Background(), urgent); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case it := <-pch:
+		if err = urgent.Equal(it); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected preemption, but got none")
+	}
+
+	// requeue keeps the original position
+	if err = qu.Add(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	items, err := qu.List(context.Background(), testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 || items[0].Priority != PriorityUrgent || items[2].Key != low.Key {
+		t.Fatalf("unexpected items %+v", items)
+	}
+
+	if _, err = CreateItemWithPriority(testBucket, "unknown", "x"); err == nil {
+		t.Fatal("expected error on unknown priority class")
+	}
+}
@@ -0,0 +1,175 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+const pfxProgress = "_progress"
+
+// childProgressPrefix returns the prefix of the progress of the child
+// items of the parent key (see 'Item.ParentKey').
+func childProgressPrefix(parentKey string) string {
+	return path.Join(pfxProgress, parentKey) + "/"
+}
+
+// childProgressOps returns the operation to record the progress of the
+// child item for its parent, written in the same transaction as the
+// item. Finished (completed, failed, or canceled) items count as done.
+func childProgressOps(item *Item) []clientv3.Op {
+	if item.ParentKey == "" {
+		return nil
+	}
+	progress := item.Progress
+	if item.Status.Terminal() {
+		progress = MaxProgress
+	}
+	return []clientv3.Op{clientv3.OpPut(childProgressPrefix(item.ParentKey)+item.Key, strconv.Itoa(progress))}
+}
+
+func (qu *queue) UpdateProgress(ctx context.Context, item *Item) error {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if item == nil {
+		return fmt.Errorf("received <nil> Item")
+	}
+	if err := checkItemKey(item); err != nil {
+		return err
+	}
+	if item.Progress < 0 || item.Progress >= MaxProgress {
+		return fmt.Errorf("progress %d out of range [0, %d) (use Complete)", item.Progress, MaxProgress)
+	}
+	if err := item.Transition(StatusInProgress); err != nil {
+		return err
+	}
+	data, err := marshalItem(item)
+	if err != nil {
+		return err
+	}
+
+	qu.writemu.Lock()
+	idxKey := statusIndexPrefix(StatusInProgress) + item.Key
+	resp, err := qu.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(idxKey), ">", 0)).
+		Then(append(append(indexOps(item, data, StatusInProgress), childProgressOps(item)...), qu.eventOp(ctx, EventProgress, item.Bucket, item.Key, data))...).
+		Commit()
+	qu.writemu.Unlock()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return qu.missingItemError(ctx, item.Key)
+	}
+	qu.aggregateProgress(ctx, item.ParentKey)
+	return nil
+}
+
+// aggregateProgress sets the progress of the parent item to the average
+// progress of its children, and of its ancestors in turn, so that sharded
+// jobs show one progress. Errors are logged. The parent progress stays
+// below 'MaxProgress' until the parent itself is completed.
+// It must be called without 'writemu' held.
+func (qu *queue) aggregateProgress(ctx context.Context, parentKey string) {
+	for depth := 0; parentKey != "" && depth < MaxLineageDepth; depth++ {
+		next, err := qu.aggregateParent(ctx, parentKey)
+		if err != nil {
+			glog.Warningf("queue: failed to aggregate progress of %q (%v)", parentKey, err)
+			return
+		}
+		parentKey = next
+	}
+}
+
+// aggregateParent updates the progress of the pending or in-progress
+// parent, and returns the key of its parent if updated.
+func (qu *queue) aggregateParent(ctx context.Context, parentKey string) (string, error) {
+	pendingKey, idxKey := PendingKey(parentKey), statusIndexPrefix(StatusInProgress)+parentKey
+	for {
+		resp, err := qu.kv.Txn(ctx).Then(
+			clientv3.OpGet(childrenPrefix(parentKey), clientv3.WithPrefix(), clientv3.WithCountOnly()),
+			clientv3.OpGet(childProgressPrefix(parentKey), clientv3.WithPrefix()),
+			clientv3.OpGet(pendingKey),
+			clientv3.OpGet(idxKey),
+		).Commit()
+		if err != nil {
+			return "", err
+		}
+		children := resp.Responses[0].GetResponseRange().Count
+		if children == 0 {
+			return "", nil
+		}
+		// children without progress (e.g. pending) count as zero
+		var sum int64
+		for _, kv := range resp.Responses[1].GetResponseRange().Kvs {
+			p, err := strconv.ParseInt(string(kv.Value), 10, 64)
+			if err != nil {
+				return "", fmt.Errorf("%q has invalid progress %q (%v)", string(kv.Key), string(kv.Value), err)
+			}
+			sum += p
+		}
+		progress := int(sum / children)
+		if progress >= MaxProgress {
+			progress = MaxProgress - 1
+		}
+
+		var (
+			item *Item
+			key  string
+			st   Status
+			rev  int64
+		)
+		if kvs := resp.Responses[2].GetResponseRange().Kvs; len(kvs) > 0 {
+			if item, err = decodeItem(kvs[0]); err != nil {
+				return "", err
+			}
+			key, st, rev = pendingKey, StatusPending, kvs[0].ModRevision
+		} else if kvs := resp.Responses[3].GetResponseRange().Kvs; len(kvs) > 0 {
+			var ent IndexEntry
+			if err = json.Unmarshal(kvs[0].Value, &ent); err != nil {
+				return "", fmt.Errorf("%q returned wrong JSON %q (%v)", idxKey, string(kvs[0].Value), err)
+			}
+			if ent.Item == nil {
+				return "", fmt.Errorf("%q has no item", idxKey)
+			}
+			item, key, st, rev = ent.Item, idxKey, StatusInProgress, kvs[0].ModRevision
+		} else {
+			// finished, or removed
+			return "", nil
+		}
+		if item.Progress == progress {
+			return "", nil
+		}
+		item.Progress = progress
+		data, err := marshalItem(item)
+		if err != nil {
+			return "", err
+		}
+		ops := append(indexOps(item, data, st), childProgressOps(item)...)
+		if st == StatusPending {
+			ops = append(ops, clientv3.OpPut(pendingKey, string(data), clientv3.WithIgnoreLease()))
+		}
+
+		qu.writemu.Lock()
+		tresp, err := qu.kv.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+			Then(ops...).
+			Commit()
+		qu.writemu.Unlock()
+		if err != nil {
+			return "", err
+		}
+		if tresp.Succeeded {
+			if st == StatusPending {
+				qu.invalidateFront(item.Bucket)
+			}
+			return item.ParentKey, nil
+		}
+		// updated concurrently (e.g. popped), retry with the new state
+	}
+}
@@ -0,0 +1,96 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUpdateProgress(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	job := CreateItem("job", 100, "sharded")
+	if err = qu.Add(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.UpdateProgress(ctx, job); !IsInvalidTransition(err) {
+		t.Fatalf("expected invalid transition of pending item, got %v", err)
+	}
+	parent := <-qu.Pop(ctx, "job")
+	if parent.Err() != nil {
+		t.Fatal(parent.Err())
+	}
+	parent.Progress = MaxProgress
+	if err = qu.UpdateProgress(ctx, parent); err == nil {
+		t.Fatal("expected out of range error")
+	}
+
+	shards := []*Item{CreateItem("shard", 100, "0"), CreateItem("shard", 100, "1")}
+	for _, item := range shards {
+		item.ParentKey = parent.Key
+	}
+	if _, err = qu.FanOut(ctx, "shard", shards); err != nil {
+		t.Fatal(err)
+	}
+	progressOf := func(key string) int {
+		ent, err := qu.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ent.Item.Progress
+	}
+
+	first, second := <-qu.Pop(ctx, "shard"), <-qu.Pop(ctx, "shard")
+	first.Progress = 50
+	if err = qu.UpdateProgress(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if p := progressOf(first.Key); p != 50 {
+		t.Fatalf("expected progress 50, got %d", p)
+	}
+	if p := progressOf(parent.Key); p != 25 {
+		t.Fatalf("expected parent progress 25, got %d", p)
+	}
+
+	stale := *first
+	first.Progress = MaxProgress
+	if err = qu.Complete(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	second.Progress = 80
+	if err = qu.UpdateProgress(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if p := progressOf(parent.Key); p != 90 {
+		t.Fatalf("expected parent progress 90, got %d", p)
+	}
+
+	// the parent is done only on its own Complete
+	second.Progress, second.Error = MaxProgress, "failed shard"
+	if err = qu.Complete(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if p := progressOf(parent.Key); p != MaxProgress-1 {
+		t.Fatalf("expected parent progress %d, got %d", MaxProgress-1, p)
+	}
+	stale.Progress = 60
+	if err = qu.UpdateProgress(ctx, &stale); err != ErrAlreadyCompleted {
+		t.Fatalf("expected %v, got %v", ErrAlreadyCompleted, err)
+	}
+}
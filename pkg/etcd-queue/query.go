@@ -0,0 +1,261 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queryOps are the operators of query terms, longest first to match
+// "!=" before "=".
+var queryOps = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// queryFields are the fields of query terms, with their kinds of values.
+var queryFields = map[string]string{
+	"bucket":    "string",
+	"key":       "string",
+	"status":    "string",
+	"owner":     "string",
+	"priority":  "string",
+	"request":   "string",
+	"created":   "time",
+	"completed": "time",
+	"attempts":  "int",
+	"progress":  "int",
+}
+
+type queryTerm struct {
+	field string
+	op    string
+	value string
+	t     time.Time
+	n     int
+}
+
+// Query is a parsed search query (see 'ParseQuery').
+type Query []queryTerm
+
+var queryAnd = regexp.MustCompile(`(?i)\s+AND\s+`)
+
+// ParseQuery parses the query of terms joined by "AND" (e.g.
+// "bucket=cats* AND status=failed AND created>-24h"). Each term compares
+// an item field with '=', '!=', '>', '>=', '<', or '<=':
+//
+//	bucket, key, status, owner, priority, request (request ID):
+//	    '=' and '!=' only, with '*' wildcards (see 'path.Match')
+//	created, completed:
+//	    time in RFC3339, or duration relative to now (e.g. "-24h")
+//	attempts, progress:
+//	    integer
+//	label.<name>:
+//	    '=' and '!=' only, with '*' wildcards
+//
+// Bucket patterns also match buckets without the leading "/".
+func ParseQuery(s string) (Query, error) {
+	return parseQuery(s, DefaultClock.Now())
+}
+
+func parseQuery(s string, now time.Time) (Query, error) {
+	var q Query
+	if strings.TrimSpace(s) == "" {
+		return q, nil
+	}
+	for _, term := range queryAnd.Split(strings.TrimSpace(s), -1) {
+		t, err := parseQueryTerm(term, now)
+		if err != nil {
+			return nil, err
+		}
+		q = append(q, t)
+	}
+	return q, nil
+}
+
+func parseQueryTerm(term string, now time.Time) (queryTerm, error) {
+	idx, op := -1, ""
+	for _, o := range queryOps {
+		if i := strings.Index(term, o); i > 0 && (idx == -1 || i < idx) {
+			idx, op = i, o
+		}
+	}
+	if idx == -1 {
+		return queryTerm{}, fmt.Errorf("invalid query term %q (no operator)", term)
+	}
+	field := strings.TrimSpace(term[:idx])
+	t := queryTerm{
+		field: strings.ToLower(field),
+		op:    op,
+		value: strings.TrimSpace(term[idx+len(op):]),
+	}
+	kind, ok := queryFields[t.field]
+	if strings.HasPrefix(t.field, "label.") && len(t.field) > len("label.") {
+		// label names are case-sensitive
+		kind, ok = "string", true
+		t.field = "label." + field[len("label."):]
+	}
+	if !ok {
+		return queryTerm{}, fmt.Errorf("unknown query field %q", t.field)
+	}
+	if t.value == "" {
+		return queryTerm{}, fmt.Errorf("invalid query term %q (no value)", term)
+	}
+
+	var err error
+	switch kind {
+	case "string":
+		if op != "=" && op != "!=" {
+			return queryTerm{}, fmt.Errorf("invalid query term %q (%q only supports '=' and '!=')", term, t.field)
+		}
+		if _, err = path.Match(t.value, ""); err != nil {
+			return queryTerm{}, fmt.Errorf("invalid query pattern %q (%v)", t.value, err)
+		}
+	case "time":
+		if strings.HasPrefix(t.value, "-") || strings.HasPrefix(t.value, "+") {
+			var d time.Duration
+			if d, err = time.ParseDuration(t.value); err != nil {
+				return queryTerm{}, fmt.Errorf("invalid query duration %q (%v)", t.value, err)
+			}
+			t.t = now.Add(d)
+		} else if t.t, err = time.Parse(time.RFC3339, t.value); err != nil {
+			return queryTerm{}, fmt.Errorf("invalid query time %q (%v)", t.value, err)
+		}
+	case "int":
+		if t.n, err = strconv.Atoi(t.value); err != nil {
+			return queryTerm{}, fmt.Errorf("invalid query number %q (%v)", t.value, err)
+		}
+	}
+	return t, nil
+}
+
+// Matches returns true if the item in the status satisfies all terms.
+func (q Query) Matches(st Status, item *Item) bool {
+	for _, t := range q {
+		if !t.matches(st, item) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t queryTerm) matches(st Status, item *Item) bool {
+	switch t.field {
+	case "bucket":
+		return t.matchString(item.Bucket, strings.TrimPrefix(item.Bucket, "/"))
+	case "key":
+		return t.matchString(item.Key)
+	case "status":
+		return t.matchString(string(st))
+	case "owner":
+		return t.matchString(item.Owner)
+	case "priority":
+		return t.matchString(string(item.Priority))
+	case "request":
+		return t.matchString(item.RequestID)
+	case "created":
+		return t.matchTime(item.CreatedAt)
+	case "completed":
+		return !item.CompletedAt.IsZero() && t.matchTime(item.CompletedAt)
+	case "attempts":
+		return t.matchInt(item.Attempts)
+	case "progress":
+		return t.matchInt(item.Progress)
+	}
+	v, ok := item.Labels[strings.TrimPrefix(t.field, "label.")]
+	if !ok {
+		return t.op == "!="
+	}
+	return t.matchString(v)
+}
+
+// matchString returns true if any of the values matches the pattern
+// for '=', or none matches for '!='.
+func (t queryTerm) matchString(vs ...string) bool {
+	for _, v := range vs {
+		if ok, _ := path.Match(t.value, v); ok {
+			return t.op == "="
+		}
+	}
+	return t.op == "!="
+}
+
+func (t queryTerm) matchTime(v time.Time) bool {
+	switch t.op {
+	case "=":
+		return v.Equal(t.t)
+	case "!=":
+		return !v.Equal(t.t)
+	case ">":
+		return v.After(t.t)
+	case ">=":
+		return !v.Before(t.t)
+	case "<":
+		return v.Before(t.t)
+	default:
+		return !v.After(t.t)
+	}
+}
+
+func (t queryTerm) matchInt(v int) bool {
+	switch t.op {
+	case "=":
+		return v == t.n
+	case "!=":
+		return v != t.n
+	case ">":
+		return v > t.n
+	case ">=":
+		return v >= t.n
+	case "<":
+		return v < t.n
+	default:
+		return v <= t.n
+	}
+}
+
+// indexPrefix returns the narrowest index prefix to evaluate the query:
+// the status index of an exact status, the owner index of an exact
+// owner, or otherwise all status indexes.
+func (q Query) indexPrefix() string {
+	for _, t := range q {
+		if t.field == "status" && t.op == "=" && !strings.Contains(t.value, "*") {
+			// claimed items are indexed as in-progress
+			if Status(t.value) == StatusClaimed {
+				return statusIndexPrefix(StatusInProgress)
+			}
+			return statusIndexPrefix(Status(t.value))
+		}
+	}
+	for _, t := range q {
+		if t.field == "owner" && t.op == "=" && !strings.Contains(t.value, "*") {
+			return ownerIndexPrefix(t.value)
+		}
+	}
+	return path.Join(pfxIndex, "status") + "/"
+}
+
+func (qu *queue) Search(ctx context.Context, query string) ([]*IndexEntry, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := qu.readIndex(ctx, q.indexPrefix())
+	if err != nil {
+		return nil, err
+	}
+	matched := entries[:0]
+	for _, ent := range entries {
+		// claimed items are indexed as in-progress
+		if ent.Status == StatusInProgress && ent.Item.Status == StatusClaimed {
+			ent.Status = StatusClaimed
+		}
+		if q.Matches(ent.Status, ent.Item) {
+			matched = append(matched, ent)
+		}
+	}
+	return matched, nil
+}
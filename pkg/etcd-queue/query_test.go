@@ -0,0 +1,116 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	now := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+	item := &Item{
+		Bucket:    "/cats-request",
+		Key:       "/cats-request/00001",
+		Owner:     "alice",
+		CreatedAt: now.Add(-time.Hour),
+		Attempts:  2,
+		Labels:    map[string]string{"Model": "resnet"},
+	}
+	tests := []struct {
+		query   string
+		matches bool
+	}{
+		{"", true},
+		{"bucket=cats*", true},
+		{"bucket=/cats-request", true},
+		{"bucket=dogs*", false},
+		{"bucket!=dogs*", true},
+		{"bucket=cats* AND status=failed", true},
+		{"bucket=cats* and status!=failed", false},
+		{"owner=ali*", true},
+		{"created>-24h", true},
+		{"created>-30m", false},
+		{"created<2018-01-02T00:00:00Z", true},
+		{"completed>-24h", false},
+		{"attempts>=2", true},
+		{"attempts<2", false},
+		{"label.Model=res*", true},
+		{"label.model=resnet", false},
+		{"label.env!=prod", true},
+	}
+	for i, tt := range tests {
+		q, err := parseQuery(tt.query, now)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if m := q.Matches(StatusFailed, item); m != tt.matches {
+			t.Fatalf("#%d: %q expected %v, got %v", i, tt.query, tt.matches, m)
+		}
+	}
+
+	for _, s := range []string{"bucket", "color=red", "status>failed", "created>yesterday", "attempts=two", "key=[", "owner="} {
+		if _, err := ParseQuery(s); err == nil {
+			t.Fatalf("expected error on %q", s)
+		}
+	}
+}
+
+func TestQueueSearch(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	cat1, cat2 := CreateItem("cats-request", 100, "a"), CreateItem("cats-request", 100, "b")
+	dog := CreateItem("dogs-request", 100, "c")
+	for _, item := range []*Item{cat1, cat2, dog} {
+		if err = qu.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = qu.Cancel(ctx, cat2.Key); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		keys  []string
+	}{
+		{"bucket=cats*", []string{cat2.Key, cat1.Key}},
+		{"bucket=cats* AND status=pending", []string{cat1.Key}},
+		{"status=canceled", []string{cat2.Key}},
+		{"status=pending AND created>-1h", []string{cat1.Key, dog.Key}},
+		{"created<-1h", nil},
+	}
+	for i, tt := range tests {
+		entries, err := qu.Search(ctx, tt.query)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if len(entries) != len(tt.keys) {
+			t.Fatalf("#%d: %q expected %d items, got %+v", i, tt.query, len(tt.keys), entries)
+		}
+		for j, ent := range entries {
+			if ent.Item.Key != tt.keys[j] {
+				t.Fatalf("#%d: %q expected %q, got %q", i, tt.query, tt.keys[j], ent.Item.Key)
+			}
+		}
+	}
+	if _, err = qu.Search(ctx, "status>pending"); err == nil {
+		t.Fatal("expected error on invalid query")
+	}
+}
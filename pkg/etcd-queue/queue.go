@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
@@ -45,6 +46,15 @@ type Item struct {
 	// Canceled is true if the item(or job) is canceled.
 	Canceled bool `json:"canceled"`
 
+	// CanceledBy is the initiator of the cancellation (e.g. "admin").
+	CanceledBy string `json:"canceled_by,omitempty"`
+
+	// CancelReason is why the item was canceled (e.g. "worker maintenance").
+	CancelReason string `json:"cancel_reason,omitempty"`
+
+	// CanceledAt is set on Cancel, to start the 'UndeleteWindow'.
+	CanceledAt time.Time `json:"canceled_at,omitempty"`
+
 	// Error contains any error message. It's defined as string for
 	// different language interpolation.
 	Error string `json:"error"`
@@ -52,6 +62,86 @@ type Item struct {
 	// RequestID is used/generated by external service,
 	// to help identify each item.
 	RequestID string `json:"request_id"`
+
+	// Priority is the priority class of the item.
+	Priority PriorityClass `json:"priority,omitempty"`
+
+	// ResultURL is the location of published result (e.g. "gs://..."),
+	// set by completion hooks.
+	ResultURL string `json:"result_url,omitempty"`
+
+	// Labels are key-value pairs to select items (see 'ParseSelector').
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Owner is the user who created the item, indexed for 'ListByOwner'.
+	Owner string `json:"owner,omitempty"`
+
+	// ClaimedAt is set when the item is popped, to estimate
+	// processing durations (see 'ETA').
+	ClaimedAt time.Time `json:"claimed_at,omitempty"`
+
+	// CompletedAt is set on Complete.
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+
+	// Attempts is the number of failed attempts, retried by
+	// the bucket retry policy (see 'RetryPolicy').
+	Attempts int `json:"attempts,omitempty"`
+
+	// Status is the lifecycle status, moved by the queue and workers
+	// with validated transitions (see 'Item.Transition').
+	Status Status `json:"status,omitempty"`
+
+	// IdempotencyKey identifies the logical job of the item in its bucket.
+	// Add of an item with the key of an unfinished item attaches to the
+	// existing item, instead of writing a new item.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// ParentKey is the key of the item that spawned this item (e.g. a
+	// training job spawning evaluation jobs). The parent must exist on Add.
+	ParentKey string `json:"parent_key,omitempty"`
+
+	// ChildKeys are the keys of the items spawned by this item, linked
+	// on their Add, and set by Lineage.
+	ChildKeys []string `json:"child_keys,omitempty"`
+
+	// Worker is the ID of the worker that popped the item (see 'WithWorker').
+	Worker string `json:"worker,omitempty"`
+
+	// AffinityKey is the key of a related earlier item (e.g. a training job
+	// whose model is warm in GPU memory), whose worker is set as Affinity on Add.
+	AffinityKey string `json:"affinity_key,omitempty"`
+
+	// Affinity is the ID of the worker the item is routed to. While the
+	// worker is registered, Pop of other workers skips the item.
+	Affinity string `json:"affinity,omitempty"`
+
+	// SchemaVersion is the version of the payload schema in Value, only
+	// offered to workers supporting it (see 'Capabilities').
+	SchemaVersion int `json:"schema_version,omitempty"`
+
+	// ModelType is the type of model the item runs (e.g. "cnn"), only
+	// offered to workers supporting it (see 'Capabilities').
+	ModelType string `json:"model_type,omitempty"`
+
+	// ContentType is the media type of Value (e.g. ContentTypeJSON), so
+	// that workers interpret it without sniffing, only offered to workers
+	// supporting it (see 'Capabilities'). Binary values are in base64
+	// (see 'Item.Bytes'). Empty is unknown.
+	ContentType string `json:"content_type,omitempty"`
+
+	// ShadowOf is the key of the item mirrored into this shadow item
+	// (see 'ShadowConfig').
+	ShadowOf string `json:"shadow_of,omitempty"`
+
+	// Sequence is the position of the item in its bucket, assigned on
+	// Add from a per-bucket counter without gaps, so that consumers can
+	// detect missed items, and order items of equal weights.
+	Sequence uint64 `json:"sequence,omitempty"`
+
+	// Charged is the encoded size of the item charged to the usage of its
+	// owner and bucket on Add, and released when the item is deleted
+	// (see 'Quota'). Requeued items keep their charges.
+	Charged int64 `json:"charged,omitempty"`
 }
 
 // CreateItem creates an item with auto-generated ID of unix nano seconds.
@@ -60,11 +150,8 @@ func CreateItem(bucket string, weight uint64, value string) *Item {
 	if weight > MaxWeight {
 		weight = MaxWeight
 	}
-	// maximum weight comes first, lexicographically
-	priority := 99999 - weight
-
-	createdAt := time.Now()
-	key := path.Join(bucket, fmt.Sprintf("%05d%035X", priority, createdAt.UnixNano()))
+	createdAt := DefaultClock.Now()
+	key := DefaultLayout.Encode(bucket, weight, createdAt)
 
 	return &Item{
 		Bucket:    bucket,
@@ -73,14 +160,17 @@ func CreateItem(bucket string, weight uint64, value string) *Item {
 		Value:     value,
 		Progress:  0,
 		Error:     "",
+		Status:    StatusPending,
 	}
 }
 
-// Equal compares two items with truncated CreatedAt field string,
-// to handle modified timestamp string after serialization
+// Equal compares two items, with timestamps in their serialized
+// TimeFormat, so that items compare equal after serialization.
+// Status and ClaimedAt are not compared, since they move as the item
+// is processed.
 func (item1 *Item) Equal(item2 *Item) error {
-	if item1.CreatedAt.String()[:29] != item2.CreatedAt.String()[:29] {
-		return fmt.Errorf("expected CreatedAt %q, got %q", item1.CreatedAt.String()[:29], item2.CreatedAt.String()[:29])
+	if t1, t2 := formatTime(item1.CreatedAt), formatTime(item2.CreatedAt); t1 != t2 {
+		return fmt.Errorf("expected CreatedAt %q, got %q", t1, t2)
 	}
 	if item1.Bucket != item2.Bucket {
 		return fmt.Errorf("expected Bucket %q, got %q", item1.Bucket, item2.Bucket)
@@ -91,18 +181,53 @@ func (item1 *Item) Equal(item2 *Item) error {
 	if item1.Value != item2.Value {
 		return fmt.Errorf("expected Value %q, got %q", item1.Value, item2.Value)
 	}
+	if item1.ContentType != item2.ContentType {
+		return fmt.Errorf("expected ContentType %q, got %q", item1.ContentType, item2.ContentType)
+	}
 	if item1.Progress != item2.Progress {
 		return fmt.Errorf("expected Progress %d, got %d", item1.Progress, item2.Progress)
 	}
 	if item1.Canceled != item2.Canceled {
 		return fmt.Errorf("expected Canceled %v, got %v", item1.Canceled, item2.Canceled)
 	}
+	if item1.CanceledBy != item2.CanceledBy {
+		return fmt.Errorf("expected CanceledBy %s, got %s", item1.CanceledBy, item2.CanceledBy)
+	}
+	if item1.CancelReason != item2.CancelReason {
+		return fmt.Errorf("expected CancelReason %s, got %s", item1.CancelReason, item2.CancelReason)
+	}
 	if item1.Error != item2.Error {
 		return fmt.Errorf("expected Error %s, got %s", item1.Error, item2.Error)
 	}
 	if item1.RequestID != item2.RequestID {
 		return fmt.Errorf("expected RequestID %s, got %s", item1.RequestID, item2.RequestID)
 	}
+	if item1.Priority != item2.Priority {
+		return fmt.Errorf("expected Priority %s, got %s", item1.Priority, item2.Priority)
+	}
+	if item1.ResultURL != item2.ResultURL {
+		return fmt.Errorf("expected ResultURL %s, got %s", item1.ResultURL, item2.ResultURL)
+	}
+	if t1, t2 := formatTime(item1.CanceledAt), formatTime(item2.CanceledAt); t1 != t2 {
+		return fmt.Errorf("expected CanceledAt %q, got %q", t1, t2)
+	}
+	if t1, t2 := formatTime(item1.CompletedAt), formatTime(item2.CompletedAt); t1 != t2 {
+		return fmt.Errorf("expected CompletedAt %q, got %q", t1, t2)
+	}
+	if item1.Attempts != item2.Attempts {
+		return fmt.Errorf("expected Attempts %d, got %d", item1.Attempts, item2.Attempts)
+	}
+	if item1.Owner != item2.Owner {
+		return fmt.Errorf("expected Owner %s, got %s", item1.Owner, item2.Owner)
+	}
+	if len(item1.Labels) != len(item2.Labels) {
+		return fmt.Errorf("expected Labels %v, got %v", item1.Labels, item2.Labels)
+	}
+	for k, v := range item1.Labels {
+		if v2, ok := item2.Labels[k]; !ok || v != v2 {
+			return fmt.Errorf("expected Labels %v, got %v", item1.Labels, item2.Labels)
+		}
+	}
 	return nil
 }
 
@@ -111,7 +236,18 @@ type ItemWatcher <-chan *Item
 
 // Op represents an operation that queue can execute.
 type Op struct {
-	ttl int64
+	ttl          int64
+	waitCapacity bool
+	rev          int64
+	serializable bool
+	notifyWindow time.Duration
+	delta        bool
+	limit        int64
+
+	canceledBy   string
+	cancelReason string
+
+	join *Item
 }
 
 // OpOption configures queue operations.
@@ -122,6 +258,12 @@ func WithTTL(dur time.Duration) OpOption {
 	return func(op *Op) { op.ttl = int64(dur.Seconds()) }
 }
 
+// WithCancelReason configures Cancel to record the initiator and reason
+// of the cancellation on the item (see 'Item.CancelMessage').
+func WithCancelReason(by, reason string) OpOption {
+	return func(op *Op) { op.canceledBy, op.cancelReason = by, reason }
+}
+
 func (op *Op) applyOpts(opts []OpOption) {
 	for _, opt := range opts {
 		opt(op)
@@ -133,11 +275,341 @@ type Queue interface {
 	// Add adds an item to the queue.
 	Add(ctx context.Context, it *Item, opts ...OpOption) error
 
+	// AddBatch adds items to the queue in transactions of at most
+	// 'MaxBatchSize' items. Items in the same transaction are written atomically.
+	AddBatch(ctx context.Context, items []*Item, opts ...OpOption) error
+
 	// Pop returns ItemWatcher that returns the first item in the queue.
 	// It blocks until there is at least one item to return.
 	Pop(ctx context.Context, bucket string) ItemWatcher
 
-	// Stop stops the queue service and any embedded clients.
+	// PopBackfill returns ItemWatcher that returns the first item in the
+	// backfill bucket, only when interactive buckets have no pending item
+	// and etcd load is below the threshold.
+	PopBackfill(ctx context.Context, cfg BackfillConfig) ItemWatcher
+
+	// Front returns the first item in the queue without removing it.
+	// It returns <nil> if the bucket is empty.
+	// Reads are linearizable, unless configured with WithSerializable.
+	Front(ctx context.Context, bucket string, opts ...OpOption) (*Item, error)
+
+	// List returns all items in the bucket, in the order of Pop.
+	List(ctx context.Context, bucket string, opts ...OpOption) ([]*Item, error)
+
+	// ListSelector returns items in the bucket whose labels match the
+	// selector (e.g. "model=resnet,env=prod"), in the order of Pop.
+	ListSelector(ctx context.Context, bucket, selector string, opts ...OpOption) ([]*Item, error)
+
+	// SetRedaction marks sensitive fields of items in the bucket.
+	// Empty redaction removes the configuration.
+	SetRedaction(ctx context.Context, bucket string, r Redaction) error
+
+	// Redaction returns the redaction configuration of the bucket.
+	Redaction(ctx context.Context, bucket string) (Redaction, error)
+
+	// RegisterSchema registers the JSON Schema of item values in the bucket.
+	// Add and AddBatch reject items whose values do not match the schema.
+	RegisterSchema(ctx context.Context, bucket string, schema []byte) error
+
+	// Schema returns the JSON Schema of the bucket, or <nil> if not registered.
+	Schema(ctx context.Context, bucket string) ([]byte, error)
+
+	// DeleteSchema deletes the JSON Schema of the bucket.
+	DeleteSchema(ctx context.Context, bucket string) error
+
+	// SetBucketConfig updates the configuration of the bucket, which
+	// queues reload by watch. Empty configuration removes it.
+	SetBucketConfig(ctx context.Context, bucket string, cfg BucketConfig) error
+
+	// BucketConfig returns the configuration of the bucket.
+	BucketConfig(ctx context.Context, bucket string) (BucketConfig, error)
+
+	// SetACL sets the access-control list of the bucket, enforced by
+	// queues of NewACLQueue. Empty ACL removes it. The ACL of GlobalACL
+	// grants operations across buckets.
+	SetACL(ctx context.Context, bucket string, acl ACL) error
+
+	// ACL returns the access-control list of the bucket.
+	ACL(ctx context.Context, bucket string) (ACL, error)
+
+	// CreateSessionBucket creates the bucket bound to the lease of a new
+	// session, which is kept alive until Close. Pending and completed
+	// items of the bucket vanish when the session ends, or after
+	// 'SessionTTL' if the session owner crashes. It returns
+	// ErrBucketExists if the bucket has a configuration or items.
+	CreateSessionBucket(ctx context.Context, bucket string) (*SessionBucket, error)
+
+	// CreateBucketFromTemplate writes the configuration and schema of
+	// the template to the new bucket, in one transaction. It returns
+	// ErrBucketExists if the bucket already has a configuration.
+	CreateBucketFromTemplate(ctx context.Context, bucket string, tmpl BucketTemplate) error
+
+	// SetBucketPolicy sets the policy of buckets accepted by Add and
+	// AddBatch. It only applies to this queue instance.
+	SetBucketPolicy(p BucketPolicy) error
+
+	// SetLimits sets the request limits (e.g. the maximum size of item
+	// values, and the timeout of operations). It only applies to this
+	// queue instance.
+	SetLimits(l Limits) error
+
+	// SetOwnerQuota sets the storage quota of the owner. Empty owner
+	// sets the default quota of owners without quota. Empty quota
+	// removes it.
+	SetOwnerQuota(ctx context.Context, owner string, q Quota) error
+
+	// OwnerQuota returns the storage quota of the owner,
+	// or the default quota if not set.
+	OwnerQuota(ctx context.Context, owner string) (Quota, error)
+
+	// OwnerUsage returns the storage usage of all indexed items of the owner.
+	OwnerUsage(ctx context.Context, owner string) (Usage, error)
+
+	// BucketUsage returns the storage usage of pending and completed
+	// items in the bucket.
+	BucketUsage(ctx context.Context, bucket string) (Usage, error)
+
+	// ListByOwner returns all indexed items of the owner, with their
+	// statuses, in the order of item keys.
+	ListByOwner(ctx context.Context, owner string) ([]*IndexEntry, error)
+
+	// ListByStatus returns all indexed items in the status, in the order
+	// of item keys.
+	ListByStatus(ctx context.Context, st Status) ([]*Item, error)
+
+	// Search returns indexed items matching the query (see 'ParseQuery'),
+	// with their statuses, in the order of index keys. The query is
+	// evaluated over the status or owner index of its exact terms,
+	// or all status indexes otherwise.
+	Search(ctx context.Context, query string) ([]*IndexEntry, error)
+
+	// Get returns the item of the given key, with the status it was found
+	// in (pending, claimed, in-progress, or completed with its terminal
+	// status), or ErrItemNotFound if none.
+	Get(ctx context.Context, itemKey string) (*IndexEntry, error)
+
+	// GetCompleted returns the completed item of the given key,
+	// or ErrItemNotFound if not completed.
+	GetCompleted(ctx context.Context, itemKey string) (*Item, error)
+
+	// Cancel removes the item of the given key from the queue,
+	// and returns the removed item marked as canceled. Use
+	// WithCancelReason to record who canceled it and why. It returns
+	// ErrCanceled or ErrAlreadyCompleted if the item has been canceled
+	// or completed, and ErrItemNotFound if not pending otherwise.
+	Cancel(ctx context.Context, itemKey string, opts ...OpOption) (*Item, error)
+
+	// Undelete restores the item canceled within 'UndeleteWindow' to
+	// pending, at its original position, and returns the restored item.
+	// It returns ErrUndeleteExpired after the window, and ErrItemNotFound
+	// if the item is not canceled. Restored items do not expire by TTL.
+	Undelete(ctx context.Context, itemKey string) (*Item, error)
+
+	// Stats returns the statistics of the bucket.
+	Stats(ctx context.Context, bucket string, opts ...OpOption) (BucketStats, error)
+
+	// ETA estimates the durations until the item is claimed and completed,
+	// from its position in the bucket, and the processing durations and
+	// throughput of items completed within 'ETAHistory'.
+	ETA(ctx context.Context, item *Item) (Estimate, error)
+
+	// Aggregate returns enqueue, completion, and error counts, and mean
+	// latency of the bucket, per time window of the given size, for the
+	// last 'AggregateWindows' windows in the order of time.
+	Aggregate(ctx context.Context, bucket string, window time.Duration) ([]WindowStats, error)
+
+	// Purge removes all items in the bucket, and returns the number of removed items.
+	// Index entries of purged items are removed lazily, on index reads.
+	Purge(ctx context.Context, bucket string) (int64, error)
+
+	// Transfer pauses the bucket (see 'BucketConfig.Paused'), and moves
+	// its pending items to the destination queue (e.g. on another etcd
+	// cluster) with their keys, so that they keep their order. Transferred
+	// items are returned by Get and WatchItem with StatusTransferred, and
+	// streamed by WatchBucket as EventTransfer. Links to other items and
+	// workers are not transferred. It returns the number of transferred items.
+	Transfer(ctx context.Context, dst Queue, bucket string) (int, error)
+
+	// Features returns the features enabled in the data (see 'Feature').
+	Features(ctx context.Context) ([]Feature, error)
+
+	// Migrate rewrites the keys of pending items encoded in the from
+	// layout to the to layout, in transactions of 'MigrateBatch' items,
+	// while the queue serves other requests. Items are readable by both
+	// keys: Get of old keys returns the migrated items. 'DefaultLayout'
+	// should be replaced first, so that items added during the migration
+	// are created in the to layout. It returns the number of migrated items.
+	Migrate(ctx context.Context, from, to Layout) (int, error)
+
+	// Watch returns EventWatcher that streams the changes of items in the
+	// bucket as typed events: EventCreated and EventUpdated of pending
+	// items, EventCompleted and EventCanceled of terminated items, and
+	// EventDeleted of items otherwise removed (e.g. popped), with the
+	// item and the revision of the change. Events are delivered in the
+	// order of revision, except that completions of popped items are
+	// watched separately, and may precede the EventDeleted of their pop
+	// when both are received at once. Watch errors are set in
+	// 'Event.Error'. The watcher is closed when the context is canceled,
+	// or when it is evicted as slow consumer (see 'EvictSlowConsumers').
+	// Use WithNotifyWindow to coalesce rapid updates of the same item.
+	Watch(ctx context.Context, bucket string, opts ...OpOption) EventWatcher
+
+	// WatchFront returns EventWatcher that streams the changes of the
+	// front item of the bucket (see 'Front'), starting from the current
+	// one: EventCreated when an item becomes the front, EventUpdated when
+	// the front item is rewritten, and EventDeleted when the front item
+	// is removed from the bucket.
+	WatchFront(ctx context.Context, bucket string) EventWatcher
+
+	// WatchBucket returns EventWatcher that streams every event of items
+	// in the bucket (add, pop, cancel, complete, and purge), with sensitive
+	// fields redacted (see 'SetRedaction'). Use WithRev to resume from
+	// a revision. Watch errors are set in 'Event.Error'. Progress updates
+	// of in-progress items are not written, so they are not streamed.
+	// Use WithDelta to receive only the changed fields of items.
+	WatchBucket(ctx context.Context, bucket string, opts ...OpOption) EventWatcher
+
+	// Enqueue adds the item as Add, and returns ItemWatcher that streams
+	// its states as WatchItem. A copy of the item with StatusAccepted is
+	// delivered immediately, before the write is committed, so that UIs
+	// show instant feedback; it is not an acknowledgment. On commit, a
+	// copy with StatusAcked is delivered (with the key of the existing
+	// item, if attached by 'Item.IdempotencyKey'), followed by the states
+	// of the item. On rollback, the accepted item is delivered with the
+	// error set in 'Item.Error', and the item is never acknowledged. The
+	// acknowledged item survives server crashes, while items accepted
+	// but not acknowledged may or may not be written. The given item is
+	// not modified. WithNotifyWindow applies to the states following
+	// the acknowledged one.
+	Enqueue(ctx context.Context, item *Item, opts ...OpOption) ItemWatcher
+
+	// WatchItem returns ItemWatcher that streams the states of the item
+	// (see 'Get'), with 'Item.Status' set, starting from its current state.
+	// Watchers of items in the same bucket share one etcd watch, and
+	// watchers of the same item share their states (e.g. duplicate
+	// requests attached by 'Item.IdempotencyKey'). The watcher is closed
+	// after the terminal state, or an error set in 'Item.Error' (e.g.
+	// ErrItemNotFound). Slow consumers lose intermediate states. Use
+	// WithNotifyWindow to coalesce rapid state changes.
+	WatchItem(ctx context.Context, itemKey string, opts ...OpOption) ItemWatcher
+
+	// WatchPreempt returns ItemWatcher that returns the item preempting
+	// the given in-progress item (see 'PriorityClass.Preempts'). On
+	// preemption, workers should checkpoint the item into its Value,
+	// and requeue it with Add (which keeps its original position).
+	WatchPreempt(ctx context.Context, item *Item) ItemWatcher
+
+	// ReadEvents returns journaled queue events from the given revision,
+	// in the order of revision, with sensitive fields redacted (see
+	// 'SetRedaction'). Consumers should resume from the last
+	// returned revision plus one, to read each event exactly once.
+	// Use WithLimit to read the journal in pages.
+	ReadEvents(ctx context.Context, fromRev int64, opts ...OpOption) ([]*Event, error)
+
+	// GCEvents deletes journaled events created before the given
+	// duration, and returns the number of deleted events. Consumers
+	// behind the retention (e.g. audit exporters) miss the deleted events.
+	GCEvents(ctx context.Context, olderThan time.Duration) (int64, error)
+
+	// Complete records the finished (done, failed, or canceled) item
+	// as completed, and removes it from the queue if still pending.
+	// Failed items are requeued instead, with incremented Attempts,
+	// until the bucket retry policy's 'MaxAttempts'. It returns
+	// ErrAlreadyCompleted if the item has been completed.
+	Complete(ctx context.Context, item *Item) error
+
+	// AddCompleteHook registers the hook to be called on Complete,
+	// before the completed item is written.
+	AddCompleteHook(h CompleteHook)
+
+	// AddErrorHook registers the hook to be called with errors of queue
+	// goroutines (e.g. PanicError of watchers, which recover from panics
+	// and send the error to their consumers, instead of crashing).
+	AddErrorHook(h ErrorHook)
+
+	// ListCompleted returns all completed items in the bucket.
+	ListCompleted(ctx context.Context, bucket string) ([]*Item, error)
+
+	// ListCompletedSince returns items completed since the given time,
+	// across all buckets, in the order of completion.
+	ListCompletedSince(ctx context.Context, since time.Time) ([]*Item, error)
+
+	// ListCompletedBefore returns items completed before the given time,
+	// across all buckets, in the order of completion.
+	ListCompletedBefore(ctx context.Context, before time.Time) ([]*Item, error)
+
+	// GCCompleted deletes completed items created before the given duration,
+	// with their annotations and metrics, and returns the number of
+	// deleted items.
+	GCCompleted(ctx context.Context, olderThan time.Duration) (int64, error)
+
+	// DeleteCompleted deletes the completed items (e.g. after archival),
+	// with their annotations and metrics, and returns the number of
+	// deleted items.
+	DeleteCompleted(ctx context.Context, items ...*Item) (int64, error)
+
+	// UpdateProgress updates 'Progress' of the popped item, below
+	// 'MaxProgress' (use Complete). The progress of child items is
+	// aggregated into their parents (see 'Item.ParentKey'), as the average
+	// of all children, so that sharded jobs show one progress.
+	UpdateProgress(ctx context.Context, item *Item) error
+
+	// AppendMetrics appends time-series metrics to the item of the given key.
+	// Metrics of the same epoch and name are overwritten.
+	AppendMetrics(ctx context.Context, itemKey string, ms ...*Metric) error
+
+	// Metrics returns all metrics of the item, sorted by epoch and name.
+	Metrics(ctx context.Context, itemKey string) ([]*Metric, error)
+
+	// Annotate attaches the timestamped note to the item (e.g. on-call
+	// notes), kept until the completed item is deleted. It returns
+	// ErrItemNotFound if the item does not exist.
+	Annotate(ctx context.Context, itemKey string, a *Annotation) error
+
+	// Annotations returns the annotations of the item, in the order of time.
+	Annotations(ctx context.Context, itemKey string) ([]*Annotation, error)
+
+	// FanOut adds the items (shards) to the bucket, labeled with a new
+	// fan-out ID (see 'FanOutLabel'), and returns JoinHandle to wait for
+	// all shards to finish (e.g. sharded inference over large datasets).
+	// With 'WithJoinItem', the join item is enqueued once all shards are
+	// completed, failed, or canceled.
+	FanOut(ctx context.Context, bucket string, items []*Item, opts ...OpOption) (*JoinHandle, error)
+
+	// Join returns JoinHandle of the fan-out ID (e.g. from the label of
+	// the join item).
+	Join(ctx context.Context, id string) (*JoinHandle, error)
+
+	// Lineage returns the lineage graph of the item (see 'Item.ParentKey'),
+	// from its oldest existing ancestor down to all descendants, with
+	// 'Item.ChildKeys' set, to debug pipeline runs.
+	Lineage(ctx context.Context, itemKey string) (*LineageNode, error)
+
+	// RegisterWorker adds the worker ID with its capabilities to the
+	// worker registry, kept alive until Close, or for 'WorkerTTL' if the
+	// worker crashes. Items with affinity to a registered worker (see
+	// 'Item.AffinityKey') are only popped with its context (see
+	// 'Worker.Context'), which only pops items the worker accepts. It
+	// returns ErrWorkerExists if the ID is already registered.
+	RegisterWorker(ctx context.Context, id string, caps Capabilities) (*Worker, error)
+
+	// Workers returns the registered workers.
+	Workers(ctx context.Context) ([]WorkerInfo, error)
+
+	// Lock blocks until it acquires the distributed lock of the name,
+	// to serialize access to shared resources (e.g. a single GPU) across
+	// workers. The lock is held until Unlock, or its lease expires.
+	Lock(ctx context.Context, name string) (*Mutex, error)
+
+	// Watchers returns all active watch registrations and goroutine
+	// counts, to debug goroutine leaks from watchers whose consumers
+	// went away. Use WithConsumer to label watch registrations.
+	Watchers() WatcherStats
+
+	// Stop stops the queue service and any embedded clients, and waits
+	// for background goroutines to exit. Watchers are closed, pending
+	// coalesced Adds fail, and operations after Stop fail fast with
+	// ErrQueueClosed. Stop is safe to call more than once.
 	Stop()
 
 	// Client returns the client.
@@ -150,12 +622,55 @@ type Queue interface {
 type queue struct {
 	writemu    sync.RWMutex
 	cli        *clientv3.Client
+	clock      Clock
+	kv         clientv3.KV
+	breaker    *breaker
+	lc         *lifecycle
 	rootCtx    context.Context
 	rootCancel func()
+
+	// readOnly is true for queues created by NewReadOnlyQueue.
+	readOnly bool
+
+	configmu sync.RWMutex
+	configs  map[string]BucketConfig
+	limitmu  sync.Mutex
+	limiters map[string]*rateLimiter
+	policymu sync.RWMutex
+	policy   BucketPolicy
+	limitsmu sync.RWMutex
+	limits   Limits
+
+	hooksmu       sync.RWMutex
+	completeHooks []CompleteHook
+	errorHooks    []ErrorHook
+
+	watchmu        sync.Mutex
+	watchID        int64
+	watchers       map[int64]*watcher
+	watchReaped    int64
+	watchEvicted   int64
+	watchRoutines  int64
+	watchReaperRun sync.Once
+
+	itemWatchmu sync.Mutex
+	itemMux     *itemMux
+
+	coalescer coalescer
+	front     frontCache
+	eta       etaCache
 }
 
-// NewQueue creates a new queue from given etcd client.
-func NewQueue(cli *clientv3.Client) (Queue, error) {
+// NewQueue creates a new queue from given etcd client. It returns
+// IncompatibleClusterError if the etcd cluster is older than
+// 'MinEtcdVersion' or lacks required capabilities, and
+// UnsupportedFeatureError if the data has been written by a newer
+// version of the queue (see 'Feature').
+func NewQueue(cli *clientv3.Client, opts ...QueueOption) (Queue, error) {
+	return newQueue(cli, false, opts...)
+}
+
+func newQueue(cli *clientv3.Client, readOnly bool, opts ...QueueOption) (*queue, error) {
 	// issue linearized read to ensure leader election
 	glog.Infof("GET request to endpoint %v", cli.Endpoints())
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -165,47 +680,328 @@ func NewQueue(cli *clientv3.Client) (Queue, error) {
 	if err != nil {
 		return nil, err
 	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	err = checkCluster(ctx, cli, readOnly)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
 
 	ctx, cancel = context.WithCancel(context.Background())
-	return &queue{
+	lc := &lifecycle{}
+	qu := &queue{
 		cli:        cli,
+		clock:      DefaultClock,
+		lc:         lc,
+		readOnly:   readOnly,
+		limits:     DefaultLimits(),
 		rootCtx:    ctx,
 		rootCancel: cancel,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(qu)
+	}
+	qu.breaker = &breaker{clock: qu.clock}
+	qu.kv = retryKV{kv: cli.KV, br: qu.breaker, lc: lc}
+	if err = qu.initFeatures(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+	if !readOnly {
+		qu.recoverOrphans(OrphanRecovery, OrphanScanDelay)
+		qu.releaseExpired()
+	}
+	return qu, nil
 }
 
 const pfxQueue = "_queue"
 
-func (qu *queue) Add(ctx context.Context, item *Item, opts ...OpOption) error {
+func (qu *queue) Add(ctx context.Context, item *Item, opts ...OpOption) (err error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
 	if item == nil {
 		return fmt.Errorf("received <nil> Item")
 	}
+	if err := checkItemKey(item); err != nil {
+		return err
+	}
+	if !qu.breaker.allow() {
+		return ErrQueueUnavailable
+	}
+
+	if err := qu.checkValueSize(item); err != nil {
+		return err
+	}
+	if err := validateContent(item); err != nil {
+		return err
+	}
+	if err := qu.checkBuckets(ctx, item); err != nil {
+		return err
+	}
+	if err := qu.checkPaused(ctx, item); err != nil {
+		return err
+	}
+	if err := qu.validateItems(ctx, item); err != nil {
+		return err
+	}
+	if err := qu.checkParents(ctx, item); err != nil {
+		return err
+	}
+	if err := qu.resolveAffinity(ctx, item); err != nil {
+		return err
+	}
+
+	// duplicate requests share the item of the same idempotency key
+	if item.IdempotencyKey != "" {
+		attached, err := qu.attachDuplicate(ctx, item)
+		if err != nil || attached {
+			return err
+		}
+	}
+
+	// shadow items are added after 'writemu' is released, and
+	// requeued items are not mirrored again
+	requeued := item.Status != "" && item.Status != StatusPending
+	defer func() {
+		if err == nil && !requeued {
+			qu.addShadows(ctx, item)
+		}
+	}()
+
+	// requeued items (e.g. preempted) move back to pending
+	if err := item.Transition(StatusPending); err != nil {
+		return err
+	}
 
 	ret := Op{}
 	ret.applyOpts(opts)
-
-	queueKey := path.Join(pfxQueue, item.Key)
-	data, err := json.Marshal(item)
+	if err := qu.checkCapacity(ctx, ret.waitCapacity, item); err != nil {
+		return err
+	}
+	data, err := marshalItem(item)
 	if err != nil {
 		return err
 	}
-	queueVal := string(data)
+	if err = qu.checkQuota(ctx, []*Item{item}, [][]byte{data}); err != nil {
+		return err
+	}
+	if err = qu.checkRateLimit(ctx, item); err != nil {
+		return err
+	}
+
+	if item.IdempotencyKey != "" {
+		qu.writemu.Lock()
+		defer qu.writemu.Unlock()
+		return qu.addIdempotent(ctx, item, ret.ttl)
+	}
+	if window := AddCoalesceWindow; window > 0 {
+		return qu.coalesceAdd(ctx, item, data, ret.ttl, window)
+	}
 
 	qu.writemu.Lock()
 	defer qu.writemu.Unlock()
 
-	if err := qu.put(ctx, queueKey, queueVal, ret.ttl); err != nil {
+	err = qu.putItem(ctx, item, ret.ttl, func(data []byte) []clientv3.Op { return qu.addOps(ctx, item, data) })
+	qu.invalidateFront(item.Bucket)
+	if err != nil {
 		return err
 	}
 	glog.Infof("queue: wrote %q with TTL %d", item.Key, ret.ttl)
 	return nil
 }
 
+// MaxBatchSize is the maximum number of items written in one transaction.
+// Each item takes up to five operations (item, its event, indexes and
+// lineage link), and transactions are split earlier to stay within
+// etcd's default '--max-txn-ops' limit of 128.
+const MaxBatchSize = 32
+
+func (qu *queue) AddBatch(ctx context.Context, items []*Item, opts ...OpOption) (err error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if !qu.breaker.allow() {
+		return ErrQueueUnavailable
+	}
+
+	ret := Op{}
+	ret.applyOpts(opts)
+
+	if err := qu.resolveAffinity(ctx, items...); err != nil {
+		return err
+	}
+	vals := make([][]byte, 0, len(items))
+	var fresh []*Item
+	for _, item := range items {
+		if item == nil {
+			return fmt.Errorf("received <nil> Item")
+		}
+		if err := checkItemKey(item); err != nil {
+			return err
+		}
+		if item.IdempotencyKey != "" {
+			return fmt.Errorf("%q has idempotency key %q (use Add)", item.Key, item.IdempotencyKey)
+		}
+		if err := qu.checkValueSize(item); err != nil {
+			return err
+		}
+		if err := validateContent(item); err != nil {
+			return err
+		}
+		if item.Status == "" || item.Status == StatusPending {
+			fresh = append(fresh, item)
+		}
+		if err := item.Transition(StatusPending); err != nil {
+			return err
+		}
+		data, err := marshalItem(item)
+		if err != nil {
+			return err
+		}
+		vals = append(vals, data)
+	}
+	if err := qu.checkBuckets(ctx, items...); err != nil {
+		return err
+	}
+	if err := qu.checkPaused(ctx, items...); err != nil {
+		return err
+	}
+	if err := qu.validateItems(ctx, items...); err != nil {
+		return err
+	}
+	if err := qu.checkParents(ctx, items...); err != nil {
+		return err
+	}
+	if err := qu.checkCapacity(ctx, ret.waitCapacity, items...); err != nil {
+		return err
+	}
+	if err := qu.checkQuota(ctx, items, vals); err != nil {
+		return err
+	}
+	if err := qu.checkRateLimit(ctx, items...); err != nil {
+		return err
+	}
+
+	// shadow items are added after 'writemu' is released
+	defer func() {
+		if err == nil {
+			qu.addShadows(ctx, fresh...)
+		}
+	}()
+
+	qu.writemu.Lock()
+	defer qu.writemu.Unlock()
+
+	// all items share one lease, except items of session buckets
+	var ttlOpts []clientv3.OpOption
+	if ret.ttl > 5 {
+		resp, err := qu.grant(ctx, ret.ttl)
+		if err != nil {
+			return err
+		}
+		ttlOpts = append(ttlOpts, clientv3.WithLease(resp.ID))
+	}
+	putOpts := make(map[string][]clientv3.OpOption)
+	for _, item := range items {
+		if _, ok := putOpts[item.Bucket]; ok {
+			continue
+		}
+		opts, err := qu.leaseOpts(ctx, item.Bucket, 0)
+		if err != nil {
+			return err
+		}
+		if opts == nil {
+			opts = ttlOpts
+		}
+		putOpts[item.Bucket] = opts
+	}
+
+	for i := 0; i < len(items); {
+		// items with lineage links take one more operation, and each
+		// operation but the lineage link writes the encoded item
+		end, nops, nbytes := i, 0, 0
+		for end < len(items) && end-i < MaxBatchSize {
+			n := len(qu.batchOps(ctx, items[end], vals[end], putOpts[items[end].Bucket]))
+			if nops+n+len(sequenceBuckets(items[i:end+1]...))+len(usageKeys(items[i:end+1]...)) > maxTxnOps {
+				break
+			}
+			size := n * len(vals[end])
+			if end > i && nbytes+size > maxTxnBytes {
+				break
+			}
+			nops += n
+			nbytes += size
+			end++
+		}
+		chunk := items[i:end]
+		_, err := qu.sequenceTxn(ctx, chunk, nil, func(vals [][]byte) []clientv3.Op {
+			ops := make([]clientv3.Op, 0, nops)
+			for j, item := range chunk {
+				ops = append(ops, qu.batchOps(ctx, item, vals[j], putOpts[item.Bucket])...)
+			}
+			return ops
+		})
+		for j := i; j < end; j++ {
+			qu.invalidateFront(items[j].Bucket)
+		}
+		if err != nil {
+			return err
+		}
+		i = end
+	}
+	glog.Infof("queue: wrote %d items with TTL %d", len(items), ret.ttl)
+	return nil
+}
+
 func (qu *queue) Pop(ctx context.Context, bucket string) ItemWatcher {
+	cfg, err := qu.bucketConfig(ctx, bucket)
+	if err == nil && cfg.Paused {
+		err = ErrBucketPaused
+	}
+	if err != nil {
+		ch := make(chan *Item, 1)
+		ch <- &Item{Bucket: bucket, Error: err.Error()}
+		close(ch)
+		return ch
+	}
+	if cfg.MaxInFlight == 0 && cfg.ConcurrencyKey == "" {
+		return qu.pop(ctx, bucket)
+	}
+
+	ch := make(chan *Item, 1)
+	ctx, done := qu.trackWatch(ctx, "pop-in-flight", bucketPrefix(bucket))
+	qu.subscribe(ctx, bucket)
+	if !qu.goBackground("pop-in-flight", bucket, func() {
+		defer close(ch)
+		defer done()
+		defer qu.recoverPanic("pop-in-flight", bucket, func(err error) {
+			notifyItem(ch, &Item{Bucket: bucket, Error: err.Error()})
+		})
+
+		if err := qu.waitInFlight(ctx, bucket); err != nil {
+			ch <- &Item{Bucket: bucket, Error: err.Error()}
+			return
+		}
+		if cfg.ConcurrencyKey != "" {
+			item, err := qu.popEligible(ctx, bucket, cfg.ConcurrencyKey)
+			if err != nil {
+				item = &Item{Bucket: bucket, Error: err.Error()}
+			}
+			ch <- item
+			return
+		}
+		ch <- <-qu.pop(ctx, bucket)
+	}) {
+		done()
+		return closedWatcher(bucket)
+	}
+	return ch
+}
+
+func (qu *queue) pop(ctx context.Context, bucket string) ItemWatcher {
 	ch := make(chan *Item, 1)
 
 	pfxQueueBucket := path.Join(pfxQueue, bucket)
-	resp, err := qu.cli.Get(ctx, pfxQueueBucket, clientv3.WithFirstKey()...)
+	resp, err := qu.kv.Get(ctx, pfxQueueBucket, clientv3.WithFirstKey()...)
 	if err != nil {
 		ch <- &Item{Error: err.Error()}
 		close(ch)
@@ -221,12 +1017,31 @@ func (qu *queue) Pop(ctx context.Context, bucket string) ItemWatcher {
 			return ch
 		}
 
+		// items routed to another live worker, or not accepted by the
+		// worker, are skipped
+		ok, err := qu.offerable(ctx, &item)
+		if err != nil {
+			ch <- &Item{Error: err.Error()}
+			close(ch)
+			return ch
+		}
+		if !ok {
+			close(ch)
+			return qu.popEligibleWatcher(ctx, bucket, "")
+		}
+
 		queueKey := path.Join(pfxQueue, item.Key)
-		if _, err = qu.cli.Delete(ctx, queueKey); err != nil {
+		claimed, err := qu.deletePopped(ctx, &item, resp.Kvs[0].ModRevision)
+		if err != nil {
 			ch <- &Item{Error: fmt.Sprintf("failed to delete %q (%v)", queueKey, err)}
 			close(ch)
 			return ch
 		}
+		// lost to another Pop or Cancel
+		if !claimed {
+			close(ch)
+			return qu.popEligibleWatcher(ctx, bucket, "")
+		}
 
 		ch <- &item
 		close(ch)
@@ -234,15 +1049,22 @@ func (qu *queue) Pop(ctx context.Context, bucket string) ItemWatcher {
 	}
 
 	if len(resp.Kvs) == 0 {
+		ctx, done := qu.trackWatch(ctx, "pop", pfxQueueBucket)
 		wch := qu.cli.Watch(ctx, pfxQueueBucket, clientv3.WithPrefix(), clientv3.WithCreatedNotify())
 		if _, ok := <-wch; !ok {
+			done()
 			ch <- &Item{Error: fmt.Sprintf("watch failed to create %q (%v)", pfxQueueBucket, err)}
 			close(ch)
 			return ch
 		}
+		qu.subscribe(ctx, bucket)
 
-		go func() {
+		if !qu.goBackground("pop", bucket, func() {
 			defer close(ch)
+			defer done()
+			defer qu.recoverPanic("pop", bucket, func(err error) {
+				notifyItem(ch, &Item{Bucket: bucket, Error: err.Error()})
+			})
 
 			select {
 			case wresp := <-wch:
@@ -266,17 +1088,39 @@ func (qu *queue) Pop(ctx context.Context, bucket string) ItemWatcher {
 					return
 				}
 
+				if ok, err := qu.offerable(ctx, &item); err != nil || !ok {
+					eligible, err := qu.popEligible(ctx, bucket, "")
+					if err != nil {
+						eligible = &Item{Bucket: bucket, Error: err.Error()}
+					}
+					ch <- eligible
+					return
+				}
+
 				queueKey := path.Join(pfxQueue, item.Key)
-				if _, err := qu.cli.Delete(ctx, queueKey); err != nil {
+				claimed, err := qu.deletePopped(ctx, &item, wresp.Events[0].Kv.ModRevision)
+				if err != nil {
 					ch <- &Item{Error: fmt.Sprintf("failed to delete %q (%v)", queueKey, err)}
 					return
 				}
+				// lost to another Pop or Cancel
+				if !claimed {
+					eligible, err := qu.popEligible(ctx, bucket, "")
+					if err != nil {
+						eligible = &Item{Bucket: bucket, Error: err.Error()}
+					}
+					ch <- eligible
+					return
+				}
 				ch <- &item
 
 			case <-ctx.Done():
 				ch <- &Item{Error: ctx.Err().Error()}
 			}
-		}()
+		}) {
+			done()
+			return closedWatcher(bucket)
+		}
 		return ch
 	}
 
@@ -286,12 +1130,19 @@ func (qu *queue) Pop(ctx context.Context, bucket string) ItemWatcher {
 }
 
 func (qu *queue) Stop() {
-	qu.writemu.Lock()
-	defer qu.writemu.Unlock()
-
+	if !qu.lc.stop() {
+		return
+	}
 	glog.Info("stopping queue")
+	qu.failCoalesced(ErrQueueClosed)
+
+	qu.writemu.Lock()
 	qu.rootCancel()
+	qu.cancelWatchers()
 	qu.cli.Close()
+	qu.writemu.Unlock()
+
+	qu.lc.wait()
 	glog.Info("stopped queue")
 }
 
@@ -303,21 +1154,422 @@ func (qu *queue) ClientEndpoints() []string {
 	return qu.cli.Endpoints()
 }
 
-func (qu *queue) put(ctx context.Context, key, val string, ttl int64) error {
-	var opts []clientv3.OpOption
-	if ttl > 5 {
-		resp, err := qu.cli.Grant(ctx, ttl)
-		if err != nil {
-			return err
-		}
-		leaseID := resp.ID
-		opts = append(opts, clientv3.WithLease(leaseID))
+// putItem writes the pending item with its sequence, with extra
+// operations of the encoded item in the same transaction.
+func (qu *queue) putItem(ctx context.Context, item *Item, ttl int64, extra func(data []byte) []clientv3.Op) error {
+	opts, err := qu.leaseOpts(ctx, item.Bucket, ttl)
+	if err != nil {
+		return err
 	}
-	_, err := qu.cli.Put(ctx, key, val, opts...)
+	_, err = qu.sequenceTxn(ctx, []*Item{item}, nil, func(vals [][]byte) []clientv3.Op {
+		return append([]clientv3.Op{clientv3.OpPut(PendingKey(item.Key), string(vals[0]), opts...)}, extra(vals[0])...)
+	})
 	return err
 }
 
+// addOps returns the operations of the encoded item added with Add,
+// other than its put. Requeued items (e.g. preempted) move back from
+// in-progress.
+func (qu *queue) addOps(ctx context.Context, item *Item, data []byte) []clientv3.Op {
+	ops := append([]clientv3.Op{qu.eventOp(ctx, EventAdd, item.Bucket, item.Key, data)}, indexOps(item, data, StatusPending, StatusInProgress)...)
+	return append(ops, lineageOps(item)...)
+}
+
+// batchOps returns the operations of the encoded item added with AddBatch.
+func (qu *queue) batchOps(ctx context.Context, item *Item, data []byte, opts []clientv3.OpOption) []clientv3.Op {
+	ops := []clientv3.Op{
+		clientv3.OpPut(PendingKey(item.Key), string(data), opts...),
+		qu.eventOp(ctx, EventAdd, item.Bucket, item.Key, data),
+	}
+	ops = append(ops, indexOps(item, data, StatusPending)...)
+	return append(ops, lineageOps(item)...)
+}
+
+// deletePopped deletes the popped item, and records the event of the
+// item claimed, if the item is still pending at the revision of its read.
+// It returns false if another Pop or Cancel has removed the item.
+func (qu *queue) deletePopped(ctx context.Context, item *Item, rev int64) (bool, error) {
+	return qu.claimIf(ctx, item, []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(PendingKey(item.Key)), "=", rev)})
+}
+
+// ClaimTimeout is the timeout of claim transactions. Claims are not
+// canceled with their Pops, so that a Pop canceled while its claim is
+// committed still returns the claimed item, instead of leaving it
+// claimed without a worker.
+var ClaimTimeout = 5 * time.Second
+
+// valueContext is the context with the values of its parent, but
+// without its cancellation.
+type valueContext struct{ context.Context }
+
+func (valueContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valueContext) Done() <-chan struct{}       { return nil }
+func (valueContext) Err() error                  { return nil }
+
+// claimIf is deletePopped, with the extra operations, if the comparisons
+// succeed. It returns false if the comparisons failed.
+func (qu *queue) claimIf(ctx context.Context, item *Item, cmps []clientv3.Cmp, extra ...clientv3.Op) (bool, error) {
+	ctx, cancel := context.WithTimeout(valueContext{ctx}, ClaimTimeout)
+	defer cancel()
+
+	item.Status = StatusClaimed
+	item.ClaimedAt = qu.clock.Now()
+	item.Worker = WorkerFrom(ctx)
+	data, err := marshalItem(item)
+	if err != nil {
+		return false, err
+	}
+	ops := []clientv3.Op{
+		clientv3.OpDelete(path.Join(pfxQueue, item.Key)),
+		qu.eventOp(ctx, EventPop, item.Bucket, item.Key, data),
+	}
+	ops = append(ops, extra...)
+	resp, err := qu.kv.Txn(ctx).If(cmps...).Then(append(ops, indexOps(item, data, StatusInProgress, StatusPending)...)...).Commit()
+	qu.invalidateFront(item.Bucket)
+	if err != nil {
+		return false, err
+	}
+	if resp.Succeeded {
+		observeClaim(item)
+	}
+	return resp.Succeeded, nil
+}
+
 func (qu *queue) delete(ctx context.Context, key string) error {
-	_, err := qu.cli.Delete(ctx, key)
+	_, err := qu.kv.Delete(ctx, key)
 	return err
 }
+
+// bucketPrefix returns the key prefix of all items in the bucket.
+// Trailing slash is needed, so that "a" does not match "ab".
+func bucketPrefix(bucket string) string {
+	return path.Join(pfxQueue, bucket) + "/"
+}
+
+func decodeItem(kv *mvccpb.KeyValue) (*Item, error) {
+	var item Item
+	if err := json.Unmarshal(kv.Value, &item); err != nil {
+		return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", string(kv.Key), string(kv.Value), err)
+	}
+	return &item, nil
+}
+
+func (qu *queue) List(ctx context.Context, bucket string, opts ...OpOption) ([]*Item, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	ret := Op{}
+	ret.applyOpts(opts)
+
+	resp, err := qu.kv.Get(ctx, bucketPrefix(bucket), ret.readOpts(clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))...)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Item, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		item, err := decodeItem(kv)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (qu *queue) Cancel(ctx context.Context, itemKey string, opts ...OpOption) (*Item, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	queueKey := path.Join(pfxQueue, itemKey)
+
+	// joins and parent progress are updated after 'writemu' is released
+	var canceled *Item
+	defer func() {
+		if canceled != nil {
+			qu.fireJoin(ctx, canceled)
+			qu.aggregateProgress(ctx, canceled.ParentKey)
+		}
+	}()
+
+	qu.writemu.Lock()
+	defer qu.writemu.Unlock()
+
+	gresp, err := qu.kv.Get(ctx, queueKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(gresp.Kvs) == 0 {
+		return nil, qu.missingItemError(ctx, itemKey)
+	}
+	item, err := decodeItem(gresp.Kvs[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = item.Transition(StatusCanceled); err != nil {
+		return nil, err
+	}
+	ret := Op{}
+	ret.applyOpts(opts)
+	item.CanceledBy, item.CancelReason = ret.canceledBy, ret.cancelReason
+	item.CanceledAt = qu.clock.Now()
+	data, err := marshalItem(item)
+	if err != nil {
+		return nil, err
+	}
+
+	// the item may be popped concurrently
+	ops := []clientv3.Op{
+		clientv3.OpDelete(queueKey),
+		qu.eventOp(ctx, EventCancel, path.Dir(itemKey), itemKey, nil),
+	}
+	ops = append(ops, idempotencyOps(item)...)
+	ops = append(ops, fanOutOps(item)...)
+	ops = append(ops, childProgressOps(item)...)
+	resp, err := qu.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(queueKey), "=", gresp.Kvs[0].ModRevision)).
+		Then(append(ops, indexOps(item, data, StatusCanceled, StatusPending)...)...).
+		Commit()
+	qu.invalidateFront(item.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, qu.missingItemError(ctx, itemKey)
+	}
+	glog.Infof("queue: canceled %q", itemKey)
+	canceled = item
+	return item, nil
+}
+
+// missingItemError returns ErrCanceled or ErrAlreadyCompleted if the item
+// missing from the queue has been canceled or completed, and otherwise
+// ErrItemNotFound (e.g. popped, or never added).
+func (qu *queue) missingItemError(ctx context.Context, itemKey string) error {
+	resp, err := qu.kv.Txn(ctx).Then(
+		clientv3.OpGet(statusIndexPrefix(StatusCanceled)+itemKey, clientv3.WithCountOnly()),
+		clientv3.OpGet(path.Join(pfxCompleted, itemKey)),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if resp.Responses[0].GetResponseRange().Count > 0 {
+		return ErrCanceled
+	}
+	if kvs := resp.Responses[1].GetResponseRange().Kvs; len(kvs) > 0 {
+		if item, err := decodeItem(kvs[0]); err == nil && item.Canceled {
+			return ErrCanceled
+		}
+		return ErrAlreadyCompleted
+	}
+	return ErrItemNotFound
+}
+
+// BucketStats represents the statistics of a bucket.
+type BucketStats struct {
+	Bucket string `json:"bucket"`
+
+	// Pending is the number of items in the bucket.
+	Pending int64 `json:"pending"`
+
+	// ValueBytes is the total size of item values in the bucket.
+	ValueBytes int64 `json:"value_bytes"`
+
+	// Oldest is the creation time of the oldest item in the bucket.
+	Oldest time.Time `json:"oldest"`
+
+	// Consumers is the number of active subscriptions of the bucket
+	// (e.g. Watch and blocked Pop), across all processes.
+	Consumers int64 `json:"consumers"`
+}
+
+func (qu *queue) Stats(ctx context.Context, bucket string, opts ...OpOption) (BucketStats, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	ret := Op{}
+	ret.applyOpts(opts)
+
+	st := BucketStats{Bucket: bucket}
+	resp, err := qu.kv.Get(ctx, bucketPrefix(bucket), ret.readOpts(clientv3.WithPrefix())...)
+	if err != nil {
+		return st, err
+	}
+	st.Pending = resp.Count
+	sresp, err := qu.kv.Get(ctx, subscriptionPrefix(bucket), ret.readOpts(clientv3.WithPrefix(), clientv3.WithCountOnly())...)
+	if err != nil {
+		return st, err
+	}
+	st.Consumers = sresp.Count
+	for _, kv := range resp.Kvs {
+		item, err := decodeItem(kv)
+		if err != nil {
+			return st, err
+		}
+		st.ValueBytes += int64(len(item.Value))
+		if st.Oldest.IsZero() || item.CreatedAt.Before(st.Oldest) {
+			st.Oldest = item.CreatedAt
+		}
+	}
+	return st, nil
+}
+
+func (qu *queue) Purge(ctx context.Context, bucket string) (int64, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	qu.writemu.Lock()
+	defer qu.writemu.Unlock()
+
+	defer qu.invalidateFront(bucket)
+
+	// items are released with their pending index entries, if none of
+	// the bucket has been written since read
+	idxPrefix := path.Join(statusIndexPrefix(StatusPending), bucket) + "/"
+	for retry := 0; ; retry++ {
+		resp, err := qu.kv.Get(ctx, bucketPrefix(bucket), clientv3.WithPrefix())
+		if err != nil {
+			return 0, err
+		}
+		items := make([]*Item, 0, len(resp.Kvs))
+		for _, kv := range resp.Kvs {
+			item, err := decodeItem(kv)
+			if err != nil {
+				glog.Warningf("queue: purging malformed item (%v)", err)
+				continue
+			}
+			items = append(items, item)
+		}
+		rev := resp.Header.Revision + 1
+		purged, err := qu.releaseTxn(ctx, items, []clientv3.Cmp{
+			clientv3.Compare(clientv3.ModRevision(bucketPrefix(bucket)), "<", rev).WithPrefix(),
+			clientv3.Compare(clientv3.ModRevision(idxPrefix), "<", rev).WithPrefix(),
+		}, []clientv3.Op{
+			clientv3.OpDelete(bucketPrefix(bucket), clientv3.WithPrefix()),
+			clientv3.OpDelete(idxPrefix, clientv3.WithPrefix()),
+			qu.eventOp(ctx, EventPurge, bucket, "", nil),
+		})
+		if err != nil {
+			return 0, err
+		}
+		if purged {
+			glog.Infof("queue: purged %d items in %q", len(resp.Kvs), bucket)
+			return int64(len(resp.Kvs)), nil
+		}
+		if err = waitConflict(ctx, retry); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (qu *queue) Watch(ctx context.Context, bucket string, opts ...OpOption) EventWatcher {
+	ret := Op{}
+	ret.applyOpts(opts)
+
+	if err := qu.lc.err(); err != nil {
+		return closedEventWatcher(bucket, err)
+	}
+	ch := make(chan *Event, 100)
+
+	pfx := bucketPrefix(bucket)
+	ctx, done := qu.trackWatch(ctx, "watch", pfx)
+	qu.subscribe(ctx, bucket)
+	wch := qu.cli.Watch(ctx, pfx, clientv3.WithPrefix(), clientv3.WithPrevKV())
+	cch := qu.cli.Watch(ctx, completedPrefix(bucket), clientv3.WithPrefix(), clientv3.WithFilterDelete())
+	if !qu.goBackground("watch", bucket, func() {
+		defer close(ch)
+		defer done()
+		defer notifyEvictedEvent(ctx, ch, bucket)
+		defer qu.recoverPanic("watch", bucket, func(err error) {
+			notifyEvent(ch, &Event{Bucket: bucket, Error: err.Error()})
+		})
+
+		for {
+			var (
+				wresp clientv3.WatchResponse
+				ok    bool
+			)
+			select {
+			case wresp, ok = <-wch:
+			case wresp, ok = <-cch:
+			}
+			if !ok {
+				return
+			}
+			if wresp.Err() != nil {
+				sendEvent(ctx, ch, &Event{Bucket: bucket, Error: fmt.Sprintf("%q returned error %v", pfx, wresp.Err())})
+				return
+			}
+			for _, wev := range wresp.Events {
+				ev, err := qu.itemEvent(ctx, bucket, wev)
+				if err != nil {
+					ev = &Event{Bucket: bucket, Rev: wev.Kv.ModRevision, Error: err.Error()}
+				}
+				if ev == nil {
+					continue
+				}
+				if !sendEvent(ctx, ch, ev) {
+					return
+				}
+			}
+		}
+	}) {
+		done()
+		return closedEventWatcher(bucket, ErrQueueClosed)
+	}
+	return qu.coalesceEvents(ctx, ch, ret.notifyWindow)
+}
+
+// itemEvent returns the typed event of the change of the item in the
+// bucket, or <nil> if the change is streamed by another event (e.g.
+// the removal of the item completed without being popped). Removals
+// are classified by the keys written in the same transaction.
+func (qu *queue) itemEvent(ctx context.Context, bucket string, wev *clientv3.Event) (*Event, error) {
+	key := string(wev.Kv.Key)
+	if strings.HasPrefix(key, pfxCompleted+"/") {
+		item, err := decodeItem(wev.Kv)
+		if err != nil {
+			return nil, err
+		}
+		ev := &Event{Type: EventCompleted, Bucket: bucket, Key: item.Key, Item: item, Rev: wev.Kv.ModRevision}
+		if item.Canceled {
+			ev.Type = EventCanceled
+		}
+		return ev, nil
+	}
+
+	itemKey := strings.TrimPrefix(key, pfxQueue+"/")
+	if wev.Type == mvccpb.PUT {
+		item, err := decodeItem(wev.Kv)
+		if err != nil {
+			return nil, err
+		}
+		ev := &Event{Type: EventUpdated, Bucket: bucket, Key: itemKey, Item: item, Rev: wev.Kv.ModRevision}
+		if wev.IsCreate() {
+			ev.Type = EventCreated
+		}
+		return ev, nil
+	}
+
+	ev := &Event{Type: EventDeleted, Bucket: bucket, Key: itemKey, Rev: wev.Kv.ModRevision}
+	if wev.PrevKv != nil {
+		item, err := decodeItem(wev.PrevKv)
+		if err != nil {
+			return nil, err
+		}
+		ev.Item = item
+	}
+	resp, err := qu.kv.Txn(ctx).Then(
+		clientv3.OpGet(path.Join(pfxCompleted, itemKey), clientv3.WithRev(ev.Rev)),
+		clientv3.OpGet(statusIndexPrefix(StatusCanceled)+itemKey, clientv3.WithRev(ev.Rev)),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 && kvs[0].ModRevision == ev.Rev {
+		return nil, nil
+	}
+	if kvs := resp.Responses[1].GetResponseRange().Kvs; len(kvs) > 0 && kvs[0].ModRevision == ev.Rev {
+		ev.Type = EventCanceled
+		var ent IndexEntry
+		if err = json.Unmarshal(kvs[0].Value, &ent); err == nil && ent.Item != nil {
+			ev.Item = ent.Item
+		}
+	}
+	return ev, nil
+}
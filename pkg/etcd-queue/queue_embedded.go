@@ -20,11 +20,26 @@ type embeddedQueue struct {
 // NewEmbeddedQueue starts a new embedded etcd server.
 // cport is the TCP port used for etcd client request serving.
 // pport is for etcd peer traffic, and still needed even if it's a single-node cluster.
-func NewEmbeddedQueue(ctx context.Context, cport, pport int, dataDir string) (Queue, error) {
-	cfg := embed.NewConfig()
+func NewEmbeddedQueue(ctx context.Context, cport, pport int, dataDir string, opts ...QueueOption) (Queue, error) {
+	cfg := embedConfig("etcd-queue", cport, pport, dataDir)
 	cfg.ClusterState = embed.ClusterStateFlagNew
+	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, cfg.APUrls[0].String())
+	return startEmbedded(ctx, cfg, opts...)
+}
 
-	cfg.Name = "etcd-queue"
+// JoinEmbeddedQueue starts an embedded etcd server as a new member of
+// the existing cluster, with the initial cluster returned by AddMember.
+// The name must be the one given to AddMember.
+func JoinEmbeddedQueue(ctx context.Context, name string, cport, pport int, dataDir, initialCluster string, opts ...QueueOption) (Queue, error) {
+	cfg := embedConfig(name, cport, pport, dataDir)
+	cfg.ClusterState = embed.ClusterStateFlagExisting
+	cfg.InitialCluster = initialCluster
+	return startEmbedded(ctx, cfg, opts...)
+}
+
+func embedConfig(name string, cport, pport int, dataDir string) *embed.Config {
+	cfg := embed.NewConfig()
+	cfg.Name = name
 	cfg.Dir = dataDir
 
 	curl := url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", cport)}
@@ -33,12 +48,14 @@ func NewEmbeddedQueue(ctx context.Context, cport, pport int, dataDir string) (Qu
 	purl := url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", pport)}
 	cfg.APUrls, cfg.LPUrls = []url.URL{purl}, []url.URL{purl}
 
-	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, cfg.APUrls[0].String())
-
 	cfg.AutoCompactionMode = compactor.ModePeriodic
 	cfg.AutoCompactionRetention = "1h" // every hour
 	cfg.SnapCount = 1000               // single-node, keep minimum snapshot
+	return cfg
+}
 
+func startEmbedded(ctx context.Context, cfg *embed.Config, opts ...QueueOption) (Queue, error) {
+	curl := cfg.ACUrls[0]
 	glog.Infof("starting %q with endpoint %q", cfg.Name, curl.String())
 	srv, err := embed.StartEtcd(cfg)
 	if err != nil {
@@ -54,6 +71,7 @@ func NewEmbeddedQueue(ctx context.Context, cport, pport int, dataDir string) (Qu
 		err = ctx.Err()
 	}
 	if err != nil {
+		srv.Close()
 		return nil, err
 	}
 	glog.Infof("started %q with endpoint %q", cfg.Name, curl.String())
@@ -66,14 +84,30 @@ func NewEmbeddedQueue(ctx context.Context, cport, pport int, dataDir string) (Qu
 	glog.Infof("sent GET to endpoint %q (error: %v)", curl.String(), err)
 
 	cctx, cancel := context.WithCancel(ctx)
-	return &embeddedQueue{
-		srv: srv,
-		Queue: &queue{
-			cli:        cli,
-			rootCtx:    cctx,
-			rootCancel: cancel,
-		},
-	}, err
+	lc := &lifecycle{}
+	qu := &queue{
+		cli:        cli,
+		clock:      DefaultClock,
+		lc:         lc,
+		limits:     DefaultLimits(),
+		rootCtx:    cctx,
+		rootCancel: cancel,
+	}
+	for _, opt := range opts {
+		opt(qu)
+	}
+	qu.breaker = &breaker{clock: qu.clock}
+	qu.kv = retryKV{kv: cli.KV, br: qu.breaker, lc: lc}
+	if err == nil {
+		if err = qu.initFeatures(cctx); err != nil {
+			cancel()
+			srv.Close()
+			return nil, err
+		}
+		qu.recoverOrphans(OrphanRecovery, OrphanScanDelay)
+		qu.releaseExpired()
+	}
+	return &embeddedQueue{srv: srv, Queue: qu}, err
 }
 
 func (qu *embeddedQueue) Stop() {
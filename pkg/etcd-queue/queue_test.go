@@ -2,8 +2,10 @@ package etcdqueue
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -131,3 +133,356 @@ func TestQueue(t *testing.T) {
 	default:
 	}
 }
+
+func TestQueueList(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	testBucket := "test-bucket"
+
+	item, err := qu.Front(context.Background(), testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != nil {
+		t.Fatalf("unexpected front item %+v", item)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := qu.Watch(ctx, testBucket)
+
+	item1 := CreateItem(testBucket, 1000, "test-data-1")
+	item2 := CreateItem(testBucket, 9000, "test-data-2")
+	item3 := CreateItem(testBucket+"2", 9000, "test-data-3")
+	for _, it := range []*Item{item1, item2, item3} {
+		if err = qu.Add(context.Background(), it); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range []*Item{item1, item2} {
+		select {
+		case ev := <-wch:
+			if ev.Type != EventCreated {
+				t.Fatalf("expected %q event, got %+v", EventCreated, ev)
+			}
+			if err = expected.Equal(ev.Item); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("expected watch events, but got none")
+		}
+	}
+
+	item, err = qu.Front(context.Background(), testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = item2.Equal(item); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := qu.List(context.Background(), testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Key != item2.Key || items[1].Key != item1.Key {
+		t.Fatalf("unexpected items %+v", items)
+	}
+
+	st, err := qu.Stats(context.Background(), testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Pending != 2 || st.ValueBytes != 22 || !st.Oldest.Equal(item1.CreatedAt) {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	canceled, err := qu.Cancel(context.Background(), item2.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !canceled.Canceled || canceled.Key != item2.Key {
+		t.Fatalf("unexpected canceled item %+v", canceled)
+	}
+	if _, err = qu.Cancel(context.Background(), item2.Key); err == nil {
+		t.Fatal("expected error on canceling missing item")
+	}
+
+	n, err := qu.Purge(context.Background(), testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 purged item, got %d", n)
+	}
+	items, err = qu.List(context.Background(), testBucket+"2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected other bucket untouched, got %+v", items)
+	}
+}
+
+func TestQueueAddBatch(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	testBucket := "test-bucket"
+
+	items := make([]*Item, 2*MaxBatchSize+1)
+	for i := range items {
+		items[i] = CreateItem(testBucket, 100, "test-data")
+	}
+	if err = qu.AddBatch(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	st, err := qu.Stats(context.Background(), testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Pending != int64(len(items)) {
+		t.Fatalf("expected %d items, got %+v", len(items), st)
+	}
+
+	if err = qu.AddBatch(context.Background(), []*Item{CreateItem(testBucket, 100, "test-data"), nil}); err == nil {
+		t.Fatal("expected error on <nil> item")
+	}
+}
+
+func TestQueueWatchEvents(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := qu.Watch(ctx, "test-bucket")
+
+	item1 := CreateItem("test-bucket", 100, "a")
+	item2 := CreateItem("test-bucket", 100, "b")
+	item3 := CreateItem("test-bucket", 100, "c")
+	for _, it := range []*Item{item1, item2, item3} {
+		if err = qu.Add(ctx, it); err != nil {
+			t.Fatal(err)
+		}
+		expectEvent(t, wch, EventCreated, it.Key)
+	}
+
+	item1.Value = "a2"
+	if err = qu.Add(ctx, item1); err != nil {
+		t.Fatal(err)
+	}
+	if ev := expectEvent(t, wch, EventUpdated, item1.Key); ev.Item.Value != "a2" {
+		t.Fatalf("expected updated value, got %+v", ev.Item)
+	}
+
+	if _, err = qu.Cancel(ctx, item2.Key); err != nil {
+		t.Fatal(err)
+	}
+	if ev := expectEvent(t, wch, EventCanceled, item2.Key); !ev.Item.Canceled {
+		t.Fatalf("expected canceled item, got %+v", ev.Item)
+	}
+
+	// completing a pending item is streamed once, by its completion
+	item3.Canceled = true
+	if err = qu.Complete(ctx, item3); err != nil {
+		t.Fatal(err)
+	}
+	if ev := expectEvent(t, wch, EventCanceled, item3.Key); ev.Item.CompletedAt.IsZero() {
+		t.Fatalf("expected completed item, got %+v", ev.Item)
+	}
+
+	popped := <-qu.Pop(ctx, "test-bucket")
+	if popped.Error != "" {
+		t.Fatal(popped.Error)
+	}
+	ev := expectEvent(t, wch, EventDeleted, item1.Key)
+	if ev.Item == nil || ev.Item.Value != "a2" || ev.Rev == 0 {
+		t.Fatalf("expected deleted item with revision, got %+v", ev)
+	}
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	if ev2 := expectEvent(t, wch, EventCompleted, item1.Key); ev2.Rev <= ev.Rev {
+		t.Fatalf("expected revision after %d, got %d", ev.Rev, ev2.Rev)
+	}
+}
+
+func expectEvent(t *testing.T, wch EventWatcher, tp EventType, key string) *Event {
+	select {
+	case ev := <-wch:
+		if ev.Type != tp || ev.Key != key || ev.Error != "" {
+			t.Fatalf("expected %q event of %q, got %+v", tp, key, ev)
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("took too long to receive %q event of %q", tp, key)
+	}
+	return nil
+}
+
+func TestQueuePopConcurrent(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	const n = 20
+	items := make([]*Item, 0, n)
+	for i := 0; i < n; i++ {
+		items = append(items, CreateItem("test-bucket", 100, fmt.Sprintf("%d", i)))
+	}
+	if err = qu.AddBatch(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	// twice as many Pops as items, racing on the front item
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	popped := make(chan *Item, 2*n)
+	var wg sync.WaitGroup
+	for i := 0; i < 2*n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			popped <- <-qu.Pop(ctx, "test-bucket")
+		}()
+	}
+	time.Sleep(time.Second)
+	cancel()
+	wg.Wait()
+	close(popped)
+
+	seen := make(map[string]bool)
+	for item := range popped {
+		if item == nil || item.Error != "" {
+			continue
+		}
+		if seen[item.Key] {
+			t.Fatalf("%q popped twice", item.Key)
+		}
+		seen[item.Key] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("expected %d items popped, got %d", n, len(seen))
+	}
+}
+
+func TestQueueClaimIf(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	eq, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eq.Stop()
+	qu := eq.(*embeddedQueue).Queue.(*queue)
+
+	ctx := context.Background()
+	readRev := func(item *Item) int64 {
+		resp, err := qu.kv.Get(ctx, PendingKey(item.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) != 1 {
+			t.Fatalf("expected %q pending", item.Key)
+		}
+		return resp.Kvs[0].ModRevision
+	}
+
+	// Pops do not revive items canceled after their reads
+	item := CreateItem("test-bucket", 100, "a")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	rev := readRev(item)
+	if _, err = qu.Cancel(ctx, item.Key); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := qu.deletePopped(ctx, item, rev); err != nil || claimed {
+		t.Fatalf("expected canceled item not claimed, got %v (%v)", claimed, err)
+	}
+	if ent, err := qu.Get(ctx, item.Key); err != nil || ent.Status != StatusCanceled {
+		t.Fatalf("expected %q, got %+v (%v)", StatusCanceled, ent, err)
+	}
+
+	// Pops do not claim items rewritten after their reads
+	item = CreateItem("test-bucket", 100, "b")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	rev = readRev(item)
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := qu.deletePopped(ctx, item, rev); err != nil || claimed {
+		t.Fatalf("expected rewritten item not claimed, got %v (%v)", claimed, err)
+	}
+
+	// claims are committed, even if the Pop is canceled
+	rev = readRev(item)
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if claimed, err := qu.deletePopped(cctx, item, rev); err != nil || !claimed {
+		t.Fatalf("expected item claimed, got %v (%v)", claimed, err)
+	}
+	if ent, err := qu.Get(ctx, item.Key); err != nil || ent.Status != StatusClaimed {
+		t.Fatalf("expected %q, got %+v (%v)", StatusClaimed, ent, err)
+	}
+}
@@ -0,0 +1,139 @@
+package queuetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// Disruption is a disruption of the etcd cluster of a queue.
+type Disruption string
+
+const (
+	// Compaction compacts etcd history up to the current revision, so
+	// that watches resumed from earlier revisions fail as compacted.
+	Compaction Disruption = "compaction"
+
+	// LeaderFailover transfers the leadership to another member, and
+	// waits until the new leader is elected.
+	LeaderFailover Disruption = "leader-failover"
+)
+
+// ErrSingleMember is returned by Disrupt on LeaderFailover, when the
+// cluster has no other member to transfer the leadership to (e.g. the
+// embedded queue).
+var ErrSingleMember = errors.New("queuetest: leader failover requires more than one member")
+
+// FailoverTimeout is how long LeaderFailover waits for the new leader.
+var FailoverTimeout = 10 * time.Second
+
+// Disrupt applies the disruptions to the etcd cluster of the queue, in
+// order. Consumers run it while their workers and watchers are running,
+// and then check that the work is still done:
+//
+//	if err := queuetest.Disrupt(ctx, qu, queuetest.Compaction, queuetest.LeaderFailover); err != nil {
+//		t.Fatal(err)
+//	}
+func Disrupt(ctx context.Context, qu etcdqueue.Queue, ds ...Disruption) error {
+	cli := qu.Client()
+	for _, d := range ds {
+		var err error
+		switch d {
+		case Compaction:
+			err = compact(ctx, cli)
+		case LeaderFailover:
+			err = failover(ctx, cli)
+		default:
+			err = fmt.Errorf("queuetest: unknown disruption %q", d)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compact(ctx context.Context, cli *clientv3.Client) error {
+	resp, err := cli.Get(ctx, "foo")
+	if err != nil {
+		return err
+	}
+	rev := resp.Header.Revision
+	if _, err = cli.Compact(ctx, rev, clientv3.WithCompactPhysical()); err != nil {
+		return fmt.Errorf("failed to compact revision %d (%v)", rev, err)
+	}
+	glog.Infof("queuetest: compacted revision %d", rev)
+	return nil
+}
+
+func failover(ctx context.Context, cli *clientv3.Client) error {
+	mresp, err := cli.MemberList(ctx)
+	if err != nil {
+		return err
+	}
+	if len(mresp.Members) < 2 {
+		return ErrSingleMember
+	}
+	leader, err := leaderID(ctx, cli)
+	if err != nil {
+		return err
+	}
+	var from []string
+	var to uint64
+	for _, m := range mresp.Members {
+		switch {
+		case m.ID == leader:
+			from = m.ClientURLs
+		case to == 0:
+			to = m.ID
+		}
+	}
+	if len(from) == 0 {
+		return fmt.Errorf("leader %x not found in members", leader)
+	}
+
+	// only the leader accepts the transfer
+	lcli, err := clientv3.New(clientv3.Config{Endpoints: from, DialTimeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to connect to leader %q (%v)", from, err)
+	}
+	defer lcli.Close()
+	if _, err = lcli.MoveLeader(ctx, to); err != nil {
+		return fmt.Errorf("failed to move leader %x to %x (%v)", leader, to, err)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, FailoverTimeout)
+	defer cancel()
+	for {
+		id, err := leaderID(tctx, cli)
+		if err == nil && id == to {
+			glog.Infof("queuetest: moved leader %x to %x", leader, to)
+			return nil
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-tctx.Done():
+			return fmt.Errorf("leader %x not elected (%v)", to, tctx.Err())
+		}
+	}
+}
+
+// leaderID returns the member ID of the leader, as seen by the first
+// endpoint of the client.
+func leaderID(ctx context.Context, cli *clientv3.Client) (uint64, error) {
+	eps := cli.Endpoints()
+	if len(eps) == 0 {
+		return 0, fmt.Errorf("no endpoint to query leader")
+	}
+	resp, err := cli.Status(ctx, eps[0])
+	if err != nil {
+		return 0, err
+	}
+	return resp.Leader, nil
+}
@@ -0,0 +1,71 @@
+package queuetest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func TestDisrupt(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := etcdqueue.NewEmbeddedQueue(context.Background(), 43379, 43380, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	item1 := etcdqueue.CreateItem("disrupt", 100, "before")
+	if err = qu.Add(ctx, item1); err != nil {
+		t.Fatal(err)
+	}
+	w := qu.WatchItem(ctx, item1.Key)
+
+	if err = Disrupt(ctx, qu, Compaction); err != nil {
+		t.Fatal(err)
+	}
+	if err = Disrupt(ctx, qu, LeaderFailover); err != ErrSingleMember {
+		t.Fatalf("expected %v, got %v", ErrSingleMember, err)
+	}
+	if err = Disrupt(ctx, qu, "partition"); err == nil {
+		t.Fatal("expected error on unknown disruption")
+	}
+
+	// queue keeps working on compacted history
+	item2 := etcdqueue.CreateItem("disrupt", 100, "after")
+	if err = qu.Add(ctx, item2); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []*etcdqueue.Item{item1, item2} {
+		popped := <-qu.Pop(ctx, "disrupt")
+		if popped == nil || popped.Err() != nil || popped.Key != expected.Key {
+			t.Fatalf("expected %q, got %+v", expected.Key, popped)
+		}
+		popped.Progress = etcdqueue.MaxProgress
+		if err = qu.Complete(ctx, popped); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// watch started before compaction still receives updates
+	for item := range w {
+		if item.Err() != nil {
+			t.Fatal(item.Err())
+		}
+		if item.Progress == etcdqueue.MaxProgress {
+			return
+		}
+	}
+	t.Fatal("watcher closed before completion")
+}
@@ -0,0 +1,3 @@
+// Package queuetest provides helpers for testing queue consumers against
+// etcd disruptions, such as history compaction and leader failover.
+package queuetest
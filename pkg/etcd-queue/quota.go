@@ -0,0 +1,438 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/golang/glog"
+)
+
+// Usage is the storage usage of an owner or a bucket.
+type Usage struct {
+	// Items is the number of stored items.
+	Items int64 `json:"items"`
+
+	// Bytes is the total size of stored items, in JSON.
+	Bytes int64 `json:"bytes"`
+}
+
+// Quota limits the storage usage of an owner, so that one tenant
+// cannot consume the entire etcd backend quota.
+type Quota struct {
+	// MaxBytes is the maximum total size of items. Zero means no limit.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+// QuotaExceededError is returned when adding items would exceed
+// the quota of the owner, or 'MaxBytes' of the bucket.
+type QuotaExceededError struct {
+	// Owner is the owner over quota, or empty if Bucket is over quota.
+	Owner  string
+	Bucket string
+	Usage  int64
+	Limit  int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.Owner != "" {
+		return fmt.Sprintf("queue: owner %q exceeded its quota (%d of %d bytes used)", e.Owner, e.Usage, e.Limit)
+	}
+	return fmt.Sprintf("queue: %q exceeded its quota (%d of %d bytes used)", e.Bucket, e.Usage, e.Limit)
+}
+
+// IsQuotaExceeded returns true if the error is QuotaExceededError.
+func IsQuotaExceeded(err error) bool {
+	_, ok := err.(*QuotaExceededError)
+	return ok
+}
+
+const pfxQuota = "_quota"
+
+// quotaKey returns the quota key of the owner, or the default
+// quota key if the owner is empty.
+func quotaKey(owner string) string {
+	if owner == "" {
+		return path.Join(pfxQuota, "default")
+	}
+	return path.Join(pfxQuota, "owner", owner)
+}
+
+func (qu *queue) SetOwnerQuota(ctx context.Context, owner string, q Quota) error {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if q.MaxBytes < 0 {
+		return fmt.Errorf("invalid negative quota %+v", q)
+	}
+	if q == (Quota{}) {
+		_, err := qu.kv.Delete(ctx, quotaKey(owner))
+		return err
+	}
+	data, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	_, err = qu.kv.Put(ctx, quotaKey(owner), string(data))
+	return err
+}
+
+func (qu *queue) OwnerQuota(ctx context.Context, owner string) (Quota, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	var q Quota
+	resp, err := qu.kv.Get(ctx, quotaKey(owner))
+	if err != nil {
+		return q, err
+	}
+	if len(resp.Kvs) == 0 {
+		if owner != "" {
+			return qu.OwnerQuota(ctx, "")
+		}
+		return q, nil
+	}
+	if err = json.Unmarshal(resp.Kvs[0].Value, &q); err != nil {
+		return q, fmt.Errorf("%q returned wrong JSON %q (%v)", quotaKey(owner), string(resp.Kvs[0].Value), err)
+	}
+	return q, nil
+}
+
+func (qu *queue) OwnerUsage(ctx context.Context, owner string) (Usage, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	return qu.readUsage(ctx, ownerUsageKey(owner))
+}
+
+func (qu *queue) BucketUsage(ctx context.Context, bucket string) (Usage, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	return qu.readUsage(ctx, bucketUsageKey(bucket))
+}
+
+func (qu *queue) readUsage(ctx context.Context, key string) (Usage, error) {
+	c := &usageCounters{keys: []string{key}}
+	resp, err := qu.kv.Get(ctx, key)
+	if err != nil {
+		return Usage{}, err
+	}
+	if err = c.set(key, resp.Kvs); err != nil {
+		return Usage{}, err
+	}
+	return c.usage[key], nil
+}
+
+// pfxUsage is the prefix of the usage counters of owners and buckets,
+// holding the JSON-encoded Usage of their stored items:
+//
+//	_usage/owner/<owner> = <Usage>
+//	_usage/bucket/<bucket> = <Usage>
+//
+// Items are charged their encoded size on Add (see 'Item.Charged'), in
+// the same transaction as their writes, and released when deleted.
+// Purged items are released by Purge, and expired pending items when
+// their stale index entries are deleted (see 'releaseExpired').
+const pfxUsage = "_usage"
+
+func ownerUsageKey(owner string) string {
+	return path.Join(pfxUsage, "owner", owner)
+}
+
+func bucketUsageKey(bucket string) string {
+	return path.Join(pfxUsage, "bucket", bucket)
+}
+
+// usageKeys returns the usage counter keys of the items: of their
+// buckets, and of their owners if any.
+func usageKeys(items ...*Item) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, item := range items {
+		for _, key := range []string{bucketUsageKey(item.Bucket), ownerUsageKey(item.Owner)} {
+			if key == ownerUsageKey("") || seen[key] {
+				continue
+			}
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// usageCounters is the usage counters read at their revisions, to be
+// updated in one transaction with the items charged or released.
+type usageCounters struct {
+	keys  []string
+	usage map[string]Usage
+	revs  map[string]int64
+
+	// added is the bytes added to the counters since read
+	added map[string]int64
+}
+
+func newUsageCounters(items ...*Item) *usageCounters {
+	return &usageCounters{keys: usageKeys(items...)}
+}
+
+// gets returns the operations reading the counters.
+func (c *usageCounters) gets() []clientv3.Op {
+	ops := make([]clientv3.Op, len(c.keys))
+	for i, key := range c.keys {
+		ops[i] = clientv3.OpGet(key)
+	}
+	return ops
+}
+
+// set records the counter read from the key-values.
+func (c *usageCounters) set(key string, kvs []*mvccpb.KeyValue) error {
+	if c.usage == nil {
+		c.usage = make(map[string]Usage, len(c.keys))
+		c.revs = make(map[string]int64, len(c.keys))
+	}
+	var u Usage
+	if len(kvs) > 0 {
+		if err := json.Unmarshal(kvs[0].Value, &u); err != nil {
+			return fmt.Errorf("%q returned wrong JSON %q (%v)", key, string(kvs[0].Value), err)
+		}
+		c.revs[key] = kvs[0].ModRevision
+	}
+	c.usage[key] = u
+	return nil
+}
+
+// read reads the counters.
+func (c *usageCounters) read(ctx context.Context, kv clientv3.KV) error {
+	if len(c.keys) == 0 {
+		return nil
+	}
+	resp, err := kv.Txn(ctx).Then(c.gets()...).Commit()
+	if err != nil {
+		return err
+	}
+	for i, key := range c.keys {
+		if err = c.set(key, resp.Responses[i].GetResponseRange().Kvs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add adds the charge of the item to its counters, or releases it if
+// sign is negative.
+func (c *usageCounters) add(item *Item, sign int64) {
+	if item == nil || item.Charged == 0 {
+		return
+	}
+	if c.usage == nil {
+		c.usage = make(map[string]Usage)
+	}
+	if c.added == nil {
+		c.added = make(map[string]int64)
+	}
+	for _, key := range usageKeys(item) {
+		c.added[key] += sign * item.Charged
+		u := c.usage[key]
+		u.Items += sign
+		u.Bytes += sign * item.Charged
+		if u.Items < 0 || u.Bytes < 0 {
+			u = Usage{}
+		}
+		c.usage[key] = u
+	}
+}
+
+// cmps returns the comparisons that the counters have not been updated
+// since read.
+func (c *usageCounters) cmps() []clientv3.Cmp {
+	cmps := make([]clientv3.Cmp, len(c.keys))
+	for i, key := range c.keys {
+		cmps[i] = clientv3.Compare(clientv3.ModRevision(key), "=", c.revs[key])
+	}
+	return cmps
+}
+
+// puts returns the operations writing the counters.
+func (c *usageCounters) puts() []clientv3.Op {
+	ops := make([]clientv3.Op, 0, len(c.keys))
+	for _, key := range c.keys {
+		u := c.usage[key]
+		if u == (Usage{}) {
+			ops = append(ops, clientv3.OpDelete(key))
+			continue
+		}
+		data, _ := json.Marshal(u)
+		ops = append(ops, clientv3.OpPut(key, string(data)))
+	}
+	return ops
+}
+
+// moved returns true if any counter has been updated since read.
+func (c *usageCounters) moved(ctx context.Context, kv clientv3.KV) (bool, error) {
+	cur := &usageCounters{keys: c.keys}
+	if err := cur.read(ctx, kv); err != nil {
+		return false, err
+	}
+	for _, key := range c.keys {
+		if cur.revs[key] != c.revs[key] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// releaseTxn commits the operations deleting the items, if the
+// comparisons succeed, with their charges released from the usage
+// counters in the same transaction. It retries when counters are updated
+// concurrently (see 'ConflictRetries'), and returns false if the
+// comparisons fail.
+func (qu *queue) releaseTxn(ctx context.Context, items []*Item, cmps []clientv3.Cmp, ops []clientv3.Op) (bool, error) {
+	var charged []*Item
+	for _, item := range items {
+		if item != nil && item.Charged > 0 {
+			charged = append(charged, item)
+		}
+	}
+	for retry := 0; ; retry++ {
+		usage := newUsageCounters(charged...)
+		if err := usage.read(ctx, qu.kv); err != nil {
+			return false, err
+		}
+		for _, item := range charged {
+			usage.add(item, -1)
+		}
+		txnCmps := append(usage.cmps(), cmps...)
+		txnOps := append(append([]clientv3.Op{}, ops...), usage.puts()...)
+		resp, err := qu.kv.Txn(ctx).If(txnCmps...).Then(txnOps...).Commit()
+		if err != nil {
+			return false, err
+		}
+		if resp.Succeeded {
+			return true, nil
+		}
+		moved, err := usage.moved(ctx, qu.kv)
+		if err != nil || !moved {
+			return false, err
+		}
+		if err = waitConflict(ctx, retry); err != nil {
+			return false, err
+		}
+	}
+}
+
+// releaseExpired releases the charges of pending items dropped with
+// their leases, until the queue stops. Other deletes of pending items
+// remove their index entries in the same transactions, so only expired
+// items leave stale entries, released with them. Expiries missed while
+// the watch is down are released when their entries are read.
+func (qu *queue) releaseExpired() {
+	qu.goBackground("release-expired", pfxQueue, func() {
+		for {
+			wch := qu.cli.Watch(qu.rootCtx, pfxQueue+"/", clientv3.WithPrefix(), clientv3.WithFilterPut())
+			for wresp := range wch {
+				if err := wresp.Err(); err != nil {
+					glog.Warningf("queue: expiry watch failed (%v), restarting", err)
+					break
+				}
+				for _, ev := range wresp.Events {
+					key := strings.TrimPrefix(string(ev.Kv.Key), pfxQueue+"/")
+					if err := qu.releaseStale(qu.rootCtx, key); err != nil {
+						glog.Warningf("queue: failed to release expired %q (%v)", key, err)
+					}
+				}
+			}
+			select {
+			case <-qu.clock.After(time.Second):
+			case <-qu.rootCtx.Done():
+				return
+			}
+		}
+	})
+}
+
+// releaseStale deletes the pending index entries of the item, with its
+// charge released, if the item is no longer pending.
+func (qu *queue) releaseStale(ctx context.Context, itemKey string) error {
+	idxKey := statusIndexPrefix(StatusPending) + itemKey
+	resp, err := qu.kv.Get(ctx, idxKey)
+	if err != nil || len(resp.Kvs) == 0 {
+		return err
+	}
+	var ent IndexEntry
+	if err = json.Unmarshal(resp.Kvs[0].Value, &ent); err != nil || ent.Item == nil {
+		return fmt.Errorf("%q returned wrong JSON %q (%v)", idxKey, string(resp.Kvs[0].Value), err)
+	}
+	_, err = qu.deleteStaleIndex(ctx, idxKey, resp.Kvs[0].ModRevision, &ent)
+	return err
+}
+
+// quotaLimit is the quota of an owner, or 'MaxBytes' of a bucket.
+type quotaLimit struct {
+	owner  string
+	bucket string
+	max    int64
+}
+
+// quotaLimits returns the configured quotas of the owners and buckets
+// of the items, by their usage counter keys.
+func (qu *queue) quotaLimits(ctx context.Context, items ...*Item) (map[string]quotaLimit, error) {
+	limits := make(map[string]quotaLimit)
+	for _, item := range items {
+		if key := bucketUsageKey(item.Bucket); limits[key].bucket == "" {
+			cfg, err := qu.bucketConfig(ctx, item.Bucket)
+			if err != nil {
+				return nil, err
+			}
+			limits[key] = quotaLimit{bucket: item.Bucket, max: cfg.MaxBytes}
+		}
+		if key := ownerUsageKey(item.Owner); item.Owner != "" && limits[key].owner == "" {
+			q, err := qu.OwnerQuota(ctx, item.Owner)
+			if err != nil {
+				return nil, err
+			}
+			limits[key] = quotaLimit{owner: item.Owner, max: q.MaxBytes}
+		}
+	}
+	for key, l := range limits {
+		if l.max == 0 {
+			delete(limits, key)
+		}
+	}
+	return limits, nil
+}
+
+// exceeded returns QuotaExceededError if any counter is over its limit,
+// with the usage before the bytes added.
+func (c *usageCounters) exceeded(limits map[string]quotaLimit) error {
+	for _, key := range c.keys {
+		l, ok := limits[key]
+		if !ok || c.usage[key].Bytes <= l.max {
+			continue
+		}
+		return &QuotaExceededError{Owner: l.owner, Bucket: l.bucket, Usage: c.usage[key].Bytes - c.added[key], Limit: l.max}
+	}
+	return nil
+}
+
+// checkQuota returns QuotaExceededError if adding the items, with their
+// encoded values, would exceed the quotas of their owners or buckets.
+// It fails early before any write, while quotas are enforced when the
+// items are charged (see 'sequenceTxn').
+func (qu *queue) checkQuota(ctx context.Context, items []*Item, vals [][]byte) error {
+	limits, err := qu.quotaLimits(ctx, items...)
+	if err != nil || len(limits) == 0 {
+		return err
+	}
+	c := newUsageCounters(items...)
+	if err = c.read(ctx, qu.kv); err != nil {
+		return err
+	}
+	for i, item := range items {
+		if item.Charged == 0 {
+			c.add(&Item{Bucket: item.Bucket, Owner: item.Owner, Charged: int64(len(vals[i]))}, 1)
+		}
+	}
+	return c.exceeded(limits)
+}
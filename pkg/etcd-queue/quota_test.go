@@ -0,0 +1,256 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+func TestQuota(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	newItem := func(bucket, owner string) *Item {
+		item := CreateItem(bucket, 100, strings.Repeat("x", 500))
+		item.Owner = owner
+		return item
+	}
+
+	// default quota applies to owners without quota
+	if err = qu.SetOwnerQuota(ctx, "", Quota{MaxBytes: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.SetOwnerQuota(ctx, "bob", Quota{MaxBytes: 100000}); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := qu.OwnerQuota(ctx, "alice"); err != nil || q.MaxBytes != 2000 {
+		t.Fatalf("expected default quota, got %+v (%v)", q, err)
+	}
+
+	if err = qu.AddBatch(ctx, []*Item{newItem("test-bucket", "alice"), newItem("test-bucket", "alice")}); err != nil {
+		t.Fatal(err)
+	}
+	u, err := qu.OwnerUsage(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Items != 2 || u.Bytes < 1000 || u.Bytes > 2000 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+	if err = qu.Add(ctx, newItem("test-bucket", "alice")); !IsQuotaExceeded(err) {
+		t.Fatalf("expected quota exceeded, got %v", err)
+	}
+	if err = qu.Add(ctx, newItem("test-bucket", "bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	// completed items count until garbage-collected
+	item := <-qu.Pop(ctx, "test-bucket")
+	if err = qu.Complete(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, newItem("test-bucket", "alice")); !IsQuotaExceeded(err) {
+		t.Fatalf("expected quota exceeded, got %v", err)
+	}
+	if _, err = qu.GCCompleted(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, newItem("test-bucket", "alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	// bucket quota
+	bu, err := qu.BucketUsage(ctx, "test-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bu.Items != 3 {
+		t.Fatalf("expected 3 items, got %+v", bu)
+	}
+	cfg := BucketConfig{MaxBytes: bu.Bytes + 100}
+	if err = qu.SetBucketConfig(ctx, "test-bucket", cfg); err != nil {
+		t.Fatal(err)
+	}
+	waitConfig(t, qu, "test-bucket", cfg)
+	err = qu.Add(ctx, newItem("test-bucket", "bob"))
+	if qerr, ok := err.(*QuotaExceededError); !ok || qerr.Bucket != "test-bucket" || qerr.Owner != "" {
+		t.Fatalf("expected bucket quota exceeded, got %v", err)
+	}
+}
+
+func TestQuotaConcurrentAdds(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if err = qu.SetOwnerQuota(ctx, "alice", Quota{MaxBytes: 5000}); err != nil {
+		t.Fatal(err)
+	}
+
+	// adds racing past the quota check are rejected when charged
+	var wg sync.WaitGroup
+	var added, exceeded int64
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item := CreateItem("test-bucket", 100, strings.Repeat("x", 500))
+			item.Owner = "alice"
+			switch err := qu.Add(ctx, item); {
+			case err == nil:
+				atomic.AddInt64(&added, 1)
+			case IsQuotaExceeded(err):
+				atomic.AddInt64(&exceeded, 1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	u, err := qu.OwnerUsage(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Items != added || u.Bytes > 5000 {
+		t.Fatalf("expected %d items within quota, got %+v", added, u)
+	}
+	if added == 0 || exceeded == 0 {
+		t.Fatalf("expected adds within quota, and rejected adds, got %d and %d", added, exceeded)
+	}
+	bu, err := qu.BucketUsage(ctx, "test-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bu != u {
+		t.Fatalf("expected bucket usage %+v, got %+v", u, bu)
+	}
+
+	// charges are released when items are deleted
+	for i := int64(0); i < added; i++ {
+		item := <-qu.Pop(ctx, "test-bucket")
+		if item.Error != "" {
+			t.Fatal(item.Error)
+		}
+		if err = qu.Complete(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = qu.GCCompleted(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if u, err = qu.OwnerUsage(ctx, "alice"); err != nil || u != (Usage{}) {
+		t.Fatalf("expected no usage, got %+v (%v)", u, err)
+	}
+}
+
+func TestQuotaPurgeExpire(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if err = qu.SetOwnerQuota(ctx, "alice", Quota{MaxBytes: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	newItem := func() *Item {
+		item := CreateItem("test-bucket", 100, strings.Repeat("x", 500))
+		item.Owner = "alice"
+		return item
+	}
+	fill := func() {
+		for i := 0; i < 2; i++ {
+			if err := qu.Add(ctx, newItem(), WithTTL(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := qu.Add(ctx, newItem()); !IsQuotaExceeded(err) {
+			t.Fatalf("expected quota exceeded, got %v", err)
+		}
+	}
+
+	// purged items are released
+	fill()
+	if n, err := qu.Purge(ctx, "test-bucket"); err != nil || n != 2 {
+		t.Fatalf("expected 2 items purged, got %d (%v)", n, err)
+	}
+	if u, err := qu.OwnerUsage(ctx, "alice"); err != nil || u != (Usage{}) {
+		t.Fatalf("expected no usage, got %+v (%v)", u, err)
+	}
+	if entries, err := qu.ListByOwner(ctx, "alice"); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no index entries, got %d (%v)", len(entries), err)
+	}
+
+	// expired items are released when their leases drop them
+	fill()
+	eq := qu.(*embeddedQueue).Queue.(*queue)
+	resp, err := eq.kv.Get(ctx, bucketPrefix("test-bucket"), clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range resp.Kvs {
+		if _, err = eq.cli.Revoke(ctx, clientv3.LeaseID(kv.Lease)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		u, err := qu.OwnerUsage(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u == (Usage{}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no usage, got %+v", u)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err = qu.Add(ctx, newItem()); err != nil {
+		t.Fatal(err)
+	}
+}
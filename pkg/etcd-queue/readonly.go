@@ -0,0 +1,161 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// ReadOnlyError is returned when a read-only queue receives a mutation.
+type ReadOnlyError struct {
+	// Op is the rejected operation (e.g. "Add").
+	Op string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("queue: %s is not allowed in read-only mode", e.Op)
+}
+
+// IsReadOnly returns true if the error is ReadOnlyError.
+func IsReadOnly(err error) bool {
+	_, ok := err.(*ReadOnlyError)
+	return ok
+}
+
+// readOnlyQueue serves reads and watches, and rejects mutations.
+type readOnlyQueue struct {
+	*queue
+}
+
+// NewReadOnlyQueue returns a Queue that serves List, Front, Watch and
+// other reads, but rejects mutations with ReadOnlyError (e.g. for
+// dashboards connected to a replica cluster of 'pkg/mirror').
+// Pop is a mutation, so its watcher returns the error in 'Item.Error'.
+func NewReadOnlyQueue(cli *clientv3.Client, opts ...QueueOption) (Queue, error) {
+	qu, err := newQueue(cli, true, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyQueue{queue: qu}, nil
+}
+
+func readOnlyWatcher(bucket, op string) ItemWatcher {
+	ch := make(chan *Item, 1)
+	ch <- &Item{Bucket: bucket, Error: (&ReadOnlyError{Op: op}).Error()}
+	close(ch)
+	return ch
+}
+
+func (qu *readOnlyQueue) Add(ctx context.Context, item *Item, opts ...OpOption) error {
+	return &ReadOnlyError{Op: "Add"}
+}
+
+func (qu *readOnlyQueue) AddBatch(ctx context.Context, items []*Item, opts ...OpOption) error {
+	return &ReadOnlyError{Op: "AddBatch"}
+}
+
+func (qu *readOnlyQueue) Enqueue(ctx context.Context, item *Item, opts ...OpOption) ItemWatcher {
+	return readOnlyWatcher(item.Bucket, "Enqueue")
+}
+
+func (qu *readOnlyQueue) Pop(ctx context.Context, bucket string) ItemWatcher {
+	return readOnlyWatcher(bucket, "Pop")
+}
+
+func (qu *readOnlyQueue) PopBackfill(ctx context.Context, cfg BackfillConfig) ItemWatcher {
+	return readOnlyWatcher(cfg.Bucket, "PopBackfill")
+}
+
+func (qu *readOnlyQueue) SetRedaction(ctx context.Context, bucket string, r Redaction) error {
+	return &ReadOnlyError{Op: "SetRedaction"}
+}
+
+func (qu *readOnlyQueue) RegisterSchema(ctx context.Context, bucket string, schema []byte) error {
+	return &ReadOnlyError{Op: "RegisterSchema"}
+}
+
+func (qu *readOnlyQueue) DeleteSchema(ctx context.Context, bucket string) error {
+	return &ReadOnlyError{Op: "DeleteSchema"}
+}
+
+func (qu *readOnlyQueue) Cancel(ctx context.Context, itemKey string, opts ...OpOption) (*Item, error) {
+	return nil, &ReadOnlyError{Op: "Cancel"}
+}
+
+func (qu *readOnlyQueue) Undelete(ctx context.Context, itemKey string) (*Item, error) {
+	return nil, &ReadOnlyError{Op: "Undelete"}
+}
+
+func (qu *readOnlyQueue) Purge(ctx context.Context, bucket string) (int64, error) {
+	return 0, &ReadOnlyError{Op: "Purge"}
+}
+
+func (qu *readOnlyQueue) Transfer(ctx context.Context, dst Queue, bucket string) (int, error) {
+	return 0, &ReadOnlyError{Op: "Transfer"}
+}
+
+func (qu *readOnlyQueue) Migrate(ctx context.Context, from, to Layout) (int, error) {
+	return 0, &ReadOnlyError{Op: "Migrate"}
+}
+
+func (qu *readOnlyQueue) Complete(ctx context.Context, item *Item) error {
+	return &ReadOnlyError{Op: "Complete"}
+}
+
+func (qu *readOnlyQueue) GCCompleted(ctx context.Context, olderThan time.Duration) (int64, error) {
+	return 0, &ReadOnlyError{Op: "GCCompleted"}
+}
+
+func (qu *readOnlyQueue) GCEvents(ctx context.Context, olderThan time.Duration) (int64, error) {
+	return 0, &ReadOnlyError{Op: "GCEvents"}
+}
+
+func (qu *readOnlyQueue) DeleteCompleted(ctx context.Context, items ...*Item) (int64, error) {
+	return 0, &ReadOnlyError{Op: "DeleteCompleted"}
+}
+
+func (qu *readOnlyQueue) AppendMetrics(ctx context.Context, itemKey string, ms ...*Metric) error {
+	return &ReadOnlyError{Op: "AppendMetrics"}
+}
+
+func (qu *readOnlyQueue) FanOut(ctx context.Context, bucket string, items []*Item, opts ...OpOption) (*JoinHandle, error) {
+	return nil, &ReadOnlyError{Op: "FanOut"}
+}
+
+func (qu *readOnlyQueue) UpdateProgress(ctx context.Context, item *Item) error {
+	return &ReadOnlyError{Op: "UpdateProgress"}
+}
+
+func (qu *readOnlyQueue) Annotate(ctx context.Context, itemKey string, a *Annotation) error {
+	return &ReadOnlyError{Op: "Annotate"}
+}
+
+func (qu *readOnlyQueue) RegisterWorker(ctx context.Context, id string, caps Capabilities) (*Worker, error) {
+	return nil, &ReadOnlyError{Op: "RegisterWorker"}
+}
+
+func (qu *readOnlyQueue) Lock(ctx context.Context, name string) (*Mutex, error) {
+	return nil, &ReadOnlyError{Op: "Lock"}
+}
+
+func (qu *readOnlyQueue) SetBucketConfig(ctx context.Context, bucket string, cfg BucketConfig) error {
+	return &ReadOnlyError{Op: "SetBucketConfig"}
+}
+
+func (qu *readOnlyQueue) SetACL(ctx context.Context, bucket string, acl ACL) error {
+	return &ReadOnlyError{Op: "SetACL"}
+}
+
+func (qu *readOnlyQueue) CreateSessionBucket(ctx context.Context, bucket string) (*SessionBucket, error) {
+	return nil, &ReadOnlyError{Op: "CreateSessionBucket"}
+}
+
+func (qu *readOnlyQueue) CreateBucketFromTemplate(ctx context.Context, bucket string, tmpl BucketTemplate) error {
+	return &ReadOnlyError{Op: "CreateBucketFromTemplate"}
+}
+
+func (qu *readOnlyQueue) SetOwnerQuota(ctx context.Context, owner string, q Quota) error {
+	return &ReadOnlyError{Op: "SetOwnerQuota"}
+}
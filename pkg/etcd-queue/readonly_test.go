@@ -0,0 +1,87 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadOnlyQueue(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	bucket := "read-only-bucket"
+	item := CreateItem(bucket, 100, "data")
+	item.Owner = "alice"
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := NewReadOnlyQueue(qu.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := ro.List(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Key != item.Key {
+		t.Fatalf("expected %q, got %+v", item.Key, items)
+	}
+	front, err := ro.Front(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if front.Key != item.Key {
+		t.Fatalf("expected %q, got %+v", item.Key, front)
+	}
+
+	if err = ro.Add(ctx, CreateItem(bucket, 100, "data")); !IsReadOnly(err) {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+	if _, err = ro.Cancel(ctx, item.Key); !IsReadOnly(err) {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+	if _, err = ro.Purge(ctx, bucket); !IsReadOnly(err) {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+	if popped := <-ro.Pop(ctx, bucket); !strings.Contains(popped.Error, "read-only") {
+		t.Fatalf("expected read-only error, got %+v", popped)
+	}
+
+	// stale index entries are skipped, but not deleted
+	if _, err = qu.Purge(ctx, bucket); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ro.ListByOwner(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no entries, got %+v", entries)
+	}
+	resp, err := qu.Client().Get(ctx, ownerIndexPrefix("alice")+item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 {
+		t.Fatal("read-only queue must not delete stale index entries")
+	}
+}
@@ -0,0 +1,113 @@
+package etcdqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// OrphanPolicy is the action on orphaned items: items in progress,
+// whose workers are no longer in the worker registry (e.g. crashed
+// before a full-system restart). Items popped without a registered
+// worker (see 'WithWorker') are never orphaned.
+type OrphanPolicy string
+
+const (
+	// OrphanIgnore leaves orphaned items in progress.
+	OrphanIgnore OrphanPolicy = ""
+	// OrphanRequeue requeues orphaned items at their original positions.
+	OrphanRequeue OrphanPolicy = "requeue"
+	// OrphanFail completes orphaned items with ErrWorkerLost. They are
+	// retried instead, if the bucket retry policy allows.
+	OrphanFail OrphanPolicy = "fail"
+)
+
+// ErrWorkerLost is the error of orphaned items failed by OrphanFail.
+var ErrWorkerLost = errors.New("queue: worker lost")
+
+var (
+	// OrphanRecovery is the policy of the recovery scan, run once after
+	// the queue starts. OrphanIgnore disables the scan.
+	OrphanRecovery = OrphanIgnore
+
+	// OrphanScanDelay is the delay of the recovery scan after the queue
+	// starts. It should be longer than 'WorkerTTL', since etcd renews
+	// the leases of crashed workers when it restarts.
+	OrphanScanDelay = 2 * time.Duration(WorkerTTL) * time.Second
+)
+
+// recoverOrphans runs the recovery scan after 'OrphanScanDelay',
+// unless the queue stops before.
+func (qu *queue) recoverOrphans(policy OrphanPolicy, delay time.Duration) {
+	if policy == OrphanIgnore {
+		return
+	}
+	qu.goBackground("recover-orphans", "", func() {
+		select {
+		case <-qu.clock.After(delay):
+		case <-qu.rootCtx.Done():
+			return
+		}
+		items, err := RecoverOrphans(qu.rootCtx, qu, policy)
+		if err != nil {
+			glog.Warningf("queue: failed to recover orphaned items (%v)", err)
+			return
+		}
+		glog.Infof("queue: recovered %d orphaned items (policy %q)", len(items), policy)
+	})
+}
+
+// RecoverOrphans applies the policy to orphaned items, and returns the
+// recovered items. It is best-effort: an item completed by its worker
+// while being recovered may be requeued (e.g. the worker re-registered
+// under a new ID).
+func RecoverOrphans(ctx context.Context, qu Queue, policy OrphanPolicy) ([]*Item, error) {
+	if policy != OrphanRequeue && policy != OrphanFail {
+		return nil, fmt.Errorf("unknown orphan policy %q", policy)
+	}
+	ws, err := qu.Workers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	alive := make(map[string]bool, len(ws))
+	for _, w := range ws {
+		alive[w.ID] = true
+	}
+	items, err := qu.ListByStatus(ctx, StatusInProgress)
+	if err != nil {
+		return nil, err
+	}
+
+	var recovered []*Item
+	for _, item := range items {
+		if item.Worker == "" || alive[item.Worker] {
+			continue
+		}
+		// skip items completed since the scan
+		resp, err := clientOf(qu).Get(ctx, statusIndexPrefix(StatusInProgress)+item.Key, clientv3.WithCountOnly())
+		if err != nil {
+			return recovered, err
+		}
+		if resp.Count == 0 {
+			continue
+		}
+
+		glog.Warningf("queue: recovering %q orphaned by worker %q (policy %q)", item.Key, item.Worker, policy)
+		switch policy {
+		case OrphanRequeue:
+			err = qu.Add(ctx, item)
+		case OrphanFail:
+			item.Error = fmt.Sprintf("%v (%q)", ErrWorkerLost, item.Worker)
+			err = qu.Complete(ctx, item)
+		}
+		if err != nil {
+			return recovered, fmt.Errorf("failed to recover %q (%v)", item.Key, err)
+		}
+		recovered = append(recovered, item)
+	}
+	return recovered, nil
+}
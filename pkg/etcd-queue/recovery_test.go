@@ -0,0 +1,116 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecoverOrphans(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { qu.Stop() }()
+
+	ctx := context.Background()
+	w1, err := qu.RegisterWorker(ctx, "gpu-1", Capabilities{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := qu.RegisterWorker(ctx, "gpu-2", Capabilities{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+
+	// items of live workers and without workers are not orphaned
+	var keys []string
+	for _, ctx := range []context.Context{w1.Context(ctx), w1.Context(ctx), w2.Context(ctx), ctx} {
+		item := CreateItem("my-job", 100, "data")
+		if err = qu.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+		if popped := <-qu.Pop(ctx, "my-job"); popped.Err() != nil || popped.Key != item.Key {
+			t.Fatalf("unexpected item %+v", popped)
+		}
+		keys = append(keys, item.Key)
+	}
+	if items, err := RecoverOrphans(ctx, qu, OrphanRequeue); err != nil || len(items) != 0 {
+		t.Fatalf("expected no orphan, got %+v (%v)", items, err)
+	}
+	if _, err = RecoverOrphans(ctx, qu, OrphanIgnore); err == nil {
+		t.Fatal("expected unknown policy error")
+	}
+
+	// worker crashed before completing its items
+	if err = w1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	items, err := RecoverOrphans(ctx, qu, OrphanFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Key != keys[0] || items[1].Key != keys[1] {
+		t.Fatalf("unexpected orphans %+v", items)
+	}
+	for _, key := range keys[:2] {
+		ent, err := qu.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ent.Status != StatusFailed || !strings.Contains(ent.Item.Error, ErrWorkerLost.Error()) {
+			t.Fatalf("unexpected entry %+v", ent)
+		}
+	}
+	if items, err = RecoverOrphans(ctx, qu, OrphanFail); err != nil || len(items) != 0 {
+		t.Fatalf("expected no orphan, got %+v (%v)", items, err)
+	}
+
+	// recovery scan on restart, after gpu-2 crashed
+	item := CreateItem("my-job", 100, "data")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	if popped := <-qu.Pop(w2.Context(ctx), "my-job"); popped.Err() != nil || popped.Key != item.Key {
+		t.Fatalf("unexpected item %+v", popped)
+	}
+	w2.Close()
+	qu.Stop()
+
+	oldPolicy, oldDelay := OrphanRecovery, OrphanScanDelay
+	OrphanRecovery, OrphanScanDelay = OrphanRequeue, 0
+	defer func() { OrphanRecovery, OrphanScanDelay = oldPolicy, oldDelay }()
+
+	qu, err = NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		items, err := qu.List(ctx, "my-job")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) == 2 && items[0].Key == keys[2] && items[1].Key == item.Key && items[1].Status == StatusPending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %q and %q requeued, got %+v", keys[2], item.Key, items)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
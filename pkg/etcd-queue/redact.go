@@ -0,0 +1,125 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// Redacted replaces sensitive values.
+const Redacted = "[REDACTED]"
+
+// Redaction marks item fields and label keys of a bucket as sensitive.
+// Sensitive values are redacted in journaled events (ReadEvents) and
+// admin listings, while workers still receive intact items from Pop.
+type Redaction struct {
+	// Fields are JSON field names of Item (e.g. "value", "request_id").
+	Fields []string `json:"fields,omitempty"`
+
+	// Labels are label keys.
+	Labels []string `json:"labels,omitempty"`
+}
+
+// redactors maps redactable Item fields to their redaction functions.
+// Empty values are kept empty.
+var redactors = map[string]func(item *Item){
+	"value":      func(item *Item) { redactString(&item.Value) },
+	"request_id": func(item *Item) { redactString(&item.RequestID) },
+	"owner":      func(item *Item) { redactString(&item.Owner) },
+	"error":      func(item *Item) { redactString(&item.Error) },
+	"result_url": func(item *Item) { redactString(&item.ResultURL) },
+}
+
+func redactString(s *string) {
+	if *s != "" {
+		*s = Redacted
+	}
+}
+
+// Validate returns an error if the redaction has unknown fields.
+func (r Redaction) Validate() error {
+	for _, f := range r.Fields {
+		if _, ok := redactors[f]; !ok {
+			fields := make([]string, 0, len(redactors))
+			for name := range redactors {
+				fields = append(fields, name)
+			}
+			sort.Strings(fields)
+			return fmt.Errorf("unknown field %q to redact (must be one of %q)", f, fields)
+		}
+	}
+	return nil
+}
+
+// Empty returns true if nothing is redacted.
+func (r Redaction) Empty() bool {
+	return len(r.Fields) == 0 && len(r.Labels) == 0
+}
+
+// Redact returns the copy of the item with sensitive values redacted.
+func (r Redaction) Redact(item *Item) *Item {
+	if item == nil || r.Empty() {
+		return item
+	}
+	copied := *item
+	for _, f := range r.Fields {
+		if fn, ok := redactors[f]; ok {
+			fn(&copied)
+		}
+	}
+	if len(r.Labels) > 0 && len(item.Labels) > 0 {
+		copied.Labels = make(map[string]string, len(item.Labels))
+		for k, v := range item.Labels {
+			copied.Labels[k] = v
+		}
+		for _, k := range r.Labels {
+			if _, ok := copied.Labels[k]; ok {
+				copied.Labels[k] = Redacted
+			}
+		}
+	}
+	return &copied
+}
+
+const pfxRedactions = "_redactions"
+
+func redactionKey(bucket string) string {
+	return path.Join(pfxRedactions, bucket)
+}
+
+func (qu *queue) SetRedaction(ctx context.Context, bucket string, r Redaction) error {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	if r.Empty() {
+		_, err := qu.kv.Delete(ctx, redactionKey(bucket))
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = qu.kv.Put(ctx, redactionKey(bucket), string(data))
+	return err
+}
+
+func (qu *queue) Redaction(ctx context.Context, bucket string) (Redaction, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	var r Redaction
+	resp, err := qu.kv.Get(ctx, redactionKey(bucket))
+	if err != nil {
+		return r, err
+	}
+	if len(resp.Kvs) == 0 {
+		return r, nil
+	}
+	if err = json.Unmarshal(resp.Kvs[0].Value, &r); err != nil {
+		return r, fmt.Errorf("%q returned wrong JSON %q (%v)", redactionKey(bucket), string(resp.Kvs[0].Value), err)
+	}
+	return r, nil
+}
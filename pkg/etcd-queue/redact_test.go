@@ -0,0 +1,95 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	item := CreateItem("bucket", 100, "secret-data")
+	item.Labels = map[string]string{"token": "abc", "model": "resnet"}
+
+	r := Redaction{Fields: []string{"value", "request_id"}, Labels: []string{"token"}}
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	redacted := r.Redact(item)
+	if redacted.Value != Redacted || redacted.RequestID != "" {
+		t.Fatalf("unexpected redacted item %+v", redacted)
+	}
+	if redacted.Labels["token"] != Redacted || redacted.Labels["model"] != "resnet" {
+		t.Fatalf("unexpected redacted labels %+v", redacted.Labels)
+	}
+	if item.Value != "secret-data" || item.Labels["token"] != "abc" {
+		t.Fatalf("original item must be intact, got %+v", item)
+	}
+
+	if err := (Redaction{Fields: []string{"key"}}).Validate(); err == nil {
+		t.Fatal("expected unknown field error")
+	}
+}
+
+func TestQueueRedaction(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	bucket := "redact-bucket"
+	if err = qu.SetRedaction(ctx, bucket, Redaction{Fields: []string{"value"}}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := qu.Redaction(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Fields) != 1 || r.Fields[0] != "value" {
+		t.Fatalf("unexpected redaction %+v", r)
+	}
+
+	item := CreateItem(bucket, 100, "secret-data")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	popped := <-qu.Pop(ctx, bucket)
+	if popped.Value != "secret-data" {
+		t.Fatalf("workers must receive intact value, got %q", popped.Value)
+	}
+
+	evs, err := qu.ReadEvents(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events, got %+v", evs)
+	}
+	for _, ev := range evs {
+		if ev.Item.Value != Redacted {
+			t.Fatalf("expected redacted value in events, got %q", ev.Item.Value)
+		}
+	}
+
+	if err = qu.SetRedaction(ctx, bucket, Redaction{}); err != nil {
+		t.Fatal(err)
+	}
+	if evs, err = qu.ReadEvents(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if evs[0].Item.Value != "secret-data" {
+		t.Fatalf("expected intact value, got %q", evs[0].Item.Value)
+	}
+}
@@ -0,0 +1,119 @@
+package etcdqueue
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ReplayLabel is the label of replayed items, with the keys of the
+// recorded items.
+const ReplayLabel = "replay-of"
+
+// Replay re-enqueues the recorded items of the export file as new items,
+// respecting their original inter-arrival times divided by the speed
+// factor (e.g. 2 to replay twice as fast), to load test new worker
+// versions against realistic workloads. The file has one JSON item per
+// line (e.g. an archive file), optionally gzip-compressed. Shadow items
+// are skipped, since they are mirrored again from the replayed items.
+// It returns the number of replayed items, until the context is done.
+func Replay(ctx context.Context, qu Queue, exportFile string, speedFactor float64) (int, error) {
+	if speedFactor <= 0 {
+		return 0, fmt.Errorf("invalid speed factor %v", speedFactor)
+	}
+	items, err := readExport(exportFile)
+	if err != nil {
+		return 0, err
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].CreatedAt.Before(items[j].CreatedAt) })
+
+	clk := clockOf(qu)
+	start, first := clk.Now(), items[0].CreatedAt
+	for i, rec := range items {
+		offset := time.Duration(float64(rec.CreatedAt.Sub(first)) / speedFactor)
+		if d := offset - clk.Since(start); d > 0 {
+			select {
+			case <-clk.After(d):
+			case <-ctx.Done():
+				return i, ctx.Err()
+			}
+		}
+		if err = qu.Add(ctx, replayItem(rec)); err != nil {
+			return i, fmt.Errorf("failed to replay %q (%v)", rec.Key, err)
+		}
+	}
+	glog.Infof("queue: replayed %d items of %q at speed %v", len(items), exportFile, speedFactor)
+	return len(items), nil
+}
+
+// readExport returns the items of the export file, except shadow items.
+func readExport(fpath string) ([]*Item, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not gzip file (%v)", fpath, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	var items []*Item
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var item Item
+		if err = json.Unmarshal(sc.Bytes(), &item); err != nil {
+			return nil, fmt.Errorf("%q has wrong JSON %q (%v)", fpath, sc.Text(), err)
+		}
+		if item.Bucket == "" || item.CreatedAt.IsZero() {
+			return nil, fmt.Errorf("%q has item %q without bucket or creation time", fpath, item.Key)
+		}
+		if item.ShadowOf == "" {
+			items = append(items, &item)
+		}
+	}
+	return items, sc.Err()
+}
+
+// replayItem returns the new item of the recorded item, in its bucket
+// and with its weight, without its results and links to users.
+func replayItem(rec *Item) *Item {
+	weight, ok := DefaultLayout.Decode(rec.Key)
+	if !ok {
+		weight = MaxWeight / 2
+	}
+	item := CreateItem(rec.Bucket, weight, rec.Value)
+	item.Priority = rec.Priority
+	item.SchemaVersion = rec.SchemaVersion
+	item.ModelType = rec.ModelType
+	item.ContentType = rec.ContentType
+	item.Labels = map[string]string{ReplayLabel: rec.Key}
+	for k, v := range rec.Labels {
+		if k != ReplayLabel {
+			item.Labels[k] = v
+		}
+	}
+	return item
+}
@@ -0,0 +1,84 @@
+package etcdqueue
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	// recorded out of order, with a shadow item
+	now := time.Now()
+	var recs []*Item
+	for _, tt := range []struct {
+		weight uint64
+		at     time.Duration
+	}{{100, 400 * time.Millisecond}, {200, 0}, {100, 200 * time.Millisecond}} {
+		rec := CreateItem("my-job", tt.weight, "data")
+		rec.CreatedAt = now.Add(tt.at)
+		rec.Key = DefaultLayout.Encode("my-job", tt.weight, rec.CreatedAt)
+		rec.Status, rec.Progress, rec.RequestID = StatusCompleted, MaxProgress, "req"
+		recs = append(recs, rec)
+	}
+	shadow := shadowItem(recs[1], "my-job-v2")
+
+	fpath := filepath.Join(dataDir, "export.ndjson.gz")
+	f, err := os.Create(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for _, rec := range append(recs, shadow) {
+		if err = enc.Encode(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zw.Close()
+	f.Close()
+
+	ctx := context.Background()
+	if _, err = Replay(ctx, qu, fpath, 0); err == nil {
+		t.Fatal("expected invalid speed factor error")
+	}
+	start := time.Now()
+	n, err := Replay(ctx, qu, fpath, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); n != 3 || took < 150*time.Millisecond || took > 5*time.Second {
+		t.Fatalf("expected 3 items replayed in about 200ms, got %d in %v", n, took)
+	}
+
+	// the first recorded item has the highest weight
+	for _, expected := range []*Item{recs[1], recs[2], recs[0]} {
+		item := <-qu.Pop(ctx, "my-job")
+		if item.Err() != nil {
+			t.Fatal(item.Err())
+		}
+		if item.Labels[ReplayLabel] != expected.Key || item.Key == expected.Key || item.RequestID != "" || item.Progress != 0 {
+			t.Fatalf("expected replay of %q, got %+v", expected.Key, item)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package etcdqueue
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// TransientRetries is the maximum number of retries of etcd requests
+	// that failed with transient errors (e.g. leader election, unavailable
+	// endpoint). Zero disables retries.
+	TransientRetries = 5
+
+	// TransientBackoff is the delay before the first retry, doubled on
+	// each following retry.
+	TransientBackoff = 100 * time.Millisecond
+)
+
+var transientRetries = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "etcdqueue",
+	Name:      "transient_retries_total",
+	Help:      "Number of etcd requests retried on transient errors.",
+})
+
+func init() {
+	prometheus.MustRegister(transientRetries)
+}
+
+// isTransient returns true if the etcd error is expected to go away
+// on retry (e.g. no leader, request timed out during leader change).
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if ev, ok := err.(rpctypes.EtcdError); ok {
+		return ev.Code() == codes.Unavailable
+	}
+	if st, ok := status.FromError(err); ok {
+		return st.Code() == codes.Unavailable
+	}
+	return false
+}
+
+// retryTransient calls f until it succeeds, fails with a non-transient
+// error, or runs out of retries. Only the last error is returned.
+func retryTransient(ctx context.Context, clk Clock, f func() error) error {
+	backoff := TransientBackoff
+	for i := 0; ; i++ {
+		err := f()
+		if !isTransient(err) || i >= TransientRetries {
+			return err
+		}
+		glog.Warningf("queue: retrying etcd request in %v after transient error (%v)", backoff, err)
+		transientRetries.Inc()
+
+		select {
+		case <-clk.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// grant grants a lease, retrying on transient errors,
+// behind the circuit breaker.
+func (qu *queue) grant(ctx context.Context, ttl int64) (resp *clientv3.LeaseGrantResponse, err error) {
+	if err = qu.lc.err(); err != nil {
+		return nil, err
+	}
+	err = qu.breaker.do(ctx, func() error {
+		resp, err = qu.cli.Grant(ctx, ttl)
+		return err
+	})
+	return resp, err
+}
+
+// retryKV is clientv3.KV, retrying requests on transient errors,
+// behind the circuit breaker.
+// Retried writes may be applied twice, if the first response was lost,
+// which is safe for puts and deletes of the queue. Transactions with
+// comparisons are not, since a lost response of a committed transaction
+// would surface as a failed comparison: see retryTxn.
+type retryKV struct {
+	kv clientv3.KV
+	br *breaker
+	lc *lifecycle
+}
+
+// do fails fast with ErrQueueClosed after Stop, or calls f behind
+// the circuit breaker.
+func (r retryKV) do(ctx context.Context, f func() error) error {
+	if err := r.lc.err(); err != nil {
+		return err
+	}
+	return r.br.do(ctx, f)
+}
+
+// once is do without retries, for requests that are not safe to re-send.
+func (r retryKV) once(ctx context.Context, f func() error) error {
+	if err := r.lc.err(); err != nil {
+		return err
+	}
+	return r.br.once(ctx, f)
+}
+
+func (r retryKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (resp *clientv3.PutResponse, err error) {
+	err = r.do(ctx, func() error {
+		resp, err = r.kv.Put(ctx, key, val, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (r retryKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (resp *clientv3.GetResponse, err error) {
+	err = r.do(ctx, func() error {
+		resp, err = r.kv.Get(ctx, key, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (r retryKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (resp *clientv3.DeleteResponse, err error) {
+	err = r.do(ctx, func() error {
+		resp, err = r.kv.Delete(ctx, key, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (r retryKV) Compact(ctx context.Context, rev int64, opts ...clientv3.CompactOption) (resp *clientv3.CompactResponse, err error) {
+	err = r.do(ctx, func() error {
+		resp, err = r.kv.Compact(ctx, rev, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (r retryKV) Do(ctx context.Context, op clientv3.Op) (resp clientv3.OpResponse, err error) {
+	if op.IsTxn() {
+		cmps, thens, elses := op.Txn()
+		tresp, err := r.Txn(ctx).If(cmps...).Then(thens...).Else(elses...).Commit()
+		if err != nil {
+			return resp, err
+		}
+		return tresp.OpResponse(), nil
+	}
+	err = r.do(ctx, func() error {
+		resp, err = r.kv.Do(ctx, op)
+		return err
+	})
+	return resp, err
+}
+
+func (r retryKV) Txn(ctx context.Context) clientv3.Txn {
+	return &retryTxn{kv: r, ctx: ctx}
+}
+
+// retryTxn records the transaction, to re-send it on transient errors.
+type retryTxn struct {
+	kv    retryKV
+	ctx   context.Context
+	cmps  []clientv3.Cmp
+	thens []clientv3.Op
+	elses []clientv3.Op
+}
+
+func (t *retryTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *retryTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.thens = append(t.thens, ops...)
+	return t
+}
+
+func (t *retryTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.elses = append(t.elses, ops...)
+	return t
+}
+
+// Commit sends the transaction, re-sending it on transient errors only
+// if that cannot apply its writes twice. Reads and unconditional writes
+// are re-sent as they are. Before a conditional transaction is re-sent,
+// its puts are read back: if they all landed, the lost request was
+// committed and is reported as succeeded. Conditional transactions
+// without puts cannot be checked, so they are not re-sent.
+func (t *retryTxn) Commit() (resp *clientv3.TxnResponse, err error) {
+	commit := func() error {
+		resp, err = t.kv.kv.Txn(t.ctx).If(t.cmps...).Then(t.thens...).Else(t.elses...).Commit()
+		return err
+	}
+	puts, writes := txnWrites(t.thens)
+	if _, elseWrites := txnWrites(t.elses); elseWrites {
+		writes = true
+	}
+	switch {
+	case len(t.cmps) == 0 || !writes:
+		err = t.kv.do(t.ctx, commit)
+	case len(puts) == 0:
+		err = t.kv.once(t.ctx, commit)
+	default:
+		sent := false
+		err = t.kv.do(t.ctx, func() error {
+			if sent {
+				landed, lerr := t.landed(puts)
+				if lerr != nil || landed != nil {
+					resp = landed
+					return lerr
+				}
+			}
+			sent = true
+			return commit()
+		})
+	}
+	return resp, err
+}
+
+// landed reads back the puts of the transaction, and returns a succeeded
+// response if they all hold the values written, or nil otherwise.
+func (t *retryTxn) landed(puts []clientv3.Op) (*clientv3.TxnResponse, error) {
+	gets := make([]clientv3.Op, len(puts))
+	for i, op := range puts {
+		gets[i] = clientv3.OpGet(string(op.KeyBytes()))
+	}
+	resp, err := t.kv.kv.Txn(t.ctx).Then(gets...).Commit()
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range puts {
+		kvs := resp.Responses[i].GetResponseRange().Kvs
+		if len(kvs) == 0 || !bytes.Equal(kvs[0].Value, op.ValueBytes()) {
+			return nil, nil
+		}
+	}
+	glog.Warningf("queue: transaction committed before transient error, not re-sending")
+	return &clientv3.TxnResponse{Header: resp.Header, Succeeded: true}, nil
+}
+
+// txnWrites returns the puts of the operations, including nested
+// transactions, and true if any operation writes.
+func txnWrites(ops []clientv3.Op) (puts []clientv3.Op, writes bool) {
+	for _, op := range ops {
+		switch {
+		case op.IsPut():
+			puts, writes = append(puts, op), true
+		case op.IsDelete():
+			writes = true
+		case op.IsTxn():
+			_, thens, elses := op.Txn()
+			if _, w := txnWrites(thens); w {
+				writes = true
+			}
+			if _, w := txnWrites(elses); w {
+				writes = true
+			}
+		}
+	}
+	return puts, writes
+}
@@ -0,0 +1,223 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// flakyKV fails requests with the error, until 'failures' runs out.
+type flakyKV struct {
+	clientv3.KV
+	err      error
+	failures int
+	calls    int
+
+	// lost is true to apply the writes of failed transactions,
+	// as if their responses were lost.
+	lost  bool
+	store map[string]string
+
+	// block is true to block requests until the context is done.
+	block bool
+}
+
+func (f *flakyKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	f.calls++
+	if f.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if f.failures > 0 {
+		f.failures--
+		return nil, f.err
+	}
+	return &clientv3.PutResponse{}, nil
+}
+
+func (f *flakyKV) Txn(ctx context.Context) clientv3.Txn {
+	return &flakyTxn{kv: f}
+}
+
+// flakyTxn applies its puts and deletes, ignoring comparisons.
+// Transactions of gets only are served without failures.
+type flakyTxn struct {
+	clientv3.Txn
+	kv  *flakyKV
+	ops []clientv3.Op
+}
+
+func (t *flakyTxn) If(cs ...clientv3.Cmp) clientv3.Txn { return t }
+func (t *flakyTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.ops = append(t.ops, ops...)
+	return t
+}
+func (t *flakyTxn) Else(ops ...clientv3.Op) clientv3.Txn { return t }
+
+func (t *flakyTxn) Commit() (*clientv3.TxnResponse, error) {
+	if _, writes := txnWrites(t.ops); !writes && len(t.ops) > 0 {
+		resp := &clientv3.TxnResponse{Header: &pb.ResponseHeader{}, Succeeded: true}
+		for _, op := range t.ops {
+			rr := &pb.RangeResponse{}
+			if v, ok := t.kv.store[string(op.KeyBytes())]; ok {
+				rr.Kvs = []*mvccpb.KeyValue{{Key: op.KeyBytes(), Value: []byte(v)}}
+			}
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponseRange{ResponseRange: rr},
+			})
+		}
+		return resp, nil
+	}
+	_, err := t.kv.Put(context.Background(), "", "")
+	if err == nil || t.kv.lost {
+		for _, op := range t.ops {
+			if t.kv.store == nil {
+				t.kv.store = make(map[string]string)
+			}
+			switch {
+			case op.IsPut():
+				t.kv.store[string(op.KeyBytes())] = string(op.ValueBytes())
+			case op.IsDelete():
+				delete(t.kv.store, string(op.KeyBytes()))
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &clientv3.TxnResponse{Succeeded: true}, nil
+}
+
+func TestRetryKV(t *testing.T) {
+	oldRetries, oldBackoff := TransientRetries, TransientBackoff
+	TransientRetries, TransientBackoff = 3, time.Millisecond
+	defer func() { TransientRetries, TransientBackoff = oldRetries, oldBackoff }()
+
+	tests := []struct {
+		err      error
+		failures int
+		calls    int
+		fail     bool
+	}{
+		{err: rpctypes.ErrNoLeader, failures: 2, calls: 3},
+		{err: rpctypes.ErrGRPCTimeoutDueToLeaderFail, failures: 3, calls: 4},
+		{err: rpctypes.ErrTimeout, failures: 4, calls: 4, fail: true},
+		{err: rpctypes.ErrGRPCCompacted, failures: 1, calls: 1, fail: true},
+		{err: fmt.Errorf("unknown"), failures: 1, calls: 1, fail: true},
+	}
+	for i, tt := range tests {
+		for _, txn := range []bool{false, true} {
+			f := &flakyKV{err: tt.err, failures: tt.failures}
+			kv := retryKV{kv: f}
+			var err error
+			if txn {
+				_, err = kv.Txn(context.Background()).Then(clientv3.OpPut("foo", "bar")).Commit()
+			} else {
+				_, err = kv.Put(context.Background(), "foo", "bar")
+			}
+			if (err != nil) != tt.fail {
+				t.Fatalf("#%d(txn %v): expected failure %v, got %v", i, txn, tt.fail, err)
+			}
+			if f.calls != tt.calls {
+				t.Fatalf("#%d(txn %v): expected %d calls, got %d", i, txn, tt.calls, f.calls)
+			}
+		}
+	}
+}
+
+func TestRetryKVConditionalTxn(t *testing.T) {
+	oldRetries, oldBackoff := TransientRetries, TransientBackoff
+	TransientRetries, TransientBackoff = 3, time.Millisecond
+	defer func() { TransientRetries, TransientBackoff = oldRetries, oldBackoff }()
+
+	cmp := clientv3.Compare(clientv3.ModRevision("foo"), "=", 0)
+	tests := []struct {
+		ops   []clientv3.Op
+		lost  bool
+		calls int
+		fail  bool
+	}{
+		// puts are re-sent, if they did not land
+		{ops: []clientv3.Op{clientv3.OpPut("foo", "bar")}, calls: 2},
+		// lost response of a committed transaction is not re-sent
+		{ops: []clientv3.Op{clientv3.OpPut("foo", "bar")}, lost: true, calls: 1},
+		{ops: []clientv3.Op{clientv3.OpDelete("baz"), clientv3.OpPut("foo", "bar")}, lost: true, calls: 1},
+		// deletes cannot be checked, so they are not re-sent
+		{ops: []clientv3.Op{clientv3.OpDelete("foo")}, calls: 1, fail: true},
+	}
+	for i, tt := range tests {
+		f := &flakyKV{err: rpctypes.ErrGRPCTimeoutDueToLeaderFail, failures: 1, lost: tt.lost}
+		resp, err := (retryKV{kv: f}).Txn(context.Background()).If(cmp).Then(tt.ops...).Commit()
+		if (err != nil) != tt.fail {
+			t.Fatalf("#%d: expected failure %v, got %v", i, tt.fail, err)
+		}
+		if err == nil && !resp.Succeeded {
+			t.Fatalf("#%d: expected success", i)
+		}
+		if f.calls != tt.calls {
+			t.Fatalf("#%d: expected %d calls, got %d", i, tt.calls, f.calls)
+		}
+	}
+}
+
+func TestRetryKVCanceled(t *testing.T) {
+	oldBackoff := TransientBackoff
+	TransientBackoff = time.Hour
+	defer func() { TransientBackoff = oldBackoff }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	f := &flakyKV{err: rpctypes.ErrNoLeader, failures: 10}
+	if _, err := (retryKV{kv: f}).Put(ctx, "foo", "bar"); err != rpctypes.ErrNoLeader {
+		t.Fatalf("expected %v, got %v", rpctypes.ErrNoLeader, err)
+	}
+	if f.calls != 1 {
+		t.Fatalf("expected 1 call, got %d", f.calls)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	qu := &queue{limits: Limits{RequestTimeout: 100 * time.Millisecond}}
+	kv := retryKV{kv: &flakyKV{block: true}}
+
+	// requests of one operation share the timeout
+	ctx, cancel := qu.withTimeout(context.Background())
+	defer cancel()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := kv.Put(ctx, "foo", "bar"); err != context.DeadlineExceeded {
+			t.Fatalf("#%d: expected %v, got %v", i, context.DeadlineExceeded, err)
+		}
+	}
+	if took := time.Since(now); took > 250*time.Millisecond {
+		t.Fatalf("expected one timeout per operation, took %v", took)
+	}
+
+	// deadline of the caller overrides the default
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	now = time.Now()
+	tctx, tcancel := qu.withTimeout(ctx)
+	defer tcancel()
+	if _, err := kv.Put(tctx, "foo", "bar"); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if took := time.Since(now); took < 500*time.Millisecond {
+		t.Fatalf("expected timeout of the caller, took %v", took)
+	}
+
+	// zero disables the timeout
+	qu.limits.RequestTimeout = 0
+	tctx, tcancel = qu.withTimeout(context.Background())
+	defer tcancel()
+	if _, ok := tctx.Deadline(); ok {
+		t.Fatal("expected no deadline")
+	}
+}
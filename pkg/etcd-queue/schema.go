@@ -0,0 +1,77 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/gyuho/dplearn/pkg/jsonschema"
+
+	"github.com/golang/glog"
+)
+
+const pfxSchemas = "_schemas"
+
+func schemaKey(bucket string) string {
+	return path.Join(pfxSchemas, bucket)
+}
+
+func (qu *queue) RegisterSchema(ctx context.Context, bucket string, schema []byte) error {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if _, err := jsonschema.Parse(schema); err != nil {
+		return err
+	}
+	if _, err := qu.kv.Put(ctx, schemaKey(bucket), string(schema)); err != nil {
+		return err
+	}
+	glog.Infof("queue: registered schema for %q", bucket)
+	return nil
+}
+
+func (qu *queue) Schema(ctx context.Context, bucket string) ([]byte, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	resp, err := qu.kv.Get(ctx, schemaKey(bucket))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+func (qu *queue) DeleteSchema(ctx context.Context, bucket string) error {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	_, err := qu.kv.Delete(ctx, schemaKey(bucket))
+	return err
+}
+
+// validateItems validates item values against the schemas of their buckets.
+func (qu *queue) validateItems(ctx context.Context, items ...*Item) error {
+	schemas := make(map[string]*jsonschema.Schema)
+	for _, item := range items {
+		s, ok := schemas[item.Bucket]
+		if !ok {
+			data, err := qu.Schema(ctx, item.Bucket)
+			if err != nil {
+				return err
+			}
+			if data != nil {
+				if s, err = jsonschema.Parse(data); err != nil {
+					return fmt.Errorf("%q has invalid schema (%v)", item.Bucket, err)
+				}
+			}
+			schemas[item.Bucket] = s
+		}
+		if s == nil {
+			continue
+		}
+		if err := s.ValidateJSON([]byte(item.Value)); err != nil {
+			return fmt.Errorf("%q value does not match the schema of %q (%v)", item.Key, item.Bucket, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestQueueSchema(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	bucket := "schema-bucket"
+	if err = qu.RegisterSchema(ctx, bucket, []byte(`{"type": "float"}`)); err == nil {
+		t.Fatal("expected invalid schema error")
+	}
+	schema := `{"type": "object", "required": ["image"], "properties": {"image": {"type": "string"}}}`
+	if err = qu.RegisterSchema(ctx, bucket, []byte(schema)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := qu.Schema(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != schema {
+		t.Fatalf("expected %q, got %q", schema, data)
+	}
+
+	if err = qu.Add(ctx, CreateItem(bucket, 100, `{"image": "a.jpg"}`)); err != nil {
+		t.Fatal(err)
+	}
+	err = qu.Add(ctx, CreateItem(bucket, 100, `{"image": 1}`))
+	if err == nil || !strings.Contains(err.Error(), "$.image: expected string, got integer") {
+		t.Fatalf("expected schema error, got %v", err)
+	}
+	err = qu.AddBatch(ctx, []*Item{CreateItem(bucket, 100, `{"image": "b.jpg"}`), CreateItem(bucket, 100, `garbage`)})
+	if err == nil || !strings.Contains(err.Error(), "invalid JSON") {
+		t.Fatalf("expected schema error, got %v", err)
+	}
+	items, err := qu.List(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected 1 item, got %+v", items)
+	}
+
+	if err = qu.DeleteSchema(ctx, bucket); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, CreateItem(bucket, 100, `garbage`)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,236 @@
+package etcdqueue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// pfxSequence is the prefix of per-bucket sequence counters, holding the
+// sequence of the last item added to the bucket:
+//
+//	_sequence/<bucket> = <sequence>
+const pfxSequence = "_sequence"
+
+func sequenceKey(bucket string) string {
+	return path.Join(pfxSequence, bucket)
+}
+
+var (
+	// ConflictRetries is the maximum number of retries of transactions
+	// conflicting with concurrent updates of their counters (e.g.
+	// sequences of busy buckets).
+	ConflictRetries = 10
+
+	// ConflictBackoff is the maximum delay before the first retry,
+	// doubled on each following retry. Delays are picked at random up
+	// to the maximum, so that conflicting writers spread out.
+	ConflictBackoff = 10 * time.Millisecond
+)
+
+// ErrTooManyConflicts is returned when a transaction still conflicts
+// with concurrent updates after 'ConflictRetries' retries.
+var ErrTooManyConflicts = errors.New("queue: too many conflicting updates")
+
+// waitConflict waits before the retry of the conflicting transaction.
+// It returns ErrTooManyConflicts if out of retries, or the context error
+// if done in the meantime.
+func waitConflict(ctx context.Context, retry int) error {
+	if retry >= ConflictRetries {
+		return ErrTooManyConflicts
+	}
+	var delay time.Duration
+	if max := ConflictBackoff << uint(retry); max > 0 {
+		delay = time.Duration(rand.Int63n(int64(max)))
+	}
+	select {
+	case <-DefaultClock.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sequenceTxn assigns the next sequences of their buckets to the items
+// without one (see 'Item.Sequence'), and commits the operations of the
+// encoded items with the counter updates in one transaction, so that
+// sequences have no gaps. Items without charges are charged to the
+// usage of their owners and buckets in the same transaction, and
+// QuotaExceededError is returned if that would exceed their quotas
+// (see 'Item.Charged'). It retries when counters are updated
+// concurrently (see 'ConflictRetries'), and returns false if the
+// comparisons fail.
+func (qu *queue) sequenceTxn(ctx context.Context, items []*Item, cmps []clientv3.Cmp, ops func(vals [][]byte) []clientv3.Op) (ok bool, err error) {
+	buckets := sequenceBuckets(items...)
+	var charged []*Item
+	for _, item := range items {
+		if item.Charged == 0 {
+			charged = append(charged, item)
+		}
+	}
+	limits, err := qu.quotaLimits(ctx, charged...)
+	if err != nil {
+		return false, err
+	}
+	for _, item := range charged {
+		data, err := marshalItem(item)
+		if err != nil {
+			return false, err
+		}
+		item.Charged = int64(len(data))
+	}
+	defer func() {
+		// charges are recorded only with the writes
+		if !ok {
+			for _, item := range charged {
+				item.Charged = 0
+			}
+		}
+	}()
+
+	for retry := 0; ; retry++ {
+		usage := newUsageCounters(charged...)
+		gets := make([]clientv3.Op, len(buckets))
+		for i, bucket := range buckets {
+			gets[i] = clientv3.OpGet(sequenceKey(bucket))
+		}
+		gresp, err := qu.kv.Txn(ctx).Then(append(gets, usage.gets()...)...).Commit()
+		if err != nil {
+			return false, err
+		}
+		for i, key := range usage.keys {
+			if err = usage.set(key, gresp.Responses[len(buckets)+i].GetResponseRange().Kvs); err != nil {
+				return false, err
+			}
+		}
+		for _, item := range charged {
+			usage.add(item, 1)
+		}
+		if err = usage.exceeded(limits); err != nil {
+			return false, err
+		}
+
+		// items are written with their sequences, so that a retry
+		// assigns them again
+		next := make(map[string]uint64, len(buckets))
+		seqCmps := make([]clientv3.Cmp, 0, len(cmps)+len(buckets))
+		revs := make([]int64, len(buckets))
+		for i, bucket := range buckets {
+			key := sequenceKey(bucket)
+			next[bucket] = 0
+			if kvs := gresp.Responses[i].GetResponseRange().Kvs; len(kvs) > 0 {
+				if next[bucket], err = strconv.ParseUint(string(kvs[0].Value), 10, 64); err != nil {
+					return false, err
+				}
+				revs[i] = kvs[0].ModRevision
+			}
+			seqCmps = append(seqCmps, clientv3.Compare(clientv3.ModRevision(key), "=", revs[i]))
+		}
+		seqCmps = append(seqCmps, usage.cmps()...)
+		vals := make([][]byte, len(items))
+		var assigned []*Item
+		for i, item := range items {
+			if _, ok := next[item.Bucket]; ok && item.Sequence == 0 {
+				next[item.Bucket]++
+				item.Sequence = next[item.Bucket]
+				assigned = append(assigned, item)
+			}
+			if vals[i], err = marshalItem(item); err != nil {
+				return false, err
+			}
+		}
+		txnOps := ops(vals)
+		for _, bucket := range buckets {
+			txnOps = append(txnOps, clientv3.OpPut(sequenceKey(bucket), strconv.FormatUint(next[bucket], 10)))
+		}
+		txnOps = append(txnOps, usage.puts()...)
+
+		resp, err := qu.kv.Txn(ctx).If(append(seqCmps, cmps...)...).Then(txnOps...).Commit()
+		if err == nil && !resp.Succeeded {
+			// the request may have been re-sent after its response was
+			// lost, failing the comparisons of its own writes
+			resp.Succeeded, err = qu.itemsWritten(ctx, items, vals)
+		}
+		if err == nil && resp.Succeeded {
+			return true, nil
+		}
+		for _, item := range assigned {
+			item.Sequence = 0
+		}
+		if err != nil {
+			return false, err
+		}
+		if len(cmps) > 0 {
+			// retry only if the counters moved
+			moved, err := qu.sequencesMoved(ctx, buckets, revs)
+			if err == nil && !moved {
+				moved, err = usage.moved(ctx, qu.kv)
+			}
+			if err != nil || !moved {
+				return false, err
+			}
+		}
+		if err = waitConflict(ctx, retry); err != nil {
+			return false, err
+		}
+	}
+}
+
+// sequencesMoved returns true if any counter of the buckets has been
+// updated since the revisions.
+func (qu *queue) sequencesMoved(ctx context.Context, buckets []string, revs []int64) (bool, error) {
+	for i, bucket := range buckets {
+		resp, err := qu.kv.Get(ctx, sequenceKey(bucket))
+		if err != nil {
+			return false, err
+		}
+		rev := int64(0)
+		if len(resp.Kvs) > 0 {
+			rev = resp.Kvs[0].ModRevision
+		}
+		if rev != revs[i] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// itemsWritten returns true if the pending keys of all items hold
+// their encoded values, with the sequences assigned.
+func (qu *queue) itemsWritten(ctx context.Context, items []*Item, vals [][]byte) (bool, error) {
+	gets := make([]clientv3.Op, len(items))
+	for i, item := range items {
+		gets[i] = clientv3.OpGet(PendingKey(item.Key))
+	}
+	resp, err := qu.kv.Txn(ctx).Then(gets...).Commit()
+	if err != nil {
+		return false, err
+	}
+	for i := range items {
+		kvs := resp.Responses[i].GetResponseRange().Kvs
+		if len(kvs) == 0 || !bytes.Equal(kvs[0].Value, vals[i]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sequenceBuckets returns the buckets of the items without sequences,
+// whose counters are updated when the items are written.
+func sequenceBuckets(items ...*Item) []string {
+	var buckets []string
+	seen := make(map[string]bool)
+	for _, item := range items {
+		if item.Sequence == 0 && !seen[item.Bucket] {
+			seen[item.Bucket] = true
+			buckets = append(buckets, item.Bucket)
+		}
+	}
+	return buckets
+}
@@ -0,0 +1,243 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+func TestSequence(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// concurrent Adds of two buckets, with a batch and an idempotent Add
+	var wg sync.WaitGroup
+	errc := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errc <- qu.Add(ctx, CreateItem("seq-a", 100, fmt.Sprintf("a%d", i)))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			errc <- qu.Add(ctx, CreateItem("seq-b", 100, fmt.Sprintf("b%d", i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := []*Item{CreateItem("seq-a", 100, "a10"), CreateItem("seq-b", 100, "b10"), CreateItem("seq-a", 100, "a11")}
+	if err = qu.AddBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	if batch[0].Sequence != 11 || batch[1].Sequence != 11 || batch[2].Sequence != 12 {
+		t.Fatalf("unexpected batch sequences %d, %d, %d", batch[0].Sequence, batch[1].Sequence, batch[2].Sequence)
+	}
+	idem := CreateItem("seq-a", 100, "a12")
+	idem.IdempotencyKey = "job-1"
+	if err = qu.Add(ctx, idem); err != nil {
+		t.Fatal(err)
+	}
+	if idem.Sequence != 13 {
+		t.Fatalf("expected sequence 13, got %d", idem.Sequence)
+	}
+
+	// sequences are gapless in each bucket
+	for bucket, n := range map[string]int{"seq-a": 13, "seq-b": 11} {
+		// requeued items keep their sequences
+		item := <-qu.Pop(ctx, bucket)
+		if item == nil || item.Err() != nil {
+			t.Fatalf("unexpected pop %+v", item)
+		}
+		seq := item.Sequence
+		if err = qu.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+		if item.Sequence != seq {
+			t.Fatalf("expected requeued sequence %d, got %d", seq, item.Sequence)
+		}
+
+		var seqs []int
+		for i := 0; i < n; i++ {
+			item = <-qu.Pop(ctx, bucket)
+			if item == nil || item.Err() != nil {
+				t.Fatalf("unexpected pop %+v", item)
+			}
+			seqs = append(seqs, int(item.Sequence))
+		}
+		sort.Ints(seqs)
+		for i, seq := range seqs {
+			if seq != i+1 {
+				t.Fatalf("%q: expected gapless sequences, got %v", bucket, seqs)
+			}
+		}
+	}
+}
+
+func TestSequenceConflictRetries(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	oldRetries, oldBackoff := ConflictRetries, ConflictBackoff
+	ConflictRetries, ConflictBackoff = 3, time.Millisecond
+	defer func() { ConflictRetries, ConflictBackoff = oldRetries, oldBackoff }()
+
+	// the counter moves on every attempt
+	ctx := context.Background()
+	eq := qu.(*embeddedQueue).Queue.(*queue)
+	item := CreateItem("my-job", 100, "data")
+	attempts := 0
+	_, err = eq.sequenceTxn(ctx, []*Item{item}, nil, func(vals [][]byte) []clientv3.Op {
+		attempts++
+		if _, err := eq.kv.Put(ctx, sequenceKey("my-job"), fmt.Sprint(attempts)); err != nil {
+			t.Fatal(err)
+		}
+		return []clientv3.Op{clientv3.OpPut(PendingKey(item.Key), string(vals[0]))}
+	})
+	if err != ErrTooManyConflicts {
+		t.Fatalf("expected %v, got %v", ErrTooManyConflicts, err)
+	}
+	if attempts != 4 {
+		t.Fatalf("expected 4 attempts, got %d", attempts)
+	}
+	if item.Sequence != 0 || item.Charged != 0 {
+		t.Fatalf("expected no sequence or charge, got %+v", item)
+	}
+
+	// retries stop when the context is done
+	ConflictRetries, ConflictBackoff = 3, time.Hour
+	cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = eq.sequenceTxn(cctx, []*Item{item}, nil, func(vals [][]byte) []clientv3.Op {
+		if _, err := eq.kv.Put(ctx, sequenceKey("my-job"), "0"); err != nil {
+			t.Fatal(err)
+		}
+		return []clientv3.Op{clientv3.OpPut(PendingKey(item.Key), string(vals[0]))}
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+// resentKV commits conditional transactions twice, as if the response
+// of the first commit was lost and the request re-sent.
+type resentKV struct {
+	clientv3.KV
+}
+
+func (kv resentKV) Txn(ctx context.Context) clientv3.Txn {
+	return &resentTxn{kv: kv.KV, ctx: ctx}
+}
+
+type resentTxn struct {
+	kv    clientv3.KV
+	ctx   context.Context
+	cmps  []clientv3.Cmp
+	thens []clientv3.Op
+}
+
+func (t *resentTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *resentTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.thens = append(t.thens, ops...)
+	return t
+}
+
+func (t *resentTxn) Else(ops ...clientv3.Op) clientv3.Txn { return t }
+
+func (t *resentTxn) Commit() (*clientv3.TxnResponse, error) {
+	if len(t.cmps) > 0 {
+		if _, err := t.kv.Txn(t.ctx).If(t.cmps...).Then(t.thens...).Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return t.kv.Txn(t.ctx).If(t.cmps...).Then(t.thens...).Commit()
+}
+
+func TestSequenceLostResponse(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	// the re-sent write fails its comparisons, but has been committed
+	ctx := context.Background()
+	eq := qu.(*embeddedQueue).Queue.(*queue)
+	rkv := eq.kv.(retryKV)
+	rkv.kv = resentKV{rkv.kv}
+	eq.kv = rkv
+	item := CreateItem("my-job", 100, "data")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	if item.Sequence != 1 {
+		t.Fatalf("expected sequence 1, got %d", item.Sequence)
+	}
+	got, err := qu.Get(ctx, item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Item.Sequence != 1 {
+		t.Fatalf("expected stored sequence 1, got %d", got.Item.Sequence)
+	}
+	resp, err := eq.kv.Get(ctx, sequenceKey("my-job"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "1" {
+		t.Fatalf("expected sequence counter 1, got %+v", resp.Kvs)
+	}
+}
@@ -0,0 +1,147 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/golang/glog"
+)
+
+// pfxSessions is the prefix of session buckets, attached to the leases
+// of their sessions:
+//
+//	_sessions/<bucket> = <empty>
+const pfxSessions = "_sessions"
+
+func sessionKey(bucket string) string {
+	return path.Join(pfxSessions, bucket)
+}
+
+// SessionTTL is the lease TTL of session buckets in seconds. If the
+// session owner crashes, the bucket is removed after the TTL.
+var SessionTTL = 30
+
+// SessionBucket is a bucket bound to the lease of its session (e.g. a
+// notebook session), created by CreateSessionBucket. Pending and
+// completed items of the bucket are written with the session lease, so
+// that they vanish when the session ends.
+type SessionBucket struct {
+	qu     *queue
+	bucket string
+	sess   *concurrency.Session
+}
+
+func (qu *queue) CreateSessionBucket(ctx context.Context, bucket string) (*SessionBucket, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if bucket == "" {
+		return nil, fmt.Errorf("empty bucket name")
+	}
+	if err := qu.lc.err(); err != nil {
+		return nil, err
+	}
+	sess, err := concurrency.NewSession(qu.cli, concurrency.WithTTL(SessionTTL), concurrency.WithContext(qu.rootCtx))
+	if err != nil {
+		return nil, err
+	}
+
+	// existing buckets, or their pending items, would outlive the session
+	resp, err := qu.kv.Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.CreateRevision(sessionKey(bucket)), "=", 0),
+			clientv3.Compare(clientv3.CreateRevision(configKey(bucket)), "=", 0),
+			clientv3.Compare(clientv3.CreateRevision(bucketPrefix(bucket)), "=", 0).WithPrefix(),
+		).
+		Then(clientv3.OpPut(sessionKey(bucket), "", clientv3.WithLease(sess.Lease()))).
+		Commit()
+	if err == nil && !resp.Succeeded {
+		err = ErrBucketExists
+	}
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	glog.Infof("queue: created session bucket %q with lease %x", bucket, sess.Lease())
+	return &SessionBucket{qu: qu, bucket: bucket, sess: sess}, nil
+}
+
+// Name returns the bucket name.
+func (s *SessionBucket) Name() string { return s.bucket }
+
+// Done returns the channel closed when the session lease expires
+// (e.g. network partition), after which the bucket has been removed.
+func (s *SessionBucket) Done() <-chan struct{} { return s.sess.Done() }
+
+// Close ends the session, revoking its lease to remove the bucket with
+// its items, and removes index entries and idempotency keys of the items.
+func (s *SessionBucket) Close(ctx context.Context) error {
+	if err := s.sess.Close(); err != nil {
+		return fmt.Errorf("failed to close session of %q (%v)", s.bucket, err)
+	}
+
+	s.qu.writemu.Lock()
+	defer s.qu.writemu.Unlock()
+
+	var dels []itemDelete
+	for _, st := range []Status{StatusPending, StatusInProgress, StatusCompleted, StatusFailed, StatusCanceled, StatusExpired} {
+		resp, err := s.qu.kv.Get(ctx, statusIndexPrefix(st)+s.bucket+"/", clientv3.WithPrefix())
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			var ent IndexEntry
+			if err = json.Unmarshal(kv.Value, &ent); err != nil || ent.Item == nil {
+				dels = append(dels, itemDelete{key: string(kv.Key), ops: []clientv3.Op{clientv3.OpDelete(string(kv.Key))}})
+				continue
+			}
+			dels = append(dels, itemDelete{item: ent.Item, key: string(kv.Key), ops: unindexOps(ent.Item, st)})
+		}
+	}
+	dels = append(dels, itemDelete{ops: []clientv3.Op{
+		clientv3.OpDelete(path.Join(pfxIdempotency, s.bucket)+"/", clientv3.WithPrefix()),
+	}})
+	if _, err := s.qu.commitItemOps(ctx, dels); err != nil {
+		return err
+	}
+	s.qu.invalidateFront(s.bucket)
+	glog.Infof("queue: closed session bucket %q", s.bucket)
+	return nil
+}
+
+// sessionLease returns the lease of the session bucket, or zero if the
+// bucket is not a session bucket (or its session has ended).
+func (qu *queue) sessionLease(ctx context.Context, bucket string) (clientv3.LeaseID, error) {
+	resp, err := qu.kv.Get(ctx, sessionKey(bucket))
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	return clientv3.LeaseID(resp.Kvs[0].Lease), nil
+}
+
+// leaseOpts returns the options to write items of the bucket with the
+// lease of its session, or with a new lease of the TTL if not a session
+// bucket. The TTL is ignored for session buckets.
+func (qu *queue) leaseOpts(ctx context.Context, bucket string, ttl int64) ([]clientv3.OpOption, error) {
+	id, err := qu.sessionLease(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 && ttl > 5 {
+		resp, err := qu.grant(ctx, ttl)
+		if err != nil {
+			return nil, err
+		}
+		id = resp.ID
+	}
+	if id == 0 {
+		return nil, nil
+	}
+	return []clientv3.OpOption{clientv3.WithLease(id)}, nil
+}
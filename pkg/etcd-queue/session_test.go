@@ -0,0 +1,109 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSessionBucket(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if err = qu.Add(ctx, CreateItem("my-job", 100, "data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.CreateSessionBucket(ctx, "my-job"); err != ErrBucketExists {
+		t.Fatalf("expected %v, got %v", ErrBucketExists, err)
+	}
+
+	sb, err := qu.CreateSessionBucket(ctx, "notebook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.CreateSessionBucket(ctx, "notebook"); err != ErrBucketExists {
+		t.Fatalf("expected %v, got %v", ErrBucketExists, err)
+	}
+	done := CreateItem("notebook", 100, "done")
+	done.IdempotencyKey = "req-1"
+	for _, item := range []*Item{done, CreateItem("notebook", 100, "pending")} {
+		if err = qu.Add(ctx, item, WithTTL(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = qu.AddBatch(ctx, []*Item{CreateItem("notebook", 100, "batch"), CreateItem("my-job", 100, "batch")}); err != nil {
+		t.Fatal(err)
+	}
+	popped := <-qu.Pop(ctx, "notebook")
+	if popped.Err() != nil || popped.Key != done.Key {
+		t.Fatalf("expected %q popped, got %+v", done.Key, popped)
+	}
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sb.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sb.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to end session")
+	}
+	if items, err := qu.List(ctx, "notebook"); err != nil || len(items) != 0 {
+		t.Fatalf("expected no pending item, got %+v (%v)", items, err)
+	}
+	if items, err := qu.ListCompleted(ctx, "notebook"); err != nil || len(items) != 0 {
+		t.Fatalf("expected no completed item, got %+v (%v)", items, err)
+	}
+	if _, err = qu.Get(ctx, done.Key); err != ErrItemNotFound {
+		t.Fatalf("expected %v, got %v", ErrItemNotFound, err)
+	}
+	completed, err := qu.ListByStatus(ctx, StatusCompleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 0 {
+		t.Fatalf("expected no indexed item, got %+v", completed)
+	}
+	if items, err := qu.List(ctx, "my-job"); err != nil || len(items) != 2 {
+		t.Fatalf("expected 2 items of other buckets, got %+v (%v)", items, err)
+	}
+
+	// expired sessions remove their items without Close
+	sb, err = qu.CreateSessionBucket(ctx, "notebook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, CreateItem("notebook", 100, "pending")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.Client().Revoke(ctx, sb.sess.Lease()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sb.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to end session")
+	}
+	if items, err := qu.List(ctx, "notebook"); err != nil || len(items) != 0 {
+		t.Fatalf("expected no pending item, got %+v (%v)", items, err)
+	}
+}
@@ -0,0 +1,104 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"path"
+
+	"github.com/golang/glog"
+)
+
+// ShadowConfig mirrors a percentage of the items added to the bucket
+// into a shadow bucket, consumed by experimental workers (e.g. of a new
+// model version) to evaluate them on real traffic. Shadow items are
+// completed and stored like other items, but never returned to users,
+// since they have their own keys without the request ID and owner of
+// the original items (see 'Item.ShadowOf').
+type ShadowConfig struct {
+	// Bucket is the shadow bucket.
+	Bucket string `json:"bucket,omitempty"`
+
+	// Percent is the percentage of items mirrored, from 0 to 100.
+	// Items are sampled by their keys. Requeued items are not mirrored
+	// again.
+	Percent int `json:"percent,omitempty"`
+}
+
+// Validate returns an error if the configuration is invalid.
+func (cfg ShadowConfig) Validate() error {
+	if cfg.Percent < 0 || cfg.Percent > 100 {
+		return fmt.Errorf("shadow percent %d out of range [0, 100]", cfg.Percent)
+	}
+	if cfg.Percent > 0 && cfg.Bucket == "" {
+		return fmt.Errorf("shadow percent %d without shadow bucket", cfg.Percent)
+	}
+	return nil
+}
+
+// sampled returns true if the item key falls in the percentage.
+func (cfg ShadowConfig) sampled(itemKey string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(itemKey))
+	return int(h.Sum32()%100) < cfg.Percent
+}
+
+// shadowItem returns the copy of the item in the shadow bucket, with the
+// same ID, and without fields that link the copy to users or other items.
+func shadowItem(item *Item, bucket string) *Item {
+	var labels map[string]string
+	if len(item.Labels) > 0 {
+		labels = make(map[string]string, len(item.Labels))
+		for k, v := range item.Labels {
+			labels[k] = v
+		}
+	}
+	return &Item{
+		Bucket:        bucket,
+		CreatedAt:     item.CreatedAt,
+		Key:           path.Join(bucket, path.Base(item.Key)),
+		Value:         item.Value,
+		Priority:      item.Priority,
+		Labels:        labels,
+		Status:        StatusPending,
+		SchemaVersion: item.SchemaVersion,
+		ModelType:     item.ModelType,
+		ContentType:   item.ContentType,
+		ShadowOf:      item.Key,
+	}
+}
+
+// addShadows mirrors the sampled items into the shadow buckets of their
+// bucket configurations. It is best-effort, after the items have been
+// added, so that shadow buckets never fail Adds of users.
+func (qu *queue) addShadows(ctx context.Context, items ...*Item) {
+	var shadows []*Item
+	for _, item := range items {
+		if item.ShadowOf != "" {
+			continue
+		}
+		cfg, err := qu.bucketConfig(ctx, item.Bucket)
+		if err != nil {
+			glog.Warningf("queue: failed to get config of %q (%v)", item.Bucket, err)
+			return
+		}
+		if cfg.Shadow.Percent == 0 || cfg.Shadow.Bucket == item.Bucket || !cfg.Shadow.sampled(item.Key) {
+			continue
+		}
+		shadows = append(shadows, shadowItem(item, cfg.Shadow.Bucket))
+	}
+	if len(shadows) == 0 {
+		return
+	}
+	var err error
+	if len(shadows) == 1 {
+		err = qu.Add(ctx, shadows[0])
+	} else {
+		err = qu.AddBatch(ctx, shadows)
+	}
+	if err != nil {
+		glog.Warningf("queue: failed to add %d shadow items (%v)", len(shadows), err)
+		return
+	}
+	glog.V(2).Infof("queue: added %d shadow items", len(shadows))
+}
@@ -0,0 +1,93 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShadowConfigSampled(t *testing.T) {
+	cfg := ShadowConfig{Bucket: "shadow", Percent: 30}
+	n := 0
+	for i := 0; i < 1000; i++ {
+		if cfg.sampled(fmt.Sprintf("my-job/%040d", i)) {
+			n++
+		}
+	}
+	if n < 250 || n > 350 {
+		t.Fatalf("expected about 300 sampled items, got %d", n)
+	}
+	for _, c := range []ShadowConfig{{Percent: 10}, {Bucket: "shadow", Percent: 101}, {Bucket: "shadow", Percent: -1}} {
+		if err := c.Validate(); err == nil {
+			t.Fatalf("expected error from %+v", c)
+		}
+	}
+}
+
+func TestShadow(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if err = qu.SetBucketConfig(ctx, "my-job", BucketConfig{Shadow: ShadowConfig{Bucket: "my-job", Percent: 100}}); err == nil {
+		t.Fatal("expected own shadow bucket error")
+	}
+	if err = qu.SetBucketConfig(ctx, "my-job", BucketConfig{Shadow: ShadowConfig{Bucket: "my-job-v2", Percent: 100}}); err != nil {
+		t.Fatal(err)
+	}
+
+	item := CreateItem("my-job", 100, "data")
+	item.RequestID, item.Owner = "req-1", "alice"
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	shadow := <-qu.Pop(ctx, "my-job-v2")
+	if shadow.Err() != nil {
+		t.Fatal(shadow.Err())
+	}
+	if shadow.ShadowOf != item.Key || shadow.Value != "data" || shadow.RequestID != "" || shadow.Owner != "" {
+		t.Fatalf("unexpected shadow item %+v", shadow)
+	}
+	shadow.Progress, shadow.Value = MaxProgress, "v2 result"
+	if err = qu.Complete(ctx, shadow); err != nil {
+		t.Fatal(err)
+	}
+
+	// requeued items are not mirrored again
+	popped := <-qu.Pop(ctx, "my-job")
+	if err = qu.Add(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	batch := []*Item{CreateItem("my-job", 100, "a"), CreateItem("my-job", 100, "b")}
+	if err = qu.AddBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range batch {
+		shadow = <-qu.Pop(ctx, "my-job-v2")
+		if shadow.Err() != nil || shadow.ShadowOf != expected.Key {
+			t.Fatalf("expected shadow of %q, got %+v", expected.Key, shadow)
+		}
+	}
+	cctx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	extra := <-qu.Pop(cctx, "my-job-v2")
+	cancel()
+	if extra.Err() == nil {
+		t.Fatalf("unexpected shadow item %+v", extra)
+	}
+}
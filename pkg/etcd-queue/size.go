@@ -0,0 +1,51 @@
+package etcdqueue
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxTxnBytes is the budget of encoded items in one transaction, when
+// items are batched (see 'AddBatch' and 'AddCoalesceWindow').
+const maxTxnBytes = 1024 * 1024
+
+// ErrValueTooLarge is matched by ValueTooLargeError.
+var ErrValueTooLarge = errors.New("queue: item value too large")
+
+// ValueTooLargeError is returned when an item value exceeds
+// 'Limits.MaxValueBytes'.
+type ValueTooLargeError struct {
+	Key   string
+	Size  int
+	Limit int
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("%v: %q (%d bytes, max %d)", ErrValueTooLarge, e.Key, e.Size, e.Limit)
+}
+
+// Is makes the error match ErrValueTooLarge with errors.Is.
+func (e *ValueTooLargeError) Is(target error) bool {
+	return target == ErrValueTooLarge
+}
+
+// IsValueTooLarge returns true if the error is ValueTooLargeError.
+func IsValueTooLarge(err error) bool {
+	_, ok := err.(*ValueTooLargeError)
+	return ok
+}
+
+// checkValueSize returns ValueTooLargeError if any item value exceeds
+// 'Limits.MaxValueBytes'.
+func (qu *queue) checkValueSize(items ...*Item) error {
+	max := qu.getLimits().MaxValueBytes
+	if max <= 0 {
+		return nil
+	}
+	for _, item := range items {
+		if n := len(item.Value); n > max {
+			return &ValueTooLargeError{Key: item.Key, Size: n, Limit: max}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxValueBytes(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	big := CreateItem("my-job", 100, strings.Repeat("x", DefaultMaxValueBytes+1))
+	err = qu.Add(ctx, big)
+	if !IsValueTooLarge(err) || !err.(*ValueTooLargeError).Is(ErrValueTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrValueTooLarge, err)
+	}
+	if e := err.(*ValueTooLargeError); e.Key != big.Key || e.Size != DefaultMaxValueBytes+1 || e.Limit != DefaultMaxValueBytes {
+		t.Fatalf("unexpected error %+v", e)
+	}
+	if err = qu.AddBatch(ctx, []*Item{CreateItem("my-job", 100, "data"), big}); !IsValueTooLarge(err) {
+		t.Fatalf("expected %v, got %v", ErrValueTooLarge, err)
+	}
+	w := qu.Enqueue(ctx, big)
+	expectStatus(t, w, StatusAccepted)
+	select {
+	case st := <-w:
+		if st.Status != StatusAccepted || !strings.Contains(st.Error, "too large") {
+			t.Fatalf("expected rollback, got %+v", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to receive rollback")
+	}
+	if items, err := qu.List(ctx, "my-job"); err != nil || len(items) != 0 {
+		t.Fatalf("expected no item, got %d (%v)", len(items), err)
+	}
+
+	// batches of values at the limit are split into transactions
+	// within etcd's request limit
+	var items []*Item
+	for i := 0; i < 8; i++ {
+		items = append(items, CreateItem("my-job", 100, strings.Repeat("x", DefaultMaxValueBytes)))
+	}
+	if err = qu.AddBatch(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(window time.Duration) { AddCoalesceWindow = window }(AddCoalesceWindow)
+	AddCoalesceWindow = 5 * time.Millisecond
+	var wg sync.WaitGroup
+	errc := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errc <- qu.Add(ctx, CreateItem("my-job", 100, strings.Repeat("x", DefaultMaxValueBytes)))
+		}()
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if items, err = qu.List(ctx, "my-job"); err != nil || len(items) != 16 {
+		t.Fatalf("expected 16 items, got %d (%v)", len(items), err)
+	}
+
+	// limits are per queue instance
+	if err = qu.SetLimits(Limits{MaxValueBytes: -1}); err == nil {
+		t.Fatal("expected error on negative limit")
+	}
+	if err = qu.SetLimits(Limits{MaxValueBytes: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, CreateItem("my-job", 100, "data!")); !IsValueTooLarge(err) {
+		t.Fatalf("expected %v, got %v", ErrValueTooLarge, err)
+	}
+	if err = qu.SetLimits(Limits{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, big); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,183 @@
+package etcdqueue
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	timeToFirstClaim = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "etcdqueue",
+		Name:      "time_to_first_claim_seconds",
+		Help:      "Time from item creation to its first claim (pop).",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 20),
+	}, []string{"bucket"})
+
+	timeToCompletion = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "etcdqueue",
+		Name:      "time_to_completion_seconds",
+		Help:      "Time from item creation to its completion.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 20),
+	}, []string{"bucket"})
+)
+
+func init() {
+	prometheus.MustRegister(timeToFirstClaim)
+	prometheus.MustRegister(timeToCompletion)
+}
+
+func observeClaim(item *Item) {
+	if !item.CreatedAt.IsZero() && !item.ClaimedAt.IsZero() {
+		timeToFirstClaim.WithLabelValues(item.Bucket).Observe(item.ClaimedAt.Sub(item.CreatedAt).Seconds())
+	}
+}
+
+func observeCompletion(item *Item) {
+	if !item.CreatedAt.IsZero() && !item.CompletedAt.IsZero() {
+		timeToCompletion.WithLabelValues(item.Bucket).Observe(item.CompletedAt.Sub(item.CreatedAt).Seconds())
+	}
+}
+
+var (
+	descPending = prometheus.NewDesc(
+		"etcdqueue_pending_items",
+		"Number of pending items in the bucket.",
+		[]string{"bucket"}, nil,
+	)
+	descOldestAge = prometheus.NewDesc(
+		"etcdqueue_oldest_item_age_seconds",
+		"Age of the oldest pending item in the bucket.",
+		[]string{"bucket"}, nil,
+	)
+)
+
+// statsCollector collects bucket statistics on scrape.
+type statsCollector struct {
+	qu      Queue
+	buckets []string
+	timeout time.Duration
+}
+
+// NewStatsCollector returns a Prometheus collector of bucket depth and
+// oldest item age, which are required by the rules from AlertRules.
+func NewStatsCollector(qu Queue, buckets ...string) prometheus.Collector {
+	return &statsCollector{qu: qu, buckets: buckets, timeout: 5 * time.Second}
+}
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descPending
+	ch <- descOldestAge
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, bucket := range c.buckets {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		st, err := c.qu.Stats(ctx, bucket)
+		cancel()
+		if err != nil {
+			glog.Warningf("failed to collect stats of %q (%v)", bucket, err)
+			continue
+		}
+		var age float64
+		if !st.Oldest.IsZero() {
+			age = clockOf(c.qu).Since(st.Oldest).Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(descPending, prometheus.GaugeValue, float64(st.Pending), bucket)
+		ch <- prometheus.MustNewConstMetric(descOldestAge, prometheus.GaugeValue, age, bucket)
+	}
+}
+
+// AlertRulesConfig configures suggested alerting rules.
+type AlertRulesConfig struct {
+	// MaxPending is the queue depth threshold. Defaults to 1000.
+	MaxPending int64
+
+	// MaxOldestAge is the threshold of the oldest pending item age,
+	// to detect stalled buckets. Defaults to 10 minutes.
+	MaxOldestAge time.Duration
+
+	// MaxClaimLatency is the threshold of p99 time-to-first-claim.
+	// Defaults to 5 minutes.
+	MaxClaimLatency time.Duration
+
+	// For is the duration conditions must hold before firing.
+	// Defaults to 5 minutes.
+	For time.Duration
+}
+
+var alertRulesTmpl = template.Must(template.New("rules").Parse(`groups:
+- name: etcdqueue
+  rules:
+  - alert: EtcdQueueDepthHigh
+    expr: etcdqueue_pending_items > {{.MaxPending}}
+    for: {{.For}}
+    labels:
+      severity: warning
+    annotations:
+      summary: 'bucket {{"{{"}} $labels.bucket {{"}}"}} has {{"{{"}} $value {{"}}"}} pending items'
+  - alert: EtcdQueueStalled
+    expr: etcdqueue_oldest_item_age_seconds > {{.MaxOldestAge}} and etcdqueue_pending_items > 0
+    for: {{.For}}
+    labels:
+      severity: critical
+    annotations:
+      summary: 'bucket {{"{{"}} $labels.bucket {{"}}"}} has not been consumed for {{"{{"}} $value {{"}}"}} seconds'
+  - alert: EtcdQueueClaimLatencyHigh
+    expr: histogram_quantile(0.99, sum(rate(etcdqueue_time_to_first_claim_seconds_bucket[{{.For}}])) by (bucket, le)) > {{.MaxClaimLatency}}
+    for: {{.For}}
+    labels:
+      severity: warning
+    annotations:
+      summary: 'bucket {{"{{"}} $labels.bucket {{"}}"}} p99 time-to-first-claim is {{"{{"}} $value {{"}}"}} seconds'
+`))
+
+// AlertRules returns suggested Prometheus alerting rules in YAML,
+// for queue depth and stall conditions.
+func AlertRules(cfg AlertRulesConfig) ([]byte, error) {
+	if cfg.MaxPending == 0 {
+		cfg.MaxPending = 1000
+	}
+	if cfg.MaxOldestAge == 0 {
+		cfg.MaxOldestAge = 10 * time.Minute
+	}
+	if cfg.MaxClaimLatency == 0 {
+		cfg.MaxClaimLatency = 5 * time.Minute
+	}
+	if cfg.For == 0 {
+		cfg.For = 5 * time.Minute
+	}
+	data := struct {
+		MaxPending      int64
+		MaxOldestAge    string
+		MaxClaimLatency string
+		For             string
+	}{
+		MaxPending:      cfg.MaxPending,
+		MaxOldestAge:    fmt.Sprint(cfg.MaxOldestAge.Seconds()),
+		MaxClaimLatency: fmt.Sprint(cfg.MaxClaimLatency.Seconds()),
+		For:             promDuration(cfg.For),
+	}
+	buf := new(bytes.Buffer)
+	if err := alertRulesTmpl.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// promDuration formats the duration in Prometheus format (e.g. "5m").
+func promDuration(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
@@ -0,0 +1,86 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSLOMetrics(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	bucket := "slo-bucket"
+	if err = qu.Add(context.Background(), CreateItem(bucket, 100, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(context.Background(), CreateItem(bucket, 100, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewStatsCollector(qu, bucket))
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 2 || mfs[1].GetName() != "etcdqueue_pending_items" || mfs[1].Metric[0].GetGauge().GetValue() != 2 {
+		t.Fatalf("unexpected metrics %+v", mfs)
+	}
+
+	item := <-qu.Pop(context.Background(), bucket)
+	if item.Error != "" {
+		t.Fatal(item.Error)
+	}
+	item.Progress = MaxProgress
+	if err = qu.Complete(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []*prometheus.HistogramVec{timeToFirstClaim, timeToCompletion} {
+		var m dto.Metric
+		if err = h.WithLabelValues(bucket).(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.GetHistogram().GetSampleCount() != 1 {
+			t.Fatalf("expected 1 sample, got %+v", m.GetHistogram())
+		}
+	}
+}
+
+func TestAlertRules(t *testing.T) {
+	rules, err := AlertRules(AlertRulesConfig{MaxPending: 50, For: 90 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"expr: etcdqueue_pending_items > 50\n",
+		"expr: etcdqueue_oldest_item_age_seconds > 600 and",
+		"[90s]",
+		"for: 90s\n",
+		"{{ $labels.bucket }}",
+	} {
+		if !strings.Contains(string(rules), s) {
+			t.Fatalf("expected %q in rules:\n%s", s, rules)
+		}
+	}
+}
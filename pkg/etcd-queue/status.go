@@ -0,0 +1,82 @@
+package etcdqueue
+
+import "fmt"
+
+// transitions are the valid transitions from non-terminal statuses.
+// Requeued items (e.g. preempted, or retried) move back to pending.
+var transitions = map[Status][]Status{
+	StatusPending:    {StatusClaimed, StatusCanceled, StatusExpired, StatusTransferred},
+	StatusClaimed:    {StatusPending, StatusInProgress, StatusCompleted, StatusFailed, StatusCanceled, StatusExpired},
+	StatusInProgress: {StatusPending, StatusCompleted, StatusFailed, StatusCanceled, StatusExpired},
+}
+
+// Terminal returns true if the status is final, with no transition.
+func (st Status) Terminal() bool {
+	switch st {
+	case StatusCompleted, StatusFailed, StatusCanceled, StatusExpired, StatusTransferred:
+		return true
+	}
+	return false
+}
+
+// CanTransition returns true if the status can move to the given status.
+// Staying in the same status is valid (e.g. progress updates).
+func (st Status) CanTransition(to Status) bool {
+	if st == to {
+		return true
+	}
+	for _, next := range transitions[st] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionError is returned on invalid status transitions.
+type TransitionError struct {
+	Key  string
+	From Status
+	To   Status
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("queue: %q cannot transition from %q to %q", e.Key, e.From, e.To)
+}
+
+// IsInvalidTransition returns true if the error is TransitionError.
+func IsInvalidTransition(err error) bool {
+	_, ok := err.(*TransitionError)
+	return ok
+}
+
+// Transition moves the item to the status, or returns TransitionError
+// if the transition is invalid. Items without status (e.g. written by
+// older versions) may move to any status. Canceled items are also
+// marked with 'Canceled'.
+func (item *Item) Transition(to Status) error {
+	if item.Status != "" && !item.Status.CanTransition(to) {
+		return &TransitionError{Key: item.Key, From: item.Status, To: to}
+	}
+	item.Status = to
+	if to == StatusCanceled {
+		item.Canceled = true
+	}
+	return nil
+}
+
+// CancelMessage describes the cancellation of the item (e.g. "canceled
+// by admin: worker maintenance"), or returns empty if not canceled.
+func (item *Item) CancelMessage() string {
+	if !item.Canceled {
+		return ""
+	}
+	msg := "canceled"
+	if item.CanceledBy != "" {
+		msg += " by " + item.CanceledBy
+	}
+	if item.CancelReason != "" {
+		msg += ": " + item.CancelReason
+	}
+	return msg
+}
@@ -0,0 +1,158 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestItemTransition(t *testing.T) {
+	tests := []struct {
+		from  Status
+		to    Status
+		valid bool
+	}{
+		{"", StatusCompleted, true},
+		{StatusPending, StatusPending, true},
+		{StatusPending, StatusClaimed, true},
+		{StatusPending, StatusCanceled, true},
+		{StatusPending, StatusCompleted, false},
+		{StatusPending, StatusInProgress, false},
+		{StatusClaimed, StatusInProgress, true},
+		{StatusClaimed, StatusPending, true},
+		{StatusInProgress, StatusFailed, true},
+		{StatusInProgress, StatusExpired, true},
+		{StatusInProgress, StatusClaimed, false},
+		{StatusCompleted, StatusCompleted, true},
+		{StatusCompleted, StatusPending, false},
+		{StatusCanceled, StatusInProgress, false},
+		{StatusExpired, StatusCompleted, false},
+	}
+	for i, tt := range tests {
+		item := &Item{Key: "my-job/1", Status: tt.from}
+		err := item.Transition(tt.to)
+		if tt.valid != (err == nil) {
+			t.Fatalf("#%d: %q to %q expected valid %v, got %v", i, tt.from, tt.to, tt.valid, err)
+		}
+		if err != nil && !IsInvalidTransition(err) {
+			t.Fatalf("#%d: expected TransitionError, got %v", i, err)
+		}
+		if err == nil && item.Status != tt.to {
+			t.Fatalf("#%d: expected status %q, got %q", i, tt.to, item.Status)
+		}
+		if err != nil && item.Status != tt.from {
+			t.Fatalf("#%d: expected status %q unchanged, got %q", i, tt.from, item.Status)
+		}
+	}
+	if item := (&Item{Status: StatusClaimed}); item.Transition(StatusCanceled) != nil || !item.Canceled {
+		t.Fatalf("expected canceled item, got %+v", item)
+	}
+}
+
+func TestQueueStatus(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	item := CreateItem("my-job", 100, "data")
+	item.Status = ""
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	if item.Status != StatusPending {
+		t.Fatalf("expected %q, got %q", StatusPending, item.Status)
+	}
+
+	popped := <-qu.Pop(ctx, "my-job")
+	if popped.Status != StatusClaimed {
+		t.Fatalf("expected %q, got %q", StatusClaimed, popped.Status)
+	}
+	items, err := qu.ListByStatus(ctx, StatusInProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Status != StatusClaimed {
+		t.Fatalf("expected 1 claimed item, got %+v", items)
+	}
+
+	if err = popped.Transition(StatusInProgress); err != nil {
+		t.Fatal(err)
+	}
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	items, err = qu.ListCompleted(ctx, "my-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Status != StatusCompleted {
+		t.Fatalf("expected 1 completed item, got %+v", items)
+	}
+
+	if err = qu.Add(ctx, popped); !IsInvalidTransition(err) {
+		t.Fatalf("expected TransitionError, got %v", err)
+	}
+}
+
+func TestCancelReason(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	item1, item2 := CreateItem("my-job", 100, "data"), CreateItem("my-job", 100, "data")
+	if err = qu.AddBatch(ctx, []*Item{item1, item2}); err != nil {
+		t.Fatal(err)
+	}
+
+	canceled, err := qu.Cancel(ctx, item1.Key, WithCancelReason("admin", "worker maintenance"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := canceled.CancelMessage(); msg != "canceled by admin: worker maintenance" {
+		t.Fatalf("unexpected cancel message %q", msg)
+	}
+	ent, err := qu.Get(ctx, item1.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = canceled.Equal(ent.Item); err != nil {
+		t.Fatal(err)
+	}
+
+	if canceled, err = qu.Cancel(ctx, item2.Key); err != nil {
+		t.Fatal(err)
+	}
+	if msg := canceled.CancelMessage(); msg != "canceled" {
+		t.Fatalf("unexpected cancel message %q", msg)
+	}
+	if msg := item1.CancelMessage(); msg != "" {
+		t.Fatalf("expected no cancel message, got %q", msg)
+	}
+}
@@ -0,0 +1,98 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// pfxSubscriptions is the prefix of bucket subscriptions (e.g. Watch
+// and blocked Pop), attached to one lease per subscription:
+//
+//	_subscriptions/<bucket>/<lease ID> = <JSON of WatchInfo>
+//
+// Subscriptions of crashed processes, whose contexts are never canceled,
+// are removed by etcd when their leases expire.
+const pfxSubscriptions = "_subscriptions"
+
+func subscriptionPrefix(bucket string) string {
+	return path.Join(pfxSubscriptions, bucket) + "/"
+}
+
+func subscriptionKey(bucket string, id clientv3.LeaseID) string {
+	return subscriptionPrefix(bucket) + fmt.Sprintf("%016x", int64(id))
+}
+
+var (
+	// SubscriptionTTL is the lease TTL of bucket subscriptions in seconds.
+	// Subscriptions of crashed consumers are counted in
+	// 'BucketStats.Consumers' until the TTL. Zero disables subscriptions.
+	SubscriptionTTL = 30
+
+	// SubscriptionRetryInterval is the interval to retry registering
+	// subscriptions, while etcd is unavailable.
+	SubscriptionRetryInterval = time.Second
+)
+
+// subscribe registers the watch of the context returned by trackWatch
+// as a subscription of the bucket, until the context is done. The lease
+// is re-granted if it expires (e.g. network partition) while the watch
+// is still active.
+func (qu *queue) subscribe(ctx context.Context, bucket string) {
+	w := watcherFrom(ctx)
+	if SubscriptionTTL <= 0 || w == nil {
+		return
+	}
+	ttl := int64(SubscriptionTTL)
+	qu.goBackground("subscribe", bucket, func() {
+		for ctx.Err() == nil {
+			if err := qu.keepSubscription(ctx, bucket, w.info, ttl); err != nil && ctx.Err() == nil {
+				glog.Warningf("queue: failed to keep %s subscription of %q (%v)", w.info.Kind, bucket, err)
+				select {
+				case <-qu.clock.After(SubscriptionRetryInterval):
+				case <-ctx.Done():
+				}
+			}
+		}
+	})
+}
+
+// keepSubscription writes the subscription with a new lease, and keeps
+// the lease alive until the context is done or the lease is lost.
+func (qu *queue) keepSubscription(ctx context.Context, bucket string, info WatchInfo, ttl int64) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	lresp, err := qu.cli.Grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// revoke to remove the subscription, without waiting for the TTL
+		rctx, cancel := context.WithTimeout(valueContext{ctx}, ClaimTimeout)
+		if _, err := qu.cli.Revoke(rctx, lresp.ID); err != nil && qu.lc.err() == nil {
+			glog.V(2).Infof("queue: failed to revoke subscription lease %x of %q (%v)", lresp.ID, bucket, err)
+		}
+		cancel()
+	}()
+
+	if _, err = qu.kv.Put(ctx, subscriptionKey(bucket, lresp.ID), string(data), clientv3.WithLease(lresp.ID)); err != nil {
+		return err
+	}
+	kch, err := qu.cli.KeepAlive(ctx, lresp.ID)
+	if err != nil {
+		return err
+	}
+	for range kch {
+	}
+	if ctx.Err() == nil {
+		return fmt.Errorf("lease %x expired", lresp.ID)
+	}
+	return nil
+}
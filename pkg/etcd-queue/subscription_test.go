@@ -0,0 +1,78 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+func TestSubscriptionConsumers(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	wctx, wcancel := context.WithCancel(ctx)
+	qu.Watch(wctx, "consumers")
+	waitConsumers(t, qu, "consumers", 1)
+
+	pctx, pcancel := context.WithCancel(ctx)
+	pch := qu.Pop(pctx, "consumers")
+	waitConsumers(t, qu, "consumers", 2)
+
+	// claimed Pop is no longer a subscription
+	if err = qu.Add(ctx, CreateItem("consumers", 100, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if item := <-pch; item == nil || item.Error != "" {
+		t.Fatalf("unexpected pop %+v", item)
+	}
+	pcancel()
+	waitConsumers(t, qu, "consumers", 1)
+
+	wcancel()
+	waitConsumers(t, qu, "consumers", 0)
+
+	// subscription of a crashed consumer expires without keep-alive
+	lresp, err := qu.Client().Grant(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qu.Client().Put(ctx, subscriptionKey("consumers", lresp.ID), "{}", clientv3.WithLease(lresp.ID)); err != nil {
+		t.Fatal(err)
+	}
+	waitConsumers(t, qu, "consumers", 1)
+	waitConsumers(t, qu, "consumers", 0)
+}
+
+// waitConsumers waits until Stats returns the expected consumers.
+func waitConsumers(t *testing.T, qu Queue, bucket string, expected int64) {
+	var st BucketStats
+	var err error
+	for i := 0; i < 100; i++ {
+		if st, err = qu.Stats(context.Background(), bucket); err != nil {
+			t.Fatal(err)
+		}
+		if st.Consumers == expected {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("expected %d consumers, got %d", expected, st.Consumers)
+}
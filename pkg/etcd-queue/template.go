@@ -0,0 +1,72 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+	"github.com/gyuho/dplearn/pkg/jsonschema"
+)
+
+// ErrBucketExists is returned by CreateBucketFromTemplate when the
+// bucket already has a configuration.
+var ErrBucketExists = errors.New("queue: bucket already exists")
+
+// BucketTemplate bundles the configuration and schema of buckets (e.g.
+// per-experiment buckets), so that buckets created from the same
+// template share the same retention, retry policy, and rate limits.
+type BucketTemplate struct {
+	Config BucketConfig `json:"config"`
+
+	// Schema is the JSON schema of item values (see 'RegisterSchema').
+	// Empty means no validation.
+	Schema json.RawMessage `json:"schema,omitempty"`
+}
+
+// Validate returns an error if the configuration or schema is invalid.
+func (tmpl BucketTemplate) Validate() error {
+	if err := tmpl.Config.Validate(); err != nil {
+		return err
+	}
+	if len(tmpl.Schema) > 0 {
+		if _, err := jsonschema.Parse(tmpl.Schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (qu *queue) CreateBucketFromTemplate(ctx context.Context, bucket string, tmpl BucketTemplate) error {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if err := tmpl.Validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(tmpl.Config)
+	if err != nil {
+		return err
+	}
+
+	// the configuration is written even if empty, for the bucket to be
+	// known (see 'BucketPolicy.RejectUnknown')
+	ops := []clientv3.Op{clientv3.OpPut(configKey(bucket), string(data))}
+	if len(tmpl.Schema) > 0 {
+		ops = append(ops, clientv3.OpPut(schemaKey(bucket), string(tmpl.Schema)))
+	} else {
+		ops = append(ops, clientv3.OpDelete(schemaKey(bucket)))
+	}
+	resp, err := qu.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(configKey(bucket)), "=", 0)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrBucketExists
+	}
+	glog.Infof("queue: created %q from template %+v", bucket, tmpl.Config)
+	return nil
+}
@@ -0,0 +1,71 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCreateBucketFromTemplate(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if err = qu.CreateBucketFromTemplate(ctx, "exp-0", BucketTemplate{Schema: json.RawMessage(`{"type": "float"}`)}); err == nil {
+		t.Fatal("expected invalid schema error")
+	}
+
+	tmpl := BucketTemplate{
+		Config: BucketConfig{Retention: 72 * time.Hour, RateLimit: 10, Retry: RetryPolicy{MaxAttempts: 3}},
+		Schema: json.RawMessage(`{"type": "object", "required": ["lr"]}`),
+	}
+	for _, bucket := range []string{"exp-1", "exp-2"} {
+		if err = qu.CreateBucketFromTemplate(ctx, bucket, tmpl); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := qu.BucketConfig(ctx, bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg != tmpl.Config {
+			t.Fatalf("expected %+v, got %+v", tmpl.Config, cfg)
+		}
+		schema, err := qu.Schema(ctx, bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(schema) != string(tmpl.Schema) {
+			t.Fatalf("expected %s, got %s", tmpl.Schema, schema)
+		}
+	}
+	if err = qu.CreateBucketFromTemplate(ctx, "exp-1", BucketTemplate{}); err != ErrBucketExists {
+		t.Fatalf("expected %v, got %v", ErrBucketExists, err)
+	}
+
+	// empty templates create known buckets
+	if err = qu.SetBucketPolicy(BucketPolicy{RejectUnknown: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.CreateBucketFromTemplate(ctx, "exp-3", BucketTemplate{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, CreateItem("exp-3", 100, "data")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// TrainBucketPrefix is the bucket prefix for all training jobs.
+// Jobs for each model are scheduled in "/train/[MODEL NAME]".
+const TrainBucketPrefix = "/train"
+
+// TrainBucket returns the bucket name for training jobs of the model.
+func TrainBucket(model string) string {
+	return path.Join(TrainBucketPrefix, model)
+}
+
+// TrainJob defines a model training request, encoded as Item Value.
+type TrainJob struct {
+	// Model is the name of model to train (e.g. "cats").
+	Model string `json:"model"`
+
+	// DatasetURI is the location of training data
+	// (e.g. "gs://dplearn/datasets/cats.tar.gz").
+	DatasetURI string `json:"dataset_uri"`
+
+	// Hyperparameters are the training parameters
+	// (e.g. "learning_rate": 0.0075).
+	Hyperparameters map[string]float64 `json:"hyperparameters"`
+
+	// Epochs is the number of training iterations.
+	Epochs int `json:"epochs"`
+
+	// TargetBucket is the storage bucket to write the produced model to.
+	TargetBucket string `json:"target_bucket"`
+}
+
+// Validate returns an error if the training job is missing required fields.
+func (job *TrainJob) Validate() error {
+	switch {
+	case job.Model == "":
+		return fmt.Errorf("train job has empty model name")
+	case strings.Contains(job.Model, "/"):
+		return fmt.Errorf("train job model name %q must not contain '/'", job.Model)
+	case job.DatasetURI == "":
+		return fmt.Errorf("train job %q has empty dataset URI", job.Model)
+	case job.Epochs <= 0:
+		return fmt.Errorf("train job %q has invalid epochs %d", job.Model, job.Epochs)
+	case job.TargetBucket == "":
+		return fmt.Errorf("train job %q has empty target bucket", job.Model)
+	}
+	return nil
+}
+
+// CreateTrainItem creates an item in the model's training bucket,
+// with the training job as its value.
+func CreateTrainItem(weight uint64, job *TrainJob) (*Item, error) {
+	if job == nil {
+		return nil, fmt.Errorf("received <nil> TrainJob")
+	}
+	if err := job.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	return CreateItem(TrainBucket(job.Model), weight, string(data)), nil
+}
+
+// ParseTrainJob decodes the training job from the item.
+func ParseTrainJob(item *Item) (*TrainJob, error) {
+	if item == nil {
+		return nil, fmt.Errorf("received <nil> Item")
+	}
+	if path.Dir(item.Bucket) != TrainBucketPrefix {
+		return nil, fmt.Errorf("%q is not a training bucket", item.Bucket)
+	}
+	var job TrainJob
+	if err := json.Unmarshal([]byte(item.Value), &job); err != nil {
+		return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", item.Key, item.Value, err)
+	}
+	if err := job.Validate(); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// AddTrainJob schedules the training job, and returns the created item.
+func AddTrainJob(ctx context.Context, qu Queue, weight uint64, job *TrainJob, opts ...OpOption) (*Item, error) {
+	item, err := CreateTrainItem(weight, job)
+	if err != nil {
+		return nil, err
+	}
+	if err = qu.Add(ctx, item, opts...); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// PopTrainJob returns the first training job of the model.
+// It blocks until there is at least one job to return.
+func PopTrainJob(ctx context.Context, qu Queue, model string) (*Item, *TrainJob, error) {
+	item := <-qu.Pop(ctx, TrainBucket(model))
+	if item == nil {
+		return nil, nil, fmt.Errorf("%q watch has been closed", TrainBucket(model))
+	}
+	if item.Error != "" {
+		return item, nil, item.Err()
+	}
+	job, err := ParseTrainJob(item)
+	return item, job, err
+}
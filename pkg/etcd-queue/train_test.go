@@ -0,0 +1,38 @@
+package etcdqueue
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTrainJob(t *testing.T) {
+	job := &TrainJob{
+		Model:           "cats",
+		DatasetURI:      "gs://test/datasets/cats.tar.gz",
+		Hyperparameters: map[string]float64{"learning_rate": 0.0075},
+		Epochs:          2500,
+		TargetBucket:    "test-models",
+	}
+	item, err := CreateTrainItem(100, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Bucket != "/train/cats" {
+		t.Fatalf("unexpected bucket %q", item.Bucket)
+	}
+
+	parsed, err := ParseTrainJob(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(job, parsed) {
+		t.Fatalf("expected %+v, got %+v", job, parsed)
+	}
+
+	if _, err = CreateTrainItem(100, &TrainJob{Model: "cats", DatasetURI: "gs://test", TargetBucket: "test-models"}); err == nil {
+		t.Fatal("expected error on zero epochs")
+	}
+	if _, err = ParseTrainJob(CreateItem("/cats-request", 100, item.Value)); err == nil {
+		t.Fatal("expected error on non-training bucket")
+	}
+}
@@ -0,0 +1,145 @@
+package etcdqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// ErrBucketPaused is returned by Add and AddBatch, and set in 'Item.Error'
+// by Pop, for buckets paused by their configuration (see 'Transfer').
+var ErrBucketPaused = errors.New("queue: bucket is paused")
+
+// pfxTransferred is the prefix of items transferred to another queue,
+// kept for 'TransferRetention' so that Get and WatchItem of their keys
+// return StatusTransferred:
+//
+//	_transferred/<item-key> = <JSON of Item>
+const pfxTransferred = "_transferred"
+
+func transferredKey(itemKey string) string {
+	return path.Join(pfxTransferred, itemKey)
+}
+
+// TransferRetention is how long records of transferred items are kept
+// in the source queue.
+var TransferRetention = 7 * 24 * time.Hour
+
+// checkPaused returns ErrBucketPaused if any bucket of the items is paused.
+func (qu *queue) checkPaused(ctx context.Context, items ...*Item) error {
+	for _, item := range items {
+		cfg, err := qu.bucketConfig(ctx, item.Bucket)
+		if err != nil {
+			return err
+		}
+		if cfg.Paused {
+			return ErrBucketPaused
+		}
+	}
+	return nil
+}
+
+func (qu *queue) Transfer(ctx context.Context, dst Queue, bucket string) (int, error) {
+	cfg, err := qu.BucketConfig(ctx, bucket)
+	if err != nil {
+		return 0, err
+	}
+	if !cfg.Paused {
+		cfg.Paused = true
+		if err = qu.SetBucketConfig(ctx, bucket, cfg); err != nil {
+			return 0, err
+		}
+		glog.Infof("queue: paused %q for transfer", bucket)
+	}
+	lresp, err := qu.grant(ctx, int64(TransferRetention.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for {
+		resp, err := qu.kv.Get(ctx, bucketPrefix(bucket), clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend), clientv3.WithLimit(MaxBatchSize))
+		if err != nil {
+			return n, err
+		}
+		if len(resp.Kvs) == 0 {
+			break
+		}
+		for _, kv := range resp.Kvs {
+			item, err := decodeItem(kv)
+			if err != nil {
+				return n, err
+			}
+			moved, err := qu.transferItem(ctx, dst, item, kv.ModRevision, lresp.ID)
+			if err != nil {
+				return n, err
+			}
+			if moved {
+				n++
+			}
+		}
+	}
+
+	// the event without key redirects bucket watchers
+	if _, err = qu.kv.Txn(ctx).Then(qu.eventOp(ctx, EventTransfer, bucket, "", nil)).Commit(); err != nil {
+		return n, err
+	}
+	glog.Infof("queue: transferred %d items of %q to %v", n, bucket, dst.ClientEndpoints())
+	return n, nil
+}
+
+// transferItem adds the copy of the pending item to the destination, and
+// then records the item as transferred, if it is still pending at the
+// revision. Items popped or canceled in the meantime (before the pause
+// took effect) are canceled in the destination. It returns false if the
+// item has not been transferred.
+func (qu *queue) transferItem(ctx context.Context, dst Queue, item *Item, rev int64, lease clientv3.LeaseID) (bool, error) {
+	// links to items and workers of the source are dropped, and the
+	// destination assigns its own sequence and charge
+	c := *item
+	c.Status = StatusPending
+	c.Sequence, c.Charged = 0, 0
+	c.ParentKey, c.ChildKeys = "", nil
+	c.AffinityKey, c.Affinity, c.Worker = "", "", ""
+	if err := dst.Add(ctx, &c); err != nil {
+		return false, fmt.Errorf("failed to add %q to destination (%v)", item.Key, err)
+	}
+
+	transferred := *item
+	transferred.Status = StatusTransferred
+	data, err := marshalItem(&transferred)
+	if err != nil {
+		return false, err
+	}
+	ops := append(unindexOps(item, StatusPending),
+		clientv3.OpDelete(PendingKey(item.Key)),
+		clientv3.OpPut(transferredKey(item.Key), string(data), clientv3.WithLease(lease)),
+		qu.eventOp(ctx, EventTransfer, item.Bucket, item.Key, data),
+	)
+	if item.IdempotencyKey != "" {
+		ops = append(ops, clientv3.OpDelete(idempotencyKey(item)))
+	}
+
+	qu.writemu.Lock()
+	ok, err := qu.releaseTxn(ctx, []*Item{item}, []clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(PendingKey(item.Key)), "=", rev),
+	}, ops)
+	qu.invalidateFront(item.Bucket)
+	qu.writemu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		glog.Warningf("queue: %q removed during transfer; canceling its copy", item.Key)
+		if _, err = dst.Cancel(ctx, c.Key, WithCancelReason("transfer", "removed from source during transfer")); err != nil {
+			glog.Warningf("queue: failed to cancel copy of %q (%v)", item.Key, err)
+		}
+		return false, nil
+	}
+	return true, nil
+}
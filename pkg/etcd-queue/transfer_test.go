@@ -0,0 +1,98 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransfer(t *testing.T) {
+	var queues []Queue
+	for i := 0; i < 2; i++ {
+		cport := int(atomic.LoadInt32(&basePort))
+		atomic.StoreInt32(&basePort, int32(cport)+2)
+
+		dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dataDir)
+
+		qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer qu.Stop()
+		queues = append(queues, qu)
+	}
+	src, dst := queues[0], queues[1]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var items []*Item
+	for i := 0; i < 3; i++ {
+		item := CreateItem("transfer", uint64(100-i), fmt.Sprintf("job-%d", i))
+		if err := src.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	w := src.WatchItem(ctx, items[0].Key)
+	if item := <-w; item == nil || item.Status != StatusPending {
+		t.Fatalf("expected pending item, got %+v", item)
+	}
+
+	n, err := src.Transfer(ctx, dst, "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 transferred items, got %d", n)
+	}
+
+	// destination keeps keys and order
+	moved, err := dst.List(ctx, "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 3 {
+		t.Fatalf("expected 3 items, got %+v", moved)
+	}
+	for i, item := range moved {
+		if item.Key != items[i].Key || item.Value != items[i].Value || item.Sequence != uint64(i+1) {
+			t.Fatalf("#%d: expected %+v, got %+v", i, items[i], item)
+		}
+	}
+
+	// source watchers end with the transferred state
+	var last *Item
+	for item := range w {
+		last = item
+	}
+	if last == nil || last.Status != StatusTransferred {
+		t.Fatalf("expected transferred item, got %+v", last)
+	}
+	ent, err := src.Get(ctx, items[1].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.Status != StatusTransferred {
+		t.Fatalf("expected %q, got %q", StatusTransferred, ent.Status)
+	}
+
+	// source bucket stays paused
+	if err = src.Add(ctx, CreateItem("transfer", 100, "late")); err != ErrBucketPaused {
+		t.Fatalf("expected %v, got %v", ErrBucketPaused, err)
+	}
+	if item := <-src.Pop(ctx, "transfer"); item == nil || item.Err() != ErrBucketPaused {
+		t.Fatalf("expected %v, got %+v", ErrBucketPaused, item)
+	}
+	if item := <-dst.Pop(ctx, "transfer"); item == nil || item.Err() != nil || item.Key != items[0].Key {
+		t.Fatalf("expected %q, got %+v", items[0].Key, item)
+	}
+}
@@ -0,0 +1,106 @@
+//go:build go1.18
+// +build go1.18
+
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// TypedQueue wraps Queue, to encode and decode item values of type T
+// as JSON. Requires Go 1.18 or later.
+type TypedQueue[T any] struct {
+	qu Queue
+}
+
+// NewTypedQueue returns a TypedQueue over the queue.
+func NewTypedQueue[T any](qu Queue) *TypedQueue[T] {
+	return &TypedQueue[T]{qu: qu}
+}
+
+// TypedItem is the item with its decoded value.
+type TypedItem[T any] struct {
+	Item  *Item
+	Value T
+}
+
+// Queue returns the underlying queue.
+func (tq *TypedQueue[T]) Queue() Queue {
+	return tq.qu
+}
+
+func (tq *TypedQueue[T]) decode(item *Item) (*TypedItem[T], error) {
+	ti := &TypedItem[T]{Item: item}
+	if err := json.Unmarshal([]byte(item.Value), &ti.Value); err != nil {
+		return ti, fmt.Errorf("%q has wrong JSON value %q (%v)", item.Key, item.Value, err)
+	}
+	return ti, nil
+}
+
+// Enqueue creates an item with the JSON-encoded value, and adds it to the queue.
+func (tq *TypedQueue[T]) Enqueue(ctx context.Context, bucket string, weight uint64, v T, opts ...OpOption) (*TypedItem[T], error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	item := CreateItem(bucket, weight, string(data))
+	item.ContentType = ContentTypeJSON
+	if err = tq.qu.Add(ctx, item, opts...); err != nil {
+		return nil, err
+	}
+	return &TypedItem[T]{Item: item, Value: v}, nil
+}
+
+// Front returns the first item in the bucket, or <nil> if empty.
+func (tq *TypedQueue[T]) Front(ctx context.Context, bucket string, opts ...OpOption) (*TypedItem[T], error) {
+	item, err := tq.qu.Front(ctx, bucket, opts...)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	return tq.decode(item)
+}
+
+// Pop pops the first item in the bucket, blocking until there is one.
+func (tq *TypedQueue[T]) Pop(ctx context.Context, bucket string) (*TypedItem[T], error) {
+	item := <-tq.qu.Pop(ctx, bucket)
+	if item.Error != "" {
+		return nil, item.Err()
+	}
+	return tq.decode(item)
+}
+
+// TypedEvent is the event with the decoded value of its item.
+type TypedEvent[T any] struct {
+	Event *Event
+	Value T
+}
+
+// Watch streams the events of items in the bucket (see 'Queue.Watch'),
+// with decoded values. Watch and decoding errors are set in 'Event.Error'.
+func (tq *TypedQueue[T]) Watch(ctx context.Context, bucket string, opts ...OpOption) <-chan *TypedEvent[T] {
+	ch := make(chan *TypedEvent[T], 100)
+	wch := tq.qu.Watch(ctx, bucket, opts...)
+	goBackgroundOf(tq.qu, "typed-watch", bucket, func(stopc <-chan struct{}) {
+		defer close(ch)
+		for ev := range wch {
+			te := &TypedEvent[T]{Event: ev}
+			if ev.Error == "" && ev.Item != nil {
+				ti, err := tq.decode(ev.Item)
+				if err != nil {
+					ev.Error = err.Error()
+				}
+				te.Value = ti.Value
+			}
+			select {
+			case ch <- te:
+			case <-ctx.Done():
+				return
+			case <-stopc:
+				return
+			}
+		}
+	})
+	return ch
+}
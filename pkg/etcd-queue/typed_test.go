@@ -0,0 +1,82 @@
+//go:build go1.18
+// +build go1.18
+
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testJob struct {
+	Image  string  `json:"image"`
+	Thresh float64 `json:"thresh"`
+}
+
+func TestTypedQueue(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tq := NewTypedQueue[testJob](qu)
+	bucket := "typed-bucket"
+	wch := tq.Watch(ctx, bucket)
+
+	job := testJob{Image: "a.jpg", Thresh: 0.5}
+	added, err := tq.Enqueue(ctx, bucket, 100, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Item.Value != `{"image":"a.jpg","thresh":0.5}` {
+		t.Fatalf("unexpected value %q", added.Item.Value)
+	}
+
+	select {
+	case te := <-wch:
+		if te.Event.Error != "" || te.Event.Type != EventCreated || te.Value != job {
+			t.Fatalf("expected created %+v, got %+v (%+v)", job, te.Value, te.Event)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected watch event")
+	}
+
+	front, err := tq.Front(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if front.Value != job {
+		t.Fatalf("expected %+v, got %+v", job, front.Value)
+	}
+	popped, err := tq.Pop(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if popped.Value != job || popped.Item.Key != added.Item.Key {
+		t.Fatalf("expected %+v, got %+v", added, popped)
+	}
+
+	if err = qu.Add(ctx, CreateItem(bucket, 100, "garbage")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tq.Front(ctx, bucket); err == nil {
+		t.Fatal("expected decoding error")
+	}
+}
@@ -0,0 +1,94 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// UndeleteWindow is the grace period after Cancel, during which
+// the canceled item can be restored with Undelete.
+var UndeleteWindow = 10 * time.Minute
+
+func (qu *queue) Undelete(ctx context.Context, itemKey string) (*Item, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if !qu.breaker.allow() {
+		return nil, ErrQueueUnavailable
+	}
+
+	// parent progress is updated after 'writemu' is released
+	var restored *Item
+	defer func() {
+		if restored != nil {
+			qu.aggregateProgress(ctx, restored.ParentKey)
+		}
+	}()
+
+	qu.writemu.Lock()
+	defer qu.writemu.Unlock()
+
+	// canceled items are only in the status index
+	idxKey := statusIndexPrefix(StatusCanceled) + itemKey
+	gresp, err := qu.kv.Get(ctx, idxKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(gresp.Kvs) == 0 {
+		return nil, ErrItemNotFound
+	}
+	var ent IndexEntry
+	if err = json.Unmarshal(gresp.Kvs[0].Value, &ent); err != nil {
+		return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", idxKey, string(gresp.Kvs[0].Value), err)
+	}
+	if ent.Item == nil {
+		return nil, fmt.Errorf("%q has no item", idxKey)
+	}
+	item := ent.Item
+	if item.CanceledAt.IsZero() || qu.clock.Since(item.CanceledAt) > UndeleteWindow {
+		return nil, ErrUndeleteExpired
+	}
+
+	// canceled is terminal, so the item is restored without Transition
+	item.Status = StatusPending
+	item.Canceled, item.CanceledBy, item.CancelReason, item.CanceledAt = false, "", "", time.Time{}
+	data, err := marshalItem(item)
+	if err != nil {
+		return nil, err
+	}
+
+	cmps := []clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(idxKey), "=", gresp.Kvs[0].ModRevision),
+		clientv3.Compare(clientv3.CreateRevision(CompletedKey(itemKey)), "=", 0),
+	}
+	ops := []clientv3.Op{
+		clientv3.OpPut(PendingKey(itemKey), string(data)),
+		qu.eventOp(ctx, EventUndelete, item.Bucket, item.Key, data),
+	}
+	if item.IdempotencyKey != "" {
+		// the key was released on Cancel
+		ik := idempotencyKey(item)
+		cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(ik), "=", 0))
+		ops = append(ops, clientv3.OpPut(ik, item.Key))
+	}
+	ops = append(ops, unfanOutOps(item)...)
+	ops = append(ops, childProgressOps(item)...)
+	resp, err := qu.kv.Txn(ctx).
+		If(cmps...).
+		Then(append(ops, indexOps(item, data, StatusPending, StatusCanceled)...)...).
+		Commit()
+	qu.invalidateFront(item.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, fmt.Errorf("%q has been completed, or requested again since canceled", itemKey)
+	}
+	glog.Infof("queue: undeleted %q", itemKey)
+	restored = item
+	return item, nil
+}
@@ -0,0 +1,78 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUndelete(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	item1, item2 := CreateItem("my-job", 200, "first"), CreateItem("my-job", 100, "second")
+	item1.IdempotencyKey = "req-1"
+	for _, item := range []*Item{item1, item2} {
+		if err = qu.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = qu.Undelete(ctx, item1.Key); err != ErrItemNotFound {
+		t.Fatalf("expected %v, got %v", ErrItemNotFound, err)
+	}
+
+	if _, err = qu.Cancel(ctx, item1.Key, WithCancelReason("admin", "oops")); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := qu.Undelete(ctx, item1.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = item1.Equal(restored); err != nil {
+		t.Fatal(err)
+	}
+
+	// restored to its original position, with its idempotency key
+	front, err := qu.Front(ctx, "my-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if front.Key != item1.Key || front.Status != StatusPending {
+		t.Fatalf("expected pending %q in front, got %+v", item1.Key, front)
+	}
+	dup := CreateItem("my-job", 100, "first")
+	dup.IdempotencyKey = "req-1"
+	if err = qu.Add(ctx, dup); err != nil {
+		t.Fatal(err)
+	}
+	if dup.Key != item1.Key {
+		t.Fatalf("expected attached %q, got %q", item1.Key, dup.Key)
+	}
+
+	// not restored after the window
+	clk := NewFakeClock(time.Now())
+	qu.(*embeddedQueue).Queue.(*queue).clock = clk
+	if _, err = qu.Cancel(ctx, item2.Key); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(UndeleteWindow + time.Second)
+	if _, err = qu.Undelete(ctx, item2.Key); err != ErrUndeleteExpired {
+		t.Fatalf("expected %v, got %v", ErrUndeleteExpired, err)
+	}
+}
@@ -0,0 +1,133 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// EventWatcher is receive-only channel of queue events.
+type EventWatcher <-chan *Event
+
+// WithRev configures WatchBucket to start from the revision, so that
+// consumers resume from the last received 'Event.Rev' plus one.
+func WithRev(rev int64) OpOption {
+	return func(op *Op) { op.rev = rev }
+}
+
+func (qu *queue) WatchBucket(ctx context.Context, bucket string, opts ...OpOption) EventWatcher {
+	ret := Op{}
+	ret.applyOpts(opts)
+
+	if err := qu.lc.err(); err != nil {
+		return closedEventWatcher(bucket, err)
+	}
+	ch := make(chan *Event, 100)
+	ctx, done := qu.trackWatch(ctx, "watch-bucket", bucketEventsPrefix(bucket))
+	qu.subscribe(ctx, bucket)
+
+	wopts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithFilterDelete()}
+	if ret.rev > 0 {
+		wopts = append(wopts, clientv3.WithRev(ret.rev))
+	}
+	wch := qu.cli.Watch(ctx, bucketEventsPrefix(bucket), wopts...)
+	if !qu.goBackground("watch-bucket", bucket, func() {
+		var delta *deltaEncoder
+		if ret.delta {
+			delta = &deltaEncoder{}
+		}
+		defer close(ch)
+		defer done()
+		defer notifyEvictedEvent(ctx, ch, bucket)
+		defer qu.recoverPanic("watch-bucket", bucket, func(err error) {
+			notifyEvent(ch, &Event{Bucket: bucket, Error: err.Error()})
+		})
+
+		for wresp := range wch {
+			if wresp.Err() != nil {
+				sendEvent(ctx, ch, &Event{Bucket: bucket, Error: fmt.Sprintf("%q returned error %v", bucketEventsPrefix(bucket), wresp.Err())})
+				return
+			}
+
+			// redaction is read once per response, to apply its changes
+			var r *Redaction
+			for _, wev := range wresp.Events {
+				var ev Event
+				if err := json.Unmarshal(wev.Kv.Value, &ev); err != nil {
+					ev = Event{Bucket: bucket, Error: fmt.Sprintf("%q returned wrong JSON %q (%v)", string(wev.Kv.Key), string(wev.Kv.Value), err)}
+				} else if ev.Bucket != bucket {
+					continue
+				}
+				ev.Rev = wev.Kv.ModRevision
+				if ev.Item != nil {
+					if r == nil {
+						rd, err := qu.Redaction(ctx, bucket)
+						if err != nil {
+							sendEvent(ctx, ch, &Event{Bucket: bucket, Rev: ev.Rev, Error: err.Error()})
+							return
+						}
+						r = &rd
+					}
+					ev.Item = r.Redact(ev.Item)
+				}
+				if delta != nil && ev.Error == "" {
+					if err := delta.encode(&ev); err != nil {
+						ev = Event{Bucket: bucket, Rev: ev.Rev, Error: err.Error()}
+					}
+				}
+				if !sendEvent(ctx, ch, &ev) {
+					return
+				}
+			}
+		}
+	}) {
+		done()
+		return closedEventWatcher(bucket, ErrQueueClosed)
+	}
+	return ch
+}
+
+// sendEvent is send for event channels.
+func sendEvent(ctx context.Context, ch chan<- *Event, ev *Event) bool {
+	select {
+	case ch <- ev:
+		return true
+	default:
+	}
+
+	w := watcherFrom(ctx)
+	if w != nil {
+		atomic.StoreInt64(&w.blockedSince, w.clock.Now().UnixNano())
+		defer atomic.StoreInt64(&w.blockedSince, 0)
+	}
+	select {
+	case ch <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// notifyEvictedEvent is notifyEvicted for event channels.
+func notifyEvictedEvent(ctx context.Context, ch chan *Event, bucket string) {
+	w := watcherFrom(ctx)
+	if w == nil || atomic.LoadInt32(&w.evicted) == 0 {
+		return
+	}
+	notifyEvent(ch, &Event{Bucket: bucket, Error: ErrWatcherEvicted.Error()})
+}
+
+// notifyEvent is notifyItem for event channels.
+func notifyEvent(ch chan *Event, ev *Event) {
+	select {
+	case <-ch:
+	default:
+	}
+	select {
+	case ch <- ev:
+	default:
+	}
+}
@@ -0,0 +1,136 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+func TestWatchBucket(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err = qu.SetRedaction(ctx, "my-job", Redaction{Fields: []string{"value"}}); err != nil {
+		t.Fatal(err)
+	}
+	wch := qu.WatchBucket(ctx, "my-job")
+
+	item := CreateItem("my-job", 100, "secret")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	if err = qu.Add(ctx, CreateItem("other-job", 100, "other")); err != nil {
+		t.Fatal(err)
+	}
+	popped := <-qu.Pop(ctx, "my-job")
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		tp EventType
+		st Status
+	}{
+		{EventAdd, StatusPending},
+		{EventPop, StatusClaimed},
+		{EventComplete, StatusCompleted},
+	}
+	var firstRev int64
+	for i, exp := range expected {
+		select {
+		case ev := <-wch:
+			if ev.Error != "" {
+				t.Fatalf("#%d: unexpected error %q", i, ev.Error)
+			}
+			if ev.Type != exp.tp || ev.Key != item.Key || ev.Item == nil || ev.Item.Status != exp.st {
+				t.Fatalf("#%d: expected %q event of %q in %q, got %+v", i, exp.tp, item.Key, exp.st, ev)
+			}
+			if ev.Item.Value == "secret" {
+				t.Fatalf("#%d: expected redacted value, got %q", i, ev.Item.Value)
+			}
+			if i == 0 {
+				firstRev = ev.Rev
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("#%d: timed out waiting for %q event", i, exp.tp)
+		}
+	}
+
+	// resume from the revision of the second event
+	rch := qu.WatchBucket(ctx, "my-job", WithRev(firstRev+1))
+	for i, exp := range expected[1:] {
+		select {
+		case ev := <-rch:
+			if ev.Type != exp.tp || ev.Key != item.Key {
+				t.Fatalf("#%d: expected %q event of %q, got %+v", i, exp.tp, item.Key, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("#%d: timed out waiting for %q event", i, exp.tp)
+		}
+	}
+}
+
+func TestWatchBucketJournalKeys(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	// events are journaled under their buckets, where bucket watches read
+	ctx := context.Background()
+	for _, bucket := range []string{"my-job", "my-job-2", "other-job"} {
+		if err = qu.Add(ctx, CreateItem(bucket, 100, "data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = qu.Purge(ctx, "my-job"); err != nil {
+		t.Fatal(err)
+	}
+	eq := qu.(*embeddedQueue).Queue.(*queue)
+	resp, err := eq.kv.Get(ctx, bucketEventsPrefix("my-job"), clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 2 {
+		t.Fatalf("expected 2 events of %q, got %d", "my-job", len(resp.Kvs))
+	}
+	for _, kv := range resp.Kvs {
+		if _, ok := eventKeyTime(string(kv.Key)); !ok {
+			t.Fatalf("expected event time in %q", kv.Key)
+		}
+	}
+	if evs, err := qu.ReadEvents(ctx, 0); err != nil || len(evs) != 4 {
+		t.Fatalf("expected 4 events, got %d (%v)", len(evs), err)
+	}
+}
@@ -0,0 +1,171 @@
+package etcdqueue
+
+import (
+	"context"
+	"time"
+)
+
+// WithNotifyWindow configures Watch, WatchItem and Enqueue to coalesce
+// states of the same item received within the window into one delivery
+// of the latest state (e.g. rapid progress updates), so that consumers
+// (e.g. frontends) are not woken up for every intermediate state.
+// States are delivered at most the window after they are received.
+func WithNotifyWindow(window time.Duration) OpOption {
+	return func(op *Op) { op.notifyWindow = window }
+}
+
+// coalesceItems relays items from the watcher, delivering the latest
+// state of each item key received within the window, in the order the
+// keys are first received. Items without a key (e.g. watch errors) are
+// delivered right after the states received before them. The returned
+// watcher is closed after the given watcher is closed and drained, or
+// the context is done, or on Stop. The given watcher is returned after
+// Stop.
+func (qu *queue) coalesceItems(ctx context.Context, in ItemWatcher, window time.Duration) ItemWatcher {
+	if window <= 0 {
+		return in
+	}
+	out := make(chan *Item, cap(in))
+	stopc := qu.stopped()
+	if !qu.goBackground("coalesce-items", "", func() {
+		defer close(out)
+		defer qu.recoverPanic("coalesce-items", "", func(err error) {
+			notifyItem(out, &Item{Error: err.Error()})
+		})
+
+		var (
+			keys   []string
+			latest = make(map[string]*Item)
+			timer  <-chan time.Time
+		)
+		flush := func() bool {
+			for _, key := range keys {
+				select {
+				case out <- latest[key]:
+				case <-ctx.Done():
+					return false
+				case <-stopc:
+					return false
+				}
+				delete(latest, key)
+			}
+			keys, timer = keys[:0], nil
+			return true
+		}
+		for {
+			select {
+			case item, ok := <-in:
+				if !ok {
+					flush()
+					return
+				}
+				if item.Key == "" {
+					if !flush() {
+						return
+					}
+					select {
+					case out <- item:
+					case <-ctx.Done():
+						return
+					case <-stopc:
+						return
+					}
+					continue
+				}
+				if _, ok := latest[item.Key]; !ok {
+					keys = append(keys, item.Key)
+				}
+				latest[item.Key] = item
+				if timer == nil {
+					timer = qu.clock.After(window)
+				}
+
+			case <-timer:
+				if !flush() {
+					return
+				}
+			}
+		}
+	}) {
+		return in
+	}
+	return out
+}
+
+// coalesceEvents is coalesceItems for event watchers. The coalesced
+// event of an item created within the window remains EventCreated.
+func (qu *queue) coalesceEvents(ctx context.Context, in EventWatcher, window time.Duration) EventWatcher {
+	if window <= 0 {
+		return in
+	}
+	out := make(chan *Event, cap(in))
+	stopc := qu.stopped()
+	if !qu.goBackground("coalesce-events", "", func() {
+		defer close(out)
+		defer qu.recoverPanic("coalesce-events", "", func(err error) {
+			notifyEvent(out, &Event{Error: err.Error()})
+		})
+
+		var (
+			keys   []string
+			latest = make(map[string]*Event)
+			timer  <-chan time.Time
+		)
+		flush := func() bool {
+			for _, key := range keys {
+				select {
+				case out <- latest[key]:
+				case <-ctx.Done():
+					return false
+				case <-stopc:
+					return false
+				}
+				delete(latest, key)
+			}
+			keys, timer = keys[:0], nil
+			return true
+		}
+		for {
+			select {
+			case ev, ok := <-in:
+				if !ok {
+					flush()
+					return
+				}
+				if ev.Key == "" {
+					if !flush() {
+						return
+					}
+					select {
+					case out <- ev:
+					case <-ctx.Done():
+						return
+					case <-stopc:
+						return
+					}
+					continue
+				}
+				prev, ok := latest[ev.Key]
+				if !ok {
+					keys = append(keys, ev.Key)
+				} else if prev.Type == EventCreated && ev.Type == EventUpdated {
+					cp := *ev
+					cp.Type = EventCreated
+					ev = &cp
+				}
+				latest[ev.Key] = ev
+				if timer == nil {
+					timer = qu.clock.After(window)
+				}
+
+			case <-timer:
+				if !flush() {
+					return
+				}
+			}
+		}
+	}) {
+		return in
+	}
+	return out
+}
@@ -0,0 +1,139 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesceItems(t *testing.T) {
+	in := make(chan *Item, 10)
+	out := (&queue{clock: DefaultClock}).coalesceItems(context.Background(), in, 100*time.Millisecond)
+
+	// progress updates of the same item within the window
+	for i := 1; i <= 3; i++ {
+		in <- &Item{Key: "a", Progress: i}
+	}
+	in <- &Item{Key: "b", Progress: 1}
+	in <- &Item{Key: "a", Progress: 4}
+
+	select {
+	case item := <-out:
+		t.Fatalf("unexpected item %+v before the window", item)
+	case <-time.After(50 * time.Millisecond):
+	}
+	expectItem(t, out, "a", 4)
+	expectItem(t, out, "b", 1)
+
+	// items without keys flush the states received before them
+	in <- &Item{Key: "a", Progress: 5}
+	in <- &Item{Error: "watch failed"}
+	expectItem(t, out, "a", 5)
+	if item := <-out; item.Error != "watch failed" {
+		t.Fatalf("expected error item, got %+v", item)
+	}
+
+	// closing flushes the pending states
+	in <- &Item{Key: "b", Progress: 2}
+	close(in)
+	expectItem(t, out, "b", 2)
+	if item, ok := <-out; ok {
+		t.Fatalf("expected closed watcher, got %+v", item)
+	}
+}
+
+func TestWatchItemNotifyWindow(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	if err = qu.Add(ctx, CreateItem("my-job", 100, "data")); err != nil {
+		t.Fatal(err)
+	}
+	popped := <-qu.Pop(ctx, "my-job")
+	if popped.Error != "" {
+		t.Fatal(popped.Error)
+	}
+	w := qu.WatchItem(ctx, popped.Key, WithNotifyWindow(time.Second))
+
+	// a burst of progress updates is delivered as its last state
+	for progress := 1; progress <= 10; progress++ {
+		popped.Progress = progress
+		if err = qu.UpdateProgress(ctx, popped); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []int
+	for len(got) == 0 || got[len(got)-1] != 10 {
+		select {
+		case item := <-w:
+			if item.Error != "" {
+				t.Fatal(item.Error)
+			}
+			got = append(got, item.Progress)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("took too long to receive progress 10, got %v", got)
+		}
+	}
+	if len(got) > 2 {
+		t.Fatalf("expected coalesced progress, got %v", got)
+	}
+
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, w, StatusCompleted)
+}
+
+func expectItem(t *testing.T, wch ItemWatcher, key string, progress int) {
+	select {
+	case item := <-wch:
+		if item.Key != key || item.Progress != progress {
+			t.Fatalf("expected %q with progress %d, got %+v", key, progress, item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("took too long to receive %q", key)
+	}
+}
+
+func TestCoalesceEvents(t *testing.T) {
+	in := make(chan *Event, 10)
+	out := (&queue{clock: DefaultClock}).coalesceEvents(context.Background(), in, 100*time.Millisecond)
+
+	// items created within the window remain created
+	in <- &Event{Type: EventCreated, Key: "a", Rev: 1}
+	in <- &Event{Type: EventUpdated, Key: "a", Rev: 2}
+	in <- &Event{Type: EventUpdated, Key: "b", Rev: 3}
+	in <- &Event{Type: EventDeleted, Key: "b", Rev: 4}
+	for _, exp := range []Event{{Type: EventCreated, Key: "a", Rev: 2}, {Type: EventDeleted, Key: "b", Rev: 4}} {
+		select {
+		case ev := <-out:
+			if ev.Type != exp.Type || ev.Key != exp.Key || ev.Rev != exp.Rev {
+				t.Fatalf("expected %+v, got %+v", exp, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("took too long to receive %+v", exp)
+		}
+	}
+
+	close(in)
+	if ev, ok := <-out; ok {
+		t.Fatalf("expected closed watcher, got %+v", ev)
+	}
+}
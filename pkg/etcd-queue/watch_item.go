@@ -0,0 +1,459 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// itemWatchBuffer is the channel size of WatchItem subscribers. Slow
+// subscribers lose their oldest states, instead of blocking others.
+const itemWatchBuffer = 10
+
+// itemSweepInterval is the interval to close WatchItem subscribers whose
+// contexts are done, without waiting for changes of their items.
+const itemSweepInterval = time.Second
+
+// itemMux is the etcd watch of events and pending keys, demultiplexed
+// to the watchers of their items, so that thousands of item watchers
+// share one watch goroutine and etcd watch stream (per queue). Item
+// states are resolved and delivered by the pool of 'NotifyWorkers'
+// goroutines.
+type itemMux struct {
+	cancel func()
+	pool   *workerPool
+
+	// fields below are guarded by 'itemWatchmu'
+	// items are the groups by item keys.
+	items map[string]*itemWatchGroup
+	// added are groups not yet resolved by the watch goroutine.
+	added []*itemWatchGroup
+
+	// notify is signaled on added groups, and when all groups are done.
+	notify chan struct{}
+}
+
+// itemWatchGroup is the subscribers of an item, shared by all WatchItem
+// calls of its key (e.g. duplicate requests attached by idempotency key).
+type itemWatchGroup struct {
+	key string
+
+	mu     sync.Mutex
+	subs   []*itemSub
+	last   *Item
+	closed bool
+
+	// resolving is true while a worker resolves the item, and dirty
+	// is true if the item changed since, to be resolved again.
+	resolving bool
+	dirty     bool
+}
+
+// itemSub is a WatchItem subscriber, registered with its consumer
+// (see 'registerWatch').
+type itemSub struct {
+	ctx  context.Context
+	ch   chan *Item
+	done func()
+}
+
+// close closes the channel, and unregisters the subscriber.
+func (s *itemSub) close() {
+	close(s.ch)
+	if s.done != nil {
+		s.done()
+	}
+}
+
+// deliver sends the item, dropping the oldest buffered item if full.
+// Only one goroutine may deliver to the subscriber at a time.
+func (s *itemSub) deliver(item *Item) {
+	for {
+		select {
+		case s.ch <- item:
+			return
+		default:
+		}
+		select {
+		case <-s.ch:
+		default:
+		}
+	}
+}
+
+func (qu *queue) WatchItem(ctx context.Context, itemKey string, opts ...OpOption) ItemWatcher {
+	ret := Op{}
+	ret.applyOpts(opts)
+
+	// keys of events and pending items are cleaned by 'path.Join'
+	itemKey = path.Clean(itemKey)
+	bucket := path.Dir(itemKey)
+	if qu.lc.err() != nil {
+		return closedWatcher(bucket)
+	}
+	sctx, done := qu.registerWatch(ctx, "watch-item", itemKey)
+	sub := &itemSub{ctx: sctx, ch: make(chan *Item, itemWatchBuffer), done: done}
+
+	qu.itemWatchmu.Lock()
+	defer qu.itemWatchmu.Unlock()
+	m := qu.itemMux
+	if m == nil {
+		if m = qu.startItemMux(); m == nil {
+			done()
+			return closedWatcher(bucket)
+		}
+		qu.itemMux = m
+	}
+	if g, ok := m.items[itemKey]; ok && g.add(sub) {
+		return qu.coalesceItems(ctx, sub.ch, ret.notifyWindow)
+	}
+	g := &itemWatchGroup{key: itemKey, subs: []*itemSub{sub}}
+	m.items[itemKey] = g
+	m.added = append(m.added, g)
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+	return qu.coalesceItems(ctx, sub.ch, ret.notifyWindow)
+}
+
+// add subscribes to the group, replaying its last state. It returns
+// false if the group has been closed.
+func (g *itemWatchGroup) add(sub *itemSub) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.subs = append(g.subs, sub)
+	if g.last != nil {
+		c := *g.last
+		sub.deliver(&c)
+	}
+	return true
+}
+
+// startItemMux starts the watch goroutine shared by item watchers.
+// Items are resolved with Get when added, and on every event of their
+// keys (and deletes of pending keys, which are not journaled on TTL
+// expiry). It returns <nil> if the queue has been stopped. It must be
+// called with 'itemWatchmu' held.
+func (qu *queue) startItemMux() *itemMux {
+	// the watch outlives its subscribers, until all are done
+	mctx, cancel := context.WithCancel(qu.rootCtx)
+	mctx, done := qu.trackWatch(mctx, "watch-item-mux", EventsPrefix())
+	m := &itemMux{
+		cancel: cancel,
+		pool:   qu.newWorkerPool(mctx, "watch-item", "", NotifyWorkers),
+		items:  make(map[string]*itemWatchGroup),
+		notify: make(chan struct{}, 1),
+	}
+
+	if !qu.goBackground("watch-item-mux", "", func() {
+		defer done()
+		defer qu.closeItemMux(m)
+		defer qu.recoverPanic("watch-item-mux", "", func(err error) {
+			qu.publishItemMux(mctx, m, "", err)
+		})
+
+		// items added before the watch are resolved after it starts
+		resp, err := qu.kv.Get(mctx, EventsPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			qu.publishItemMux(mctx, m, "", err)
+			return
+		}
+		rev := clientv3.WithRev(resp.Header.Revision + 1)
+		ech := qu.cli.Watch(mctx, EventsPrefix(), clientv3.WithPrefix(), clientv3.WithFilterDelete(), rev)
+		pch := qu.cli.Watch(mctx, pfxQueue+"/", clientv3.WithPrefix(), clientv3.WithFilterPut(), rev)
+		sweep := qu.clock.After(itemSweepInterval)
+		for {
+			var keys []string
+			select {
+			case <-sweep:
+				sweep = qu.clock.After(itemSweepInterval)
+				qu.itemWatchmu.Lock()
+				sweepItemMux(m)
+				qu.itemWatchmu.Unlock()
+
+			case <-m.notify:
+				qu.itemWatchmu.Lock()
+				for _, g := range m.added {
+					keys = append(keys, g.key)
+				}
+				m.added = nil
+				qu.itemWatchmu.Unlock()
+
+			case wresp, ok := <-ech:
+				if !ok {
+					return
+				}
+				if err = wresp.Err(); err != nil {
+					qu.publishItemMux(mctx, m, "", err)
+					return
+				}
+				for _, wev := range wresp.Events {
+					var ev struct {
+						Bucket string `json:"bucket"`
+						Key    string `json:"key"`
+					}
+					if json.Unmarshal(wev.Kv.Value, &ev) != nil {
+						continue
+					}
+					if ev.Key == "" {
+						// purge removes all pending items of the bucket
+						if ev.Bucket != "" {
+							qu.publishItemMux(mctx, m, path.Clean(ev.Bucket), nil)
+						}
+						continue
+					}
+					keys = append(keys, ev.Key)
+				}
+
+			case wresp, ok := <-pch:
+				if !ok {
+					return
+				}
+				if err = wresp.Err(); err != nil {
+					qu.publishItemMux(mctx, m, "", err)
+					return
+				}
+				for _, wev := range wresp.Events {
+					keys = append(keys, strings.TrimPrefix(string(wev.Kv.Key), pfxQueue+"/"))
+				}
+			}
+
+			for _, key := range keys {
+				qu.itemWatchmu.Lock()
+				g, ok := m.items[key]
+				qu.itemWatchmu.Unlock()
+				if ok {
+					qu.scheduleResolve(mctx, m, g)
+				}
+			}
+			if !qu.keepItemMux(m) {
+				return
+			}
+		}
+	}) {
+		cancel()
+		done()
+		return nil
+	}
+	return m
+}
+
+// scheduleResolve resolves the item on the worker pool. Each item is
+// resolved by one worker at a time, so that states are published in
+// order, and changes during resolution are coalesced.
+func (qu *queue) scheduleResolve(ctx context.Context, m *itemMux, g *itemWatchGroup) {
+	g.mu.Lock()
+	if g.resolving {
+		g.dirty = true
+		g.mu.Unlock()
+		return
+	}
+	g.resolving = true
+	g.mu.Unlock()
+
+	m.pool.submit(ctx, func() {
+		// a malformed item only fails its own watchers
+		defer qu.recoverPanic("watch-item", g.key, func(err error) {
+			g.mu.Lock()
+			g.resolving, g.dirty = false, false
+			g.mu.Unlock()
+			qu.publishItem(m, g, nil, err)
+		})
+		for {
+			qu.resolveItem(ctx, m, g)
+
+			g.mu.Lock()
+			if !g.dirty || g.closed {
+				g.resolving, g.dirty = false, false
+				g.mu.Unlock()
+				return
+			}
+			g.dirty = false
+			g.mu.Unlock()
+		}
+	})
+}
+
+// resolveItem publishes the current state of the item, removing its
+// group from the item watch if done.
+func (qu *queue) resolveItem(ctx context.Context, m *itemMux, g *itemWatchGroup) {
+	ent, _, err := qu.get(ctx, g.key)
+	qu.publishItem(m, g, ent, err)
+}
+
+// publishItem publishes the state of the item, removing its group from
+// the item watch if closed.
+func (qu *queue) publishItem(m *itemMux, g *itemWatchGroup, ent *IndexEntry, err error) {
+	if g.publish(ent, err) {
+		return
+	}
+	qu.itemWatchmu.Lock()
+	if m.items[g.key] == g {
+		delete(m.items, g.key)
+	}
+	if len(m.items) == 0 {
+		// wake up the watch goroutine to stop
+		select {
+		case m.notify <- struct{}{}:
+		default:
+		}
+	}
+	qu.itemWatchmu.Unlock()
+}
+
+// publishItemMux resolves all watched items of the bucket, or of all
+// buckets if empty, or publishes the error to them if not <nil>.
+func (qu *queue) publishItemMux(ctx context.Context, m *itemMux, bucket string, err error) {
+	qu.itemWatchmu.Lock()
+	var groups []*itemWatchGroup
+	for key, g := range m.items {
+		if bucket == "" || path.Dir(key) == bucket {
+			groups = append(groups, g)
+		}
+	}
+	qu.itemWatchmu.Unlock()
+	for _, g := range groups {
+		if err != nil {
+			qu.publishItem(m, g, nil, err)
+			continue
+		}
+		qu.scheduleResolve(ctx, m, g)
+	}
+}
+
+// keepItemMux returns false, removing the item watch, if it has no
+// items to watch.
+func (qu *queue) keepItemMux(m *itemMux) bool {
+	qu.itemWatchmu.Lock()
+	defer qu.itemWatchmu.Unlock()
+	if len(m.items) > 0 {
+		return true
+	}
+	if qu.itemMux == m {
+		qu.itemMux = nil
+	}
+	return false
+}
+
+// closeItemMux removes the item watch from the queue, and closes the
+// channels of its subscribers.
+func (qu *queue) closeItemMux(m *itemMux) {
+	qu.itemWatchmu.Lock()
+	if qu.itemMux == m {
+		qu.itemMux = nil
+	}
+	groups := m.items
+	m.items = make(map[string]*itemWatchGroup)
+	qu.itemWatchmu.Unlock()
+
+	for _, g := range groups {
+		g.close()
+	}
+	m.cancel()
+	m.pool.wait()
+}
+
+// publish sends the state of the item to subscribers, skipping
+// unchanged states. It returns false, closing the group, if the item
+// should no longer be watched (on errors, terminal states, or when all
+// subscribers are done).
+func (g *itemWatchGroup) publish(ent *IndexEntry, err error) bool {
+	var item *Item
+	if err != nil {
+		item = &Item{Bucket: path.Dir(g.key), Key: g.key, Error: err.Error()}
+	} else {
+		c := *ent.Item
+		c.Status = ent.Status
+		item = &c
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	if l := g.last; l == nil || l.Status != item.Status || l.Error != item.Error || l.Attempts != item.Attempts || l.Progress != item.Progress {
+		g.last = item
+		live := g.subs[:0]
+		for _, s := range g.subs {
+			if s.ctx.Err() != nil {
+				s.close()
+				continue
+			}
+			c := *item
+			s.deliver(&c)
+			live = append(live, s)
+		}
+		g.subs = live
+	}
+	if err == nil && !item.Status.Terminal() && len(g.subs) > 0 {
+		return true
+	}
+	g.closeLocked()
+	return false
+}
+
+// close closes the channels of all subscribers.
+func (g *itemWatchGroup) close() {
+	g.mu.Lock()
+	g.closeLocked()
+	g.mu.Unlock()
+}
+
+func (g *itemWatchGroup) closeLocked() {
+	if g.closed {
+		return
+	}
+	g.closed = true
+	for _, s := range g.subs {
+		s.close()
+	}
+	g.subs = nil
+}
+
+// reapItemWatches removes subscribers whose contexts are done, and
+// cancels the item watch without subscribers.
+func (qu *queue) reapItemWatches() {
+	qu.itemWatchmu.Lock()
+	defer qu.itemWatchmu.Unlock()
+	m := qu.itemMux
+	if m == nil {
+		return
+	}
+	sweepItemMux(m)
+	if len(m.items) == 0 {
+		m.cancel()
+		qu.itemMux = nil
+	}
+}
+
+// sweepItemMux closes subscribers whose contexts are done, and removes
+// groups without subscribers. It must be called with 'itemWatchmu' held.
+func sweepItemMux(m *itemMux) {
+	for key, g := range m.items {
+		g.mu.Lock()
+		live := g.subs[:0]
+		for _, s := range g.subs {
+			if s.ctx.Err() != nil {
+				s.close()
+				continue
+			}
+			live = append(live, s)
+		}
+		g.subs = live
+		if len(live) == 0 {
+			g.closed = true
+			delete(m.items, key)
+		}
+		g.mu.Unlock()
+	}
+}
@@ -0,0 +1,209 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchItemMux(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	var (
+		items    []*Item
+		watchers []ItemWatcher
+	)
+	for i := 0; i < 50; i++ {
+		item := CreateItem("my-job", 100, "data")
+		if err = qu.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+		watchers = append(watchers, qu.WatchItem(WithConsumer(ctx, "my-consumer"), item.Key))
+	}
+	other := CreateItem("other-job", 100, "data")
+	if err = qu.Add(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	wo := qu.WatchItem(WithConsumer(ctx, "other-consumer"), other.Key)
+
+	// one watch for all buckets, and subscribers with their consumers
+	n, consumers := 0, make(map[string]int)
+	for _, w := range qu.Watchers().Watchers {
+		switch w.Kind {
+		case "watch-item-mux":
+			n++
+		case "watch-item":
+			consumers[w.Consumer]++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 item watch, got %d", n)
+	}
+	if consumers["my-consumer"] != 50 || consumers["other-consumer"] != 1 {
+		t.Fatalf("unexpected item watchers %v", consumers)
+	}
+	for _, w := range watchers {
+		expectStatus(t, w, StatusPending)
+	}
+	expectStatus(t, wo, StatusPending)
+
+	// events are demultiplexed to the watchers of their items
+	if _, err = qu.Cancel(ctx, items[0].Key); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, watchers[0], StatusCanceled)
+	popped := <-qu.Pop(ctx, "other-job")
+	expectStatus(t, wo, StatusClaimed)
+	select {
+	case item := <-watchers[1]:
+		t.Fatalf("unexpected state %+v", item)
+	default:
+	}
+
+	// progress updates are published without status changes
+	for _, progress := range []int{30, 60} {
+		popped.Progress = progress
+		if err = qu.UpdateProgress(ctx, popped); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case item := <-wo:
+			if item.Status != StatusInProgress || item.Progress != progress {
+				t.Fatalf("expected progress %d, got %+v", progress, item)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("took too long to receive progress %d", progress)
+		}
+	}
+
+	// purged items are not found
+	if _, err = qu.Purge(ctx, "my-job"); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range watchers[1:] {
+		select {
+		case item := <-w:
+			if item.Err() != ErrItemNotFound {
+				t.Fatalf("expected %v, got %+v", ErrItemNotFound, item)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("took too long to receive purge")
+		}
+	}
+
+	// the item watch stops when its items are done
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, wo, StatusCompleted)
+	for i := 0; i < 50; i++ {
+		n = 0
+		for _, w := range qu.Watchers().Watchers {
+			if w.Kind == "watch-item-mux" || w.Kind == "watch-item" {
+				n++
+			}
+		}
+		if n == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n != 0 {
+		t.Fatalf("expected no item watchers, got %d", n)
+	}
+}
+
+func TestWatchItemUncleanBucket(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	// item keys are cleaned, but events keep the bucket as given
+	ctx := context.Background()
+	item := CreateItem("my-job/", 100, "data")
+	if err = qu.Add(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	w := qu.WatchItem(ctx, item.Key)
+	expectStatus(t, w, StatusPending)
+	popped := <-qu.Pop(ctx, "my-job/")
+	expectStatus(t, w, StatusClaimed)
+	popped.Progress = MaxProgress
+	if err = qu.Complete(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, w, StatusCompleted)
+}
+
+func TestWatchItemCanceled(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	item := CreateItem("my-job", 100, "data")
+	if err = qu.Add(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := qu.WatchItem(ctx, item.Key)
+	other := qu.WatchItem(context.Background(), item.Key)
+	expectStatus(t, w, StatusPending)
+	expectStatus(t, other, StatusPending)
+
+	// watchers close without changes of their items
+	cancel()
+	select {
+	case _, ok := <-w:
+		if ok {
+			t.Fatal("unexpected item")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to close the watcher")
+	}
+	select {
+	case item := <-other:
+		t.Fatalf("unexpected item %+v", item)
+	default:
+	}
+}
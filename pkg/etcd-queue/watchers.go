@@ -0,0 +1,307 @@
+package etcdqueue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WatchInfo describes an active watch registration, created by
+// Watch, WatchPreempt, Pop or PopBackfill.
+type WatchInfo struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"`
+	Key       string    `json:"key"`
+	Consumer  string    `json:"consumer,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// BlockedSince is set while the watcher's channel is full,
+	// since when its consumer stopped receiving.
+	BlockedSince time.Time `json:"blocked_since,omitempty"`
+}
+
+// WatcherStats is the snapshot of watch registrations.
+type WatcherStats struct {
+	Watchers []WatchInfo `json:"watchers"`
+
+	// Goroutines is the number of running watch goroutines. It is
+	// greater than the number of watchers, if reaped goroutines have
+	// not exited (e.g. blocked on sending to the consumer).
+	Goroutines int64 `json:"goroutines"`
+
+	// Reaped is the total number of reaped watchers.
+	Reaped int64 `json:"reaped"`
+
+	// Evicted is the total number of watchers evicted as slow consumers.
+	Evicted int64 `json:"evicted"`
+}
+
+type consumerKey struct{}
+
+// WithConsumer labels watch registrations created with the context,
+// so that leaked watchers can be traced back to their consumers.
+func WithConsumer(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, consumerKey{}, label)
+}
+
+func consumerFrom(ctx context.Context) string {
+	label, _ := ctx.Value(consumerKey{}).(string)
+	return label
+}
+
+// ReapInterval is the interval to reap watchers whose contexts are done,
+// and to detect slow consumers.
+var ReapInterval = time.Minute
+
+var (
+	// SlowConsumerThreshold is how long a watcher's channel can stay full,
+	// before its consumer is reported as slow.
+	SlowConsumerThreshold = time.Minute
+
+	// EvictSlowConsumers is true to cancel watchers of slow consumers,
+	// after sending a terminal item with ErrWatcherEvicted.
+	EvictSlowConsumers = false
+)
+
+// ErrWatcherEvicted is the error of the terminal item sent to slow
+// consumers, before their watchers are closed.
+var ErrWatcherEvicted = errors.New("queue: watcher evicted as slow consumer")
+
+var (
+	slowConsumers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcdqueue",
+		Name:      "slow_consumers_total",
+		Help:      "Number of watchers detected as slow consumers.",
+	}, []string{"kind"})
+
+	evictedWatchers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcdqueue",
+		Name:      "evicted_watchers_total",
+		Help:      "Number of watchers evicted as slow consumers.",
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(slowConsumers)
+	prometheus.MustRegister(evictedWatchers)
+}
+
+type watcher struct {
+	info   WatchInfo
+	ctx    context.Context
+	cancel func()
+	clock  Clock
+
+	// doneSeen is true if its context was done at the last reap.
+	doneSeen bool
+
+	// blockedSince is the unix nano time since the channel is full,
+	// or zero if not blocked. Updated atomically by the watch goroutine.
+	blockedSince int64
+	// slowSeen is true if the watcher is reported as slow consumer.
+	slowSeen bool
+	// evicted is 1 if the watcher is evicted, accessed atomically.
+	evicted int32
+}
+
+type watcherKey struct{}
+
+// watcherFrom returns the watcher of the context returned by trackWatch.
+func watcherFrom(ctx context.Context) *watcher {
+	w, _ := ctx.Value(watcherKey{}).(*watcher)
+	return w
+}
+
+// send sends the item to the watch channel, marking the watcher blocked
+// while the channel is full. It returns false if the context is done.
+func send(ctx context.Context, ch chan<- *Item, item *Item) bool {
+	select {
+	case ch <- item:
+		return true
+	default:
+	}
+
+	w := watcherFrom(ctx)
+	if w != nil {
+		atomic.StoreInt64(&w.blockedSince, w.clock.Now().UnixNano())
+		defer atomic.StoreInt64(&w.blockedSince, 0)
+	}
+	select {
+	case ch <- item:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// notifyEvicted replaces the oldest buffered item with the terminal
+// item of ErrWatcherEvicted, if the watcher has been evicted. It must
+// be called by the watch goroutine, before closing the channel.
+func notifyEvicted(ctx context.Context, ch chan *Item, bucket string) {
+	w := watcherFrom(ctx)
+	if w == nil || atomic.LoadInt32(&w.evicted) == 0 {
+		return
+	}
+	notifyItem(ch, &Item{Bucket: bucket, Error: ErrWatcherEvicted.Error()})
+}
+
+// notifyItem sends the terminal item without blocking, replacing
+// the oldest buffered item if the channel is full.
+func notifyItem(ch chan *Item, item *Item) {
+	select {
+	case <-ch:
+	default:
+	}
+	select {
+	case ch <- item:
+	default:
+	}
+}
+
+// trackWatch registers an active watch. It returns the context to be
+// used by the watch, which is canceled on reap, and the function to
+// unregister it when the watch goroutine exits.
+func (qu *queue) trackWatch(ctx context.Context, kind, key string) (context.Context, func()) {
+	cctx, unregister := qu.registerWatch(ctx, kind, key)
+	atomic.AddInt64(&qu.watchRoutines, 1)
+
+	// watches after Stop exit on the canceled context
+	added := qu.lc.add()
+	if !added {
+		unregister()
+	}
+
+	return cctx, func() {
+		unregister()
+		atomic.AddInt64(&qu.watchRoutines, -1)
+		if added {
+			qu.lc.done()
+		}
+	}
+}
+
+// registerWatch registers a watch without its own goroutine (e.g. a
+// WatchItem subscriber, served by the shared item watch), labeled with
+// the consumer of the context. It returns the context to be used by the
+// watch, which is canceled on reap, and the function to unregister it.
+func (qu *queue) registerWatch(ctx context.Context, kind, key string) (context.Context, func()) {
+	qu.watchReaperRun.Do(func() { qu.goBackground("reap-watchers", "", qu.reapWatchers) })
+
+	cctx, cancel := context.WithCancel(ctx)
+	qu.watchmu.Lock()
+	if qu.watchers == nil {
+		qu.watchers = make(map[int64]*watcher)
+	}
+	qu.watchID++
+	id := qu.watchID
+	w := &watcher{
+		info:   WatchInfo{ID: id, Kind: kind, Key: key, Consumer: consumerFrom(ctx), CreatedAt: qu.clock.Now()},
+		ctx:    ctx,
+		cancel: cancel,
+		clock:  qu.clock,
+	}
+	qu.watchers[id] = w
+	qu.watchmu.Unlock()
+	cctx = context.WithValue(cctx, watcherKey{}, w)
+
+	return cctx, func() {
+		cancel()
+		qu.watchmu.Lock()
+		delete(qu.watchers, id)
+		qu.watchmu.Unlock()
+	}
+}
+
+// cancelWatchers cancels all registered watchers, so that their
+// goroutines exit on Stop, even if blocked on sending to consumers.
+func (qu *queue) cancelWatchers() {
+	qu.watchmu.Lock()
+	for _, w := range qu.watchers {
+		w.cancel()
+	}
+	qu.watchmu.Unlock()
+}
+
+// reapWatchers removes watchers whose contexts have been done since
+// the last reap, but are still registered, and detects slow consumers,
+// until the queue stops.
+func (qu *queue) reapWatchers() {
+	for {
+		select {
+		case <-qu.clock.After(ReapInterval):
+		case <-qu.rootCtx.Done():
+			return
+		}
+
+		qu.reapItemWatches()
+
+		qu.watchmu.Lock()
+		for id, w := range qu.watchers {
+			if w.ctx.Err() == nil {
+				qu.checkSlowConsumer(w)
+				continue
+			}
+			if !w.doneSeen {
+				w.doneSeen = true
+				continue
+			}
+			glog.Warningf("queue: reaping %s watcher %q (consumer %q, created at %v)", w.info.Kind, w.info.Key, w.info.Consumer, w.info.CreatedAt)
+			w.cancel()
+			delete(qu.watchers, id)
+			qu.watchReaped++
+		}
+		qu.watchmu.Unlock()
+	}
+}
+
+// checkSlowConsumer reports the watcher if its channel has been full
+// longer than SlowConsumerThreshold, and evicts it if configured.
+// It must be called with 'watchmu' held.
+func (qu *queue) checkSlowConsumer(w *watcher) {
+	blocked := atomic.LoadInt64(&w.blockedSince)
+	if blocked == 0 {
+		w.slowSeen = false
+		return
+	}
+	since := time.Unix(0, blocked)
+	if qu.clock.Since(since) < SlowConsumerThreshold {
+		return
+	}
+	if !w.slowSeen {
+		w.slowSeen = true
+		slowConsumers.WithLabelValues(w.info.Kind).Inc()
+		glog.Warningf("queue: %s watcher %q (consumer %q) blocked since %v", w.info.Kind, w.info.Key, w.info.Consumer, since)
+	}
+	if EvictSlowConsumers && atomic.CompareAndSwapInt32(&w.evicted, 0, 1) {
+		evictedWatchers.WithLabelValues(w.info.Kind).Inc()
+		glog.Warningf("queue: evicting %s watcher %q (consumer %q)", w.info.Kind, w.info.Key, w.info.Consumer)
+		w.cancel()
+		qu.watchEvicted++
+	}
+}
+
+func (qu *queue) Watchers() WatcherStats {
+	qu.watchmu.Lock()
+	st := WatcherStats{
+		Watchers: make([]WatchInfo, 0, len(qu.watchers)),
+		Reaped:   qu.watchReaped,
+		Evicted:  qu.watchEvicted,
+	}
+	for _, w := range qu.watchers {
+		info := w.info
+		if blocked := atomic.LoadInt64(&w.blockedSince); blocked != 0 {
+			info.BlockedSince = time.Unix(0, blocked)
+		}
+		st.Watchers = append(st.Watchers, info)
+	}
+	qu.watchmu.Unlock()
+	st.Goroutines = atomic.LoadInt64(&qu.watchRoutines)
+
+	sort.Slice(st.Watchers, func(i, j int) bool { return st.Watchers[i].ID < st.Watchers[j].ID })
+	return st
+}
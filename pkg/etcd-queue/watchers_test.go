@@ -0,0 +1,119 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchers(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	prev := ReapInterval
+	ReapInterval = 100 * time.Millisecond
+	defer func() { ReapInterval = prev }()
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx, cancel := context.WithCancel(WithConsumer(context.Background(), "test-consumer"))
+	wch := qu.Watch(ctx, "test-bucket")
+
+	st := qu.Watchers()
+	if len(st.Watchers) != 1 || st.Goroutines != 1 {
+		t.Fatalf("expected 1 watcher, got %+v", st)
+	}
+	if w := st.Watchers[0]; w.Kind != "watch" || w.Key != PendingPrefix("test-bucket") || w.Consumer != "test-consumer" {
+		t.Fatalf("unexpected watcher %+v", w)
+	}
+
+	cancel()
+	for range wch {
+	}
+	time.Sleep(100 * time.Millisecond)
+	if st = qu.Watchers(); len(st.Watchers) != 0 || st.Goroutines != 0 || st.Reaped != 0 {
+		t.Fatalf("expected no watcher, got %+v", st)
+	}
+
+	// simulate a leaked watcher, whose goroutine never exits
+	lctx, lcancel := context.WithCancel(context.Background())
+	wctx, done := qu.(*embeddedQueue).Queue.(*queue).trackWatch(lctx, "watch", "leaked")
+	defer done()
+	lcancel()
+	time.Sleep(500 * time.Millisecond)
+	if st = qu.Watchers(); len(st.Watchers) != 0 || st.Goroutines != 1 || st.Reaped != 1 {
+		t.Fatalf("expected leaked watcher reaped, got %+v", st)
+	}
+	if wctx.Err() == nil {
+		t.Fatal("expected reaped watcher context canceled")
+	}
+}
+
+func TestWatchersSlowConsumer(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	prevReap, prevThreshold := ReapInterval, SlowConsumerThreshold
+	ReapInterval, SlowConsumerThreshold, EvictSlowConsumers = 50*time.Millisecond, 100*time.Millisecond, true
+	defer func() { ReapInterval, SlowConsumerThreshold, EvictSlowConsumers = prevReap, prevThreshold, false }()
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	wch := qu.Watch(WithConsumer(context.Background(), "dashboard"), "test-bucket")
+
+	// fill the watch channel, without receiving
+	items := make([]*Item, 0, 110)
+	for i := 0; i < 110; i++ {
+		items = append(items, CreateItem("test-bucket", 100, "a"))
+	}
+	if err = qu.AddBatch(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	var st WatcherStats
+	for i := 0; i < 50; i++ {
+		if st = qu.Watchers(); st.Evicted == 1 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if st.Evicted != 1 {
+		t.Fatalf("expected slow consumer evicted, got %+v", st)
+	}
+
+	var last *Event
+	n := 0
+	for ev := range wch {
+		last = ev
+		n++
+	}
+	if last == nil || last.Error != ErrWatcherEvicted.Error() {
+		t.Fatalf("expected terminal evicted event, got %+v", last)
+	}
+	if n != 100 {
+		t.Fatalf("expected 100 events with terminal event, got %d", n)
+	}
+}
@@ -0,0 +1,199 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/golang/glog"
+)
+
+// pfxWorkers is the prefix of the worker registry, attached to the
+// leases of the workers:
+//
+//	_workers/<id> = <JSON of Capabilities>
+const pfxWorkers = "_workers"
+
+func workerKey(id string) string {
+	return path.Join(pfxWorkers, id)
+}
+
+// WorkerTTL is the lease TTL of worker registrations in seconds. If the
+// worker crashes, its items with affinity may be popped by other workers
+// after the TTL.
+var WorkerTTL = 30
+
+// ErrWorkerExists is returned by RegisterWorker when a live worker is
+// registered with the same ID.
+var ErrWorkerExists = errors.New("queue: worker already registered")
+
+type workerKeyType struct{}
+
+// WithWorker returns the context of the worker ID, set as 'Item.Worker'
+// of the items popped with the context, and matched against the
+// 'Item.Affinity' of pending items.
+func WithWorker(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, workerKeyType{}, id)
+}
+
+// WorkerFrom returns the worker ID of the context, or empty if none.
+func WorkerFrom(ctx context.Context) string {
+	id, _ := ctx.Value(workerKeyType{}).(string)
+	return id
+}
+
+// Worker is a registration in the worker registry, created by
+// RegisterWorker, and kept alive until Close.
+type Worker struct {
+	id   string
+	sess *concurrency.Session
+}
+
+// WorkerInfo is a registered worker, returned by Workers.
+type WorkerInfo struct {
+	ID           string       `json:"id"`
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+func (qu *queue) RegisterWorker(ctx context.Context, id string, caps Capabilities) (*Worker, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	if id == "" || strings.Contains(id, "/") {
+		return nil, fmt.Errorf("invalid worker ID %q", id)
+	}
+	data, err := json.Marshal(caps)
+	if err != nil {
+		return nil, err
+	}
+	if err := qu.lc.err(); err != nil {
+		return nil, err
+	}
+	sess, err := concurrency.NewSession(qu.cli, concurrency.WithTTL(WorkerTTL), concurrency.WithContext(qu.rootCtx))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := qu.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(workerKey(id)), "=", 0)).
+		Then(clientv3.OpPut(workerKey(id), string(data), clientv3.WithLease(sess.Lease()))).
+		Commit()
+	if err == nil && !resp.Succeeded {
+		err = ErrWorkerExists
+	}
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	glog.Infof("queue: registered worker %q with lease %x (%s)", id, sess.Lease(), data)
+	return &Worker{id: id, sess: sess}, nil
+}
+
+// ID returns the worker ID.
+func (w *Worker) ID() string { return w.id }
+
+// Context returns the context of the worker ID (see 'WithWorker').
+func (w *Worker) Context(ctx context.Context) context.Context { return WithWorker(ctx, w.id) }
+
+// Done returns the channel closed when the registration lease expires
+// (e.g. network partition), after which the worker is no longer alive.
+func (w *Worker) Done() <-chan struct{} { return w.sess.Done() }
+
+// Close removes the worker from the registry, and revokes its lease.
+func (w *Worker) Close() error {
+	if err := w.sess.Close(); err != nil {
+		return fmt.Errorf("failed to close worker %q (%v)", w.id, err)
+	}
+	glog.Infof("queue: unregistered worker %q", w.id)
+	return nil
+}
+
+func (qu *queue) Workers(ctx context.Context) ([]WorkerInfo, error) {
+	ctx, cancel := qu.withTimeout(ctx)
+	defer cancel()
+	resp, err := qu.kv.Get(ctx, pfxWorkers+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	ws := make([]WorkerInfo, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		w, err := decodeWorker(kv.Key, kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, *w)
+	}
+	return ws, nil
+}
+
+func decodeWorker(key, value []byte) (*WorkerInfo, error) {
+	w := &WorkerInfo{ID: strings.TrimPrefix(string(key), pfxWorkers+"/")}
+	if len(value) > 0 {
+		if err := json.Unmarshal(value, &w.Capabilities); err != nil {
+			return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", string(key), string(value), err)
+		}
+	}
+	return w, nil
+}
+
+// workerInfo returns the registered worker, or nil if not registered.
+func (qu *queue) workerInfo(ctx context.Context, id string) (*WorkerInfo, error) {
+	resp, err := qu.kv.Get(ctx, workerKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return decodeWorker(resp.Kvs[0].Key, resp.Kvs[0].Value)
+}
+
+// resolveAffinity sets 'Item.Affinity' of the items with AffinityKey to
+// the worker that popped the related item. Items whose related item has
+// not been popped yet have no affinity.
+func (qu *queue) resolveAffinity(ctx context.Context, items ...*Item) error {
+	for _, item := range items {
+		if item == nil || item.AffinityKey == "" || item.Affinity != "" {
+			continue
+		}
+		ent, err := qu.Get(ctx, item.AffinityKey)
+		if err != nil {
+			if err == ErrItemNotFound {
+				return fmt.Errorf("affinity item %q of %q not found", item.AffinityKey, item.Key)
+			}
+			return err
+		}
+		item.Affinity = ent.Item.Worker
+	}
+	return nil
+}
+
+// reservedFor returns true if the item has affinity to another worker
+// than the one of the context, that is alive.
+func reservedFor(item *Item, worker string, alive map[string]*WorkerInfo) bool {
+	return item.Affinity != "" && item.Affinity != worker && alive[item.Affinity] != nil
+}
+
+// offerable returns true if the item may be popped with the context: it
+// is not routed to another live worker, and the worker of the context
+// (if registered) accepts it.
+func (qu *queue) offerable(ctx context.Context, item *Item) (bool, error) {
+	worker := WorkerFrom(ctx)
+	if item.Affinity != "" && item.Affinity != worker {
+		w, err := qu.workerInfo(ctx, item.Affinity)
+		if err != nil || w != nil {
+			return false, err
+		}
+	}
+	if worker == "" || (item.SchemaVersion == 0 && item.ModelType == "" && item.ContentType == "") {
+		return true, nil
+	}
+	w, err := qu.workerInfo(ctx, worker)
+	if err != nil {
+		return false, err
+	}
+	return w == nil || w.Capabilities.Accepts(item), nil
+}
@@ -0,0 +1,116 @@
+package etcdqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerAffinity(t *testing.T) {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.StoreInt32(&basePort, int32(cport)+2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	w1, err := qu.RegisterWorker(ctx, "gpu-1", Capabilities{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := qu.RegisterWorker(ctx, "gpu-2", Capabilities{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	if _, err = qu.RegisterWorker(ctx, "gpu-1", Capabilities{}); err != ErrWorkerExists {
+		t.Fatalf("expected %v, got %v", ErrWorkerExists, err)
+	}
+	if ws, err := qu.Workers(ctx); err != nil || len(ws) != 2 || ws[0].ID != "gpu-1" {
+		t.Fatalf("unexpected workers %+v (%v)", ws, err)
+	}
+
+	train := CreateItem("my-job", 100, "train")
+	if err = qu.Add(ctx, train); err != nil {
+		t.Fatal(err)
+	}
+	popped := <-qu.Pop(w1.Context(ctx), "my-job")
+	if popped.Err() != nil || popped.Worker != "gpu-1" {
+		t.Fatalf("expected item popped by gpu-1, got %+v", popped)
+	}
+
+	if err = qu.Add(ctx, &Item{Bucket: "my-job", Key: "x", AffinityKey: "missing"}); err == nil {
+		t.Fatal("expected missing affinity item error")
+	}
+	infer := CreateItem("my-job", 100, "infer")
+	infer.AffinityKey = train.Key
+	if err = qu.Add(ctx, infer); err != nil {
+		t.Fatal(err)
+	}
+	if infer.Affinity != "gpu-1" {
+		t.Fatalf("expected affinity to gpu-1, got %q", infer.Affinity)
+	}
+	other := CreateItem("my-job", 100, "other")
+	if err = qu.Add(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+
+	// other workers skip items routed to a live worker
+	for _, pctx := range []context.Context{w2.Context(ctx), ctx} {
+		popped = <-qu.Pop(pctx, "my-job")
+		if popped.Err() != nil || popped.Key != other.Key {
+			t.Fatalf("expected %q, got %+v", other.Key, popped)
+		}
+		if err = qu.Add(ctx, popped); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the worker claims its items first
+	popped = <-qu.Pop(w1.Context(ctx), "my-job")
+	if popped.Err() != nil || popped.Key != infer.Key {
+		t.Fatalf("expected %q, got %+v", infer.Key, popped)
+	}
+	if err = qu.Add(ctx, popped); err != nil {
+		t.Fatal(err)
+	}
+	if popped = <-qu.Pop(w2.Context(ctx), "my-job"); popped.Key != other.Key {
+		t.Fatalf("expected %q, got %+v", other.Key, popped)
+	}
+
+	cctx, cancel := context.WithTimeout(w2.Context(ctx), 300*time.Millisecond)
+	blocked := <-qu.Pop(cctx, "my-job")
+	cancel()
+	if blocked.Err() == nil {
+		t.Fatalf("expected Pop to skip %q, got %+v", infer.Key, blocked)
+	}
+
+	// items of dead workers are popped by any worker
+	donec := make(chan *Item, 1)
+	go func() {
+		donec <- <-qu.Pop(w2.Context(ctx), "my-job")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err = w1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case popped = <-donec:
+		if popped.Err() != nil || popped.Key != infer.Key || popped.Worker != "gpu-2" {
+			t.Fatalf("expected %q popped by gpu-2, got %+v", infer.Key, popped)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("took too long to pop the item of the dead worker")
+	}
+}
@@ -91,16 +91,27 @@ func (s *Storage) Close() error {
 // Put writes 'data' with 'key' as a file name in the storage.
 // The actual path will be namespaced with version and prefix.
 func (s *Storage) Put(key string, data []byte) error {
+	return s.PutContentType(key, "", data)
+}
+
+// PutContentType is Put, with the content type of the object.
+// Empty content type is detected by the storage.
+func (s *Storage) PutContentType(key, contentType string, data []byte) error {
 	glog.Infof("writing key %q (value size: %s)", key, humanize.Bytes(uint64(len(data))))
 	objectName := path.Join(v1, s.prefix, key)
 	wr := s.client.Bucket(s.bucket).Object(objectName).NewWriter(s.ctx)
-	// TODO: set wr.ContentType?
+	wr.ContentType = contentType
 	if _, err := wr.Write(data); err != nil {
 		return err
 	}
 	return wr.Close()
 }
 
+// URL returns the "gs://" URL of the object for the specified 'key'.
+func (s *Storage) URL(key string) string {
+	return fmt.Sprintf("gs://%s/%s", s.bucket, path.Join(v1, s.prefix, key))
+}
+
 // Get returns data reader for the specified 'key'.
 func (s *Storage) Get(key string) (io.ReadCloser, error) {
 	glog.Infof("fetching key %q", key)
@@ -157,6 +168,26 @@ func (s *Storage) List() ([]string, error) {
 	return keys, err
 }
 
+// ListPrefix lists the keys with the key prefix, querying only the
+// objects of the prefix.
+func (s *Storage) ListPrefix(prefix string) ([]string, error) {
+	glog.Infof("listing keys by prefix %q", prefix)
+	pfx := path.Join(v1, s.prefix) + "/"
+	it := s.client.Bucket(s.bucket).Objects(s.ctx, &storage.Query{Prefix: pfx + prefix})
+	var keys []string
+	for {
+		attr, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, strings.TrimPrefix(attr.Name, pfx))
+	}
+	return keys, nil
+}
+
 // TotalSize returns the total size of storage.
 func (s *Storage) TotalSize() (int64, error) {
 	size, _, err := s.list(s.prefix)
@@ -0,0 +1,4 @@
+// Package jsonschema implements a subset of JSON Schema validation
+// (type, properties, required, additionalProperties, items, enum,
+// minimum, maximum, minLength, maxLength, minItems, maxItems, pattern).
+package jsonschema
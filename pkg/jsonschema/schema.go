@@ -0,0 +1,239 @@
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a parsed JSON Schema.
+type Schema struct {
+	Type                 typeList           `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// typeList is "type" keyword, either a string or an array of strings.
+type typeList []string
+
+func (tl *typeList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*tl = typeList{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(data, &ss); err != nil {
+		return fmt.Errorf("'type' must be a string or an array of strings (%v)", err)
+	}
+	*tl = ss
+	return nil
+}
+
+var knownTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+// Parse parses the JSON Schema document.
+func Parse(data []byte) (*Schema, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var s Schema
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("invalid JSON Schema (%v)", err)
+	}
+	if err := s.compile("$"); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Schema) compile(at string) error {
+	for _, tp := range s.Type {
+		if !knownTypes[tp] {
+			return fmt.Errorf("%s: unknown type %q", at, tp)
+		}
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern %q (%v)", at, s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	for name, p := range s.Properties {
+		if p == nil {
+			return fmt.Errorf("%s.%s: empty schema", at, name)
+		}
+		if err := p.compile(at + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.compile(at + "[]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidationError is returned when a value does not match the schema.
+type ValidationError struct {
+	// Path is the location of the invalid value (e.g. "$.image.size").
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidateJSON validates the JSON document against the schema.
+func (s *Schema) ValidateJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return &ValidationError{Path: "$", Message: fmt.Sprintf("invalid JSON (%v)", err)}
+	}
+	return s.Validate(v)
+}
+
+// Validate validates the value decoded by 'encoding/json' against the schema.
+func (s *Schema) Validate(v interface{}) error {
+	return s.validate("$", v)
+}
+
+func (s *Schema) validate(at string, v interface{}) error {
+	if len(s.Type) > 0 {
+		tp := typeOf(v)
+		matched := false
+		for _, want := range s.Type {
+			if want == tp || (want == "number" && tp == "integer") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return &ValidationError{Path: at, Message: fmt.Sprintf("expected %s, got %s", strings.Join(s.Type, " or "), tp)}
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		matched := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return &ValidationError{Path: at, Message: fmt.Sprintf("%v is not one of %v", v, s.Enum)}
+		}
+	}
+
+	switch tv := v.(type) {
+	case float64:
+		if s.Minimum != nil && tv < *s.Minimum {
+			return &ValidationError{Path: at, Message: fmt.Sprintf("%v is less than minimum %v", tv, *s.Minimum)}
+		}
+		if s.Maximum != nil && tv > *s.Maximum {
+			return &ValidationError{Path: at, Message: fmt.Sprintf("%v is greater than maximum %v", tv, *s.Maximum)}
+		}
+
+	case string:
+		n := utf8.RuneCountInString(tv)
+		if s.MinLength != nil && n < *s.MinLength {
+			return &ValidationError{Path: at, Message: fmt.Sprintf("length %d is less than minLength %d", n, *s.MinLength)}
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return &ValidationError{Path: at, Message: fmt.Sprintf("length %d is greater than maxLength %d", n, *s.MaxLength)}
+		}
+		if s.pattern != nil && !s.pattern.MatchString(tv) {
+			return &ValidationError{Path: at, Message: fmt.Sprintf("%q does not match pattern %q", tv, s.Pattern)}
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(tv) < *s.MinItems {
+			return &ValidationError{Path: at, Message: fmt.Sprintf("%d items are less than minItems %d", len(tv), *s.MinItems)}
+		}
+		if s.MaxItems != nil && len(tv) > *s.MaxItems {
+			return &ValidationError{Path: at, Message: fmt.Sprintf("%d items are more than maxItems %d", len(tv), *s.MaxItems)}
+		}
+		if s.Items != nil {
+			for i, elem := range tv {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", at, i), elem); err != nil {
+					return err
+				}
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := tv[name]; !ok {
+				return &ValidationError{Path: at, Message: fmt.Sprintf("missing required property %q", name)}
+			}
+		}
+		names := make([]string, 0, len(tv))
+		for name := range tv {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return &ValidationError{Path: at, Message: fmt.Sprintf("unexpected property %q", name)}
+				}
+				continue
+			}
+			if err := p.validate(at+"."+name, tv[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// typeOf returns the JSON Schema type of the decoded value.
+func typeOf(v interface{}) string {
+	switch tv := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if tv == float64(int64(tv)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
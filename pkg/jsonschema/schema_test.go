@@ -0,0 +1,69 @@
+package jsonschema
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["image", "model"],
+	"additionalProperties": false,
+	"properties": {
+		"image": {"type": "string", "pattern": "^https?://", "maxLength": 100},
+		"model": {"enum": ["resnet", "vgg"]},
+		"epochs": {"type": "integer", "minimum": 1, "maximum": 100},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string", "minLength": 1}},
+		"threshold": {"type": ["number", "null"]}
+	}
+}`
+
+func TestSchema(t *testing.T) {
+	s, err := Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		doc string
+		err string
+	}{
+		{`{"image": "https://a/b.jpg", "model": "resnet"}`, ""},
+		{`{"image": "https://a/b.jpg", "model": "vgg", "epochs": 10, "tags": ["a"], "threshold": 0.5}`, ""},
+		{`{"image": "https://a/b.jpg", "model": "vgg", "threshold": null}`, ""},
+		{`{"image": "https://a/b.jpg"}`, `$: missing required property "model"`},
+		{`{"image": 1, "model": "vgg"}`, "$.image: expected string, got integer"},
+		{`{"image": "ftp://a", "model": "vgg"}`, `$.image: "ftp://a" does not match pattern "^https?://"`},
+		{`{"image": "https://a", "model": "alexnet"}`, "$.model: alexnet is not one of [resnet vgg]"},
+		{`{"image": "https://a", "model": "vgg", "epochs": 1.5}`, "$.epochs: expected integer, got number"},
+		{`{"image": "https://a", "model": "vgg", "epochs": 0}`, "$.epochs: 0 is less than minimum 1"},
+		{`{"image": "https://a", "model": "vgg", "tags": ["a", ""]}`, "$.tags[1]: length 0 is less than minLength 1"},
+		{`{"image": "https://a", "model": "vgg", "extra": 1}`, `$: unexpected property "extra"`},
+		{`[1, 2]`, "$: expected object, got array"},
+		{`{`, "$: invalid JSON"},
+	}
+	for i, tt := range tests {
+		err := s.ValidateJSON([]byte(tt.doc))
+		if tt.err == "" {
+			if err != nil {
+				t.Fatalf("#%d: unexpected error %v", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Fatalf("#%d: expected error %q, got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, doc := range []string{
+		`{"type": "float"}`,
+		`{"properties": {"a": {"pattern": "("}}}`,
+		`{"type": 1}`,
+		`not json`,
+	} {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Fatalf("expected error on %s", doc)
+		}
+	}
+}
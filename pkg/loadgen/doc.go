@@ -0,0 +1,5 @@
+// Package loadgen generates synthetic queue load for performance
+// sign-off. It enqueues items in configurable patterns (steady, burst,
+// diurnal) with payload size distributions, consumes them with workers,
+// and reports end-to-end latency percentiles.
+package loadgen
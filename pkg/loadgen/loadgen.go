@@ -0,0 +1,276 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/golang/glog"
+)
+
+// Config configures a load generation run.
+type Config struct {
+	// Bucket is the bucket of generated items.
+	Bucket string
+
+	// Pattern is the enqueue rate over time.
+	Pattern Pattern
+
+	// Sizes is the distribution of payload sizes.
+	Sizes SizeDist
+
+	// Duration is how long items are enqueued.
+	Duration time.Duration
+
+	// Workers is the number of workers popping and completing items.
+	Workers int
+
+	// ProcessTime is how long workers process each item.
+	ProcessTime time.Duration
+
+	// MaxPendingAdds is the maximum number of concurrent Adds, so that
+	// bursts are not serialized behind slow Adds. Defaults to 64.
+	MaxPendingAdds int
+
+	// DrainTimeout is how long to wait for workers to complete the
+	// enqueued items, after Duration. Defaults to 30 seconds.
+	DrainTimeout time.Duration
+
+	// Seed seeds payload sizes, for reproducible runs.
+	Seed int64
+}
+
+// Percentiles are latency percentiles.
+type Percentiles struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// newPercentiles returns the percentiles of the latencies.
+func newPercentiles(ds []time.Duration) Percentiles {
+	if len(ds) == 0 {
+		return Percentiles{}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	at := func(p float64) time.Duration {
+		return ds[int(p*float64(len(ds)-1))]
+	}
+	return Percentiles{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: ds[len(ds)-1]}
+}
+
+// Report is the result of a run.
+type Report struct {
+	Enqueued  int           `json:"enqueued"`
+	Completed int           `json:"completed"`
+	Errors    int           `json:"errors"`
+	Bytes     int64         `json:"bytes"`
+	Took      time.Duration `json:"took"`
+
+	// Duplicates is the number of items popped by more than one worker,
+	// whose later Completes returned ErrAlreadyCompleted.
+	Duplicates int `json:"duplicates"`
+
+	// Wait is the latency from enqueue to Pop.
+	Wait Percentiles `json:"wait"`
+
+	// EndToEnd is the latency from enqueue to Complete.
+	EndToEnd Percentiles `json:"end_to_end"`
+}
+
+func (r *Report) String() string {
+	row := func(name string, p Percentiles) string {
+		return fmt.Sprintf("%-10s p50 %-12v p90 %-12v p99 %-12v max %v\n", name, p.P50, p.P90, p.P99, p.Max)
+	}
+	return fmt.Sprintf("enqueued %d (%d bytes), completed %d, duplicates %d, errors %d in %v\n", r.Enqueued, r.Bytes, r.Completed, r.Duplicates, r.Errors, r.Took) +
+		row("wait", r.Wait) + row("end-to-end", r.EndToEnd)
+}
+
+// Run enqueues items of the configuration, and returns the report once
+// workers have completed them (or after DrainTimeout).
+func Run(ctx context.Context, qu etcdqueue.Queue, cfg Config) (*Report, error) {
+	if cfg.Bucket == "" || cfg.Pattern == nil || cfg.Sizes == nil {
+		return nil, fmt.Errorf("loadgen: bucket, pattern, and sizes are required")
+	}
+	if cfg.Duration <= 0 || cfg.Workers <= 0 {
+		return nil, fmt.Errorf("loadgen: invalid duration %v or workers %d", cfg.Duration, cfg.Workers)
+	}
+	if cfg.MaxPendingAdds <= 0 {
+		cfg.MaxPendingAdds = 64
+	}
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = 30 * time.Second
+	}
+
+	r := &run{qu: qu, cfg: cfg, rnd: rand.New(rand.NewSource(cfg.Seed))}
+	start := time.Now()
+
+	wctx, wcancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			r.work(wctx)
+		}()
+	}
+
+	r.produce(ctx, start)
+	r.drain(ctx)
+	wcancel()
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rp.Took = time.Since(start)
+	r.rp.Wait = newPercentiles(r.waits)
+	r.rp.EndToEnd = newPercentiles(r.ends)
+	glog.Infof("loadgen: %q enqueued %d, completed %d, errors %d", cfg.Bucket, r.rp.Enqueued, r.rp.Completed, r.rp.Errors)
+	return &r.rp, ctx.Err()
+}
+
+type run struct {
+	qu  etcdqueue.Queue
+	cfg Config
+	rnd *rand.Rand
+
+	mu    sync.Mutex
+	rp    Report
+	waits []time.Duration
+	ends  []time.Duration
+}
+
+// tick is the interval of enqueue rate updates.
+const tick = 10 * time.Millisecond
+
+// produce enqueues items at the rate of the pattern until Duration.
+func (r *run) produce(ctx context.Context, start time.Time) {
+	sem := make(chan struct{}, r.cfg.MaxPendingAdds)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	due, last := 0.0, start
+	for {
+		select {
+		case now := <-ticker.C:
+			elapsed := now.Sub(start)
+			if elapsed >= r.cfg.Duration {
+				return
+			}
+			due += r.cfg.Pattern.Rate(elapsed) * now.Sub(last).Seconds()
+			last = now
+			for ; due >= 1; due-- {
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				value := strings.Repeat("x", r.cfg.Sizes.Size(r.rnd))
+				wg.Add(1)
+				go func() {
+					defer func() { <-sem; wg.Done() }()
+					r.add(ctx, value)
+				}()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *run) add(ctx context.Context, value string) {
+	err := r.qu.Add(ctx, etcdqueue.CreateItem(r.cfg.Bucket, 100, value))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		glog.Warningf("loadgen: failed to add to %q (%v)", r.cfg.Bucket, err)
+		r.rp.Errors++
+		return
+	}
+	r.rp.Enqueued++
+	r.rp.Bytes += int64(len(value))
+}
+
+// work pops and completes items until the context is done.
+func (r *run) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		item := <-r.qu.Pop(ctx, r.cfg.Bucket)
+		if item == nil || ctx.Err() != nil {
+			return
+		}
+		if err := item.Err(); err != nil {
+			r.fail(err)
+			select {
+			case <-time.After(tick):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		wait := time.Since(item.CreatedAt)
+		if r.cfg.ProcessTime > 0 {
+			select {
+			case <-time.After(r.cfg.ProcessTime):
+			case <-ctx.Done():
+				return
+			}
+		}
+		item.Progress = etcdqueue.MaxProgress
+		if err := r.qu.Complete(ctx, item); err != nil {
+			if err == etcdqueue.ErrAlreadyCompleted {
+				r.mu.Lock()
+				r.rp.Duplicates++
+				r.mu.Unlock()
+				continue
+			}
+			r.fail(err)
+			continue
+		}
+		end := time.Since(item.CreatedAt)
+
+		r.mu.Lock()
+		r.rp.Completed++
+		r.waits = append(r.waits, wait)
+		r.ends = append(r.ends, end)
+		r.mu.Unlock()
+	}
+}
+
+func (r *run) fail(err error) {
+	glog.Warningf("loadgen: failed to process item of %q (%v)", r.cfg.Bucket, err)
+	r.mu.Lock()
+	r.rp.Errors++
+	r.mu.Unlock()
+}
+
+// drain waits until workers have completed all enqueued items, or
+// DrainTimeout.
+func (r *run) drain(ctx context.Context) {
+	timeout := time.After(r.cfg.DrainTimeout)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		r.mu.Lock()
+		done := r.rp.Completed >= r.rp.Enqueued
+		r.mu.Unlock()
+		if done {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			glog.Warningf("loadgen: %q not drained after %v", r.cfg.Bucket, r.cfg.DrainTimeout)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
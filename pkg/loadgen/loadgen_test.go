@@ -0,0 +1,90 @@
+package loadgen
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func TestPatterns(t *testing.T) {
+	burst := Burst{PerSecond: 10, Peak: 100, Every: time.Minute, For: 10 * time.Second}
+	if r := burst.Rate(5 * time.Second); r != 100 {
+		t.Fatalf("expected peak rate, got %v", r)
+	}
+	if r := burst.Rate(65 * time.Second); r != 100 {
+		t.Fatalf("expected peak rate, got %v", r)
+	}
+	if r := burst.Rate(30 * time.Second); r != 10 {
+		t.Fatalf("expected base rate, got %v", r)
+	}
+
+	diurnal := Diurnal{Min: 10, Max: 110, Period: time.Hour}
+	for _, tt := range []struct {
+		at   time.Duration
+		rate float64
+	}{{0, 10}, {15 * time.Minute, 60}, {30 * time.Minute, 110}, {time.Hour, 10}} {
+		if r := diurnal.Rate(tt.at); r < tt.rate-0.001 || r > tt.rate+0.001 {
+			t.Fatalf("expected %v at %v, got %v", tt.rate, tt.at, r)
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		if n := (Uniform{Min: 10, Max: 20}).Size(rnd); n < 10 || n > 20 {
+			t.Fatalf("unexpected uniform size %d", n)
+		}
+		if n := (LogNormal{Median: 1024, Sigma: 2, Max: 4096}).Size(rnd); n < 1 || n > 4096 {
+			t.Fatalf("unexpected log-normal size %d", n)
+		}
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	var ds []time.Duration
+	for i := 100; i > 0; i-- {
+		ds = append(ds, time.Duration(i)*time.Millisecond)
+	}
+	p := newPercentiles(ds)
+	if p.P50 != 50*time.Millisecond || p.P90 != 90*time.Millisecond || p.P99 != 99*time.Millisecond || p.Max != 100*time.Millisecond {
+		t.Fatalf("unexpected percentiles %+v", p)
+	}
+}
+
+func TestRun(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := etcdqueue.NewEmbeddedQueue(context.Background(), 38379, 38380, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	if _, err = Run(context.Background(), qu, Config{Bucket: "load"}); err == nil {
+		t.Fatal("expected invalid config error")
+	}
+	rp, err := Run(context.Background(), qu, Config{
+		Bucket:   "load",
+		Pattern:  Steady{PerSecond: 100},
+		Sizes:    Fixed(128),
+		Duration: 500 * time.Millisecond,
+		Workers:  4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rp.Enqueued < 25 || rp.Completed != rp.Enqueued || rp.Errors != 0 || rp.Bytes != int64(128*rp.Enqueued) {
+		t.Fatalf("unexpected report %+v", rp)
+	}
+	if rp.EndToEnd.P50 <= 0 || rp.EndToEnd.Max < rp.EndToEnd.P99 || rp.EndToEnd.P50 < rp.Wait.P50 {
+		t.Fatalf("unexpected latencies %+v", rp)
+	}
+}
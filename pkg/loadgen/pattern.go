@@ -0,0 +1,102 @@
+package loadgen
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Pattern is the enqueue rate over time.
+type Pattern interface {
+	// Rate returns the number of items enqueued per second, at the
+	// elapsed time since the start of the run.
+	Rate(elapsed time.Duration) float64
+}
+
+// Steady enqueues items at a constant rate.
+type Steady struct {
+	PerSecond float64
+}
+
+// Rate implements Pattern.
+func (p Steady) Rate(elapsed time.Duration) float64 { return p.PerSecond }
+
+// Burst enqueues items at the base rate, with bursts at the peak rate
+// lasting 'For' at the start of every 'Every'.
+type Burst struct {
+	PerSecond float64
+	Peak      float64
+	Every     time.Duration
+	For       time.Duration
+}
+
+// Rate implements Pattern.
+func (p Burst) Rate(elapsed time.Duration) float64 {
+	if p.Every > 0 && elapsed%p.Every < p.For {
+		return p.Peak
+	}
+	return p.PerSecond
+}
+
+// Diurnal enqueues items at a rate following a cosine wave from Min to
+// Max and back, over each Period (e.g. a day compressed into minutes).
+type Diurnal struct {
+	Min    float64
+	Max    float64
+	Period time.Duration
+}
+
+// Rate implements Pattern.
+func (p Diurnal) Rate(elapsed time.Duration) float64 {
+	if p.Period <= 0 {
+		return p.Min
+	}
+	phase := 2 * math.Pi * float64(elapsed%p.Period) / float64(p.Period)
+	return p.Min + (p.Max-p.Min)*(1-math.Cos(phase))/2
+}
+
+// SizeDist is the distribution of payload sizes in bytes.
+type SizeDist interface {
+	Size(r *rand.Rand) int
+}
+
+// Fixed is payloads of the same size.
+type Fixed int
+
+// Size implements SizeDist.
+func (d Fixed) Size(r *rand.Rand) int { return int(d) }
+
+// Uniform is payload sizes uniformly distributed in [Min, Max].
+type Uniform struct {
+	Min int
+	Max int
+}
+
+// Size implements SizeDist.
+func (d Uniform) Size(r *rand.Rand) int {
+	if d.Max <= d.Min {
+		return d.Min
+	}
+	return d.Min + r.Intn(d.Max-d.Min+1)
+}
+
+// LogNormal is payload sizes log-normally distributed around Median, as
+// observed for real request bodies (mostly small, with a long tail), up
+// to Max if positive.
+type LogNormal struct {
+	Median int
+	Sigma  float64
+	Max    int
+}
+
+// Size implements SizeDist.
+func (d LogNormal) Size(r *rand.Rand) int {
+	n := int(float64(d.Median) * math.Exp(d.Sigma*r.NormFloat64()))
+	if d.Max > 0 && n > d.Max {
+		n = d.Max
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
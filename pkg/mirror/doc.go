@@ -0,0 +1,3 @@
+// Package mirror replicates selected key prefixes of one etcd cluster to
+// another (e.g. queue buckets to a warm-standby queue in another region).
+package mirror
@@ -0,0 +1,271 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/golang/glog"
+)
+
+// ConflictPolicy decides how to apply source changes to keys
+// that were modified on the destination.
+type ConflictPolicy string
+
+const (
+	// SourceWins overwrites destination keys with source changes.
+	SourceWins ConflictPolicy = "source-wins"
+
+	// DestinationWins skips source changes to keys that were modified
+	// on the destination after the mirror last wrote them.
+	DestinationWins ConflictPolicy = "destination-wins"
+)
+
+// Config defines mirror configuration.
+type Config struct {
+	// Name identifies the mirror, to persist its cursor in the destination.
+	Name string
+
+	// Prefixes are the key prefixes to mirror (e.g. "_queue/cats-request/").
+	Prefixes []string
+
+	// Policy defaults to SourceWins.
+	Policy ConflictPolicy
+}
+
+// Mirror replicates keys under the prefixes, by watching the source and
+// applying changes to the destination in revision order. The source
+// revision is persisted in the destination, in the same transaction as
+// applied changes, so that it resumes after restart.
+//
+// Leases are not mirrored, since they are local to a cluster. Expired
+// keys are deleted on the destination, when the source deletes them.
+type Mirror struct {
+	cfg      Config
+	src, dst *clientv3.Client
+}
+
+// New creates a new mirror.
+func New(cfg Config, src, dst *clientv3.Client) (*Mirror, error) {
+	if cfg.Name == "" || len(cfg.Prefixes) == 0 {
+		return nil, fmt.Errorf("invalid mirror config %+v", cfg)
+	}
+	if cfg.Policy == "" {
+		cfg.Policy = SourceWins
+	}
+	if cfg.Policy != SourceWins && cfg.Policy != DestinationWins {
+		return nil, fmt.Errorf("unknown conflict policy %q", cfg.Policy)
+	}
+	return &Mirror{cfg: cfg, src: src, dst: dst}, nil
+}
+
+const pfxMirror = "_mirror"
+
+// maxTxnOps is etcd's default '--max-txn-ops' limit.
+const maxTxnOps = 128
+
+func (m *Mirror) cursorKey() string {
+	return path.Join(pfxMirror, m.cfg.Name, "rev")
+}
+
+// cursor returns the last source revision applied to the destination,
+// and the destination revision it was applied at. Destination keys
+// modified after the destination revision are modified locally, since
+// the mirror writes the cursor after all other changes.
+func (m *Mirror) cursor(ctx context.Context) (srcRev, dstRev int64, err error) {
+	resp, err := m.dst.Get(ctx, m.cursorKey())
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, 0, nil
+	}
+	srcRev, err = strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
+	return srcRev, resp.Kvs[0].ModRevision, err
+}
+
+// Cursor returns the last source revision applied to the destination.
+func (m *Mirror) Cursor(ctx context.Context) (int64, error) {
+	rev, _, err := m.cursor(ctx)
+	return rev, err
+}
+
+func (m *Mirror) match(key []byte) bool {
+	for _, pfx := range m.cfg.Prefixes {
+		if strings.HasPrefix(string(key), pfx) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run mirrors changes until the context is canceled.
+func (m *Mirror) Run(ctx context.Context) error {
+	for {
+		err := m.run(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		glog.Warningf("mirror %q failed (%v), retrying", m.cfg.Name, err)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *Mirror) run(ctx context.Context) error {
+	cursor, _, err := m.cursor(ctx)
+	if err != nil {
+		return err
+	}
+	if cursor == 0 {
+		if cursor, err = m.Sync(ctx); err != nil {
+			return err
+		}
+	}
+	glog.Infof("mirror %q watching from revision %d", m.cfg.Name, cursor+1)
+
+	// watch the whole keyspace, to apply changes across prefixes in order
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wch := m.src.Watch(wctx, "\x00", clientv3.WithFromKey(), clientv3.WithRev(cursor+1))
+	for wresp := range wch {
+		if wresp.CompactRevision > 0 || wresp.Err() == rpctypes.ErrCompacted {
+			glog.Warningf("mirror %q cursor %d has been compacted (compact revision %d), resyncing", m.cfg.Name, cursor, wresp.CompactRevision)
+			if cursor, err = m.Sync(ctx); err != nil {
+				return err
+			}
+			return fmt.Errorf("resynced at revision %d", cursor)
+		}
+		if err = wresp.Err(); err != nil {
+			return err
+		}
+		if err = m.apply(ctx, wresp.Events, wresp.Header.Revision); err != nil {
+			return err
+		}
+		cursor = wresp.Header.Revision
+	}
+	return ctx.Err()
+}
+
+func toOp(ev *clientv3.Event) clientv3.Op {
+	if ev.Type == mvccpb.DELETE {
+		return clientv3.OpDelete(string(ev.Kv.Key))
+	}
+	return clientv3.OpPut(string(ev.Kv.Key), string(ev.Kv.Value))
+}
+
+// apply applies the watch events, and moves the cursor to the revision.
+func (m *Mirror) apply(ctx context.Context, evs []*clientv3.Event, rev int64) error {
+	var ops []clientv3.Op
+	for _, ev := range evs {
+		if m.match(ev.Kv.Key) {
+			ops = append(ops, toOp(ev))
+		}
+	}
+
+	// skip cursor writes for revisions out of prefixes, which are
+	// harmlessly re-read after restart
+	if len(ops) == 0 && len(evs) > 0 {
+		return nil
+	}
+
+	if m.cfg.Policy == DestinationWins && len(ops) > 0 {
+		_, lastDstRev, err := m.cursor(ctx)
+		if err != nil {
+			return err
+		}
+		// keys written in this batch, with their destination revisions
+		written := make(map[string]int64)
+		for _, op := range ops {
+			key := string(op.KeyBytes())
+			cmp := clientv3.Compare(clientv3.ModRevision(key), "<", lastDstRev+1)
+			if wrev, ok := written[key]; ok {
+				cmp = clientv3.Compare(clientv3.ModRevision(key), "=", wrev)
+			}
+			resp, err := m.dst.Txn(ctx).If(cmp).Then(op).Commit()
+			if err != nil {
+				return err
+			}
+			if !resp.Succeeded {
+				glog.Warningf("mirror %q skipped %q modified on destination", m.cfg.Name, key)
+				continue
+			}
+			written[key] = resp.Header.Revision
+		}
+		ops = nil
+	}
+
+	// cursor is moved with the last chunk, so a partially applied
+	// revision is re-applied after restart (puts and deletes are idempotent)
+	for len(ops) > maxTxnOps-2 {
+		if _, err := m.dst.Txn(ctx).Then(ops[:maxTxnOps-2]...).Commit(); err != nil {
+			return err
+		}
+		ops = ops[maxTxnOps-2:]
+	}
+	ops = append(ops, clientv3.OpPut(m.cursorKey(), strconv.FormatInt(rev, 10)))
+	_, err := m.dst.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+// Sync copies all keys under the prefixes from the source, deletes
+// destination keys that do not exist in the source, and returns the
+// source revision it synced at. Keys modified on the destination are
+// overwritten regardless of the policy.
+func (m *Mirror) Sync(ctx context.Context) (int64, error) {
+	var rev int64
+	var ops []clientv3.Op
+	for _, pfx := range m.cfg.Prefixes {
+		opts := []clientv3.OpOption{clientv3.WithPrefix()}
+		if rev > 0 {
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		sresp, err := m.src.Get(ctx, pfx, opts...)
+		if err != nil {
+			return 0, err
+		}
+		if rev == 0 {
+			rev = sresp.Header.Revision
+		}
+		exist := make(map[string]struct{}, len(sresp.Kvs))
+		for _, kv := range sresp.Kvs {
+			exist[string(kv.Key)] = struct{}{}
+			ops = append(ops, clientv3.OpPut(string(kv.Key), string(kv.Value)))
+		}
+
+		dresp, err := m.dst.Get(ctx, pfx, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+		if err != nil {
+			return 0, err
+		}
+		for _, kv := range dresp.Kvs {
+			if _, ok := exist[string(kv.Key)]; !ok {
+				ops = append(ops, clientv3.OpDelete(string(kv.Key)))
+			}
+		}
+	}
+
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		if _, err := m.dst.Txn(ctx).Then(ops[:n]...).Commit(); err != nil {
+			return 0, err
+		}
+		ops = ops[n:]
+	}
+	if err := m.apply(ctx, nil, rev); err != nil {
+		return 0, err
+	}
+	glog.Infof("mirror %q synced at revision %d", m.cfg.Name, rev)
+	return rev, nil
+}
@@ -0,0 +1,117 @@
+package mirror
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+func startQueue(t *testing.T, cport int) (etcdqueue.Queue, func()) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qu, err := etcdqueue.NewEmbeddedQueue(context.Background(), cport, cport+1, dataDir)
+	if err != nil {
+		os.RemoveAll(dataDir)
+		t.Fatal(err)
+	}
+	return qu, func() {
+		qu.Stop()
+		os.RemoveAll(dataDir)
+	}
+}
+
+// waitValue waits until the key has the value, or is deleted if empty.
+func waitValue(t *testing.T, cli *clientv3.Client, key, val string) {
+	for i := 0; i < 30; i++ {
+		resp, err := cli.Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (val == "" && len(resp.Kvs) == 0) || (len(resp.Kvs) == 1 && string(resp.Kvs[0].Value) == val) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("expected %q=%q", key, val)
+}
+
+func TestMirror(t *testing.T) {
+	src, stopSrc := startQueue(t, 33379)
+	defer stopSrc()
+	dst, stopDst := startQueue(t, 33381)
+	defer stopDst()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scli, dcli := src.Client(), dst.Client()
+
+	if _, err := scli.Put(ctx, "_queue/a/1", "before-start"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dcli.Put(ctx, "_queue/a/stale", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(Config{Name: "test", Prefixes: []string{"_queue/a/"}, Policy: DestinationWins}, scli, dcli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	donec := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(donec)
+	}()
+
+	// initial sync copies existing keys, and deletes keys not in source
+	waitValue(t, dcli, "_queue/a/1", "before-start")
+	waitValue(t, dcli, "_queue/a/stale", "")
+
+	if _, err = scli.Put(ctx, "_queue/a/2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scli.Put(ctx, "_queue/b/1", "not-mirrored"); err != nil {
+		t.Fatal(err)
+	}
+	waitValue(t, dcli, "_queue/a/2", "v2")
+	if _, err = scli.Delete(ctx, "_queue/a/2"); err != nil {
+		t.Fatal(err)
+	}
+	waitValue(t, dcli, "_queue/a/2", "")
+	waitValue(t, dcli, "_queue/b/1", "")
+
+	// destination modification wins
+	if _, err = dcli.Put(ctx, "_queue/a/1", "local"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scli.Put(ctx, "_queue/a/1", "remote"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scli.Put(ctx, "_queue/a/3", "v3"); err != nil {
+		t.Fatal(err)
+	}
+	waitValue(t, dcli, "_queue/a/3", "v3")
+	waitValue(t, dcli, "_queue/a/1", "local")
+
+	cancel()
+	<-donec
+
+	cursor, err := m.Cursor(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := scli.Get(context.Background(), "_queue/a/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != resp.Kvs[0].ModRevision {
+		t.Fatalf("expected cursor %d, got %d", resp.Kvs[0].ModRevision, cursor)
+	}
+}
@@ -0,0 +1,3 @@
+// Package notify sends Slack messages or emails when queue items
+// reach terminal states.
+package notify
@@ -0,0 +1,147 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+// State is the terminal state of an item.
+type State string
+
+const (
+	// StateCompleted is for items finished without error.
+	StateCompleted State = "completed"
+	// StateFailed is for items finished with error.
+	StateFailed State = "failed"
+	// StateDeadLettered is for items that are given up after retries.
+	StateDeadLettered State = "dead-lettered"
+)
+
+// Rule defines which notifications to send for a bucket.
+type Rule struct {
+	// Bucket is the bucket to match. Empty matches all buckets.
+	Bucket string
+
+	// States are the states to notify. Empty matches all states.
+	States []State
+
+	// Subject and Body are text/template over item fields and
+	// '.State' (e.g. "{{.Bucket}} {{.Key}} {{.State}}: {{.Error}}").
+	Subject string
+	Body    string
+
+	Sender Sender
+}
+
+// DefaultSubject is used when Rule.Subject is empty.
+const DefaultSubject = "[dplearn] {{.Bucket}} item {{.State}}"
+
+// DefaultBody is used when Rule.Body is empty.
+const DefaultBody = `key: {{.Key}}
+request ID: {{.RequestID}}
+created at: {{.CreatedAt}}
+{{if .Error}}error: {{.Error}}
+{{end}}{{if .ResultURL}}result: {{.ResultURL}}
+{{end}}`
+
+type rule struct {
+	Rule
+	states  map[State]struct{}
+	subject *template.Template
+	body    *template.Template
+}
+
+func (r *rule) match(state State, item *etcdqueue.Item) bool {
+	if r.Bucket != "" && r.Bucket != item.Bucket {
+		return false
+	}
+	if len(r.states) == 0 {
+		return true
+	}
+	_, ok := r.states[state]
+	return ok
+}
+
+// templateData is passed to templates, to expose item fields with state.
+type templateData struct {
+	State State
+	*etcdqueue.Item
+}
+
+// Notifier sends notifications on item terminal states.
+type Notifier struct {
+	rules []*rule
+}
+
+// New creates a new notifier, with templates parsed.
+func New(rules ...Rule) (*Notifier, error) {
+	n := &Notifier{}
+	for i, r := range rules {
+		if r.Sender == nil {
+			return nil, fmt.Errorf("rule %d has no sender", i)
+		}
+		if r.Subject == "" {
+			r.Subject = DefaultSubject
+		}
+		if r.Body == "" {
+			r.Body = DefaultBody
+		}
+		sub, err := template.New("subject").Parse(r.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d has invalid subject (%v)", i, err)
+		}
+		body, err := template.New("body").Parse(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d has invalid body (%v)", i, err)
+		}
+		states := make(map[State]struct{}, len(r.States))
+		for _, s := range r.States {
+			states[s] = struct{}{}
+		}
+		n.rules = append(n.rules, &rule{Rule: r, states: states, subject: sub, body: body})
+	}
+	return n, nil
+}
+
+// Notify sends notifications of all matching rules.
+// It returns the first error, after trying all rules.
+func (n *Notifier) Notify(ctx context.Context, state State, item *etcdqueue.Item) error {
+	data := templateData{State: state, Item: item}
+	var firstErr error
+	for _, r := range n.rules {
+		if !r.match(state, item) {
+			continue
+		}
+		var sub, body bytes.Buffer
+		err := r.subject.Execute(&sub, data)
+		if err == nil {
+			err = r.body.Execute(&body, data)
+		}
+		if err == nil {
+			err = r.Sender.Send(ctx, sub.String(), body.String())
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to notify %q %s (%v)", item.Key, state, err)
+		}
+	}
+	return firstErr
+}
+
+// CompleteHook returns a queue complete hook that notifies
+// completed or failed items. Canceled items are not notified.
+func (n *Notifier) CompleteHook() etcdqueue.CompleteHook {
+	return func(ctx context.Context, item *etcdqueue.Item) error {
+		switch {
+		case item.Canceled:
+			return nil
+		case item.Error != "":
+			return n.Notify(ctx, StateFailed, item)
+		default:
+			return n.Notify(ctx, StateCompleted, item)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+type message struct {
+	subject, body string
+}
+
+type fakeSender struct {
+	msgs []message
+}
+
+func (s *fakeSender) Send(ctx context.Context, subject, body string) error {
+	s.msgs = append(s.msgs, message{subject: subject, body: body})
+	return nil
+}
+
+func TestNotifier(t *testing.T) {
+	failed, all := &fakeSender{}, &fakeSender{}
+	n, err := New(
+		Rule{
+			Bucket:  "/cats-request",
+			States:  []State{StateFailed},
+			Subject: "{{.Bucket}} {{.State}}",
+			Body:    "{{.Key}}: {{.Error}}",
+			Sender:  failed,
+		},
+		Rule{Sender: all},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := n.CompleteHook()
+
+	item := etcdqueue.CreateItem("/cats-request", 100, "")
+	item.Progress = etcdqueue.MaxProgress
+	if err = hook(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	if len(failed.msgs) != 0 || len(all.msgs) != 1 {
+		t.Fatalf("unexpected messages %+v %+v", failed.msgs, all.msgs)
+	}
+	if all.msgs[0].subject != "[dplearn] /cats-request item completed" {
+		t.Fatalf("unexpected subject %q", all.msgs[0].subject)
+	}
+
+	item.Error = "out of memory"
+	if err = hook(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	if len(failed.msgs) != 1 || len(all.msgs) != 2 {
+		t.Fatalf("unexpected messages %+v %+v", failed.msgs, all.msgs)
+	}
+	if exp := (message{subject: "/cats-request failed", body: item.Key + ": out of memory"}); failed.msgs[0] != exp {
+		t.Fatalf("expected %+v, got %+v", exp, failed.msgs[0])
+	}
+
+	item.Canceled = true
+	if err = hook(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	if len(all.msgs) != 2 {
+		t.Fatalf("unexpected notification on canceled item %+v", all.msgs)
+	}
+
+	if _, err = New(Rule{Subject: "{{.Key", Sender: all}); err == nil {
+		t.Fatal("expected template error")
+	}
+}
+
+func TestSlackSender(t *testing.T) {
+	var got map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	if err := NewSlackSender(srv.URL, nil).Send(context.Background(), "title", "body"); err != nil {
+		t.Fatal(err)
+	}
+	if got["text"] != "*title*\nbody" {
+		t.Fatalf("unexpected Slack payload %+v", got)
+	}
+}
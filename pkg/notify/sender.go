@@ -0,0 +1,112 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"strings"
+)
+
+// Sender sends a notification message.
+type Sender interface {
+	Send(ctx context.Context, subject, body string) error
+}
+
+type slackSender struct {
+	webhookURL string
+	cli        *http.Client
+}
+
+// NewSlackSender returns a Sender that posts to the Slack incoming webhook.
+// The subject is sent in bold, followed by the body.
+func NewSlackSender(webhookURL string, cli *http.Client) Sender {
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	return &slackSender{webhookURL: webhookURL, cli: cli}
+}
+
+func (s *slackSender) Send(ctx context.Context, subject, body string) error {
+	text := body
+	if subject != "" {
+		text = "*" + subject + "*\n" + body
+	}
+	data, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.webhookURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack returned %d (%s)", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// SMTPConfig defines SMTP configuration to send emails.
+type SMTPConfig struct {
+	// Addr is the SMTP server address (e.g. "smtp.gmail.com:587").
+	Addr string
+
+	// Username and Password are used for PLAIN authentication, if not empty.
+	Username string
+	Password string
+
+	From string
+	To   []string
+}
+
+type smtpSender struct {
+	cfg SMTPConfig
+}
+
+// NewSMTPSender returns a Sender that sends emails.
+func NewSMTPSender(cfg SMTPConfig) (Sender, error) {
+	if cfg.Addr == "" || cfg.From == "" || len(cfg.To) == 0 {
+		return nil, fmt.Errorf("invalid SMTP config (addr %q, from %q, to %q)", cfg.Addr, cfg.From, cfg.To)
+	}
+	return &smtpSender{cfg: cfg}, nil
+}
+
+func (s *smtpSender) Send(ctx context.Context, subject, body string) error {
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		host := s.cfg.Addr
+		if i := strings.LastIndex(host, ":"); i > 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		s.cfg.From, strings.Join(s.cfg.To, ", "), subject, body)
+
+	// net/smtp does not take context; run in background to honor cancellation
+	errc := make(chan error, 1)
+	go func() {
+		errc <- smtp.SendMail(s.cfg.Addr, auth, s.cfg.From, s.cfg.To, []byte(msg))
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,3 @@
+// Package objectstore publishes completed queue results to object storage
+// (Google Cloud Storage, Amazon S3).
+package objectstore
@@ -0,0 +1,102 @@
+package objectstore
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+	"github.com/gyuho/dplearn/pkg/gcp"
+)
+
+// Store stores objects by key.
+type Store interface {
+	// Put writes the data of the content type to the key.
+	Put(key, contentType string, data []byte) error
+
+	// URL returns the URL of the object with the key.
+	URL(key string) string
+}
+
+// NewGCS returns a Store backed by Google Cloud Storage.
+func NewGCS(s *gcp.Storage) Store {
+	return gcsStore{s}
+}
+
+type gcsStore struct {
+	*gcp.Storage
+}
+
+func (s gcsStore) Put(key, contentType string, data []byte) error {
+	return s.PutContentType(key, contentType, data)
+}
+
+// extensions maps media types to the extensions of object keys.
+// Other media types use the first extension known to package mime.
+var extensions = map[string]string{
+	"application/json":         ".json",
+	"text/plain":               ".txt",
+	"application/octet-stream": ".bin",
+	"image/jpeg":               ".jpg",
+	"image/png":                ".png",
+}
+
+// contentType returns the content type of the item, defaulting to JSON
+// for items without content type.
+func contentType(item *etcdqueue.Item) string {
+	if item.ContentType == "" {
+		return etcdqueue.ContentTypeJSON
+	}
+	return item.ContentType
+}
+
+// extension returns the object key extension of the content type,
+// or ".bin" if unknown.
+func extension(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ".bin"
+	}
+	if ext, ok := extensions[mt]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(mt); len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// Key returns the deterministic object key of the item, in the format
+// of "<bucket>/<YYYY>/<MM>/<DD>/<item-key><ext>", where the extension
+// is of its content type (e.g. ".json", or ".jpg" of "image/jpeg").
+func Key(item *etcdqueue.Item) string {
+	return path.Join(
+		strings.TrimPrefix(item.Bucket, "/"),
+		item.CreatedAt.UTC().Format("2006/01/02"),
+		path.Base(item.Key)+extension(contentType(item)),
+	)
+}
+
+// CompleteHook returns a queue complete hook that uploads the value of
+// successfully finished items to the store, decoded by its content type
+// (see 'Item.Bytes'), and sets its ResultURL. Canceled or failed items
+// are not uploaded.
+func CompleteHook(st Store) etcdqueue.CompleteHook {
+	return func(ctx context.Context, item *etcdqueue.Item) error {
+		if item.Canceled || item.Error != "" || item.Progress < etcdqueue.MaxProgress {
+			return nil
+		}
+		data, err := item.Bytes()
+		if err != nil {
+			return err
+		}
+		key := Key(item)
+		if err = st.Put(key, contentType(item), data); err != nil {
+			return fmt.Errorf("failed to upload %q (%v)", key, err)
+		}
+		item.ResultURL = st.URL(key)
+		return nil
+	}
+}
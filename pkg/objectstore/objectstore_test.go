@@ -0,0 +1,128 @@
+package objectstore
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+type fakeStore struct {
+	objects      map[string][]byte
+	contentTypes map[string]string
+}
+
+func (s *fakeStore) Put(key, contentType string, data []byte) error {
+	s.objects[key] = data
+	s.contentTypes[key] = contentType
+	return nil
+}
+
+func (s *fakeStore) URL(key string) string { return "fake://" + key }
+
+func TestCompleteHook(t *testing.T) {
+	st := &fakeStore{objects: make(map[string][]byte), contentTypes: make(map[string]string)}
+	hook := CompleteHook(st)
+
+	item := etcdqueue.CreateItem("/cats-request", 100, `{"result":"cat"}`)
+	item.CreatedAt = time.Date(2017, time.December, 3, 10, 0, 0, 0, time.UTC)
+	if err := hook(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.objects) != 0 || item.ResultURL != "" {
+		t.Fatalf("unexpected upload of unfinished item %+v", item)
+	}
+
+	item.Progress = etcdqueue.MaxProgress
+	if err := hook(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	key := "cats-request/2017/12/03/" + item.Key[strings.LastIndex(item.Key, "/")+1:] + ".json"
+	if string(st.objects[key]) != item.Value {
+		t.Fatalf("expected %q uploaded, got %+v", key, st.objects)
+	}
+	if item.ResultURL != "fake://"+key {
+		t.Fatalf("unexpected ResultURL %q", item.ResultURL)
+	}
+	if ct := st.contentTypes[key]; ct != etcdqueue.ContentTypeJSON {
+		t.Fatalf("expected %q, got %q", etcdqueue.ContentTypeJSON, ct)
+	}
+
+	// binary values are uploaded decoded, with their content types
+	img := []byte{0xff, 0xd8, 0xff, 0xe0}
+	item = etcdqueue.CreateItem("/cats-request", 100, "")
+	if err := item.SetBytes(etcdqueue.ContentTypeJPEG, img); err != nil {
+		t.Fatal(err)
+	}
+	item.CreatedAt = time.Date(2017, time.December, 3, 10, 0, 0, 0, time.UTC)
+	item.Progress = etcdqueue.MaxProgress
+	if err := hook(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	key = "cats-request/2017/12/03/" + item.Key[strings.LastIndex(item.Key, "/")+1:] + ".jpg"
+	if string(st.objects[key]) != string(img) || st.contentTypes[key] != etcdqueue.ContentTypeJPEG {
+		t.Fatalf("expected %q uploaded as %q, got %q", key, etcdqueue.ContentTypeJPEG, st.contentTypes)
+	}
+}
+
+func TestKeyExtension(t *testing.T) {
+	for i, tt := range []struct {
+		contentType string
+		ext         string
+	}{
+		{"", ".json"},
+		{etcdqueue.ContentTypeJSON, ".json"},
+		{etcdqueue.ContentTypeText, ".txt"},
+		{etcdqueue.ContentTypeOctetStream, ".bin"},
+		{etcdqueue.ContentTypeJPEG, ".jpg"},
+		{"application/x-unknown", ".bin"},
+	} {
+		item := etcdqueue.CreateItem("test-bucket", 100, "")
+		item.ContentType = tt.contentType
+		if key := Key(item); !strings.HasSuffix(key, path.Base(item.Key)+tt.ext) {
+			t.Fatalf("#%d: expected extension %q, got %q", i, tt.ext, key)
+		}
+	}
+}
+
+func TestS3Put(t *testing.T) {
+	var gotPath, gotAuth, gotType, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotPath, gotAuth, gotType = req.URL.Path, req.Header.Get("Authorization"), req.Header.Get("Content-Type")
+		b, _ := ioutil.ReadAll(req.Body)
+		gotBody = string(b)
+	}))
+	defer srv.Close()
+
+	st, err := NewS3(S3Config{
+		Endpoint:        srv.URL,
+		Region:          "us-west-2",
+		Bucket:          "results",
+		Prefix:          "dplearn",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.(*s3Store).now = func() time.Time { return time.Date(2017, time.December, 3, 10, 0, 0, 0, time.UTC) }
+
+	if err = st.Put("a/b.jpg", etcdqueue.ContentTypeJPEG, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/results/dplearn/a/b.jpg" || gotType != etcdqueue.ContentTypeJPEG || gotBody != "data" {
+		t.Fatalf("unexpected request %q %q %q", gotPath, gotType, gotBody)
+	}
+	if !strings.HasPrefix(gotAuth, "AWS4-HMAC-SHA256 Credential=AKID/20171203/us-west-2/s3/aws4_request, ") {
+		t.Fatalf("unexpected Authorization %q", gotAuth)
+	}
+	if u := st.URL("a/b.jpg"); u != "s3://results/dplearn/a/b.jpg" {
+		t.Fatalf("unexpected URL %q", u)
+	}
+}
@@ -0,0 +1,141 @@
+package objectstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// S3Config defines Amazon S3 configuration.
+type S3Config struct {
+	// Endpoint is the S3 endpoint (e.g. "https://s3.us-west-2.amazonaws.com").
+	// Objects are addressed in path-style.
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	// Prefix is prepended to all object keys.
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+type s3Store struct {
+	cfg S3Config
+	now func() time.Time
+}
+
+// NewS3 returns a Store backed by Amazon S3 (or S3-compatible storage),
+// signing requests with AWS Signature Version 4.
+func NewS3(cfg S3Config) (Store, error) {
+	if cfg.Endpoint == "" || cfg.Region == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("invalid S3 config (endpoint %q, region %q, bucket %q)", cfg.Endpoint, cfg.Region, cfg.Bucket)
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("S3 credentials are not given")
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	return &s3Store{cfg: cfg, now: time.Now}, nil
+}
+
+func (s *s3Store) objectPath(key string) string {
+	return "/" + path.Join(s.cfg.Bucket, s.cfg.Prefix, key)
+}
+
+func (s *s3Store) URL(key string) string {
+	return "s3://" + path.Join(s.cfg.Bucket, s.cfg.Prefix, key)
+}
+
+func (s *s3Store) Put(key, contentType string, data []byte) error {
+	u, err := url.Parse(s.cfg.Endpoint + s.objectPath(key))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, data)
+
+	resp, err := s.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("S3 PUT %q returned %d (%s)", key, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// sign signs the request with AWS Signature Version 4.
+// See https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html.
+func (s *s3Store) sign(req *http.Request, payload []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), day)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
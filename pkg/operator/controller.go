@@ -0,0 +1,333 @@
+package operator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/golang/glog"
+)
+
+// Config configures the Kubernetes API access of the controller.
+type Config struct {
+	// Host is the API server URL (e.g. "https://kubernetes.default.svc").
+	Host string
+
+	// Token is sent as bearer token, if not empty.
+	Token string
+
+	// Namespace limits the resources to the namespace.
+	// Empty watches all namespaces.
+	Namespace string
+
+	// HTTPClient is used to send requests. Defaults to 'http.DefaultClient'.
+	HTTPClient *http.Client
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// InClusterConfig returns the configuration of the pod service account.
+func InClusterConfig() (Config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return Config{}, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	token, err := ioutil.ReadFile(path.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return Config{}, err
+	}
+	ca, err := ioutil.ReadFile(path.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return Config{}, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return Config{}, fmt.Errorf("no certificate in %q", path.Join(serviceAccountDir, "ca.crt"))
+	}
+	return Config{
+		Host:  "https://" + net.JoinHostPort(host, port),
+		Token: string(bytes.TrimSpace(token)),
+		HTTPClient: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		}},
+	}, nil
+}
+
+// RetryInterval is the interval to list resources again, after
+// API server errors.
+var RetryInterval = 5 * time.Second
+
+// Controller reconciles QueueBucket and QueueJob resources, listing
+// them on every resync and watching changes in between.
+type Controller struct {
+	cfg Config
+	rc  *Reconciler
+}
+
+// NewController returns a new controller of the queue.
+func NewController(cfg Config, qu etcdqueue.Queue) (*Controller, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("empty API server host")
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	return &Controller{cfg: cfg, rc: NewReconciler(qu)}, nil
+}
+
+// Run reconciles the resources until the context is canceled. All
+// resources are reconciled again every resync, to report the states
+// of items and to prune deleted resources.
+func (c *Controller) Run(ctx context.Context, resync time.Duration) error {
+	errc := make(chan error, 2)
+	go func() { errc <- c.run(ctx, "queuebuckets", resync, c.syncBuckets, c.applyBucket) }()
+	go func() { errc <- c.run(ctx, "queuejobs", resync, c.syncJobs, c.applyJob) }()
+	err := <-errc
+	<-errc
+	return err
+}
+
+// watchEvent is an event of the watch API.
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// run lists and reconciles the resources, and watches them until the
+// resync, in turn.
+func (c *Controller) run(ctx context.Context, plural string, resync time.Duration, sync func(context.Context, []json.RawMessage) error, apply func(context.Context, watchEvent) error) error {
+	for {
+		rv, err := c.list(ctx, plural, sync)
+		if err == nil {
+			err = c.watch(ctx, plural, rv, resync, apply)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			glog.Warningf("operator: failed to reconcile %s (%v)", plural, err)
+			select {
+			case <-time.After(RetryInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// list reconciles all resources, and returns the resource version
+// of the list to watch from.
+func (c *Controller) list(ctx context.Context, plural string, sync func(context.Context, []json.RawMessage) error) (string, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.resourcePath("", plural, ""), nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []json.RawMessage `json:"items"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+	return list.Metadata.ResourceVersion, sync(ctx, list.Items)
+}
+
+// watch applies the events of the resources from the resource version,
+// until the resync or the watch is closed by the API server.
+func (c *Controller) watch(ctx context.Context, plural, rv string, resync time.Duration, apply func(context.Context, watchEvent) error) error {
+	q := url.Values{}
+	q.Set("watch", "true")
+	q.Set("resourceVersion", rv)
+	q.Set("timeoutSeconds", strconv.Itoa(int(resync.Seconds())))
+	resp, err := c.do(ctx, http.MethodGet, c.resourcePath("", plural, "")+"?"+q.Encode(), nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var ev watchEvent
+		if err = dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// closed on timeout, to list again
+			return nil
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			if err = apply(ctx, ev); err != nil {
+				glog.Warningf("operator: failed to apply %s event of %s (%v)", ev.Type, plural, err)
+			}
+		case "ERROR":
+			// e.g. expired resource version
+			return fmt.Errorf("watch error %s", string(ev.Object))
+		}
+	}
+}
+
+func (c *Controller) syncBuckets(ctx context.Context, objs []json.RawMessage) error {
+	uids := make(map[string]bool, len(objs))
+	prune := true
+	for _, obj := range objs {
+		var b QueueBucket
+		if err := decodeObject(obj, &b); err != nil {
+			glog.Warningf("operator: skipping queuebucket (%v)", err)
+			prune = keepUID(obj, uids) && prune
+			continue
+		}
+		uids[b.Metadata.UID] = true
+		if err := c.rc.ReconcileBucket(ctx, &b); err != nil {
+			glog.Warningf("operator: failed to reconcile %s/%s (%v)", b.Metadata.Namespace, b.Metadata.Name, err)
+		}
+	}
+	if !prune {
+		glog.Warningf("operator: skipping prune of queuebuckets with unknown UIDs")
+		return nil
+	}
+	// records of other namespaces are not listed
+	return c.rc.Prune(ctx, c.cfg.Namespace, uids, nil)
+}
+
+func (c *Controller) applyBucket(ctx context.Context, ev watchEvent) error {
+	var b QueueBucket
+	if err := decodeObject(ev.Object, &b); err != nil {
+		return err
+	}
+	if ev.Type == "DELETED" {
+		return c.rc.DeleteBucket(ctx, b.Spec.Bucket)
+	}
+	return c.rc.ReconcileBucket(ctx, &b)
+}
+
+func (c *Controller) syncJobs(ctx context.Context, objs []json.RawMessage) error {
+	uids := make(map[string]bool, len(objs))
+	prune := true
+	for _, obj := range objs {
+		var j QueueJob
+		if err := decodeObject(obj, &j); err != nil {
+			glog.Warningf("operator: skipping queuejob (%v)", err)
+			prune = keepUID(obj, uids) && prune
+			continue
+		}
+		uids[j.Metadata.UID] = true
+		if err := c.reconcileJob(ctx, &j); err != nil {
+			glog.Warningf("operator: failed to reconcile %s/%s (%v)", j.Metadata.Namespace, j.Metadata.Name, err)
+		}
+	}
+	if !prune {
+		glog.Warningf("operator: skipping prune of queuejobs with unknown UIDs")
+		return nil
+	}
+	return c.rc.Prune(ctx, c.cfg.Namespace, nil, uids)
+}
+
+func (c *Controller) applyJob(ctx context.Context, ev watchEvent) error {
+	var j QueueJob
+	if err := decodeObject(ev.Object, &j); err != nil {
+		return err
+	}
+	if ev.Type == "DELETED" {
+		return c.rc.DeleteJob(ctx, j.Metadata.UID)
+	}
+	return c.reconcileJob(ctx, &j)
+}
+
+// reconcileJob reconciles the job, and updates its status if changed.
+func (c *Controller) reconcileJob(ctx context.Context, j *QueueJob) error {
+	st, err := c.rc.ReconcileJob(ctx, j)
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(st, j.Status) {
+		return nil
+	}
+	data, err := json.Marshal(map[string]interface{}{"status": st})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPatch, c.resourcePath(j.Metadata.Namespace, "queuejobs", j.Metadata.Name)+"/status", data, "application/merge-patch+json")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// resourcePath returns the API path of the resources, or of the named
+// resource if not empty.
+func (c *Controller) resourcePath(namespace, plural, name string) string {
+	if namespace == "" {
+		namespace = c.cfg.Namespace
+	}
+	p := path.Join("/apis", Group, Version)
+	if namespace != "" {
+		p = path.Join(p, "namespaces", namespace)
+	}
+	return path.Join(p, plural, name)
+}
+
+func (c *Controller) do(ctx context.Context, method, p string, body []byte, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.cfg.Host+p, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s returned %d (%s)", method, p, resp.StatusCode, bytes.TrimSpace(b))
+	}
+	return resp, nil
+}
+
+// keepUID records the UID of the undecodable object, so that its
+// resources are not pruned. It returns false if the UID is unknown.
+func keepUID(obj json.RawMessage, uids map[string]bool) bool {
+	var o struct {
+		Metadata ObjectMeta `json:"metadata"`
+	}
+	if json.Unmarshal(obj, &o) != nil || o.Metadata.UID == "" {
+		return false
+	}
+	uids[o.Metadata.UID] = true
+	return true
+}
+
+// decodeObject decodes the JSON object of a list or watch event.
+func decodeObject(data json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("wrong JSON %q (%v)", string(data), err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+// Package operator reconciles Kubernetes custom resources into queue
+// state, so that buckets and jobs are managed declaratively with kubectl.
+// QueueBucket resources configure buckets (retention, rate limits, and
+// quotas), and QueueJob resources add items, whose states are reported
+// in the resource status. The custom resource definitions are in
+// 'crd.yaml'.
+//
+// The controller lists and watches the resources with the Kubernetes
+// REST API, without client-go.
+//
+// NewExternalMetricsHandler serves queue depth and the age of oldest
+// pending items as Kubernetes external metrics, so that the Horizontal
+// Pod Autoscaler scales worker deployments on backlog instead of CPU.
+// The APIService and an example autoscaler are in 'metrics.yaml'.
+package operator
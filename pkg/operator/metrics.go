@@ -0,0 +1,174 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/golang/glog"
+)
+
+// ExternalMetricsGroupVersion is the API of external metrics, served
+// to the Horizontal Pod Autoscaler via the API aggregation layer
+// (see 'metrics.yaml').
+const ExternalMetricsGroupVersion = "external.metrics.k8s.io/v1beta1"
+
+const (
+	// MetricPending is the number of pending items in the bucket.
+	MetricPending = "etcdqueue_pending_items"
+	// MetricOldestAge is the age of the oldest pending item in seconds.
+	MetricOldestAge = "etcdqueue_oldest_item_age_seconds"
+)
+
+// BucketLabel returns the value of the 'bucket' label of the bucket
+// in metric selectors, since label values cannot contain slashes
+// (e.g. "cats-request" for "/cats-request", "a.b" for "a/b").
+func BucketLabel(bucket string) string {
+	return strings.Trim(strings.Replace(bucket, "/", ".", -1), ".")
+}
+
+// metricsHandler serves external metrics of the buckets.
+type metricsHandler struct {
+	qu      etcdqueue.Queue
+	buckets map[string]string
+	timeout time.Duration
+}
+
+// NewExternalMetricsHandler returns the handler of external metrics
+// of the buckets, so that worker deployments autoscale on backlog.
+// Metrics are selected by the 'bucket' label (see 'BucketLabel'),
+// and read with serializable reads, since they are polled.
+func NewExternalMetricsHandler(qu etcdqueue.Queue, buckets ...string) http.Handler {
+	h := &metricsHandler{qu: qu, buckets: make(map[string]string, len(buckets)), timeout: 5 * time.Second}
+	for _, bucket := range buckets {
+		h.buckets[BucketLabel(bucket)] = bucket
+	}
+	return h
+}
+
+// externalMetricValue is the 'ExternalMetricValue' of the external
+// metrics API.
+type externalMetricValue struct {
+	MetricName   string            `json:"metricName"`
+	MetricLabels map[string]string `json:"metricLabels"`
+	Timestamp    time.Time         `json:"timestamp"`
+	Value        string            `json:"value"`
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	base := "/apis/" + ExternalMetricsGroupVersion
+	p := strings.TrimSuffix(req.URL.Path, "/")
+	if p == base {
+		h.writeJSON(w, discovery())
+		return
+	}
+
+	// /apis/external.metrics.k8s.io/v1beta1/namespaces/<namespace>/<metric>
+	parts := strings.Split(strings.TrimPrefix(p, base+"/"), "/")
+	if !strings.HasPrefix(p, base+"/") || len(parts) != 3 || parts[0] != "namespaces" {
+		http.NotFound(w, req)
+		return
+	}
+	metric := parts[2]
+	if metric != MetricPending && metric != MetricOldestAge {
+		http.Error(w, fmt.Sprintf("unknown metric %q", metric), http.StatusNotFound)
+		return
+	}
+	buckets, err := h.selectBuckets(req.URL.Query().Get("labelSelector"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := make([]externalMetricValue, 0, len(buckets))
+	for _, bucket := range buckets {
+		ctx, cancel := context.WithTimeout(req.Context(), h.timeout)
+		st, err := h.qu.Stats(ctx, bucket, etcdqueue.WithSerializable())
+		cancel()
+		if err != nil {
+			glog.Warningf("operator: failed to read stats of %q (%v)", bucket, err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		now := etcdqueue.DefaultClock.Now()
+		value := st.Pending
+		if metric == MetricOldestAge {
+			value = 0
+			if !st.Oldest.IsZero() {
+				value = int64(now.Sub(st.Oldest).Seconds())
+			}
+		}
+		items = append(items, externalMetricValue{
+			MetricName:   metric,
+			MetricLabels: map[string]string{"bucket": BucketLabel(bucket)},
+			Timestamp:    now.UTC(),
+			Value:        strconv.FormatInt(value, 10),
+		})
+	}
+	h.writeJSON(w, map[string]interface{}{
+		"kind":       "ExternalMetricValueList",
+		"apiVersion": ExternalMetricsGroupVersion,
+		"metadata":   map[string]interface{}{},
+		"items":      items,
+	})
+}
+
+// selectBuckets returns the buckets of the label selector, which only
+// supports 'bucket=<label>' (or '==').
+func (h *metricsHandler) selectBuckets(selector string) ([]string, error) {
+	var buckets []string
+	for _, term := range strings.Split(selector, ",") {
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+		kv := strings.SplitN(strings.Replace(term, "==", "=", 1), "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "bucket" {
+			return nil, fmt.Errorf("unsupported label selector %q (expected 'bucket=<name>')", selector)
+		}
+		bucket, ok := h.buckets[strings.TrimSpace(kv[1])]
+		if !ok {
+			return nil, fmt.Errorf("unknown bucket %q", strings.TrimSpace(kv[1]))
+		}
+		buckets = append(buckets, bucket)
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("no bucket in label selector %q", selector)
+	}
+	return buckets, nil
+}
+
+// discovery returns the 'APIResourceList' of the external metrics.
+func discovery() map[string]interface{} {
+	var resources []map[string]interface{}
+	for _, metric := range []string{MetricPending, MetricOldestAge} {
+		resources = append(resources, map[string]interface{}{
+			"name":       metric,
+			"namespaced": true,
+			"kind":       "ExternalMetricValueList",
+			"verbs":      []string{"get"},
+		})
+	}
+	return map[string]interface{}{
+		"kind":         "APIResourceList",
+		"apiVersion":   "v1",
+		"groupVersion": ExternalMetricsGroupVersion,
+		"resources":    resources,
+	}
+}
+
+func (h *metricsHandler) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Warningf("operator: failed to write external metrics (%v)", err)
+	}
+}
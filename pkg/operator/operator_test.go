@@ -0,0 +1,285 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func newTestQueue(t *testing.T, port int) (etcdqueue.Queue, func()) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qu, err := etcdqueue.NewEmbeddedQueue(context.Background(), port, port+1, dataDir)
+	if err != nil {
+		os.RemoveAll(dataDir)
+		t.Fatal(err)
+	}
+	return qu, func() {
+		qu.Stop()
+		os.RemoveAll(dataDir)
+	}
+}
+
+func TestReconciler(t *testing.T) {
+	qu, stop := newTestQueue(t, 44379)
+	defer stop()
+
+	ctx := context.Background()
+	r := NewReconciler(qu)
+
+	// fields not in the spec are kept
+	if err := qu.SetBucketConfig(ctx, "/train", etcdqueue.BucketConfig{ConcurrencyKey: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	b := &QueueBucket{
+		Metadata: ObjectMeta{Name: "train", Namespace: "ml", UID: "uid-bucket"},
+		Spec:     QueueBucketSpec{Bucket: "/train", Retention: "72h", MaxPending: 10},
+	}
+	if err := r.ReconcileBucket(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := qu.BucketConfig(ctx, "/train")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := etcdqueue.BucketConfig{Retention: 72 * time.Hour, MaxPending: 10, ConcurrencyKey: "user"}
+	if cfg != expected {
+		t.Fatalf("expected %+v, got %+v", expected, cfg)
+	}
+
+	j := &QueueJob{
+		Metadata: ObjectMeta{Name: "resnet", Namespace: "ml", UID: "uid-job"},
+		Spec:     QueueJobSpec{Bucket: "/train", Value: "resnet-50"},
+	}
+	st, err := r.ReconcileJob(ctx, j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Key == "" || st.Status != etcdqueue.StatusPending {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	j.Status = st
+	if st, err = r.ReconcileJob(ctx, j); err != nil {
+		t.Fatal(err)
+	}
+	if st != j.Status {
+		t.Fatalf("expected %+v, got %+v", j.Status, st)
+	}
+	items, err := qu.List(ctx, "/train")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Labels["queuejob"] != "ml.resnet" {
+		t.Fatalf("expected 1 item of the job, got %+v", items)
+	}
+
+	// controllers of other namespaces do not prune the resources
+	if err = r.Prune(ctx, "dev", map[string]bool{}, map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = qu.BucketConfig(ctx, "/train"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg != expected {
+		t.Fatalf("expected %+v, got %+v", expected, cfg)
+	}
+
+	// resources deleted while the controller was down
+	if err = r.Prune(ctx, "ml", map[string]bool{}, map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = qu.BucketConfig(ctx, "/train"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg != (etcdqueue.BucketConfig{ConcurrencyKey: "user"}) {
+		t.Fatalf("unexpected config after prune %+v", cfg)
+	}
+	ent, err := qu.Get(ctx, st.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.Status != etcdqueue.StatusCanceled {
+		t.Fatalf("expected canceled item, got %q", ent.Status)
+	}
+}
+
+func TestController(t *testing.T) {
+	qu, stop := newTestQueue(t, 44381)
+	defer stop()
+
+	patches := make(chan QueueJobStatus, 10)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apis/dplearn.io/v1alpha1/namespaces/ml/queuebuckets", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("watch") == "true" {
+			<-req.Context().Done()
+			return
+		}
+		fmt.Fprint(w, `{"metadata":{"resourceVersion":"1"},"items":[
+			{"metadata":{"name":"bad","namespace":"ml","uid":"uid-bad"},"spec":{"bucket":"/bad","rateLimit":"5"}},
+			{"metadata":{"name":"train","namespace":"ml","uid":"uid-bucket"},"spec":{"bucket":"/train","rateLimit":5}}]}`)
+	})
+	mux.HandleFunc("/apis/dplearn.io/v1alpha1/namespaces/ml/queuejobs", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("watch") == "true" {
+			w.(http.Flusher).Flush()
+			fmt.Fprint(w, `{"type":"ADDED","object":{"metadata":{"name":"vgg","namespace":"ml","uid":"uid-vgg"},"spec":{"bucket":"/train","value":"vgg-16"}}}`+"\n")
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+			return
+		}
+		fmt.Fprint(w, `{"metadata":{"resourceVersion":"1"},"items":[]}`)
+	})
+	mux.HandleFunc("/apis/dplearn.io/v1alpha1/namespaces/ml/queuejobs/vgg/status", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPatch || req.Header.Get("Content-Type") != "application/merge-patch+json" {
+			t.Errorf("unexpected %s %q", req.Method, req.Header.Get("Content-Type"))
+		}
+		var patch struct {
+			Status QueueJobStatus `json:"status"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&patch); err != nil {
+			t.Error(err)
+		}
+		patches <- patch.Status
+		fmt.Fprint(w, `{}`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// the job was deleted while the controller was down
+	ctx := context.Background()
+	r := NewReconciler(qu)
+	st, err := r.ReconcileJob(ctx, &QueueJob{
+		Metadata: ObjectMeta{Name: "resnet", Namespace: "ml", UID: "uid-resnet"},
+		Spec:     QueueJobSpec{Bucket: "/train", Value: "resnet-50"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewController(Config{Host: ts.URL, Namespace: "ml"}, qu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rctx, cancel := context.WithCancel(ctx)
+	donec := make(chan error)
+	go func() { donec <- c.Run(rctx, time.Minute) }()
+
+	select {
+	case st := <-patches:
+		if st.Key == "" || st.Status != etcdqueue.StatusPending {
+			t.Fatalf("unexpected status %+v", st)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("took too long to patch job status")
+	}
+	cfg, err := qu.BucketConfig(ctx, "/train")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RateLimit != 5 {
+		t.Fatalf("expected rate limit 5, got %+v", cfg)
+	}
+	ent, err := qu.Get(ctx, st.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.Status != etcdqueue.StatusCanceled {
+		t.Fatalf("expected pruned job canceled, got %q", ent.Status)
+	}
+
+	cancel()
+	if err = <-donec; err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestExternalMetricsHandler(t *testing.T) {
+	qu, stop := newTestQueue(t, 44383)
+	defer stop()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := qu.Add(ctx, etcdqueue.CreateItem("/cats-request", 100, fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(NewExternalMetricsHandler(qu, "/cats-request", "/dogs-request"))
+	defer srv.Close()
+
+	get := func(path string) (int, []byte) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, b
+	}
+
+	code, b := get("/apis/external.metrics.k8s.io/v1beta1")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (%s)", code, b)
+	}
+
+	code, b = get("/apis/external.metrics.k8s.io/v1beta1/namespaces/default/etcdqueue_pending_items?labelSelector=bucket%3Dcats-request")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (%s)", code, b)
+	}
+	var list struct {
+		Kind  string                `json:"kind"`
+		Items []externalMetricValue `json:"items"`
+	}
+	if err := json.Unmarshal(b, &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Kind != "ExternalMetricValueList" || len(list.Items) != 1 {
+		t.Fatalf("unexpected list %s", b)
+	}
+	if v := list.Items[0]; v.Value != "3" || v.MetricLabels["bucket"] != "cats-request" {
+		t.Fatalf("unexpected value %+v", v)
+	}
+
+	code, b = get("/apis/external.metrics.k8s.io/v1beta1/namespaces/default/etcdqueue_oldest_item_age_seconds?labelSelector=bucket%3Ddogs-request")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (%s)", code, b)
+	}
+	if err := json.Unmarshal(b, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Value != "0" {
+		t.Fatalf("unexpected list %s", b)
+	}
+
+	for _, path := range []string{
+		"/apis/external.metrics.k8s.io/v1beta1/namespaces/default/etcdqueue_pending_items",
+		"/apis/external.metrics.k8s.io/v1beta1/namespaces/default/etcdqueue_pending_items?labelSelector=bucket%3Dunknown",
+		"/apis/external.metrics.k8s.io/v1beta1/namespaces/default/etcdqueue_pending_items?labelSelector=app%3Dx",
+	} {
+		if code, b = get(path); code != http.StatusBadRequest {
+			t.Fatalf("%q: expected 400, got %d (%s)", path, code, b)
+		}
+	}
+	if code, _ = get("/apis/external.metrics.k8s.io/v1beta1/namespaces/default/unknown"); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+}
+
+func TestBucketLabel(t *testing.T) {
+	for bucket, expected := range map[string]string{"/cats-request": "cats-request", "a/b": "a.b", "train": "train"} {
+		if got := BucketLabel(bucket); got != expected {
+			t.Fatalf("%q: expected %q, got %q", bucket, expected, got)
+		}
+	}
+}
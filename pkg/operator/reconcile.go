@@ -0,0 +1,250 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// pfxOperator is the prefix of the resources managed by the operator,
+// recorded with their namespaces:
+//
+//	_operator/buckets/<bucket> = {"namespace": ..., "uid": <UID of QueueBucket>}
+//	_operator/jobs/<UID of QueueJob> = {"namespace": ..., "key": <item key>}
+const pfxOperator = "_operator"
+
+var (
+	pfxBuckets = path.Join(pfxOperator, "buckets") + "/"
+	pfxJobs    = path.Join(pfxOperator, "jobs") + "/"
+)
+
+// record is the record of a resource, so that controllers of a
+// namespace only prune the resources of the namespace.
+type record struct {
+	Namespace string `json:"namespace,omitempty"`
+
+	// UID is the UID of QueueBucket.
+	UID string `json:"uid,omitempty"`
+	// Key is the item key of QueueJob.
+	Key string `json:"key,omitempty"`
+}
+
+func (rec record) String() string {
+	data, _ := json.Marshal(rec)
+	return string(data)
+}
+
+func decodeRecord(key string, data []byte) (record, error) {
+	var rec record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, fmt.Errorf("%q returned wrong JSON %q (%v)", key, string(data), err)
+	}
+	return rec, nil
+}
+
+// Reconciler applies custom resources to the queue. Reconciliation is
+// idempotent, so that resources are applied again on every resync.
+type Reconciler struct {
+	qu etcdqueue.Queue
+}
+
+// NewReconciler returns a new reconciler of the queue.
+func NewReconciler(qu etcdqueue.Queue) *Reconciler {
+	return &Reconciler{qu: qu}
+}
+
+// ReconcileBucket sets the bucket configuration of the spec. Fields not
+// in the spec (e.g. 'Paused' by Transfer) are kept.
+func (r *Reconciler) ReconcileBucket(ctx context.Context, b *QueueBucket) error {
+	cfg, err := b.Spec.BucketConfig()
+	if err != nil {
+		return err
+	}
+	cur, err := r.qu.BucketConfig(ctx, b.Spec.Bucket)
+	if err != nil {
+		return err
+	}
+	cfg.ConcurrencyKey, cfg.Shadow, cfg.Paused = cur.ConcurrencyKey, cur.Shadow, cur.Paused
+	if cfg != cur {
+		if err = r.qu.SetBucketConfig(ctx, b.Spec.Bucket, cfg); err != nil {
+			return err
+		}
+		glog.Infof("operator: configured %q of %s/%s to %+v", b.Spec.Bucket, b.Metadata.Namespace, b.Metadata.Name, cfg)
+	}
+	rec := record{Namespace: b.Metadata.Namespace, UID: b.Metadata.UID}
+	_, err = r.qu.Client().Put(ctx, pfxBuckets+b.Spec.Bucket, rec.String())
+	return err
+}
+
+// DeleteBucket removes the configuration of the bucket set by the spec.
+// Items of the bucket are not removed.
+func (r *Reconciler) DeleteBucket(ctx context.Context, bucket string) error {
+	cur, err := r.qu.BucketConfig(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	cfg := etcdqueue.BucketConfig{ConcurrencyKey: cur.ConcurrencyKey, Shadow: cur.Shadow, Paused: cur.Paused}
+	if err = r.qu.SetBucketConfig(ctx, bucket, cfg); err != nil {
+		return err
+	}
+	if _, err = r.qu.Client().Delete(ctx, pfxBuckets+bucket); err != nil {
+		return err
+	}
+	glog.Infof("operator: removed configuration of %q", bucket)
+	return nil
+}
+
+// ReconcileJob adds the item of the job if not yet added, and returns
+// the current state of the item. Jobs are identified by their UIDs, so
+// that recreated jobs of the same name add new items.
+func (r *Reconciler) ReconcileJob(ctx context.Context, j *QueueJob) (QueueJobStatus, error) {
+	if j.Metadata.UID == "" {
+		return j.Status, fmt.Errorf("%s/%s has no UID", j.Metadata.Namespace, j.Metadata.Name)
+	}
+	recKey := pfxJobs + j.Metadata.UID
+	resp, err := r.qu.Client().Get(ctx, recKey)
+	if err != nil {
+		return j.Status, err
+	}
+	var itemKey string
+	if len(resp.Kvs) > 0 {
+		rec, err := decodeRecord(recKey, resp.Kvs[0].Value)
+		if err != nil {
+			return j.Status, err
+		}
+		itemKey = rec.Key
+	} else {
+		if itemKey, err = r.addJob(ctx, j); err != nil {
+			return j.Status, err
+		}
+	}
+
+	ent, err := r.qu.Get(ctx, itemKey)
+	if err == etcdqueue.ErrItemNotFound {
+		// garbage collected or archived, after the last observed state
+		st := j.Status
+		st.Key = itemKey
+		return st, nil
+	}
+	if err != nil {
+		return j.Status, err
+	}
+	return QueueJobStatus{
+		Key:      itemKey,
+		Status:   ent.Status,
+		Progress: ent.Item.Progress,
+		Error:    ent.Item.Error,
+	}, nil
+}
+
+// addJob adds the item of the job, and records its key. Retries after
+// failed records attach to the same item by its idempotency key.
+func (r *Reconciler) addJob(ctx context.Context, j *QueueJob) (string, error) {
+	weight := j.Spec.Weight
+	if weight == 0 {
+		weight = 100
+	}
+	item := etcdqueue.CreateItem(j.Spec.Bucket, weight, j.Spec.Value)
+	item.Labels = map[string]string{"queuejob": j.Metadata.Namespace + "." + j.Metadata.Name}
+	for k, v := range j.Spec.Labels {
+		item.Labels[k] = v
+	}
+	item.IdempotencyKey = path.Join("queuejob", j.Metadata.UID)
+	if err := r.qu.Add(ctx, item); err != nil {
+		return "", err
+	}
+	recKey := pfxJobs + j.Metadata.UID
+	rec := record{Namespace: j.Metadata.Namespace, Key: item.Key}
+	_, err := r.qu.Client().Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(recKey), "=", 0)).
+		Then(clientv3.OpPut(recKey, rec.String())).
+		Commit()
+	if err != nil {
+		return "", err
+	}
+	glog.Infof("operator: added %q of %s/%s", item.Key, j.Metadata.Namespace, j.Metadata.Name)
+	return item.Key, nil
+}
+
+// DeleteJob cancels the item of the job if pending, and removes its
+// record. Items in progress run to completion.
+func (r *Reconciler) DeleteJob(ctx context.Context, uid string) error {
+	recKey := pfxJobs + uid
+	resp, err := r.qu.Client().Get(ctx, recKey)
+	if err != nil || len(resp.Kvs) == 0 {
+		return err
+	}
+	rec, err := decodeRecord(recKey, resp.Kvs[0].Value)
+	if err != nil {
+		return err
+	}
+	itemKey := rec.Key
+	ent, err := r.qu.Get(ctx, itemKey)
+	switch {
+	case err == etcdqueue.ErrItemNotFound:
+	case err != nil:
+		return err
+	case ent.Status == etcdqueue.StatusPending:
+		_, err = r.qu.Cancel(ctx, itemKey, etcdqueue.WithCancelReason("operator", "QueueJob deleted"))
+		if err != nil && err != etcdqueue.ErrItemNotFound {
+			return err
+		}
+		glog.Infof("operator: canceled %q of deleted job %q", itemKey, uid)
+	}
+	_, err = r.qu.Client().Delete(ctx, recKey)
+	return err
+}
+
+// Prune removes the configurations of buckets and the items of jobs
+// whose resources no longer exist (e.g. deleted while the controller
+// was down), given the UIDs of all existing resources of the namespace,
+// or of all namespaces if empty.
+func (r *Reconciler) Prune(ctx context.Context, namespace string, bucketUIDs, jobUIDs map[string]bool) error {
+	if bucketUIDs != nil {
+		resp, err := r.qu.Client().Get(ctx, pfxBuckets, clientv3.WithPrefix())
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			rec, err := decodeRecord(string(kv.Key), kv.Value)
+			if err != nil {
+				glog.Warningf("operator: skipping record (%v)", err)
+				continue
+			}
+			if bucketUIDs[rec.UID] || (namespace != "" && rec.Namespace != namespace) {
+				continue
+			}
+			if err = r.DeleteBucket(ctx, strings.TrimPrefix(string(kv.Key), pfxBuckets)); err != nil {
+				return err
+			}
+		}
+	}
+	if jobUIDs != nil {
+		resp, err := r.qu.Client().Get(ctx, pfxJobs, clientv3.WithPrefix())
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			rec, err := decodeRecord(string(kv.Key), kv.Value)
+			if err != nil {
+				glog.Warningf("operator: skipping record (%v)", err)
+				continue
+			}
+			uid := strings.TrimPrefix(string(kv.Key), pfxJobs)
+			if jobUIDs[uid] || (namespace != "" && rec.Namespace != namespace) {
+				continue
+			}
+			if err = r.DeleteJob(ctx, uid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
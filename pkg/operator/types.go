@@ -0,0 +1,99 @@
+package operator
+
+import (
+	"fmt"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+const (
+	// Group is the API group of the custom resources.
+	Group = "dplearn.io"
+	// Version is the API version of the custom resources.
+	Version = "v1alpha1"
+)
+
+// ObjectMeta is the subset of Kubernetes object metadata used by the
+// controller.
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	UID             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// QueueBucket is the custom resource of a bucket configuration.
+type QueueBucket struct {
+	APIVersion string          `json:"apiVersion,omitempty"`
+	Kind       string          `json:"kind,omitempty"`
+	Metadata   ObjectMeta      `json:"metadata"`
+	Spec       QueueBucketSpec `json:"spec"`
+}
+
+// QueueBucketSpec is the desired configuration of the bucket
+// (see 'etcdqueue.BucketConfig').
+type QueueBucketSpec struct {
+	// Bucket is the bucket name (e.g. "/cats-request").
+	Bucket string `json:"bucket"`
+
+	// Retention is how long completed items are kept (e.g. "72h").
+	Retention string `json:"retention,omitempty"`
+
+	RateLimit   float64 `json:"rateLimit,omitempty"`
+	RateBurst   int     `json:"rateBurst,omitempty"`
+	MaxPending  int     `json:"maxPending,omitempty"`
+	MaxBytes    int64   `json:"maxBytes,omitempty"`
+	MaxInFlight int     `json:"maxInFlight,omitempty"`
+	MaxAttempts int     `json:"maxAttempts,omitempty"`
+}
+
+// BucketConfig returns the bucket configuration of the spec.
+func (spec QueueBucketSpec) BucketConfig() (etcdqueue.BucketConfig, error) {
+	var cfg etcdqueue.BucketConfig
+	if spec.Bucket == "" {
+		return cfg, fmt.Errorf("empty bucket name")
+	}
+	if spec.Retention != "" {
+		d, err := time.ParseDuration(spec.Retention)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid retention %q (%v)", spec.Retention, err)
+		}
+		cfg.Retention = d
+	}
+	cfg.RateLimit = spec.RateLimit
+	cfg.RateBurst = spec.RateBurst
+	cfg.MaxPending = spec.MaxPending
+	cfg.MaxBytes = spec.MaxBytes
+	cfg.MaxInFlight = spec.MaxInFlight
+	cfg.Retry.MaxAttempts = spec.MaxAttempts
+	return cfg, cfg.Validate()
+}
+
+// QueueJob is the custom resource of a queue item.
+type QueueJob struct {
+	APIVersion string         `json:"apiVersion,omitempty"`
+	Kind       string         `json:"kind,omitempty"`
+	Metadata   ObjectMeta     `json:"metadata"`
+	Spec       QueueJobSpec   `json:"spec"`
+	Status     QueueJobStatus `json:"status,omitempty"`
+}
+
+// QueueJobSpec is the item to add. It is added once per resource;
+// later changes of the spec do not modify the item.
+type QueueJobSpec struct {
+	Bucket string            `json:"bucket"`
+	Value  string            `json:"value"`
+	Weight uint64            `json:"weight,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// QueueJobStatus is the observed state of the item.
+type QueueJobStatus struct {
+	// Key is the item key.
+	Key string `json:"key,omitempty"`
+
+	Status   etcdqueue.Status `json:"status,omitempty"`
+	Progress int              `json:"progress,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
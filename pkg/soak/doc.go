@@ -0,0 +1,5 @@
+// Package soak runs random enqueue, claim, complete, cancel, and watch
+// operations against a queue for a long time, while continuously checking
+// invariants (no item lost, no double completion, watchers closed), to
+// catch rare races that unit tests miss.
+package soak
@@ -0,0 +1,373 @@
+package soak
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/golang/glog"
+)
+
+// Config configures a soak run.
+type Config struct {
+	// Bucket is the bucket of soak items.
+	Bucket string
+
+	// Duration is how long random operations run.
+	Duration time.Duration
+
+	// Actors is the number of goroutines running random operations.
+	Actors int
+
+	// CheckInterval is the interval of invariant checks on a sample of
+	// items, while operations run. Defaults to one second.
+	CheckInterval time.Duration
+
+	// WatchTimeout is how long watchers may take to close after their
+	// contexts are canceled. Defaults to five seconds.
+	WatchTimeout time.Duration
+
+	// Seed seeds the random operations, for reproducible runs.
+	Seed int64
+}
+
+// MaxViolations is the maximum number of violations kept in Report.
+var MaxViolations = 100
+
+// Report is the result of a soak run.
+type Report struct {
+	// Items is the number of added items.
+	Items int `json:"items"`
+
+	// Ops is the number of operations by name.
+	Ops map[string]int `json:"ops"`
+
+	// Duplicates is the number of items popped more than once (whose
+	// later Completes returned ErrAlreadyCompleted). It is not an
+	// invariant violation, since workers must handle it.
+	Duplicates int `json:"duplicates"`
+
+	// Violations are the broken invariants, up to 'MaxViolations'.
+	Violations []string `json:"violations"`
+}
+
+// state is the expected state of an item.
+type state struct {
+	completed int
+	canceled  bool
+}
+
+type soak struct {
+	qu  etcdqueue.Queue
+	cfg Config
+
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	keys   []string
+	states map[string]*state
+	rp     Report
+}
+
+// Run runs random operations against the queue for the configured
+// duration, then completes the remaining items and checks every item.
+// Invariant violations are returned in the report.
+func Run(ctx context.Context, qu etcdqueue.Queue, cfg Config) (*Report, error) {
+	if cfg.Bucket == "" || cfg.Duration <= 0 || cfg.Actors <= 0 {
+		return nil, fmt.Errorf("soak: invalid config %+v", cfg)
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = time.Second
+	}
+	if cfg.WatchTimeout <= 0 {
+		cfg.WatchTimeout = 5 * time.Second
+	}
+	s := &soak{
+		qu:     qu,
+		cfg:    cfg,
+		rnd:    rand.New(rand.NewSource(cfg.Seed)),
+		states: make(map[string]*state),
+		rp:     Report{Ops: make(map[string]int), Violations: []string{}},
+	}
+	baseline := qu.Watchers().Goroutines
+
+	rctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	var wg sync.WaitGroup
+	wg.Add(cfg.Actors + 1)
+	for i := 0; i < cfg.Actors; i++ {
+		go func() {
+			defer wg.Done()
+			for rctx.Err() == nil {
+				s.step(rctx)
+			}
+		}()
+	}
+	go func() {
+		defer wg.Done()
+		s.checkLoop(rctx)
+	}()
+	wg.Wait()
+	cancel()
+	if ctx.Err() != nil {
+		return &s.rp, ctx.Err()
+	}
+
+	s.drain(ctx)
+	s.check(ctx, s.snapshot(0), true)
+	s.checkWatchers(baseline)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	glog.Infof("soak: %d items, %d duplicates, %d violations (ops %v)", s.rp.Items, s.rp.Duplicates, len(s.rp.Violations), s.rp.Ops)
+	return &s.rp, nil
+}
+
+func (s *soak) violate(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	glog.Warningf("soak: violation: %s", msg)
+	s.mu.Lock()
+	if len(s.rp.Violations) < MaxViolations {
+		s.rp.Violations = append(s.rp.Violations, msg)
+	}
+	s.mu.Unlock()
+}
+
+// step runs one random operation.
+func (s *soak) step(ctx context.Context) {
+	s.mu.Lock()
+	n, key := s.rnd.Intn(100), ""
+	if len(s.keys) > 0 {
+		key = s.keys[s.rnd.Intn(len(s.keys))]
+	}
+	delay := time.Duration(s.rnd.Intn(50)) * time.Millisecond
+	s.mu.Unlock()
+
+	switch {
+	case n < 35 || key == "":
+		s.enqueue(ctx)
+	case n < 70:
+		s.claim(ctx)
+	case n < 85:
+		s.cancel(key)
+	case n < 95:
+		s.watch(ctx, "WatchItem", delay, func(wctx context.Context) <-chan struct{} { return drainItems(s.qu.WatchItem(wctx, key)) })
+	default:
+		s.watch(ctx, "Watch", delay, func(wctx context.Context) <-chan struct{} { return drainEvents(s.qu.Watch(wctx, s.cfg.Bucket)) })
+	}
+}
+
+func (s *soak) count(op string) {
+	s.mu.Lock()
+	s.rp.Ops[op]++
+	s.mu.Unlock()
+}
+
+// enqueue adds an item, expected before the Add, since it may be popped
+// before Add returns.
+func (s *soak) enqueue(ctx context.Context) {
+	item := etcdqueue.CreateItem(s.cfg.Bucket, 100, "soak")
+	s.mu.Lock()
+	s.states[item.Key] = &state{}
+	s.mu.Unlock()
+	if err := s.qu.Add(ctx, item); err != nil {
+		if ctx.Err() == nil {
+			s.violate("Add %q failed (%v)", item.Key, err)
+		}
+		return
+	}
+	s.mu.Lock()
+	s.keys = append(s.keys, item.Key)
+	s.rp.Items++
+	s.rp.Ops["enqueue"]++
+	s.mu.Unlock()
+}
+
+// claim pops an item, and completes it.
+func (s *soak) claim(ctx context.Context) {
+	pctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	item := <-s.qu.Pop(pctx, s.cfg.Bucket)
+	cancel()
+	if item == nil || item.Err() != nil {
+		return
+	}
+	s.count("claim")
+	s.complete(item)
+}
+
+// complete completes the item, even after the run is done, so that the
+// expected state is never ambiguous.
+func (s *soak) complete(item *etcdqueue.Item) {
+	item.Progress = etcdqueue.MaxProgress
+	err := s.qu.Complete(context.Background(), item)
+
+	s.mu.Lock()
+	st, violation := s.states[item.Key], ""
+	switch {
+	case st == nil:
+		violation = fmt.Sprintf("popped unknown item %q", item.Key)
+	case err == etcdqueue.ErrAlreadyCompleted:
+		s.rp.Duplicates++
+	case err != nil:
+		violation = fmt.Sprintf("Complete %q failed (%v)", item.Key, err)
+	default:
+		st.completed++
+		s.rp.Ops["complete"]++
+		if st.completed > 1 || st.canceled {
+			violation = fmt.Sprintf("%q completed %d times (canceled %v)", item.Key, st.completed, st.canceled)
+		}
+	}
+	s.mu.Unlock()
+	if violation != "" {
+		s.violate("%s", violation)
+	}
+}
+
+func (s *soak) cancel(key string) {
+	_, err := s.qu.Cancel(context.Background(), key)
+	switch err {
+	case nil:
+		s.mu.Lock()
+		st := s.states[key]
+		st.canceled = true
+		s.rp.Ops["cancel"]++
+		completed := st.completed
+		s.mu.Unlock()
+		if completed > 0 {
+			s.violate("%q canceled after completed", key)
+		}
+	case etcdqueue.ErrItemNotFound, etcdqueue.ErrAlreadyCompleted, etcdqueue.ErrCanceled:
+		// raced with a claim, or canceled twice
+	default:
+		s.violate("Cancel %q failed (%v)", key, err)
+	}
+}
+
+// watch starts a watcher, cancels it after the delay, and expects it to
+// be closed within 'WatchTimeout'. The watcher is started by f, which
+// returns the channel closed after the watcher is drained and closed.
+func (s *soak) watch(ctx context.Context, kind string, delay time.Duration, f func(context.Context) <-chan struct{}) {
+	s.count("watch")
+	wctx, cancel := context.WithCancel(ctx)
+	closed := f(wctx)
+	time.AfterFunc(delay, cancel)
+	select {
+	case <-closed:
+	case <-time.After(delay + s.cfg.WatchTimeout):
+		s.violate("%s watcher not closed %v after its context was canceled", kind, s.cfg.WatchTimeout)
+	}
+}
+
+// drainItems returns the channel closed after the watcher is closed.
+func drainItems(w etcdqueue.ItemWatcher) <-chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		for range w {
+		}
+		close(closed)
+	}()
+	return closed
+}
+
+// drainEvents is drainItems for event watchers.
+func drainEvents(w etcdqueue.EventWatcher) <-chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		for range w {
+		}
+		close(closed)
+	}()
+	return closed
+}
+
+// snapshot returns the expected states of up to n random items, or of
+// all items if n is zero.
+func (s *soak) snapshot(n int) map[string]state {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.keys
+	if n > 0 && len(keys) > n {
+		keys = make([]string, n)
+		for i := range keys {
+			keys[i] = s.keys[s.rnd.Intn(len(s.keys))]
+		}
+	}
+	states := make(map[string]state, len(keys))
+	for _, key := range keys {
+		states[key] = *s.states[key]
+	}
+	return states
+}
+
+func (s *soak) checkLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.check(ctx, s.snapshot(64), false)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check gets the items, and compares their statuses with the states
+// expected before the reads. If final, all items must be terminal.
+func (s *soak) check(ctx context.Context, states map[string]state, final bool) {
+	for key, st := range states {
+		ent, err := s.qu.Get(ctx, key)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if err == etcdqueue.ErrItemNotFound {
+				s.violate("%q lost", key)
+			} else {
+				s.violate("Get %q failed (%v)", key, err)
+			}
+			continue
+		}
+		switch {
+		case st.canceled && ent.Status != etcdqueue.StatusCanceled:
+			s.violate("%q canceled, but found %s", key, ent.Status)
+		case st.completed > 0 && ent.Status != etcdqueue.StatusCompleted:
+			s.violate("%q completed, but found %s", key, ent.Status)
+		case final && !ent.Status.Terminal():
+			s.violate("%q not drained (found %s)", key, ent.Status)
+		}
+	}
+}
+
+// drain completes the remaining items, until none is popped for a second.
+func (s *soak) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		pctx, cancel := context.WithTimeout(ctx, time.Second)
+		item := <-s.qu.Pop(pctx, s.cfg.Bucket)
+		cancel()
+		if item == nil || item.Err() != nil {
+			return
+		}
+		s.count("drain")
+		s.complete(item)
+	}
+}
+
+// checkWatchers expects watch goroutines to exit, once all watchers have
+// been closed.
+func (s *soak) checkWatchers(baseline int64) {
+	deadline := time.Now().Add(s.cfg.WatchTimeout)
+	for {
+		n := s.qu.Watchers().Goroutines
+		if n <= baseline {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.violate("%d watch goroutines leaked", n-baseline)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
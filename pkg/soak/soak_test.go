@@ -0,0 +1,48 @@
+package soak
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+// soakDuration runs the soak test longer (e.g. '-soak=4h'), with
+// '-timeout' set accordingly.
+var soakDuration = flag.Duration("soak", 3*time.Second, "Duration of TestSoak.")
+
+func TestSoak(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := etcdqueue.NewEmbeddedQueue(context.Background(), 39379, 39380, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	rp, err := Run(context.Background(), qu, Config{
+		Bucket:        "soak",
+		Duration:      *soakDuration,
+		Actors:        8,
+		CheckInterval: 200 * time.Millisecond,
+		Seed:          time.Now().UnixNano(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%d items, %d duplicates, ops %v", rp.Items, rp.Duplicates, rp.Ops)
+	if rp.Items == 0 || rp.Ops["complete"] == 0 || rp.Ops["watch"] == 0 {
+		t.Fatalf("expected operations, got %+v", rp)
+	}
+	for _, v := range rp.Violations {
+		t.Error(v)
+	}
+}
@@ -0,0 +1,4 @@
+// Package tlsutil loads TLS certificates for mutual TLS between the
+// backend, the queue, and workers, reloading them when the files are
+// rotated (e.g. Kubernetes secret updates).
+package tlsutil
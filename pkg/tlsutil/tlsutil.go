@@ -0,0 +1,192 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Config defines the certificate files.
+type Config struct {
+	// CertFile and KeyFile are the PEM-encoded certificate and key,
+	// presented to peers.
+	CertFile string
+	KeyFile  string
+
+	// CAFile is the PEM-encoded bundle of certificate authorities, to
+	// verify peers. Servers require client certificates signed by the
+	// CA if not empty. Clients use the system roots if empty.
+	CAFile string
+}
+
+// Empty returns true if no file is configured.
+func (cfg Config) Empty() bool {
+	return cfg.CertFile == "" && cfg.KeyFile == "" && cfg.CAFile == ""
+}
+
+// Reloader holds the certificates of the files, reloaded by Run when
+// the files are modified. Connections established before a reload
+// keep their certificates.
+type Reloader struct {
+	cfg Config
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+// NewReloader loads the certificates of the files.
+func NewReloader(cfg Config) (*Reloader, error) {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("both cert and key files are required (got %+v)", cfg)
+	}
+	r := &Reloader{cfg: cfg}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Run reloads the certificates every interval if any file is modified,
+// until the context is done. Failed reloads (e.g. partially written
+// files) are logged, keeping the previous certificates.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := r.reload()
+		if err != nil {
+			glog.Warningf("failed to reload certificates %+v (%v)", r.cfg, err)
+			continue
+		}
+		if reloaded {
+			glog.Infof("reloaded certificates %+v", r.cfg)
+		}
+	}
+}
+
+// reload loads the files if modified since the last load.
+func (r *Reloader) reload() (bool, error) {
+	var modTime time.Time
+	for _, fpath := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.CAFile} {
+		if fpath == "" {
+			continue
+		}
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			return false, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	r.mu.RLock()
+	loaded := r.modTime
+	r.mu.RUnlock()
+	if !loaded.IsZero() && !modTime.After(loaded) {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if r.cfg.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if r.cfg.CAFile != "" {
+		data, err := ioutil.ReadFile(r.cfg.CAFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return false, fmt.Errorf("no certificate in %q", r.cfg.CAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.pool, r.modTime = cert, pool, modTime
+	r.mu.Unlock()
+	return true, nil
+}
+
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, r.pool
+}
+
+// ServerConfig returns the server TLS configuration of the current
+// certificates. Clients must present certificates signed by the CA,
+// if configured.
+func (r *Reloader) ServerConfig() (*tls.Config, error) {
+	if r.cfg.CertFile == "" {
+		return nil, fmt.Errorf("no server certificate (got %+v)", r.cfg)
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}, nil
+}
+
+// ClientConfig returns the client TLS configuration of the current
+// certificates. Server certificates are verified against the current
+// CA, or the system roots if not configured.
+func (r *Reloader) ClientConfig() *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if r.cfg.CertFile != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		}
+	}
+	if r.cfg.CAFile != "" {
+		// roots are rotated with the CA file, so that the verification
+		// is done with the current pool, instead of 'RootCAs'
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("no server certificate")
+			}
+			_, pool := r.current()
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         pool,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,175 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloaderMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := newCert(t, nil, nil, "ca")
+	writePEM(t, filepath.Join(dir, "ca.pem"), ca, nil)
+	srvCert, srvKey := newCert(t, ca, caKey, "server")
+	writePEM(t, filepath.Join(dir, "server.pem"), srvCert, srvKey)
+	cliCert, cliKey := newCert(t, ca, caKey, "client-1")
+	writePEM(t, filepath.Join(dir, "client.pem"), cliCert, cliKey)
+
+	srvReloader, err := NewReloader(Config{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvCfg, err := srvReloader.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = srvCfg
+	ts.StartTLS()
+	defer ts.Close()
+
+	cliReloader, err := NewReloader(Config{
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := get(t, ts.URL, cliReloader.ClientConfig()); cn != "client-1" {
+		t.Fatalf("expected client-1, got %q", cn)
+	}
+
+	// clients without certificates are rejected
+	noCert, err := NewReloader(Config{CAFile: filepath.Join(dir, "ca.pem")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := &http.Client{Transport: &http.Transport{TLSClientConfig: noCert.ClientConfig()}}
+	if _, err = cli.Get(ts.URL); err == nil {
+		t.Fatal("expected error without client certificate")
+	}
+
+	// rotated certificates are used by new connections
+	cliCert, cliKey = newCert(t, ca, caKey, "client-2")
+	writePEM(t, filepath.Join(dir, "client.pem"), cliCert, cliKey)
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(filepath.Join(dir, "client.pem"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := cliReloader.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded {
+		t.Fatal("expected reload of modified files")
+	}
+	if cn := get(t, ts.URL, cliReloader.ClientConfig()); cn != "client-2" {
+		t.Fatalf("expected client-2, got %q", cn)
+	}
+	if reloaded, err = cliReloader.reload(); err != nil || reloaded {
+		t.Fatalf("expected no reload of unmodified files, got %v (%v)", reloaded, err)
+	}
+
+	// servers signed by other authorities are rejected
+	other, _ := newCert(t, nil, nil, "other-ca")
+	writePEM(t, filepath.Join(dir, "other-ca.pem"), other, nil)
+	otherReloader, err := NewReloader(Config{
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client.pem"),
+		CAFile:   filepath.Join(dir, "other-ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli = &http.Client{Transport: &http.Transport{TLSClientConfig: otherReloader.ClientConfig()}}
+	if _, err = cli.Get(ts.URL); err == nil {
+		t.Fatal("expected error with unknown server authority")
+	}
+}
+
+func get(t *testing.T, u string, cfg *tls.Config) string {
+	cli := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	resp, err := cli.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// newCert creates a certificate signed by the parent, or a self-signed
+// CA if the parent is <nil>.
+func newCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, cn string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writePEM writes the certificate, and the key if not <nil>.
+func writePEM(t *testing.T, fpath string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if key != nil {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...)
+	}
+	if err := ioutil.WriteFile(fpath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,6 +2,7 @@
 package urlutil
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -52,3 +53,18 @@ func Get(ep string) ([]byte, error) {
 
 	return data, nil
 }
+
+// Copy downloads the URL contents to the writer, without reading the
+// whole contents in memory. It returns the number of bytes written.
+func Copy(w io.Writer, ep string) (int64, error) {
+	resp, err := http.Get(ep)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return 0, fmt.Errorf("%q returned %s", ep, resp.Status)
+	}
+	return io.Copy(w, resp.Body)
+}
@@ -0,0 +1,4 @@
+// Package workflow runs workflows of dependent queue items (DAG). A
+// workflow spec is submitted once, and the engine enqueues each step when
+// all its dependencies complete, persisting workflow state in etcd.
+package workflow
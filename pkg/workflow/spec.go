@@ -0,0 +1,122 @@
+package workflow
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Step is a step of a workflow, enqueued as an item once all its
+// dependencies succeed.
+type Step struct {
+	// Name identifies the step in the workflow.
+	Name string `json:"name"`
+
+	// Bucket is the queue bucket to enqueue the step item to.
+	Bucket string `json:"bucket"`
+
+	// Weight is the weight of the step item. Defaults to 100.
+	Weight uint64 `json:"weight,omitempty"`
+
+	// Payload is the text/template of the item value, executed with the
+	// workflow ID, its parameters, and the results of dependencies
+	// (e.g. '{"model": "{{.Params.model}}", "ckpt": "{{(index .Steps "train").Result}}"}').
+	Payload string `json:"payload"`
+
+	// DependsOn are the names of steps that must succeed first.
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+// Spec defines a workflow.
+type Spec struct {
+	// Name is the name of the workflow, prefixed to its IDs.
+	Name  string `json:"name"`
+	Steps []Step `json:"steps"`
+}
+
+// Validate returns an error if the spec has unknown or cyclic
+// dependencies, or invalid templates.
+func (s Spec) Validate() error {
+	if s.Name == "" || strings.Contains(s.Name, "/") {
+		return fmt.Errorf("invalid workflow name %q", s.Name)
+	}
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("workflow %q has no step", s.Name)
+	}
+	steps := make(map[string]Step, len(s.Steps))
+	for _, st := range s.Steps {
+		if st.Name == "" || st.Bucket == "" {
+			return fmt.Errorf("step %+v has empty name or bucket", st)
+		}
+		if _, ok := steps[st.Name]; ok {
+			return fmt.Errorf("duplicate step %q", st.Name)
+		}
+		if _, err := template.New(st.Name).Option("missingkey=error").Parse(st.Payload); err != nil {
+			return fmt.Errorf("step %q has invalid payload (%v)", st.Name, err)
+		}
+		steps[st.Name] = st
+	}
+	for _, st := range s.Steps {
+		for _, dep := range st.DependsOn {
+			if _, ok := steps[dep]; !ok {
+				return fmt.Errorf("step %q depends on unknown step %q", st.Name, dep)
+			}
+		}
+	}
+
+	// depth-first search for cycles
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[string]int, len(steps))
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visiting:
+			return fmt.Errorf("step %q is in a dependency cycle", name)
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		for _, dep := range steps[name].DependsOn {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+		return nil
+	}
+	names := make([]string, 0, len(steps))
+	for name := range steps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateData is the data of payload templates.
+type templateData struct {
+	WorkflowID string
+	Params     map[string]string
+	Steps      map[string]*StepState
+}
+
+func (st Step) render(data templateData) (string, error) {
+	tmpl, err := template.New(st.Name).Option("missingkey=error").Parse(st.Payload)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("step %q failed to render payload (%v)", st.Name, err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,355 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+)
+
+// Status is the status of a workflow or step.
+type Status string
+
+const (
+	// StatusWaiting is the status of steps waiting for dependencies.
+	StatusWaiting Status = "waiting"
+	// StatusEnqueued is the status of steps whose items are in the queue.
+	StatusEnqueued Status = "enqueued"
+	// StatusRunning is the status of workflows with unfinished steps.
+	StatusRunning Status = "running"
+	// StatusSucceeded is the status of completed steps, and of workflows
+	// whose steps all succeeded.
+	StatusSucceeded Status = "succeeded"
+	// StatusFailed is the status of failed, canceled, or expired steps,
+	// and of their workflows. Steps depending on failed steps are not run.
+	StatusFailed Status = "failed"
+)
+
+// StepState is the state of a workflow step.
+type StepState struct {
+	Status Status `json:"status"`
+
+	// ItemKey is the key of the enqueued item.
+	ItemKey string `json:"item_key,omitempty"`
+
+	// Result is the value of the completed item.
+	Result string `json:"result,omitempty"`
+
+	// Error is the error of the failed item.
+	Error string `json:"error,omitempty"`
+}
+
+// Workflow is the state of a submitted workflow.
+type Workflow struct {
+	ID        string                `json:"id"`
+	Spec      Spec                  `json:"spec"`
+	Params    map[string]string     `json:"params,omitempty"`
+	Status    Status                `json:"status"`
+	Steps     map[string]*StepState `json:"steps"`
+	CreatedAt time.Time             `json:"created_at"`
+	UpdatedAt time.Time             `json:"updated_at"`
+}
+
+// ErrNotFound is returned when the workflow does not exist.
+var ErrNotFound = errors.New("workflow: not found")
+
+const pfxWorkflow = "_workflow"
+
+func workflowKey(id string) string {
+	return path.Join(pfxWorkflow, id)
+}
+
+// Engine enqueues workflow steps as their dependencies complete.
+// Multiple engines may run on the same queue; state updates are
+// serialized by etcd revisions, and step items are enqueued with
+// idempotency keys, so that retried updates do not enqueue twice.
+type Engine struct {
+	qu etcdqueue.Queue
+}
+
+// New returns a new workflow engine.
+func New(qu etcdqueue.Queue) *Engine {
+	return &Engine{qu: qu}
+}
+
+// Submit validates the spec, persists the workflow, and enqueues its
+// steps without dependencies.
+func (e *Engine) Submit(ctx context.Context, spec Spec, params map[string]string) (*Workflow, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	wf := &Workflow{
+		ID:        fmt.Sprintf("%s-%d", spec.Name, now.UnixNano()),
+		Spec:      spec,
+		Params:    params,
+		Status:    StatusRunning,
+		Steps:     make(map[string]*StepState, len(spec.Steps)),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	for _, st := range spec.Steps {
+		wf.Steps[st.Name] = &StepState{Status: StatusWaiting}
+	}
+	data, err := json.Marshal(wf)
+	if err != nil {
+		return nil, err
+	}
+	key := workflowKey(wf.ID)
+	resp, err := e.qu.Client().Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(data))).
+		Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, fmt.Errorf("workflow %q already exists", wf.ID)
+	}
+	glog.Infof("workflow: submitted %q with %d steps", wf.ID, len(spec.Steps))
+	return e.Advance(ctx, wf.ID)
+}
+
+// Get returns the workflow of the ID, or ErrNotFound.
+func (e *Engine) Get(ctx context.Context, id string) (*Workflow, error) {
+	wf, _, err := e.get(ctx, id)
+	return wf, err
+}
+
+func (e *Engine) get(ctx context.Context, id string) (*Workflow, int64, error) {
+	resp, err := e.qu.Client().Get(ctx, workflowKey(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, ErrNotFound
+	}
+	var wf Workflow
+	if err = json.Unmarshal(resp.Kvs[0].Value, &wf); err != nil {
+		return nil, 0, fmt.Errorf("%q returned wrong JSON %q (%v)", string(resp.Kvs[0].Key), string(resp.Kvs[0].Value), err)
+	}
+	return &wf, resp.Kvs[0].ModRevision, nil
+}
+
+// List returns all workflows, sorted by ID.
+func (e *Engine) List(ctx context.Context) ([]*Workflow, error) {
+	resp, err := e.qu.Client().Get(ctx, pfxWorkflow+"/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	wfs := make([]*Workflow, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var wf Workflow
+		if err = json.Unmarshal(kv.Value, &wf); err != nil {
+			return nil, fmt.Errorf("%q returned wrong JSON %q (%v)", string(kv.Key), string(kv.Value), err)
+		}
+		wfs = append(wfs, &wf)
+	}
+	return wfs, nil
+}
+
+// Delete deletes the workflow state. Enqueued step items are not canceled.
+func (e *Engine) Delete(ctx context.Context, id string) error {
+	resp, err := e.qu.Client().Delete(ctx, workflowKey(id))
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Advance updates the steps of the workflow from their items, and
+// enqueues the steps whose dependencies have all succeeded.
+func (e *Engine) Advance(ctx context.Context, id string) (*Workflow, error) {
+	for {
+		wf, rev, err := e.get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if wf.Status != StatusRunning {
+			return wf, nil
+		}
+		changed, err := e.advance(ctx, wf)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			return wf, nil
+		}
+
+		wf.UpdatedAt = time.Now().UTC()
+		data, err := json.Marshal(wf)
+		if err != nil {
+			return nil, err
+		}
+		key := workflowKey(id)
+		resp, err := e.qu.Client().Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+			Then(clientv3.OpPut(key, string(data))).
+			Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			if wf.Status != StatusRunning {
+				glog.Infof("workflow: %q %s", id, wf.Status)
+			}
+			return wf, nil
+		}
+		// updated by another engine, retry with its state
+	}
+}
+
+// advance moves the workflow state, and returns true if changed.
+func (e *Engine) advance(ctx context.Context, wf *Workflow) (bool, error) {
+	changed := false
+	for _, st := range wf.Spec.Steps {
+		state := wf.Steps[st.Name]
+		if state.Status != StatusEnqueued {
+			continue
+		}
+		ent, err := e.qu.Get(ctx, state.ItemKey)
+		switch {
+		case err == etcdqueue.ErrItemNotFound:
+			state.Status, state.Error = StatusFailed, fmt.Sprintf("item %q not found", state.ItemKey)
+		case err != nil:
+			return changed, err
+		case ent.Status == etcdqueue.StatusCompleted:
+			state.Status, state.Result = StatusSucceeded, ent.Item.Value
+		case ent.Status.Terminal():
+			state.Status, state.Error = StatusFailed, fmt.Sprintf("item %s (%s)", ent.Status, ent.Item.Error)
+		default:
+			continue
+		}
+		changed = true
+	}
+
+	succeeded, failed := 0, 0
+	for _, st := range wf.Spec.Steps {
+		state := wf.Steps[st.Name]
+		switch state.Status {
+		case StatusSucceeded:
+			succeeded++
+			continue
+		case StatusFailed:
+			failed++
+			continue
+		case StatusEnqueued:
+			continue
+		}
+		ready := true
+		for _, dep := range st.DependsOn {
+			if wf.Steps[dep].Status != StatusSucceeded {
+				ready = false
+				break
+			}
+		}
+		if !ready {
+			continue
+		}
+		item, err := e.stepItem(ctx, wf, st)
+		if err != nil {
+			glog.Warningf("workflow: failed to create %q of %q (%v)", st.Name, wf.ID, err)
+			state.Status, state.Error = StatusFailed, err.Error()
+			failed++
+			changed = true
+			continue
+		}
+		// retried on the next advance, attaching to items already
+		// enqueued by this advance with their idempotency keys
+		if err = e.qu.Add(ctx, item); err != nil {
+			return changed, err
+		}
+		state.Status, state.ItemKey = StatusEnqueued, item.Key
+		changed = true
+	}
+
+	switch {
+	case failed > 0 && !e.inFlight(wf):
+		wf.Status = StatusFailed
+		changed = true
+	case succeeded == len(wf.Spec.Steps):
+		wf.Status = StatusSucceeded
+		changed = true
+	}
+	return changed, nil
+}
+
+// inFlight returns true if any step item is still in the queue.
+func (e *Engine) inFlight(wf *Workflow) bool {
+	for _, state := range wf.Steps {
+		if state.Status == StatusEnqueued {
+			return true
+		}
+	}
+	return false
+}
+
+// stepItem returns the item of the step, labeled with the workflow,
+// and linked to the item of its first dependency (see 'Queue.Lineage').
+// It returns an error only if the payload fails to render.
+func (e *Engine) stepItem(ctx context.Context, wf *Workflow, st Step) (*etcdqueue.Item, error) {
+	value, err := st.render(templateData{WorkflowID: wf.ID, Params: wf.Params, Steps: wf.Steps})
+	if err != nil {
+		return nil, err
+	}
+	weight := st.Weight
+	if weight == 0 {
+		weight = 100
+	}
+	item := etcdqueue.CreateItem(st.Bucket, weight, value)
+	item.Labels = map[string]string{"workflow": wf.ID, "step": st.Name}
+	item.IdempotencyKey = path.Join(wf.ID, st.Name)
+
+	deps := append([]string(nil), st.DependsOn...)
+	sort.Strings(deps)
+	if len(deps) > 0 {
+		// completed items may have been deleted (e.g. archived)
+		parent := wf.Steps[deps[0]].ItemKey
+		if _, err = e.qu.Get(ctx, parent); err == nil {
+			item.ParentKey = parent
+		}
+	}
+	return item, nil
+}
+
+// Run advances all running workflows every interval, until the
+// context is canceled.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) error {
+	for {
+		wfs, err := e.List(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			glog.Warningf("workflow: failed to list workflows (%v)", err)
+		}
+		for _, wf := range wfs {
+			if wf.Status != StatusRunning {
+				continue
+			}
+			if _, err = e.Advance(ctx, wf.ID); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				glog.Warningf("workflow: failed to advance %q (%v)", wf.ID, err)
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
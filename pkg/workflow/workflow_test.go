@@ -0,0 +1,146 @@
+package workflow
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+)
+
+func TestSpecValidate(t *testing.T) {
+	tests := []struct {
+		spec Spec
+		ok   bool
+	}{
+		{Spec{Name: "wf", Steps: []Step{{Name: "a", Bucket: "b"}}}, true},
+		{Spec{Name: "wf"}, false},
+		{Spec{Name: "w/f", Steps: []Step{{Name: "a", Bucket: "b"}}}, false},
+		{Spec{Name: "wf", Steps: []Step{{Name: "a", Bucket: "b"}, {Name: "a", Bucket: "b"}}}, false},
+		{Spec{Name: "wf", Steps: []Step{{Name: "a", Bucket: "b", DependsOn: []string{"c"}}}}, false},
+		{Spec{Name: "wf", Steps: []Step{{Name: "a", Bucket: "b", Payload: "{{.Params"}}}, false},
+		{Spec{Name: "wf", Steps: []Step{
+			{Name: "a", Bucket: "b", DependsOn: []string{"c"}},
+			{Name: "b", Bucket: "b", DependsOn: []string{"a"}},
+			{Name: "c", Bucket: "b", DependsOn: []string{"b"}},
+		}}, false},
+	}
+	for i, tt := range tests {
+		if err := tt.spec.Validate(); (err == nil) != tt.ok {
+			t.Fatalf("#%d: expected ok %v, got %v", i, tt.ok, err)
+		}
+	}
+}
+
+// complete pops the item of the bucket, and completes it with the value
+// or error.
+func complete(t *testing.T, qu etcdqueue.Queue, bucket, value, errMsg string) *etcdqueue.Item {
+	item := <-qu.Pop(context.Background(), bucket)
+	if item.Err() != nil {
+		t.Fatal(item.Err())
+	}
+	item.Value, item.Error, item.Progress = value, errMsg, etcdqueue.MaxProgress
+	if err := qu.Complete(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+func TestEngine(t *testing.T) {
+	dataDir, err := ioutil.TempDir(os.TempDir(), "etcd-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	qu, err := etcdqueue.NewEmbeddedQueue(context.Background(), 37379, 37380, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qu.Stop()
+
+	ctx := context.Background()
+	e := New(qu)
+	spec := Spec{Name: "pipeline", Steps: []Step{
+		{Name: "train", Bucket: "train", Payload: "{{.Params.model}}"},
+		{Name: "eval-top1", Bucket: "eval", Payload: `top1 {{(index .Steps "train").Result}}`, DependsOn: []string{"train"}},
+		{Name: "eval-top5", Bucket: "eval", Payload: `top5 {{(index .Steps "train").Result}}`, DependsOn: []string{"train"}},
+		{Name: "report", Bucket: "report", Payload: "{{.WorkflowID}}", DependsOn: []string{"eval-top1", "eval-top5"}},
+	}}
+	wf, err := e.Submit(ctx, spec, map[string]string{"model": "resnet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wf.Status != StatusRunning || wf.Steps["train"].Status != StatusEnqueued || wf.Steps["report"].Status != StatusWaiting {
+		t.Fatalf("unexpected workflow %+v", wf)
+	}
+
+	// advancing without progress does not enqueue twice
+	if wf, err = e.Advance(ctx, wf.ID); err != nil {
+		t.Fatal(err)
+	}
+	train := complete(t, qu, "train", "ckpt-1", "")
+	if train.Key != wf.Steps["train"].ItemKey {
+		t.Fatalf("expected %q, got %q", wf.Steps["train"].ItemKey, train.Key)
+	}
+	if items, err := qu.List(ctx, "train"); err != nil || len(items) != 0 {
+		t.Fatalf("expected no duplicate step item, got %+v (%v)", items, err)
+	}
+
+	if wf, err = e.Advance(ctx, wf.ID); err != nil {
+		t.Fatal(err)
+	}
+	if wf.Steps["train"].Result != "ckpt-1" || wf.Steps["eval-top1"].Status != StatusEnqueued || wf.Steps["eval-top5"].Status != StatusEnqueued {
+		t.Fatalf("unexpected workflow %+v", wf)
+	}
+	eval1 := complete(t, qu, "eval", "0.7", "")
+	complete(t, qu, "eval", "0.9", "")
+	if eval1.Value != "0.7" || eval1.ParentKey != train.Key || eval1.Labels["workflow"] != wf.ID {
+		t.Fatalf("unexpected step item %+v", eval1)
+	}
+
+	if wf, err = e.Advance(ctx, wf.ID); err != nil {
+		t.Fatal(err)
+	}
+	report := complete(t, qu, "report", "done", "")
+	if wf, err = e.Advance(ctx, wf.ID); err != nil {
+		t.Fatal(err)
+	}
+	if wf.Status != StatusSucceeded || wf.Steps["report"].ItemKey != report.Key {
+		t.Fatalf("unexpected workflow %+v", wf)
+	}
+	root, err := qu.Lineage(ctx, report.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Item.Key != train.Key || len(root.Children) != 2 {
+		t.Fatalf("unexpected lineage %+v", root)
+	}
+
+	// failed steps fail the workflow, without running dependent steps
+	if wf, err = e.Submit(ctx, spec, map[string]string{"model": "vgg"}); err != nil {
+		t.Fatal(err)
+	}
+	complete(t, qu, "train", "", "GPU OOM")
+	if wf, err = e.Advance(ctx, wf.ID); err != nil {
+		t.Fatal(err)
+	}
+	if wf.Status != StatusFailed || wf.Steps["train"].Status != StatusFailed || wf.Steps["eval-top1"].Status != StatusWaiting {
+		t.Fatalf("unexpected workflow %+v", wf)
+	}
+
+	wfs, err := e.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wfs) != 2 {
+		t.Fatalf("expected 2 workflows, got %d", len(wfs))
+	}
+	if err = e.Delete(ctx, wf.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = e.Get(ctx, wf.ID); err != ErrNotFound {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+}
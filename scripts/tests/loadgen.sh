@@ -0,0 +1,23 @@
+#!/usr/bin/env bash
+set -e
+
+if ! [[ "$0" =~ "./scripts/tests/loadgen.sh" ]]; then
+  echo "must be run from repository root"
+  exit 255
+fi
+
+PATTERN=${PATTERN:-steady}
+DURATION=${DURATION:-1m}
+
+echo "Running loadgen with pattern" ${PATTERN} "for" ${DURATION}
+go install -v ./cmd/loadgen
+loadgen \
+  -pattern ${PATTERN} \
+  -duration ${DURATION} \
+  -size-dist lognormal \
+  -json \
+  "$@"
+
+<<COMMENT
+PATTERN=burst DURATION=5m ./scripts/tests/loadgen.sh -rate 20 -peak 200 -period 1m -burst-for 10s
+COMMENT
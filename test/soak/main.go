@@ -0,0 +1,177 @@
+// soak runs producers and consumers against the queue for a duration,
+// and reports ops/sec and latency percentiles of each operation, to
+// evaluate queue redesigns quantitatively.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	etcdqueue "github.com/gyuho/dplearn/pkg/etcd-queue"
+
+	"github.com/golang/glog"
+)
+
+func main() {
+	endpoints := flag.String("endpoints", "", "Comma-separated external etcd endpoints. Empty to start an embedded etcd.")
+	portClient := flag.Int("embedded-port-client", 42379, "Client port of the embedded etcd.")
+	portPeer := flag.Int("embedded-port-peer", 42380, "Peer port of the embedded etcd.")
+	duration := flag.Duration("duration", time.Minute, "Duration of the soak test.")
+	producers := flag.Int("producers", 8, "Number of concurrent producers.")
+	consumers := flag.Int("consumers", 8, "Number of concurrent consumers.")
+	valueSize := flag.Int("value-size", 256, "Size of item values in bytes.")
+	bucket := flag.String("bucket", "soak-bucket", "Bucket to enqueue items to.")
+	coalesce := flag.Duration("coalesce-window", etcdqueue.AddCoalesceWindow, "Latency budget to coalesce concurrent enqueues (0 to disable).")
+	flag.Parse()
+
+	etcdqueue.AddCoalesceWindow = *coalesce
+
+	var qu etcdqueue.Queue
+	var err error
+	if *endpoints == "" {
+		dataDir, err := ioutil.TempDir(os.TempDir(), "soak")
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer os.RemoveAll(dataDir)
+		qu, err = etcdqueue.NewEmbeddedQueue(context.Background(), *portClient, *portPeer, dataDir)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	} else {
+		qu, err = etcdqueue.NewClientQueue(etcdqueue.ClientConfig{
+			Endpoints:   strings.Split(*endpoints, ","),
+			DialTimeout: 5 * time.Second,
+		})
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+	defer qu.Stop()
+
+	if _, err = qu.Purge(context.Background(), *bucket); err != nil {
+		glog.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	rec := newRecorder()
+	value := strings.Repeat("x", *valueSize)
+	var wg sync.WaitGroup
+	for i := 0; i < *producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				start := time.Now()
+				err := qu.Add(ctx, etcdqueue.CreateItem(*bucket, 100, value))
+				rec.observe("enqueue", start, err)
+
+				start = time.Now()
+				_, err = qu.Front(ctx, *bucket)
+				rec.observe("front", start, err)
+			}
+		}()
+	}
+	for i := 0; i < *consumers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				start := time.Now()
+				item := <-qu.Pop(ctx, *bucket)
+				if item.Error != "" {
+					if ctx.Err() == nil {
+						rec.observe("pop", start, fmt.Errorf("%s", item.Error))
+					}
+					continue
+				}
+				rec.observe("pop", start, nil)
+
+				item.Progress = etcdqueue.MaxProgress
+				start = time.Now()
+				rec.observe("complete", start, qu.Complete(ctx, item))
+			}
+		}()
+	}
+
+	started := time.Now()
+	wg.Wait()
+	rec.report(os.Stdout, time.Since(started))
+}
+
+// recorder records latencies and errors per operation.
+type recorder struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{latencies: make(map[string][]time.Duration), errors: make(map[string]int)}
+}
+
+func (r *recorder) observe(op string, start time.Time, err error) {
+	took := time.Since(start)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		// operations interrupted by the end of the test are not errors
+		if err != context.DeadlineExceeded && err != context.Canceled {
+			r.errors[op]++
+			glog.V(2).Infof("%s failed (%v)", op, err)
+		}
+		return
+	}
+	r.latencies[op] = append(r.latencies[op], took)
+}
+
+func (r *recorder) report(w io.Writer, took time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ops []string
+	for op := range r.latencies {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	fmt.Fprintf(w, "%-10s %10s %12s %12s %12s %12s %8s\n", "OP", "COUNT", "OPS/SEC", "P50", "P99", "MAX", "ERRORS")
+	for _, op := range ops {
+		ls := r.latencies[op]
+		sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+		fmt.Fprintf(w, "%-10s %10d %12.1f %12v %12v %12v %8d\n",
+			op,
+			len(ls),
+			float64(len(ls))/took.Seconds(),
+			percentile(ls, 0.5),
+			percentile(ls, 0.99),
+			ls[len(ls)-1],
+			r.errors[op],
+		)
+	}
+}
+
+// percentile returns the percentile of sorted latencies.
+func percentile(ls []time.Duration, p float64) time.Duration {
+	if len(ls) == 0 {
+		return 0
+	}
+	idx := int(float64(len(ls))*p+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(ls) {
+		idx = len(ls) - 1
+	}
+	return ls[idx]
+}